@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/datawire/teleproxy/internal/pkg/agentauth"
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+// agentProxy serves, in the teleproxy pods, the SOCKS proxy that
+// developers log into with a token that is in group, and, with rbac,
+// only connect to the namespaces they may intercept through. It only
+// returns if it can't.
+func agentProxy(group string, rbac bool) error {
+	reviewer, err := agentauth.InCluster(group)
+	if err != nil {
+		return err
+	}
+	proxy, err := socks.NewPolicyServer(agentauth.ProxyAddress, net.Dial, agentauth.NewPolicy(reviewer, rbac))
+	if err != nil {
+		return err
+	}
+	proxy.Start()
+	log.Printf("AUT: proxying on %s, rbac=%v", proxy.Addr(), rbac)
+	select {}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/datawire/teleproxy/pkg/client"
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+)
+
+// how long a doctor probe may take
+const probeTimeout = 5 * time.Second
+
+// the sshd of the teleproxy pod, as seen from inside it
+const agentSSH = "127.0.0.1:8022"
+
+// A check is the outcome of one doctor probe.
+type check struct {
+	name   string
+	ok     bool
+	detail string
+	// cluster checks are made from the teleproxy pod's side of the
+	// tunnel
+	cluster bool
+	// code is what to exit with if the check failed, if not
+	// client.ExitOther
+	code int
+}
+
+func (c check) String() string {
+	result := "ok  "
+	if !c.ok {
+		result = "FAIL"
+	}
+	return fmt.Sprintf("%s  %-12s %s", result, c.name, c.detail)
+}
+
+// laptopChecks asks the running teleproxy how it is, and whether its
+// tunnel accepts connections. It returns the address of the tunnel
+// too, which the teleproxy may have moved off the default.
+func laptopChecks(socks string) ([]check, string) {
+	body, err := get("http://teleproxy/api/status")
+	if err != nil {
+		return []check{{name: "teleproxy", detail: fmt.Sprintf("is it running? %v", err)}}, socks
+	}
+	var status interceptor.Status
+	if err := json.Unmarshal(body, &status); err != nil {
+		return []check{{name: "teleproxy", detail: err.Error()}}, socks
+	}
+	result := []check{{name: "teleproxy", ok: status.Healthy, detail: "running"}}
+	if !status.Healthy {
+		var problems []string
+		for command, health := range status.Unhealthy {
+			problems = append(problems, fmt.Sprintf("%s is %s: %s", command, health.Health, health.Error))
+		}
+		sort.Strings(problems)
+		result[0].detail = strings.Join(append(problems, status.Errors...), "; ")
+	}
+	if port, ok := status.Ports["socks"]; ok && socks == client.DefaultSocks {
+		socks = net.JoinHostPort("localhost", strconv.Itoa(port))
+	}
+
+	conn, err := net.DialTimeout("tcp", socks, probeTimeout)
+	if err != nil {
+		result = append(result, check{name: "tunnel", detail: err.Error()})
+	} else {
+		conn.Close()
+		result = append(result, check{name: "tunnel", ok: true, detail: "listening on " + socks})
+	}
+	return result, socks
+}
+
+// clusterChecks probes the network from the teleproxy pod: whether it
+// resolves names with kube-dns, reaches a service ip, and what mtu it
+// has, and how long the tunnel takes to the pod as opposed to beyond
+// it.
+func clusterChecks(kubeinfo *k8s.KubeInfo, socks string) []check {
+	kubectl := func(args string) (string, error) {
+		output, err := tpu.Cmd("sh", "-c", "kubectl "+kubeinfo.GetKubectl(args))
+		return strings.TrimSpace(output), err
+	}
+	exec := func(command string) (string, error) {
+		return kubectl("exec pod/teleproxy -- " + command)
+	}
+
+	if output, err := exec("true"); err != nil {
+		detail := fmt.Sprintf("can't exec in pod/teleproxy: %s", lastLine(output))
+		if err := client.AgentPullError(kubeinfo); err != nil {
+			detail = err.Error()
+		}
+		return []check{{name: "agent", detail: detail, cluster: true, code: client.ExitAgentMissing}}
+	}
+	result := []check{{name: "agent", ok: true, detail: "pod/teleproxy in " + kubeinfo.Namespace, cluster: true}}
+
+	output, err := exec("nslookup kube-dns.kube-system")
+	if err != nil {
+		result = append(result, check{name: "cluster dns", detail: "the pod can't resolve kube-dns.kube-system: " + lastLine(output), cluster: true})
+	} else {
+		result = append(result, check{name: "cluster dns", ok: true, detail: "the pod resolves kube-dns.kube-system", cluster: true})
+	}
+
+	if output, err := exec("cat /sys/class/net/eth0/mtu"); err != nil {
+		result = append(result, check{name: "mtu", detail: lastLine(output), cluster: true})
+	} else {
+		detail := output + " on the pod's eth0"
+		if mtu, _ := strconv.Atoi(output); mtu > 0 && mtu < 1500 {
+			detail += ", less than ethernet's 1500; try -clamp-mss if big transfers stall"
+		}
+		result = append(result, check{name: "mtu", ok: true, detail: detail, cluster: true})
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socks, nil, proxy.Direct)
+	if err != nil {
+		return append(result, check{name: "rtt", detail: err.Error(), cluster: true})
+	}
+	toPod, err := connectTime(dialer, agentSSH)
+	if err != nil {
+		return append(result, check{name: "rtt", detail: "through the tunnel to the pod: " + err.Error()})
+	}
+	result = append(result, check{name: "rtt", ok: true, detail: fmt.Sprintf("%v through the tunnel to the pod", toPod)})
+
+	ip, err := kubectl("get service kubernetes --namespace default -o jsonpath={.spec.clusterIP}")
+	if err != nil || net.ParseIP(ip) == nil {
+		return append(result, check{name: "service", detail: "no kubernetes.default service ip: " + lastLine(ip), cluster: true})
+	}
+	target := net.JoinHostPort(ip, "443")
+	toService, err := connectTime(dialer, target)
+	if err != nil {
+		return append(result, check{name: "service", detail: fmt.Sprintf("the pod can't reach kubernetes.default at %s: %v", target, err), cluster: true})
+	}
+	beyond := toService - toPod
+	if beyond < 0 {
+		beyond = 0
+	}
+	return append(result, check{name: "service", ok: true, detail: fmt.Sprintf("kubernetes.default at %s in %v, %v beyond the pod", target, toService, beyond), cluster: true})
+}
+
+// connectTime returns the median of a few connects to target.
+func connectTime(dialer proxy.Dialer, target string) (time.Duration, error) {
+	var times []time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		conn, err := dialTimeout(dialer, target)
+		if err != nil {
+			return 0, err
+		}
+		times = append(times, time.Since(start))
+		conn.Close()
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2].Round(100 * time.Microsecond), nil
+}
+
+func dialTimeout(dialer proxy.Dialer, target string) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := dialer.Dial("tcp", target)
+		done <- dialed{conn, err}
+	}()
+	select {
+	case d := <-done:
+		return d.conn, d.err
+	case <-time.After(probeTimeout):
+		go func() {
+			if d := <-done; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %v", probeTimeout)
+	}
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
+
+// doctor prints the outcome of each check, and where the trouble is if
+// any failed. It returns the code to exit with, that of the first
+// check to fail.
+func doctor(kubeinfo *k8s.KubeInfo, socks string, cluster bool) int {
+	checks, socks := laptopChecks(socks)
+	if cluster {
+		checks = append(checks, clusterChecks(kubeinfo, socks)...)
+	}
+	laptop, pod := true, true
+	code := 0
+	for _, c := range checks {
+		fmt.Println(c)
+		if !c.ok && code == 0 {
+			code = client.ExitOther
+			if c.code != 0 {
+				code = c.code
+			}
+		}
+		switch {
+		case c.ok:
+		case c.cluster:
+			pod = false
+		default:
+			laptop = false
+		}
+	}
+	switch {
+	case !laptop:
+		fmt.Println("\nthe trouble is on this side of the tunnel")
+	case !pod:
+		fmt.Println("\nthe tunnel works, the trouble is on the cluster's side of it")
+	case !cluster:
+		fmt.Println("\nuse -cluster to also check from the cluster's side of the tunnel")
+	}
+	return code
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// gatherItem produces one file of a bug report bundle. Items are best
+// effort: a failure is recorded in the file rather than aborting the
+// bundle, since a partially working teleproxy is usually why someone
+// is gathering in the first place.
+type gatherItem struct {
+	name    string
+	collect func() (string, error)
+}
+
+func apiItem(name, path string) gatherItem {
+	return gatherItem{name, func() (string, error) {
+		body, err := get("http://teleproxy" + path)
+		return string(body), err
+	}}
+}
+
+func cmdItem(commands ...[]string) func() (string, error) {
+	return func() (string, error) {
+		result := ""
+		for _, command := range commands {
+			output, err := tpu.Cmd(command...)
+			result += fmt.Sprintf("$ %s\n%s\n", strings.Join(command, " "), output)
+			if err != nil {
+				result += fmt.Sprintf("error: %v\n", err)
+			}
+		}
+		return result, nil
+	}
+}
+
+func gatherItems(kubeconfig, context string) []gatherItem {
+	kubectl := func(args ...string) []string {
+		command := []string{"kubectl"}
+		if kubeconfig != "" {
+			command = append(command, "--kubeconfig", kubeconfig)
+		}
+		if context != "" {
+			command = append(command, "--context", context)
+		}
+		return append(command, args...)
+	}
+
+	dns := [][]string{{"cat", "/etc/resolv.conf"}}
+	if runtime.GOOS == "darwin" {
+		dns = append(dns, []string{"scutil", "--dns"})
+	}
+
+	return []gatherItem{
+		{"version.txt", func() (string, error) {
+			result := fmt.Sprintf("teleproxy %s\n%s %s/%s\n\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			more, err := cmdItem(kubectl("version", "--client"), []string{"uname", "-a"})()
+			return result + more, err
+		}},
+		apiItem("status.json", "/api/status"),
+		apiItem("logs.txt", "/api/logs"),
+		apiItem("nat.json", "/api/nat"),
+		apiItem("tables.json", "/api/tables/"),
+		apiItem("search.json", "/api/search"),
+		{"dns.txt", cmdItem(dns...)},
+		// view --minify only shows the current context, and redacts
+		// credentials unless --raw is given
+		{"kube.txt", cmdItem(kubectl("config", "current-context"),
+			kubectl("config", "view", "--minify"))},
+	}
+}
+
+// gather writes a tarball of everything we usually ask for in a bug
+// report and returns its name.
+func gather(kubeconfig, context string) (string, error) {
+	now := time.Now()
+	name := fmt.Sprintf("teleproxy-gather-%s.tar.gz", now.Format("20060102-150405"))
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
+	for _, item := range gatherItems(kubeconfig, context) {
+		content, err := item.collect()
+		if err != nil {
+			content += fmt.Sprintf("\nerror: %v\n", err)
+		}
+		hdr := &tar.Header{
+			Name:    "teleproxy-gather/" + item.name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/datawire/teleproxy/internal/pkg/graph"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+// graphOf returns the graph of the access logs named by files (- for
+// stdin), or else of the usage of the running teleproxy.
+func graphOf(files []string) (*graph.Graph, error) {
+	g := graph.New()
+	if len(files) == 0 {
+		body, err := get("http://teleproxy/api/status")
+		if err != nil {
+			return nil, fmt.Errorf("is teleproxy running? %v", err)
+		}
+		var status struct {
+			Usage *proxy.Report `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			return nil, err
+		}
+		if status.Usage != nil {
+			g.AddReport(*status.Usage)
+		}
+		return g, nil
+	}
+	for _, file := range files {
+		if err := addAccessLog(g, file); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// addAccessLog adds the entries of the access log file to g.
+func addAccessLog(g *graph.Graph, file string) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry, err := proxy.ParseEntry(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		g.AddEntry(entry)
+	}
+	return scanner.Err()
+}
+
+// writeGraph writes g to stdout in format, dot or json.
+func writeGraph(g *graph.Graph, format string) error {
+	switch format {
+	case "dot":
+		fmt.Print(g.DOT())
+	case "json":
+		data, err := json.MarshalIndent(g.JSON(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		return fmt.Errorf("-format: %q is neither dot nor json", format)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitWithParent has the kernel send us SIGTERM when the process that
+// started us dies, however it dies, so that we shut down as usual.
+func exitWithParent(signals chan<- os.Signal) error {
+	parent := os.Getppid()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGTERM), 0); errno != 0 {
+		return errno
+	}
+	if os.Getppid() != parent {
+		// it died before the kernel was told
+		signals <- syscall.SIGTERM
+	}
+	return nil
+}
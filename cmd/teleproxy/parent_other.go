@@ -0,0 +1,25 @@
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// exitWithParent sends signals SIGTERM when the process that started
+// us dies, however it dies, so that we shut down as usual. Without
+// prctl, we find out by being reparented.
+func exitWithParent(signals chan<- os.Signal) error {
+	parent := os.Getppid()
+	go func() {
+		for range time.Tick(time.Second) {
+			if os.Getppid() != parent {
+				signals <- syscall.SIGTERM
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/lsm"
+)
+
+// executable is where this teleproxy is installed, which policies and
+// file capabilities apply to.
+func executable() (string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(binary)
+}
+
+// securityPolicy writes the SELinux module or AppArmor profile, per
+// args or whichever of them the host has, that permits what teleproxy
+// does.
+func securityPolicy(args []string) error {
+	var kind string
+	if len(args) > 0 {
+		kind = args[0]
+	} else if modules := lsm.Detect(); len(modules) > 0 {
+		kind = modules[0].Name
+	} else {
+		return errors.New("found neither SELinux nor AppArmor, say which: teleproxy security-policy selinux (or apparmor)")
+	}
+	binary, err := executable()
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "selinux":
+		module, contexts := lsm.SELinux(binary)
+		if err := ioutil.WriteFile("teleproxy.te", []byte(module), 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile("teleproxy.fc", []byte(contexts), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, `wrote teleproxy.te and teleproxy.fc, to build and load them (with selinux-policy-devel):
+  make -f /usr/share/selinux/devel/Makefile teleproxy.pp
+  sudo semodule -i teleproxy.pp
+  sudo restorecon -v %s
+`, binary)
+	case "apparmor":
+		profile := "/etc/apparmor.d/" + strings.Replace(strings.TrimPrefix(binary, "/"), "/", ".", -1)
+		fmt.Print(lsm.AppArmor(binary))
+		fmt.Fprintf(os.Stderr, `to load it:
+  teleproxy security-policy apparmor | sudo tee %s
+  sudo apparmor_parser -r %s
+`, profile, profile)
+	default:
+		return fmt.Errorf("no policy for %q, only for selinux and apparmor", kind)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// A reload rereads a file of configuration on SIGHUP.
+type reload struct {
+	what, file string
+	apply      func() error
+}
+
+var reloadsMutex sync.Mutex
+var reloads []reload
+
+// onReload arranges for apply to reread file, the configuration of
+// what, e.g. "timeouts", on each SIGHUP. A reload that fails keeps the
+// previous configuration.
+func onReload(what, file string, apply func() error) {
+	reloadsMutex.Lock()
+	defer reloadsMutex.Unlock()
+	reloads = append(reloads, reload{what, file, apply})
+}
+
+// handleReloads takes over SIGHUP, which would otherwise kill us, to run
+// the reloads in the order they were added.
+func handleReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadsMutex.Lock()
+			current := append([]reload(nil), reloads...)
+			reloadsMutex.Unlock()
+			if len(current) == 0 {
+				log.Printf("TPY: SIGHUP: nothing to reload")
+			}
+			for _, r := range current {
+				if err := r.apply(); err != nil {
+					log.Printf("TPY: keeping the previous %s: %v", r.what, err)
+				} else {
+					log.Printf("TPY: reloaded %s", r.file)
+				}
+			}
+		}
+	}()
+}
+
+// handleDumps logs the state of the session on each SIGUSR1.
+func handleDumps(dump func()) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			dump()
+		}
+	}()
+}
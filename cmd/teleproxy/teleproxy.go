@@ -2,82 +2,550 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"git.lukeshu.com/go/libsystemd/sd_daemon"
-	"github.com/pkg/errors"
 
+	"github.com/datawire/teleproxy/pkg/client"
 	"github.com/datawire/teleproxy/pkg/k8s"
 	"github.com/datawire/teleproxy/pkg/tpu"
 
+	"github.com/datawire/teleproxy/internal/pkg/agentauth"
+	"github.com/datawire/teleproxy/internal/pkg/agenttls"
 	"github.com/datawire/teleproxy/internal/pkg/api"
-	"github.com/datawire/teleproxy/internal/pkg/dns"
 	"github.com/datawire/teleproxy/internal/pkg/docker"
-	"github.com/datawire/teleproxy/internal/pkg/interceptor"
 	"github.com/datawire/teleproxy/internal/pkg/proxy"
-	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/redact"
+	"github.com/datawire/teleproxy/internal/pkg/session"
+	"github.com/datawire/teleproxy/internal/pkg/shaping"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+	"github.com/datawire/teleproxy/internal/pkg/tlsterm"
 )
 
-func dnsListeners(port string) (listeners []string) {
-	// turns out you need to listen on localhost for nat to work
-	// properly for udp, otherwise you get an "unexpected source
-	// blah thingy" because the dns reply packets look like they
-	// are coming from the wrong place
-	listeners = append(listeners, "127.0.0.1:"+port)
-
-	if runtime.GOOS == "linux" {
-		// This is the default docker bridge. We should
-		// probably figure out how to query this out of docker
-		// instead of hardcoding it. We need to listen here
-		// because the nat logic we use to intercept dns
-		// packets will divert the packet to the interface it
-		// originates from, which in the case of containers is
-		// the docker bridge. Without this dns won't work from
-		// inside containers.
-		listeners = append(listeners, "172.17.0.1:"+port)
-	}
-
-	return
-}
-
 var Version = "(unknown version)"
 
 const (
-	DEFAULT   = ""
-	INTERCEPT = "intercept"
-	BRIDGE    = "bridge"
-	VERSION   = "version"
+	DEFAULT    = ""
+	INTERCEPT  = "intercept"
+	BRIDGE     = "bridge"
+	SHIM       = "shim"
+	STATUS     = "status"
+	SELFTEST   = "selftest"
+	GATHER     = "gather"
+	DOCTOR     = "doctor"
+	MANIFEST   = "manifest"
+	RBAC       = "rbac"
+	EXPOSE     = "expose"
+	TRUSTCA    = "trust-ca"
+	FORGETKEY  = "forget-host-key"
+	GRANTCAPS  = "grant-caps"
+	POLICY     = "security-policy"
+	DNS        = "dns"
+	RUN        = "run"
+	EXPORT     = "export"
+	APPLY      = "apply"
+	GRAPH      = "graph"
+	AGENTAUTH  = "agent-auth"
+	AGENTPROXY = "agent-proxy"
+	AGENTTLS   = "agent-tls"
+	AGENTDIAL  = "agent-dial"
+	VERSION    = "version"
 )
 
 func main() {
 	var version = flag.Bool("version", false, "alias for '-mode=version'")
-	var mode = flag.String("mode", "", "mode of operation ('intercept', 'bridge', or 'version')")
+	var mode = flag.String("mode", "", "mode of operation ('intercept', 'bridge', 'status', 'gather', 'doctor', 'manifest', 'rbac', 'expose', 'selftest', 'trust-ca', 'forget-host-key', 'grant-caps', 'security-policy', 'dns', 'run', 'export', 'apply', 'graph', 'agent-auth', 'agent-proxy', 'agent-tls', 'agent-dial', or 'version')")
+	var graphFormat = flag.String("format", "dot", "graph mode: write the graph as 'dot' or 'json'")
+	var cluster = flag.Bool("cluster", false, "doctor mode: also probe from the teleproxy pod, to tell problems on the cluster's side from those on this one")
 	var kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	var context = flag.String("context", "", "context to use (default: the current context)")
+	var kubeContext = flag.String("context", "", "context to use (default: the current context)")
 	var namespace = flag.String("namespace", "", "namespace to use (default: the current namespace for the context")
 	var dnsIP = flag.String("dns", "", "dns ip address")
 	var fallbackIP = flag.String("fallback", "", "dns fallback")
-
+	var dnsRewrites = flag.String("dns-rewrite", "", "comma separated rules, like dev.internal=default.svc.cluster.local, mapping vanity suffixes onto cluster names")
+	var dnsCorefile = flag.String("dns-corefile", "", "CoreDNS Corefile to take the forward, hosts, rewrite, and cache blocks of")
+	var dnsClientRate = flag.Int("dns-client-rate", 0, "queries a second each client address may make of the dns server, e.g. 500, beyond which they are refused (default: no limit)")
+	var natBackend = flag.String("nat-backend", "auto",
+		fmt.Sprintf("nat backend to use (%s, or 'auto' to detect)", strings.Join(client.NATBackends(), ", ")))
+	var socks = flag.String("socks", client.DefaultSocks, "address of the socks tunnel into the cluster")
+	var replicas = flag.Int("replicas", 1, "run the tunnel through a deployment of this many teleproxy pods, which fails over between them")
+	var agentInstalled = flag.Bool("agent-installed", false, "connect to the teleproxy pods installed from 'teleproxy manifest' in -namespace, rather than applying them")
+	var agentImage = flag.String("agent-image", "", "image of the teleproxy pods, e.g. from a registry of your own (default: "+client.AgentImage+")")
+	var exposeAs = flag.String("as", "", "expose mode: the service, svc/name, to expose the port as")
+	var unexpose = flag.Bool("unexpose", false, "expose mode: delete the service given with -as instead")
+	var execPod = flag.String("exec-pod", "", "tunnel through kubectl exec into this existing pod, which needs nc, rather than a teleproxy pod, for clusters that only allow exec")
+	var agentPullSecrets = flag.String("agent-pull-secret", "", "comma separated names of the secrets to pull -agent-image with, from a private registry")
+	var agentArch = flag.String("agent-arch", "", "comma separated architectures (e.g. amd64,arm64) -agent-image is built for, to keep the pods to nodes that can run it (default: any)")
+	var agentCPU = flag.String("agent-cpu", "", "manifest mode: cpu to request and limit the teleproxy pods to, e.g. 100m")
+	var agentMemory = flag.String("agent-memory", "", "manifest mode: memory to request and limit the teleproxy pods to, e.g. 64Mi")
+	var agentNodeSelector = flag.String("agent-node-selector", "", "manifest mode: comma separated labels (e.g. kubernetes.io/os=linux) of the nodes to run the teleproxy pods on")
+	var agentRBAC = flag.String("agent-rbac", "", "manifest mode: grant -agent-group permission to connect to the pods ('namespace'), and to list services everywhere too ('cluster')")
+	var agentGroup = flag.String("agent-group", "", "manifest, agent-auth and agent-proxy modes: group of the developers -agent-rbac grants permissions to, and that -agent-auth token requires")
+	var agentAuth = flag.String("agent-auth", "", "manifest mode: have the teleproxy pods authenticate developers by a bearer token the kubernetes api accepts ('token') or an ssh certificate signed by the CA in -agent-ca-secret ('cert'), with an -agent-image built from docker/teleproxy-agent (default: let in anyone who can port-forward to them)")
+	var agentPolicy = flag.Bool("agent-policy", false, "manifest mode: with -agent-auth token, have the teleproxy pods only connect developers to namespaces where the cluster permits them to create "+client.InterceptResource)
+	var agentCASecret = flag.String("agent-ca-secret", "", "manifest mode: secret, in the namespace of the pods, whose ca.pub is the ssh CA that -agent-auth cert trusts")
+	var agentTLS = flag.Bool("agent-tls", false, "tunnel into the teleproxy pods over mutual TLS, with a certificate issued from the CA in the secret "+agenttls.Secret+", which is created if missing; in manifest mode, have the pods require it, with an -agent-image built from docker/teleproxy-agent")
+	var agentTokenCommand = flag.String("agent-token-command", "", "shell command that prints the bearer token to log into teleproxy pods with -agent-auth token, e.g. 'kubectl create token dev-alice', run for every login")
+	var agentIdentity = flag.String("agent-identity", "", "ssh private key to log into teleproxy pods with -agent-auth cert, whose certificate is next to it as <key>-cert.pub")
+	var chart = flag.String("chart", "", "manifest mode: write a helm chart archive to this file instead")
+	var knownHosts = flag.String("known-hosts", client.DefaultKnownHosts(), "file the host key of the teleproxy pod of each context is pinned in")
+	var trustFirstKey = flag.Bool("trust-first-host-key", false, "pin whatever host key a teleproxy pod offers first when it can't be fetched through the kubernetes api, rather than refuse the pod, and list the pod as unchecked in the status")
+	var dockerVM = flag.Bool("docker-vm", false, "also intercept traffic from containers inside the Docker Desktop VM")
+	var dockerVMImage = flag.String("docker-vm-image", "datawire/teleproxy-shim", "image to run inside the Docker Desktop VM")
+	var containerRuntime = flag.String("container-runtime", "auto", "container runtime to watch ('docker', 'podman', or 'auto')")
+	var upstream = flag.String("upstream", "", "url of the teleproxy api to mirror routing tables from (shim mode only)")
+	var interceptNetworks = flag.String("intercept-networks", "",
+		"comma separated container networks or bridge interfaces to intercept (default: all)")
+	var excludeNetworks = flag.String("exclude-networks", "",
+		"comma separated container networks or bridge interfaces to never intercept")
+	var httpPorts = flag.String("http-ports", "",
+		"comma separated ports (e.g. 80,8080) where intercepted traffic is routed by its http Host header")
+	var cacheHosts = flag.String("cache-hosts", "",
+		"comma separated names (e.g. '*.svc.cluster.local') whose http GET responses on -http-ports are cached locally")
+	var cacheTTL = flag.Duration("cache-ttl", 0, "how long to cache -cache-hosts responses that don't say how long they may be cached for (default: not at all)")
+	var tlsHosts = flag.String("tls-hosts", "",
+		"comma separated names (e.g. '*.svc.cluster.local') to terminate tls for with a locally trusted certificate")
+	var warmForwards = flag.Int("warm-forwards", 0, "keep a connection through the tunnel ready for this many of the destinations used most recently")
+	var raceDirect = flag.Bool("race-direct", false, "dial intercepted destinations directly as well as through the tunnel and keep the faster, for clusters partly reachable on a VPN (linux only)")
+	var accessLog = flag.String("access-log", "", "file to note every intercepted connection in: the process, destination, service, bytes, duration, and how it ended")
+	var accessLogJSON = flag.Bool("access-log-json", false, "write the -access-log as json objects, one per line")
+	var quota = flag.String("quota", "", "warn (with a quota-exceeded event) when more than this much, e.g. 50GB, goes through the tunnel")
+	var tlsPorts = flag.String("tls-ports", "443", "comma separated ports where -tls-hosts are terminated")
+	var caDir = flag.String("ca-dir", tlsterm.DefaultDir, "where the local certificate authority for -tls-hosts is kept")
+	var rejectQUIC = flag.Bool("reject-quic", true, "refuse udp to port 443 of intercepted services, so that browsers fall back from QUIC to tcp right away (not with the tun, windows, and tproxy backends)")
+	var jumpAfter = flag.String("jump-after", "", "put the jumps to our iptables chains right after those to this chain, e.g. a security agent's, rather than first")
+	var clampMSS = flag.Bool("clamp-mss", false, "clamp the segment size of intercepted connections to the path mtu (iptables and nftables only)")
+	var processScoped = flag.Bool("process-scoped", false, "intercept only processes started with 'teleproxy run -- command' (linux with cgroup v2 only)")
+	var tunMTU = flag.Int("tun-mtu", 1500, "mtu of the device of the tun and windows nat backends")
+	var routeCIDRs = flag.String("route-cidrs", "",
+		"comma separated ranges (e.g. the service and pod ranges) to route through a tunnel device of teleproxy's own ahead of any VPN (mac only)")
+	var neverProxy = flag.String("never-proxy", "",
+		"comma separated domains (e.g. '*.okta.com') that are never intercepted or resolved by teleproxy")
+	var upstreamProxy = flag.String("upstream-proxy", "",
+		"http, https, or socks5 proxy url to reach the cluster through (default: $HTTPS_PROXY)")
+	var bastionHops = flag.String("bastion", "",
+		"comma separated ssh hosts ([user@]host[:port]) to reach the cluster through, the last one must be able to reach the api server")
+	var debug = flag.Bool("debug", false, "serve pprof profiles and expvar under /debug/ on the api")
+	var advertise = flag.String("advertise", "", "address, e.g. :7979, to serve whose teleproxy this is and what it intercepts on, read only, advertised on the local network with mdns")
+	flag.StringVar(&apiTokenFile, "api-token-file", client.DefaultTokenFile, "where to save the token required by the api for changes")
+	var apiSocket = flag.String("api-socket", "/var/run/teleproxy.sock", "unix socket to also serve the api on (linux only, empty to disable)")
+	var apiListen = flag.String("api-listen", "", "address the api listens on, reads need the token too off localhost or with -docker-vm (default: a random localhost port, which the -docker-vm shim reaches too)")
+	var clusterDomain = flag.String("cluster-domain", "", "dns domain of the cluster (default: detect, falling back to "+k8s.DefaultClusterDomain+")")
+	var serviceCIDR = flag.String("service-cidr", "", "range cluster ips are allocated from (default: detect)")
+	var enforceRBAC = flag.Bool("rbac", false, "only intercept namespaces where the cluster permits creating "+client.InterceptResource+", and in agent-proxy mode, only connect to them (the pods only enforce it when installed with -agent-policy)")
+	var lockFile = flag.String("lock-file", client.DefaultLockFile, "lock file that prevents two teleproxies from managing dns and the firewall at once")
+	var takeover = flag.Bool("takeover", false, "shut down any other active teleproxy session before starting")
+	var redactConfig = flag.String("redact-config", "", "json file of hostnames and addresses to redact from the logs, reread on SIGHUP")
+	var timeoutsConfig = flag.String("timeouts-config", "", "json file of dial, idle, udp flow, and dns query timeouts, by destination, reread on SIGHUP")
+	var shapingConfig = flag.String("shaping-config", "", "json file of the latency and bandwidth of relayed connections, by destination, reread on SIGHUP")
+	var observe = flag.Bool("observe", false, "discover and plan everything intercepting would do, and serve it on the api, but change nothing on this host, without root")
+	var ignoreConflicts = flag.Bool("ignore-conflicts", false, "start even if another interception tool (e.g. telepresence) is running")
+	var remap = flag.String("remap", "", "give services virtual addresses instead of their cluster ips: never, always, or auto (if the service range overlaps a local network) (default: auto for local clusters like kind, otherwise never)")
+	var loopbackServices = flag.String("loopback", "", "comma separated services, as namespace/name patterns like default/*, to bind to loopback addresses of their own for clients that insist on localhost")
+	var loopbackCIDR = flag.String("loopback-cidr", client.DefaultLoopbackCIDR, "range -loopback picks addresses from")
+	var hostsFile = flag.String("hosts-file", client.DefaultHostsFile, "hosts file naming the services bound with -loopback, and those of -hosts-dns")
+	var hostsDNS = flag.Bool("hosts-dns", false, "leave dns alone, and name the intercepted services in -hosts-file instead")
+	var hostsNames = flag.String("hosts-names", "", "comma separated patterns, like *.default.svc.cluster.local, of the names -hosts-dns publishes (default: all)")
+	var virtualCIDR = flag.String("virtual-cidr", client.DefaultVirtualCIDR, "range -remap picks virtual addresses from")
+	var offline = flag.Bool("offline", false, "cache the services of the cluster, and keep resolving them from the cache while it is unreachable")
+	var warmStart = flag.Bool("warm-start", false, "route the services cached by the last session right away, while the cluster is listed")
+	var cacheDir = flag.String("cache-dir", "", "where -offline and -warm-start keep the services of each context, and -remap the virtual addresses pinned (default: the user cache directory)")
+	var publishWindows = flag.Bool("wsl", false, "also make the cluster reachable from the Windows host (WSL2 only)")
+	var windowsDNS = flag.Bool("wsl-dns", false, "with -wsl, also have Windows resolve the names under the cluster's domain through teleproxy, with name resolution policy table rules")
+	var windowsPortProxy = flag.String("wsl-portproxy", "", "comma separated services, as namespace/name patterns, to give the Windows host with netsh portproxy when -wsl's routes can't be had (WSL2 only)")
+	var readyFile = flag.String("ready-file", "", "file to write the pid to once teleproxy is fully up, e.g. for ci to wait on (removed on exit)")
+	var readyFD = flag.Int("ready-fd", -1, "file descriptor to write a line to, and close, once teleproxy is fully up")
+	var drainTimeout = flag.Duration("drain-timeout", 10*time.Second, "how long SIGTERM waits for intercepted connections to finish before shutting down")
+	var expires = flag.Duration("expires", 0, "remove intercepts of services after this long, e.g. 2h, unless they are given a lifetime of their own (default: never)")
+	var maxDuration = flag.Duration("max-duration", 0, "shut down after this long, e.g. 30m, so a ci job can't leave teleproxy running (default: never)")
+	var exitWithParentFlag = flag.Bool("exit-with-parent", false, "shut down, cleaning up, when the process that started teleproxy dies, even of SIGKILL")
+	var portRange = flag.String("port-range", "", "range of local ports, e.g. 20000-20100, to use when the usual ones are taken (default: any free port)")
+
+	var mirrors repeated
+	flag.Var(&mirrors, "mirror", "copy traffic for a service to a local port as well, e.g. default/web:80=8080, while the cluster still serves it (may be repeated)")
+	var hooks repeated
+	flag.Var(&hooks, "hook", "url to post, or shell command to run, on connect, tunnel loss, intercepts, and shutdown (may be repeated)")
+	var plugins repeated
+	flag.Var(&plugins, "plugin", "shell command running a policy plugin, which may deny intercepts and answer for names (may be repeated)")
 	flag.Parse()
 
+	// keep recent logs around for the gather mode
+	redactor := redact.NewWriter(io.MultiWriter(os.Stderr, api.Logs))
+	log.SetOutput(redactor)
+	handleReloads()
+	if *redactConfig != "" {
+		if err := configureRedaction(redactor, *redactConfig); err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		onReload("redaction", *redactConfig, func() error {
+			return configureRedaction(redactor, *redactConfig)
+		})
+	}
+
 	if *version {
 		*mode = VERSION
 	}
+	args := flag.Args()
+	if len(args) > 0 && args[0] == RUN {
+		// teleproxy run -- command
+		*mode = RUN
+		args = args[1:]
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+	}
+	if len(args) > 0 && (args[0] == GRANTCAPS || args[0] == POLICY) {
+		// sudo teleproxy grant-caps, teleproxy security-policy selinux
+		*mode = args[0]
+		args = args[1:]
+	}
+	if len(args) > 0 && (args[0] == EXPORT || args[0] == APPLY) {
+		// teleproxy export > setup.yaml, teleproxy apply setup.yaml
+		*mode = args[0]
+		args = args[1:]
+	}
+	if len(args) > 0 && (args[0] == DOCTOR || args[0] == MANIFEST || args[0] == RBAC || args[0] == GRAPH) {
+		// teleproxy doctor --cluster, teleproxy manifest --replicas 3,
+		// teleproxy rbac --exec-pod tools, teleproxy graph --format json
+		*mode = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+	var exposePort string
+	if len(args) > 0 && args[0] == EXPOSE {
+		// teleproxy expose 8080 --as svc/my-dev-api
+		*mode = EXPOSE
+		args = args[1:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			exposePort, args = args[0], args[1:]
+		}
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if exposePort == "" && len(args) > 0 {
+			exposePort, args = args[0], args[1:]
+		}
+	}
+	var dnsCommand string
+	if len(args) > 0 && args[0] == DNS {
+		// teleproxy dns reset --context kind-kind
+		*mode = DNS
+		args = args[1:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			dnsCommand, args = args[0], args[1:]
+		}
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+	}
+	var setup client.Setup
 
 	switch *mode {
 	case DEFAULT, INTERCEPT, BRIDGE:
 		// do nothing
+	case SHIM:
+		if *upstream == "" {
+			log.Fatal("TPY: shim mode requires -upstream")
+		}
+	case STATUS:
+		body, err := get("http://teleproxy/api/status")
+		if err != nil {
+			log.Fatalf("TPY: is teleproxy running? %v", err)
+		}
+		os.Stdout.Write(body)
+		os.Exit(0)
+	case GATHER:
+		name, err := gather(*kubeconfig, *kubeContext)
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		fmt.Println("wrote", name)
+		os.Exit(0)
+	case DOCTOR:
+		kubeinfo, err := k8s.NewKubeInfo(*kubeconfig, *kubeContext, *namespace)
+		if err != nil {
+			die(client.KubeconfigInvalid(err))
+		}
+		os.Exit(doctor(kubeinfo, *socks, *cluster))
+	case MANIFEST:
+		m := client.Manifest{
+			Namespace:   *namespace,
+			Image:       *agentImage,
+			Arch:        split(*agentArch),
+			PullSecrets: split(*agentPullSecrets),
+			Replicas:    *replicas,
+			CPU:         *agentCPU,
+			Memory:      *agentMemory,
+			RBAC:        *agentRBAC,
+			Group:       *agentGroup,
+			Auth:        *agentAuth,
+			CASecret:    *agentCASecret,
+			Policy:      *agentPolicy,
+			TLS:         *agentTLS,
+		}
+		for _, label := range split(*agentNodeSelector) {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("TPY: node selector %q is not label=value", label)
+			}
+			if m.NodeSelector == nil {
+				m.NodeSelector = make(map[string]string)
+			}
+			m.NodeSelector[parts[0]] = parts[1]
+		}
+		// the cluster, if there is one yet, says which budgets it
+		// takes, and charts ask it when they are installed
+		if kubeinfo, err := k8s.NewKubeInfo(*kubeconfig, *kubeContext, *namespace); err == nil && *chart == "" {
+			m.BudgetVersion = kubeinfo.BudgetVersion()
+		}
+		if *chart != "" {
+			if err := writeChart(*chart, m); err != nil {
+				log.Fatalf("TPY: %v", err)
+			}
+			fmt.Fprintln(os.Stderr, "wrote", *chart)
+			os.Exit(0)
+		}
+		manifest, err := m.Render()
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		fmt.Print(manifest)
+		os.Exit(0)
+	case SELFTEST:
+		// measure the relay with a range of payload sizes, from
+		// latency bound to throughput bound
+		log.SetOutput(ioutil.Discard)
+		for _, size := range []int{64, 1024, 64 * 1024, 1024 * 1024} {
+			m, err := proxy.SelfTest(size, time.Second)
+			if err != nil {
+				log.Fatalf("TPY: self test failed: %v", err)
+			}
+			fmt.Println(m)
+		}
+		os.Exit(0)
+	case TRUSTCA:
+		ca, err := tlsterm.LoadCA(*caDir)
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if err := ca.Trust(); err != nil {
+			log.Fatalf("TPY: trusting %s: %v", ca.CertFile(), err)
+		}
+		fmt.Println("trusted", ca.CertFile())
+		os.Exit(0)
+	case FORGETKEY:
+		kubeinfo, err := k8s.NewKubeInfo(*kubeconfig, *kubeContext, *namespace)
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		found, err := client.ForgetHostKey(*knownHosts, kubeinfo.Context)
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if found {
+			fmt.Println("forgot the host key for", kubeinfo.Context+", the next one will be pinned")
+		} else {
+			fmt.Println("no host key pinned for", kubeinfo.Context)
+		}
+		os.Exit(0)
+	case GRANTCAPS:
+		binary, err := executable()
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if err := client.GrantCapabilities(binary); err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		fmt.Println("granted", binary, "the capabilities to intercept without sudo")
+		os.Exit(0)
+	case POLICY:
+		if err := securityPolicy(args); err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		os.Exit(0)
+	case DNS:
+		if dnsCommand != "reset" {
+			log.Fatalf("TPY: usage: teleproxy dns reset [-context name] [-cache-dir dir]")
+		}
+		if owner, running := session.Running(*lockFile); running {
+			log.Fatalf("TPY: %s is running, and would pin the addresses again, stop it first", owner)
+		}
+		forgotten, err := client.ResetPins(*cacheDir, *kubeContext)
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if len(forgotten) == 0 {
+			fmt.Println("no virtual addresses pinned")
+		} else {
+			fmt.Println("forgot the virtual addresses pinned for", strings.Join(forgotten, ", ")+", the next session gives names new ones")
+		}
+		os.Exit(0)
+	case RUN:
+		if _, running := session.Running(*lockFile); running {
+			code, err := client.Run(args, client.DefaultCgroup, *socks)
+			if err != nil {
+				log.Fatalf("TPY: %v", err)
+			}
+			os.Exit(code)
+		}
+		// otherwise start a teleproxy for just the command
+	case GRAPH:
+		g, err := graphOf(args)
+		if err == nil {
+			err = writeGraph(g, *graphFormat)
+		}
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		os.Exit(0)
+	case AGENTAUTH:
+		// run by sshd in the teleproxy pods, through pam_exec, with
+		// the password, a bearer token, on stdin
+		log.SetOutput(os.Stderr)
+		input, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		reviewer, err := agentauth.InCluster(*agentGroup)
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		user, err := reviewer.Review(strings.TrimSpace(strings.TrimRight(string(input), "\x00")))
+		if err != nil {
+			log.Fatalf("AUT: denied: %v", err)
+		}
+		log.Printf("AUT: authenticated %s", user)
+		os.Exit(0)
+	case AGENTPROXY:
+		// run in the teleproxy pods, for ssh to forward developers'
+		// connections to
+		log.Fatalf("AUT: %v", agentProxy(*agentGroup, *enforceRBAC))
+	case AGENTTLS:
+		// run in the teleproxy pods, in front of sshd -i, which
+		// follows --
+		log.SetOutput(os.Stderr)
+		if len(args) == 0 {
+			log.Fatal("AUT: usage: teleproxy agent-tls -- sshd -i ...")
+		}
+		ca, err := agenttls.LoadCA(agenttls.Dir)
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		config, err := ca.ServerConfig()
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", agenttls.Port))
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		log.Fatalf("AUT: %v", agenttls.Serve(ln, config, args))
+	case AGENTDIAL:
+		// run by ssh, as its ProxyCommand, to reach pods with
+		// -agent-tls
+		log.SetOutput(os.Stderr)
+		if len(args) != 2 {
+			log.Fatal("AUT: usage: teleproxy agent-dial bundle host:port")
+		}
+		bundle, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		config, err := agenttls.ParseBundle(bundle)
+		if err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		if err := agenttls.Dial(args[1], config, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("AUT: %v", err)
+		}
+		os.Exit(0)
+	case EXPORT:
+		body, err := get("http://teleproxy/api/setup")
+		if err != nil {
+			log.Fatalf("TPY: is teleproxy running? %v", err)
+		}
+		os.Stdout.Write(body)
+		os.Exit(0)
+	case APPLY:
+		if len(args) != 1 {
+			log.Fatal("TPY: usage: teleproxy apply setup.yaml (or - for stdin)")
+		}
+		var data []byte
+		var err error
+		if args[0] == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(args[0])
+		}
+		if err == nil {
+			setup, err = client.ParseSetup(data)
+		}
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if _, running := session.Running(*lockFile); running {
+			if err := post("http://teleproxy/api/setup", data); err != nil {
+				log.Fatalf("TPY: %v", err)
+			}
+			fmt.Println("applied", args[0])
+			os.Exit(0)
+		}
+		// otherwise start a teleproxy with the setup
+	case EXPOSE:
+		if *exposeAs == "" {
+			body, err := get("http://teleproxy/api/exposes")
+			if err != nil {
+				log.Fatalf("TPY: is teleproxy running? %v", err)
+			}
+			os.Stdout.Write(body)
+			os.Exit(0)
+		}
+		service := strings.TrimPrefix(*exposeAs, "svc/")
+		port := 0
+		if !*unexpose {
+			var err error
+			if port, err = strconv.Atoi(exposePort); err != nil || port == 0 {
+				log.Fatal("TPY: usage: teleproxy expose PORT --as svc/NAME, or teleproxy expose --unexpose --as svc/NAME")
+			}
+		}
+		data, err := json.Marshal(map[string]interface{}{"service": service, "port": port})
+		if err != nil {
+			panic(err)
+		}
+		if err := post("http://teleproxy/api/exposes", data); err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		if port == 0 {
+			fmt.Println("unexposed", "svc/"+service)
+		} else {
+			fmt.Printf("exposed port %d as svc/%s\n", port, service)
+		}
+		os.Exit(0)
+	case RBAC:
+		fmt.Print(client.RequiredRBAC(client.Options{
+			Bridge:         true,
+			Namespace:      *namespace,
+			ClusterDomain:  *clusterDomain,
+			ServiceCIDR:    *serviceCIDR,
+			EnforceRBAC:    *enforceRBAC,
+			Replicas:       *replicas,
+			AgentInstalled: *agentInstalled,
+			AgentTLS:       *agentTLS,
+			ExecPod:        *execPod,
+		}))
+		os.Exit(0)
 	case VERSION:
 		fmt.Println("teleproxy", "version", Version)
 		os.Exit(0)
@@ -85,31 +553,269 @@ func main() {
 		log.Fatalf("TPY: unrecognized mode: %v", *mode)
 	}
 
-	checkKubectl()
+	if *mode != SHIM {
+		checkKubectl()
+	}
+
+	if !*dockerVM {
+		*dockerVMImage = ""
+	}
+
+	opts := client.Options{
+		Intercept:        *mode == DEFAULT || *mode == APPLY || *mode == INTERCEPT || *mode == SHIM,
+		Bridge:           *mode == DEFAULT || *mode == APPLY || *mode == BRIDGE,
+		Kubeconfig:       *kubeconfig,
+		Context:          *kubeContext,
+		Namespace:        *namespace,
+		ClusterDomain:    *clusterDomain,
+		ServiceCIDR:      *serviceCIDR,
+		EnforceRBAC:      *enforceRBAC,
+		DNS:              *dnsIP,
+		Fallback:         *fallbackIP,
+		DNSClientRate:    *dnsClientRate,
+		DNSRewrites:      split(*dnsRewrites),
+		DNSCorefile:      *dnsCorefile,
+		NATBackend:       *natBackend,
+		IncludeNetworks:  split(*interceptNetworks),
+		RouteCIDRs:       split(*routeCIDRs),
+		ClampMSS:         *clampMSS,
+		RejectQUIC:       *rejectQUIC,
+		JumpAfter:        *jumpAfter,
+		ProcessScoped:    *processScoped,
+		TunMTU:           *tunMTU,
+		ExcludeNetworks:  split(*excludeNetworks),
+		NeverProxy:       split(*neverProxy),
+		Socks:            *socks,
+		KnownHosts:       *knownHosts,
+		TrustFirstKey:    *trustFirstKey,
+		Replicas:         *replicas,
+		AgentInstalled:   *agentInstalled,
+		ExecPod:          *execPod,
+		AgentImage:       *agentImage,
+		AgentArch:        split(*agentArch),
+		AgentPullSecrets: split(*agentPullSecrets),
+		AgentTokenCmd:    *agentTokenCommand,
+		AgentIdentity:    *agentIdentity,
+		AgentTLS:         *agentTLS,
+		HTTPPorts:        numbers("http-ports", *httpPorts),
+		CacheHosts:       split(*cacheHosts),
+		CacheTTL:         *cacheTTL,
+		TLSHosts:         split(*tlsHosts),
+		TLSPorts:         numbers("tls-ports", *tlsPorts),
+		Quota:            size("quota", *quota),
+		AccessLog:        *accessLog,
+		WarmForwards:     *warmForwards,
+		RaceDirect:       *raceDirect,
+		AccessLogJSON:    *accessLogJSON,
+		CADir:            *caDir,
+		ContainerRuntime: *containerRuntime,
+		DockerVMImage:    *dockerVMImage,
+		PublishWindows:   *publishWindows,
+		WindowsDNS:       *windowsDNS,
+		WindowsPortProxy: split(*windowsPortProxy),
+		UpstreamProxy:    *upstreamProxy,
+		Bastion:          split(*bastionHops),
+		APITokenFile:     apiTokenFile,
+		APISocket:        *apiSocket,
+		APIListen:        *apiListen,
+		InterceptTTL:     *expires,
+		Debug:            *debug,
+		Advertise:        *advertise,
+		PortRange:        *portRange,
+		LockFile:         *lockFile,
+		Takeover:         *takeover,
+		IgnoreConflicts:  *ignoreConflicts,
+		Observe:          *observe,
+		Remap:            *remap,
+		VirtualCIDR:      *virtualCIDR,
+		Loopback:         split(*loopbackServices),
+		LoopbackCIDR:     *loopbackCIDR,
+		HostsFile:        *hostsFile,
+		HostsDNS:         *hostsDNS,
+		HostsNames:       split(*hostsNames),
+		Offline:          *offline,
+		WarmStart:        *warmStart,
+		CacheDir:         *cacheDir,
+		Hooks:            hooks,
+		Plugins:          plugins,
+	}
+	if *mode == SHIM {
+		opts.Upstream = *upstream
+		opts.UpstreamToken = os.Getenv(docker.UpstreamTokenEnv)
+	}
+	if *mode == APPLY {
+		opts = withSetup(opts, setup)
+	}
+	if *timeoutsConfig != "" {
+		config, err := timeouts.ReadConfig(*timeoutsConfig)
+		if err == nil {
+			opts.Timeouts, err = timeouts.NewTable(config)
+		}
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		onReload("timeouts", *timeoutsConfig, func() error {
+			config, err := timeouts.ReadConfig(*timeoutsConfig)
+			if err == nil {
+				err = opts.Timeouts.Configure(config)
+			}
+			return err
+		})
+	}
+	if *shapingConfig != "" {
+		config, err := shaping.ReadConfig(*shapingConfig)
+		if err == nil {
+			opts.Shaping, err = shaping.NewTable(config)
+		}
+		if err != nil {
+			log.Fatalf("TPY: %v", err)
+		}
+		onReload("shaping", *shapingConfig, func() error {
+			config, err := shaping.ReadConfig(*shapingConfig)
+			if err == nil {
+				err = opts.Shaping.Configure(config)
+			}
+			return err
+		})
+	}
+	if *mode == RUN {
+		// intercept the command alone if possible, otherwise it
+		// gets the tunnel by way of the proxy variables
+		opts.ProcessScoped = client.CanScopeProcesses()
+		opts.Intercept = opts.ProcessScoped
+		opts.Bridge = opts.ProcessScoped
+		opts.TunnelOnly = !opts.ProcessScoped
+	}
 
 	// do this up front so we don't miss out on cleanup if someone
 	// Control-C's just after starting us
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-
-	if *mode == DEFAULT || *mode == INTERCEPT {
-		shutdown, err := intercept(*dnsIP, *fallbackIP)
-		if err != nil {
-			log.Printf("TPY: Error: %v", err)
+	if *readyFile != "" {
+		// left over from a session that was killed
+		os.Remove(*readyFile)
+	}
+	if *exitWithParentFlag {
+		if err := exitWithParent(signalChan); err != nil {
+			log.Fatalf("TPY: -exit-with-parent: %v", err)
 		}
-		defer shutdown()
 	}
-	if *mode == DEFAULT || *mode == BRIDGE {
-		kubeinfo, err := k8s.NewKubeInfo(*kubeconfig, *context, *namespace)
+
+	sess, err := client.Connect(context.Background(), opts)
+	if err != nil {
+		die(err)
+	}
+	if *mode == RUN {
+		// signals reach the command too, so wait for it to exit
+		code, err := sess.Run(args)
+		sess.Close()
 		if err != nil {
-			log.Fatalln("KubeInfo failed:", err)
+			log.Fatalf("TPY: %v", err)
 		}
-		shutdown := bridges(kubeinfo)
-		defer shutdown()
+		os.Exit(code)
 	}
+	defer sess.Close()
 	sd_daemon.Notification{State: "READY=1"}.Send(false)
+	handleDumps(sess.DumpToLog)
+	if *mode == APPLY {
+		go applyWhenListed(sess, setup)
+		if file := args[0]; file != "-" {
+			onReload("setup", file, func() error {
+				data, err := ioutil.ReadFile(file)
+				if err == nil {
+					setup, err = client.ParseSetup(data)
+				}
+				if err == nil {
+					err = sess.Apply(setup)
+				}
+				return err
+			})
+		}
+	}
+	for _, m := range mirrors {
+		namespace, service, port, local := parseMirror(m)
+		if err := sess.AddMirror(namespace, service, port, local); err != nil {
+			log.Fatalf("TPY: -mirror: %v", err)
+		}
+	}
+	if *readyFile != "" || *readyFD >= 0 {
+		if *readyFile != "" {
+			defer os.Remove(*readyFile)
+		}
+		go func() {
+			<-sess.Ready()
+			log.Printf("TPY: ready")
+			if err := notifyReady(*readyFile, *readyFD); err != nil {
+				log.Printf("TPY: Error notifying readiness: %v", err)
+			}
+		}()
+	}
+
+	var deadline <-chan time.Time
+	if *maxDuration > 0 {
+		deadline = time.After(*maxDuration)
+	}
+	select {
+	case sig := <-signalChan:
+		log.Printf("TPY: %v", sig)
+		if sig == syscall.SIGTERM {
+			sess.Drain(*drainTimeout)
+		}
+	case <-deadline:
+		log.Printf("TPY: shutting down after -max-duration %v", *maxDuration)
+	}
+}
+
+// parseMirror parses a -mirror, namespace/service:port=localport.
+func parseMirror(value string) (namespace, service string, port, local int) {
+	eq := strings.LastIndex(value, "=")
+	colon := strings.LastIndex(value, ":")
+	slash := strings.Index(value, "/")
+	if slash > 0 && colon > slash+1 && eq > colon+1 {
+		namespace, service = value[:slash], value[slash+1:colon]
+		var err1, err2 error
+		port, err1 = strconv.Atoi(value[colon+1 : eq])
+		local, err2 = strconv.Atoi(value[eq+1:])
+		if err1 == nil && err2 == nil {
+			return
+		}
+	}
+	log.Fatalf("TPY: -mirror: %q is not like default/web:80=8080", value)
+	return
+}
+
+// notifyReady writes our pid to file, all at once so that whoever
+// waits on it never reads half of it, and a line to fd.
+func notifyReady(file string, fd int) error {
+	if file != "" {
+		tmp := file + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			return err
+		}
+	}
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "ready-fd")
+		defer f.Close()
+		if _, err := f.Write([]byte("ready\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	log.Printf("TPY: %v", <-signalChan)
+// die reports err and exits with its code, so that scripts and editors
+// can tell the common failures apart. Those are named in the message
+// too, as in "TPY: Error[port-busy]: ...".
+func die(err error) {
+	if f := client.FailureOf(err); f != nil {
+		log.Printf("TPY: Error[%s]: %v", f.Name, err)
+	} else {
+		log.Printf("TPY: Error: %v", err)
+	}
+	os.Exit(client.ExitCode(err))
 }
 
 func kubeDie(err error) {
@@ -151,226 +857,157 @@ func checkKubectl() {
 	}
 }
 
-// intercept starts the interceptor, and only returns once the
-// interceptor is successfully running in another goroutine.  It
-// returns a function to call to shut down that goroutine.
-//
-// If dnsIP is empty, it will be detected from /etc/resolv.conf
-//
-// If fallbackIP is empty, it will default to Google DNS.
-func intercept(dnsIP string, fallbackIP string) (func(), error) {
-	// xxx check that we are root
-
-	if dnsIP == "" {
-		dat, err := ioutil.ReadFile("/etc/resolv.conf")
-		if err != nil {
-			return nil, err
-		}
-		for _, line := range strings.Split(string(dat), "\n") {
-			if strings.Contains(line, "nameserver") {
-				fields := strings.Fields(line)
-				dnsIP = fields[1]
-				log.Printf("TPY: Automatically set -dns=%v", dnsIP)
-				break
-			}
-		}
+// writeChart writes the helm chart of m to filename, versioned after
+// teleproxy if it has a release version.
+func writeChart(filename string, m client.Manifest) error {
+	version := strings.TrimPrefix(Version, "v")
+	if len(version) == 0 || version[0] < '0' || version[0] > '9' {
+		version = "0.0.0"
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := m.Chart(file, version); err != nil {
+		file.Close()
+		return err
 	}
-	if dnsIP == "" {
-		return nil, errors.New("couldn't determine dns ip from /etc/resolv.conf")
+	return file.Close()
+}
+
+func configureRedaction(redactor *redact.Writer, filename string) error {
+	config, err := redact.ReadConfig(filename)
+	if err != nil {
+		return err
 	}
+	return redactor.Configure(config)
+}
 
-	if fallbackIP == "" {
-		if dnsIP == "8.8.8.8" {
-			fallbackIP = "8.8.4.4"
-		} else {
-			fallbackIP = "8.8.8.8"
+// split splits a comma separated flag value.
+func split(values string) (result []string) {
+	for _, value := range strings.Split(values, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			result = append(result, value)
 		}
-		log.Printf("TPY: Automatically set -fallback=%v", dnsIP)
-	}
-	if fallbackIP == dnsIP {
-		return nil, errors.New("if your fallbackIP and your dnsIP are the same, you will have a dns loop")
 	}
+	return
+}
 
-	iceptor := interceptor.NewInterceptor("teleproxy")
+// repeated collects the values of a flag that is given more than
+// once.
+type repeated []string
 
-	apis, err := api.NewAPIServer(iceptor)
-	if err != nil {
-		return nil, errors.Wrap(err, "API Server")
-	}
-
-	srv := dns.Server{
-		Listeners: dnsListeners("1233"),
-		Fallback:  fallbackIP + ":53",
-		Resolve: func(domain string) string {
-			route := iceptor.Resolve(domain)
-			if route != nil {
-				return route.Ip
-			} else {
-				return ""
-			}
-		},
-	}
+func (r *repeated) String() string {
+	return strings.Join(*r, " ")
+}
 
-	// hmm, we may not actually need to get the original
-	// destination, we could just forward each ip to a unique port
-	// and either listen on that port or run port-forward
-	proxy, err := proxy.NewProxy(":1234", iceptor.Destination)
-	if err != nil {
-		return nil, errors.Wrap(err, "Proxy")
-	}
-
-	bootstrap := route.Table{Name: "bootstrap"}
-	bootstrap.Add(route.Route{
-		Ip:     dnsIP,
-		Target: "1233",
-		Proto:  "udp",
-	})
-	bootstrap.Add(route.Route{
-		Name:   "teleproxy",
-		Ip:     "127.254.254.254",
-		Target: apis.Port(),
-		Proto:  "tcp",
-	})
-
-	apis.Start()
-	srv.Start()
-	proxy.Start(10000)
-	restore := dns.OverrideSearchDomains(".")
-
-	iceptor.Start()
-	iceptor.Update(bootstrap)
-
-	return func() {
-		// stop the api server first since it makes calls into
-		// the interceptor
-		apis.Stop()
-		iceptor.Stop()
-		restore()
-		dns.Flush()
-	}, nil
+func (r *repeated) Set(value string) error {
+	*r = append(*r, value)
+	return nil
 }
 
-func bridges(kubeinfo *k8s.KubeInfo) func() {
-	disconnect := connect(kubeinfo)
-
-	// setup kubernetes bridge
-	log.Printf("BRG: kubernetes ctx=%s ns=%s", kubeinfo.Context, kubeinfo.Namespace)
-	w := k8s.NewClient(kubeinfo).Watcher()
-	w.Watch("services", func(w *k8s.Watcher) {
-		table := route.Table{Name: "kubernetes"}
-		for _, svc := range w.List("services") {
-			ip, ok := svc.Spec()["clusterIP"]
-			// for headless services the IP is None, we
-			// should properly handle these by listening
-			// for endpoints and returning multiple A
-			// records at some point
-			if ok && ip != "None" {
-				qualName := svc.Name() + "." + svc.Namespace() + ".svc.cluster.local"
-				table.Add(route.Route{
-					Name:   qualName,
-					Ip:     ip.(string),
-					Proto:  "tcp",
-					Target: "1234",
-				})
-			}
+// numbers splits a comma separated flag value of numbers.
+func numbers(name, values string) (result []int) {
+	for _, value := range split(values) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("TPY: -%s: %v", name, err)
 		}
-		post(table)
-	})
-	w.Start()
-
-	// Set up DNS search path based on current Kubernetes namespace
-	paths := []string{
-		kubeinfo.Namespace + ".svc.cluster.local.",
-		"svc.cluster.local.",
-		"cluster.local.",
-		"",
+		result = append(result, n)
 	}
-	log.Println("BRG: Setting DNS search path:", paths[0])
-	body, err := json.Marshal(paths)
-	if err != nil {
-		panic(err)
+	return
+}
+
+var units = map[string]uint64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
+
+// size parses an amount of bytes like "50GB", where units are powers
+// of 1024.
+func size(name, value string) uint64 {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0
 	}
-	_, err = http.Post("http://teleproxy/api/search", "application/json", bytes.NewReader(body))
-	if err != nil {
-		log.Printf("BRG: error setting up search path: %v", err)
-		panic(err) // Because this will fail if we win the startup race
+	digits := strings.TrimRightFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+	unit, ok := units[strings.TrimSpace(value[len(digits):])]
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if !ok || err != nil {
+		log.Fatalf("TPY: -%s: %q is not a size like 50GB", name, value)
 	}
+	return n * unit
+}
 
-	// setup docker bridge
-	dw := docker.NewWatcher()
-	dw.Start(func(w *docker.Watcher) {
-		table := route.Table{Name: "docker"}
-		for name, ip := range w.Containers {
-			table.Add(route.Route{Name: name, Ip: ip, Proto: "tcp"})
-		}
-		post(table)
-	})
+// apiTokenFile is where the running teleproxy saved the token for its
+// api.
+var apiTokenFile string
 
-	return func() {
-		dw.Stop()
-		w.Stop()
-		post(route.Table{Name: "kubernetes"}, route.Table{Name: "docker"})
-		disconnect()
+func post(url string, body []byte) error {
+	resp, err := client.API(apiTokenFile).Post(url, "application/yaml", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
 	}
+	return nil
 }
 
-func post(tables ...route.Table) {
-	names := make([]string, len(tables))
-	for i, t := range tables {
-		names[i] = t.Name
+// withSetup starts from the cluster and networks of setup, except for
+// those given on the command line.
+func withSetup(opts client.Options, setup client.Setup) client.Options {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	result := setup.Options(opts)
+	if given["context"] {
+		result.Context = opts.Context
 	}
-	jnames := strings.Join(names, ", ")
-
-	body, err := json.Marshal(tables)
-	if err != nil {
-		panic(err)
+	if given["namespace"] {
+		result.Namespace = opts.Namespace
 	}
-	resp, err := http.Post("http://teleproxy/api/tables/", "application/json", bytes.NewReader(body))
-	if err != nil {
-		log.Printf("BRG: error posting update to %s: %v", jnames, err)
-	} else {
-		log.Printf("BRG: posted update to %s: %v", jnames, resp.StatusCode)
+	if given["never-proxy"] {
+		result.NeverProxy = opts.NeverProxy
 	}
+	if given["intercept-networks"] {
+		result.IncludeNetworks = opts.IncludeNetworks
+	}
+	if given["exclude-networks"] {
+		result.ExcludeNetworks = opts.ExcludeNetworks
+	}
+	return result
 }
 
-const TELEPROXY_POD = `
----
-apiVersion: v1
-kind: Pod
-metadata:
-  name: teleproxy
-  labels:
-    name: teleproxy
-spec:
-  containers:
-  - name: proxy
-    image: datawire/telepresence-k8s:0.75
-    ports:
-    - protocol: TCP
-      containerPort: 8022
-`
-
-func connect(kubeinfo *k8s.KubeInfo) func() {
-	// setup remote teleproxy pod
-	apply := tpu.NewKeeper("KAP", "kubectl "+kubeinfo.GetKubectl("apply -f -"))
-	apply.Input = TELEPROXY_POD
-	apply.Limit = 1
-	apply.Start()
-	apply.Wait()
-
-	pf := tpu.NewKeeper("KPF", "kubectl "+kubeinfo.GetKubectl("port-forward pod/teleproxy 8022"))
-	pf.Inspect = "kubectl " + kubeinfo.GetKubectl("get pod/teleproxy")
-
-	// XXX: probably need some kind of keepalive check for ssh, first
-	// curl after wakeup seems to trigger detection of death
-	ssh := tpu.NewKeeper("SSH", "ssh -D localhost:1080 -C -N -oConnectTimeout=5 -oExitOnForwardFailure=yes "+
-		"-oStrictHostKeyChecking=no -oUserKnownHostsFile=/dev/null telepresence@localhost -p 8022")
-
-	pf.Start()
-	ssh.Start()
-
-	return func() {
-		ssh.Stop()
-		pf.Stop()
+// how long a fresh session gets to list the services of the cluster
+// before the intercepts of a setup give up on them
+const applyWait = time.Minute
+
+// applyWhenListed applies setup to a session that was just started,
+// retrying while the services it intercepts aren't listed yet.
+func applyWhenListed(sess *client.Session, setup client.Setup) {
+	start := time.Now()
+	for {
+		err := sess.Apply(setup)
+		if err == nil {
+			log.Printf("TPY: applied the setup")
+			return
+		}
+		if time.Since(start) > applyWait {
+			log.Printf("TPY: applying the setup: %v", err)
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := client.API(apiTokenFile).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
 	}
+	return ioutil.ReadAll(resp.Body)
 }
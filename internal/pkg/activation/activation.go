@@ -0,0 +1,94 @@
+// Package activation takes the sockets that systemd passes a service
+// it starts by socket activation, see sd_listen_fds(3), by the
+// FileDescriptorName= of their socket units.
+//
+// That way teleproxy can be started on demand, by the first connection
+// to the api or the first dns query.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"git.lukeshu.com/go/libsystemd/sd_daemon"
+)
+
+var (
+	once  sync.Once
+	mutex sync.Mutex
+	files map[string][]*os.File
+)
+
+// passed returns the sockets passed, by name, that haven't been taken
+// yet. The variables are unset, so that what teleproxy runs doesn't
+// take the sockets to be its own.
+func passed() map[string][]*os.File {
+	once.Do(func() {
+		files = byName(sd_daemon.ListenFds(true))
+	})
+	return files
+}
+
+// byName groups files by name. Those without one are "unknown", as
+// systemd names them.
+func byName(passed []*os.File) map[string][]*os.File {
+	result := make(map[string][]*os.File, len(passed))
+	for _, f := range passed {
+		name := f.Name()
+		if name == "" {
+			name = "unknown"
+		}
+		result[name] = append(result[name], f)
+	}
+	return result
+}
+
+// take returns the sockets passed by name, which are then no longer
+// passed.
+func take(name string) []*os.File {
+	mutex.Lock()
+	defer mutex.Unlock()
+	taken := passed()[name]
+	delete(files, name)
+	return taken
+}
+
+// Listener returns the stream socket passed by name, or nil if none
+// was.
+func Listener(name string) (net.Listener, error) {
+	taken := take(name)
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	if len(taken) > 1 {
+		for _, f := range taken {
+			f.Close()
+		}
+		return nil, fmt.Errorf("systemd passed %d sockets named %s, expected one", len(taken), name)
+	}
+	defer taken[0].Close()
+	ln, err := net.FileListener(taken[0])
+	if err != nil {
+		return nil, fmt.Errorf("socket %s: %v", name, err)
+	}
+	return ln, nil
+}
+
+// PacketConns returns the datagram sockets passed by name, if any.
+func PacketConns(name string) ([]net.PacketConn, error) {
+	var conns []net.PacketConn
+	for _, f := range take(name) {
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("socket %s: %v", name, err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
@@ -0,0 +1,58 @@
+package activation
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// named returns a copy of f as systemd would pass it, named name.
+func named(t *testing.T, f *os.File, name string) *os.File {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	addr := ln.Addr().String()
+	ln.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// as systemd would pass it, unnamed sockets are unknown
+	once.Do(func() {})
+	files = byName([]*os.File{named(t, f, "api"), named(t, r, "")})
+	if len(files["unknown"]) != 1 {
+		t.Errorf("expected the unnamed socket to be unknown, got %v", files)
+	}
+	if ln, err := Listener("dns"); ln != nil || err != nil {
+		t.Errorf("expected no dns socket, got %v, %v", ln, err)
+	}
+	passed, err := Listener("api")
+	if err != nil || passed == nil {
+		t.Fatalf("api: %v, %v", passed, err)
+	}
+	defer passed.Close()
+	if passed.Addr().String() != addr {
+		t.Errorf("expected %s, got %s", addr, passed.Addr())
+	}
+	if again, err := Listener("api"); again != nil || err != nil {
+		t.Errorf("expected the api socket to be taken, got %v, %v", again, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package agentauth checks, in the teleproxy pods, the credentials that
+// developers log into them with.
+package agentauth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultServer is the kubernetes api as a pod reaches it.
+const DefaultServer = "https://kubernetes.default.svc"
+
+// serviceAccount is where the credentials of the pod's service account
+// are mounted.
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// A Reviewer has the kubernetes api review bearer tokens. It accepts
+// whatever the api server does: tokens minted with the TokenRequest api,
+// e.g. by kubectl create token, and, if the api server is configured
+// for OIDC, id_tokens from its issuer.
+type Reviewer struct {
+	// Server is the url of the kubernetes api.
+	Server string
+	// Token is what the reviewer authenticates as, which needs
+	// permission to create tokenreviews, and for a Policy with RBAC,
+	// subjectaccessreviews, and to list services and pods.
+	Token  string
+	Client *http.Client
+	// Group, if set, is the group users must be in.
+	Group string
+}
+
+// InCluster returns a Reviewer that authenticates as the service
+// account of the pod it runs in.
+func InCluster(group string) (*Reviewer, error) {
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccount, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccount, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccount, "ca.crt"))
+	}
+	return &Reviewer{
+		Server: DefaultServer,
+		Token:  strings.TrimSpace(string(token)),
+		Client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   10 * time.Second,
+		},
+		Group: group,
+	}, nil
+}
+
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token string `json:"token"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string   `json:"username"`
+			UID      string   `json:"uid"`
+			Groups   []string `json:"groups"`
+		} `json:"user"`
+		Error string `json:"error"`
+	} `json:"status"`
+}
+
+// A user is who a token authenticates.
+type user struct {
+	Name   string
+	UID    string
+	Groups []string
+}
+
+// Review returns the user that token authenticates, or why it doesn't
+// let them in.
+func (r *Reviewer) Review(token string) (string, error) {
+	u, err := r.authenticate(token)
+	return u.Name, err
+}
+
+func (r *Reviewer) authenticate(token string) (user, error) {
+	if token == "" {
+		return user{}, fmt.Errorf("no token")
+	}
+	review := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	review.Spec.Token = token
+	if err := r.call("POST", "/apis/authentication.k8s.io/v1/tokenreviews", review, &review); err != nil {
+		return user{}, fmt.Errorf("reviewing the token: %v", err)
+	}
+	u := user{Name: review.Status.User.Username, UID: review.Status.User.UID, Groups: review.Status.User.Groups}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return user{}, fmt.Errorf("token not accepted: %s", review.Status.Error)
+		}
+		return user{}, fmt.Errorf("token not accepted")
+	}
+	if r.Group != "" && !contains(u.Groups, r.Group) {
+		return user{}, fmt.Errorf("%s is not in group %s", u.Name, r.Group)
+	}
+	return u, nil
+}
+
+// call has the kubernetes api answer method on path, with in as the
+// body if there is one, and decodes the answer into out.
+func (r *Reviewer) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(r.Server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(answer))
+	}
+	return json.Unmarshal(answer, out)
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
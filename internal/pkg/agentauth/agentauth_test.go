@@ -0,0 +1,60 @@
+package agentauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReview(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" || r.Header.Get("Authorization") != "Bearer reviewer" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var review tokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			t.Error(err)
+		}
+		switch review.Spec.Token {
+		case "alice":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "alice@example.com"
+			review.Status.User.Groups = []string{"developers", "system:authenticated"}
+		case "bob":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "bob@example.com"
+			review.Status.User.Groups = []string{"system:authenticated"}
+		default:
+			review.Status.Error = "invalid bearer token"
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer server.Close()
+
+	r := &Reviewer{Server: server.URL, Token: "reviewer", Client: server.Client(), Group: "developers"}
+	if user, err := r.Review("alice"); err != nil || user != "alice@example.com" {
+		t.Errorf("alice: %q, %v", user, err)
+	}
+	for token, expected := range map[string]string{
+		"bob":     "bob@example.com is not in group developers",
+		"mallory": "token not accepted: invalid bearer token",
+		"":        "no token",
+	} {
+		if user, err := r.Review(token); err == nil || err.Error() != expected {
+			t.Errorf("%q: expected %q, got %q, %v", token, expected, user, err)
+		}
+	}
+
+	r.Group = ""
+	if user, err := r.Review("bob"); err != nil || user != "bob@example.com" {
+		t.Errorf("bob without a group: %q, %v", user, err)
+	}
+	r.Token = "someone else"
+	if _, err := r.Review("alice"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected the review to be forbidden, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package agentauth
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyAddress is where, in the teleproxy pods, the SOCKS proxy that
+// enforces a Policy listens. Developers reach it through ssh.
+const ProxyAddress = "127.0.0.1:1080"
+
+// The intercepts a Policy with RBAC reviews access to: what platform
+// teams grant the "create" verb on, per namespace, as
+// intercepts.teleproxy.datawire.io.
+const (
+	interceptGroup    = "teleproxy.datawire.io"
+	interceptResource = "intercepts"
+)
+
+// loginTTL is how long a token review is trusted for, decisionTTL how
+// long an access review is, and decisionRetry how long one that failed
+// is before it is retried. directoryTTL is how often, at most, the
+// addresses of services and pods are listed again.
+const (
+	loginTTL      = time.Minute
+	decisionTTL   = time.Minute
+	decisionRetry = 10 * time.Second
+	directoryTTL  = 10 * time.Second
+)
+
+type login struct {
+	user user
+	err  error
+	at   time.Time
+}
+
+type decision struct {
+	err    error
+	failed bool
+	at     time.Time
+}
+
+// A Policy is the socks.Policy of the teleproxy pods. Developers log
+// in with a token the Reviewer accepts, and with RBAC, only connect to
+// services and pods in namespaces where the cluster lets them create
+// intercepts. Destinations in no namespace, e.g. outside the cluster,
+// are not restricted.
+type Policy struct {
+	reviewer *Reviewer
+	rbac     bool
+	// lookup resolves names; it is a field so tests can substitute
+	// one.
+	lookup func(host string) ([]net.IP, error)
+
+	mutex     sync.Mutex
+	logins    map[string]login
+	users     map[string]user
+	decisions map[string]decision
+
+	// listing guards namespaces, which has the namespace of each
+	// service and pod address as of listed, so that one listing
+	// doesn't hold up logins.
+	listing    sync.Mutex
+	namespaces map[string]string
+	listed     time.Time
+}
+
+// NewPolicy returns the Policy that logs in with reviewer, and with
+// rbac, reviews access to namespaces too.
+func NewPolicy(reviewer *Reviewer, rbac bool) *Policy {
+	return &Policy{
+		reviewer:  reviewer,
+		rbac:      rbac,
+		lookup:    net.LookupIP,
+		logins:    make(map[string]login),
+		users:     make(map[string]user),
+		decisions: make(map[string]decision),
+	}
+}
+
+// Login returns the user token authenticates.
+func (p *Policy) Login(token string) (string, error) {
+	p.mutex.Lock()
+	l, ok := p.logins[token]
+	p.mutex.Unlock()
+	if !ok || time.Since(l.at) >= loginTTL {
+		l.user, l.err = p.reviewer.authenticate(token)
+		l.at = time.Now()
+		p.mutex.Lock()
+		for t, old := range p.logins {
+			if time.Since(old.at) >= loginTTL {
+				delete(p.logins, t)
+			}
+		}
+		p.logins[token] = l
+		if l.err == nil {
+			p.users[l.user.Name] = l.user
+		}
+		p.mutex.Unlock()
+		if l.err == nil {
+			log.Printf("AUT: authenticated %s", l.user.Name)
+		}
+	}
+	return l.user.Name, l.err
+}
+
+// Allow returns why who may not connect to host, if they may not.
+func (p *Policy) Allow(who, host string) error {
+	if !p.rbac {
+		return nil
+	}
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	ips := []net.IP{net.ParseIP(name)}
+	if ips[0] == nil {
+		if ips, err = p.lookup(name); err != nil {
+			return err
+		}
+	}
+	p.mutex.Lock()
+	u := p.users[who]
+	p.mutex.Unlock()
+	for _, ip := range ips {
+		namespace, ok := p.namespace(ip)
+		if !ok {
+			continue
+		}
+		if err := p.decide(u, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespace returns the namespace of the service or pod at ip,
+// listing them again if it isn't known and they weren't just listed.
+func (p *Policy) namespace(ip net.IP) (string, bool) {
+	p.listing.Lock()
+	defer p.listing.Unlock()
+	if namespace, ok := p.namespaces[ip.String()]; ok {
+		return namespace, true
+	}
+	if time.Since(p.listed) < directoryTTL {
+		return "", false
+	}
+	namespaces, err := p.reviewer.addresses()
+	p.listed = time.Now()
+	if err != nil {
+		log.Printf("AUT: listing services and pods: %v", err)
+		return "", false
+	}
+	p.namespaces = namespaces
+	namespace, ok := namespaces[ip.String()]
+	return namespace, ok
+}
+
+// decide returns why u may not intercept namespace, as of the last
+// review of it that is still good, if they may not.
+func (p *Policy) decide(u user, namespace string) error {
+	key := u.Name + "\x00" + namespace
+	p.mutex.Lock()
+	d, ok := p.decisions[key]
+	p.mutex.Unlock()
+	ttl := decisionTTL
+	if d.failed {
+		ttl = decisionRetry
+	}
+	if ok && time.Since(d.at) < ttl {
+		return d.err
+	}
+
+	d = decision{at: time.Now()}
+	if allowed, reason, err := p.reviewer.can(u, "create", interceptGroup, interceptResource, namespace); err != nil {
+		log.Printf("AUT: access review of %s in namespace %s failed: %v", u.Name, namespace, err)
+		d.err = fmt.Errorf("namespace %s: access review failed: %v", namespace, err)
+		d.failed = true
+	} else if !allowed {
+		d.err = fmt.Errorf("namespace %s: %s may not create %s.%s", namespace, u.Name, interceptResource, interceptGroup)
+		if reason != "" {
+			d.err = fmt.Errorf("%v: %s", d.err, reason)
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for k, old := range p.decisions {
+		if time.Since(old.at) >= decisionTTL {
+			delete(p.decisions, k)
+		}
+	}
+	if previous, ok := p.decisions[key]; !ok || (previous.err == nil) != (d.err == nil) {
+		log.Printf("AUT: %s intercepting namespace %s allowed=%v", u.Name, namespace, d.err == nil)
+	}
+	p.decisions[key] = d
+	return d.err
+}
+
+type subjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		User               string   `json:"user"`
+		UID                string   `json:"uid,omitempty"`
+		Groups             []string `json:"groups,omitempty"`
+		ResourceAttributes struct {
+			Namespace string `json:"namespace"`
+			Verb      string `json:"verb"`
+			Group     string `json:"group"`
+			Resource  string `json:"resource"`
+		} `json:"resourceAttributes"`
+	} `json:"spec"`
+	Status struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	} `json:"status"`
+}
+
+// can reports whether the cluster lets u verb resources of group in
+// namespace, and why not.
+func (r *Reviewer) can(u user, verb, group, resource, namespace string) (bool, string, error) {
+	review := subjectAccessReview{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"}
+	review.Spec.User, review.Spec.UID, review.Spec.Groups = u.Name, u.UID, u.Groups
+	attributes := &review.Spec.ResourceAttributes
+	attributes.Namespace, attributes.Verb, attributes.Group, attributes.Resource = namespace, verb, group, resource
+	if err := r.call("POST", "/apis/authorization.k8s.io/v1/subjectaccessreviews", review, &review); err != nil {
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+type addressList struct {
+	Items []struct {
+		Metadata struct {
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			ClusterIP  string   `json:"clusterIP"`
+			ClusterIPs []string `json:"clusterIPs"`
+		} `json:"spec"`
+		Status struct {
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// addresses returns the namespace of every service and pod address.
+func (r *Reviewer) addresses() (map[string]string, error) {
+	namespaces := make(map[string]string)
+	for _, path := range []string{"/api/v1/services", "/api/v1/pods"} {
+		var list addressList
+		if err := r.call("GET", path, nil, &list); err != nil {
+			return nil, fmt.Errorf("%s: %v", strings.TrimPrefix(path, "/api/v1/"), err)
+		}
+		for _, item := range list.Items {
+			ips := append([]string{item.Spec.ClusterIP, item.Status.PodIP}, item.Spec.ClusterIPs...)
+			for _, ip := range item.Status.PodIPs {
+				ips = append(ips, ip.IP)
+			}
+			for _, ip := range ips {
+				if parsed := net.ParseIP(ip); parsed != nil {
+					namespaces[parsed.String()] = item.Metadata.Namespace
+				}
+			}
+		}
+	}
+	return namespaces, nil
+}
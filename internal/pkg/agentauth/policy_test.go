@@ -0,0 +1,103 @@
+package agentauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	reviews := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews[r.URL.Path]++
+		switch r.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			var review tokenReview
+			json.NewDecoder(r.Body).Decode(&review)
+			if review.Spec.Token == "alice" {
+				review.Status.Authenticated = true
+				review.Status.User.Username = "alice@example.com"
+				review.Status.User.Groups = []string{"developers"}
+			}
+			json.NewEncoder(w).Encode(review)
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			var review subjectAccessReview
+			json.NewDecoder(r.Body).Decode(&review)
+			attributes := review.Spec.ResourceAttributes
+			if review.Spec.User != "alice@example.com" || review.Spec.Groups[0] != "developers" ||
+				attributes.Verb != "create" || attributes.Group != "teleproxy.datawire.io" || attributes.Resource != "intercepts" {
+				t.Errorf("unexpected review %+v", review.Spec)
+			}
+			switch attributes.Namespace {
+			case "default":
+				review.Status.Allowed = true
+			case "broken":
+				http.Error(w, "etcd is down", http.StatusInternalServerError)
+				return
+			default:
+				review.Status.Reason = "no RBAC policy matched"
+			}
+			json.NewEncoder(w).Encode(review)
+		case "/api/v1/services":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"namespace": "default"}, "spec": {"clusterIP": "10.96.0.20"}},
+				{"metadata": {"namespace": "prod"}, "spec": {"clusterIP": "10.96.0.30"}},
+				{"metadata": {"namespace": "broken"}, "spec": {"clusterIP": "10.96.0.40"}}]}`))
+		case "/api/v1/pods":
+			w.Write([]byte(`{"items": [{"metadata": {"namespace": "prod"}, "status": {"podIP": "10.1.0.5"}}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := NewPolicy(&Reviewer{Server: server.URL, Token: "reviewer", Client: server.Client()}, true)
+	p.lookup = func(host string) ([]net.IP, error) {
+		if host == "hello.default" {
+			return []net.IP{net.ParseIP("10.96.0.20")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	if _, err := p.Login("mallory"); err == nil {
+		t.Error("expected mallory not to log in")
+	}
+	who, err := p.Login("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Login("alice")
+	if reviews["/apis/authentication.k8s.io/v1/tokenreviews"] != 2 {
+		t.Errorf("expected the token review to be kept, got %v", reviews)
+	}
+
+	for host, expected := range map[string]string{
+		"hello.default:80":   "",
+		"10.96.0.20:80":      "",
+		"10.96.0.30:443":     "namespace prod: alice@example.com may not create intercepts.teleproxy.datawire.io: no RBAC policy matched",
+		"10.1.0.5:8080":      "namespace prod: alice@example.com may not create intercepts.teleproxy.datawire.io: no RBAC policy matched",
+		"10.96.0.40:80":      "namespace broken: access review failed",
+		"93.184.216.34:443":  "",
+		"nowhere.default:80": "no such host",
+	} {
+		err := p.Allow(who, host)
+		if expected == "" && err != nil || expected != "" && (err == nil || !strings.HasPrefix(err.Error(), expected)) {
+			t.Errorf("%s: expected %q, got %v", host, expected, err)
+		}
+	}
+	if reviews["/apis/authorization.k8s.io/v1/subjectaccessreviews"] != 3 {
+		t.Errorf("expected one access review per namespace, got %v", reviews)
+	}
+	if reviews["/api/v1/services"] != 1 {
+		t.Errorf("expected the addresses to be listed once, got %v", reviews)
+	}
+
+	p = NewPolicy(p.reviewer, false)
+	who, _ = p.Login("alice")
+	if err := p.Allow(who, "10.96.0.30:443"); err != nil {
+		t.Errorf("expected no access reviews without rbac, got %v", err)
+	}
+}
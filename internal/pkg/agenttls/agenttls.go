@@ -0,0 +1,276 @@
+// Package agenttls wraps the tunnel into the teleproxy pods in mutual
+// TLS. Both ends issue their certificates from a CA kept in a secret
+// next to the pods, so whoever may read it may connect.
+package agenttls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Secret is the secret, in the namespace of the pods, that
+	// keeps the CA as CertFile and KeyFile.
+	Secret   = "teleproxy-tls"
+	CertFile = "ca.pem"
+	KeyFile  = "ca-key.pem"
+	// Dir is where the pods mount Secret.
+	Dir = "/etc/teleproxy/tls"
+	// Port is where the pods take the tunnel.
+	Port = 8443
+
+	serverName = "teleproxy"
+	// leaves are issued afresh whenever a pod starts or a session
+	// connects
+	leafLifetime = 7 * 24 * time.Hour
+	caLifetime   = 10 * 365 * 24 * time.Hour
+	handshake    = 10 * time.Second
+)
+
+// A CA issues the certificates of both ends of the tunnel.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// NewCA returns the certificate and key of a new CA, as pem.
+func NewCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{Organization: []string{"teleproxy"}, CommonName: "teleproxy tunnel CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// ParseCA returns the CA of a certificate and key from NewCA.
+func ParseCA(certPEM, keyPEM []byte) (*CA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the key of the CA isn't ecdsa")
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+// LoadCA returns the CA kept in dir, as the pods mount Secret.
+func LoadCA(dir string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, CertFile))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCA(certPEM, keyPEM)
+}
+
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// issue returns a certificate for name, to be used as usage says.
+func (ca *CA) issue(name string, usage x509.ExtKeyUsage) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{Organization: []string{"teleproxy"}, CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (ca *CA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// ServerConfig is the TLS of the pods, which only take clients with a
+// certificate from ca.
+func (ca *CA) ServerConfig() (*tls.Config, error) {
+	cert, err := ca.issue(serverName, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Bundle returns the certificate of a client called name, its key, and
+// the certificate of ca, as pem, which ParseBundle reads back.
+func (ca *CA) Bundle(name string) ([]byte, error) {
+	cert, err := ca.issue(name, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	var bundle []byte
+	for _, block := range []*pem.Block{
+		{Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		{Type: "EC PRIVATE KEY", Bytes: keyDER},
+		{Type: "CERTIFICATE", Bytes: ca.cert.Raw},
+	} {
+		bundle = append(bundle, pem.EncodeToMemory(block)...)
+	}
+	return bundle, nil
+}
+
+// ParseBundle returns the TLS of the client whose Bundle it is, which
+// only takes pods with a certificate from the same CA.
+func ParseBundle(bundle []byte) (*tls.Config, error) {
+	var blocks []*pem.Block
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) != 3 {
+		return nil, fmt.Errorf("expected a certificate, a key, and the CA in the bundle, got %d blocks", len(blocks))
+	}
+	cert, err := tls.X509KeyPair(pem.EncodeToMemory(blocks[0]), pem.EncodeToMemory(blocks[1]))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(blocks[2].Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Serve runs command for each connection to ln that authenticates,
+// with the connection as its stdin and stdout, e.g. sshd -i. It only
+// returns once ln is closed.
+func Serve(ln net.Listener, config *tls.Config, command []string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serve(tls.Server(conn, config), command)
+	}
+}
+
+func serve(conn *tls.Conn, command []string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshake))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("AUT: refused the tunnel from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("AUT: tunnel of %s", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = conn
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("AUT: %v", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("AUT: %v", err)
+		return
+	}
+	// not cmd.Stdin, which Wait would wait on until the client is
+	// done with the connection too
+	go func() {
+		io.Copy(stdin, conn)
+		stdin.Close()
+	}()
+	cmd.Wait()
+}
+
+// Dial connects stdin and stdout to the pod at address, as the
+// ProxyCommand of ssh, over the TLS of a client. It returns once the
+// pod is done.
+func Dial(address string, config *tls.Config, stdin io.Reader, stdout io.Writer) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: handshake}, "tcp", address, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, stdin)
+		conn.CloseWrite()
+	}()
+	_, err = io.Copy(stdout, conn)
+	return err
+}
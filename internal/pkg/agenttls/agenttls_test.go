@@ -0,0 +1,64 @@
+package agenttls
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newCA(t *testing.T) *CA {
+	certPEM, keyPEM, err := NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ParseCA(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// dial has a client with a certificate from ca, that trusts pods of
+// trusted, say hello to the pod at address, and returns what the pod
+// said back.
+func dial(t *testing.T, ca, trusted *CA, address string) (string, error) {
+	bundle, err := ca.Bundle("alice@laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RootCAs = trusted.pool()
+	var out bytes.Buffer
+	err = Dial(address, config, strings.NewReader("hello\n"), &out)
+	return out.String(), err
+}
+
+func TestTunnel(t *testing.T) {
+	ca := newCA(t)
+	config, err := ca.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// cat stands in for sshd -i
+	go Serve(ln, config, []string{"cat"})
+
+	if out, err := dial(t, ca, ca, ln.Addr().String()); err != nil || out != "hello\n" {
+		t.Errorf("expected the pod to echo hello, got %q, %v", out, err)
+	}
+	other := newCA(t)
+	if out, _ := dial(t, other, ca, ln.Addr().String()); out != "" {
+		t.Errorf("expected the pod to refuse a client of another CA, got %q", out)
+	}
+	if _, err := dial(t, ca, other, ln.Addr().String()); err == nil {
+		t.Errorf("expected the client to refuse a pod of another CA")
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TokenHeader carries the api token on requests that change state.
+const TokenHeader = "Authorization"
+
+// NewToken returns a random api token.
+func NewToken() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Owner returns the uid and gid of the user who started teleproxy,
+// which might not be the user it is running as if it was started via
+// sudo or is suid root.
+func Owner() (uid, gid int) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if uid == 0 {
+		if n, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+			uid = n
+		}
+		if n, err := strconv.Atoi(os.Getenv("SUDO_GID")); err == nil {
+			gid = n
+		}
+	}
+	return
+}
+
+// WriteToken saves the token where only its owner can read it.
+func WriteToken(path, token string) error {
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return err
+	}
+	uid, gid := Owner()
+	return os.Chown(path, uid, gid)
+}
+
+// ReadToken loads a token saved by WriteToken.
+func ReadToken(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Bearer formats a token for use in the TokenHeader.
+func Bearer(token string) string {
+	return "Bearer " + token
+}
+
+// authenticate rejects requests that could change teleproxy's state
+// unless they carry the token. Reads are left open on localhost so
+// that the api remains easy to inspect with curl. Logs and debug
+// endpoints expose (and can be expensive for) the process, so they
+// always need the token.
+func authenticate(token string, local bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readonly := local && r.Method == http.MethodGet && r.URL.Path != "/api/shutdown" &&
+			r.URL.Path != "/api/logs" && !strings.HasPrefix(r.URL.Path, "/debug/")
+		if !readonly && subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(Bearer(token))) != 1 {
+			http.Error(w, "missing or invalid api token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peerListener only accepts unix socket connections from root and the
+// owner.
+type peerListener struct {
+	net.Listener
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	owner, _ := Owner()
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && (uid == 0 || uid == owner) {
+			return conn, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("uid %d not permitted", uid)
+		}
+		log.Printf("API Server: rejecting unix socket connection: %v", err)
+		conn.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var requests = []struct {
+	method string
+	path   string
+	token  string
+	status int
+}{
+	{"GET", "/api/tables/", "", http.StatusOK},
+	{"GET", "/api/shutdown", "", http.StatusUnauthorized},
+	{"GET", "/api/shutdown", "secret", http.StatusOK},
+	{"POST", "/api/tables/", "", http.StatusUnauthorized},
+	{"POST", "/api/tables/", "wrong", http.StatusUnauthorized},
+	{"POST", "/api/tables/", "secret", http.StatusOK},
+	{"DELETE", "/api/tables/foo", "secret", http.StatusOK},
+	{"GET", "/api/logs", "", http.StatusUnauthorized},
+	{"GET", "/debug/pprof/heap", "", http.StatusUnauthorized},
+	{"GET", "/debug/pprof/heap", "secret", http.StatusOK},
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler := authenticate("secret", true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range requests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set(TokenHeader, Bearer(tt.token))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s (token %q): expected %d, got %d", tt.method, tt.path, tt.token, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestAuthenticateOffLocalhost(t *testing.T) {
+	handler := authenticate("secret", false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/api/tables/", nil)
+		if tt.token != "" {
+			req.Header.Set(TokenHeader, Bearer(tt.token))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("read (token %q): expected %d, got %d", tt.token, tt.status, rec.Code)
+		}
+	}
+}
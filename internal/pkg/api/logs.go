@@ -0,0 +1,44 @@
+package api
+
+import (
+	"strings"
+	"sync"
+)
+
+// Logs keeps the most recent log lines so that they can be retrieved
+// from /api/logs, e.g. for bug reports. Send the log output here (as
+// well as wherever else it goes) to enable it.
+var Logs = NewLogBuffer(2000)
+
+// A LogBuffer is an io.Writer that remembers the last lines written
+// to it.
+type LogBuffer struct {
+	mutex   sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+// NewLogBuffer returns a LogBuffer that remembers up to max lines.
+func NewLogBuffer(max int) *LogBuffer {
+	return &LogBuffer{max: max}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	parts := strings.Split(b.partial+string(p), "\n")
+	b.partial = parts[len(parts)-1]
+	b.lines = append(b.lines, parts[:len(parts)-1]...)
+	if len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+	return len(p), nil
+}
+
+// Lines returns the remembered lines, oldest first.
+func (b *LogBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.lines...)
+}
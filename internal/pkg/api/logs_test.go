@@ -0,0 +1,16 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(2)
+	b.Write([]byte("one\ntw"))
+	b.Write([]byte("o\nthree\nfour"))
+	expected := []string{"two", "three"}
+	if actual := b.Lines(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
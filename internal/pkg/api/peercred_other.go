@@ -0,0 +1,14 @@
+// +build !linux
+
+package api
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredSupported = false
+
+func peerUID(conn net.Conn) (int, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
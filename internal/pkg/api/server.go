@@ -3,22 +3,91 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
 
+	"github.com/datawire/teleproxy/internal/pkg/activation"
+	"github.com/datawire/teleproxy/internal/pkg/coexist"
 	"github.com/datawire/teleproxy/internal/pkg/dns"
 	"github.com/datawire/teleproxy/internal/pkg/interceptor"
 	"github.com/datawire/teleproxy/internal/pkg/route"
 )
 
+// A Mapping is a firewall mapping, as served at /api/mappings.
+type Mapping struct {
+	Proto string `json:"proto"`
+	IP    string `json:"ip"`
+	Port  int    `json:"port"`
+	// Name is what the address belongs to, e.g. "default/web", if
+	// that is known.
+	Name string `json:"name,omitempty"`
+}
+
+// DNS is how dns is answered, as served at /api/dns.
+type DNS struct {
+	*interceptor.DNS
+	// Search is the search path that names are tried with.
+	Search []string `json:"search"`
+	// Names are the names answered with the address of a route,
+	// and the addresses.
+	Names map[string]string `json:"names"`
+}
+
+// A Tunnel is a tunnel into the cluster, as served at /api/tunnels.
+type Tunnel struct {
+	// Name is "tunnel" for the one intercepted connections go
+	// through, or "replica N" for those it spreads them over.
+	Name string `json:"name"`
+	// Address is where its SOCKS5 proxy listens.
+	Address string `json:"address"`
+	// Via is what it goes through, e.g. "port-forward to pod/teleproxy".
+	Via string `json:"via"`
+	// Forward is the local port of the port-forward it goes through,
+	// if any.
+	Forward int `json:"forward,omitempty"`
+	// Up is whether it accepts connections.
+	Up bool `json:"up"`
+}
+
+// A Fake is a service made up with the interceptor's Fake, as served
+// at /api/fakes.
+type Fake struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	// Port is the port on localhost that connections to IP go to.
+	Port int `json:"port"`
+}
+
 type APIServer struct {
+	mux      *http.ServeMux
 	listener net.Listener
 	server   http.Server
+	token    string
+	// the unix socket is authenticated by peer credentials rather
+	// than by token
+	socket     string
+	unix       net.Listener
+	unixServer http.Server
 }
 
-func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
+// NewAPIServer constructs an api for the interceptor on addr, or a
+// random localhost port if addr is empty, where requests that change
+// state must carry the token. Off localhost, reads must carry it too.
+// If socket is non-empty and the platform supports checking peer
+// credentials, the api is also served without a token on that
+// unix socket to root and the user who started teleproxy. Under
+// systemd's socket activation, the sockets named api and api-unix are
+// served instead.
+func NewAPIServer(iceptor *interceptor.Interceptor, addr, token, socket string) (*APIServer, error) {
 	handler := http.NewServeMux()
 	tables := "/api/tables/"
 	handler.HandleFunc(tables, func(w http.ResponseWriter, r *http.Request) {
@@ -44,10 +113,52 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 				}
 				dns.Flush()
 			}
+		case http.MethodPatch:
+			d := json.NewDecoder(r.Body)
+			var deltas []route.Delta
+			err := d.Decode(&deltas)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			for _, delta := range deltas {
+				if err := iceptor.Patch(delta); err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+			}
+			dns.Flush()
 		case http.MethodDelete:
 			iceptor.Delete(table)
 		}
 	})
+	handler.HandleFunc("/api/fakes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fakes := []Fake{}
+			for _, route := range iceptor.Fakes() {
+				port, _ := strconv.Atoi(route.Target)
+				fakes = append(fakes, Fake{route.Name, route.Ip, port})
+			}
+			result, err := json.MarshalIndent(fakes, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
+		case http.MethodPost:
+			var fake Fake
+			d := json.NewDecoder(r.Body)
+			if err := d.Decode(&fake); err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if err := iceptor.Fake(fake.Name, fake.IP, fake.Port); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				dns.Flush()
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 	handler.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
 		var paths []string
 		switch r.Method {
@@ -69,6 +180,220 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 			}
 		}
 	})
+	handler.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.MarshalIndent(iceptor.Status(), "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/nat", func(w http.ResponseWriter, r *http.Request) {
+		var entries []string
+		for _, entry := range iceptor.Snapshot() {
+			entries = append(entries, entry.String())
+		}
+		result, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/mappings", func(w http.ResponseWriter, r *http.Request) {
+		mappings := []Mapping{}
+		for _, entry := range iceptor.Snapshot() {
+			port, _ := strconv.Atoi(entry.Port)
+			dst := entry.Destination
+			mappings = append(mappings, Mapping{dst.Proto, dst.Ip, port, route.NameOf(dst.Ip)})
+		}
+		result, err := json.MarshalIndent(mappings, "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/dns", func(w http.ResponseWriter, r *http.Request) {
+		state := DNS{iceptor.Status().DNS, iceptor.GetSearchPath(), iceptor.Names()}
+		result, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			panic(err)
+		} else {
+			w.Write(append(result, '\n'))
+		}
+	})
+	handler.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range Logs.Lines() {
+			w.Write([]byte(line + "\n"))
+		}
+	})
+	handler.HandleFunc("/api/denied", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Denied)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var denied []string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&denied)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.SetDenied(denied)
+			}
+		}
+	})
+	handler.HandleFunc("/api/refused", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Refused)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var destination string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&destination)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.Refuse(destination)
+			}
+		}
+	})
+	handler.HandleFunc("/api/unchecked", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Unchecked)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var pod string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&pod)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.TrustUnchecked(pod)
+			}
+		}
+	})
+	handler.HandleFunc("/api/overlaps", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Overlaps)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var overlaps []coexist.Overlap
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&overlaps)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.SetOverlaps(overlaps)
+			}
+		}
+	})
+	handler.HandleFunc("/api/cidrs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Routed)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var change struct {
+				Add    []string `json:"add"`
+				Remove []string `json:"remove"`
+			}
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&change)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if err := iceptor.Reroute(change.Add, change.Remove); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		}
+	})
+	handler.HandleFunc("/api/stale", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Stale)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var tables []string
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&tables)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.SetStale(tables)
+			}
+		}
+	})
+	handler.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Unhealthy)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var health struct {
+				Name string `json:"command"`
+				interceptor.Command
+			}
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&health)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.SetHealth(health.Name, health.Command)
+			}
+		}
+	})
+	handler.HandleFunc("/api/ports", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.Marshal(iceptor.Status().Ports)
+			if err != nil {
+				panic(err)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			var ports map[string]int
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&ports)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else {
+				iceptor.AddPorts(ports)
+			}
+		}
+	})
 	handler.HandleFunc("/api/shutdown", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Goodbye!\n"))
 		p, err := os.FindProcess(os.Getpid())
@@ -78,17 +403,298 @@ func NewAPIServer(iceptor *interceptor.Interceptor) (*APIServer, error) {
 		p.Signal(os.Interrupt)
 	})
 
-	ln, err := net.Listen("tcp", ":0")
+	// under socket activation, the api listens where the units of
+	// systemd say
+	ln, err := activation.Listener("api")
 	if err != nil {
 		return nil, err
 	}
+	if ln == nil {
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	local := false
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		local = tcp.IP.IsLoopback()
+	}
 
-	return &APIServer{
+	a := &APIServer{
+		mux:      handler,
 		listener: ln,
 		server: http.Server{
-			Handler: handler,
+			Handler: authenticate(token, local, handler),
 		},
-	}, nil
+		token: token,
+	}
+
+	unix, err := activation.Listener("api-unix")
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if unix == nil && socket != "" {
+		if !peerCredSupported {
+			log.Printf("API Server: unix socket not supported on this platform")
+			return a, nil
+		}
+		os.Remove(socket)
+		unix, err = net.Listen("unix", socket)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		// access is checked per connection
+		if err := os.Chmod(socket, 0666); err != nil {
+			unix.Close()
+			ln.Close()
+			return nil, err
+		}
+		// systemd removes the sockets it made itself
+		a.socket = socket
+	}
+	if unix != nil {
+		if !peerCredSupported {
+			log.Printf("API Server: unix socket not supported on this platform")
+			unix.Close()
+			return a, nil
+		}
+		a.unix = peerListener{unix}
+		a.unixServer.Handler = handler
+	}
+
+	return a, nil
+}
+
+// ServeSetup serves what the session intercepts and routes, as yaml,
+// under /api/setup, which is read with export and added to with apply.
+func (a *APIServer) ServeSetup(export func() ([]byte, error), apply func([]byte) error) {
+	a.mux.HandleFunc("/api/setup", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := export()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else {
+				w.Write(result)
+			}
+		case http.MethodPost:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if err := apply(body); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeIntercepts serves the ports of intercepted services, by
+// "namespace/service", under /api/intercepts. Posting {"namespace":
+// ..., "service": ..., "port": ...} intercepts one, replying with the
+// local port its traffic goes to as {"local": ...}, and port 0
+// releases it. An intercept posted with a "ttl", e.g. "1h", is
+// released after that long, or never for "0s"; without, ttl is nil.
+func (a *APIServer) ServeIntercepts(get func() map[string]int, set func(namespace, service string, port int, ttl *time.Duration) (int, error)) {
+	a.mux.HandleFunc("/api/intercepts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.MarshalIndent(get(), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
+		case http.MethodPost:
+			var x struct {
+				Namespace string `json:"namespace"`
+				Service   string `json:"service"`
+				Port      *int   `json:"port"`
+				TTL       string `json:"ttl"`
+			}
+			var ttl *time.Duration
+			err := json.NewDecoder(r.Body).Decode(&x)
+			if err == nil && x.TTL != "" {
+				var d time.Duration
+				if d, err = time.ParseDuration(x.TTL); err == nil && d < 0 {
+					err = fmt.Errorf("negative ttl %s", x.TTL)
+				}
+				ttl = &d
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if x.Namespace == "" || x.Service == "" || x.Port == nil {
+				http.Error(w, "namespace, service, and port are required", 400)
+			} else if local, err := set(x.Namespace, x.Service, *x.Port, ttl); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				result, err := json.Marshal(struct {
+					Local int `json:"local"`
+				}{local})
+				if err != nil {
+					panic(err)
+				}
+				w.Write(append(result, '\n'))
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeWeights serves the percentages of connections that weighted
+// intercepts route locally, by "namespace/service", under /api/weights.
+// Posting {"namespace": ..., "service": ..., "percent": ...} sets one.
+func (a *APIServer) ServeWeights(get func() map[string]int, set func(namespace, service string, percent int) error) {
+	a.mux.HandleFunc("/api/weights", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.MarshalIndent(get(), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
+		case http.MethodPost:
+			var weight struct {
+				Namespace string `json:"namespace"`
+				Service   string `json:"service"`
+				Percent   *int   `json:"percent"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&weight); err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if weight.Namespace == "" || weight.Service == "" || weight.Percent == nil {
+				http.Error(w, "namespace, service, and percent are required", 400)
+			} else if err := set(weight.Namespace, weight.Service, *weight.Percent); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeSelectors serves the headers, "name: value", by which intercepts
+// route requests locally, by "namespace/service", under /api/selectors.
+// Posting {"namespace": ..., "service": ..., "header": ...} sets one,
+// and an empty header clears it.
+func (a *APIServer) ServeSelectors(get func() map[string]string, set func(namespace, service, header string) error) {
+	a.mux.HandleFunc("/api/selectors", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.MarshalIndent(get(), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
+		case http.MethodPost:
+			var sel struct {
+				Namespace string `json:"namespace"`
+				Service   string `json:"service"`
+				Header    string `json:"header"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if sel.Namespace == "" || sel.Service == "" {
+				http.Error(w, "namespace and service are required", 400)
+			} else if err := set(sel.Namespace, sel.Service, sel.Header); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeExposes serves the local ports exposed into the cluster, by
+// service, under /api/exposes. Posting {"service": ..., "port": ...}
+// exposes one, and port 0 unexposes it.
+func (a *APIServer) ServeExposes(get func() map[string]int, set func(service string, port int) error) {
+	a.mux.HandleFunc("/api/exposes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			result, err := json.MarshalIndent(get(), "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			w.Write(append(result, '\n'))
+		case http.MethodPost:
+			var x struct {
+				Service string `json:"service"`
+				Port    *int   `json:"port"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+				http.Error(w, err.Error(), 400)
+			} else if x.Service == "" || x.Port == nil {
+				http.Error(w, "service and port are required", 400)
+			} else if err := set(x.Service, *x.Port); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeTunnels serves the tunnels into the cluster under /api/tunnels.
+func (a *APIServer) ServeTunnels(get func() []Tunnel) {
+	a.mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := json.MarshalIndent(get(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		w.Write(append(result, '\n'))
+	})
+}
+
+// ServeAnswers serves what the dns server would answer a query for a
+// name with, under /api/resolve?name=..., whether or not it listens.
+func (a *APIServer) ServeAnswers(answer func(name string) dns.Answer) {
+	a.mux.HandleFunc("/api/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "name is required", 400)
+			return
+		}
+		result, err := json.MarshalIndent(answer(name), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		w.Write(append(result, '\n'))
+	})
+}
+
+// EnableDebug serves net/http/pprof profiles under /debug/pprof/ and
+// expvar under /debug/vars. It must be invoked before Start.
+func (a *APIServer) EnableDebug() {
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	a.mux.Handle("/debug/vars", expvar.Handler())
+	// mutex and block profiles are empty unless sampling is on
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+}
+
+// ShareLoopback has reads take the token on localhost too, for when
+// others reach the api there: Docker Desktop forwards the connections
+// of its VM to host.docker.internal to the loopback of the host. It
+// must be invoked before Start.
+func (a *APIServer) ShareLoopback() {
+	a.server.Handler = authenticate(a.token, false, a.mux)
 }
 
 func (a *APIServer) Port() string {
@@ -106,6 +712,13 @@ func (a *APIServer) Start() {
 			log.Printf("API Server: %v", err)
 		}
 	}()
+	if a.unix != nil {
+		go func() {
+			if err := a.unixServer.Serve(a.unix); err != http.ErrServerClosed {
+				log.Printf("API Server: %v", err)
+			}
+		}()
+	}
 }
 
 func (a *APIServer) Stop() {
@@ -113,4 +726,12 @@ func (a *APIServer) Stop() {
 		// Error from closing listeners, or context timeout:
 		log.Printf("API Server Shutdown: %v", err)
 	}
+	if a.unix != nil {
+		if err := a.unixServer.Shutdown(context.Background()); err != nil {
+			log.Printf("API Server Shutdown: %v", err)
+		}
+		if a.socket != "" {
+			os.Remove(a.socket)
+		}
+	}
 }
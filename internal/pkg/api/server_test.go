@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestState(t *testing.T) {
+	iceptor := interceptor.NewObserver("teleproxy")
+	if err := iceptor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer iceptor.Stop()
+	iceptor.Update(route.Table{Name: "kubernetes", Routes: []route.Route{
+		{Name: "web.default.svc.cluster.local", Ip: "10.96.0.10", Proto: "tcp", Target: "1234"},
+	}})
+	defer route.Forget("10.96.0.10", "web.default.svc.cluster.local")
+	iceptor.SetSearchPath([]string{"default.svc.cluster.local.", ""})
+	iceptor.SetDNS(interceptor.DNS{Strategy: "redirect", Nameserver: "10.0.0.2:53", Port: 5353})
+
+	a, err := NewAPIServer(iceptor, "", "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.ServeTunnels(func() []Tunnel {
+		return []Tunnel{{Name: "tunnel", Address: "localhost:1080", Via: "port-forward to pod/teleproxy", Forward: 8022, Up: true}}
+	})
+	get := func(path string, v interface{}) {
+		w := httptest.NewRecorder()
+		a.mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, w.Body)
+		}
+	}
+
+	var mappings []Mapping
+	get("/api/mappings", &mappings)
+	expected := []Mapping{{"tcp", "10.96.0.10", 1234, "default/web"}}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("expected %v, got %v", expected, mappings)
+	}
+
+	var dns DNS
+	get("/api/dns", &dns)
+	if dns.DNS == nil || dns.Strategy != "redirect" || dns.Port != 5353 {
+		t.Errorf("expected the redirect to port 5353, got %+v", dns.DNS)
+	}
+	if dns.Names["web.default.svc.cluster.local."] != "10.96.0.10" || len(dns.Search) != 2 {
+		t.Errorf("expected the names and search path, got %+v", dns)
+	}
+
+	var tunnels []Tunnel
+	get("/api/tunnels", &tunnels)
+	if len(tunnels) != 1 || !tunnels[0].Up || tunnels[0].Forward != 8022 {
+		t.Errorf("expected the tunnel, got %+v", tunnels)
+	}
+
+	w := httptest.NewRecorder()
+	a.mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/fakes", strings.NewReader(`{"name": "payments.default.svc.cluster.local", "ip": "198.18.0.1", "port": 8080}`)))
+	if w.Code != 200 {
+		t.Fatalf("expected the fake to be made up, got %d %s", w.Code, w.Body)
+	}
+	defer route.Forget("198.18.0.1", "payments.default.svc.cluster.local")
+	var fakes []Fake
+	get("/api/fakes", &fakes)
+	if !reflect.DeepEqual(fakes, []Fake{{"payments.default.svc.cluster.local", "198.18.0.1", 8080}}) {
+		t.Errorf("expected the fake, got %+v", fakes)
+	}
+	if route := iceptor.Resolve("payments"); route == nil || route.Ip != "198.18.0.1" {
+		t.Errorf("expected payments to resolve to the fake, got %v", route)
+	}
+}
+
+// checkReads checks that reads of the api at url take the token.
+func checkReads(t *testing.T, url string) {
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "token": http.StatusOK} {
+		req, _ := http.NewRequest("GET", url+"/api/tables/", nil)
+		if token != "" {
+			req.Header.Set(TokenHeader, Bearer(token))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s, token %q: expected %d, got %d", url, token, status, resp.StatusCode)
+		}
+	}
+}
+
+// TestListen reaches the api the way the docker vm shim does, on
+// localhost shared with the VM, and from off localhost.
+func TestListen(t *testing.T) {
+	iceptor := interceptor.NewObserver("teleproxy")
+	if err := iceptor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer iceptor.Stop()
+	local, err := NewAPIServer(iceptor, "", "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := local.listener.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("expected the api on localhost by default, got %s", ip)
+	}
+	local.ShareLoopback()
+	local.Start()
+	defer local.Stop()
+	checkReads(t, "http://127.0.0.1:"+local.Port())
+
+	var host string
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			host = ipnet.IP.String()
+			break
+		}
+	}
+	if host == "" {
+		t.Skip("no address off localhost")
+	}
+	a, err := NewAPIServer(iceptor, ":0", "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	defer a.Stop()
+	checkReads(t, "http://"+net.JoinHostPort(host, a.Port()))
+}
+
+func TestServeIntercepts(t *testing.T) {
+	a, err := NewAPIServer(interceptor.NewObserver("teleproxy"), "", "token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.listener.Close()
+	intercepts := make(map[string]int)
+	var lifetime *time.Duration
+	a.ServeIntercepts(func() map[string]int { return intercepts }, func(namespace, service string, port int, ttl *time.Duration) (int, error) {
+		lifetime = ttl
+		if port == 0 {
+			delete(intercepts, namespace+"/"+service)
+			return 0, nil
+		}
+		intercepts[namespace+"/"+service] = port
+		return 8080, nil
+	})
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.mux.ServeHTTP(w, httptest.NewRequest(method, "/api/intercepts", strings.NewReader(body)))
+		return w
+	}
+
+	if w := serve("POST", `{"namespace": "default", "service": "web"}`); w.Code != 400 {
+		t.Errorf("expected the port to be required, got %d", w.Code)
+	}
+	if w := serve("POST", `{"namespace": "default", "service": "web", "port": 80}`); w.Code != 200 || w.Body.String() != `{"local":8080}`+"\n" {
+		t.Errorf("expected the local port, got %d %s", w.Code, w.Body)
+	}
+	if lifetime != nil {
+		t.Errorf("expected the default lifetime, got %v", *lifetime)
+	}
+	if w := serve("POST", `{"namespace": "default", "service": "web", "port": 80, "ttl": "-1h"}`); w.Code != 400 {
+		t.Errorf("expected a negative ttl to be rejected, got %d", w.Code)
+	}
+	serve("POST", `{"namespace": "default", "service": "web", "port": 80, "ttl": "2h"}`)
+	if lifetime == nil || *lifetime != 2*time.Hour {
+		t.Errorf("expected a lifetime of 2h, got %v", lifetime)
+	}
+	var listed map[string]int
+	if err := json.Unmarshal(serve("GET", "").Body.Bytes(), &listed); err != nil || listed["default/web"] != 80 {
+		t.Errorf("expected the intercept, got %v, %v", listed, err)
+	}
+	serve("POST", `{"namespace": "default", "service": "web", "port": 0}`)
+	if len(intercepts) != 0 {
+		t.Errorf("expected the intercept to be released, got %v", intercepts)
+	}
+}
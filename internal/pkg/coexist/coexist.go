@@ -0,0 +1,151 @@
+// Package coexist detects other tools that intercept traffic, whose
+// rules conflict with ours in confusing ways.
+package coexist
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// A Conflict is another tool found intercepting traffic.
+type Conflict struct {
+	Tool     string `json:"tool"`
+	Evidence string `json:"evidence"`
+	Remedy   string `json:"remedy"`
+	// Fatal conflicts break interception outright, rather than
+	// for some destinations.
+	Fatal bool `json:"fatal"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s (%s): %s", c.Tool, c.Evidence, c.Remedy)
+}
+
+// host is what detection looks at, gathered up front so that the
+// signatures can be tested.
+type host struct {
+	// interfaces maps the names of network interfaces to their
+	// addresses
+	interfaces map[string][]net.IP
+	// rules are the names of iptables chains, nft tables, or pf
+	// anchors
+	rules []string
+}
+
+type signature struct {
+	tool   string
+	remedy string
+	fatal  bool
+	// match returns evidence of the tool, if any
+	match func(h host) string
+}
+
+// tailscale hands out addresses from the shared address space
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var signatures = []signature{
+	{
+		tool: "sshuttle (or Telepresence 1)",
+		remedy: "quit telepresence (or sshuttle) before starting teleproxy, " +
+			"they redirect the same traffic",
+		fatal: true,
+		match: func(h host) string {
+			return h.rule(func(name string) bool { return strings.HasPrefix(name, "sshuttle-") })
+		},
+	},
+	{
+		tool:   "Telepresence 2",
+		remedy: "run `telepresence quit` before starting teleproxy, they route the same traffic",
+		fatal:  true,
+		match: func(h host) string {
+			return h.iface(func(name string, _ []net.IP) bool { return name == "tel0" })
+		},
+	},
+	{
+		tool: "Tailscale",
+		remedy: "if a subnet router advertises the cluster's ranges, run `tailscale up --accept-routes=false`, " +
+			"or on a mac pass -route-cidrs so teleproxy's routes win",
+		match: func(h host) string {
+			if evidence := h.iface(func(name string, addrs []net.IP) bool {
+				if name == "tailscale0" {
+					return true
+				}
+				if !strings.HasPrefix(name, "utun") {
+					return false
+				}
+				for _, addr := range addrs {
+					if cgnat.Contains(addr) {
+						return true
+					}
+				}
+				return false
+			}); evidence != "" {
+				return evidence
+			}
+			return h.rule(func(name string) bool { return strings.HasPrefix(name, "ts-") || name == "tailscale" })
+		},
+	},
+	{
+		tool: "Zscaler",
+		remedy: "Zscaler captures traffic before the firewall sees it, have the cluster's ranges bypassed, " +
+			"or on a mac pass -route-cidrs so teleproxy's routes win",
+		match: func(h host) string {
+			if evidence := h.iface(func(name string, _ []net.IP) bool { return strings.HasPrefix(name, "zcctun") }); evidence != "" {
+				return evidence
+			}
+			return h.rule(func(name string) bool { return strings.Contains(strings.ToLower(name), "zscaler") })
+		},
+	},
+}
+
+func (h host) iface(match func(name string, addrs []net.IP) bool) string {
+	for name, addrs := range h.interfaces {
+		if match(name, addrs) {
+			return "interface " + name
+		}
+	}
+	return ""
+}
+
+func (h host) rule(match func(name string) bool) string {
+	for _, name := range h.rules {
+		if match(name) {
+			return "firewall rules " + name
+		}
+	}
+	return ""
+}
+
+func detect(h host) (conflicts []Conflict) {
+	for _, s := range signatures {
+		if evidence := s.match(h); evidence != "" {
+			conflicts = append(conflicts, Conflict{Tool: s.tool, Evidence: evidence, Remedy: s.remedy, Fatal: s.fatal})
+		}
+	}
+	return
+}
+
+// Detect looks for known tools that conflict with teleproxy. Probing
+// firewall rules requires root, without it only interfaces are
+// checked.
+func Detect() []Conflict {
+	h := host{interfaces: make(map[string][]net.IP)}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("TPY: listing interfaces: %v", err)
+	}
+	for _, iface := range ifaces {
+		var ips []net.IP
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+		h.interfaces[iface.Name] = ips
+	}
+	h.rules = rules()
+	return detect(h)
+}
@@ -0,0 +1,82 @@
+package coexist
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name  string
+		host  host
+		tools []string
+		fatal bool
+	}{
+		{"clean", host{
+			interfaces: map[string][]net.IP{"lo": {net.IPv4(127, 0, 0, 1)}, "utun0": {net.ParseIP("fe80::1")}},
+			rules:      []string{"PREROUTING", "DOCKER", "com.apple"},
+		}, nil, false},
+		{"sshuttle", host{rules: []string{"OUTPUT", "sshuttle-12300"}}, []string{"sshuttle (or Telepresence 1)"}, true},
+		{"telepresence", host{interfaces: map[string][]net.IP{"tel0": nil}}, []string{"Telepresence 2"}, true},
+		{"tailscale linux", host{rules: []string{"ts-input", "ts-forward"}}, []string{"Tailscale"}, false},
+		{"tailscale mac", host{interfaces: map[string][]net.IP{"utun3": {net.IPv4(100, 101, 102, 103)}}}, []string{"Tailscale"}, false},
+		{"zscaler", host{rules: []string{"com.zscaler.anchor"}}, []string{"Zscaler"}, false},
+		{"several", host{
+			interfaces: map[string][]net.IP{"tailscale0": nil, "zcctun0": nil},
+		}, []string{"Tailscale", "Zscaler"}, false},
+	}
+
+	for _, c := range cases {
+		conflicts := detect(c.host)
+		if len(conflicts) != len(c.tools) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.tools, conflicts)
+			continue
+		}
+		for i, conflict := range conflicts {
+			if conflict.Tool != c.tools[i] {
+				t.Errorf("%s: expected %s, got %s", c.name, c.tools[i], conflict.Tool)
+			}
+			if conflict.Fatal != c.fatal {
+				t.Errorf("%s: expected fatal=%v for %s", c.name, c.fatal, conflict.Tool)
+			}
+			if conflict.Evidence == "" || conflict.Remedy == "" {
+				t.Errorf("%s: incomplete %v", c.name, conflict)
+			}
+		}
+	}
+}
+
+func cidr(s string) *net.IPNet {
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	network.IP = ip
+	return network
+}
+
+func TestOverlaps(t *testing.T) {
+	networks := map[string][]*net.IPNet{
+		"en0":     {cidr("10.0.1.23/24")},
+		"docker0": {cidr("172.17.0.1/16")},
+		"br-1234": {cidr("172.18.0.1/16")},
+	}
+	ranges := []*net.IPNet{cidr("10.0.0.0/16"), cidr("172.16.0.0/12")}
+	expected := []Overlap{
+		{"br-1234", "172.18.0.0/16", "172.16.0.0/12"},
+		{"docker0", "172.17.0.0/16", "172.16.0.0/12"},
+		{"en0", "10.0.1.0/24", "10.0.0.0/16"},
+	}
+	actual := overlaps(networks, ranges)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], actual[i])
+		}
+	}
+	if actual := overlaps(networks, []*net.IPNet{cidr("10.96.0.0/12")}); len(actual) != 0 {
+		t.Errorf("expected no overlaps, got %v", actual)
+	}
+}
@@ -0,0 +1,74 @@
+package coexist
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// An Overlap is a local network that shares addresses with a range
+// teleproxy intercepts, so that intercepting the range cuts the host
+// off from part of the network.
+type Overlap struct {
+	Interface string `json:"interface"`
+	Network   string `json:"network"`
+	Range     string `json:"range"`
+}
+
+func (o Overlap) String() string {
+	return fmt.Sprintf("%s on %s overlaps %s", o.Network, o.Interface, o.Range)
+}
+
+func intersect(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func overlaps(networks map[string][]*net.IPNet, ranges []*net.IPNet) (result []Overlap) {
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, network := range networks[name] {
+			for _, r := range ranges {
+				if intersect(network, r) {
+					masked := &net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}
+					result = append(result, Overlap{Interface: name, Network: masked.String(), Range: r.String()})
+				}
+			}
+		}
+	}
+	return
+}
+
+// Overlaps returns the networks of local interfaces, e.g. the LAN or
+// docker networks, that overlap any of the ranges. Loopback is left
+// out, since nothing routes there.
+func Overlaps(ranges []string) ([]Overlap, error) {
+	var parsed []*net.IPNet
+	for _, r := range ranges {
+		_, cidr, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, cidr)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	networks := make(map[string][]*net.IPNet)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				networks[iface.Name] = append(networks[iface.Name], ipnet)
+			}
+		}
+	}
+	return overlaps(networks, parsed), nil
+}
@@ -0,0 +1,27 @@
+// +build darwin
+
+package coexist
+
+import (
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// rules lists pf anchors, nested ones included.
+func rules() (names []string) {
+	// pfctl warns about ALTQ on stderr
+	result, err := tpu.Run([]string{"pfctl", "-s", "Anchors", "-v"}, "")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// nested anchors are reported as paths
+		names = append(names, line[strings.LastIndex(line, "/")+1:])
+	}
+	return
+}
@@ -0,0 +1,32 @@
+// +build linux
+
+package coexist
+
+import (
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// rules lists iptables chains and nft tables. Either tool may be
+// missing, which just means it has nothing to report.
+func rules() (names []string) {
+	if result, err := tpu.Run([]string{"iptables-save"}, ""); err == nil {
+		for _, line := range strings.Split(result.Stdout, "\n") {
+			// ":CHAIN POLICY [packets:bytes]"
+			if strings.HasPrefix(line, ":") {
+				names = append(names, strings.Fields(line[1:])[0])
+			}
+		}
+	}
+	if result, err := tpu.Run([]string{"nft", "list", "tables"}, ""); err == nil {
+		for _, line := range strings.Split(result.Stdout, "\n") {
+			// "table FAMILY NAME"
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "table" {
+				names = append(names, fields[2])
+			}
+		}
+	}
+	return
+}
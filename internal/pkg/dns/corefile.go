@@ -0,0 +1,305 @@
+package dns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A Forward relays the queries for names in Zone to Upstream, rather
+// than to the fallback server.
+type Forward struct {
+	Zone     string
+	Upstream string
+}
+
+// A Corefile is what teleproxy takes from a CoreDNS Corefile, so that
+// teams who already configure CoreDNS needn't say the same again in
+// another dialect. Only a subset is understood:
+//
+//	forward ZONE UPSTREAM...  relays the zone ("." being the zone of
+//	                          the server block) to the first upstream
+//	hosts [FILE] { IP NAME... } answers the names with the addresses
+//	rewrite name suffix FROM TO  is a Rewrite
+//	cache [TTL]               caps how long answers are good for
+//
+// Other plugins, and the options of these, are listed in Ignored
+// rather than failing, since a Corefile made for a cluster is bound to
+// have some.
+type Corefile struct {
+	// Fallback is where queries go that no Forward relays, if the
+	// Corefile says.
+	Fallback string
+	Forwards []Forward
+	Hosts    map[string]string
+	Rewrites []Rewrite
+	// MaxTTL, if set, caps the ttl of answers.
+	MaxTTL  uint32
+	Ignored []string
+}
+
+// Configure makes s behave as c says, adding to what s already has.
+// The Fallback of c is left to the caller.
+func (c Corefile) Configure(s *Server) {
+	s.Forwards = append(s.Forwards, c.Forwards...)
+	s.Rewrites = append(s.Rewrites, c.Rewrites...)
+	if len(c.Hosts) > 0 && s.Hosts == nil {
+		s.Hosts = make(map[string]string, len(c.Hosts))
+	}
+	for name, ip := range c.Hosts {
+		s.Hosts[name] = ip
+	}
+	if c.MaxTTL > 0 {
+		s.MaxTTL = c.MaxTTL
+	}
+}
+
+// LoadCorefile parses the Corefile in filename.
+func LoadCorefile(filename string) (Corefile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Corefile{}, err
+	}
+	return ParseCorefile(string(data))
+}
+
+// A directive is a line of a Corefile, with the block that follows it,
+// if any.
+type directive struct {
+	line  int
+	args  []string
+	block []directive
+}
+
+// ParseCorefile parses the text of a Corefile.
+func ParseCorefile(text string) (Corefile, error) {
+	p := &parser{tokens: tokenize(text), line: 1}
+	servers, err := p.block(true)
+	if err != nil {
+		return Corefile{}, err
+	}
+	c := Corefile{}
+	for _, server := range servers {
+		if server.block == nil {
+			return c, fmt.Errorf("line %d: %s is not a server block", server.line, strings.Join(server.args, " "))
+		}
+		var zones []string
+		for _, key := range server.args {
+			zones = append(zones, zoneOf(key))
+		}
+		for _, d := range server.block {
+			if err := c.apply(zones, d); err != nil {
+				return c, fmt.Errorf("line %d: %v", d.line, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Corefile) apply(zones []string, d directive) error {
+	ignore := func(what string) {
+		c.Ignored = append(c.Ignored, fmt.Sprintf("line %d: %s", d.line, what))
+	}
+	switch d.args[0] {
+	case "forward":
+		if len(d.args) < 3 {
+			return fmt.Errorf("forward needs a zone and an upstream")
+		}
+		upstream, err := upstreamOf(d.args[2])
+		if err != nil {
+			return err
+		}
+		if len(d.args) > 3 {
+			ignore("forward to more than one upstream, only " + d.args[2] + " is used")
+		}
+		if d.block != nil {
+			ignore("the options of forward")
+		}
+		from := zones
+		if d.args[1] != "." {
+			from = []string{zoneOf(d.args[1])}
+		}
+		for _, zone := range from {
+			if zone == "." {
+				c.Fallback = upstream
+			} else {
+				c.Forwards = append(c.Forwards, Forward{zone, upstream})
+			}
+		}
+	case "hosts":
+		if c.Hosts == nil {
+			c.Hosts = make(map[string]string)
+		}
+		if len(d.args) > 1 {
+			data, err := ioutil.ReadFile(d.args[1])
+			if err != nil {
+				return err
+			}
+			for i, line := range strings.Split(string(data), "\n") {
+				if comment := strings.Index(line, "#"); comment >= 0 {
+					line = line[:comment]
+				}
+				if fields := strings.Fields(line); len(fields) > 0 {
+					if err := c.host(fields); err != nil {
+						return fmt.Errorf("%s:%d: %v", d.args[1], i+1, err)
+					}
+				}
+			}
+		}
+		for _, entry := range d.block {
+			if entry.args[0] == "fallthrough" || entry.args[0] == "ttl" || entry.args[0] == "reload" || entry.args[0] == "no_reverse" {
+				// teleproxy always falls through, and
+				// never reverses
+				continue
+			}
+			if err := c.host(entry.args); err != nil {
+				return err
+			}
+		}
+	case "rewrite":
+		if len(d.args) != 5 || d.args[1] != "name" || d.args[2] != "suffix" {
+			ignore("rewrite other than name suffix FROM TO")
+			return nil
+		}
+		rewrites, err := ParseRewrites([]string{d.args[3] + "=" + d.args[4]})
+		if err != nil {
+			return err
+		}
+		c.Rewrites = append(c.Rewrites, rewrites...)
+	case "cache":
+		c.MaxTTL = answerTTL
+		if len(d.args) > 1 {
+			ttl, err := strconv.ParseUint(d.args[1], 10, 32)
+			if err != nil || ttl == 0 {
+				return fmt.Errorf("cache ttl %q is not a number of seconds", d.args[1])
+			}
+			c.MaxTTL = uint32(ttl)
+		}
+		if d.block != nil {
+			ignore("the options of cache")
+		}
+	default:
+		ignore("the " + d.args[0] + " plugin")
+	}
+	return nil
+}
+
+func (c *Corefile) host(fields []string) error {
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return fmt.Errorf("hosts entry %q is not an address and names", strings.Join(fields, " "))
+	}
+	if net.ParseIP(fields[0]).To4() == nil {
+		// only A records are answered
+		return nil
+	}
+	for _, name := range fields[1:] {
+		c.Hosts[zoneOf(name)] = fields[0]
+	}
+	return nil
+}
+
+// zoneOf is the name a server block key or a zone stands for, in the
+// form queries have, e.g. "example.com." for "dns://example.com:53".
+func zoneOf(key string) string {
+	key = strings.TrimPrefix(key, "dns://")
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	} else if i := strings.LastIndex(key, ":"); i >= 0 && !strings.Contains(key[:i], ":") {
+		key = key[:i]
+	}
+	zone := strings.Trim(strings.ToLower(key), ".")
+	if zone == "" {
+		return "."
+	}
+	return zone + "."
+}
+
+// upstreamOf is the address to relay to for an upstream of forward,
+// e.g. "10.0.0.10:53" for "dns://10.0.0.10".
+func upstreamOf(upstream string) (string, error) {
+	if strings.Contains(upstream, "://") && !strings.HasPrefix(upstream, "dns://") {
+		return "", fmt.Errorf("upstream %s: only plain dns is supported", upstream)
+	}
+	upstream = strings.TrimPrefix(upstream, "dns://")
+	if net.ParseIP(upstream) != nil {
+		return net.JoinHostPort(upstream, "53"), nil
+	}
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("upstream %s is not an address", upstream)
+	}
+	return upstream, nil
+}
+
+// tokenize splits a Corefile into words, with "\n" ending each line and
+// braces words of their own.
+func tokenize(text string) []string {
+	var tokens []string
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.Replace(line, "{", " { ", -1)
+		line = strings.Replace(line, "}", " } ", -1)
+		tokens = append(tokens, strings.Fields(line)...)
+		tokens = append(tokens, "\n")
+	}
+	return tokens
+}
+
+// A parser parses the directives of a Corefile, from its tokens.
+type parser struct {
+	tokens []string
+	next   int
+	line   int
+}
+
+// block parses directives up to the brace that closes the block, or to
+// the end if top.
+func (p *parser) block(top bool) ([]directive, error) {
+	var directives []directive
+	// whether the last directive is still on its line
+	open := false
+	for p.next < len(p.tokens) {
+		token := p.tokens[p.next]
+		p.next++
+		switch token {
+		case "\n":
+			p.line++
+			open = false
+		case "{":
+			// keys may be on a line of their own, with the
+			// brace on the next one
+			if len(directives) == 0 || directives[len(directives)-1].block != nil {
+				return nil, fmt.Errorf("line %d: block without a directive", p.line)
+			}
+			block, err := p.block(false)
+			if err != nil {
+				return nil, err
+			}
+			if block == nil {
+				block = []directive{}
+			}
+			directives[len(directives)-1].block = block
+			open = false
+		case "}":
+			if top {
+				return nil, fmt.Errorf("line %d: unexpected }", p.line)
+			}
+			return directives, nil
+		default:
+			if !open {
+				directives = append(directives, directive{line: p.line})
+				open = true
+			}
+			d := &directives[len(directives)-1]
+			d.args = append(d.args, token)
+		}
+	}
+	if !top {
+		return nil, fmt.Errorf("line %d: missing }", p.line)
+	}
+	return directives, nil
+}
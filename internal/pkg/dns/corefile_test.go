@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const corefile = `
+# what the platform team runs
+.:53 {
+    errors
+    forward . 1.1.1.1 8.8.8.8
+    cache 30
+    rewrite name suffix .dev.internal. .default.svc.cluster.local.
+    hosts {
+        10.0.0.5 api.internal API.corp
+        fe80::1 v6.internal
+        fallthrough
+    }
+}
+
+corp.example:53 {
+    forward . dns://10.1.0.10:5353 {
+        max_fails 3
+    }
+}
+`
+
+func TestParseCorefile(t *testing.T) {
+	c, err := ParseCorefile(corefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Fallback != "1.1.1.1:53" {
+		t.Errorf("expected the fallback 1.1.1.1:53, got %q", c.Fallback)
+	}
+	if expected := []Forward{{"corp.example.", "10.1.0.10:5353"}}; !reflect.DeepEqual(c.Forwards, expected) {
+		t.Errorf("expected forwards %v, got %v", expected, c.Forwards)
+	}
+	if expected := map[string]string{"api.internal.": "10.0.0.5", "api.corp.": "10.0.0.5"}; !reflect.DeepEqual(c.Hosts, expected) {
+		t.Errorf("expected hosts %v, got %v", expected, c.Hosts)
+	}
+	if expected := []Rewrite{{"dev.internal", "default.svc.cluster.local"}}; !reflect.DeepEqual(c.Rewrites, expected) {
+		t.Errorf("expected rewrites %v, got %v", expected, c.Rewrites)
+	}
+	if c.MaxTTL != 30 {
+		t.Errorf("expected a max ttl of 30, got %d", c.MaxTTL)
+	}
+	ignored := strings.Join(c.Ignored, "\n")
+	for _, what := range []string{"line 4: the errors plugin", "line 5: forward to more than one upstream", "line 16: the options of forward"} {
+		if !strings.Contains(ignored, what) {
+			t.Errorf("expected %q to be ignored, got %q", what, ignored)
+		}
+	}
+}
+
+func TestParseCorefileErrors(t *testing.T) {
+	for _, text := range []string{
+		". {\n  forward . tls://1.1.1.1\n}",
+		". {\n  forward .\n}",
+		". {\n  cache soon\n}",
+		". {\n  hosts {\n    api.internal\n  }\n}",
+		". {\n  errors\n",
+		"}",
+		"forward . 1.1.1.1",
+	} {
+		if _, err := ParseCorefile(text); err == nil {
+			t.Errorf("expected an error for %q", text)
+		}
+	}
+}
+
+func TestCorefileConfigure(t *testing.T) {
+	c, err := ParseCorefile(corefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Fallback: c.Fallback, Resolve: func(domain string) string {
+		if domain == "web.default.svc.cluster.local." {
+			return "10.96.0.10"
+		}
+		return ""
+	}}
+	c.Configure(&s)
+	for name, ip := range map[string]string{"api.internal.": "10.0.0.5", "web.dev.internal.": "10.96.0.10"} {
+		reply := s.respond(query(name, dns.TypeA))
+		if reply == nil || len(reply.Answer) != 1 {
+			t.Errorf("expected %s to be answered, got %v", name, reply)
+			continue
+		}
+		if a := reply.Answer[0].(*dns.A); a.A.String() != ip || a.Hdr.Ttl != 30 {
+			t.Errorf("expected %s to be %s for 30s, got %v", name, ip, a)
+		}
+	}
+	for name, upstream := range map[string]string{"db.corp.example.": "10.1.0.10:5353", "corp.example.": "10.1.0.10:5353", "example.": "1.1.1.1:53"} {
+		if got := s.upstream(name); got != upstream {
+			t.Errorf("expected %s to go to %s, got %s", name, upstream, got)
+		}
+	}
+}
@@ -1,82 +1,344 @@
 package dns
 
 import (
+	"fmt"
 	_log "log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
 )
 
 type Server struct {
 	Listeners []string
-	Fallback  string
-	Resolve   func(string) string
+	// PacketConns are served along with the Listeners, e.g. the
+	// sockets systemd's socket activation passed.
+	PacketConns []net.PacketConn
+	Fallback    string
+	Resolve     func(string) string
+	// Excluded, if set, reports whether a domain must never be
+	// intercepted. Queries for such domains always go to the
+	// fallback server, and the addresses it answers with are
+	// passed to Avoid (if set) so they can be kept out of the
+	// firewall too.
+	Excluded func(string) bool
+	Avoid    func(ips []string)
+	// Provisional, if set, reports whether the answer for a domain
+	// may well be out of date. Such answers are only good for
+	// provisionalTTL, so that clients don't hang on to them.
+	Provisional func(string) bool
+	// Timeouts, if set, says how long queries that go to the
+	// fallback server may take, by the name queried.
+	Timeouts *timeouts.Table
+	// Workers bounds how many queries are relayed to the fallback
+	// server at once, DefaultWorkers if zero; the ones we answer
+	// ourselves never wait. Up to Backlog (DefaultBacklog if zero)
+	// more wait for a worker, and beyond that queries fail with
+	// SERVFAIL right away rather than pile up behind a fallback
+	// server that is slow to answer.
+	Workers int
+	Backlog int
+	// ClientRate, if set, limits each client address to that many
+	// queries a second, in bursts of as many. More are REFUSED, so
+	// that one client gone wild can't starve the rest.
+	ClientRate int
+	// Rewrites map vanity names onto the cluster names they are looked
+	// up as. Names they don't map are relayed as asked.
+	Rewrites []Rewrite
+	// Forwards relay the queries of their zones to upstreams of their
+	// own rather than to Fallback.
+	Forwards []Forward
+	// Hosts answers for names, which end in a dot, right away with
+	// the addresses they map to, ahead of Resolve.
+	Hosts map[string]string
+	// MaxTTL, if set, caps how long answers are good for.
+	MaxTTL uint32
+	// Filter, if set, has the last word on the answer for a name,
+	// given the address we would answer with, "" if none. It
+	// returns the address to answer with instead, "" to relay the
+	// query, or false if the name doesn't exist.
+	Filter func(domain, ip string) (string, bool)
+
+	// queries counts the queries served, accessed atomically
+	queries uint64
+
+	once    sync.Once
+	pool    *pool
+	limiter *limiter
+	// exchange relays a query, to upstream but in tests
+	exchange func(r *dns.Msg, upstream string, timeout time.Duration) (*dns.Msg, error)
+}
+
+const (
+	answerTTL      = 60
+	provisionalTTL = 5
+)
+
+func (s *Server) ttl(domain string) uint32 {
+	ttl := uint32(answerTTL)
+	if s.Provisional != nil && s.Provisional(domain) {
+		ttl = provisionalTTL
+	}
+	if s.MaxTTL > 0 && s.MaxTTL < ttl {
+		ttl = s.MaxTTL
+	}
+	return ttl
 }
 
 func log(line string, args ...interface{}) {
-	_log.Printf("DNS: "+line, args...)
+	_log.Print(route.Annotate(fmt.Sprintf("DNS: "+line, args...)))
 }
 
 func die(line string, args ...interface{}) {
 	_log.Fatalf("DNS: "+line, args...)
 }
 
-func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	domain := strings.ToLower(r.Question[0].Name)
-	switch r.Question[0].Qtype {
-	case dns.TypeA:
-		ip := s.Resolve(domain)
-		if ip != "" {
-			log("QUERY %s -> %s", domain, ip)
-			msg := dns.Msg{}
-			msg.SetReply(r)
-			msg.Authoritative = true
-			// mac dns seems to fallback if you don't
-			// support recursion, if you have more than a
-			// single dns server, this will prevent us
-			// from intercepting all queries
-			msg.RecursionAvailable = true
-			// if we don't give back the same domain
-			// requested, then mac dns seems to return an
-			// nxdomain
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(ip),
-			})
-			w.WriteMsg(&msg)
-			return
+func (s *Server) init() {
+	workers, backlog := s.Workers, s.Backlog
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
+	s.pool = newPool(workers, backlog)
+	if s.ClientRate > 0 {
+		s.limiter = newLimiter(s.ClientRate)
+	}
+	if s.exchange == nil {
+		s.exchange = func(r *dns.Msg, upstream string, timeout time.Duration) (*dns.Msg, error) {
+			client := dns.Client{Net: "udp", Timeout: timeout}
+			in, _, err := client.Exchange(r, upstream)
+			return in, err
 		}
-	default:
-		ip := s.Resolve(domain)
-		if ip != "" {
-			log("QTYPE[%v] %s -> EMPTY", r.Question[0].Qtype, domain)
+	}
+}
+
+// Queries returns how many queries have been served, whatever the
+// answer.
+func (s *Server) Queries() uint64 {
+	return atomic.LoadUint64(&s.queries)
+}
+
+// ServeDNS answers the queries we intercept right away, and relays the
+// rest by way of the pool of workers.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.once.Do(s.init)
+	atomic.AddUint64(&s.queries, 1)
+	if s.limiter != nil {
+		if client := clientOf(w.RemoteAddr()); !s.limiter.allow(client, time.Now()) {
+			log("QUERY from %s -> REFUSED, over %d a second", client, s.ClientRate)
 			msg := dns.Msg{}
-			msg.SetReply(r)
-			msg.Authoritative = true
-			msg.RecursionAvailable = true
+			msg.SetRcode(r, dns.RcodeRefused)
 			w.WriteMsg(&msg)
 			return
 		}
 	}
-	in, err := dns.Exchange(r, s.Fallback)
+	if reply := s.respond(r); reply != nil {
+		w.WriteMsg(reply)
+		return
+	}
+	if !s.pool.acquire() {
+		relaying, waiting := s.pool.busy()
+		log("QUERY -> SERVFAIL, %d relayed and %d waiting already", relaying, waiting)
+		msg := dns.Msg{}
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(&msg)
+		return
+	}
+	defer s.pool.release()
+	var timeout time.Duration
+	upstream := s.Fallback
+	if len(r.Question) > 0 {
+		timeout = s.Timeouts.DNSQuery(r.Question[0].Name, 0)
+		upstream = s.upstream(strings.ToLower(r.Question[0].Name))
+	}
+	in, err := s.exchange(r, upstream, timeout)
 	if err != nil {
 		log(err.Error())
 		return
 	}
+	if s.Avoid != nil && s.excluded(r) {
+		var ips []string
+		for _, rr := range in.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				ips = append(ips, a.A.String())
+			}
+		}
+		if len(ips) > 0 {
+			s.Avoid(ips)
+		}
+	}
 	w.WriteMsg(in)
 }
 
-func (s *Server) Start() {
+// upstream is where queries for domain are relayed: the Forward with the
+// longest zone domain is in, or the fallback server.
+func (s *Server) upstream(domain string) string {
+	upstream, longest := s.Fallback, 0
+	for _, f := range s.Forwards {
+		if (domain == f.Zone || strings.HasSuffix(domain, "."+f.Zone)) && len(f.Zone) > longest {
+			upstream, longest = f.Upstream, len(f.Zone)
+		}
+	}
+	return upstream
+}
+
+func (s *Server) excluded(r *dns.Msg) bool {
+	return s.Excluded != nil && len(r.Question) == 1 &&
+		s.Excluded(strings.ToLower(r.Question[0].Name))
+}
+
+// respond returns our answer to the query, or nil if the query should
+// be relayed to the fallback server. This listens on port 53 for every
+// process on the host, so it must cope with anything that parses as a
+// dns message.
+func (s *Server) respond(r *dns.Msg) *dns.Msg {
+	// the server only rejects messages that don't parse, so there
+	// could be any number of questions
+	if len(r.Question) != 1 {
+		log("QUERY with %d questions -> FORMERR", len(r.Question))
+		msg := dns.Msg{}
+		msg.SetRcode(r, dns.RcodeFormatError)
+		return &msg
+	}
+
+	domain := strings.ToLower(r.Question[0].Name)
+	if s.excluded(r) {
+		log("QUERY %s -> EXCLUDED", domain)
+		return nil
+	}
+	lookup, ip, exists := s.lookup(domain)
+	if !exists {
+		log("QUERY %s -> NXDOMAIN", domain)
+		msg := dns.Msg{}
+		msg.SetRcode(r, dns.RcodeNameError)
+		return &msg
+	}
+	if ip == "" {
+		return nil
+	}
+	if lookup != domain {
+		domain += " (" + lookup + ")"
+	}
+
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	msg.Authoritative = true
+	// mac dns seems to fallback if you don't
+	// support recursion, if you have more than a
+	// single dns server, this will prevent us
+	// from intercepting all queries
+	msg.RecursionAvailable = true
+
+	switch r.Question[0].Qtype {
+	case dns.TypeA:
+		addr := net.ParseIP(ip).To4()
+		if addr == nil {
+			log("QUERY %s -> %s is not an ipv4 address", domain, ip)
+			msg.Rcode = dns.RcodeServerFailure
+			return &msg
+		}
+		log("QUERY %s -> %s", domain, ip)
+		// if we don't give back the same domain
+		// requested, then mac dns seems to return an
+		// nxdomain
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.ttl(lookup)},
+			A:   addr,
+		})
+	default:
+		log("QTYPE[%v] %s -> EMPTY", r.Question[0].Qtype, domain)
+	}
+	return &msg
+}
+
+// lookup is what respond makes of domain, which is lower case and ends
+// in a dot: the name it is looked up as, the address to answer with,
+// "" to relay the query, and whether the name exists at all.
+func (s *Server) lookup(domain string) (lookup, ip string, exists bool) {
+	lookup = rewrite(s.Rewrites, domain)
+	ip = s.Hosts[lookup]
+	if ip == "" {
+		ip = s.Resolve(lookup)
+	}
+	if s.Filter != nil {
+		ip, exists = s.Filter(lookup, ip)
+		return
+	}
+	return lookup, ip, true
+}
+
+// An Answer is what the server would make of a query for a name.
+type Answer struct {
+	Name string `json:"name"`
+	// Lookup is the name looked up, if a rewrite maps Name onto it.
+	Lookup string `json:"lookup,omitempty"`
+	// IP is the address answered with. Without one, the query is
+	// relayed to Upstream, unless the name doesn't exist.
+	IP       string `json:"ip,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	// Excluded is whether the name is never intercepted.
+	Excluded bool   `json:"excluded,omitempty"`
+	NXDomain bool   `json:"nxdomain,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// Answer says what the server would answer a query for name with,
+// without a query being made, or the server even listening.
+func (s *Server) Answer(name string) Answer {
+	domain := strings.ToLower(name)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	answer := Answer{Name: domain}
+	if s.Excluded != nil && s.Excluded(domain) {
+		answer.Excluded = true
+		answer.Upstream = s.upstream(domain)
+		return answer
+	}
+	lookup, ip, exists := s.lookup(domain)
+	if lookup != domain {
+		answer.Lookup = lookup
+	}
+	switch {
+	case !exists:
+		answer.NXDomain = true
+	case ip == "":
+		answer.Upstream = s.upstream(domain)
+	default:
+		answer.IP = ip
+		answer.TTL = s.ttl(lookup)
+	}
+	return answer
+}
+
+// Start listens on the Listeners and serves queries in the background,
+// there and on the PacketConns. It fails if any of the Listeners can't
+// be listened on.
+func (s *Server) Start() error {
 	listeners := make([]net.PacketConn, len(s.Listeners))
 	for i, addr := range s.Listeners {
 		var err error
 		listeners[i], err = net.ListenPacket("udp", addr)
 		if err != nil {
-			die("failed to set up udp listener: %v", err)
+			for _, listener := range listeners[:i] {
+				listener.Close()
+			}
+			return err
 		}
 		log("listening on %s", addr)
 	}
+	for _, conn := range s.PacketConns {
+		log("listening on %s, as systemd does", conn.LocalAddr())
+		listeners = append(listeners, conn)
+	}
 	for _, listener := range listeners {
 		go func(listener net.PacketConn) {
 			srv := &dns.Server{PacketConn: listener, Handler: s}
@@ -85,4 +347,5 @@ func (s *Server) Start() {
 			}
 		}(listener)
 	}
+	return nil
 }
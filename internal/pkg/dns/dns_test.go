@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/miekg/dns"
+)
+
+// resolver intercepts a fixed set of names, so that the properties
+// below are checked against both intercepted and relayed queries.
+func resolver(domain string) string {
+	if strings.HasPrefix(domain, "a") {
+		return "10.0.0.1"
+	}
+	return ""
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, qtype)
+	return msg
+}
+
+func TestRespondDeterministic(t *testing.T) {
+	s := Server{Resolve: resolver}
+	f := func(name string, qtype uint16) bool {
+		return reflect.DeepEqual(s.respond(query(name, qtype)), s.respond(query(name, qtype)))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRespondIntercepts(t *testing.T) {
+	s := Server{Resolve: resolver}
+	f := func(name string, qtype uint16) bool {
+		reply := s.respond(query(name, qtype))
+		intercepted := resolver(strings.ToLower(name)) != ""
+		if !intercepted {
+			return reply == nil
+		}
+		if reply == nil || !reply.Authoritative || reply.Rcode != dns.RcodeSuccess {
+			return false
+		}
+		if qtype != dns.TypeA {
+			return len(reply.Answer) == 0
+		}
+		// the answer must echo the name exactly as asked
+		return len(reply.Answer) == 1 && reply.Answer[0].Header().Name == name
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRespondQuestions(t *testing.T) {
+	s := Server{Resolve: resolver}
+	for _, questions := range [][]dns.Question{
+		nil,
+		{{Name: "a.", Qtype: dns.TypeA}, {Name: "b.", Qtype: dns.TypeA}},
+	} {
+		reply := s.respond(&dns.Msg{Question: questions})
+		if reply == nil || reply.Rcode != dns.RcodeFormatError {
+			t.Errorf("%d questions: expected FORMERR, got %v", len(questions), reply)
+		}
+	}
+}
+
+func TestRespondBadAddress(t *testing.T) {
+	s := Server{Resolve: func(string) string { return "not-an-ip" }}
+	reply := s.respond(query("a.", dns.TypeA))
+	if reply == nil || reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", reply)
+	}
+}
+
+func TestRespondExcluded(t *testing.T) {
+	s := Server{
+		Resolve:  resolver,
+		Excluded: func(domain string) bool { return strings.HasSuffix(domain, ".okta.com.") },
+	}
+	if reply := s.respond(query("a.okta.com.", dns.TypeA)); reply != nil {
+		t.Errorf("expected excluded query to be relayed, got %v", reply)
+	}
+	if reply := s.respond(query("a.default.", dns.TypeA)); reply == nil {
+		t.Errorf("expected query to be intercepted")
+	}
+}
+
+// The proxy only relays TCP, so the udp data path is the dns
+// responder.
+func BenchmarkRespond(b *testing.B) {
+	s := Server{Resolve: resolver}
+	msg := query("a.default.svc.cluster.local.", dns.TypeA)
+	for i := 0; i < b.N; i++ {
+		s.respond(msg)
+	}
+}
+
+func TestRespondProvisional(t *testing.T) {
+	s := Server{Resolve: resolver, Provisional: func(domain string) bool {
+		return domain == "a.stale."
+	}}
+	for name, ttl := range map[string]uint32{"a.stale.": provisionalTTL, "a.fresh.": answerTTL} {
+		reply := s.respond(query(name, dns.TypeA))
+		if len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != ttl {
+			t.Errorf("expected %s to be good for %ds, got %v", name, ttl, reply.Answer)
+		}
+	}
+}
+
+func TestRespondRewrites(t *testing.T) {
+	rewrites, err := ParseRewrites([]string{"Dev.Internal.=default.svc.cluster.local", "internal=svc.cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Rewrites: rewrites, Resolve: func(domain string) string {
+		switch domain {
+		case "web.default.svc.cluster.local.":
+			return "10.0.0.1"
+		case "api.team-a.svc.cluster.local.":
+			return "10.0.0.2"
+		}
+		return ""
+	}}
+	for name, ip := range map[string]string{
+		"web.dev.internal.":    "10.0.0.1",
+		"WEB.dev.internal.":    "10.0.0.1",
+		"api.team-a.internal.": "10.0.0.2",
+		"web.devinternal.":     "",
+		"db.dev.internal.":     "",
+	} {
+		reply := s.respond(query(name, dns.TypeA))
+		if ip == "" {
+			if reply != nil {
+				t.Errorf("expected %s to be relayed, got %v", name, reply)
+			}
+			continue
+		}
+		if reply == nil || len(reply.Answer) != 1 {
+			t.Errorf("expected %s to be answered, got %v", name, reply)
+			continue
+		}
+		a := reply.Answer[0].(*dns.A)
+		if a.Hdr.Name != name || a.A.String() != ip {
+			t.Errorf("expected %s to be %s, got %v", name, ip, a)
+		}
+	}
+}
+
+func TestRespondFilter(t *testing.T) {
+	s := Server{
+		Resolve: func(domain string) string {
+			if domain == "web.prod.svc.cluster.local." || domain == "db.prod.svc.cluster.local." {
+				return "10.96.0.10"
+			}
+			return ""
+		},
+		Filter: func(domain, ip string) (string, bool) {
+			switch domain {
+			case "api.corp.example.":
+				return "10.0.0.5", true
+			case "db.prod.svc.cluster.local.":
+				return "", false
+			case "web.prod.svc.cluster.local.":
+				return "", true
+			}
+			return ip, true
+		},
+	}
+	if reply := s.respond(query("api.corp.example.", dns.TypeA)); reply == nil || len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "10.0.0.5" {
+		t.Errorf("expected the filter to answer, got %v", reply)
+	}
+	if reply := s.respond(query("db.prod.svc.cluster.local.", dns.TypeA)); reply == nil || reply.Rcode != dns.RcodeNameError {
+		t.Errorf("expected the filter to deny, got %v", reply)
+	}
+	if reply := s.respond(query("web.prod.svc.cluster.local.", dns.TypeA)); reply != nil {
+		t.Errorf("expected the filter to relay, got %v", reply)
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	s := Server{
+		Fallback: "8.8.8.8:53",
+		Resolve: func(domain string) string {
+			if domain == "web.default.svc.cluster.local." {
+				return "10.96.0.10"
+			}
+			return ""
+		},
+		Excluded: func(domain string) bool { return domain == "ads.example." },
+		Filter: func(domain, ip string) (string, bool) {
+			return ip, domain != "secret.default.svc.cluster.local."
+		},
+	}
+	s.Rewrites, _ = ParseRewrites([]string{"dev.internal=default.svc.cluster.local"})
+	for _, c := range []struct {
+		name     string
+		expected Answer
+	}{
+		{"Web.Default.svc.cluster.local", Answer{Name: "web.default.svc.cluster.local.", IP: "10.96.0.10", TTL: answerTTL}},
+		{"web.dev.internal.", Answer{Name: "web.dev.internal.", Lookup: "web.default.svc.cluster.local.", IP: "10.96.0.10", TTL: answerTTL}},
+		{"example.com", Answer{Name: "example.com.", Upstream: "8.8.8.8:53"}},
+		{"ads.example", Answer{Name: "ads.example.", Excluded: true, Upstream: "8.8.8.8:53"}},
+		{"secret.default.svc.cluster.local", Answer{Name: "secret.default.svc.cluster.local.", NXDomain: true}},
+	} {
+		if got := s.Answer(c.name); got != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestParseRewrites(t *testing.T) {
+	for _, rule := range []string{"dev.internal", "=svc.cluster.local", "dev.internal=."} {
+		if _, err := ParseRewrites([]string{rule}); err == nil {
+			t.Errorf("expected an error for %q", rule)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWorkers and DefaultBacklog are for Server.Workers and
+	// Server.Backlog.
+	DefaultWorkers = 64
+	DefaultBacklog = 256
+	// how long a client's bucket is kept once it is full again
+	bucketIdle = time.Minute
+)
+
+// A pool bounds how many queries are relayed at once, and how many
+// wait their turn.
+type pool struct {
+	slots   chan struct{}
+	waiting int64
+	backlog int64
+}
+
+func newPool(workers, backlog int) *pool {
+	return &pool{slots: make(chan struct{}, workers), backlog: int64(backlog)}
+}
+
+// acquire takes a worker, waiting for one if need be, unless the
+// backlog is full already.
+func (p *pool) acquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt64(&p.waiting, 1) > p.backlog {
+		atomic.AddInt64(&p.waiting, -1)
+		return false
+	}
+	p.slots <- struct{}{}
+	atomic.AddInt64(&p.waiting, -1)
+	return true
+}
+
+func (p *pool) release() {
+	<-p.slots
+}
+
+// busy returns how many queries are being relayed, and how many wait.
+func (p *pool) busy() (relaying, waiting int) {
+	return len(p.slots), int(atomic.LoadInt64(&p.waiting))
+}
+
+// A limiter is a token bucket per client, each filling at rate tokens a
+// second up to rate of them.
+type limiter struct {
+	rate float64
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int) *limiter {
+	return &limiter{rate: float64(rate), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of client, if it has one.
+func (l *limiter) allow(client string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.swept) > bucketIdle {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the clients whose buckets have been full for a while,
+// which is as good as not having one.
+func (l *limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		full := b.last.Add(time.Duration((l.rate - b.tokens) / l.rate * float64(time.Second)))
+		if now.Sub(full) > bucketIdle {
+			delete(l.buckets, client)
+		}
+	}
+	l.swept = now
+}
+
+// clientOf is the address of a client, without its port.
+func clientOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
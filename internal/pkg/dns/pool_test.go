@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writer is a dns.ResponseWriter that keeps what it is written.
+type writer struct {
+	remote net.Addr
+	mutex  sync.Mutex
+	msgs   []*dns.Msg
+}
+
+func (w *writer) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *writer) RemoteAddr() net.Addr { return w.remote }
+func (w *writer) WriteMsg(m *dns.Msg) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+func (w *writer) Write(b []byte) (int, error) { return len(b), nil }
+func (w *writer) Close() error                { return nil }
+func (w *writer) TsigStatus() error           { return nil }
+func (w *writer) TsigTimersOnly(bool)         {}
+func (w *writer) Hijack()                     {}
+
+func (w *writer) rcodes() (rcodes []int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, m := range w.msgs {
+		rcodes = append(rcodes, m.Rcode)
+	}
+	return
+}
+
+func client(ip string) *writer {
+	return &writer{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestPool(t *testing.T) {
+	unblock := make(chan struct{})
+	relayed := make(chan struct{}, 10)
+	s := &Server{Resolve: resolver, Workers: 2, Backlog: 1}
+	s.exchange = func(r *dns.Msg, upstream string, timeout time.Duration) (*dns.Msg, error) {
+		relayed <- struct{}{}
+		<-unblock
+		return new(dns.Msg).SetReply(r), nil
+	}
+	w := client("127.0.0.1")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ServeDNS(w, query("b.example.com.", dns.TypeA))
+		}()
+	}
+	// two are relayed and one waits
+	<-relayed
+	<-relayed
+	for {
+		if _, waiting := s.pool.busy(); waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// which leaves no room for another
+	s.ServeDNS(w, query("b.example.com.", dns.TypeA))
+	if rcodes := w.rcodes(); len(rcodes) != 1 || rcodes[0] != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", rcodes)
+	}
+	// and the ones we answer don't wait
+	s.ServeDNS(w, query("a.default.", dns.TypeA))
+	if rcodes := w.rcodes(); len(rcodes) != 2 || rcodes[1] != dns.RcodeSuccess {
+		t.Fatalf("expected an answer, got %v", rcodes)
+	}
+	close(unblock)
+	wg.Wait()
+	if rcodes := w.rcodes(); len(rcodes) != 5 {
+		t.Errorf("expected 5 replies, got %v", rcodes)
+	}
+	if relaying, waiting := s.pool.busy(); relaying != 0 || waiting != 0 {
+		t.Errorf("expected an idle pool, got %d relaying and %d waiting", relaying, waiting)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if !l.allow("10.0.0.1", start) {
+			t.Fatalf("query %d of the burst refused", i)
+		}
+	}
+	if l.allow("10.0.0.1", start) {
+		t.Errorf("expected the 11th query to be refused")
+	}
+	if !l.allow("10.0.0.2", start) {
+		t.Errorf("expected another client to be allowed")
+	}
+	// a token a tenth of a second
+	if !l.allow("10.0.0.1", start.Add(100*time.Millisecond)) {
+		t.Errorf("expected a query to be allowed after a tenth of a second")
+	}
+	if l.allow("10.0.0.1", start.Add(100*time.Millisecond)) {
+		t.Errorf("expected only one query to be allowed after a tenth of a second")
+	}
+	// buckets that have been full long enough are forgotten
+	l.allow("10.0.0.3", start.Add(2*bucketIdle))
+	if len(l.buckets) != 1 {
+		t.Errorf("expected idle buckets to be swept, got %d", len(l.buckets))
+	}
+}
+
+func TestServeRefused(t *testing.T) {
+	s := &Server{Resolve: resolver, ClientRate: 2}
+	noisy, quiet := client("172.17.0.2"), client("172.17.0.3")
+	for i := 0; i < 3; i++ {
+		s.ServeDNS(noisy, query("a.default.", dns.TypeA))
+	}
+	s.ServeDNS(quiet, query("a.default.", dns.TypeA))
+	if rcodes := noisy.rcodes(); len(rcodes) != 3 || rcodes[2] != dns.RcodeRefused {
+		t.Errorf("expected the third query to be refused, got %v", rcodes)
+	}
+	if rcodes := quiet.rcodes(); len(rcodes) != 1 || rcodes[0] != dns.RcodeSuccess {
+		t.Errorf("expected the other client to be answered, got %v", rcodes)
+	}
+}
+
+// BenchmarkServeDNS answers queries from many clients at once, which
+// takes no worker.
+func BenchmarkServeDNS(b *testing.B) {
+	s := &Server{Resolve: resolver}
+	b.RunParallel(func(pb *testing.PB) {
+		w := client("127.0.0.1")
+		msg := query("a.default.svc.cluster.local.", dns.TypeA)
+		for pb.Next() {
+			s.ServeDNS(w, msg)
+			w.msgs = w.msgs[:0]
+		}
+	})
+}
+
+// BenchmarkServeDNSRelayed relays queries to a fallback server that
+// takes a millisecond to answer, from 256 clients at once, as a
+// parallel build might. Each relay holds a worker for the millisecond,
+// so the default pool has room for some 64000 queries a second, where
+// relaying one at a time would manage 1000.
+func BenchmarkServeDNSRelayed(b *testing.B) {
+	s := &Server{Resolve: resolver}
+	s.exchange = func(r *dns.Msg, upstream string, timeout time.Duration) (*dns.Msg, error) {
+		time.Sleep(time.Millisecond)
+		return new(dns.Msg).SetReply(r), nil
+	}
+	b.SetParallelism(256 / runtime.GOMAXPROCS(0))
+	b.RunParallel(func(pb *testing.PB) {
+		w := client("127.0.0.1")
+		msg := query("b.example.com.", dns.TypeA)
+		for pb.Next() {
+			s.ServeDNS(w, msg)
+			w.msgs = w.msgs[:0]
+		}
+	})
+}
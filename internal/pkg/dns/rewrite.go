@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Rewrite maps the names under a vanity suffix onto cluster names,
+// e.g. with From "dev.internal" and To "default.svc.cluster.local",
+// web.dev.internal is looked up as web.default.svc.cluster.local. The
+// answer is given for the name that was asked for.
+type Rewrite struct {
+	From string
+	To   string
+}
+
+func (r Rewrite) String() string {
+	return r.From + "=" + r.To
+}
+
+// ParseRewrites parses rules like "dev.internal=default.svc.cluster.local".
+func ParseRewrites(rules []string) ([]Rewrite, error) {
+	var result []Rewrite
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rewrite %q is not suffix=suffix", rule)
+		}
+		rewrite := Rewrite{From: normalize(parts[0]), To: normalize(parts[1])}
+		if rewrite.From == "" || rewrite.To == "" {
+			return nil, fmt.Errorf("rewrite %q has an empty suffix", rule)
+		}
+		result = append(result, rewrite)
+	}
+	return result, nil
+}
+
+func normalize(suffix string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+}
+
+// rewrite returns the name that domain, which ends in a dot, is looked
+// up as: that of the first of rules with a suffix it has, or domain
+// itself if none do.
+func rewrite(rules []Rewrite, domain string) string {
+	name := strings.TrimSuffix(domain, ".")
+	for _, rule := range rules {
+		if name == rule.From {
+			return rule.To + "."
+		}
+		if strings.HasSuffix(name, "."+rule.From) {
+			return strings.TrimSuffix(name, rule.From) + rule.To + "."
+		}
+	}
+	return domain
+}
@@ -23,6 +23,7 @@ func OverrideSearchDomains(domains string) func() {
 	for _, iface := range ifaces {
 		// setup dns search path
 		domain, _ := getSearchDomains(iface)
+		log("previous search domains for %s: %s", iface, domain)
 		setSearchDomains(iface, domains)
 		previous = append(previous, searchDomains{iface, domain})
 	}
@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// A Shim runs a copy of teleproxy inside the Docker VM. With Docker
+// Desktop on macOS containers live inside a linux VM, so their traffic
+// never passes through the host's pf rules. The shim intercepts that
+// traffic with iptables inside the VM, relays it through the host's
+// SOCKS tunnel, and mirrors its routing tables from the host
+// teleproxy's API.
+type Shim struct {
+	Image string
+	Name  string
+}
+
+// NewShim returns a Shim that runs the given image.
+func NewShim(image string) *Shim {
+	return &Shim{
+		Image: image,
+		Name:  "teleproxy-shim",
+	}
+}
+
+func (s *Shim) log(line string, args ...interface{}) {
+	log.Printf("SHM: "+line, args...)
+}
+
+// UpstreamTokenEnv is the environment variable the shim takes the
+// token of the host teleproxy's API from.
+const UpstreamTokenEnv = "TELEPROXY_UPSTREAM_TOKEN"
+
+// Start launches the shim container. The upstream is the URL of the
+// host teleproxy's API as seen from inside the VM, which takes the
+// token, and socks is the host's SOCKS tunnel as seen from inside the
+// VM.
+func (s *Shim) Start(upstream, socks, token string) error {
+	// clean up anything left over from a previous run
+	s.Stop()
+	// the token goes in a file rather than on the command line,
+	// where anyone on the host could see it
+	env, err := ioutil.TempFile("", "teleproxy-shim")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(env.Name())
+	_, err = env.WriteString(UpstreamTokenEnv + "=" + token + "\n")
+	if cerr := env.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tpu.CmdLogf([]string{"docker", "run", "--detach", "--rm",
+		"--name", s.Name,
+		"--env-file", env.Name(),
+		// the host network here is the VM's network, which
+		// is what we need to be intercepting
+		"--net=host",
+		"--privileged",
+		s.Image,
+		"-mode", "shim",
+		"-upstream", upstream,
+		"-socks", socks}, s.log)
+	return err
+}
+
+// Stop removes the shim container. The shim cleans up the iptables
+// rules it installed inside the VM when it receives SIGTERM, so we
+// give it a chance to do that before forcibly removing it.
+func (s *Shim) Stop() {
+	tpu.CmdLogf([]string{"docker", "stop", "--time", "10", s.Name}, s.log)
+	tpu.CmdLogf([]string{"docker", "rm", "--force", s.Name}, s.log)
+}
@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeDocker puts a docker on the PATH that logs how it was run, and
+// any env file it was given, and returns the log.
+func fakeDocker(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n" +
+		"for arg; do [ \"$prev\" = --env-file ] && cat \"$arg\" >> " + calls + "; prev=$arg; done\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return calls, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestShim(t *testing.T) {
+	calls, cleanup := fakeDocker(t)
+	defer cleanup()
+
+	shim := NewShim("datawire/teleproxy-shim")
+	if err := shim.Start("http://host.docker.internal:8080", "host.docker.internal:1080", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	shim.Stop()
+
+	content, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		// what a previous run left
+		"stop --time 10 teleproxy-shim",
+		"rm --force teleproxy-shim",
+		"run --detach --rm --name teleproxy-shim --env-file ENV --net=host --privileged datawire/teleproxy-shim" +
+			" -mode shim -upstream http://host.docker.internal:8080 -socks host.docker.internal:1080",
+		// the token, where only the shim sees it
+		"TELEPROXY_UPSTREAM_TOKEN=secret",
+		"stop --time 10 teleproxy-shim",
+		"rm --force teleproxy-shim",
+	}
+	got := regexp.MustCompile(`--env-file \S+`).ReplaceAllString(string(content), "--env-file ENV")
+	if lines := strings.Split(strings.TrimSpace(got), "\n"); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), content)
+	}
+	if files, _ := filepath.Glob(filepath.Join(os.TempDir(), "teleproxy-shim*")); len(files) > 0 {
+		t.Errorf("expected the env file to be removed, got %v", files)
+	}
+}
@@ -2,8 +2,10 @@ package docker
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os/exec"
 	"strings"
 	"time"
@@ -13,10 +15,50 @@ import (
 
 type empty struct{}
 
+// A Runtime describes a docker compatible container engine CLI.
+type Runtime struct {
+	Command string
+	// the names of the events emitted when a container starts
+	// and stops
+	Events []string
+}
+
+var (
+	Docker = Runtime{Command: "docker", Events: []string{"start", "die"}}
+	// Podman's CLI is docker compatible except for the name of
+	// the stop event. Rootless podman containers reach the network
+	// through slirp4netns, which runs as a regular host process, so
+	// their traffic hits the OUTPUT chain just like any local
+	// process.
+	Podman = Runtime{Command: "podman", Events: []string{"start", "died"}}
+)
+
+// Runtimes lists the supported runtimes in the order they are
+// detected.
+var Runtimes = []Runtime{Docker, Podman}
+
+// RuntimeNamed returns the named runtime, or nil for "" and "auto".
+func RuntimeNamed(name string) (*Runtime, error) {
+	if name == "" || name == "auto" {
+		return nil, nil
+	}
+	for _, r := range Runtimes {
+		if r.Command == name {
+			r := r
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown container runtime: %s", name)
+}
+
 type Watcher struct {
 	Containers map[string]string
-	stop       chan empty
-	done       chan empty
+	// Runtime is the container engine to watch. If nil, the
+	// first available one in Runtimes is used.
+	Runtime *Runtime
+	runtime Runtime
+	stop    chan empty
+	done    chan empty
 }
 
 func NewWatcher() *Watcher {
@@ -71,7 +113,7 @@ func (w *Watcher) Stop() {
 }
 
 func (w *Watcher) containers() (result map[string]string, err error) {
-	ids, err := tpu.CmdLogf([]string{"docker", "container", "list", "-q"}, w.log)
+	ids, err := tpu.CmdLogf([]string{w.runtime.Command, "container", "list", "-q"}, w.log)
 	if err != nil {
 		return
 	}
@@ -80,7 +122,7 @@ func (w *Watcher) containers() (result map[string]string, err error) {
 
 	lines := ""
 	if ids != "" {
-		lines, err = tpu.CmdLogf(append([]string{"docker", "inspect", "--format={{.Name}} {{.NetworkSettings.IPAddress}}", "--"}, ids), w.log)
+		lines, err = tpu.CmdLogf(append([]string{w.runtime.Command, "inspect", "--format={{.Name}} {{.NetworkSettings.IPAddress}}", "--"}, ids), w.log)
 		if err != nil {
 			return
 		}
@@ -101,17 +143,33 @@ func (w *Watcher) containers() (result map[string]string, err error) {
 	return
 }
 
-func (w *Watcher) checkDocker(warn bool) bool {
-	output, err := tpu.Cmd("docker", "version")
-	if err != nil {
+// checkRuntime reports whether a container runtime is available,
+// and selects it for use by the watcher.
+func (w *Watcher) checkRuntime(warn bool) bool {
+	candidates := Runtimes
+	if w.Runtime != nil {
+		candidates = []Runtime{*w.Runtime}
+	}
+	var names []string
+	for _, r := range candidates {
+		output, err := tpu.Cmd(r.Command, "version")
+		if err == nil {
+			if r.Command != w.runtime.Command {
+				w.log("using %s", r.Command)
+			}
+			w.runtime = r
+			return true
+		}
 		if warn {
 			w.log(output)
 			w.log(err.Error())
-			w.log("docker is required for docker bridge functionality")
 		}
-		return false
+		names = append(names, r.Command)
 	}
-	return true
+	if warn {
+		w.log("%s is required for docker bridge functionality", strings.Join(names, " or "))
+	}
+	return false
 }
 
 func (w *Watcher) waiter() chan empty {
@@ -122,7 +180,7 @@ func (w *Watcher) waiter() chan empty {
 
 		for {
 			for count := 0; true; count += 1 {
-				if w.checkDocker((count % 60) == 0) {
+				if w.checkRuntime((count % 60) == 0) {
 					break
 				} else {
 					time.Sleep(1 * time.Second)
@@ -153,10 +211,10 @@ func (w *Watcher) waiter() chan empty {
 }
 
 func (w *Watcher) containerEvents() io.ReadCloser {
-	command := []string{"docker", "events",
-		"--filter", "type=container",
-		"--filter", "event=start",
-		"--filter", "event=die"}
+	command := []string{w.runtime.Command, "events", "--filter", "type=container"}
+	for _, event := range w.runtime.Events {
+		command = append(command, "--filter", "event="+event)
+	}
 	w.log(strings.Join(command, " "))
 	cmd := exec.Command(command[0], command[1:]...)
 	events, err := cmd.StdoutPipe()
@@ -173,3 +231,73 @@ func (w *Watcher) containerEvents() io.ReadCloser {
 
 	return events
 }
+
+// bridges are the host side interfaces of the default networks
+// created by the container runtimes we know about
+var bridges = []string{"docker0", "podman0", "cni-podman0"}
+
+// BridgeAddrs returns the IPv4 addresses of any container bridge
+// interfaces present on this host.
+func BridgeAddrs() (result []string) {
+	for _, name := range bridges {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				result = append(result, ipnet.IP.String())
+			}
+		}
+	}
+	return
+}
+
+// NetworkInterface returns the host side bridge interface of the
+// named container network. Names of existing interfaces (e.g. br-1234
+// or docker0) are passed through unchanged.
+func (r Runtime) NetworkInterface(network string) (string, error) {
+	if _, err := net.InterfaceByName(network); err == nil {
+		return network, nil
+	}
+
+	format := "{{.Id}} {{index .Options \"com.docker.network.bridge.name\"}}"
+	if r.Command == Podman.Command {
+		format = "{{.Id}} {{.NetworkInterface}}"
+	}
+	output, err := tpu.Cmd(r.Command, "network", "inspect", "--format", format, "--", network)
+	if err != nil {
+		return "", fmt.Errorf("%s: unable to inspect network %s: %v", r.Command, network, err)
+	}
+
+	fields := strings.Fields(output)
+	switch {
+	case len(fields) > 1 && fields[1] != "<no value>":
+		return fields[1], nil
+	case len(fields) > 0 && r.Command == Docker.Command:
+		// user defined docker bridges are named after the
+		// network id unless the name was set explicitly
+		id := fields[0]
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		return "br-" + id, nil
+	default:
+		return "", fmt.Errorf("%s: network %s has no bridge interface", r.Command, network)
+	}
+}
+
+// DetectRuntime returns the first runtime in Runtimes that is
+// available on this host.
+func DetectRuntime() (Runtime, error) {
+	for _, r := range Runtimes {
+		if _, err := tpu.Cmd(r.Command, "version"); err == nil {
+			return r, nil
+		}
+	}
+	return Runtime{}, fmt.Errorf("no container runtime found")
+}
@@ -0,0 +1,214 @@
+// Package graph draws what the local processes talked to through
+// teleproxy: each process, the services it connected to, and the
+// namespaces of the cluster those are in, from the usage of a session
+// or its access log.
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+// The kinds of Node.
+const (
+	Process     = "process"
+	Service     = "service"
+	Namespace   = "namespace"
+	Destination = "destination"
+)
+
+// A Node is a process, a service, a namespace, or a destination that
+// is no service's address.
+type Node struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// PIDs are those of the processes of the name, where known.
+	PIDs []int `json:"pids,omitempty"`
+}
+
+// An Edge is from a process to what it connected to, or from a
+// service to its namespace. The counts are those of the access log,
+// the usage has none per edge.
+type Edge struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Connections uint64 `json:"connections,omitempty"`
+	Sent        uint64 `json:"sent,omitempty"`
+	Received    uint64 `json:"received,omitempty"`
+}
+
+// A Graph collects nodes and edges as they are added.
+type Graph struct {
+	nodes map[string]*Node
+	pids  map[string]map[int]bool
+	edges map[[2]string]*Edge
+}
+
+// New returns an empty Graph.
+func New() *Graph {
+	return &Graph{
+		nodes: make(map[string]*Node),
+		pids:  make(map[string]map[int]bool),
+		edges: make(map[[2]string]*Edge),
+	}
+}
+
+func (g *Graph) node(kind, name string) string {
+	id := kind + ":" + name
+	if _, ok := g.nodes[id]; !ok {
+		g.nodes[id] = &Node{ID: id, Kind: kind, Name: name}
+	}
+	return id
+}
+
+func (g *Graph) edge(from, to string) *Edge {
+	e, ok := g.edges[[2]string{from, to}]
+	if !ok {
+		e = &Edge{From: from, To: to}
+		g.edges[[2]string{from, to}] = e
+	}
+	return e
+}
+
+// process adds the process, with pid unless it is 0.
+func (g *Graph) process(name string, pid int) string {
+	id := g.node(Process, name)
+	if pid != 0 {
+		if g.pids[id] == nil {
+			g.pids[id] = make(map[int]bool)
+		}
+		g.pids[id][pid] = true
+	}
+	return id
+}
+
+// connect adds an edge from process to where it connected, a service
+// named as in "default/web", which is in the namespace named first, or
+// else a destination.
+func (g *Graph) connect(process, to string) *Edge {
+	var target string
+	if slash := strings.Index(to, "/"); slash > 0 {
+		target = g.node(Service, to)
+		g.edge(target, g.node(Namespace, to[:slash]))
+	} else {
+		target = g.node(Destination, to)
+	}
+	return g.edge(process, target)
+}
+
+// AddReport adds the processes of the usage of a session, and what
+// they connected to.
+func (g *Graph) AddReport(r proxy.Report) {
+	for name, pt := range r.Processes {
+		process := g.process(name, 0)
+		for _, pid := range pt.PIDs {
+			g.process(name, pid)
+		}
+		for _, destination := range pt.Destinations {
+			g.connect(process, destination)
+		}
+	}
+}
+
+// AddEntry adds the connection of an access log entry. Those whose
+// process wasn't found are left out, as they are of the usage.
+func (g *Graph) AddEntry(entry proxy.Entry) {
+	to := entry.Service
+	if to == "" {
+		to = entry.Destination
+	}
+	if entry.Process == "" || to == "" {
+		return
+	}
+	e := g.connect(g.process(entry.Process, entry.PID), to)
+	e.Connections++
+	e.Sent += entry.Sent
+	e.Received += entry.Received
+}
+
+var kinds = map[string]int{Process: 0, Service: 1, Destination: 2, Namespace: 3}
+
+// Nodes returns the nodes, processes first and namespaces last, each
+// by name.
+func (g *Graph) Nodes() []Node {
+	nodes := make([]Node, 0, len(g.nodes))
+	for id, n := range g.nodes {
+		node := *n
+		for pid := range g.pids[id] {
+			node.PIDs = append(node.PIDs, pid)
+		}
+		sort.Ints(node.PIDs)
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Kind != nodes[j].Kind {
+			return kinds[nodes[i].Kind] < kinds[nodes[j].Kind]
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// Edges returns the edges, by where they are from and to.
+func (g *Graph) Edges() []Edge {
+	edges := make([]Edge, 0, len(g.edges))
+	for _, e := range g.edges {
+		edges = append(edges, *e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// JSON is what a Graph is written as in json.
+type JSON struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// JSON returns the nodes and edges.
+func (g *Graph) JSON() JSON {
+	return JSON{Nodes: g.Nodes(), Edges: g.Edges()}
+}
+
+var shapes = map[string]string{Process: "box", Service: "ellipse", Destination: "plaintext", Namespace: "folder"}
+
+// DOT returns the graph in graphviz's dot language, left to right.
+func (g *Graph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph teleproxy {\n\trankdir=LR;\n")
+	for _, n := range g.Nodes() {
+		label := n.Name
+		if len(n.PIDs) > 0 {
+			pids := make([]string, len(n.PIDs))
+			for i, pid := range n.PIDs {
+				pids[i] = fmt.Sprint(pid)
+			}
+			label += "\\npid " + strings.Join(pids, ", ")
+		}
+		fmt.Fprintf(&b, "\t%s [label=%s, shape=%s];\n", quote(n.ID), quote(label), shapes[n.Kind])
+	}
+	for _, e := range g.Edges() {
+		fmt.Fprintf(&b, "\t%s -> %s", quote(e.From), quote(e.To))
+		if e.Connections > 0 {
+			fmt.Fprintf(&b, " [label=%s]", quote(fmt.Sprintf("%d connections, %d bytes sent, %d received", e.Connections, e.Sent, e.Received)))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// quote quotes s as an id of the dot language, where only double
+// quotes need escaping. Backslashes are left, for the \n of labels.
+func quote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,61 @@
+package graph
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+func TestAddReport(t *testing.T) {
+	g := New()
+	g.AddReport(proxy.Report{Processes: map[string]proxy.ProcessTraffic{
+		"curl": {PIDs: []int{12, 7}, Destinations: []string{"default/web", "10.0.0.9:443"}},
+		"node": {PIDs: []int{30}, Destinations: []string{"default/api", "billing/db"}},
+	}})
+	var ids []string
+	for _, n := range g.Nodes() {
+		ids = append(ids, n.ID)
+	}
+	expected := []string{
+		"process:curl", "process:node",
+		"service:billing/db", "service:default/api", "service:default/web",
+		"destination:10.0.0.9:443",
+		"namespace:billing", "namespace:default",
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("nodes: %v", ids)
+	}
+	if pids := g.Nodes()[0].PIDs; !reflect.DeepEqual(pids, []int{7, 12}) {
+		t.Errorf("pids of curl: %v", pids)
+	}
+	if edges := g.Edges(); len(edges) != 7 || edges[0] != (Edge{From: "process:curl", To: "destination:10.0.0.9:443"}) {
+		t.Errorf("edges: %+v", edges)
+	}
+}
+
+func TestAddEntry(t *testing.T) {
+	g := New()
+	g.AddEntry(proxy.Entry{PID: 7, Process: "curl", Destination: "10.96.0.10:80", Service: "default/web", Sent: 10, Received: 100})
+	g.AddEntry(proxy.Entry{PID: 8, Process: "curl", Destination: "10.96.0.10:80", Service: "default/web", Sent: 20, Received: 200})
+	// the process isn't known
+	g.AddEntry(proxy.Entry{Destination: "10.96.0.11:80", Service: "default/api"})
+	expected := []Edge{
+		{From: "process:curl", To: "service:default/web", Connections: 2, Sent: 30, Received: 300},
+		{From: "service:default/web", To: "namespace:default"},
+	}
+	if edges := g.Edges(); !reflect.DeepEqual(edges, expected) {
+		t.Errorf("edges: %+v", edges)
+	}
+	dot := g.DOT()
+	for _, line := range []string{
+		`"process:curl" [label="curl\npid 7, 8", shape=box];`,
+		`"process:curl" -> "service:default/web" [label="2 connections, 30 bytes sent, 300 received"];`,
+		`"service:default/web" -> "namespace:default";`,
+	} {
+		if !strings.Contains(dot, "\t"+line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, dot)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package hosts keeps blocks of entries of teleproxy's own in the hosts
+// file, each between markers of its own, so that they can be updated
+// and removed without touching the rest of the file.
+package hosts
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// A File is one block of a hosts file.
+type File struct {
+	path  string
+	begin string
+	end   string
+
+	mutex sync.Mutex
+	block string
+}
+
+// NewFile returns the block of the hosts file at path that is marked
+// with name, e.g. "teleproxy loopback".
+func NewFile(path, name string) *File {
+	return &File{path: path, begin: "# BEGIN " + name, end: "# END " + name}
+}
+
+// Write replaces the block, unless it is the same already. An empty
+// block removes it.
+func (f *File) Write(block string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if block == f.block {
+		return nil
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.path, []byte(f.Splice(string(content), block)), info.Mode()); err != nil {
+		return err
+	}
+	f.block = block
+	return nil
+}
+
+// Block returns the block as it was last written.
+func (f *File) Block() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.block
+}
+
+// Splice replaces the block within content, the content of a hosts
+// file.
+func (f *File) Splice(content, block string) string {
+	var result []string
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		switch {
+		case line == f.begin:
+			inside = true
+		case line == f.end:
+			inside = false
+		case !inside:
+			result = append(result, line)
+		}
+	}
+	for len(result) > 0 && result[len(result)-1] == "" {
+		result = result[:len(result)-1]
+	}
+	if block != "" {
+		result = append(result, f.begin, block, f.end)
+	}
+	return strings.Join(result, "\n") + "\n"
+}
+
+// Entries renders addresses, by name, as lines of a hosts file. Names
+// of services, like web.default.svc.cluster.local, also get their
+// short name, web.default, since without teleproxy's dns server
+// nothing searches the cluster domain.
+func Entries(names map[string]string) string {
+	var lines []string
+	for name, ip := range names {
+		aliases := name
+		if i := strings.Index(name, ".svc."); i > 0 {
+			aliases += " " + name[:i]
+		}
+		lines = append(lines, ip+" "+aliases)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// A Publisher names the routes of the interceptor in the hosts file, in
+// place of its dns server.
+type Publisher struct {
+	file   *File
+	routes func() []rt.Route
+	match  func(name string) bool
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewPublisher returns a Publisher that polls routes for the names that
+// match, into the hosts file at path.
+func NewPublisher(path string, routes func() []rt.Route, match func(name string) bool) *Publisher {
+	return &Publisher{
+		file:   NewFile(path, "teleproxy"),
+		routes: routes,
+		match:  match,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (p *Publisher) log(line string, args ...interface{}) {
+	log.Printf("HST: "+line, args...)
+}
+
+// Start publishes the routes once a second, and whenever woken, until
+// Stop is called.
+func (p *Publisher) Start() {
+	p.log("naming routes in %s", p.file.path)
+	go func() {
+		defer close(p.done)
+		for {
+			p.publish(p.routes())
+			select {
+			case <-p.stop:
+				p.publish(nil)
+				return
+			case <-p.wake:
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// Wake makes the routes be published right away, e.g. because they
+// just changed, rather than at the next poll.
+func (p *Publisher) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop takes the block out of the hosts file.
+func (p *Publisher) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *Publisher) publish(routes []rt.Route) {
+	names := make(map[string]string)
+	for _, route := range routes {
+		if route.Name != "" && route.Ip != "" && p.match(route.Name) {
+			names[route.Name] = route.Ip
+		}
+	}
+	block := Entries(names)
+	if block == p.file.Block() {
+		return
+	}
+	if err := p.file.Write(block); err != nil {
+		p.log("error updating %s: %v", p.file.path, err)
+		return
+	}
+	dns.Flush()
+}
@@ -0,0 +1,69 @@
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestSplice(t *testing.T) {
+	f := NewFile("/etc/hosts", "teleproxy")
+	hosts := "127.0.0.1 localhost\n"
+	spliced := f.Splice(hosts, "10.96.0.10 web.default.svc.cluster.local web.default")
+	if spliced != "127.0.0.1 localhost\n# BEGIN teleproxy\n10.96.0.10 web.default.svc.cluster.local web.default\n# END teleproxy\n" {
+		t.Errorf("spliced:\n%s", spliced)
+	}
+	if again := f.Splice(spliced, "10.96.0.11 api"); strings.Count(again, "# BEGIN") != 1 || strings.Contains(again, "web") {
+		t.Errorf("respliced:\n%s", again)
+	}
+	if removed := f.Splice(spliced, ""); removed != hosts {
+		t.Errorf("removed:\n%s", removed)
+	}
+	// other blocks are left alone
+	other := NewFile("/etc/hosts", "teleproxy loopback").Splice(hosts, "127.0.2.1 web.default")
+	if both := f.Splice(other, "10.96.0.11 api"); !strings.Contains(both, "127.0.2.1 web.default\n") || !strings.Contains(both, "10.96.0.11 api\n") {
+		t.Errorf("both:\n%s", both)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	entries := Entries(map[string]string{
+		"web.default.svc.cluster.local": "10.96.0.10",
+		"teleproxy":                     "127.254.254.254",
+	})
+	if entries != "10.96.0.10 web.default.svc.cluster.local web.default\n127.254.254.254 teleproxy" {
+		t.Errorf("entries:\n%s", entries)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644)
+
+	routes := []rt.Route{
+		{Name: "web.default.svc.cluster.local", Ip: "10.96.0.10", Proto: "tcp"},
+		{Name: "api.payments.svc.cluster.local", Ip: "10.96.0.11", Proto: "tcp"},
+		{Ip: "10.96.0.10", Proto: "udp"},
+	}
+	p := NewPublisher(path, func() []rt.Route { return routes }, func(name string) bool {
+		return strings.HasSuffix(name, ".default.svc.cluster.local")
+	})
+	p.publish(routes)
+	content, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(content), "10.96.0.10 web.default.svc.cluster.local web.default\n") || strings.Contains(string(content), "payments") {
+		t.Errorf("hosts:\n%s", content)
+	}
+	p.publish(nil)
+	if content, _ := ioutil.ReadFile(path); string(content) != "127.0.0.1 localhost\n" {
+		t.Errorf("hosts after publishing nothing:\n%s", content)
+	}
+}
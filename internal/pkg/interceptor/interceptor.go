@@ -2,49 +2,476 @@ package interceptor
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/datawire/teleproxy/internal/pkg/coexist"
+	"github.com/datawire/teleproxy/internal/pkg/lsm"
 	"github.com/datawire/teleproxy/internal/pkg/nat"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
 	rt "github.com/datawire/teleproxy/internal/pkg/route"
 )
 
 type Interceptor struct {
-	translator *nat.Translator
+	translator nat.Translator
 	tables     map[string]rt.Table
 	tablesLock sync.RWMutex
 
 	domains     map[string]rt.Route
+	never       []string
+	avoid       map[string]bool
+	started     bool
 	domainsLock sync.RWMutex
 
 	search     []string
 	searchLock sync.RWMutex
+
+	// resolvers decide where intercepted connections go, in order
+	resolvers []Resolver
+
+	errors []string
+	// failing are the addresses whose last firewall operation
+	// failed, the zero one standing for the firewall as a whole
+	failing    map[nat.Address]bool
+	denied     []string
+	refused    []string
+	unchecked  []string
+	ports      map[string]int
+	conflicts  []coexist.Conflict
+	security   []lsm.Module
+	stale      map[string]time.Time
+	unhealthy  map[string]Command
+	overlaps   []coexist.Overlap
+	routed     []string
+	usage      func() proxy.Report
+	totals     func() (session, lifetime Totals)
+	dns        *DNS
+	updates    nat.Timing
+	errorsLock sync.Mutex
+}
+
+// maxErrors bounds how many recent failures we remember for status
+// reporting.
+const maxErrors = 10
+
+// Status summarizes the health of the interceptor.
+type Status struct {
+	// Healthy is false while the last firewall operation on any
+	// address failed, until one on that address succeeds or its
+	// mapping is removed, and while a command is Unhealthy.
+	Healthy bool `json:"healthy"`
+	// Errors lists the recent failures, whether or not they are
+	// over.
+	Errors []string `json:"errors,omitempty"`
+	// Denied lists destinations that policy forbids intercepting.
+	Denied []string `json:"denied,omitempty"`
+	// Refused lists the most recent destinations that the teleproxy
+	// pods refused to connect to because their policy forbids it,
+	// last last.
+	Refused []string `json:"refused,omitempty"`
+	// Unchecked lists the teleproxy pods whose host key was trusted
+	// on first use, as -trust-first-host-key allows, since it couldn't
+	// be fetched through the kubernetes api to check it.
+	Unchecked []string `json:"unchecked,omitempty"`
+	// Ports lists the local ports teleproxy uses, by purpose.
+	Ports map[string]int `json:"ports,omitempty"`
+	// Conflicts lists other tools found intercepting traffic.
+	Conflicts []coexist.Conflict `json:"conflicts,omitempty"`
+	// Security lists the security modules, SELinux and AppArmor,
+	// found at startup.
+	Security []lsm.Module `json:"security,omitempty"`
+	// Stale lists tables that are last known answers rather than
+	// current ones, with when they went stale.
+	Stale map[string]time.Time `json:"stale,omitempty"`
+	// Overlaps lists local networks that intercepted ranges clash
+	// with.
+	Overlaps []coexist.Overlap `json:"overlaps,omitempty"`
+	// Unhealthy lists the commands kept running for the session,
+	// e.g. ssh, that keep dying, with their health.
+	Unhealthy map[string]Command `json:"unhealthy,omitempty"`
+	// Routed lists the ranges routed through a device of our own.
+	Routed []string `json:"routed,omitempty"`
+	// Usage counts the bytes relayed through the tunnel.
+	Usage *proxy.Report `json:"usage,omitempty"`
+	// Session and Lifetime total what this session relayed, and what
+	// every session there has been did.
+	Session  *Totals `json:"session,omitempty"`
+	Lifetime *Totals `json:"lifetime,omitempty"`
+	// DNS is how dns queries reach teleproxy.
+	DNS *DNS `json:"dns,omitempty"`
+	// Programming is how long programming the firewall takes.
+	Programming Programming `json:"programming"`
+	// Plan, when observing only, is what the firewall would be
+	// programmed with, a rule a line.
+	Plan []string `json:"plan,omitempty"`
+}
+
+// Command is the health of a command kept running for the session,
+// e.g. "flapping", and how it last died.
+type Command struct {
+	Health   string `json:"health"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+// Programming is how long programming the firewall takes: each run of
+// the tools it takes, by tool, and each update of a table that changed
+// mappings, all told.
+type Programming struct {
+	Commands map[string]nat.Timing `json:"commands,omitempty"`
+	Updates  nat.Timing            `json:"updates"`
 }
 
-func NewInterceptor(name string) *Interceptor {
+func (p Programming) String() string {
+	line := fmt.Sprintf("%d updates took %v at most, %v on average", p.Updates.Count, p.Updates.Max, p.Updates.Mean())
+	var tools []string
+	for tool := range p.Commands {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	for _, tool := range tools {
+		t := p.Commands[tool]
+		line += fmt.Sprintf("; %s ran %d times, %v at most, %v on average", tool, t.Count, t.Max, t.Mean())
+	}
+	return line
+}
+
+// DNS is how dns queries reach teleproxy, since whatever owns port 53
+// is left alone.
+type DNS struct {
+	// Strategy is "redirect", queries to Nameserver being redirected
+	// by the firewall to the dns server of teleproxy on Port, or
+	// "hosts", names being published in HostsFile instead.
+	Strategy   string `json:"strategy"`
+	Nameserver string `json:"nameserver,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	HostsFile  string `json:"hosts_file,omitempty"`
+}
+
+// Totals are cumulative counts of what went through the tunnel.
+type Totals struct {
+	proxy.Traffic
+	Connections uint64 `json:"connections"`
+	DNSQueries  uint64 `json:"dns_queries"`
+	// Sessions counts the sessions totalled, for lifetime totals.
+	Sessions int `json:"sessions,omitempty"`
+}
+
+// Add returns the sum of t and other.
+func (t Totals) Add(other Totals) Totals {
+	return Totals{
+		Traffic:     proxy.Traffic{Sent: t.Sent + other.Sent, Received: t.Received + other.Received},
+		Connections: t.Connections + other.Connections,
+		DNSQueries:  t.DNSQueries + other.DNSQueries,
+		Sessions:    t.Sessions + other.Sessions,
+	}
+}
+
+// NewInterceptor constructs an Interceptor whose firewall rules are
+// managed by the named nat backend ("" means auto detect).
+func NewInterceptor(name, backend string) (*Interceptor, error) {
+	translator, err := nat.NewTranslator(backend, name)
+	if err != nil {
+		return nil, err
+	}
+	return newInterceptor(translator), nil
+}
+
+// NewObserver constructs an Interceptor that programs nothing, whose
+// Status plans the firewall rules it would program instead.
+func NewObserver(name string) *Interceptor {
+	return newInterceptor(nat.NewObserver(name))
+}
+
+func newInterceptor(translator nat.Translator) *Interceptor {
 	ret := &Interceptor{
 		tables:     make(map[string]rt.Table),
-		translator: nat.NewTranslator(name),
+		translator: translator,
 		domains:    make(map[string]rt.Route),
+		avoid:      make(map[string]bool),
 		search:     []string{""},
+		ports:      make(map[string]int),
+		stale:      make(map[string]time.Time),
+		unhealthy:  make(map[string]Command),
+		failing:    make(map[nat.Address]bool),
 	}
 	ret.tablesLock.Lock() // leave it locked until .Start() unlocks it
 	return ret
 }
 
-func (i *Interceptor) Start() {
-	i.translator.Enable()
+// Configure changes the firewall settings. It must be invoked before
+// Start.
+func (i *Interceptor) Configure(config nat.Config) {
+	i.translator.Configure(config)
+	i.errorsLock.Lock()
+	i.routed = config.RouteCIDRs
+	i.errorsLock.Unlock()
+}
+
+func (i *Interceptor) Start() error {
+	if err := i.translator.Enable(); err != nil {
+		i.check(nat.Address{}, err)
+		// clean up whatever part of the setup did succeed
+		i.translator.Disable()
+		return err
+	}
+	// mappings may exist from here on
+	i.domainsLock.Lock()
+	i.started = true
+	i.domainsLock.Unlock()
 	i.tablesLock.Unlock()
+	return nil
 }
 
 func (i *Interceptor) Stop() {
+	i.domainsLock.Lock()
+	i.started = false
+	i.domainsLock.Unlock()
 	i.tablesLock.Lock()
-	i.translator.Disable()
+	err := i.translator.Disable()
+	if err == nil {
+		// nothing is mapped anymore, so nothing is failing
+		i.errorsLock.Lock()
+		i.failing = make(map[nat.Address]bool)
+		i.errorsLock.Unlock()
+	}
+	i.check(nat.Address{}, err)
+	log.Printf("INT: programming the firewall: %v", i.Status().Programming)
 	// leave it locked
 }
 
+// check records how an operation on addr went: a non-nil error shows
+// up in Status(), along with the security module that may be behind
+// it, if any, and addr is failing until a nil one for it says it works
+// again.
+func (i *Interceptor) check(addr nat.Address, err error) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	if err == nil {
+		delete(i.failing, addr)
+		return
+	}
+	i.failing[addr] = true
+	message := rt.Annotate(lsm.Explain(err, i.security).Error())
+	log.Printf("INT: %s", message)
+
+	i.errors = append(i.errors, message)
+	if len(i.errors) > maxErrors {
+		i.errors = i.errors[len(i.errors)-maxErrors:]
+	}
+}
+
+// Status reports whether any recent firewall operations have failed.
+func (i *Interceptor) Status() Status {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	stale := make(map[string]time.Time, len(i.stale))
+	for table, since := range i.stale {
+		stale[table] = since
+	}
+	ports := make(map[string]int, len(i.ports))
+	for name, port := range i.ports {
+		ports[name] = port
+	}
+	unhealthy := make(map[string]Command, len(i.unhealthy))
+	for command, health := range i.unhealthy {
+		unhealthy[command] = health
+	}
+	var usage *proxy.Report
+	if i.usage != nil {
+		report := i.usage()
+		usage = &report
+	}
+	var session, lifetime *Totals
+	if i.totals != nil {
+		s, l := i.totals()
+		session, lifetime = &s, &l
+	}
+	var plan []string
+	if planner, ok := i.translator.(interface{ Plan() []string }); ok {
+		plan = planner.Plan()
+	}
+	return Status{
+		Healthy:   len(i.failing) == 0 && len(unhealthy) == 0,
+		Errors:    append([]string(nil), i.errors...),
+		Denied:    append([]string(nil), i.denied...),
+		Refused:   append([]string(nil), i.refused...),
+		Unchecked: append([]string(nil), i.unchecked...),
+		Ports:     ports,
+		Conflicts: append([]coexist.Conflict(nil), i.conflicts...),
+		Security:  append([]lsm.Module(nil), i.security...),
+		Stale:     stale,
+		Overlaps:  append([]coexist.Overlap(nil), i.overlaps...),
+		Unhealthy: unhealthy,
+		Routed:    append([]string(nil), i.routed...),
+		Usage:     usage,
+		Session:   session,
+		Lifetime:  lifetime,
+		DNS:       i.dns,
+		Programming: Programming{
+			Commands: nat.Timings(),
+			Updates:  i.updates,
+		},
+		Plan: plan,
+	}
+}
+
+// AddPorts records local ports in use for reporting in the status.
+func (i *Interceptor) AddPorts(ports map[string]int) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	for name, port := range ports {
+		i.ports[name] = port
+	}
+}
+
+// SetDenied records the destinations that the bridge declined to
+// route because policy forbids intercepting them.
+func (i *Interceptor) SetDenied(denied []string) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.denied = denied
+}
+
+// Refuse records that the teleproxy pods refused to connect to
+// destination, keeping the most recent ones.
+func (i *Interceptor) Refuse(destination string) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	refused := i.refused[:0]
+	for _, d := range i.refused {
+		if d != destination {
+			refused = append(refused, d)
+		}
+	}
+	i.refused = append(refused, destination)
+	if len(i.refused) > maxErrors {
+		i.refused = i.refused[len(i.refused)-maxErrors:]
+	}
+}
+
+// TrustUnchecked records that the host key of the teleproxy pod was
+// trusted without being checked.
+func (i *Interceptor) TrustUnchecked(pod string) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	for _, p := range i.unchecked {
+		if p == pod {
+			return
+		}
+	}
+	i.unchecked = append(i.unchecked, pod)
+}
+
+// SetStale records which tables are stale, e.g. because the cluster
+// they came from is unreachable. Tables that were already stale stay
+// stale since the first time.
+func (i *Interceptor) SetStale(tables []string) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	stale := make(map[string]time.Time, len(tables))
+	for _, table := range tables {
+		if since, ok := i.stale[table]; ok {
+			stale[table] = since
+		} else {
+			stale[table] = time.Now()
+		}
+	}
+	i.stale = stale
+}
+
+// SetHealth records the health of a command kept running for the
+// session, for reporting in the status until it is healthy again.
+func (i *Interceptor) SetHealth(command string, health Command) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	if health.Health == "healthy" {
+		delete(i.unhealthy, command)
+	} else {
+		i.unhealthy[command] = health
+	}
+}
+
+// Provisional reports whether the answer for domain comes from a stale
+// table, which may well have changed.
+func (i *Interceptor) Provisional(domain string) bool {
+	i.errorsLock.Lock()
+	var stale []string
+	for table := range i.stale {
+		stale = append(stale, table)
+	}
+	i.errorsLock.Unlock()
+	if len(stale) == 0 {
+		return false
+	}
+
+	route := i.Resolve(domain)
+	if route == nil {
+		return false
+	}
+	i.tablesLock.RLock()
+	defer i.tablesLock.RUnlock()
+	for _, table := range stale {
+		for _, r := range i.tables[table].Routes {
+			if r == *route {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetUsage makes the status include what usage reports.
+func (i *Interceptor) SetUsage(usage func() proxy.Report) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.usage = usage
+}
+
+// SetTotals makes the status include the session and lifetime totals
+// that totals reports.
+func (i *Interceptor) SetTotals(totals func() (session, lifetime Totals)) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.totals = totals
+}
+
+// SetOverlaps records which local networks intercepted ranges clash
+// with.
+func (i *Interceptor) SetOverlaps(overlaps []coexist.Overlap) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.overlaps = overlaps
+}
+
+// SetDNS records how dns queries reach teleproxy.
+func (i *Interceptor) SetDNS(dns DNS) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.dns = &dns
+}
+
+// SetConflicts records the other interception tools found at startup.
+func (i *Interceptor) SetConflicts(conflicts []coexist.Conflict) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.conflicts = conflicts
+}
+
+// SetSecurity records the security modules found at startup, which
+// errors are explained by.
+func (i *Interceptor) SetSecurity(modules []lsm.Module) {
+	i.errorsLock.Lock()
+	defer i.errorsLock.Unlock()
+	i.security = modules
+}
+
 // Resolve looks up the given query in the (FIXME: somewhere), trying
 // all the suffixes in the search path, and returns a Route on success
 // or nil on failure. This implementation does not count the number of
@@ -69,9 +496,248 @@ func (i *Interceptor) Resolve(query string) *rt.Route {
 	return nil
 }
 
+// Names returns the names that dns answers with the address of a
+// route, fully qualified, and the addresses.
+func (i *Interceptor) Names() map[string]string {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+	names := make(map[string]string, len(i.domains))
+	for domain, route := range i.domains {
+		names[domain] = route.Ip
+	}
+	return names
+}
+
+// SetNeverProxy sets the domains that must never be intercepted. A
+// pattern of the form "*.example.com" matches every subdomain of
+// example.com, any other pattern matches only itself.
+func (i *Interceptor) SetNeverProxy(patterns []string) {
+	i.domainsLock.Lock()
+	defer i.domainsLock.Unlock()
+	i.never = nil
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if !strings.HasSuffix(pattern, ".") {
+			pattern += "."
+		}
+		i.never = append(i.never, pattern)
+	}
+}
+
+// NeverProxy reports whether the domain matches one of the patterns
+// given to SetNeverProxy.
+func (i *Interceptor) NeverProxy(domain string) bool {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+	return i.neverProxy(domain)
+}
+
+// .neverProxy() assumes that .domainsLock is held.
+func (i *Interceptor) neverProxy(domain string) bool {
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	for _, pattern := range i.never {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Avoid keeps the firewall from redirecting the given addresses, which
+// are what never proxied domains resolve to. Any existing mappings for
+// them are removed. Before Start there are none, and Avoid doesn't wait
+// for it.
+func (i *Interceptor) Avoid(ips []string) {
+	i.domainsLock.Lock()
+	var fresh []string
+	for _, ip := range ips {
+		if !i.avoid[ip] {
+			log.Printf("INT: AVOID %v", ip)
+			i.avoid[ip] = true
+			fresh = append(fresh, ip)
+		}
+	}
+	started := i.started
+	i.domainsLock.Unlock()
+	if !started || len(fresh) == 0 {
+		return
+	}
+
+	// updates from here on leave them alone, so only the mappings
+	// made so far need clearing
+	i.tablesLock.Lock()
+	defer i.tablesLock.Unlock()
+	for _, ip := range fresh {
+		for _, table := range i.tables {
+			for _, route := range table.Routes {
+				if route.Ip == ip && route.Target != "" {
+					i.clear(route)
+				}
+			}
+		}
+	}
+}
+
+// Reroute adds ranges to, and removes ranges from, those routed through
+// a device of our own (see nat.Config.RouteCIDRs) while running. Only
+// the routes that change are touched and the rest of the firewall is
+// left as it is, so connections carry on, except those to the ranges
+// removed, which go wherever the host routes them again.
+func (i *Interceptor) Reroute(add, remove []string) error {
+	router, ok := i.translator.(nat.Router)
+	if !ok {
+		return fmt.Errorf("this nat backend doesn't route ranges, only pf does")
+	}
+	for _, cidr := range append(append([]string(nil), add...), remove...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+
+	i.tablesLock.Lock()
+	defer i.tablesLock.Unlock()
+
+	removed := make(map[string]bool, len(remove))
+	for _, cidr := range remove {
+		removed[cidr] = true
+	}
+	i.errorsLock.Lock()
+	routed := append([]string(nil), i.routed...)
+	i.errorsLock.Unlock()
+	var cidrs []string
+	seen := make(map[string]bool)
+	for _, cidr := range append(routed, add...) {
+		if !removed[cidr] && !seen[cidr] {
+			cidrs = append(cidrs, cidr)
+			seen[cidr] = true
+		}
+	}
+	err := router.Route(cidrs)
+	i.check(nat.Address{}, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("INT: routing %s", strings.Join(cidrs, ", "))
+	i.errorsLock.Lock()
+	i.routed = cidrs
+	i.errorsLock.Unlock()
+	return nil
+}
+
+// fakes is the table of the services that Fake makes up.
+const fakes = "fakes"
+
+// Fake makes up a service that no cluster has: dns answers name with
+// ip, the search path applying as it does to the services of the
+// cluster, and tcp to ip, on any port, goes to port on localhost,
+// e.g. to a build of the service yet to be deployed. Port 0 removes
+// it. Neither the name nor the address may be another table's. The
+// fakes last until Stop.
+func (i *Interceptor) Fake(name, ip string, port int) error {
+	if name == "" {
+		return fmt.Errorf("a fake service needs a name")
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("%d is not a port", port)
+	}
+	if port != 0 && net.ParseIP(ip).To4() == nil {
+		return fmt.Errorf("%q is not an ipv4 address", ip)
+	}
+
+	i.tablesLock.Lock()
+	defer i.tablesLock.Unlock()
+	i.domainsLock.Lock()
+	defer i.domainsLock.Unlock()
+
+	faked := rt.Route{Name: name, Ip: ip, Proto: "tcp", Target: strconv.Itoa(port)}
+	for table, t := range i.tables {
+		if table == fakes {
+			continue
+		}
+		for _, route := range t.Routes {
+			if port != 0 && (faked.Domain() == route.Domain() || route.Ip == ip) {
+				return fmt.Errorf("%s %s is already in table %s", name, ip, table)
+			}
+		}
+	}
+
+	table := rt.Table{Name: fakes}
+	for _, route := range i.tables[fakes].Routes {
+		if route.Domain() != faked.Domain() {
+			table.Add(route)
+		}
+	}
+	if port != 0 {
+		table.Add(faked)
+	}
+	i.update(table)
+	return nil
+}
+
+// Fakes returns the services that Fake made up.
+func (i *Interceptor) Fakes() []rt.Route {
+	i.tablesLock.RLock()
+	defer i.tablesLock.RUnlock()
+	return append([]rt.Route{}, i.tables[fakes].Routes...)
+}
+
+// Remap makes connections to addresses in virtual go to the service
+// that was given the address, by name, since the address means nothing
+// to the cluster. It must be invoked before Start.
+func (i *Interceptor) Remap(virtual *net.IPNet) {
+	// ahead of the rest, the address is no use to them
+	i.resolvers = append([]Resolver{Virtual(virtual, i.routeName)}, i.resolvers...)
+}
+
+// AddResolver makes r decide where the intercepted connections that the
+// resolvers before it leave alone go. Connections that no resolver
+// decides on go where they were headed. It must be invoked before
+// Start.
+func (i *Interceptor) AddResolver(r Resolver) {
+	i.resolvers = append(i.resolvers, r)
+}
+
+// routeName returns the name of the route to ip, if there is one.
+func (i *Interceptor) routeName(ip string) string {
+	i.domainsLock.RLock()
+	defer i.domainsLock.RUnlock()
+	for _, route := range i.domains {
+		if route.Ip == ip && route.Name != "" {
+			return route.Name
+		}
+	}
+	return ""
+}
+
+// Destination returns where an intercepted connection goes, as the
+// resolvers decide.
 func (i *Interceptor) Destination(conn *net.TCPConn) (string, error) {
-	_, host, err := i.translator.GetOriginalDst(conn)
-	return host, err
+	host, err := i.translator.GetOriginalDst(conn)
+	if err != nil {
+		return host, err
+	}
+	return resolve(i.resolvers, host)
+}
+
+// Service names the route with the address of host, as in
+// "default/hello", for the access log, or returns "" if there is none.
+func (i *Interceptor) Service(host string) string {
+	ip, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return ""
+	}
+	if net.ParseIP(ip) == nil {
+		// remapped destinations are named already
+		return rt.Shorten(ip)
+	}
+	return rt.NameOf(ip)
 }
 
 func (i *Interceptor) Render(table string) string {
@@ -103,6 +769,29 @@ func (i *Interceptor) Render(table string) string {
 	}
 }
 
+// Subscribe returns the changes to the firewall mappings to come, see
+// nat.Mappings.Subscribe.
+func (i *Interceptor) Subscribe(buffer int) (<-chan nat.Change, func()) {
+	return i.translator.Subscribe(buffer)
+}
+
+// Snapshot returns the firewall mappings currently installed.
+func (i *Interceptor) Snapshot() []nat.Entry {
+	i.tablesLock.RLock()
+	defer i.tablesLock.RUnlock()
+	return i.translator.Snapshot()
+}
+
+// Routes returns the routes of all tables.
+func (i *Interceptor) Routes() (routes []rt.Route) {
+	i.tablesLock.RLock()
+	defer i.tablesLock.RUnlock()
+	for _, t := range i.tables {
+		routes = append(routes, t.Routes...)
+	}
+	return
+}
+
 func (i *Interceptor) Delete(table string) bool {
 	i.tablesLock.Lock()
 	defer i.tablesLock.Unlock()
@@ -138,10 +827,29 @@ func (i *Interceptor) Update(table rt.Table) {
 	i.update(table)
 }
 
+// Patch applies the delta to its table. If the result doesn't have the
+// number of routes the sender expects, nothing is changed and an error
+// is returned, after which the sender should Update the full table.
+func (i *Interceptor) Patch(delta rt.Delta) error {
+	i.tablesLock.Lock()
+	defer i.tablesLock.Unlock()
+	i.domainsLock.Lock()
+	defer i.domainsLock.Unlock()
+
+	table := delta.Apply(i.tables[delta.Name])
+	if len(table.Routes) != delta.Count {
+		return fmt.Errorf("table %s would have %d routes, expected %d", delta.Name, len(table.Routes), delta.Count)
+	}
+	i.update(table)
+	return nil
+}
+
 // .update() assumes that both .tablesLock and .domainsLock are held
 // for writing.  Ensuring that is the case is the caller's
 // responsibility.
 func (i *Interceptor) update(table rt.Table) {
+	start := time.Now()
+	changes := 0
 	oldTable, ok := i.tables[table.Name]
 
 	oldRoutes := make(map[string]rt.Route)
@@ -158,23 +866,18 @@ func (i *Interceptor) update(table rt.Table) {
 		if newRoute != oldRoute {
 			// delete the old version
 			if oldRouteOk {
-				switch newRoute.Proto {
-				case "tcp":
-					i.translator.ClearTCP(oldRoute.Ip)
-				case "udp":
-					i.translator.ClearUDP(oldRoute.Ip)
-				default:
-					log.Printf("INT: unrecognized protocol: %v", newRoute)
-				}
+				i.clear(oldRoute)
+				changes++
+				rt.Forget(oldRoute.Ip, oldRoute.Name)
 			}
 			// and add the new version
 			if newRoute.Target != "" {
-				switch newRoute.Proto {
-				case "tcp":
-					i.translator.ForwardTCP(newRoute.Ip, newRoute.Target)
-				case "udp":
-					i.translator.ForwardUDP(newRoute.Ip, newRoute.Target)
-				default:
+				if i.avoid[newRoute.Ip] || (newRoute.Name != "" && i.neverProxy(newRoute.Domain())) {
+					log.Printf("INT: NEVER PROXY %v", newRoute)
+				} else if validProto(newRoute.Proto) {
+					i.check(nat.Address{Proto: newRoute.Proto, Ip: newRoute.Ip}, i.translator.Forward(newRoute.Proto, newRoute.Ip, newRoute.Target))
+					changes++
+				} else {
 					log.Printf("INT: unrecognized protocol: %v", newRoute)
 				}
 			}
@@ -182,6 +885,7 @@ func (i *Interceptor) update(table rt.Table) {
 			if newRoute.Name != "" {
 				log.Printf("INT: STORE %v->%v", newRoute.Domain(), newRoute)
 				i.domains[newRoute.Domain()] = newRoute
+				rt.Remember(newRoute.Ip, newRoute.Name)
 			}
 		}
 
@@ -193,16 +897,9 @@ func (i *Interceptor) update(table rt.Table) {
 	for _, route := range oldRoutes {
 		log.Printf("INT: CLEAR %v->%v", route.Domain(), route)
 		delete(i.domains, route.Domain())
-
-		switch route.Proto {
-		case "tcp":
-			i.translator.ClearTCP(route.Ip)
-		case "udp":
-			i.translator.ClearUDP(route.Ip)
-		default:
-			log.Printf("INT: unrecognized protocol: %v", route)
-		}
-
+		rt.Forget(route.Ip, route.Name)
+		i.clear(route)
+		changes++
 	}
 
 	if table.Routes == nil || len(table.Routes) == 0 {
@@ -210,6 +907,26 @@ func (i *Interceptor) update(table rt.Table) {
 	} else {
 		i.tables[table.Name] = table
 	}
+
+	if changes > 0 {
+		took := time.Since(start)
+		i.errorsLock.Lock()
+		i.updates.Add(took)
+		i.errorsLock.Unlock()
+		log.Printf("INT: programmed %d changes to table %s in %v", changes, table.Name, took.Round(time.Millisecond))
+	}
+}
+
+func validProto(proto string) bool {
+	return proto == "tcp" || proto == "udp"
+}
+
+func (i *Interceptor) clear(route rt.Route) {
+	if validProto(route.Proto) {
+		i.check(nat.Address{Proto: route.Proto, Ip: route.Ip}, i.translator.Clear(route.Proto, route.Ip))
+	} else {
+		log.Printf("INT: unrecognized protocol: %v", route)
+	}
 }
 
 // SetSearchPath updates the DNS search path used by the resolver
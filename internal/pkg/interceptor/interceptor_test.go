@@ -0,0 +1,186 @@
+package interceptor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+func TestReroute(t *testing.T) {
+	i := NewObserver("teleproxy")
+	i.Configure(nat.Config{RouteCIDRs: []string{"10.96.0.0/12"}})
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Stop()
+	i.Update(rt.Table{Name: "kubernetes", Routes: []rt.Route{{Name: "web", Ip: "10.96.0.10", Proto: "tcp", Target: "1234"}}})
+
+	if err := i.Reroute([]string{"10.244.0.0/16", "10.96.0.0/12"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Reroute([]string{"10.100.0.0/16"}, []string{"10.96.0.0/12"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.244.0.0/16", "10.100.0.0/16"}
+	if routed := i.Status().Routed; !reflect.DeepEqual(routed, expected) {
+		t.Errorf("expected %v, got %v", expected, routed)
+	}
+	if len(i.Snapshot()) != 1 {
+		t.Errorf("expected the mappings to be left alone, got %v", i.Snapshot())
+	}
+
+	if err := i.Reroute([]string{"10.0.0.0"}, nil); err == nil {
+		t.Errorf("expected an address that isn't a range to be refused")
+	}
+	if routed := i.Status().Routed; !reflect.DeepEqual(routed, expected) {
+		t.Errorf("expected %v to be left alone, got %v", expected, routed)
+	}
+}
+
+func TestAvoid(t *testing.T) {
+	i := NewObserver("teleproxy")
+	done := make(chan struct{})
+	go func() {
+		i.Avoid([]string{"10.96.0.10"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Avoid waited for Start")
+	}
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Stop()
+	i.Update(rt.Table{Name: "kubernetes", Routes: []rt.Route{
+		{Name: "web", Ip: "10.96.0.10", Proto: "tcp", Target: "1234"},
+		{Name: "api", Ip: "10.96.0.11", Proto: "tcp", Target: "1234"},
+	}})
+	if len(i.Snapshot()) != 1 {
+		t.Errorf("expected only api to be mapped, got %v", i.Snapshot())
+	}
+	i.Avoid([]string{"10.96.0.11"})
+	if len(i.Snapshot()) != 0 {
+		t.Errorf("expected api to be cleared, got %v", i.Snapshot())
+	}
+}
+
+func TestFake(t *testing.T) {
+	i := NewObserver("teleproxy")
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Stop()
+	i.Update(rt.Table{Name: "kubernetes", Routes: []rt.Route{{Name: "web.default", Ip: "10.96.0.10", Proto: "tcp", Target: "1234"}}})
+	defer rt.Forget("10.96.0.10", "web.default")
+	i.SetSearchPath([]string{"default.", ""})
+
+	if err := i.Fake("payments.default", "198.18.0.1", 8080); err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Forget("198.18.0.1", "payments.default")
+	if route := i.Resolve("payments"); route == nil || route.Ip != "198.18.0.1" || route.Target != "8080" {
+		t.Errorf("expected payments to resolve to the fake, got %v", route)
+	}
+	if len(i.Snapshot()) != 2 {
+		t.Errorf("expected the fake to be mapped, got %v", i.Snapshot())
+	}
+
+	if err := i.Fake("web.default", "198.18.0.2", 8081); err == nil {
+		t.Errorf("expected a name the cluster has to be refused")
+	}
+	if err := i.Fake("orders.default", "10.96.0.10", 8081); err == nil {
+		t.Errorf("expected an address the cluster has to be refused")
+	}
+
+	if err := i.Fake("payments.default", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if route := i.Resolve("payments"); route != nil || len(i.Fakes()) != 0 || len(i.Snapshot()) != 1 {
+		t.Errorf("expected the fake to be gone, got %v and %v", route, i.Fakes())
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	i := NewObserver("teleproxy")
+	i.SetHealth("ssh", Command{Health: "flapping", Error: "exit status 255", ExitCode: 255})
+	if status := i.Status(); status.Healthy || status.Unhealthy["ssh"].ExitCode != 255 {
+		t.Errorf("expected ssh to be flapping, got %+v", status)
+	}
+	i.SetHealth("ssh", Command{Health: "healthy"})
+	if status := i.Status(); !status.Healthy || len(status.Unhealthy) != 0 {
+		t.Errorf("expected ssh to have recovered, got %+v", status)
+	}
+}
+
+func TestRecovers(t *testing.T) {
+	i := NewObserver("teleproxy")
+	web := nat.Address{Proto: "tcp", Ip: "10.96.0.10"}
+	i.check(web, &nat.Error{Op: "forward", Err: errors.New("iptables: exit status 4")})
+	if status := i.Status(); status.Healthy || len(status.Errors) != 1 {
+		t.Errorf("expected a failure, got %+v", status)
+	}
+	i.check(web, nil)
+	if status := i.Status(); !status.Healthy || len(status.Errors) != 1 {
+		t.Errorf("expected to have recovered, with the failure kept, got %+v", status)
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	i := NewObserver("teleproxy")
+	for n := 0; n < maxErrors+2; n++ {
+		i.Refuse(fmt.Sprintf("10.96.0.%d:80", n))
+	}
+	i.Refuse("10.96.0.5:80")
+	refused := i.Status().Refused
+	if len(refused) != maxErrors || refused[0] != "10.96.0.2:80" || refused[maxErrors-1] != "10.96.0.5:80" {
+		t.Errorf("expected the most recent, each once, got %v", refused)
+	}
+}
+
+func TestTrustUnchecked(t *testing.T) {
+	i := NewObserver("teleproxy")
+	for _, pod := range []string{"teleproxy", "teleproxy-5d9c7", "teleproxy"} {
+		i.TrustUnchecked(pod)
+	}
+	if unchecked := i.Status().Unchecked; len(unchecked) != 2 || unchecked[0] != "teleproxy" || unchecked[1] != "teleproxy-5d9c7" {
+		t.Errorf("expected each pod once, got %v", unchecked)
+	}
+}
+
+// failingTranslator fails to forward fail.
+type failingTranslator struct {
+	nat.Translator
+	fail string
+}
+
+func (f failingTranslator) Forward(protocol, ip, toPort string) error {
+	if ip == f.fail {
+		return &nat.Error{Op: "forward", Err: errors.New("iptables: exit status 4")}
+	}
+	return f.Translator.Forward(protocol, ip, toPort)
+}
+
+func TestFailingAddress(t *testing.T) {
+	i := newInterceptor(failingTranslator{nat.NewObserver("teleproxy"), "10.96.0.10"})
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Stop()
+	i.Update(rt.Table{Name: "kubernetes", Routes: []rt.Route{{Name: "web", Ip: "10.96.0.10", Proto: "tcp", Target: "1234"}}})
+	i.Update(rt.Table{Name: "other", Routes: []rt.Route{{Name: "api", Ip: "10.96.0.11", Proto: "tcp", Target: "1234"}}})
+	if status := i.Status(); status.Healthy {
+		t.Errorf("expected web to be failing still, got %+v", status)
+	}
+	// removing the mapping that failed is what recovers
+	i.Update(rt.Table{Name: "kubernetes"})
+	if status := i.Status(); !status.Healthy {
+		t.Errorf("expected to have recovered, got %+v", status)
+	}
+}
@@ -0,0 +1,56 @@
+package interceptor
+
+import (
+	"fmt"
+	"net"
+)
+
+// A Resolver decides where an intercepted connection that was headed
+// for ip and port is sent through the tunnel. It returns "" to leave
+// the connection to the next resolver, and an error to refuse it.
+type Resolver interface {
+	Resolve(ip, port string) (string, error)
+}
+
+// ResolverFunc is a function that is a Resolver.
+type ResolverFunc func(ip, port string) (string, error)
+
+// Resolve invokes f.
+func (f ResolverFunc) Resolve(ip, port string) (string, error) {
+	return f(ip, port)
+}
+
+// Virtual sends connections to addresses in virtual, which mean nothing
+// to the cluster, to whatever name gives the address to, by name.
+// Addresses in virtual that nothing has are refused.
+func Virtual(virtual *net.IPNet, name func(ip string) string) Resolver {
+	return ResolverFunc(func(ip, port string) (string, error) {
+		if !virtual.Contains(net.ParseIP(ip)) {
+			return "", nil
+		}
+		if host := name(ip); host != "" {
+			return net.JoinHostPort(host, port), nil
+		}
+		return "", fmt.Errorf("nothing has the virtual address %s", ip)
+	})
+}
+
+// resolve finds where a connection headed for host (ip:port) goes: to
+// what the first of resolvers that knows says, or where it was headed
+// if none do.
+func resolve(resolvers []Resolver, host string) (string, error) {
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, nil
+	}
+	for _, r := range resolvers {
+		destination, err := r.Resolve(ip, port)
+		if err != nil {
+			return "", err
+		}
+		if destination != "" {
+			return destination, nil
+		}
+	}
+	return host, nil
+}
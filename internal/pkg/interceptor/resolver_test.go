@@ -0,0 +1,44 @@
+package interceptor
+
+import (
+	"net"
+	"testing"
+)
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestResolvers(t *testing.T) {
+	names := map[string]string{"10.240.0.1": "web.default"}
+	resolvers := []Resolver{
+		Virtual(cidr("10.240.0.0/16"), func(ip string) string { return names[ip] }),
+		ResolverFunc(func(ip, port string) (string, error) {
+			if ip == "10.96.0.20" || ip == "10.240.0.1" {
+				return "shadowed:" + port, nil
+			}
+			return "", nil
+		}),
+	}
+	for host, expected := range map[string]string{
+		// virtual addresses go by name
+		"10.240.0.1:80": "web.default:80",
+		// the first resolver that knows decides
+		"10.96.0.20:80": "shadowed:80",
+		// addresses no resolver knows go as they are
+		"10.96.0.10:80":   "10.96.0.10:80",
+		"192.168.1.1:443": "192.168.1.1:443",
+	} {
+		destination, err := resolve(resolvers, host)
+		if err != nil || destination != expected {
+			t.Errorf("expected %s to go to %s, got %q, %v", host, expected, destination, err)
+		}
+	}
+	if destination, err := resolve(resolvers, "10.240.0.2:80"); err == nil {
+		t.Errorf("expected a virtual address nothing has to be refused, got %s", destination)
+	}
+}
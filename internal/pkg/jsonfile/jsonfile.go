@@ -0,0 +1,22 @@
+// Package jsonfile reads the json files that configure teleproxy, which
+// may be reread on SIGHUP.
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Read decodes the json of filename into v. A malformed file is named
+// in the error, which is logged on a failed reread.
+func Read(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
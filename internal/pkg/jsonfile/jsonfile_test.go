@@ -0,0 +1,33 @@
+package jsonfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good, bad := filepath.Join(dir, "good.json"), filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(good, []byte(`{"domains": ["corp.example.com"]}`), 0644)
+	ioutil.WriteFile(bad, []byte(`{"domains": `), 0644)
+
+	var config struct {
+		Domains []string `json:"domains"`
+	}
+	if err := Read(good, &config); err != nil || len(config.Domains) != 1 {
+		t.Errorf("good: %v, %v", config, err)
+	}
+	if err := Read(bad, &config); err == nil || !strings.HasPrefix(err.Error(), bad+": ") {
+		t.Errorf("expected the malformed file to be named, got %v", err)
+	}
+	if err := Read(filepath.Join(dir, "missing.json"), &config); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to be reported as such, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package loopback
+
+import "github.com/datawire/teleproxy/pkg/tpu"
+
+// On macOS, lo0 only answers to 127.0.0.1 until given the rest as
+// aliases.
+
+func addAlias(ip string, logf func(string, ...interface{})) error {
+	_, err := tpu.CmdLogf([]string{"ifconfig", "lo0", "alias", ip, "up"}, logf)
+	return err
+}
+
+func removeAlias(ip string, logf func(string, ...interface{})) {
+	tpu.CmdLogf([]string{"ifconfig", "lo0", "-alias", ip}, logf)
+}
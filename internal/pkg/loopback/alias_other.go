@@ -0,0 +1,9 @@
+// +build !darwin
+
+package loopback
+
+// Elsewhere, all of 127.0.0.0/8 is already on the loopback interface.
+
+func addAlias(ip string, logf func(string, ...interface{})) error { return nil }
+
+func removeAlias(ip string, logf func(string, ...interface{})) {}
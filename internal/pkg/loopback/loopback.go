@@ -0,0 +1,229 @@
+// Package loopback binds cluster services to loopback addresses, for
+// clients that refuse proxies and insist on connecting to localhost.
+// Each service gets an address of its own in a loopback range, e.g.
+// 127.0.2.1, listened on at each of its ports, with a block of entries
+// in the hosts file naming it. Connections are relayed into the
+// cluster with the dial given, i.e. the tunnel.
+package loopback
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/datawire/teleproxy/internal/pkg/hosts"
+)
+
+// A Service is bound to an address of its own, on each of its ports.
+type Service struct {
+	// Host is what connections are relayed to, along with the
+	// port, e.g. "web.default.svc.cluster.local".
+	Host string
+	// Names are what the hosts file resolves to the address, e.g.
+	// "web.default".
+	Names []string
+	Ports []int
+}
+
+// A Binder keeps services bound, and the hosts file naming them.
+type Binder struct {
+	network *net.IPNet
+	hosts   *hosts.File
+	dial    func(network, address string) (net.Conn, error)
+
+	mutex sync.Mutex
+	// assigned has the address of each service, by host
+	assigned map[string]net.IP
+	// listeners are by address and port
+	listeners map[string]net.Listener
+	closed    bool
+}
+
+// NewBinder binds services to addresses from cidr, a loopback range,
+// naming them in the hosts file at path.
+func NewBinder(cidr, path string, dial func(network, address string) (net.Conn, error)) (*Binder, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if !network.IP.IsLoopback() || network.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 loopback range", cidr)
+	}
+	return &Binder{
+		network:   network,
+		hosts:     hosts.NewFile(path, "teleproxy loopback"),
+		dial:      dial,
+		assigned:  make(map[string]net.IP),
+		listeners: make(map[string]net.Listener),
+	}, nil
+}
+
+func (b *Binder) log(line string, args ...interface{}) {
+	log.Printf("LBK: "+line, args...)
+}
+
+// Bind binds services, and unbinds the ones that were bound before
+// but aren't among them. Services keep their addresses for as long as
+// they stay bound.
+func (b *Binder) Bind(services []Service) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Host < services[j].Host })
+
+	wanted := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, svc := range services {
+		hosts[svc.Host] = true
+	}
+	var lines []string
+	for _, svc := range services {
+		ip, ok := b.assigned[svc.Host]
+		if !ok {
+			if ip = Allocate(b.network, b.assigned); ip == nil {
+				b.log("not binding %s: %s is used up", svc.Host, b.network)
+				continue
+			}
+			if err := addAlias(ip.String(), b.log); err != nil {
+				b.log("not binding %s: %v", svc.Host, err)
+				continue
+			}
+			b.assigned[svc.Host] = ip
+		}
+		for _, port := range svc.Ports {
+			address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			wanted[address] = true
+			if _, ok := b.listeners[address]; ok {
+				continue
+			}
+			ln, err := net.Listen("tcp", address)
+			if err != nil {
+				b.log("not binding %s: %v", svc.Host, err)
+				continue
+			}
+			b.listeners[address] = ln
+			go Serve(ln, net.JoinHostPort(svc.Host, strconv.Itoa(port)), b.dial, b.log)
+		}
+		if len(svc.Names) > 0 {
+			lines = append(lines, ip.String()+" "+strings.Join(svc.Names, " "))
+		}
+	}
+	for address, ln := range b.listeners {
+		if !wanted[address] {
+			ln.Close()
+			delete(b.listeners, address)
+		}
+	}
+	for host, ip := range b.assigned {
+		if !hosts[host] {
+			delete(b.assigned, host)
+			removeAlias(ip.String(), b.log)
+		}
+	}
+	b.writeHosts(strings.Join(lines, "\n"))
+}
+
+func (b *Binder) writeHosts(block string) {
+	if err := b.hosts.Write(block); err != nil {
+		b.log("error updating the hosts file: %v", err)
+	}
+}
+
+// Allocate returns the first address of network that isn't among
+// assigned, skipping the network and broadcast addresses and
+// 127.0.0.1, or nil if there is none.
+func Allocate(network *net.IPNet, assigned map[string]net.IP) net.IP {
+	used := make(map[string]bool)
+	for _, ip := range assigned {
+		used[ip.String()] = true
+	}
+	base := network.IP.To4()
+	for ip := next(base); network.Contains(ip); ip = next(ip) {
+		if !used[ip.String()] && !ip.Equal(net.IPv4(127, 0, 0, 1)) && !ip.Equal(broadcast(network)) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func next(ip net.IP) net.IP {
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i]++
+		if result[i] != 0 {
+			break
+		}
+	}
+	return result
+}
+
+func broadcast(network *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	for i, b := range network.IP.To4() {
+		ip[i] = b | ^network.Mask[i]
+	}
+	return ip
+}
+
+// Serve relays each connection accepted on ln to upstream, dialed
+// with dial, until ln is closed.
+func Serve(ln net.Listener, upstream string, dial func(network, address string) (net.Conn, error), logf func(string, ...interface{})) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go relay(conn, upstream, dial, logf)
+	}
+}
+
+func relay(conn net.Conn, upstream string, dial func(network, address string) (net.Conn, error), logf func(string, ...interface{})) {
+	defer conn.Close()
+	remote, err := dial("tcp", upstream)
+	if err != nil {
+		logf("%s: %v", upstream, err)
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{}, 2)
+	pipe := func(from, to net.Conn) {
+		io.Copy(to, from)
+		if half, ok := to.(interface{ CloseWrite() error }); ok {
+			half.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(conn, remote)
+	go pipe(remote, conn)
+	<-done
+	<-done
+}
+
+// Close unbinds everything, and takes the block out of the hosts file.
+func (b *Binder) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for address, ln := range b.listeners {
+		ln.Close()
+		delete(b.listeners, address)
+	}
+	for host, ip := range b.assigned {
+		removeAlias(ip.String(), b.log)
+		delete(b.assigned, host)
+	}
+	b.writeHosts("")
+}
+
+// Hosts returns the block of the hosts file, as it was last written.
+func (b *Binder) Hosts() string {
+	return b.hosts.Block()
+}
@@ -0,0 +1,95 @@
+package loopback
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBind(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte("127.0.0.1 localhost\n"), 0644)
+
+	dialed := make(chan string, 1)
+	b, err := NewBinder("127.0.2.0/24", hosts, func(network, address string) (net.Conn, error) {
+		dialed <- address
+		return net.Dial(network, backend.Addr().String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the port of the backend is as good as any, since nothing else
+	// listens on the alias
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+	p, _ := strconv.Atoi(port)
+	b.Bind([]Service{{Host: "web.default.svc.cluster.local", Names: []string{"web.default"}, Ports: []int{p}}})
+	defer b.Close()
+
+	content, _ := ioutil.ReadFile(hosts)
+	if !strings.Contains(string(content), "127.0.2.1 web.default\n") {
+		t.Errorf("hosts:\n%s", content)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.2.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if address := <-dialed; string(data) != "hello" || address != "web.default.svc.cluster.local:"+port {
+		t.Errorf("read %q, dialed %s", data, address)
+	}
+
+	b.Bind(nil)
+	if _, err := net.Dial("tcp", net.JoinHostPort("127.0.2.1", port)); err == nil {
+		t.Error("still bound")
+	}
+	content, _ = ioutil.ReadFile(hosts)
+	if string(content) != "127.0.0.1 localhost\n" {
+		t.Errorf("hosts after unbinding:\n%s", content)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	_, network, _ := net.ParseCIDR("127.0.2.0/30")
+	assigned := make(map[string]net.IP)
+	for _, expected := range []string{"127.0.2.1", "127.0.2.2", "<nil>"} {
+		ip := Allocate(network, assigned)
+		if ip.String() != expected {
+			t.Errorf("expected %s, got %s", expected, ip)
+		}
+		assigned[expected] = ip
+	}
+
+	// 127.0.0.1 is the host's own
+	_, network, _ = net.ParseCIDR("127.0.0.0/29")
+	if ip := Allocate(network, nil); ip.String() != "127.0.0.2" {
+		t.Errorf("expected 127.0.0.2, got %s", ip)
+	}
+}
@@ -0,0 +1,141 @@
+// Package lsm looks for the linux security modules, SELinux and
+// AppArmor, that confine programs on hardened hosts, and explains the
+// cryptic permission errors they cause teleproxy. Its policies permit
+// exactly what teleproxy does.
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Module is a security module found on the host.
+type Module struct {
+	// Name is "selinux" or "apparmor".
+	Name string `json:"name"`
+	// Enforcing is whether it denies what its policy doesn't
+	// permit, rather than just logging it.
+	Enforcing bool `json:"enforcing"`
+	// Context is what teleproxy runs as: its SELinux label, e.g.
+	// "system_u:system_r:teleproxy_t:s0", or its AppArmor profile.
+	Context string `json:"context"`
+	// Confined is whether the policy restricts teleproxy at all.
+	// Unconfined processes, e.g. one from sudo in an unconfined
+	// shell, have nothing denied.
+	Confined bool `json:"confined"`
+}
+
+// Denies is whether the module may deny teleproxy anything.
+func (m Module) Denies() bool {
+	return m.Enforcing && m.Confined
+}
+
+func (m Module) title() string {
+	if m.Name == "selinux" {
+		return "SELinux"
+	}
+	return "AppArmor"
+}
+
+func (m Module) String() string {
+	mode := "permissive"
+	if m.Enforcing {
+		mode = "enforcing"
+	}
+	confined := "unconfined"
+	if m.Confined {
+		confined = "confined"
+	}
+	return fmt.Sprintf("%s is %s, teleproxy runs %s as %s", m.title(), mode, confined, m.Context)
+}
+
+// denials says where the module logs what it denied.
+func (m Module) denials() string {
+	if m.Name == "selinux" {
+		return "ausearch -m avc -ts recent"
+	}
+	return `journalctl -k | grep 'apparmor="DENIED"'`
+}
+
+// Detect finds the security modules of this host, and what they make
+// of this process.
+func Detect() []Module {
+	return detect(func(path string) (string, error) {
+		data, err := ioutil.ReadFile(path)
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00")), err
+	})
+}
+
+func detect(read func(path string) (string, error)) (modules []Module) {
+	// the attributes of each module are under a directory of its own
+	// on recent kernels, and shared by whichever is the major module
+	// on older ones
+	attr := func(name string) string {
+		if context, err := read("/proc/self/attr/" + name + "/current"); err == nil {
+			return context
+		}
+		context, _ := read("/proc/self/attr/current")
+		return context
+	}
+	if enforce, err := read("/sys/fs/selinux/enforce"); err == nil {
+		m := Module{Name: "selinux", Enforcing: enforce == "1", Context: attr("selinux")}
+		fields := strings.Split(m.Context, ":")
+		m.Confined = len(fields) >= 3 && !strings.HasPrefix(fields[2], "unconfined_")
+		modules = append(modules, m)
+	}
+	if enabled, err := read("/sys/module/apparmor/parameters/enabled"); err == nil && enabled == "Y" {
+		// e.g. "/usr/local/bin/teleproxy (enforce)", or "unconfined"
+		m := Module{Name: "apparmor", Context: attr("apparmor")}
+		m.Confined = m.Context != "" && m.Context != "unconfined"
+		m.Enforcing = m.Confined && strings.HasSuffix(m.Context, "(enforce)")
+		modules = append(modules, m)
+	}
+	return
+}
+
+// A Denied is an error that a security module is likely behind.
+type Denied struct {
+	Err    error
+	Module Module
+}
+
+func (d *Denied) Error() string {
+	return fmt.Sprintf("%v (%s, which may be what denied this: check `%s`, "+
+		"or load the policy of `teleproxy security-policy %s`)", d.Err, d.Module, d.Module.denials(), d.Module.Name)
+}
+
+// Cause is the error itself.
+func (d *Denied) Cause() error {
+	return d.Err
+}
+
+// Explain returns err as a Denied if it is a permission error, and one
+// of modules may have denied it. Otherwise it returns err as it is.
+func Explain(err error, modules []Module) error {
+	if err == nil || !permission(err) {
+		return err
+	}
+	if _, ok := err.(*Denied); ok {
+		return err
+	}
+	for _, m := range modules {
+		if m.Denies() {
+			return &Denied{err, m}
+		}
+	}
+	return err
+}
+
+// permission is whether err is a permission error, of ours or of a
+// tool like iptables, which only says so in its output.
+func permission(err error) bool {
+	if os.IsPermission(errors.Cause(err)) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "permission denied") || strings.Contains(message, "operation not permitted")
+}
@@ -0,0 +1,105 @@
+package lsm
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func files(contents map[string]string) func(string) (string, error) {
+	return func(path string) (string, error) {
+		if content, ok := contents[path]; ok {
+			return content, nil
+		}
+		return "", os.ErrNotExist
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		files    map[string]string
+		expected []Module
+	}{
+		{"neither", nil, nil},
+		{"selinux, from sudo", map[string]string{
+			"/sys/fs/selinux/enforce": "1",
+			"/proc/self/attr/current": "unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023",
+		}, []Module{{Name: "selinux", Enforcing: true, Context: "unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023"}}},
+		{"selinux, as a service", map[string]string{
+			"/sys/fs/selinux/enforce": "1",
+			"/proc/self/attr/current": "system_u:system_r:init_t:s0",
+		}, []Module{{Name: "selinux", Enforcing: true, Context: "system_u:system_r:init_t:s0", Confined: true}}},
+		{"selinux, permissive", map[string]string{
+			"/sys/fs/selinux/enforce": "0",
+			"/proc/self/attr/current": "system_u:system_r:teleproxy_t:s0",
+		}, []Module{{Name: "selinux", Context: "system_u:system_r:teleproxy_t:s0", Confined: true}}},
+		{"apparmor, unconfined", map[string]string{
+			"/sys/module/apparmor/parameters/enabled": "Y",
+			"/proc/self/attr/current":                 "unconfined",
+		}, []Module{{Name: "apparmor", Context: "unconfined"}}},
+		{"apparmor, enforcing", map[string]string{
+			"/sys/module/apparmor/parameters/enabled": "Y",
+			"/proc/self/attr/apparmor/current":        "/usr/local/bin/teleproxy (enforce)",
+			"/proc/self/attr/current":                 "unconfined",
+		}, []Module{{Name: "apparmor", Enforcing: true, Context: "/usr/local/bin/teleproxy (enforce)", Confined: true}}},
+		{"apparmor, disabled", map[string]string{
+			"/sys/module/apparmor/parameters/enabled": "N",
+		}, nil},
+	} {
+		if got := detect(files(c.files)); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	enforcing := []Module{{Name: "selinux", Enforcing: true, Context: "system_u:system_r:init_t:s0", Confined: true}}
+	unconfined := []Module{{Name: "apparmor", Context: "unconfined"}}
+
+	denied := errors.New("iptables -t nat -N teleproxy: exit status 4: can't initialize iptables table `nat': Permission denied (you must be root)")
+	explained := Explain(denied, enforcing)
+	if _, ok := explained.(*Denied); !ok || !strings.Contains(explained.Error(), "ausearch -m avc") {
+		t.Errorf("expected the denial to be explained, got %v", explained)
+	}
+	if Explain(explained, enforcing) != explained {
+		t.Errorf("expected an explained error to be left alone")
+	}
+	if errors.Cause(explained) != denied {
+		t.Errorf("expected the cause to be the error itself")
+	}
+
+	wrapped := errors.Wrap(&os.PathError{Op: "open", Path: "/run/teleproxy.token", Err: os.ErrPermission}, "token")
+	if _, ok := Explain(wrapped, enforcing).(*Denied); !ok {
+		t.Errorf("expected a wrapped permission error to be explained")
+	}
+
+	for _, c := range []struct {
+		err     error
+		modules []Module
+	}{
+		{denied, unconfined},
+		{denied, nil},
+		{errors.New("exit status 1: no such chain"), enforcing},
+	} {
+		if got := Explain(c.err, c.modules); got != c.err {
+			t.Errorf("expected %v with %v to be left alone, got %v", c.err, c.modules, got)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	module, contexts := SELinux("/usr/local/bin/teleproxy.v2")
+	if !strings.HasPrefix(module, "policy_module(teleproxy") {
+		t.Errorf("expected a policy module, got %q", module)
+	}
+	if !strings.HasPrefix(contexts, `/usr/local/bin/teleproxy\.v2 -- gen_context(system_u:object_r:teleproxy_exec_t,s0)`) {
+		t.Errorf("expected the binary to be labeled, got %q", contexts)
+	}
+	if profile := AppArmor("/usr/local/bin/teleproxy"); !strings.Contains(profile, "\n/usr/local/bin/teleproxy {\n") {
+		t.Errorf("expected a profile for the binary, got %q", profile)
+	}
+}
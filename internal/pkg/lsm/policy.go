@@ -0,0 +1,145 @@
+package lsm
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SELinux returns a policy module (teleproxy.te) and its file contexts
+// (teleproxy.fc) that confine teleproxy, installed at binary, to what
+// it does: program the firewall with iptables or nft, through a
+// domain transition, relay connections, keep its token, lock, and
+// socket in /run, and the rest as in AppArmor. They are built with the
+// selinux-policy-devel Makefile.
+func SELinux(binary string) (module, contexts string) {
+	module = strings.TrimLeft(`
+policy_module(teleproxy, 1.0.0)
+
+type teleproxy_t;
+type teleproxy_exec_t;
+init_daemon_domain(teleproxy_t, teleproxy_exec_t)
+application_domain(teleproxy_t, teleproxy_exec_t)
+# so that sudo teleproxy is confined too
+unconfined_run_to(teleproxy_t, teleproxy_exec_t)
+
+type teleproxy_var_run_t;
+files_pid_file(teleproxy_var_run_t)
+type teleproxy_var_lib_t;
+files_type(teleproxy_var_lib_t)
+
+# the firewall, and the tun device of the tun backend
+allow teleproxy_t self:capability { net_admin net_bind_service net_raw dac_override chown fowner };
+allow teleproxy_t self:netlink_route_socket create_netlink_socket_perms;
+allow teleproxy_t self:netlink_netfilter_socket create_socket_perms;
+allow teleproxy_t self:rawip_socket create_socket_perms;
+allow teleproxy_t self:tun_socket create_socket_perms;
+corenet_rw_tun_tap_dev(teleproxy_t)
+iptables_domtrans(teleproxy_t)
+
+# the relay, the dns server, and the api
+allow teleproxy_t self:tcp_socket create_stream_socket_perms;
+allow teleproxy_t self:udp_socket create_socket_perms;
+allow teleproxy_t self:unix_stream_socket { create_stream_socket_perms connectto };
+allow teleproxy_t self:process { signal sigchld fork };
+allow teleproxy_t self:fifo_file rw_fifo_file_perms;
+corenet_tcp_bind_generic_node(teleproxy_t)
+corenet_udp_bind_generic_node(teleproxy_t)
+corenet_tcp_bind_all_ports(teleproxy_t)
+corenet_udp_bind_all_ports(teleproxy_t)
+corenet_tcp_connect_all_ports(teleproxy_t)
+corenet_sendrecv_all_packets(teleproxy_t)
+
+# the token, lock, and socket
+manage_files_pattern(teleproxy_t, teleproxy_var_run_t, teleproxy_var_run_t)
+manage_sock_files_pattern(teleproxy_t, teleproxy_var_run_t, teleproxy_var_run_t)
+files_pid_filetrans(teleproxy_t, teleproxy_var_run_t, { file sock_file })
+# the certificate authority of -tls-hosts
+manage_dirs_pattern(teleproxy_t, teleproxy_var_lib_t, teleproxy_var_lib_t)
+manage_files_pattern(teleproxy_t, teleproxy_var_lib_t, teleproxy_var_lib_t)
+files_var_lib_filetrans(teleproxy_t, teleproxy_var_lib_t, dir)
+
+# resolv.conf, and the hosts file of -hosts-dns and -loopback
+sysnet_manage_config(teleproxy_t)
+sysnet_read_config(teleproxy_t)
+kernel_read_system_state(teleproxy_t)
+kernel_read_network_state(teleproxy_t)
+kernel_rw_net_sysctls(teleproxy_t)
+fs_manage_cgroup_dirs(teleproxy_t)
+fs_rw_cgroup_files(teleproxy_t)
+miscfiles_read_localization(teleproxy_t)
+miscfiles_read_generic_certs(teleproxy_t)
+
+# kubectl, ssh, and hooks run as the user would
+corecmd_exec_bin(teleproxy_t)
+corecmd_exec_shell(teleproxy_t)
+ssh_exec(teleproxy_t)
+userdom_read_user_home_content_files(teleproxy_t)
+userdom_manage_user_home_content_dirs(teleproxy_t)
+userdom_manage_user_home_content_files(teleproxy_t)
+userdom_user_home_dir_filetrans_user_home_content(teleproxy_t, { dir file })
+optional_policy(`+"`"+`
+	docker_stream_connect(teleproxy_t)
+')
+`, "\n")
+	contexts = regexp.QuoteMeta(binary) + ` -- gen_context(system_u:object_r:teleproxy_exec_t,s0)
+/run/teleproxy\.(token|lock|sock) -- gen_context(system_u:object_r:teleproxy_var_run_t,s0)
+/var/lib/teleproxy(/.*)? gen_context(system_u:object_r:teleproxy_var_lib_t,s0)
+`
+	return
+}
+
+// AppArmor returns a profile that confines teleproxy, installed at
+// binary, to what it does. The firewall tools it runs are confined by
+// it too, while kubectl, ssh, and the shell of hooks run as the user
+// would.
+func AppArmor(binary string) string {
+	return `# teleproxy, from teleproxy security-policy apparmor
+#include <tunables/global>
+
+` + binary + ` {
+  #include <abstractions/base>
+  #include <abstractions/nameservice>
+  #include <abstractions/ssl_certs>
+
+  # the firewall, and the tun device of the tun backend
+  capability net_admin,
+  capability net_bind_service,
+  capability net_raw,
+  capability dac_override,
+  network netlink raw,
+  network inet raw,
+  /dev/net/tun rw,
+  /{usr/,}{s,}bin/{iptables,ip6tables,xtables}* rix,
+  /{usr/,}{s,}bin/{nft,ip,sysctl} rix,
+  /run/xtables.lock rwk,
+
+  # the relay, the dns server, and the api
+  network inet stream,
+  network inet dgram,
+  network inet6 stream,
+  network inet6 dgram,
+  network unix stream,
+  ` + binary + ` mr,
+  /run/teleproxy.{token,lock,sock} rwk,
+  /var/lib/teleproxy/{,**} rw,
+
+  # resolv.conf, and the hosts file of -hosts-dns and -loopback
+  /etc/resolv.conf r,
+  /run/systemd/resolve/* r,
+  /etc/hosts rw,
+  /{usr/,}{s,}bin/{nscd,resolvectl} rix,
+  @{PROC}/@{pid}/** r,
+  @{PROC}/sys/net/** rw,
+  /sys/fs/cgroup/** rw,
+  /tmp/** rwk,
+
+  # kubectl, ssh, and hooks run as the user would
+  /{usr/,}{local/,}bin/{kubectl,ssh,sh,bash,dash,docker,podman} Ux,
+  /run/docker.sock rw,
+  /run/podman/podman.sock rw,
+  owner @{HOME}/.kube/** r,
+  owner @{HOME}/.teleproxy/{,**} rw,
+  owner @{HOME}/.cache/teleproxy/{,**} rw,
+}
+`
+}
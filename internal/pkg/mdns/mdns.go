@@ -0,0 +1,235 @@
+// Package mdns advertises a service on the local network with
+// multicast dns, the way zeroconf (Bonjour, Avahi) does, so that it can
+// be browsed for with e.g. dns-sd -B or avahi-browse.
+package mdns
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// the group and port of multicast dns on ipv4
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// how long browsers may keep what we advertise, the default of RFC 6762
+// for records of a service
+const ttl = 120
+
+// browsing is the name listing the types of services on a network.
+const browsing = "_services._dns-sd._udp.local."
+
+// A Service is what is advertised.
+type Service struct {
+	// Instance names this particular one, e.g. "alice@laptop".
+	Instance string
+	// Type is the type of service, e.g. "_teleproxy._tcp".
+	Type string
+	// Host is the name of the host, with or without ".local", and Port
+	// where the service listens on it.
+	Host string
+	Port int
+	// Text, if set, returns the key=value pairs of the TXT
+	// record. It is consulted for every answer, so it may change.
+	Text func() []string
+}
+
+func (s Service) typeName() string {
+	return strings.ToLower(s.Type) + ".local."
+}
+
+func (s Service) instanceName() string {
+	return escape(s.Instance) + "." + s.typeName()
+}
+
+func (s Service) hostName() string {
+	return strings.TrimSuffix(strings.ToLower(s.Host), ".local") + ".local."
+}
+
+// escape makes name a label of its own, escaped the way names are
+// written, e.g. in questions
+func escape(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`. @;()"\$`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// An Advertiser answers queries for a Service.
+type Advertiser struct {
+	service Service
+	conn    *net.UDPConn
+	ips     func() []net.IP
+	done    sync.WaitGroup
+}
+
+// Advertise joins the multicast dns group, announces service, and
+// answers queries for it until Close.
+func Advertise(service Service) (*Advertiser, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	a := &Advertiser{service: service, conn: conn, ips: localIPs}
+	a.announce(ttl)
+	a.done.Add(1)
+	go a.serve()
+	return a, nil
+}
+
+// Close says goodbye, so that browsers forget the service at once
+// rather than when it expires, and stops answering.
+func (a *Advertiser) Close() error {
+	a.announce(0)
+	err := a.conn.Close()
+	a.done.Wait()
+	return err
+}
+
+func (a *Advertiser) serve() {
+	defer a.done.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil || query.Response || len(query.Question) == 0 {
+			continue
+		}
+		reply := a.reply(&query, ttl)
+		if reply == nil {
+			continue
+		}
+		to := group
+		if from.Port != group.Port {
+			// a plain resolver asking, which wants the reply
+			// to itself, like unicast dns
+			reply.Id = query.Id
+			reply.Question = query.Question
+			to = from
+		}
+		a.send(reply, to)
+	}
+}
+
+// announce sends every record of the service unasked, with the ttl
+// given, which is 0 to withdraw them.
+func (a *Advertiser) announce(ttl uint32) {
+	reply := new(dns.Msg)
+	reply.Response = true
+	reply.Authoritative = true
+	reply.Answer = append(a.pointer(ttl), a.records(ttl)...)
+	a.send(reply, group)
+}
+
+func (a *Advertiser) send(msg *dns.Msg, to *net.UDPAddr) {
+	data, err := msg.Pack()
+	if err == nil {
+		_, err = a.conn.WriteToUDP(data, to)
+	}
+	if err != nil {
+		log.Printf("MDN: %v", err)
+	}
+}
+
+// reply answers what of query is about the service, or returns nil if
+// nothing is.
+func (a *Advertiser) reply(query *dns.Msg, ttl uint32) *dns.Msg {
+	s := a.service
+	reply := new(dns.Msg)
+	reply.Response = true
+	reply.Authoritative = true
+	for _, q := range query.Question {
+		name := strings.ToLower(q.Name)
+		switch {
+		case name == browsing && matches(q, dns.TypePTR):
+			reply.Answer = append(reply.Answer, &dns.PTR{Hdr: header(browsing, dns.TypePTR, ttl), Ptr: s.typeName()})
+		case name == s.typeName() && matches(q, dns.TypePTR):
+			reply.Answer = append(reply.Answer, a.pointer(ttl)...)
+			reply.Extra = append(reply.Extra, a.records(ttl)...)
+		case name == strings.ToLower(s.instanceName()):
+			for _, rr := range a.records(ttl) {
+				if matches(q, rr.Header().Rrtype) && rr.Header().Name == s.instanceName() {
+					reply.Answer = append(reply.Answer, rr)
+				}
+			}
+		case name == s.hostName() && matches(q, dns.TypeA):
+			reply.Answer = append(reply.Answer, a.addresses(ttl)...)
+		}
+	}
+	if len(reply.Answer) == 0 {
+		return nil
+	}
+	return reply
+}
+
+func (a *Advertiser) pointer(ttl uint32) []dns.RR {
+	return []dns.RR{&dns.PTR{Hdr: header(a.service.typeName(), dns.TypePTR, ttl), Ptr: a.service.instanceName()}}
+}
+
+// records are the SRV and TXT of the instance, and the addresses of
+// the host it points at.
+func (a *Advertiser) records(ttl uint32) []dns.RR {
+	s := a.service
+	var text []string
+	if s.Text != nil {
+		text = s.Text()
+	}
+	if len(text) == 0 {
+		// a TXT record can't be empty
+		text = []string{""}
+	}
+	records := []dns.RR{
+		&dns.SRV{Hdr: header(s.instanceName(), dns.TypeSRV, ttl), Port: uint16(s.Port), Target: s.hostName()},
+		&dns.TXT{Hdr: header(s.instanceName(), dns.TypeTXT, ttl), Txt: text},
+	}
+	return append(records, a.addresses(ttl)...)
+}
+
+func (a *Advertiser) addresses(ttl uint32) (result []dns.RR) {
+	for _, ip := range a.ips() {
+		result = append(result, &dns.A{Hdr: header(a.service.hostName(), dns.TypeA, ttl), A: ip})
+	}
+	return
+}
+
+func matches(q dns.Question, rrtype uint16) bool {
+	return q.Qtype == rrtype || q.Qtype == dns.TypeANY
+}
+
+func header(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
+
+// localIPs are the ipv4 addresses of the interfaces that are up and
+// multicast, other than loopback.
+func localIPs() (result []net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				result = append(result, ipnet.IP.To4())
+			}
+		}
+	}
+	return
+}
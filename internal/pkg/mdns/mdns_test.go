@@ -0,0 +1,56 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReply(t *testing.T) {
+	a := &Advertiser{
+		service: Service{
+			Instance: "alice@laptop",
+			Type:     "_teleproxy._tcp",
+			Host:     "Laptop.local",
+			Port:     7979,
+			Text:     func() []string { return []string{"user=alice", "context=dev"} },
+		},
+		ips: func() []net.IP { return []net.IP{net.IPv4(192, 168, 1, 20).To4()} },
+	}
+	ask := func(name string, qtype uint16) *dns.Msg {
+		query := new(dns.Msg)
+		query.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+		return a.reply(query, ttl)
+	}
+
+	if reply := ask("_services._dns-sd._udp.local.", dns.TypePTR); reply == nil || reply.Answer[0].(*dns.PTR).Ptr != "_teleproxy._tcp.local." {
+		t.Errorf("expected browsing to list the service type, got %v", reply)
+	}
+
+	reply := ask("_teleproxy._tcp.local.", dns.TypePTR)
+	if reply == nil || len(reply.Answer) != 1 || reply.Answer[0].(*dns.PTR).Ptr != "alice\\@laptop._teleproxy._tcp.local." {
+		t.Fatalf("expected a pointer to the instance, got %v", reply)
+	}
+	if len(reply.Extra) != 3 {
+		t.Fatalf("expected the SRV, TXT, and A along with it, got %v", reply.Extra)
+	}
+	if srv := reply.Extra[0].(*dns.SRV); srv.Port != 7979 || srv.Target != "laptop.local." {
+		t.Errorf("expected the service at laptop.local.:7979, got %s:%d", srv.Target, srv.Port)
+	}
+	if txt := reply.Extra[1].(*dns.TXT); len(txt.Txt) != 2 || txt.Txt[1] != "context=dev" {
+		t.Errorf("expected the text of the service, got %v", txt.Txt)
+	}
+
+	if reply := ask("ALICE\\@laptop._teleproxy._tcp.local.", dns.TypeTXT); reply == nil || len(reply.Answer) != 1 {
+		t.Errorf("expected just the TXT of the instance, got %v", reply)
+	}
+	if reply := ask("laptop.local.", dns.TypeA); reply == nil || !reply.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("expected the address of the host, got %v", reply)
+	}
+	for _, name := range []string{"_http._tcp.local.", "bob@desktop._teleproxy._tcp.local.", "desktop.local."} {
+		if reply := ask(name, dns.TypeANY); reply != nil {
+			t.Errorf("expected no reply about %s, got %v", name, reply)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package nat
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Change is a mapping being added, replaced, or (with an empty Port)
+// removed. Resync marks the first change a subscriber gets after
+// missing some, when it must take a Snapshot to catch up.
+type Change struct {
+	Address Address
+	Port    string
+	Resync  bool
+}
+
+// Mappings are the local ports that addresses are redirected to. They
+// are written as the firewall is programmed and read from the paths
+// that relay connections, so they are safe for concurrent use, and
+// whoever needs to keep up with them can subscribe to their changes
+// rather than poll.
+type Mappings struct {
+	mutex       sync.RWMutex
+	ports       map[Address]string
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	changes chan Change
+	missed  bool
+}
+
+func newMappings() *Mappings {
+	return &Mappings{ports: make(map[Address]string), subscribers: make(map[*subscriber]bool)}
+}
+
+// Get returns the port address is redirected to, if any.
+func (m *Mappings) Get(address Address) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	port, ok := m.ports[address]
+	return port, ok
+}
+
+// Set redirects address to port, returning what it was redirected to
+// before, if anything.
+func (m *Mappings) Set(address Address, port string) (previous string, existed bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous, existed = m.ports[address]
+	m.ports[address] = port
+	if !existed || previous != port {
+		m.notify(Change{Address: address, Port: port})
+	}
+	return
+}
+
+// Delete removes the redirect of address, returning what it was, if
+// anything.
+func (m *Mappings) Delete(address Address) (previous string, existed bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous, existed = m.ports[address]
+	if existed {
+		delete(m.ports, address)
+		m.notify(Change{Address: address})
+	}
+	return
+}
+
+// restore puts back what Set or Delete of address returned, for a
+// change the firewall didn't take.
+func (m *Mappings) restore(address Address, previous string, existed bool) {
+	if existed {
+		m.Set(address, previous)
+	} else {
+		m.Delete(address)
+	}
+}
+
+// Len returns how many addresses are redirected.
+func (m *Mappings) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.ports)
+}
+
+// Entries returns the mappings in a stable order.
+func (m *Mappings) Entries() []Entry {
+	m.mutex.RLock()
+	entries := make([]Entry, 0, len(m.ports))
+	for k, v := range m.ports {
+		entries = append(entries, Entry{k, v})
+	}
+	m.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Compare(entries[i].String(), entries[j].String()) < 0
+	})
+
+	return entries
+}
+
+// Subscribe returns a channel of the changes to come, buffering up to
+// buffer of them, and a function that cancels the subscription and
+// closes the channel. Changes are never waited on: a subscriber that
+// falls behind misses some, and learns so from the Resync of whichever
+// change it gets next.
+func (m *Mappings) Subscribe(buffer int) (<-chan Change, func()) {
+	s := &subscriber{changes: make(chan Change, buffer)}
+	m.mutex.Lock()
+	m.subscribers[s] = true
+	m.mutex.Unlock()
+	var once sync.Once
+	return s.changes, func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			delete(m.subscribers, s)
+			m.mutex.Unlock()
+			close(s.changes)
+		})
+	}
+}
+
+// this assumes that m.mutex is already held for writing
+func (m *Mappings) notify(change Change) {
+	for s := range m.subscribers {
+		c := change
+		c.Resync = s.missed
+		select {
+		case s.changes <- c:
+			s.missed = false
+		default:
+			s.missed = true
+		}
+	}
+}
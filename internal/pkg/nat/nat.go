@@ -2,13 +2,216 @@ package nat
 
 import (
 	"fmt"
-	"sort"
+	"log"
+	"net"
 	"strings"
+	"sync"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+	"github.com/datawire/teleproxy/pkg/origdst"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// A Translator programs the system firewall to redirect traffic for
+// particular destination addresses to local ports, and can recover
+// the original destination of a redirected connection.
+type Translator interface {
+	// Enable installs whatever top level firewall configuration
+	// the translator needs. It must be invoked before any other
+	// method.
+	Enable() error
+	// Disable removes everything the translator has installed.
+	Disable() error
+	// Forward redirects traffic for protocol ("tcp" or "udp")
+	// destined to ip to the local port toPort, replacing any
+	// previous mapping for the same address.
+	Forward(protocol, ip, toPort string) error
+	// Clear removes any mapping for the address.
+	Clear(protocol, ip string) error
+	// GetOriginalDst returns the destination (host:port) a
+	// redirected connection was originally headed for.
+	GetOriginalDst(conn *net.TCPConn) (host string, err error)
+	// Snapshot returns the current mappings in a stable order.
+	Snapshot() []Entry
+	// Subscribe returns the changes to the mappings to come, see
+	// Mappings.Subscribe.
+	Subscribe(buffer int) (<-chan Change, func())
+	// Configure changes settings that take effect on the next
+	// Enable.
+	Configure(config Config)
+}
+
+// A Router is a Translator that routes ranges through a device of its
+// own, see Config.RouteCIDRs, and can change them while enabled.
+type Router interface {
+	// Route changes the ranges routed to cidrs, adding and removing
+	// only the routes that differ, so that the mappings, and the
+	// connections to everything else, are left alone.
+	Route(cidrs []string) error
+}
+
+// Config holds settings shared by all backends.
+type Config struct {
+	// IncludeInterfaces restricts interception of forwarded
+	// traffic (e.g. from containers) to packets arriving on these
+	// interfaces. Empty means every interface. Traffic from local
+	// processes is always intercepted.
+	IncludeInterfaces []string
+	// ExcludeInterfaces lists interfaces whose forwarded traffic
+	// is never intercepted.
+	ExcludeInterfaces []string
+	// RouteCIDRs lists ranges (e.g. the service and pod ranges of a
+	// cluster) to route through a device of our own, so that their
+	// traffic reaches the firewall even if a VPN client would take
+	// it first. Only the pf backend supports this, and it can change
+	// them while enabled, see Router.
+	RouteCIDRs []string
+	// Cgroup, if set, restricts interception to the traffic of
+	// processes in this cgroup (a cgroup v2 path, e.g.
+	// "teleproxy"), leaving the rest of the host, containers
+	// included, alone. The iptables and nftables backends support
+	// this.
+	Cgroup string
+	// ClampMSS lowers the maximum segment size that intercepted tcp
+	// connections negotiate to what the path MTU allows, for VPNs
+	// that drop the icmp needed to discover it. The iptables and
+	// nftables backends support this.
+	ClampMSS bool
+	// MTU is the MTU of the device the tun backend creates, 1500 by
+	// default. Connections through it negotiate segments that fit.
+	MTU int
+	// BypassMark, if not zero, is the firewall mark of sockets that
+	// are never redirected, so that teleproxy can dial destinations
+	// directly. The iptables and nftables backends support this.
+	BypassMark int
+	// Timeouts, if set, says how long the udp flows that the tun
+	// backend relays may be idle for, by destination.
+	Timeouts *timeouts.Table
+	// RejectQUIC answers udp to port 443 of the addresses forwarded
+	// for tcp with an icmp port unreachable. Only tcp is relayed, and
+	// browsers trying QUIC (HTTP/3) otherwise stall for seconds
+	// before falling back to it. The iptables, nftables, and pf
+	// backends support this.
+	RejectQUIC bool
+	// JumpAfter, if set, is a chain, e.g. a security agent's, whose
+	// jumps must come ahead of ours: ours go right after them rather
+	// than first in the chains of the system. Only the iptables
+	// backend needs this, since the chains of nftables see every
+	// packet, whatever the chains ahead of them accept.
+	JumpAfter string
+}
+
+// logf logs a line of ours, noting what the addresses in it belong
+// to.
+func logf(line string, args ...interface{}) {
+	log.Print(route.Annotate(fmt.Sprintf("NAT: "+line, args...)))
+}
+
+// originalDst is GetOriginalDst for the backends that leave it to the
+// kernel's NAT.
+func originalDst(conn *net.TCPConn) (string, error) {
+	addr, err := origdst.Lookup(conn)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// run executes a firewall tool. It is a variable so tests can
+// substitute a fake.
+var run = func(command []string, input string, logf func(string, ...interface{})) (output string, err error) {
+	err = timed(command, func() error {
+		output, err = tpu.CmdLogInput(command, input, func(line string) { logf("%s", line) })
+		return err
+	})
+	return
+}
+
+// A Backend describes a Translator implementation.
+type Backend struct {
+	Name string
+	// New constructs a Translator that manages a table/chain/anchor
+	// with the given name.
+	New func(name string) Translator
+	// Detect reports whether the backend can be used on this
+	// host. A nil Detect means the backend is always usable.
+	Detect func() bool
+}
+
+var (
+	backends     []Backend
+	backendsLock sync.Mutex
 )
 
+// Register makes a backend available to NewTranslator. Backends are
+// tried in registration order when auto detecting, so platform
+// default backends should register first.
+func Register(backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	for _, b := range backends {
+		if b.Name == backend.Name {
+			panic(fmt.Sprintf("nat backend already registered: %s", backend.Name))
+		}
+	}
+	backends = append(backends, backend)
+}
+
+// Backends returns the names of all registered backends.
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	return backendNames()
+}
+
+// NewTranslator constructs a Translator using the named backend. If
+// backend is "" or "auto", the first registered backend that detects
+// as usable is chosen.
+func NewTranslator(backend, name string) (Translator, error) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if backend == "" || backend == "auto" {
+		for _, b := range backends {
+			if b.Detect == nil || b.Detect() {
+				return b.New(name), nil
+			}
+		}
+		return nil, fmt.Errorf("no usable nat backend found (tried: %s)", strings.Join(backendNames(), ", "))
+	}
+
+	for _, b := range backends {
+		if b.Name == backend {
+			return b.New(name), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown nat backend %q (available: %s)", backend, strings.Join(backendNames(), ", "))
+}
+
+// backendNames assumes backendsLock is held
+func backendNames() (names []string) {
+	for _, b := range backends {
+		names = append(names, b.Name)
+	}
+	return
+}
+
 type commonTranslator struct {
 	Name     string
-	Mappings map[Address]string
+	Mappings *Mappings
+	config   Config
+}
+
+func (t *commonTranslator) Configure(config Config) {
+	t.config = config
+}
+
+func newCommonTranslator(name string) commonTranslator {
+	return commonTranslator{
+		Name:     name,
+		Mappings: newMappings(),
+	}
 }
 
 type Address struct {
@@ -25,25 +228,26 @@ func (e *Entry) String() string {
 	return fmt.Sprintf("%s:%s->%s", e.Destination.Proto, e.Destination.Ip, e.Port)
 }
 
-func (t *Translator) sorted() []Entry {
-	entries := make([]Entry, len(t.Mappings))
+// Error reports a failure to program the system firewall. The
+// underlying error is usually a *tpu.CmdError carrying the stderr and
+// exit code of the firewall tool.
+type Error struct {
+	Op  string
+	Err error
+}
 
-	index := 0
-	for k, v := range t.Mappings {
-		entries[index] = Entry{k, v}
-		index += 1
-	}
+func (e *Error) Error() string {
+	return fmt.Sprintf("nat %s: %v", e.Op, e.Err)
+}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return strings.Compare(entries[i].String(), entries[j].String()) < 0
-	})
+func (t *commonTranslator) sorted() []Entry {
+	return t.Mappings.Entries()
+}
 
-	return entries
+func (t *commonTranslator) Snapshot() []Entry {
+	return t.sorted()
 }
 
-func NewTranslator(name string) *Translator {
-	var t Translator
-	t.Name = name
-	t.Mappings = make(map[Address]string)
-	return &t
+func (t *commonTranslator) Subscribe(buffer int) (<-chan Change, func()) {
+	return t.Mappings.Subscribe(buffer)
 }
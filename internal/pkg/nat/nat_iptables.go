@@ -4,124 +4,345 @@ package nat
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"syscall"
+	"strconv"
+	"sync"
 
 	"github.com/datawire/teleproxy/pkg/tpu"
 )
 
-type Translator struct {
+func init() {
+	Register(Backend{
+		Name: "iptables",
+		New: func(name string) Translator {
+			return &iptablesTranslator{commonTranslator: newCommonTranslator(name)}
+		},
+		Detect: func() bool {
+			_, err := tpu.Cmd("iptables", "-t", "nat", "-L", "-n")
+			return err == nil
+		},
+	})
+}
+
+type iptablesTranslator struct {
 	commonTranslator
+	// forward is the chain that jumps to ours in the filter table
+	// for forwarded traffic: DOCKER-USER where Docker is, FORWARD
+	// otherwise
+	forward string
+	// mutex keeps the checks of Docker's rules from running
+	// iptables at the same time as Forward and Clear
+	mutex         sync.Mutex
+	stop, stopped chan struct{}
 }
 
-func (t *Translator) log(line string, args ...interface{}) {
-	log.Printf("NAT: "+line, args...)
+func (t *iptablesTranslator) log(line string, args ...interface{}) {
+	logf(line, args...)
 }
 
-func (t *Translator) ipt(args ...string) {
-	tpu.CmdLogf(append([]string{"iptables", "-t", "nat"}, args...), t.log)
+func (t *iptablesTranslator) ipt(args ...string) error {
+	_, err := run(append([]string{"iptables", "-t", "nat"}, args...), "", t.log)
+	return err
 }
 
-func (t *Translator) Enable() {
-	// XXX: -D only removes one copy of the rule, need to figure out how to remove all copies just in case
-	t.ipt("-D", "OUTPUT", "-j", t.Name)
-	// we need to be in the PREROUTING chain in order to get traffic
-	// from docker containers, not sure you would *always* want this,
-	// but probably makes sense as a default
-	t.ipt("-D", "PREROUTING", "-j", t.Name)
-	t.ipt("-N", t.Name)
-	t.ipt("-F", t.Name)
-	t.ipt("-I", "OUTPUT", "1", "-j", t.Name)
-	t.ipt("-I", "PREROUTING", "1", "-j", t.Name)
-	t.ipt("-A", t.Name, "-j", "RETURN", "--dest", "127.0.0.1/32", "-p", "tcp")
+// mangle runs iptables on the mangle table, where our chain of the
+// same name clamps the mss of intercepted connections.
+func (t *iptablesTranslator) mangle(op string, args ...string) error {
+	_, err := run(append([]string{"iptables", "-t", "mangle"}, args...), "", t.log)
+	if err != nil && op != "" {
+		return &Error{Op: op, Err: err}
+	}
+	return err
 }
 
-func (t *Translator) Disable() {
-	// XXX: -D only removes one copy of the rule, need to figure out how to remove all copies just in case
-	t.ipt("-D", "OUTPUT", "-j", t.Name)
-	t.ipt("-D", "PREROUTING", "-j", t.Name)
-	t.ipt("-F", t.Name)
-	t.ipt("-X", t.Name)
+// filter runs iptables on the filter table, where our chain of the
+// same name rejects QUIC to intercepted addresses.
+func (t *iptablesTranslator) filter(op string, args ...string) error {
+	_, err := run(append([]string{"iptables", "-t", "filter"}, args...), "", t.log)
+	if err != nil && op != "" {
+		return &Error{Op: op, Err: err}
+	}
+	return err
 }
 
-func (t *Translator) ForwardTCP(ip, toPort string) {
-	t.forward("tcp", ip, toPort)
+func (t *iptablesTranslator) quic(ip string) []string {
+	return []string{t.Name, "--dest", ip + "/32", "-p", "udp", "--dport", "443", "-j", "REJECT", "--reject-with", "icmp-port-unreachable"}
 }
 
-func (t *Translator) ForwardUDP(ip, toPort string) {
-	t.forward("udp", ip, toPort)
+func (t *iptablesTranslator) clamp(ip string) []string {
+	return []string{t.Name, "--dest", ip + "/32", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
 }
 
-func (t *Translator) forward(protocol, ip, toPort string) {
-	t.clear(protocol, ip)
-	t.ipt("-A", t.Name, "-j", "REDIRECT", "--dest", ip+"/32", "-p", protocol, "--to-ports", toPort)
-	t.Mappings[Address{protocol, ip}] = toPort
+// output is the rule in OUTPUT that jumps to the main chain.
+func (t *iptablesTranslator) output() []string {
+	if t.config.Cgroup != "" {
+		return []string{"-m", "cgroup", "--path", t.config.Cgroup, "-j", t.Name}
+	}
+	return []string{"-j", t.Name}
 }
 
-func (t *Translator) ClearTCP(ip string) {
-	t.clear("tcp", ip)
+// pre is the chain that PREROUTING jumps to. It decides which
+// forwarded traffic gets sent on to the main chain.
+func (t *iptablesTranslator) pre() string {
+	return t.Name + "-pre"
 }
 
-func (t *Translator) ClearUDP(ip string) {
-	t.clear("udp", ip)
+// iptAll runs each set of iptables arguments in order, stopping at
+// the first failure.
+func (t *iptablesTranslator) iptAll(op string, commands ...[]string) error {
+	for _, args := range commands {
+		if err := t.ipt(args...); err != nil {
+			return &Error{Op: op, Err: err}
+		}
+	}
+	return nil
 }
 
-func (t *Translator) clear(protocol, ip string) {
-	if previous, exists := t.Mappings[Address{protocol, ip}]; exists {
-		t.ipt("-D", t.Name, "-j", "REDIRECT", "--dest", ip+"/32", "-p", protocol, "--to-ports", previous)
-		delete(t.Mappings, Address{protocol, ip})
+func (t *iptablesTranslator) Enable() error {
+	t.unwatchDocker()
+	rules := t.save()
+	t.forward = "FORWARD"
+	if rules.has("filter", dockerUser) {
+		t.forward = dockerUser
 	}
+	if err := t.enable(); err != nil {
+		return err
+	}
+	t.watchDocker(rules)
+	return nil
 }
 
-const (
-	SO_ORIGINAL_DST      = 80
-	IP6T_SO_ORIGINAL_DST = 80
-)
+// maxCopies bounds how many copies of a rule unjump removes, should
+// iptables keep saying that it is there.
+const maxCopies = 16
 
-// get the original destination for the socket when redirect by linux iptables
-// refer to https://raw.githubusercontent.com/missdeer/avege/master/src/inbound/redir/redir_iptables.go
-//
-func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host string, err error) {
-	var addr *syscall.IPv6Mreq
-
-	// Get original destination
-	// this is the only syscall in the Golang libs that I can find that returns 16 bytes
-	// Example result: &{Multiaddr:[2 0 31 144 206 190 36 45 0 0 0 0 0 0 0 0] Interface:0}
-	// port starts at the 3rd byte and is 2 bytes long (31 144 = port 8080)
-	// IPv6 version, didn't find a way to detect network family
-	//addr, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
-	// IPv4 address starts at the 5th byte, 4 bytes long (206 190 36 45)
-	rawConn, err := conn.SyscallConn()
-	if err != nil {
-		return nil, "", err
-	}
-
-	err = rawConn.Control(func(fd uintptr) {
-		addr, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
-	})
-	if err != nil {
-		return nil, "", err
-	}
-
-	// \attention: IPv4 only!!!
-	// address type, 1 - IPv4, 4 - IPv6, 3 - hostname, only IPv4 is supported now
-	rawaddr = append(rawaddr, byte(1))
-	// raw IP address, 4 bytes for IPv4 or 16 bytes for IPv6, only IPv4 is supported now
-	rawaddr = append(rawaddr, addr.Multiaddr[4])
-	rawaddr = append(rawaddr, addr.Multiaddr[5])
-	rawaddr = append(rawaddr, addr.Multiaddr[6])
-	rawaddr = append(rawaddr, addr.Multiaddr[7])
-	// port
-	rawaddr = append(rawaddr, addr.Multiaddr[2])
-	rawaddr = append(rawaddr, addr.Multiaddr[3])
-
-	host = fmt.Sprintf("%d.%d.%d.%d:%d",
-		addr.Multiaddr[4],
-		addr.Multiaddr[5],
-		addr.Multiaddr[6],
-		addr.Multiaddr[7],
-		uint16(addr.Multiaddr[2])<<8+uint16(addr.Multiaddr[3]))
-
-	return rawaddr, host, nil
+// quiet logs nothing, for the commands that are expected to fail.
+func quiet(string, ...interface{}) {}
+
+// exists is whether chain in table has rule, as iptables -C checks.
+func (t *iptablesTranslator) exists(table, chain string, rule []string) bool {
+	_, err := run(append([]string{"iptables", "-t", table, "-C", chain}, rule...), "", quiet)
+	return err == nil
+}
+
+// chainExists is whether table has chain.
+func (t *iptablesTranslator) chainExists(table, chain string) bool {
+	_, err := run([]string{"iptables", "-t", table, "-n", "-L", chain}, "", quiet)
+	return err == nil
+}
+
+// insertJump inserts j at its position in its chain, see position,
+// unless the chain has it already, so that enabling again leaves one
+// copy of each jump. Where Docker has moved ahead of it, reorder puts
+// it back.
+func (t *iptablesTranslator) insertJump(op string, rules ruleset, j jump) error {
+	if t.exists(j.table, j.chain, j.rule) {
+		return nil
+	}
+	command := []string{"iptables", "-t", j.table, "-I", j.chain, strconv.Itoa(t.position(rules, j))}
+	if _, err := run(append(command, j.rule...), "", t.log); err != nil {
+		return &Error{Op: op, Err: err}
+	}
+	return nil
+}
+
+// unjump removes every copy of rule from chain, where -D only removes
+// one.
+func (t *iptablesTranslator) unjump(table, chain string, rule []string) {
+	for n := 0; n < maxCopies && t.exists(table, chain, rule); n++ {
+		run(append([]string{"iptables", "-t", table, "-D", chain}, rule...), "", t.log)
+	}
+}
+
+// newChain creates chain in table, or flushes it if it is left over.
+func (t *iptablesTranslator) newChain(op, table, chain string) error {
+	command := "-N"
+	if t.chainExists(table, chain) {
+		command = "-F"
+	}
+	if _, err := run([]string{"iptables", "-t", table, command, chain}, "", t.log); err != nil {
+		return &Error{Op: op, Err: err}
+	}
+	return nil
+}
+
+// dropChain removes chain from table, if it is there.
+func (t *iptablesTranslator) dropChain(op, table, chain string) error {
+	if !t.chainExists(table, chain) {
+		return nil
+	}
+	for _, command := range []string{"-F", "-X"} {
+		if _, err := run([]string{"iptables", "-t", table, command, chain}, "", t.log); err != nil {
+			return &Error{Op: op, Err: err}
+		}
+	}
+	return nil
+}
+
+// enable can run again, as reconnecting does, or after a run that
+// didn't get to Disable, and leaves the firewall as one run would:
+// jumps that are there already are kept rather than added again, our
+// chains are flushed and filled afresh, and the mappings so far are
+// programmed into them again.
+func (t *iptablesTranslator) enable() error {
+	// older versions jumped straight from PREROUTING to the main
+	// chain
+	t.unjump("nat", "PREROUTING", []string{"-j", t.Name})
+	if t.config.Cgroup != "" {
+		// left over from a run without a cgroup
+		t.unjump("nat", "OUTPUT", []string{"-j", t.Name})
+		t.unjump("nat", "PREROUTING", []string{"-j", t.pre()})
+	}
+	for _, chain := range []string{t.Name, t.pre()} {
+		if err := t.newChain("enable", "nat", chain); err != nil {
+			return err
+		}
+	}
+
+	var commands [][]string
+	// Excluded interfaces RETURN from our own chain rather than
+	// from PREROUTING, so the rest of PREROUTING (e.g. docker's
+	// port publishing) still applies to them.
+	for _, iface := range t.config.ExcludeInterfaces {
+		commands = append(commands, []string{"-A", t.pre(), "-i", iface, "-j", "RETURN"})
+	}
+	if len(t.config.IncludeInterfaces) == 0 {
+		commands = append(commands, []string{"-A", t.pre(), "-j", t.Name})
+	} else {
+		for _, iface := range t.config.IncludeInterfaces {
+			commands = append(commands, []string{"-A", t.pre(), "-i", iface, "-j", t.Name})
+		}
+	}
+	commands = append(commands, []string{"-A", t.Name, "-j", "RETURN", "--dest", "127.0.0.1/32", "-p", "tcp"})
+	if t.config.BypassMark != 0 {
+		commands = append(commands, []string{"-A", t.Name, "-m", "mark", "--mark", fmt.Sprintf("%#x", t.config.BypassMark), "-j", "RETURN"})
+	}
+	if err := t.iptAll("enable", commands...); err != nil {
+		return err
+	}
+
+	// the filter and mangle chains are there only when configured,
+	// and forwarded traffic is rejected from one of FORWARD and
+	// DOCKER-USER
+	for _, chain := range []string{"OUTPUT", "FORWARD", dockerUser} {
+		if !t.config.RejectQUIC || (chain != "OUTPUT" && chain != t.forward) {
+			t.unjump("filter", chain, []string{"-j", t.Name})
+		}
+	}
+	if !t.config.ClampMSS {
+		for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+			t.unjump("mangle", chain, []string{"-j", t.Name})
+		}
+	}
+	for _, table := range []string{"filter", "mangle"} {
+		if (table == "filter" && t.config.RejectQUIC) || (table == "mangle" && t.config.ClampMSS) {
+			if err := t.newChain("enable", table, t.Name); err != nil {
+				return err
+			}
+		} else {
+			t.dropChain("", table, t.Name)
+		}
+	}
+
+	rules := t.save()
+	for _, j := range t.jumps() {
+		if err := t.insertJump("enable", rules, j); err != nil {
+			return err
+		}
+	}
+	if err := t.verify(t.save()); err != nil {
+		return err
+	}
+
+	// the chains were flushed of them
+	for _, entry := range t.Mappings.Entries() {
+		protocol, ip := entry.Destination.Proto, entry.Destination.Ip
+		if err := t.iptAll("enable", append([]string{"-A"}, t.redirect(protocol, ip, entry.Port)...)); err != nil {
+			return err
+		}
+		if err := t.guard(protocol, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disable can run again too, and whether or not Enable got far.
+func (t *iptablesTranslator) Disable() error {
+	t.unwatchDocker()
+	for _, j := range t.jumps() {
+		t.unjump(j.table, j.chain, j.rule)
+	}
+	if t.config.ClampMSS {
+		t.dropChain("", "mangle", t.Name)
+	}
+	if t.config.RejectQUIC {
+		t.dropChain("", "filter", t.Name)
+	}
+	for _, chain := range []string{t.pre(), t.Name} {
+		if err := t.dropChain("disable", "nat", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *iptablesTranslator) Forward(protocol, ip, toPort string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.clear(protocol, ip); err != nil {
+		return err
+	}
+	if err := t.iptAll("forward", append([]string{"-A"}, t.redirect(protocol, ip, toPort)...)); err != nil {
+		return err
+	}
+	t.Mappings.Set(Address{protocol, ip}, toPort)
+	return t.guard(protocol, ip)
+}
+
+// redirect is the rule of a mapping in the main chain.
+func (t *iptablesTranslator) redirect(protocol, ip, toPort string) []string {
+	return []string{t.Name, "-j", "REDIRECT", "--dest", ip + "/32", "-p", protocol, "--to-ports", toPort}
+}
+
+// guard appends the rules that go with the redirect of a mapping in
+// the filter and mangle chains, where configured.
+func (t *iptablesTranslator) guard(protocol, ip string) error {
+	if t.config.RejectQUIC && protocol == "tcp" {
+		if err := t.filter("forward", append([]string{"-A"}, t.quic(ip)...)...); err != nil {
+			return err
+		}
+	}
+	if t.config.ClampMSS && protocol == "tcp" {
+		return t.mangle("forward", append([]string{"-A"}, t.clamp(ip)...)...)
+	}
+	return nil
+}
+
+func (t *iptablesTranslator) Clear(protocol, ip string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.clear(protocol, ip)
+}
+
+func (t *iptablesTranslator) clear(protocol, ip string) error {
+	if previous, exists := t.Mappings.Get(Address{protocol, ip}); exists {
+		if err := t.iptAll("clear", append([]string{"-D"}, t.redirect(protocol, ip, previous)...)); err != nil {
+			return err
+		}
+		t.Mappings.Delete(Address{protocol, ip})
+		if t.config.RejectQUIC && protocol == "tcp" {
+			if err := t.filter("clear", append([]string{"-D"}, t.quic(ip)...)...); err != nil {
+				return err
+			}
+		}
+		if t.config.ClampMSS && protocol == "tcp" {
+			return t.mangle("clear", append([]string{"-D"}, t.clamp(ip)...)...)
+		}
+	}
+	return nil
+}
+
+func (t *iptablesTranslator) GetOriginalDst(conn *net.TCPConn) (host string, err error) {
+	return originalDst(conn)
 }
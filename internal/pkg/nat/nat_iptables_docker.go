@@ -0,0 +1,211 @@
+// +build linux
+
+package nat
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// Docker programs iptables too, and whenever it starts it puts its
+// jumps back ahead of everyone else's. Its nat rules only take traffic
+// to local addresses, which ours never redirect, but in the filter
+// table its rules accept the forwarded traffic of containers before
+// any rule added after them is reached. So rules of ours for forwarded
+// traffic go in DOCKER-USER, the chain Docker keeps for the rules of
+// others, once Docker is there, and the jumps to our chains are
+// checked as the firewall is enabled, and every dockerCheck after, and
+// put back first wherever Docker has moved ahead of them. The nftables
+// backend needs none of this: each of its chains sees every packet,
+// whatever the chains of Docker's iptables-nft accept.
+
+// dockerUser is the chain that Docker jumps to from FORWARD ahead of
+// its own.
+const dockerUser = "DOCKER-USER"
+
+// dockerCheck is how often the order of the jumps is checked, while
+// Docker is around, so that it is put right soon after Docker restarts.
+const dockerCheck = 10 * time.Second
+
+// dockerSocket is there when Docker is installed, whether or not it
+// has programmed iptables yet.
+const dockerSocket = "/var/run/docker.sock"
+
+func dockerChain(name string) bool {
+	return name == "DOCKER" || strings.HasPrefix(name, "DOCKER-")
+}
+
+// A ruleset is what iptables-save says: the rules of each chain, in
+// order, by table and chain. Chains without rules are there too.
+type ruleset map[string]map[string][]string
+
+func parseRuleset(saved string) ruleset {
+	rules := ruleset{}
+	var table map[string][]string
+	for _, line := range strings.Split(saved, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case strings.HasPrefix(line, "*"):
+			table = make(map[string][]string)
+			rules[line[1:]] = table
+		case table == nil:
+		case strings.HasPrefix(line, ":"):
+			// ":CHAIN POLICY [packets:bytes]"
+			if chain := fields[0][1:]; table[chain] == nil {
+				table[chain] = []string{}
+			}
+		case fields[0] == "-A" && len(fields) > 1:
+			table[fields[1]] = append(table[fields[1]], strings.Join(fields[2:], " "))
+		}
+	}
+	return rules
+}
+
+func (r ruleset) has(table, chain string) bool {
+	_, ok := r[table][chain]
+	return ok
+}
+
+// docker is whether Docker has programmed iptables.
+func (r ruleset) docker() bool {
+	for _, table := range r {
+		for chain := range table {
+			if dockerChain(chain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// target is the chain a rule jumps to, if any.
+func target(rule string) string {
+	fields := strings.Fields(rule)
+	for i, field := range fields {
+		if (field == "-j" || field == "--jump") && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// A jump is a rule in a chain of the system, or in DOCKER-USER, that
+// jumps to one of ours.
+type jump struct {
+	table, chain string
+	rule         []string
+}
+
+func (j jump) target() string {
+	return target(strings.Join(j.rule, " "))
+}
+
+// jumps are the jumps to our chains that Enable inserts first.
+func (t *iptablesTranslator) jumps() []jump {
+	jumps := []jump{{"nat", "OUTPUT", t.output()}}
+	if t.config.Cgroup == "" {
+		jumps = append(jumps, jump{"nat", "PREROUTING", []string{"-j", t.pre()}})
+	}
+	if t.config.RejectQUIC {
+		jumps = append(jumps,
+			jump{"filter", "OUTPUT", []string{"-j", t.Name}},
+			jump{"filter", t.forward, []string{"-j", t.Name}})
+	}
+	if t.config.ClampMSS {
+		jumps = append(jumps,
+			jump{"mangle", "OUTPUT", []string{"-j", t.Name}},
+			jump{"mangle", "PREROUTING", []string{"-j", t.Name}})
+	}
+	return jumps
+}
+
+// misordered returns the jumps that rules have behind one of Docker's,
+// or ahead of the jump to Config.JumpAfter, or that are missing from a
+// chain they have.
+func (t *iptablesTranslator) misordered(rules ruleset) (result []jump) {
+	for _, j := range t.jumps() {
+		chain, ok := rules[j.table][j.chain]
+		if !ok {
+			continue
+		}
+		ours, docker, after := -1, -1, -1
+		for i, rule := range chain {
+			to := target(rule)
+			if to == j.target() && ours < 0 {
+				ours = i
+			}
+			// DOCKER-USER ends by returning to FORWARD
+			if (dockerChain(to) || (j.chain == dockerUser && to == "RETURN")) && docker < 0 {
+				docker = i
+			}
+			if t.config.JumpAfter != "" && to == t.config.JumpAfter {
+				after = i
+			}
+		}
+		if ours < 0 || (docker >= 0 && docker < ours) || ours < after {
+			result = append(result, j)
+		}
+	}
+	return
+}
+
+// save runs iptables-save, quietly, since it has the whole firewall to
+// say. It returns nothing if it fails.
+func (t *iptablesTranslator) save() ruleset {
+	saved, err := run([]string{"iptables-save"}, "", func(string, ...interface{}) {})
+	if err != nil {
+		return ruleset{}
+	}
+	return parseRuleset(saved)
+}
+
+// reorder puts each jump to our chains back in its position where
+// Docker has moved ahead of it.
+func (t *iptablesTranslator) reorder() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, j := range t.misordered(t.save()) {
+		logf("Docker's rules in %s %s come ahead of ours, putting ours back", j.table, j.chain)
+		command := []string{"iptables", "-t", j.table}
+		run(append(append(command, "-D", j.chain), j.rule...), "", t.log)
+		if err := t.insertJump("reorder", t.save(), j); err != nil {
+			logf("failed to put our jump in %s %s back: %v", j.table, j.chain, err)
+		}
+	}
+}
+
+// watchDocker checks the order of the jumps now, and every dockerCheck
+// until Disable, if Docker is around.
+func (t *iptablesTranslator) watchDocker(rules ruleset) {
+	if !rules.docker() {
+		if _, err := os.Stat(dockerSocket); err != nil {
+			return
+		}
+	}
+	t.reorder()
+	t.stop, t.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(dockerCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.reorder()
+			}
+		}
+	}(t.stop, t.stopped)
+}
+
+// unwatchDocker stops watchDocker.
+func (t *iptablesTranslator) unwatchDocker() {
+	if t.stop != nil {
+		close(t.stop)
+		<-t.stopped
+		t.stop = nil
+	}
+}
@@ -0,0 +1,103 @@
+// +build linux
+
+package nat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Our jumps normally go first in the chains of the system, but some
+// security agents insist that their rules come first, and take theirs
+// back. With Config.JumpAfter they keep their place: ours go right
+// after the last jump to the chain named, wherever that is, or first
+// in the chains without one. Either way, once the jumps are in, the
+// rules ahead of them are checked for any that take every packet, in
+// which case nothing would reach ours.
+
+// position is where in its chain j goes.
+func (t *iptablesTranslator) position(rules ruleset, j jump) int {
+	if t.config.JumpAfter == "" {
+		return 1
+	}
+	after := 0
+	for i, rule := range rules[j.table][j.chain] {
+		if target(rule) == t.config.JumpAfter {
+			after = i + 1
+		}
+	}
+	if after == 0 {
+		logf("no jump to %s in %s %s, ours goes first", t.config.JumpAfter, j.table, j.chain)
+	}
+	return after + 1
+}
+
+// terminal are the targets that decide what happens to a packet,
+// rather than passing it on down the chain.
+var terminal = map[string]bool{
+	"ACCEPT":   true,
+	"DROP":     true,
+	"REJECT":   true,
+	"DNAT":     true,
+	"REDIRECT": true,
+}
+
+// unconditional is whether rule matches every packet: it has nothing
+// but its target, and maybe a comment.
+func unconditional(rule string) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "-j", "--jump":
+			i++
+		case "-m":
+			if i+1 >= len(fields) || fields[i+1] != "comment" {
+				return false
+			}
+			i++
+		case "--comment":
+			i++
+			if i < len(fields) && strings.HasPrefix(fields[i], `"`) {
+				for quoted := fields[i][1:]; !strings.HasSuffix(quoted, `"`) && i+1 < len(fields); quoted = fields[i] {
+					i++
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// takesAll is whether rule, of table, decides the fate of every
+// packet, itself or in the chain it jumps to.
+func takesAll(rules ruleset, table, rule string) bool {
+	if !unconditional(rule) {
+		return false
+	}
+	to := target(rule)
+	if terminal[to] {
+		return true
+	}
+	for _, r := range rules[table][to] {
+		if unconditional(r) && terminal[target(r)] {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks that nothing ahead of our jumps takes every packet.
+func (t *iptablesTranslator) verify(rules ruleset) error {
+	for _, j := range t.jumps() {
+		for _, rule := range rules[j.table][j.chain] {
+			if target(rule) == j.target() {
+				break
+			}
+			if takesAll(rules, j.table, rule) {
+				return &Error{Op: "enable", Err: fmt.Errorf("%q comes ahead of our jump in %s %s and takes every packet", rule, j.table, j.chain)}
+			}
+		}
+	}
+	return nil
+}
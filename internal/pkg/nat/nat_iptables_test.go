@@ -1,7 +1,17 @@
+//go:build linux
 // +build linux
 
 package nat
 
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
 // we don't yet have any iptables config cases to test against
 
 type env struct{}
@@ -13,3 +23,495 @@ var environments = []env{
 func (e *env) setup() {}
 
 func (e *env) teardown() {}
+
+// fakeRun records the commands that would have been run and
+// succeeds without touching the firewall, except that it has none of
+// our rules or chains for iptables -C and -L to find. Call the
+// returned function to restore the real runner.
+func fakeRun() (*[]string, func()) {
+	var commands []string
+	saved := run
+	run = func(command []string, input string, logf func(string, ...interface{})) (string, error) {
+		if query(command) {
+			return "", errors.New("no such rule")
+		}
+		commands = append(commands, strings.Join(command, " "))
+		return "", nil
+	}
+	return &commands, func() { run = saved }
+}
+
+// query is whether command only asks iptables whether a rule or chain
+// is there.
+func query(command []string) bool {
+	for _, arg := range command {
+		if arg == "-C" || arg == "-L" {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeIptables keeps the rules of each chain, by table, the way
+// iptables does, so that what running commands again does shows.
+// Chains in capitals are built in.
+type fakeIptables struct {
+	chains map[string][]string
+}
+
+func (f *fakeIptables) run(command []string, input string, logf func(string, ...interface{})) (string, error) {
+	if command[0] == "iptables-save" {
+		return f.save(), nil
+	}
+	if command[0] != "iptables" {
+		return "", nil
+	}
+	var args []string
+	for _, arg := range command[3:] {
+		if arg != "-n" {
+			args = append(args, arg)
+		}
+	}
+	op, chain, rule := args[0], command[2]+" "+args[1], args[2:]
+	position := 1
+	if op == "-I" {
+		position, _ = strconv.Atoi(rule[0])
+		rule = rule[1:]
+	}
+	rules, ok := f.chains[chain]
+	if !ok && args[1] == strings.ToUpper(args[1]) {
+		ok = true
+	}
+	if op == "-N" {
+		if ok {
+			return "", errors.New("chain already exists")
+		}
+		f.chains[chain] = nil
+		return "", nil
+	}
+	if !ok {
+		return "", errors.New("no chain by that name")
+	}
+	joined := strings.Join(rule, " ")
+	switch op {
+	case "-C", "-D":
+		for i, r := range rules {
+			if r == joined {
+				if op == "-D" {
+					f.chains[chain] = append(rules[:i:i], rules[i+1:]...)
+				}
+				return "", nil
+			}
+		}
+		return "", errors.New("no such rule")
+	case "-I":
+		if position < 1 || position > len(rules)+1 {
+			return "", errors.New("index of insertion too big")
+		}
+		f.chains[chain] = append(append(append([]string{}, rules[:position-1]...), joined), rules[position-1:]...)
+	case "-A":
+		f.chains[chain] = append(rules, joined)
+	case "-F":
+		f.chains[chain] = nil
+	case "-X":
+		delete(f.chains, chain)
+	}
+	return "", nil
+}
+
+// save says what iptables-save would.
+func (f *fakeIptables) save() string {
+	tables := make(map[string][]string)
+	for chain := range f.chains {
+		fields := strings.Fields(chain)
+		tables[fields[0]] = append(tables[fields[0]], fields[1])
+	}
+	var saved []string
+	for table, chains := range tables {
+		sort.Strings(chains)
+		saved = append(saved, "*"+table)
+		for _, chain := range chains {
+			saved = append(saved, ":"+chain+" - [0:0]")
+		}
+		for _, chain := range chains {
+			for _, rule := range f.chains[table+" "+chain] {
+				saved = append(saved, "-A "+chain+" "+rule)
+			}
+		}
+		saved = append(saved, "COMMIT")
+	}
+	return strings.Join(saved, "\n") + "\n"
+}
+
+// count returns how many rules of chain are rule.
+func (f *fakeIptables) count(chain, rule string) (n int) {
+	for _, r := range f.chains[chain] {
+		if r == rule {
+			n++
+		}
+	}
+	return
+}
+
+func contains(commands []string, command string) bool {
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIptablesInterfaces(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{
+		IncludeInterfaces: []string{"br-dev"},
+		ExcludeInterfaces: []string{"br-ci"},
+	})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"iptables -t nat -I OUTPUT 1 -j test-table",
+		"iptables -t nat -I PREROUTING 1 -j test-table-pre",
+		"iptables -t nat -A test-table-pre -i br-ci -j RETURN",
+		"iptables -t nat -A test-table-pre -i br-dev -j test-table",
+	} {
+		if !contains(*commands, expected) {
+			t.Errorf("missing %q in %q", expected, *commands)
+		}
+	}
+	if contains(*commands, "iptables -t nat -A test-table-pre -j test-table") {
+		t.Errorf("unexpected blanket jump in %q", *commands)
+	}
+}
+
+func TestIptablesAllInterfaces(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*commands, "iptables -t nat -A test-table-pre -j test-table") {
+		t.Errorf("missing blanket jump in %q", *commands)
+	}
+}
+
+func TestIptablesClampMSS(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{ClampMSS: true})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Forward("tcp", "10.96.0.10", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Forward("udp", "10.96.0.11", "1235"); err != nil {
+		t.Fatal(err)
+	}
+	clamp := "iptables -t mangle -A test-table --dest 10.96.0.10/32 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu"
+	for _, expected := range []string{
+		"iptables -t mangle -N test-table",
+		"iptables -t mangle -I OUTPUT 1 -j test-table",
+		"iptables -t mangle -I PREROUTING 1 -j test-table",
+		clamp,
+	} {
+		if !contains(*commands, expected) {
+			t.Errorf("missing %q in %q", expected, *commands)
+		}
+	}
+	if contains(*commands, "iptables -t mangle -A test-table --dest 10.96.0.11/32 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu") {
+		t.Errorf("unexpected clamp for udp in %q", *commands)
+	}
+
+	if err := tr.Clear("tcp", "10.96.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*commands, strings.Replace(clamp, " -A ", " -D ", 1)) {
+		t.Errorf("missing removal of the clamp in %q", *commands)
+	}
+}
+
+func TestIptablesCgroup(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{Cgroup: "teleproxy"})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*commands, "iptables -t nat -I OUTPUT 1 -m cgroup --path teleproxy -j test-table") {
+		t.Errorf("missing cgroup jump in %q", *commands)
+	}
+	for _, unexpected := range []string{
+		"iptables -t nat -I OUTPUT 1 -j test-table",
+		"iptables -t nat -I PREROUTING 1 -j test-table-pre",
+	} {
+		if contains(*commands, unexpected) {
+			t.Errorf("unexpected %q in %q", unexpected, *commands)
+		}
+	}
+}
+
+func TestIptablesBypassMark(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{BypassMark: 0x7470})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(*commands, "iptables -t nat -A test-table -m mark --mark 0x7470 -j RETURN") {
+		t.Errorf("missing mark bypass in %q", *commands)
+	}
+	if err := tr.Forward("tcp", "10.96.0.5", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	// the bypass has to come ahead of the redirects
+	bypass, redirect := -1, -1
+	for i, command := range *commands {
+		switch {
+		case strings.Contains(command, "--mark"):
+			bypass = i
+		case strings.Contains(command, "-A test-table -j REDIRECT"):
+			redirect = i
+		}
+	}
+	if bypass < 0 || redirect < bypass {
+		t.Errorf("expected the bypass before the redirect in %q", *commands)
+	}
+}
+
+func TestIptablesRejectQUIC(t *testing.T) {
+	commands, restore := fakeRun()
+	defer restore()
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{RejectQUIC: true})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Forward("tcp", "10.96.0.10", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Forward("udp", "10.96.0.53", "1233"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Clear("tcp", "10.96.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	reject := "test-table --dest 10.96.0.10/32 -p udp --dport 443 -j REJECT --reject-with icmp-port-unreachable"
+	for _, expected := range []string{
+		"iptables -t filter -I OUTPUT 1 -j test-table",
+		"iptables -t filter -I FORWARD 1 -j test-table",
+		"iptables -t filter -A " + reject,
+		"iptables -t filter -D " + reject,
+	} {
+		if !contains(*commands, expected) {
+			t.Errorf("missing %q in %q", expected, *commands)
+		}
+	}
+	for _, command := range *commands {
+		if strings.Contains(command, "10.96.0.53/32 -p udp --dport 443") {
+			t.Errorf("unexpected rejection of udp forwarded as udp: %q", command)
+		}
+	}
+}
+
+// restarted is what iptables-save says once Docker has restarted, and
+// put its jumps ahead of ours.
+const restarted = `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:DOCKER - [0:0]
+:test-table - [0:0]
+:test-table-pre - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A PREROUTING -j test-table-pre
+-A OUTPUT -j test-table
+-A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER
+COMMIT
+*filter
+:OUTPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:DOCKER-USER - [0:0]
+:test-table - [0:0]
+-A OUTPUT -j test-table
+-A FORWARD -j DOCKER-USER
+-A DOCKER-USER -j RETURN
+-A DOCKER-USER -j test-table
+COMMIT
+`
+
+func TestIptablesDocker(t *testing.T) {
+	var commands []string
+	saved := run
+	defer func() { run = saved }()
+	rules := restarted
+	run = func(command []string, input string, logf func(string, ...interface{})) (string, error) {
+		if command[0] == "iptables-save" {
+			return rules, nil
+		}
+		if query(command) {
+			return "", errors.New("no such rule")
+		}
+		commands = append(commands, strings.Join(command, " "))
+		return "", nil
+	}
+
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{RejectQUIC: true})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disable()
+	for _, expected := range []string{
+		// forwarded traffic is rejected from DOCKER-USER
+		"iptables -t filter -I DOCKER-USER 1 -j test-table",
+		// and what Docker moved ahead of is put back first
+		"iptables -t nat -D PREROUTING -j test-table-pre",
+		"iptables -t nat -I PREROUTING 1 -j test-table-pre",
+		"iptables -t filter -I DOCKER-USER 1 -j test-table",
+	} {
+		if !contains(commands, expected) {
+			t.Errorf("missing %q in %q", expected, commands)
+		}
+	}
+	if contains(commands, "iptables -t filter -I FORWARD 1 -j test-table") {
+		t.Errorf("unexpected jump from FORWARD in %q", commands)
+	}
+	// nat OUTPUT was in order already
+	outputs := 0
+	for _, command := range commands {
+		if command == "iptables -t nat -I OUTPUT 1 -j test-table" {
+			outputs++
+		}
+	}
+	if outputs != 1 {
+		t.Errorf("expected the jump in nat OUTPUT to be left alone, got %q", commands)
+	}
+
+	// once they are in order there is nothing to put right
+	rules = strings.Replace(rules, "-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER\n-A PREROUTING -j test-table-pre\n",
+		"-A PREROUTING -j test-table-pre\n-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER\n", 1)
+	rules = strings.Replace(rules, "-A DOCKER-USER -j RETURN\n-A DOCKER-USER -j test-table\n",
+		"-A DOCKER-USER -j test-table\n-A DOCKER-USER -j RETURN\n", 1)
+	if misordered := tr.misordered(parseRuleset(rules)); len(misordered) != 0 {
+		t.Errorf("expected nothing misordered, got %v", misordered)
+	}
+}
+
+func TestIptablesIdempotent(t *testing.T) {
+	f := &fakeIptables{chains: map[string][]string{
+		// left over from a run that didn't get to Disable
+		"nat OUTPUT":         {"-j test-table"},
+		"nat test-table":     {"-j REDIRECT --dest 10.96.0.99/32 -p tcp --to-ports 999"},
+		"nat test-table-pre": {"-j test-table"},
+	}}
+	saved := run
+	defer func() { run = saved }()
+	run = f.run
+
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{RejectQUIC: true, ClampMSS: true})
+	for i := 0; i < 2; i++ {
+		if err := tr.Enable(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := tr.Forward("tcp", "10.96.0.10", "1234"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for chain, rule := range map[string]string{
+		"nat OUTPUT":         "-j test-table",
+		"nat PREROUTING":     "-j test-table-pre",
+		"nat test-table-pre": "-j test-table",
+		"nat test-table":     "-j REDIRECT --dest 10.96.0.10/32 -p tcp --to-ports 1234",
+		"filter OUTPUT":      "-j test-table",
+		"filter FORWARD":     "-j test-table",
+		"filter test-table":  strings.Join(tr.quic("10.96.0.10")[1:], " "),
+		"mangle OUTPUT":      "-j test-table",
+		"mangle PREROUTING":  "-j test-table",
+		"mangle test-table":  strings.Join(tr.clamp("10.96.0.10")[1:], " "),
+	} {
+		if n := f.count(chain, rule); n != 1 {
+			t.Errorf("expected one %q in %s, got %d in %q", rule, chain, n, f.chains[chain])
+		}
+	}
+	if f.count("nat test-table", "-j REDIRECT --dest 10.96.0.99/32 -p tcp --to-ports 999") != 0 {
+		t.Errorf("expected the leftover mapping to be flushed, got %q", f.chains["nat test-table"])
+	}
+	if err := tr.Clear("tcp", "10.96.0.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tr.Disable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for chain, rules := range f.chains {
+		if strings.Contains(chain, "test-table") || len(rules) != 0 {
+			t.Errorf("expected nothing of ours left, got %q in %s", rules, chain)
+		}
+	}
+}
+
+func TestIptablesJumpAfter(t *testing.T) {
+	f := &fakeIptables{chains: map[string][]string{
+		"nat OUTPUT":     {"-j AGENT", "-d 10.0.0.1/32 -j RETURN"},
+		"nat PREROUTING": {"-j AGENT"},
+		"nat AGENT":      {"-p tcp --dport 22 -j ACCEPT"},
+	}}
+	saved := run
+	defer func() { run = saved }()
+	run = f.run
+
+	tr := &iptablesTranslator{commonTranslator: newCommonTranslator("test-table")}
+	tr.Configure(Config{JumpAfter: "AGENT"})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-j AGENT", "-j test-table", "-d 10.0.0.1/32 -j RETURN"}
+	if !reflect.DeepEqual(f.chains["nat OUTPUT"], expected) {
+		t.Errorf("expected %q, got %q", expected, f.chains["nat OUTPUT"])
+	}
+	if misordered := tr.misordered(parseRuleset(f.save())); len(misordered) != 0 {
+		t.Errorf("expected nothing misordered, got %v", misordered)
+	}
+
+	// an agent that lets everything through would leave us nothing
+	f.chains["nat AGENT"] = append(f.chains["nat AGENT"], `-m comment --comment "let it all through" -j ACCEPT`)
+	if err := tr.Enable(); err == nil {
+		t.Errorf("expected the agent taking every packet ahead of us to be refused")
+	}
+
+	// and the jump to the agent only has to come ahead of ours
+	f.chains["nat AGENT"] = nil
+	f.chains["nat OUTPUT"] = []string{"-j test-table", "-j AGENT"}
+	if misordered := tr.misordered(parseRuleset(f.save())); len(misordered) != 1 || misordered[0].chain != "OUTPUT" {
+		t.Errorf("expected the jump in OUTPUT misordered, got %v", misordered)
+	}
+}
+
+func TestUnconditional(t *testing.T) {
+	for rule, expected := range map[string]bool{
+		"-j ACCEPT": true,
+		`-m comment --comment "docker user" -j RETURN`: true,
+		`-m comment --comment agent -j ACCEPT`:         true,
+		"-p tcp --dport 22 -j ACCEPT":                  false,
+		"! -d 127.0.0.0/8 -j DOCKER":                   false,
+		"-m addrtype --dst-type LOCAL -j DOCKER":       false,
+	} {
+		if unconditional(rule) != expected {
+			t.Errorf("expected %q to be unconditional: %v", rule, expected)
+		}
+	}
+}
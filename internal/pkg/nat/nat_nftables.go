@@ -0,0 +1,168 @@
+// +build linux
+
+package nat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+func init() {
+	Register(Backend{
+		Name: "nftables",
+		New: func(name string) Translator {
+			return &nftablesTranslator{newCommonTranslator(name)}
+		},
+		Detect: func() bool {
+			_, err := tpu.Cmd("nft", "list", "tables")
+			return err == nil
+		},
+	})
+}
+
+// nftablesTranslator keeps everything in a table of its own. The
+// redirect rules live in a regular chain that is atomically rewritten
+// on every change, which avoids having to track rule handles.
+type nftablesTranslator struct {
+	commonTranslator
+}
+
+func (t *nftablesTranslator) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+// table returns the name of our nft table. Identifiers in nft can't
+// contain dashes.
+func (t *nftablesTranslator) table() string {
+	return strings.Replace(t.Name, "-", "_", -1)
+}
+
+func (t *nftablesTranslator) nft(op, script string) error {
+	_, err := run([]string{"nft", "-f", "-"}, script, t.log)
+	if err != nil {
+		return &Error{Op: op, Err: err}
+	}
+	return nil
+}
+
+func (t *nftablesTranslator) rules() string {
+	table := t.table()
+	result := fmt.Sprintf("flush chain ip %s proxy\n", table)
+	result += fmt.Sprintf("add rule ip %s proxy ip daddr 127.0.0.1 meta l4proto tcp return\n", table)
+	if t.config.BypassMark != 0 {
+		result += fmt.Sprintf("add rule ip %s proxy meta mark %#x return\n", table, t.config.BypassMark)
+	}
+	for _, entry := range t.sorted() {
+		dst := entry.Destination
+		result += fmt.Sprintf("add rule ip %s proxy ip daddr %s meta l4proto %s redirect to :%s\n",
+			table, dst.Ip, dst.Proto, entry.Port)
+	}
+	if t.config.RejectQUIC {
+		result += fmt.Sprintf("flush chain ip %s quic\n", table)
+		for _, entry := range t.sorted() {
+			if entry.Destination.Proto == "tcp" {
+				result += fmt.Sprintf("add rule ip %s quic ip daddr %s udp dport 443 reject with icmp type port-unreachable\n",
+					table, entry.Destination.Ip)
+			}
+		}
+	}
+	if t.config.ClampMSS {
+		result += fmt.Sprintf("flush chain ip %s clamp\n", table)
+		for _, entry := range t.sorted() {
+			if entry.Destination.Proto == "tcp" {
+				result += fmt.Sprintf("add rule ip %s clamp ip daddr %s tcp flags & (syn|rst) == syn tcp option maxseg size set rt mtu\n",
+					table, entry.Destination.Ip)
+			}
+		}
+	}
+	return result
+}
+
+func (t *nftablesTranslator) Enable() error {
+	table := t.table()
+	// "add table" is a noop if the table already exists, so this
+	// gives us a clean slate regardless of what a previous run
+	// left behind
+	script := fmt.Sprintf("add table ip %s\n", table)
+	script += fmt.Sprintf("delete table ip %s\n", table)
+	script += fmt.Sprintf("add table ip %s\n", table)
+	// as with iptables, we hook PREROUTING in order to get traffic
+	// from docker containers
+	for _, hook := range []string{"output", "prerouting"} {
+		script += fmt.Sprintf("add chain ip %s %s { type nat hook %s priority -100 ; }\n", table, hook, hook)
+	}
+	script += fmt.Sprintf("add chain ip %s proxy\n", table)
+	if t.config.ClampMSS {
+		// at mangle priority, ahead of the redirect
+		script += fmt.Sprintf("add chain ip %s clamp\n", table)
+		for _, hook := range []string{"output", "prerouting"} {
+			script += fmt.Sprintf("add chain ip %s mss_%s { type filter hook %s priority -150 ; }\n", table, hook, hook)
+			script += fmt.Sprintf("add rule ip %s mss_%s jump clamp\n", table, hook)
+		}
+	}
+	if t.config.RejectQUIC {
+		script += fmt.Sprintf("add chain ip %s quic\n", table)
+		for _, hook := range []string{"output", "forward"} {
+			script += fmt.Sprintf("add chain ip %s quic_%s { type filter hook %s priority 0 ; }\n", table, hook, hook)
+			script += fmt.Sprintf("add rule ip %s quic_%s jump quic\n", table, hook)
+		}
+	}
+	if t.config.Cgroup != "" {
+		// containers aren't in the cgroup, so prerouting is left
+		// alone
+		level := len(strings.Split(strings.Trim(t.config.Cgroup, "/"), "/"))
+		script += fmt.Sprintf("add rule ip %s output socket cgroupv2 level %d %q jump proxy\n", table, level, strings.Trim(t.config.Cgroup, "/"))
+		script += t.rules()
+		return t.nft("enable", script)
+	}
+	script += fmt.Sprintf("add rule ip %s output jump proxy\n", table)
+	for _, iface := range t.config.ExcludeInterfaces {
+		script += fmt.Sprintf("add rule ip %s prerouting iifname %q return\n", table, iface)
+	}
+	if len(t.config.IncludeInterfaces) == 0 {
+		script += fmt.Sprintf("add rule ip %s prerouting jump proxy\n", table)
+	} else {
+		for _, iface := range t.config.IncludeInterfaces {
+			script += fmt.Sprintf("add rule ip %s prerouting iifname %q jump proxy\n", table, iface)
+		}
+	}
+	script += t.rules()
+	return t.nft("enable", script)
+}
+
+func (t *nftablesTranslator) Disable() error {
+	table := t.table()
+	return t.nft("disable", fmt.Sprintf("add table ip %s\ndelete table ip %s\n", table, table))
+}
+
+func (t *nftablesTranslator) Forward(protocol, ip, toPort string) error {
+	previous, existed := t.Mappings.Set(Address{protocol, ip}, toPort)
+	if err := t.nft("forward", t.rules()); err != nil {
+		if existed {
+			t.Mappings.Set(Address{protocol, ip}, previous)
+		} else {
+			t.Mappings.Delete(Address{protocol, ip})
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *nftablesTranslator) Clear(protocol, ip string) error {
+	previous, existed := t.Mappings.Delete(Address{protocol, ip})
+	if !existed {
+		return nil
+	}
+	if err := t.nft("clear", t.rules()); err != nil {
+		t.Mappings.Set(Address{protocol, ip}, previous)
+		return err
+	}
+	return nil
+}
+
+func (t *nftablesTranslator) GetOriginalDst(conn *net.TCPConn) (host string, err error) {
+	return originalDst(conn)
+}
@@ -0,0 +1,109 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NewObserver constructs a Translator that programs nothing. It keeps
+// the mappings a real backend would program, and its Plan says what
+// the rules would be, so that what interception would do can be looked
+// at before it is done. It isn't a Backend, so that it is never
+// detected, or picked by mistake.
+func NewObserver(name string) Translator {
+	return &observer{newCommonTranslator(name)}
+}
+
+type observer struct {
+	commonTranslator
+}
+
+func (t *observer) Enable() error {
+	logf("observing only, the firewall is left alone")
+	return nil
+}
+
+func (t *observer) Disable() error {
+	return nil
+}
+
+func (t *observer) Forward(protocol, ip, toPort string) error {
+	if previous, existed := t.Mappings.Set(Address{protocol, ip}, toPort); !existed || previous != toPort {
+		logf("would redirect %s %s to port %s", protocol, ip, toPort)
+	}
+	return nil
+}
+
+func (t *observer) Clear(protocol, ip string) error {
+	if _, existed := t.Mappings.Delete(Address{protocol, ip}); existed {
+		logf("would stop redirecting %s %s", protocol, ip)
+	}
+	return nil
+}
+
+func (t *observer) Route(cidrs []string) error {
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr] = true
+	}
+	routed := make(map[string]bool, len(t.config.RouteCIDRs))
+	for _, cidr := range t.config.RouteCIDRs {
+		routed[cidr] = true
+		if !wanted[cidr] {
+			logf("would stop routing %s", cidr)
+		}
+	}
+	for _, cidr := range cidrs {
+		if !routed[cidr] {
+			logf("would route %s through a device of our own", cidr)
+		}
+	}
+	t.config.RouteCIDRs = cidrs
+	return nil
+}
+
+func (t *observer) GetOriginalDst(conn *net.TCPConn) (string, error) {
+	return "", errors.New("observing only, nothing is redirected")
+}
+
+// Plan says, a rule a line, what the firewall would be programmed
+// with.
+func (t *observer) Plan() []string {
+	var plan []string
+	if t.config.Cgroup != "" {
+		plan = append(plan, fmt.Sprintf("intercept the traffic of processes in cgroup %s", t.config.Cgroup))
+	} else {
+		plan = append(plan, "intercept the traffic of this host")
+		if len(t.config.IncludeInterfaces) > 0 {
+			plan = append(plan, fmt.Sprintf("intercept traffic forwarded from %s", strings.Join(t.config.IncludeInterfaces, ", ")))
+		} else {
+			plan = append(plan, "intercept traffic forwarded from any interface")
+		}
+		if len(t.config.ExcludeInterfaces) > 0 {
+			plan = append(plan, fmt.Sprintf("never intercept traffic forwarded from %s", strings.Join(t.config.ExcludeInterfaces, ", ")))
+		}
+	}
+	if t.config.JumpAfter != "" {
+		plan = append(plan, fmt.Sprintf("come after the jumps to %s", t.config.JumpAfter))
+	}
+	plan = append(plan, "leave tcp to 127.0.0.1 alone")
+	if t.config.BypassMark != 0 {
+		plan = append(plan, fmt.Sprintf("leave sockets marked %#x alone", t.config.BypassMark))
+	}
+	for _, cidr := range t.config.RouteCIDRs {
+		plan = append(plan, fmt.Sprintf("route %s through a device of our own", cidr))
+	}
+	for _, entry := range t.sorted() {
+		dst := entry.Destination
+		plan = append(plan, fmt.Sprintf("redirect %s to %s to port %s", dst.Proto, dst.Ip, entry.Port))
+		if dst.Proto == "tcp" && t.config.RejectQUIC {
+			plan = append(plan, fmt.Sprintf("reject udp to %s port 443", dst.Ip))
+		}
+		if dst.Proto == "tcp" && t.config.ClampMSS {
+			plan = append(plan, fmt.Sprintf("clamp the mss of tcp to %s to the path mtu", dst.Ip))
+		}
+	}
+	return plan
+}
@@ -0,0 +1,63 @@
+package nat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObserver(t *testing.T) {
+	saved := run
+	defer func() { run = saved }()
+	run = func(command []string, input string, logf func(string, ...interface{})) (string, error) {
+		t.Errorf("expected nothing to be run, got %q", command)
+		return "", nil
+	}
+
+	tr := NewObserver("teleproxy")
+	tr.Configure(Config{ExcludeInterfaces: []string{"docker0"}, RejectQUIC: true})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	tr.Forward("tcp", "10.96.0.10", "1234")
+	tr.Forward("udp", "10.0.0.2", "5353")
+	tr.Forward("tcp", "10.96.0.11", "1235")
+	tr.Clear("tcp", "10.96.0.11")
+
+	expected := []string{
+		"intercept the traffic of this host",
+		"intercept traffic forwarded from any interface",
+		"never intercept traffic forwarded from docker0",
+		"leave tcp to 127.0.0.1 alone",
+		"redirect tcp to 10.96.0.10 to port 1234",
+		"reject udp to 10.96.0.10 port 443",
+		"redirect udp to 10.0.0.2 to port 5353",
+	}
+	if plan := tr.(*observer).Plan(); !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected %q, got %q", expected, plan)
+	}
+	if len(tr.Snapshot()) != 2 {
+		t.Errorf("expected 2 mappings, got %v", tr.Snapshot())
+	}
+	if err := tr.Disable(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObserverRoute(t *testing.T) {
+	tr := NewObserver("teleproxy")
+	tr.Configure(Config{Cgroup: "teleproxy", RouteCIDRs: []string{"10.96.0.0/12"}})
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.(Router).Route([]string{"10.244.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"intercept the traffic of processes in cgroup teleproxy",
+		"leave tcp to 127.0.0.1 alone",
+		"route 10.244.0.0/16 through a device of our own",
+	}
+	if plan := tr.(*observer).Plan(); !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected %q, got %q", expected, plan)
+	}
+}
@@ -6,34 +6,48 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
 	"strings"
 
 	ppf "github.com/datawire/pf"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/tpu"
 )
 
-type Translator struct {
+func init() {
+	Register(Backend{
+		Name: "pf",
+		New: func(name string) Translator {
+			return &pfTranslator{commonTranslator: newCommonTranslator(name)}
+		},
+	})
+}
+
+type pfTranslator struct {
 	commonTranslator
 	dev *ppf.Handle
+	tun *utun
 }
 
-func pf(args []string, stdin string) (err error) {
-	cmd := exec.Command("pfctl", args...)
-	cmd.Stdin = strings.NewReader(stdin)
-	log.Printf("pfctl %s < %s\n", strings.Join(args, " "), stdin)
-	out, err := cmd.CombinedOutput()
-	if len(out) > 0 {
-		log.Printf("%s", out)
+func pf(args []string, stdin string) error {
+	log.Print(route.Annotate(fmt.Sprintf("pfctl %s < %s\n", strings.Join(args, " "), stdin)))
+	command := append([]string{"pfctl"}, args...)
+	var result tpu.Result
+	err := timed(command, func() (err error) {
+		result, err = tpu.Run(command, stdin)
+		return
+	})
+	if len(result.Output) > 0 {
+		log.Printf("%s", result.Output)
 	}
 	if err != nil {
 		log.Println(err)
-		return fmt.Errorf("IN:%s\nOUT:%s\nERR:%s", strings.TrimSpace(stdin), strings.TrimSpace(string(out)),
-			err)
+		return err
 	}
-	return
+	return nil
 }
 
-func (t *Translator) rules() string {
+func (t *pfTranslator) rules() string {
 	if t.dev == nil {
 		return ""
 	}
@@ -49,6 +63,14 @@ func (t *Translator) rules() string {
 
 	result += "pass out quick inet proto tcp to 127.0.0.1/32\n"
 
+	if t.config.RejectQUIC {
+		for _, entry := range entries {
+			if dst := entry.Destination; dst.Proto == "tcp" {
+				result += "block return out quick inet proto udp to " + dst.Ip + " port 443\n"
+			}
+		}
+	}
+
 	for _, entry := range entries {
 		dst := entry.Destination
 		result += "pass out route-to lo0 inet proto " + dst.Proto + " to " + dst.Ip + " keep state\n"
@@ -59,36 +81,83 @@ func (t *Translator) rules() string {
 
 var actions = []ppf.Action{ppf.ActionPass, ppf.ActionRDR}
 
-func (t *Translator) Enable() {
+func (t *pfTranslator) Enable() error {
 	var err error
 	t.dev, err = ppf.Open()
 	if err != nil {
-		panic(err)
+		return &Error{Op: "enable", Err: err}
 	}
 
 	for _, action := range actions {
 		var rule ppf.Rule
 		err = rule.SetAnchorCall(t.Name)
 		if err != nil {
-			panic(err)
+			return &Error{Op: "enable", Err: err}
 		}
 		rule.SetAction(action)
 		rule.SetQuick(true)
 		err = t.dev.PrependRule(rule)
 		if err != nil {
-			panic(err)
+			return &Error{Op: "enable", Err: err}
 		}
 	}
 
 	pf([]string{"-a", t.Name, "-F", "all"}, "")
 
-	pf([]string{"-f", "/dev/stdin"}, "pass on lo0")
-	pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	if err = pf([]string{"-f", "/dev/stdin"}, "pass on lo0"); err != nil {
+		return &Error{Op: "enable", Err: err}
+	}
+	if err = pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules()); err != nil {
+		return &Error{Op: "enable", Err: err}
+	}
 
 	t.dev.Start()
+
+	if t.config.ClampMSS {
+		log.Printf("NAT: pf can't clamp the mss to the path mtu, not clamping")
+	}
+
+	if err = t.route(t.config.RouteCIDRs); err != nil {
+		return &Error{Op: "enable", Err: err}
+	}
+	return nil
+}
+
+// Route changes the ranges routed through the utun device, opening it
+// if there was none. The anchor isn't reloaded, so the mappings, and
+// the states of connections, are left alone.
+func (t *pfTranslator) Route(cidrs []string) error {
+	if err := t.route(cidrs); err != nil {
+		return &Error{Op: "route", Err: err}
+	}
+	return nil
 }
 
-func (t *Translator) Disable() {
+func (t *pfTranslator) route(cidrs []string) error {
+	if t.tun == nil {
+		if len(cidrs) == 0 {
+			return nil
+		}
+		tun, err := openUtun()
+		if err != nil {
+			return err
+		}
+		t.tun = tun
+		go t.tun.drain()
+	}
+	if err := t.tun.reroute(cidrs); err != nil {
+		return err
+	}
+	t.config.RouteCIDRs = cidrs
+	return nil
+}
+
+func (t *pfTranslator) Disable() error {
+	if t.tun != nil {
+		t.tun.close()
+		t.tun = nil
+	}
+
 	if t.dev != nil {
 		t.dev.Stop()
 
@@ -97,7 +166,7 @@ func (t *Translator) Disable() {
 			for {
 				rules, err := t.dev.Rules(action)
 				if err != nil {
-					panic(err)
+					return &Error{Op: "disable", Err: err}
 				}
 
 				for _, rule := range rules {
@@ -105,7 +174,7 @@ func (t *Translator) Disable() {
 						log.Printf("Removing rule: %v\n", rule)
 						err = t.dev.RemoveRule(rule)
 						if err != nil {
-							panic(err)
+							return &Error{Op: "disable", Err: err}
 						}
 						continue OUTER
 					}
@@ -115,44 +184,43 @@ func (t *Translator) Disable() {
 		}
 	}
 
-	pf([]string{"-a", t.Name, "-F", "all"}, "")
-}
-
-func (t *Translator) ForwardTCP(ip, toPort string) {
-	t.forward("tcp", ip, toPort)
-}
-
-func (t *Translator) ForwardUDP(ip, toPort string) {
-	t.forward("udp", ip, toPort)
-}
-
-func (t *Translator) forward(protocol, ip, toPort string) {
-	t.clear(protocol, ip)
-	t.Mappings[Address{protocol, ip}] = toPort
-	pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
-}
-
-func (t *Translator) ClearTCP(ip string) {
-	t.clear("tcp", ip)
-	pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+	if err := pf([]string{"-a", t.Name, "-F", "all"}, ""); err != nil {
+		return &Error{Op: "disable", Err: err}
+	}
+	return nil
 }
 
-func (t *Translator) ClearUDP(ip string) {
-	t.clear("udp", ip)
-	pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules())
+// Forward and Clear change the mappings the rules are made from, and
+// change them back if pf doesn't take the rules, which leaves the
+// anchor as it was.
+func (t *pfTranslator) Forward(protocol, ip, toPort string) error {
+	address := Address{protocol, ip}
+	previous, existed := t.Mappings.Set(address, toPort)
+	if err := t.load("forward"); err != nil {
+		t.Mappings.restore(address, previous, existed)
+		return err
+	}
+	return nil
 }
 
-func (t *Translator) clear(protocol, ip string) {
-	delete(t.Mappings, Address{protocol, ip})
+func (t *pfTranslator) Clear(protocol, ip string) error {
+	address := Address{protocol, ip}
+	previous, existed := t.Mappings.Delete(address)
+	if err := t.load("clear"); err != nil {
+		t.Mappings.restore(address, previous, existed)
+		return err
+	}
+	return nil
 }
 
-func (t *Translator) GetOriginalDst(conn *net.TCPConn) (rawaddr []byte, host string, err error) {
-	remote := conn.RemoteAddr().(*net.TCPAddr)
-	local := conn.LocalAddr().(*net.TCPAddr)
-	addr, port, err := t.dev.NatLook(remote.IP.String(), remote.Port, local.IP.String(), local.Port)
-	if err != nil {
-		return
+// load replaces the contents of our anchor with the current rules
+func (t *pfTranslator) load(op string) error {
+	if err := pf([]string{"-a", t.Name, "-f", "/dev/stdin"}, t.rules()); err != nil {
+		return &Error{Op: op, Err: err}
 	}
+	return nil
+}
 
-	return nil, fmt.Sprintf("%s:%d", addr, port), nil
+func (t *pfTranslator) GetOriginalDst(conn *net.TCPConn) (host string, err error) {
+	return originalDst(conn)
 }
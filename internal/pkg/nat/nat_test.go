@@ -5,6 +5,7 @@ import (
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,7 +14,7 @@ const (
 	GOOD = "GOOD"
 )
 
-func checkForwardTCP(t *testing.T, tr *Translator, fromIP string, ports []string, toPort string) {
+func checkForwardTCP(t *testing.T, tr Translator, fromIP string, ports []string, toPort string) {
 	ln, err := net.Listen("tcp", ":"+toPort)
 	if err != nil {
 		t.Error(err)
@@ -40,7 +41,7 @@ func checkForwardTCP(t *testing.T, tr *Translator, fromIP string, ports []string
 			defer conn.Close()
 			conn.(*net.TCPConn).SetDeadline(deadline)
 
-			_, orig, err := tr.GetOriginalDst(conn.(*net.TCPConn))
+			orig, err := tr.GetOriginalDst(conn.(*net.TCPConn))
 			if err != nil {
 				t.Error(err)
 				return
@@ -134,42 +135,52 @@ func TestTranslator(t *testing.T) {
 	for _, env := range environments {
 		env.setup()
 		for _, network := range networks {
-			tr := NewTranslator("test-table")
+			tr, err := NewTranslator("", "test-table")
+			if err != nil {
+				t.Fatal(err)
+			}
 
 			for _, mapping := range mappings {
 				checkNoForwardTCP(t, fmt.Sprintf("%s.%s", network, mapping.from), ports)
 			}
 
-			tr.Enable()
+			if err := tr.Enable(); err != nil {
+				t.Fatal(err)
+			}
 
 			for _, mapping := range mappings {
 				from := fmt.Sprintf("%s.%s", network, mapping.from)
 
 				checkNoForwardTCP(t, from, ports)
-				tr.ForwardTCP(from, mapping.to)
+				if err := tr.Forward("tcp", from, mapping.to); err != nil {
+					t.Error(err)
+				}
 				checkForwardTCP(t, tr, from, ports, mapping.to)
 			}
 
 			for _, mapping := range mappings {
 				from := fmt.Sprintf("%s.%s", network, mapping.from)
-				tr.ClearTCP(from)
+				if err := tr.Clear("tcp", from); err != nil {
+					t.Error(err)
+				}
 				checkNoForwardTCP(t, from, ports)
 			}
 
-			tr.Disable()
+			if err := tr.Disable(); err != nil {
+				t.Error(err)
+			}
 		}
 		env.teardown()
 	}
 }
 
 func TestSorted(t *testing.T) {
-	tr := NewTranslator("test-table")
-	defer tr.Disable()
-	tr.ForwardTCP("192.0.2.1", "4321")
-	tr.ForwardTCP("192.0.2.3", "4323")
-	tr.ForwardTCP("192.0.2.2", "4322")
-	tr.ForwardUDP("192.0.2.4", "1234")
-	entries := tr.sorted()
+	tr := &fakeTranslator{newCommonTranslator("test-table")}
+	tr.Forward("tcp", "192.0.2.1", "4321")
+	tr.Forward("tcp", "192.0.2.3", "4323")
+	tr.Forward("tcp", "192.0.2.2", "4322")
+	tr.Forward("udp", "192.0.2.4", "1234")
+	entries := tr.Snapshot()
 	if !reflect.DeepEqual(entries, []Entry{
 		{Address{"tcp", "192.0.2.1"}, "4321"},
 		{Address{"tcp", "192.0.2.2"}, "4322"},
@@ -179,3 +190,193 @@ func TestSorted(t *testing.T) {
 		t.Errorf("not sorted: %s", entries)
 	}
 }
+
+type fakeTranslator struct {
+	commonTranslator
+}
+
+func (f *fakeTranslator) Enable() error  { return nil }
+func (f *fakeTranslator) Disable() error { return nil }
+func (f *fakeTranslator) Forward(proto, ip, port string) error {
+	f.Mappings.Set(Address{proto, ip}, port)
+	return nil
+}
+func (f *fakeTranslator) Clear(proto, ip string) error {
+	f.Mappings.Delete(Address{proto, ip})
+	return nil
+}
+func (f *fakeTranslator) GetOriginalDst(conn *net.TCPConn) (string, error) {
+	return "", nil
+}
+
+func TestBackendSelection(t *testing.T) {
+	Register(Backend{
+		Name: "test-fake",
+		New: func(name string) Translator {
+			return &fakeTranslator{newCommonTranslator(name)}
+		},
+		Detect: func() bool { return false },
+	})
+
+	tr, err := NewTranslator("test-fake", "test-table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tr.(*fakeTranslator); !ok {
+		t.Errorf("got %T, expecting *fakeTranslator", tr)
+	}
+
+	_, err = NewTranslator("no-such-backend", "test-table")
+	if err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+
+	found := false
+	for _, name := range Backends() {
+		if name == "test-fake" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("test-fake missing from %v", Backends())
+	}
+}
+
+func TestTimed(t *testing.T) {
+	before := Timings()["sleep-for-test"]
+	failure := fmt.Errorf("exit status 1")
+	for _, d := range []time.Duration{10 * time.Millisecond, 30 * time.Millisecond} {
+		err := timed([]string{"/bin/sleep-for-test"}, func() error {
+			time.Sleep(d)
+			return failure
+		})
+		if err != failure {
+			t.Errorf("expected the error of the command, got %v", err)
+		}
+	}
+	timing := Timings()["sleep-for-test"]
+	if timing.Count-before.Count != 2 {
+		t.Errorf("expected 2 more runs, got %+v", timing)
+	}
+	if timing.Max < 30*time.Millisecond || timing.Last < 30*time.Millisecond || timing.Total < 40*time.Millisecond {
+		t.Errorf("expected the runs to be timed, got %+v", timing)
+	}
+	data, err := timing.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"count":2`) || !strings.Contains(string(data), `"max":"3`) {
+		t.Errorf("expected durations people can read, got %s", data)
+	}
+}
+
+func TestMappings(t *testing.T) {
+	m := newMappings()
+	changes, cancel := m.Subscribe(2)
+	web := Address{"tcp", "10.96.0.10"}
+	m.Set(web, "1234")
+	m.Set(web, "1234")
+	if previous, existed := m.Set(web, "4321"); !existed || previous != "1234" {
+		t.Errorf("expected the previous port 1234, got %q, %v", previous, existed)
+	}
+	// the buffer is full, so this is missed
+	m.Delete(web)
+	for _, expected := range []Change{{web, "1234", false}, {web, "4321", false}} {
+		if change := <-changes; change != expected {
+			t.Errorf("expected %+v, got %+v", expected, change)
+		}
+	}
+	m.Delete(web)
+	m.Set(web, "5678")
+	if change, expected := <-changes, (Change{web, "5678", true}); change != expected {
+		t.Errorf("expected %+v, got %+v", expected, change)
+	}
+	cancel()
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Error("expected the channel to be closed")
+	}
+
+	// readers and writers at once, for -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			address := Address{"tcp", fmt.Sprintf("10.96.0.%d", i)}
+			for j := 0; j < 100; j++ {
+				m.Set(address, "1234")
+				m.Get(web)
+				m.Entries()
+				m.Delete(address)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m.Len() != 1 {
+		t.Errorf("expected only %v left, got %v", web, m.Entries())
+	}
+
+	// what the firewall didn't take is undone
+	api := Address{"tcp", "10.96.0.11"}
+	previous, existed := m.Set(api, "1234")
+	m.restore(api, previous, existed)
+	previous, existed = m.Set(web, "8765")
+	m.restore(web, previous, existed)
+	if _, ok := m.Get(api); ok {
+		t.Errorf("expected %v to be unmapped again", api)
+	}
+	if port, _ := m.Get(web); port != "5678" {
+		t.Errorf("expected %v back at 5678, got %s", web, port)
+	}
+}
+
+func TestRelayDatagrams(t *testing.T) {
+	// client <-> a, relayed to b <-> server
+	pair := func() (*net.UDPConn, *net.UDPConn) {
+		end, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.DialUDP("udp", nil, end.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return end, conn
+	}
+	client, a := pair()
+	defer client.Close()
+	defer a.Close()
+	server, b := pair()
+	defer server.Close()
+	defer b.Close()
+
+	const idle = 100 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		relayDatagrams(a, b, idle)
+		close(done)
+	}()
+
+	// only the server sends, for longer than idle
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for n := 0; n < 8; n++ {
+		server.WriteTo([]byte("tick"), b.LocalAddr())
+		buf := make([]byte, 16)
+		if _, _, err := client.ReadFrom(buf); err != nil {
+			t.Fatalf("tick %d: %v", n, err)
+		}
+		time.Sleep(idle / 3)
+	}
+	select {
+	case <-done:
+		t.Fatal("the relay ended while the server was sending")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * idle):
+		t.Error("the relay didn't end once idle")
+	}
+}
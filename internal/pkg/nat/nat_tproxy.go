@@ -0,0 +1,410 @@
+// +build linux
+
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	Register(Backend{
+		Name: "tproxy",
+		New: func(name string) Translator {
+			return &tproxyTranslator{
+				commonTranslator: newCommonTranslator(name),
+				relays:           newRelays(),
+				flows:            make(map[string]net.Conn),
+			}
+		},
+		// never picked automatically, it has to be asked for
+		Detect: func() bool { return false },
+	})
+}
+
+const (
+	// tproxyMark marks the packets that TPROXY hands to our sockets,
+	// and that tproxyTable then routes to the host itself
+	tproxyMark  = "0x7470"
+	tproxyTable = "7470"
+	tproxyWait  = time.Second
+)
+
+// transparent lets a socket take connections, and send datagrams,
+// for addresses that aren't the host's, as TPROXY needs. It is a
+// variable so tests can do without the privilege that takes.
+var transparent = func(network, address string, c syscall.RawConn) (err error) {
+	c.Control(func(fd uintptr) {
+		for _, option := range []int{syscall.IP_TRANSPARENT, syscall.IP_RECVORIGDSTADDR} {
+			if err == nil {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, option, 1)
+			}
+		}
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+	})
+	return
+}
+
+// tproxyTranslator intercepts with the TPROXY target of iptables
+// rather than NAT: the kernel hands the connections to a transparent
+// socket of ours without rewriting them, so conntrack has nothing to
+// do with them, and it relays them to the local port of the mapping.
+// The relays connect from loopback, which is how GetOriginalDst
+// recognizes them. Traffic of the host itself is marked in OUTPUT to be
+// routed through loopback, where PREROUTING sees it too.
+//
+// ClampMSS and RejectQUIC don't apply.
+type tproxyTranslator struct {
+	commonTranslator
+	tcp    *net.TCPListener
+	udp    *net.UDPConn
+	relays *relays
+
+	// mutex guards flows, the upstream connection of each udp flow
+	// by source and destination
+	mutex sync.Mutex
+	flows map[string]net.Conn
+}
+
+func (t *tproxyTranslator) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+// mangle runs iptables on the mangle table, where TPROXY works.
+func (t *tproxyTranslator) mangle(op string, args ...string) error {
+	_, err := run(append([]string{"iptables", "-t", "mangle"}, args...), "", t.log)
+	if err != nil && op != "" {
+		return &Error{Op: op, Err: err}
+	}
+	return err
+}
+
+// pre is the chain that PREROUTING jumps to, which decides what goes
+// on to the main chain, and out the chain that OUTPUT jumps to, which
+// marks the traffic of the host for the main chain.
+func (t *tproxyTranslator) pre() string { return t.Name + "-pre" }
+func (t *tproxyTranslator) out() string { return t.Name + "-output" }
+
+// jumps are the rules of PREROUTING and OUTPUT that jump to pre and
+// out.
+func (t *tproxyTranslator) jumps() [][]string {
+	output := []string{"OUTPUT", "-j", t.out()}
+	if t.config.Cgroup != "" {
+		output = []string{"OUTPUT", "-m", "cgroup", "--path", t.config.Cgroup, "-j", t.out()}
+	}
+	return [][]string{{"PREROUTING", "-j", t.pre()}, output}
+}
+
+func (t *tproxyTranslator) exists(rule []string) bool {
+	_, err := run(append([]string{"iptables", "-t", "mangle", "-C"}, rule...), "", quiet)
+	return err == nil
+}
+
+// unjump removes every copy of rule, where -D only removes one.
+func (t *tproxyTranslator) unjump(rule []string) {
+	for n := 0; n < maxCopies && t.exists(rule); n++ {
+		t.mangle("", append([]string{"-D"}, rule...)...)
+	}
+}
+
+func (t *tproxyTranslator) chainExists(chain string) bool {
+	_, err := run([]string{"iptables", "-t", "mangle", "-n", "-L", chain}, "", quiet)
+	return err == nil
+}
+
+// unroute removes the rule that routes marked packets to loopback,
+// every copy of it.
+func (t *tproxyTranslator) unroute() {
+	for n := 0; n < maxCopies; n++ {
+		if _, err := run([]string{"ip", "rule", "del", "fwmark", tproxyMark, "lookup", tproxyTable}, "", quiet); err != nil {
+			break
+		}
+	}
+}
+
+// tproxy is the rule of a mapping in the main chain, and mark the one
+// in the output chain.
+func (t *tproxyTranslator) tproxy(protocol, ip string) []string {
+	port := strconv.Itoa(t.tcp.Addr().(*net.TCPAddr).Port)
+	return []string{t.Name, "--dest", ip + "/32", "-p", protocol, "-j", "TPROXY", "--on-ip", "127.0.0.1", "--on-port", port, "--tproxy-mark", tproxyMark}
+}
+
+func (t *tproxyTranslator) mark(protocol, ip string) []string {
+	return []string{t.out(), "--dest", ip + "/32", "-p", protocol, "-j", "MARK", "--set-mark", tproxyMark}
+}
+
+// Enable can run again, as reconnecting does, and leaves the firewall
+// as one run would, like the iptables backend.
+func (t *tproxyTranslator) Enable() error {
+	if err := t.listen(); err != nil {
+		return &Error{Op: "enable", Err: err}
+	}
+
+	t.unroute()
+	for _, command := range [][]string{
+		{"ip", "rule", "add", "fwmark", tproxyMark, "lookup", tproxyTable},
+		{"ip", "route", "replace", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyTable},
+	} {
+		if _, err := run(command, "", t.log); err != nil {
+			return &Error{Op: "enable", Err: err}
+		}
+	}
+
+	// the iptables backend jumps to a mangle chain of the same name
+	// to clamp the mss, which TPROXY may not be jumped to from
+	for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+		t.unjump([]string{chain, "-j", t.Name})
+	}
+	for _, chain := range []string{t.Name, t.pre(), t.out()} {
+		command := "-N"
+		if t.chainExists(chain) {
+			command = "-F"
+		}
+		if err := t.mangle("enable", command, chain); err != nil {
+			return err
+		}
+	}
+	// the traffic of the host comes back through loopback marked
+	commands := [][]string{{"-A", t.pre(), "-m", "mark", "--mark", tproxyMark, "-j", t.Name}}
+	for _, iface := range t.config.ExcludeInterfaces {
+		commands = append(commands, []string{"-A", t.pre(), "-i", iface, "-j", "RETURN"})
+	}
+	if len(t.config.IncludeInterfaces) == 0 {
+		commands = append(commands, []string{"-A", t.pre(), "-j", t.Name})
+	} else {
+		for _, iface := range t.config.IncludeInterfaces {
+			commands = append(commands, []string{"-A", t.pre(), "-i", iface, "-j", t.Name})
+		}
+	}
+	if t.config.BypassMark != 0 {
+		commands = append(commands, []string{"-A", t.out(), "-m", "mark", "--mark", fmt.Sprintf("%#x", t.config.BypassMark), "-j", "RETURN"})
+	}
+	for _, jump := range t.jumps() {
+		if !t.exists(jump) {
+			commands = append(commands, append([]string{"-I"}, jump...))
+		}
+	}
+	// the chains were flushed of them
+	for _, entry := range t.Mappings.Entries() {
+		protocol, ip := entry.Destination.Proto, entry.Destination.Ip
+		commands = append(commands, append([]string{"-A"}, t.tproxy(protocol, ip)...), append([]string{"-A"}, t.mark(protocol, ip)...))
+	}
+	for _, command := range commands {
+		if err := t.mangle("enable", command...); err != nil {
+			return err
+		}
+	}
+	t.log("intercepting via TPROXY to 127.0.0.1:%d", t.tcp.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// listen opens the transparent sockets, unless they are open, on the
+// same port for tcp and udp.
+func (t *tproxyTranslator) listen() error {
+	if t.tcp != nil {
+		return nil
+	}
+	config := net.ListenConfig{Control: transparent}
+	ln, err := config.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	conn, err := config.ListenPacket(context.Background(), "udp4", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	t.tcp, t.udp = ln.(*net.TCPListener), conn.(*net.UDPConn)
+	go t.acceptTCP(t.tcp)
+	go t.acceptUDP(t.udp)
+	return nil
+}
+
+// Disable can run again too, and whether or not Enable got far.
+func (t *tproxyTranslator) Disable() error {
+	for _, jump := range t.jumps() {
+		t.unjump(jump)
+	}
+	for _, chain := range []string{t.pre(), t.out(), t.Name} {
+		if !t.chainExists(chain) {
+			continue
+		}
+		for _, command := range []string{"-F", "-X"} {
+			if err := t.mangle("disable", command, chain); err != nil {
+				return err
+			}
+		}
+	}
+	t.unroute()
+	run([]string{"ip", "route", "flush", "table", tproxyTable}, "", quiet)
+	if t.tcp != nil {
+		t.tcp.Close()
+		t.udp.Close()
+		t.tcp, t.udp = nil, nil
+	}
+	return nil
+}
+
+func (t *tproxyTranslator) Forward(protocol, ip, toPort string) error {
+	if t.tcp == nil {
+		return &Error{Op: "forward", Err: fmt.Errorf("not enabled")}
+	}
+	if _, ok := t.Mappings.Get(Address{protocol, ip}); !ok {
+		for _, rule := range [][]string{t.tproxy(protocol, ip), t.mark(protocol, ip)} {
+			if err := t.mangle("forward", append([]string{"-A"}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+	// the rules are the same whatever the port, which the relays
+	// look up
+	t.Mappings.Set(Address{protocol, ip}, toPort)
+	return nil
+}
+
+func (t *tproxyTranslator) Clear(protocol, ip string) error {
+	if _, ok := t.Mappings.Get(Address{protocol, ip}); !ok {
+		return nil
+	}
+	for _, rule := range [][]string{t.tproxy(protocol, ip), t.mark(protocol, ip)} {
+		if err := t.mangle("clear", append([]string{"-D"}, rule...)...); err != nil {
+			return err
+		}
+	}
+	t.Mappings.Delete(Address{protocol, ip})
+	return nil
+}
+
+// GetOriginalDst waits briefly for the relay to record where conn was
+// headed.
+func (t *tproxyTranslator) GetOriginalDst(conn *net.TCPConn) (host string, err error) {
+	return t.relays.lookup(conn.RemoteAddr().String(), tproxyWait)
+}
+
+// acceptTCP relays the connections TPROXY hands to ln, whose local
+// address is where they were headed.
+func (t *tproxyTranslator) acceptTCP(ln *net.TCPListener) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go t.relayTCP(conn)
+	}
+}
+
+func (t *tproxyTranslator) relayTCP(conn *net.TCPConn) {
+	defer conn.Close()
+	destination := conn.LocalAddr().(*net.TCPAddr)
+	port, ok := t.Mappings.Get(Address{"tcp", destination.IP.String()})
+	if !ok {
+		return
+	}
+	local, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.log("relaying %s: %v", destination, err)
+		return
+	}
+	defer local.Close()
+	key := local.LocalAddr().String()
+	t.relays.add(key, destination.String())
+	defer t.relays.remove(key)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		local.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// acceptUDP relays the datagrams TPROXY hands to conn, each flow by
+// way of a socket of its own from where they were headed to their
+// source, which the rest of the flow then arrives on.
+func (t *tproxyTranslator) acceptUDP(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+	oob := make([]byte, 256)
+	for {
+		n, oobn, _, source, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return
+		}
+		destination := originalUDPDst(oob[:oobn])
+		if destination == nil {
+			destination = conn.LocalAddr().(*net.UDPAddr)
+		}
+		port, ok := t.Mappings.Get(Address{"udp", destination.IP.String()})
+		if !ok {
+			continue
+		}
+		key := source.String() + ">" + destination.String()
+		t.mutex.Lock()
+		upstream, ok := t.flows[key]
+		if !ok {
+			upstream = t.flow(key, source, destination, port)
+		}
+		t.mutex.Unlock()
+		if upstream != nil {
+			upstream.Write(buf[:n])
+		}
+	}
+}
+
+// flow starts relaying the udp flow from source to destination, and
+// returns its upstream connection. The caller holds the mutex.
+func (t *tproxyTranslator) flow(key string, source, destination *net.UDPAddr, port string) net.Conn {
+	dialer := net.Dialer{LocalAddr: destination, Control: transparent}
+	downstream, err := dialer.Dial("udp4", source.String())
+	if err != nil {
+		t.log("relaying udp %s: %v", destination, err)
+		return nil
+	}
+	upstream, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		downstream.Close()
+		t.log("relaying udp %s: %v", destination, err)
+		return nil
+	}
+	t.flows[key] = upstream
+	go func() {
+		defer downstream.Close()
+		defer upstream.Close()
+		relayDatagrams(downstream, upstream, t.config.Timeouts.UDPFlow(destination.String(), udpIdleTimeout))
+		t.mutex.Lock()
+		delete(t.flows, key)
+		t.mutex.Unlock()
+	}()
+	return upstream
+}
+
+// originalUDPDst returns where a datagram was headed, from the control
+// message that IP_RECVORIGDSTADDR has the kernel add.
+func originalUDPDst(oob []byte) *net.UDPAddr {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range messages {
+		// a sockaddr_in: the family, the port, then the address
+		if m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR && len(m.Data) >= 8 {
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), m.Data[4:8]...)), Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// +build linux
+
+package nat
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// plainSockets has the tproxy backend open sockets that don't need
+// the privilege of transparent ones, for the tests.
+func plainSockets() func() {
+	saved := transparent
+	transparent = func(network, address string, c syscall.RawConn) (err error) {
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		return
+	}
+	return func() { transparent = saved }
+}
+
+func TestTproxyRules(t *testing.T) {
+	defer plainSockets()()
+	commands, restore := fakeRun()
+	defer restore()
+
+	tr := &tproxyTranslator{commonTranslator: newCommonTranslator("test-table"), relays: newRelays(), flows: make(map[string]net.Conn)}
+	tr.config.ExcludeInterfaces = []string{"docker0"}
+	tr.config.BypassMark = 0x10
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disable()
+	port := strconv.Itoa(tr.tcp.Addr().(*net.TCPAddr).Port)
+	if err := tr.Forward("tcp", "10.96.0.1", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Forward("tcp", "10.96.0.1", "4321"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Clear("tcp", "10.96.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"ip rule add fwmark 0x7470 lookup 7470",
+		"ip route replace local 0.0.0.0/0 dev lo table 7470",
+		"iptables -t mangle -N test-table",
+		"iptables -t mangle -N test-table-pre",
+		"iptables -t mangle -N test-table-output",
+		"iptables -t mangle -A test-table-pre -m mark --mark 0x7470 -j test-table",
+		"iptables -t mangle -A test-table-pre -i docker0 -j RETURN",
+		"iptables -t mangle -A test-table-pre -j test-table",
+		"iptables -t mangle -A test-table-output -m mark --mark 0x10 -j RETURN",
+		"iptables -t mangle -I PREROUTING -j test-table-pre",
+		"iptables -t mangle -I OUTPUT -j test-table-output",
+		"iptables -t mangle -A test-table --dest 10.96.0.1/32 -p tcp -j TPROXY --on-ip 127.0.0.1 --on-port " + port + " --tproxy-mark 0x7470",
+		"iptables -t mangle -A test-table-output --dest 10.96.0.1/32 -p tcp -j MARK --set-mark 0x7470",
+		// the port is the relay's business, not the rules'
+		"iptables -t mangle -D test-table --dest 10.96.0.1/32 -p tcp -j TPROXY --on-ip 127.0.0.1 --on-port " + port + " --tproxy-mark 0x7470",
+		"iptables -t mangle -D test-table-output --dest 10.96.0.1/32 -p tcp -j MARK --set-mark 0x7470",
+	}
+	// deleting the rule of a previous run succeeds every time here
+	var got []string
+	for _, command := range *commands {
+		if !strings.HasPrefix(command, "ip rule del ") {
+			got = append(got, command)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// TestTproxyRelay has the tproxy backend relay connections that come to
+// its sockets directly, which is where TPROXY would hand them, headed
+// for 127.0.0.1.
+func TestTproxyRelay(t *testing.T) {
+	defer plainSockets()()
+	_, restore := fakeRun()
+	defer restore()
+
+	tr := &tproxyTranslator{commonTranslator: newCommonTranslator("test-table"), relays: newRelays(), flows: make(map[string]net.Conn)}
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disable()
+
+	// the proxy, which answers with where connections were headed
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			destination, err := tr.GetOriginalDst(conn)
+			if err != nil {
+				destination = err.Error()
+			}
+			conn.Write([]byte(destination + "\n"))
+			conn.Close()
+		}
+	}()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+
+	for protocol, port := range map[string]int{"tcp": ln.Addr().(*net.TCPAddr).Port, "udp": udp.LocalAddr().(*net.UDPAddr).Port} {
+		if err := tr.Forward(protocol, "127.0.0.1", strconv.Itoa(port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	address := tr.tcp.Addr().String()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != address {
+		t.Errorf("expected the proxy to see %s, got %q, %v", address, line, err)
+	}
+
+	client, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, message := range []string{"one", "two"} {
+		if _, err := client.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != "echo "+message {
+			t.Errorf("expected the echo of %q, got %q, %v", message, buf[:n], err)
+		}
+	}
+	tr.mutex.Lock()
+	flows := len(tr.flows)
+	tr.mutex.Unlock()
+	if flows != 1 {
+		t.Errorf("expected one udp flow, got %d", flows)
+	}
+}
@@ -0,0 +1,307 @@
+//go:build netstack && (linux || darwin || windows)
+// +build netstack
+// +build linux darwin windows
+
+package nat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+func init() {
+	Register(Backend{
+		Name: "tun",
+		New:  newTunTranslator,
+		// never picked automatically, it has to be asked for
+		Detect: func() bool { return false },
+	})
+}
+
+func newTunTranslator(name string) Translator {
+	return &tunTranslator{
+		commonTranslator: newCommonTranslator(name),
+		relays:           newRelays(),
+		routed:           make(map[string]bool),
+	}
+}
+
+// A device is a tun interface that carries bare ip packets.
+type device interface {
+	io.ReadWriteCloser
+	Name() string
+	// addRoute and deleteRoute route a single address to the
+	// device.
+	addRoute(ip string) error
+	deleteRoute(ip string) error
+}
+
+// newDevice opens the tun device, and is swapped out by the tests.
+var newDevice = openDevice
+
+const (
+	defaultMTU = 1500
+	tunNIC     = 1
+	tunWait    = time.Second
+)
+
+// tunTranslator intercepts without a firewall. Each forwarded address
+// is routed to a tun device, and a userspace network stack terminates
+// the connections that arrive there and relays them to the local port
+// of the mapping. The relays connect from loopback, which is how
+// GetOriginalDst recognizes them.
+//
+// The interfaces of the Config don't apply: whatever the host routes
+// to the device is intercepted, container traffic included.
+type tunTranslator struct {
+	commonTranslator
+	dev   device
+	stack *stack.Stack
+	link  *channel.Endpoint
+	done  chan struct{}
+
+	relays *relays
+
+	// mutex guards routed, which the network stack reads from its
+	// own goroutines
+	mutex  sync.Mutex
+	routed map[string]bool
+}
+
+func (t *tunTranslator) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+func (t *tunTranslator) mtu() int {
+	if t.config.MTU > 0 {
+		return t.config.MTU
+	}
+	return defaultMTU
+}
+
+func (t *tunTranslator) Enable() error {
+	dev, err := newDevice(t.mtu())
+	if err != nil {
+		return &Error{Op: "enable", Err: err}
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol(), udp.NewProtocol()},
+	})
+	// the stack derives the mss it offers from the mtu
+	link := channel.New(512, uint32(t.mtu()), "")
+	if err := s.CreateNIC(tunNIC, link); err != nil {
+		dev.Close()
+		return &Error{Op: "enable", Err: fmt.Errorf("%v", err)}
+	}
+	// accept, and answer from, whatever address was routed to us
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	everything, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+	s.SetRouteTable([]tcpip.Route{{Destination: everything, NIC: tunNIC}})
+
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(s, 0, 1024, t.acceptTCP).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(s, t.acceptUDP).HandlePacket)
+
+	t.dev = dev
+	t.stack = s
+	t.link = link
+	t.done = make(chan struct{})
+	// the device is passed, since Disable forgets it before they
+	// notice
+	go t.inbound(dev)
+	go t.outbound(dev)
+	t.log("intercepting via %s", dev.Name())
+	return nil
+}
+
+func (t *tunTranslator) Disable() error {
+	if t.dev == nil {
+		return nil
+	}
+	close(t.done)
+	// the routes go with the device
+	err := t.dev.Close()
+	t.dev = nil
+	t.mutex.Lock()
+	t.routed = make(map[string]bool)
+	t.mutex.Unlock()
+	if err != nil {
+		return &Error{Op: "disable", Err: err}
+	}
+	return nil
+}
+
+// inbound hands packets the host routed to the device to the stack.
+func (t *tunTranslator) inbound(dev device) {
+	buf := make([]byte, t.mtu())
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				t.log("reading %s: %v", dev.Name(), err)
+			}
+			return
+		}
+		// only ipv4 is ever routed here
+		if n == 0 || buf[0]>>4 != 4 {
+			continue
+		}
+		t.link.InjectInbound(ipv4.ProtocolNumber, tcpip.PacketBuffer{
+			Data: buffer.NewViewFromBytes(buf[:n]).ToVectorisedView(),
+		})
+	}
+}
+
+// outbound hands packets the stack sends back to the host.
+func (t *tunTranslator) outbound(dev device) {
+	for {
+		select {
+		case info := <-t.link.C:
+			packet := append(append([]byte(nil), info.Pkt.Header.View()...), info.Pkt.Data.ToView()...)
+			if _, err := dev.Write(packet); err != nil {
+				t.log("writing %s: %v", dev.Name(), err)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// target returns the local port for connections to ip.
+func (t *tunTranslator) target(protocol, ip string) (string, bool) {
+	return t.Mappings.Get(Address{protocol, ip})
+}
+
+func (t *tunTranslator) acceptTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	ip := net.IP(id.LocalAddress).String()
+	port, ok := t.target("tcp", ip)
+	if !ok {
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		t.log("accepting %s:%d: %v", ip, id.LocalPort, err)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	go t.relayTCP(gonet.NewConn(&wq, ep), net.JoinHostPort(ip, strconv.Itoa(int(id.LocalPort))), port)
+}
+
+func (t *tunTranslator) relayTCP(conn net.Conn, destination, port string) {
+	defer conn.Close()
+	local, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.log("relaying %s: %v", destination, err)
+		return
+	}
+	defer local.Close()
+
+	key := local.LocalAddr().String()
+	t.relays.add(key, destination)
+	defer t.relays.remove(key)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		local.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		conn.(*gonet.Conn).CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func (t *tunTranslator) acceptUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	ip := net.IP(id.LocalAddress).String()
+	port, ok := t.target("udp", ip)
+	if !ok {
+		return
+	}
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		t.log("accepting udp %s:%d: %v", ip, id.LocalPort, err)
+		return
+	}
+	// the endpoint is connected to the sender, so reads and writes
+	// are of its datagrams
+	go t.relayUDP(gonet.NewConn(&wq, ep), net.JoinHostPort(ip, strconv.Itoa(int(id.LocalPort))), port)
+}
+
+func (t *tunTranslator) relayUDP(conn net.Conn, destination, port string) {
+	defer conn.Close()
+	local, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.log("relaying udp %s: %v", destination, err)
+		return
+	}
+	defer local.Close()
+
+	relayDatagrams(conn, local, t.config.Timeouts.UDPFlow(destination, udpIdleTimeout))
+}
+
+func (t *tunTranslator) Forward(protocol, ip, toPort string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.routed[ip] {
+		if err := t.dev.addRoute(ip); err != nil {
+			return &Error{Op: "forward", Err: err}
+		}
+		t.routed[ip] = true
+	}
+	t.Mappings.Set(Address{protocol, ip}, toPort)
+	return nil
+}
+
+func (t *tunTranslator) Clear(protocol, ip string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Mappings.Delete(Address{protocol, ip})
+	for _, entry := range t.Mappings.Entries() {
+		if entry.Destination.Ip == ip {
+			// still needed for the other protocol
+			return nil
+		}
+	}
+	if t.routed[ip] {
+		if err := t.dev.deleteRoute(ip); err != nil {
+			return &Error{Op: "clear", Err: err}
+		}
+		delete(t.routed, ip)
+	}
+	return nil
+}
+
+// GetOriginalDst waits briefly for the relay to record where conn was
+// headed.
+func (t *tunTranslator) GetOriginalDst(conn *net.TCPConn) (host string, err error) {
+	return t.relays.lookup(conn.RemoteAddr().String(), tunWait)
+}
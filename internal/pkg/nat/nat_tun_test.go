@@ -0,0 +1,203 @@
+//go:build netstack && (linux || darwin)
+// +build netstack
+// +build linux darwin
+
+package nat
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+)
+
+// fakeDevice is a tun device whose other end is a network stack of
+// the test's own, standing in for the host.
+type fakeDevice struct {
+	host   *channel.Endpoint
+	closed chan struct{}
+	once   sync.Once
+
+	mutex  sync.Mutex
+	routes map[string]bool
+}
+
+func (d *fakeDevice) Read(b []byte) (int, error) {
+	select {
+	case info := <-d.host.C:
+		return copy(b, append(info.Pkt.Header.View(), info.Pkt.Data.ToView()...)), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	d.host.InjectInbound(ipv4.ProtocolNumber, tcpip.PacketBuffer{
+		Data: buffer.NewViewFromBytes(b).ToVectorisedView(),
+	})
+	return len(b), nil
+}
+
+func (d *fakeDevice) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *fakeDevice) Name() string { return "fake0" }
+
+func (d *fakeDevice) addRoute(ip string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.routes[ip] = true
+	return nil
+}
+
+func (d *fakeDevice) deleteRoute(ip string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.routes, ip)
+	return nil
+}
+
+// fakeHost returns a stack at 10.0.0.1 that routes everything to the
+// device it returns.
+func fakeHost(t *testing.T) (*stack.Stack, *fakeDevice) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol(), udp.NewProtocol()},
+	})
+	link := channel.New(512, defaultMTU, "")
+	if err := s.CreateNIC(1, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, tcpip.Address(net.IPv4(10, 0, 0, 1).To4())); err != nil {
+		t.Fatal(err)
+	}
+	everything, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+	s.SetRouteTable([]tcpip.Route{{Destination: everything, NIC: 1}})
+	return s, &fakeDevice{host: link, closed: make(chan struct{}), routes: make(map[string]bool)}
+}
+
+func TestTun(t *testing.T) {
+	host, dev := fakeHost(t)
+	defer func(open func(int) (device, error)) { newDevice = open }(newDevice)
+	newDevice = func(int) (device, error) { return dev, nil }
+
+	tr := &tunTranslator{
+		commonTranslator: newCommonTranslator("test"),
+		relays:           newRelays(),
+		routed:           make(map[string]bool),
+	}
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disable()
+
+	// the service answers with where the connection was headed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			original, err := tr.GetOriginalDst(conn.(*net.TCPConn))
+			if err != nil {
+				original = err.Error()
+			}
+			conn.Write([]byte(original))
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	if err := tr.Forward("tcp", "10.96.0.10", port); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.routes["10.96.0.10"] {
+		t.Errorf("expected 10.96.0.10 to be routed to the device, got %v", dev.routes)
+	}
+
+	conn, err := gonet.DialTCP(host, tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(net.IPv4(10, 96, 0, 10).To4()), Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil || string(reply) != "10.96.0.10:80" {
+		t.Errorf("expected 10.96.0.10:80, got %q, %v", reply, err)
+	}
+
+	if err := tr.Clear("tcp", "10.96.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if dev.routes["10.96.0.10"] {
+		t.Errorf("expected the route to be deleted, got %v", dev.routes)
+	}
+}
+
+func TestTunUDP(t *testing.T) {
+	host, dev := fakeHost(t)
+	defer func(open func(int) (device, error)) { newDevice = open }(newDevice)
+	newDevice = func(int) (device, error) { return dev, nil }
+
+	tr := &tunTranslator{
+		commonTranslator: newCommonTranslator("test"),
+		relays:           newRelays(),
+		routed:           make(map[string]bool),
+	}
+	if err := tr.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disable()
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	if err := tr.Forward("udp", "10.96.0.11", port); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gonet.DialUDP(host, nil, &tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(net.IPv4(10, 96, 0, 11).To4()), Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("expected the datagram back, got %q, %v", buf[:n], err)
+	}
+}
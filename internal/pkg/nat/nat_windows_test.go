@@ -0,0 +1,13 @@
+package nat
+
+// the windows backend needs no firewall config to test against
+
+type env struct{}
+
+var environments = []env{
+	{},
+}
+
+func (e *env) setup() {}
+
+func (e *env) teardown() {}
@@ -0,0 +1,294 @@
+// +build linux
+
+package nat
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// The tests in this file exercise the real firewall, inside
+// throwaway network namespaces so that they can't disturb the host:
+//
+//	client ns                   router ns
+//	10.98.0.1 (tpc-N) <-veth-> (tpr-N) 10.98.0.2
+//
+// The translator runs in the router ns, which has a route for
+// netnsTarget but nothing listening there, so connections only
+// succeed if they are redirected.
+
+const netnsTarget = "10.99.0.1"
+
+type netns struct {
+	name string
+}
+
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace tests must be run as root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("network namespace tests require iproute2")
+	}
+}
+
+func newNetns(t *testing.T, name string) *netns {
+	n := &netns{name}
+	// e.g. in a container without CAP_SYS_ADMIN
+	if _, err := tpu.Cmd("ip", "netns", "add", name); err != nil {
+		t.Skipf("unable to create network namespaces: %v", err)
+	}
+	if _, err := tpu.Cmd("ip", "-n", name, "link", "set", "lo", "up"); err != nil {
+		n.delete()
+		t.Fatal(err)
+	}
+	return n
+}
+
+func (n *netns) delete() {
+	tpu.Cmd("ip", "netns", "delete", n.name)
+}
+
+// do runs f with the calling goroutine in the namespace. Sockets
+// created by f stay in the namespace after do returns.
+func (n *netns) do(f func() error) error {
+	runtime.LockOSThread()
+
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	target, err := os.Open("/var/run/netns/" + n.name)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer target.Close()
+
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	result := f()
+	if err := setns(orig); err != nil {
+		// leave the thread locked so that it is thrown away
+		// rather than reused in the wrong namespace
+		panic(err)
+	}
+	runtime.UnlockOSThread()
+	return result
+}
+
+func setns(file *os.File) error {
+	return unix.Setns(int(file.Fd()), unix.CLONE_NEWNET)
+}
+
+type topology struct {
+	client, router *netns
+	routerIface    string
+}
+
+func newTopology(t *testing.T) *topology {
+	requireRoot(t)
+	id := os.Getpid() % 100000
+	top := &topology{routerIface: fmt.Sprintf("tpr-%d", id)}
+	// clean up if we skip or fail part way through
+	ok := false
+	defer func() {
+		if !ok {
+			top.delete()
+		}
+	}()
+	top.client = newNetns(t, fmt.Sprintf("tp-client-%d", id))
+	top.router = newNetns(t, fmt.Sprintf("tp-router-%d", id))
+	clientIface := fmt.Sprintf("tpc-%d", id)
+	for _, command := range [][]string{
+		{"ip", "link", "add", clientIface, "type", "veth", "peer", "name", top.routerIface},
+		{"ip", "link", "set", clientIface, "netns", top.client.name},
+		{"ip", "link", "set", top.routerIface, "netns", top.router.name},
+		{"ip", "-n", top.client.name, "addr", "add", "10.98.0.1/24", "dev", clientIface},
+		{"ip", "-n", top.router.name, "addr", "add", "10.98.0.2/24", "dev", top.routerIface},
+		{"ip", "-n", top.client.name, "link", "set", clientIface, "up"},
+		{"ip", "-n", top.router.name, "link", "set", top.routerIface, "up"},
+		{"ip", "-n", top.client.name, "route", "add", "default", "via", "10.98.0.2"},
+		{"ip", "-n", top.router.name, "route", "add", "default", "via", "10.98.0.1"},
+	} {
+		if _, err := tpu.Cmd(command...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ok = true
+	return top
+}
+
+func (top *topology) delete() {
+	// deleting a namespace deletes the veth pair with it
+	for _, n := range []*netns{top.client, top.router} {
+		if n != nil {
+			n.delete()
+		}
+	}
+}
+
+// translator returns a translator whose firewall commands run in the
+// router namespace, and a function to restore the real runner.
+func (top *topology) translator(t *testing.T, backend string) (Translator, func()) {
+	tr, err := NewTranslator(backend, "netns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := run
+	run = func(command []string, input string, logf func(string, ...interface{})) (string, error) {
+		return saved(append([]string{"ip", "netns", "exec", top.router.name}, command...), input, logf)
+	}
+	return tr, func() { run = saved }
+}
+
+// checkRedirect dials netnsTarget:80 from the given namespace, and
+// reports whether the connection reached a listener on port in the
+// router namespace with the original destination intact.
+func (top *topology) checkRedirect(t *testing.T, tr Translator, from *netns, port string) bool {
+	var ln net.Listener
+	err := top.router.do(func() (err error) {
+		ln, err = net.Listen("tcp", ":"+port)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+
+	accepted := make(chan string, 1)
+	go func() {
+		defer close(accepted)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		orig, err := tr.GetOriginalDst(conn.(*net.TCPConn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- orig
+	}()
+
+	var conn net.Conn
+	err = from.do(func() (err error) {
+		conn, err = net.DialTimeout("tcp", netnsTarget+":80", time.Second)
+		return
+	})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	orig := <-accepted
+	if orig != netnsTarget+":80" {
+		t.Errorf("got original destination %q, expecting %s:80", orig, netnsTarget)
+	}
+	return true
+}
+
+func backendsFor(t *testing.T) []string {
+	requireRoot(t)
+	var result []string
+	for _, b := range []string{"iptables", "nftables"} {
+		tool := map[string]string{"iptables": "iptables", "nftables": "nft"}[b]
+		if _, err := exec.LookPath(tool); err == nil {
+			result = append(result, b)
+		}
+	}
+	if len(result) == 0 {
+		t.Skip("neither iptables nor nft is available")
+	}
+	return result
+}
+
+func TestNetnsRedirect(t *testing.T) {
+	backends := backendsFor(t)
+	top := newTopology(t)
+	defer top.delete()
+
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			tr, restore := top.translator(t, backend)
+			defer restore()
+			if err := tr.Enable(); err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Disable()
+			if err := tr.Forward("tcp", netnsTarget, "4321"); err != nil {
+				t.Fatal(err)
+			}
+
+			// OUTPUT
+			if !top.checkRedirect(t, tr, top.router, "4321") {
+				t.Error("local connection was not redirected")
+			}
+			// PREROUTING
+			if !top.checkRedirect(t, tr, top.client, "4321") {
+				t.Error("forwarded connection was not redirected")
+			}
+
+			if err := tr.Clear("tcp", netnsTarget); err != nil {
+				t.Fatal(err)
+			}
+			if top.checkRedirect(t, tr, top.router, "4321") {
+				t.Error("connection was redirected after clear")
+			}
+		})
+	}
+}
+
+func TestNetnsInterfaces(t *testing.T) {
+	backends := backendsFor(t)
+	top := newTopology(t)
+	defer top.delete()
+
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			for _, config := range []struct {
+				config   Config
+				expected bool
+			}{
+				{Config{IncludeInterfaces: []string{top.routerIface}}, true},
+				{Config{IncludeInterfaces: []string{"nonexistent0"}}, false},
+				{Config{ExcludeInterfaces: []string{top.routerIface}}, false},
+			} {
+				tr, restore := top.translator(t, backend)
+				tr.Configure(config.config)
+				if err := tr.Enable(); err != nil {
+					restore()
+					t.Fatal(err)
+				}
+				if err := tr.Forward("tcp", netnsTarget, "4321"); err != nil {
+					t.Error(err)
+				}
+				if top.checkRedirect(t, tr, top.client, "4321") != config.expected {
+					t.Errorf("%+v: expected redirected=%v", config.config, config.expected)
+				}
+				// local traffic is always intercepted
+				if !top.checkRedirect(t, tr, top.router, "4321") {
+					t.Errorf("%+v: local connection was not redirected", config.config)
+				}
+				tr.Disable()
+				restore()
+			}
+		})
+	}
+}
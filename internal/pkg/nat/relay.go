@@ -0,0 +1,95 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udp has no close, so relays end when idle
+const udpIdleTimeout = 30 * time.Second
+
+// relayDatagrams copies datagrams both ways between a and b until
+// neither way has carried one for idle. The caller closes them.
+func relayDatagrams(a, b net.Conn, idle time.Duration) {
+	last := time.Now().UnixNano()
+	done := make(chan struct{}, 2)
+	relay := func(from, to net.Conn) {
+		buf := make([]byte, 65536)
+		for {
+			from.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&last)).Add(idle))
+			n, err := from.Read(buf)
+			if err != nil {
+				// the other way may have carried some since
+				if timeout, ok := err.(net.Error); ok && timeout.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(&last))) < idle {
+					continue
+				}
+				break
+			}
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			if _, err := to.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go relay(a, b)
+	go relay(b, a)
+	// once it is idle, or either way fails, the closes end the other
+	<-done
+}
+
+// relays maps the local address of each connection that a backend
+// relays to the local port of a mapping to where the connection was
+// headed, for GetOriginalDst.
+type relays struct {
+	mutex     sync.Mutex
+	found     *sync.Cond
+	originals map[string]string
+}
+
+func newRelays() *relays {
+	r := &relays{originals: make(map[string]string)}
+	r.found = sync.NewCond(&r.mutex)
+	return r
+}
+
+func (r *relays) add(key, destination string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.originals[key] = destination
+	r.found.Broadcast()
+}
+
+func (r *relays) remove(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.originals, key)
+}
+
+// lookup waits up to wait for the relay from key to be added, since
+// the relay only learns its local address once the connection is
+// already established.
+func (r *relays) lookup(key string, wait time.Duration) (string, error) {
+	deadline := time.Now().Add(wait)
+	timer := time.AfterFunc(wait, func() {
+		r.mutex.Lock()
+		r.found.Broadcast()
+		r.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		if destination, ok := r.originals[key]; ok {
+			return destination, nil
+		}
+		if !time.Now().Before(deadline) {
+			return "", fmt.Errorf("no relay from %s", key)
+		}
+		r.found.Wait()
+	}
+}
@@ -0,0 +1,89 @@
+package nat
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// slowCommand is how long a firewall tool may take before we say so,
+// which endpoint security agents that vet every exec can make it.
+const slowCommand = time.Second
+
+// A Timing sums up how long something took, the Count times it
+// happened.
+type Timing struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+	Last  time.Duration
+}
+
+// Add counts one more time, that took d.
+func (t *Timing) Add(d time.Duration) {
+	t.Count++
+	t.Total += d
+	t.Last = d
+	if d > t.Max {
+		t.Max = d
+	}
+}
+
+// Mean is how long it took on average.
+func (t Timing) Mean() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Total / time.Duration(t.Count)
+}
+
+// MarshalJSON gives the durations as strings like "1.5s", for people
+// to read.
+func (t Timing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count int    `json:"count"`
+		Total string `json:"total"`
+		Mean  string `json:"mean"`
+		Max   string `json:"max"`
+		Last  string `json:"last"`
+	}{t.Count, t.Total.String(), t.Mean().String(), t.Max.String(), t.Last.String()})
+}
+
+var (
+	timings     = make(map[string]*Timing)
+	timingsLock sync.Mutex
+)
+
+// timed runs f, a run of command, and records how long it took under
+// the name of the tool, logging runs that are slow.
+func timed(command []string, f func() error) error {
+	start := time.Now()
+	err := f()
+	took := time.Since(start)
+	tool := filepath.Base(command[0])
+	timingsLock.Lock()
+	t, ok := timings[tool]
+	if !ok {
+		t = &Timing{}
+		timings[tool] = t
+	}
+	t.Add(took)
+	timingsLock.Unlock()
+	if took > slowCommand {
+		logf("%s took %v, something (e.g. endpoint security) may be slowing down exec", tool, took.Round(time.Millisecond))
+	}
+	return err
+}
+
+// Timings returns how long each firewall tool, e.g. iptables or pfctl,
+// has taken to run so far.
+func Timings() map[string]Timing {
+	timingsLock.Lock()
+	defer timingsLock.Unlock()
+	result := make(map[string]Timing, len(timings))
+	for tool, t := range timings {
+		result[tool] = *t
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+// +build netstack
+
+package nat
+
+import (
+	"encoding/binary"
+	"strconv"
+	"syscall"
+)
+
+// utunDevice adapts a utun to carry bare ip packets.
+type utunDevice struct {
+	*utun
+	buf []byte
+}
+
+func openDevice(mtu int) (device, error) {
+	u, err := openUtun()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := run([]string{"ifconfig", u.name, "mtu", strconv.Itoa(mtu)}, "", u.log); err != nil {
+		u.close()
+		return nil, err
+	}
+	return &utunDevice{utun: u, buf: make([]byte, 4+mtu)}, nil
+}
+
+func (d *utunDevice) Name() string {
+	return d.name
+}
+
+// Read is only ever invoked from one goroutine.
+func (d *utunDevice) Read(packet []byte) (int, error) {
+	for {
+		n, err := d.file.Read(d.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n > 4 {
+			return copy(packet, d.buf[4:n]), nil
+		}
+	}
+}
+
+// Write is only ever invoked from one goroutine.
+func (d *utunDevice) Write(packet []byte) (int, error) {
+	out := make([]byte, 4+len(packet))
+	binary.BigEndian.PutUint32(out, syscall.AF_INET)
+	copy(out[4:], packet)
+	n, err := d.file.Write(out)
+	if n >= 4 {
+		n -= 4
+	}
+	return n, err
+}
+
+func (d *utunDevice) Close() error {
+	d.close()
+	return nil
+}
+
+func (d *utunDevice) addRoute(ip string) error {
+	_, err := run([]string{"route", "-n", "add", "-host", ip, "-interface", d.name}, "", d.log)
+	return err
+}
+
+func (d *utunDevice) deleteRoute(ip string) error {
+	_, err := run([]string{"route", "-n", "delete", "-host", ip, "-interface", d.name}, "", d.log)
+	return err
+}
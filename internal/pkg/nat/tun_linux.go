@@ -0,0 +1,78 @@
+// +build netstack
+
+package nat
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// from <linux/if_tun.h>
+const (
+	tunsetiff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// linuxTun is a tun device without packet information, so reads and
+// writes are bare ip packets.
+type linuxTun struct {
+	*os.File
+	name string
+}
+
+func openDevice(mtu int) (device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("open", err)
+	}
+
+	req := ifreq{flags: iffTun | iffNoPi}
+	copy(req.name[:], "teleproxy%d")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunsetiff, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("ioctl", errno)
+	}
+
+	// non blocking so that closing the file interrupts reads
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	name := strings.TrimRight(string(req.name[:]), "\x00")
+	dev := &linuxTun{os.NewFile(uintptr(fd), name), name}
+	if _, err := run([]string{"ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"}, "", dev.log); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func (d *linuxTun) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+func (d *linuxTun) Name() string {
+	return d.name
+}
+
+func (d *linuxTun) addRoute(ip string) error {
+	_, err := run([]string{"ip", "route", "replace", ip + "/32", "dev", d.name}, "", d.log)
+	return err
+}
+
+func (d *linuxTun) deleteRoute(ip string) error {
+	_, err := run([]string{"ip", "route", "del", ip + "/32", "dev", d.name}, "", d.log)
+	return err
+}
@@ -0,0 +1,175 @@
+// +build netstack
+
+package nat
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The windows backend is the tun one, over wintun, which is picked
+// when wintun is there since windows has no firewall to intercept with.
+func init() {
+	Register(Backend{
+		Name:   "windows",
+		New:    newTunTranslator,
+		Detect: func() bool { return wintun.Load() == nil },
+	})
+}
+
+// wintun is the driver of the tun device on windows, which isn't part
+// of windows: wintun.dll has to sit next to teleproxy.exe, or on the
+// PATH. See https://www.wintun.net.
+var (
+	wintun                     = syscall.NewLazyDLL("wintun.dll")
+	wintunCreateAdapter        = wintun.NewProc("WintunCreateAdapter")
+	wintunCloseAdapter         = wintun.NewProc("WintunCloseAdapter")
+	wintunStartSession         = wintun.NewProc("WintunStartSession")
+	wintunEndSession           = wintun.NewProc("WintunEndSession")
+	wintunGetReadWaitEvent     = wintun.NewProc("WintunGetReadWaitEvent")
+	wintunReceivePacket        = wintun.NewProc("WintunReceivePacket")
+	wintunReleaseReceivePacket = wintun.NewProc("WintunReleaseReceivePacket")
+	wintunAllocateSendPacket   = wintun.NewProc("WintunAllocateSendPacket")
+	wintunSendPacket           = wintun.NewProc("WintunSendPacket")
+)
+
+const (
+	wintunName = "teleproxy"
+	// wintunRing is the size of the rings the driver and we share
+	wintunRing = 0x400000
+	// wintunAddress is the address of the device, without which
+	// windows doesn't route to it: one of the range set aside for
+	// benchmarks, which nothing should be using.
+	wintunAddress = "198.18.0.1"
+	// wintunPoll is how long a read waits on the driver at a time,
+	// before it checks whether the device was closed.
+	wintunPoll = 250
+
+	errorNoMoreItems = syscall.Errno(259)
+)
+
+// windowsTun is a wintun adapter, whose packets are bare ip packets.
+type windowsTun struct {
+	adapter, session uintptr
+	readable         syscall.Handle
+
+	// closing is held to read to write to the session, and taken by
+	// Close to end it
+	closing sync.RWMutex
+	closed  bool
+}
+
+// pointer is the pointer a wintun function returned, which vet can't
+// tell was never a go pointer.
+func pointer(r uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&r))
+}
+
+func openDevice(mtu int) (device, error) {
+	if err := wintun.Load(); err != nil {
+		return nil, err
+	}
+	name, err := syscall.UTF16PtrFromString(wintunName)
+	if err != nil {
+		return nil, err
+	}
+	tunnelType, err := syscall.UTF16PtrFromString("Teleproxy")
+	if err != nil {
+		return nil, err
+	}
+	adapter, _, err := wintunCreateAdapter.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(tunnelType)), 0)
+	if adapter == 0 {
+		return nil, &Error{Op: "WintunCreateAdapter", Err: err}
+	}
+	session, _, err := wintunStartSession.Call(adapter, wintunRing)
+	if session == 0 {
+		wintunCloseAdapter.Call(adapter)
+		return nil, &Error{Op: "WintunStartSession", Err: err}
+	}
+	readable, _, _ := wintunGetReadWaitEvent.Call(session)
+	dev := &windowsTun{adapter: adapter, session: session, readable: syscall.Handle(readable)}
+
+	for _, command := range [][]string{
+		{"netsh", "interface", "ipv4", "set", "address", "name=" + wintunName, "source=static", "address=" + wintunAddress, "mask=255.255.255.255"},
+		{"netsh", "interface", "ipv4", "set", "subinterface", wintunName, "mtu=" + strconv.Itoa(mtu), "store=active"},
+	} {
+		if _, err := run(command, "", dev.log); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+func (d *windowsTun) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+func (d *windowsTun) Name() string {
+	return wintunName
+}
+
+func (d *windowsTun) Read(b []byte) (int, error) {
+	for {
+		d.closing.RLock()
+		if d.closed {
+			d.closing.RUnlock()
+			return 0, io.EOF
+		}
+		var size uint32
+		packet, _, err := wintunReceivePacket.Call(d.session, uintptr(unsafe.Pointer(&size)))
+		if packet != 0 {
+			n := copy(b, (*[1 << 30]byte)(pointer(packet))[:size:size])
+			wintunReleaseReceivePacket.Call(d.session, packet)
+			d.closing.RUnlock()
+			return n, nil
+		}
+		d.closing.RUnlock()
+		if !errors.Is(err, errorNoMoreItems) {
+			return 0, &Error{Op: "WintunReceivePacket", Err: err}
+		}
+		syscall.WaitForSingleObject(d.readable, wintunPoll)
+	}
+}
+
+func (d *windowsTun) Write(b []byte) (int, error) {
+	d.closing.RLock()
+	defer d.closing.RUnlock()
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+	packet, _, err := wintunAllocateSendPacket.Call(d.session, uintptr(len(b)))
+	if packet == 0 {
+		return 0, &Error{Op: "WintunAllocateSendPacket", Err: err}
+	}
+	copy((*[1 << 30]byte)(pointer(packet))[:len(b):len(b)], b)
+	wintunSendPacket.Call(d.session, packet)
+	return len(b), nil
+}
+
+// Close removes the adapter, and the routes with it.
+func (d *windowsTun) Close() error {
+	d.closing.Lock()
+	defer d.closing.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	wintunEndSession.Call(d.session)
+	wintunCloseAdapter.Call(d.adapter)
+	return nil
+}
+
+func (d *windowsTun) addRoute(ip string) error {
+	_, err := run([]string{"netsh", "interface", "ipv4", "add", "route", ip + "/32", wintunName, "store=active"}, "", d.log)
+	return err
+}
+
+func (d *windowsTun) deleteRoute(ip string) error {
+	_, err := run([]string{"netsh", "interface", "ipv4", "delete", "route", ip + "/32", wintunName}, "", d.log)
+	return err
+}
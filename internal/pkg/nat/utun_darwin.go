@@ -0,0 +1,188 @@
+// +build darwin
+
+package nat
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// A utun is a tunnel device owned by this process. Routing a range to
+// it makes the range leave by way of an interface pf is watching, even
+// when a VPN client has routes (or a packet filter of its own) that
+// would otherwise take the traffic first. The pf rules divert whatever
+// is intercepted to lo0, so nothing useful is ever read from the
+// device. The device, and with it its routes, goes away when the
+// process exits.
+//
+// Each packet read from or written to the device is preceded by its
+// address family as a 4 byte big endian integer.
+type utun struct {
+	file   *os.File
+	name   string
+	routes []string
+}
+
+// from <sys/kern_control.h> and <net/if_utun.h>, which syscall
+// doesn't cover
+const (
+	sysprotoControl = 2
+	afSysControl    = 2
+	ctliocginfo     = 0xc0644e03
+	utunControl     = "com.apple.net.utun_control"
+	utunOptIfname   = 2
+)
+
+// these mirror struct ctl_info and struct sockaddr_ctl
+type ctlInfo struct {
+	id   uint32
+	name [96]byte
+}
+
+type sockaddrCtl struct {
+	len      uint8
+	family   uint8
+	sysaddr  uint16
+	id       uint32
+	unit     uint32
+	reserved [5]uint32
+}
+
+// the address of our end of the tunnel, link local so that it can't
+// collide with anything real
+const (
+	utunLocal = "169.254.254.1"
+	utunPeer  = "169.254.254.2"
+)
+
+func openUtun() (*utun, error) {
+	fd, err := syscall.Socket(syscall.AF_SYSTEM, syscall.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	var info ctlInfo
+	copy(info.name[:], utunControl)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ctliocginfo, uintptr(unsafe.Pointer(&info)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("ioctl", errno)
+	}
+
+	// unit 0 asks for the next free utunN
+	addr := sockaddrCtl{
+		family:  syscall.AF_SYSTEM,
+		sysaddr: afSysControl,
+		id:      info.id,
+	}
+	addr.len = uint8(unsafe.Sizeof(addr))
+	_, _, errno = syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", errno)
+	}
+
+	var name [syscall.IFNAMSIZ]byte
+	size := uintptr(len(name))
+	_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), sysprotoControl, utunOptIfname,
+		uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockopt", errno)
+	}
+
+	// non blocking so that closing the file interrupts drain
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	u := &utun{name: strings.TrimRight(string(name[:size]), "\x00")}
+	u.file = os.NewFile(uintptr(fd), u.name)
+	if _, err := run([]string{"ifconfig", u.name, "inet", utunLocal, utunPeer, "up"}, "", u.log); err != nil {
+		u.file.Close()
+		return nil, err
+	}
+	u.log("opened %s", u.name)
+	return u, nil
+}
+
+func (u *utun) log(line string, args ...interface{}) {
+	logf(line, args...)
+}
+
+// drain discards packets for destinations in the routed ranges that
+// aren't intercepted, so they don't queue up in the kernel.
+func (u *utun) drain() {
+	buf := make([]byte, 65536)
+	for {
+		if _, err := u.file.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// route sends traffic for cidr through the device.
+func (u *utun) route(cidr string) error {
+	if _, err := run([]string{"route", "-n", "add", "-net", cidr, "-interface", u.name}, "", u.log); err != nil {
+		return err
+	}
+	u.routes = append(u.routes, cidr)
+	return nil
+}
+
+// unroute stops sending traffic for cidr through the device.
+func (u *utun) unroute(cidr string) error {
+	if _, err := run([]string{"route", "-n", "delete", "-net", cidr, "-interface", u.name}, "", u.log); err != nil {
+		return err
+	}
+	for i, routed := range u.routes {
+		if routed == cidr {
+			u.routes = append(u.routes[:i], u.routes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// reroute changes the routes through the device to cidrs, deleting and
+// adding only the ones that differ.
+func (u *utun) reroute(cidrs []string) error {
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr] = true
+	}
+	routed := make(map[string]bool, len(u.routes))
+	for _, cidr := range append([]string(nil), u.routes...) {
+		if !wanted[cidr] {
+			if err := u.unroute(cidr); err != nil {
+				return err
+			}
+			continue
+		}
+		routed[cidr] = true
+	}
+	for _, cidr := range cidrs {
+		if !routed[cidr] {
+			if err := u.route(cidr); err != nil {
+				return err
+			}
+			routed[cidr] = true
+		}
+	}
+	return nil
+}
+
+// close removes the routes and the device.
+func (u *utun) close() {
+	for _, cidr := range u.routes {
+		// the kernel removes them with the device anyway, but
+		// this way the log shows it
+		run([]string{"route", "-n", "delete", "-net", cidr, "-interface", u.name}, "", u.log)
+	}
+	u.routes = nil
+	u.file.Close()
+	u.log("closed %s", u.name)
+}
@@ -0,0 +1,348 @@
+// Package plugin runs policy plugins, which have the last word on what
+// is intercepted and how names resolve, so that organizations can add
+// rules of their own (never intercept prod, answer for some hosts)
+// without forking teleproxy.
+//
+// A plugin is a program, in any language, that reads requests from its
+// stdin and writes responses to its stdout, as a json object a line,
+// and logs to its stderr. It runs for as long as teleproxy does, and is
+// asked one thing at a time or several at once, so responses carry the
+// id of their request. The first request is a hello:
+//
+//	{"id": 0, "kind": "hello", "version": 1}
+//	{"id": 0, "name": "prod-guard", "intercepts": true, "names": ["*.prod.svc.cluster.local"]}
+//
+// whose response says what the plugin wants asked about: intercepts,
+// and the names matching a list of patterns. Then intercepts are asked
+// about as they are made, and may be denied or given a shorter ttl:
+//
+//	{"id": 1, "kind": "intercept", "namespace": "prod", "service": "web", "port": 80}
+//	{"id": 1, "deny": "prod is never intercepted"}
+//
+// and names as they are queried, with what teleproxy would answer, if
+// anything, which may be replaced, denied (so the name doesn't exist),
+// or relayed to the usual dns server instead:
+//
+//	{"id": 2, "kind": "dns", "name": "web.prod.svc.cluster.local", "answer": "10.96.0.10"}
+//	{"id": 2, "answer": "10.0.0.5"}
+//
+// An empty response, {"id": 2}, leaves things as they are. A plugin
+// that takes longer than Timeout to respond, or dies, is passed over,
+// unless its hello asked to fail closed, "fail_closed": true, when
+// whatever it was asked is denied.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the protocol, which the hello gives.
+const Version = 1
+
+// Timeout is how long a plugin may take to respond.
+const Timeout = time.Second
+
+// A Request asks a plugin something.
+type Request struct {
+	ID   uint64 `json:"id"`
+	Kind string `json:"kind"`
+	// Version is that of the protocol, in the hello.
+	Version int `json:"version,omitempty"`
+	// Namespace, Service, Port, and TTL are those of an intercept.
+	Namespace string `json:"namespace,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	// Name is the name queried, and Answer the address teleproxy
+	// would answer with, if any.
+	Name   string `json:"name,omitempty"`
+	Answer string `json:"answer,omitempty"`
+}
+
+// A Response is what a plugin makes of a Request.
+type Response struct {
+	ID uint64 `json:"id"`
+	// Deny, if set, is why an intercept is denied, or why a name
+	// doesn't exist.
+	Deny string `json:"deny,omitempty"`
+	// TTL, if set, is the lifetime to give an intercept instead.
+	TTL string `json:"ttl,omitempty"`
+	// Answer, if set, is the address to answer a query with
+	// instead, and Relay leaves the query to the usual dns server.
+	Answer string `json:"answer,omitempty"`
+	Relay  bool   `json:"relay,omitempty"`
+
+	// Name, Intercepts, Names, and FailClosed respond to the hello:
+	// what the plugin is called, whether it is asked about
+	// intercepts, the patterns of the names it is asked about, and
+	// whether to deny what it fails to respond to.
+	Name       string   `json:"name,omitempty"`
+	Intercepts bool     `json:"intercepts,omitempty"`
+	Names      []string `json:"names,omitempty"`
+	FailClosed bool     `json:"fail_closed,omitempty"`
+}
+
+// A Plugin is a running plugin.
+type Plugin struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	hello   Response
+
+	mutex   sync.Mutex
+	next    uint64
+	pending map[uint64]chan Response
+	// err is why the plugin stopped, once it has
+	err  error
+	done chan struct{}
+}
+
+// Start runs command, with sh, as a plugin, and says hello to it.
+func Start(command string) (*Plugin, error) {
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := newPlugin(command, stdin, stdout)
+	p.cmd = cmd
+	go func() {
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			log.Printf("PLG: %s: %s", p, lines.Text())
+		}
+	}()
+	if err := p.greet(); err != nil {
+		p.Close()
+		return nil, errors.Wrapf(err, "plugin %s", command)
+	}
+	log.Printf("PLG: started %s", p)
+	return p, nil
+}
+
+func newPlugin(command string, stdin io.WriteCloser, stdout io.Reader) *Plugin {
+	p := &Plugin{
+		command: command,
+		stdin:   stdin,
+		pending: make(map[uint64]chan Response),
+		done:    make(chan struct{}),
+	}
+	go p.read(stdout)
+	return p
+}
+
+func (p *Plugin) String() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.hello.Name != "" {
+		return p.hello.Name
+	}
+	return p.command
+}
+
+func (p *Plugin) greet() error {
+	hello, err := p.ask(Request{Kind: "hello", Version: Version})
+	if err != nil {
+		return err
+	}
+	for _, pattern := range hello.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("name pattern %q: %v", pattern, err)
+		}
+	}
+	// the plugin may already be logging under its name, which the
+	// hello gives
+	p.mutex.Lock()
+	p.hello = hello
+	p.mutex.Unlock()
+	return nil
+}
+
+// read hands the responses to whoever waits for them.
+func (p *Plugin) read(stdout io.Reader) {
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		var response Response
+		if err := json.Unmarshal(lines.Bytes(), &response); err != nil {
+			log.Printf("PLG: %s: ignoring %q: %v", p, lines.Text(), err)
+			continue
+		}
+		p.mutex.Lock()
+		waiting, ok := p.pending[response.ID]
+		delete(p.pending, response.ID)
+		p.mutex.Unlock()
+		if ok {
+			waiting <- response
+		}
+	}
+	err := lines.Err()
+	if err == nil {
+		err = errors.New("exited")
+	}
+	p.mutex.Lock()
+	p.err = err
+	p.mutex.Unlock()
+	close(p.done)
+}
+
+// ask sends request, and waits for the response to it.
+func (p *Plugin) ask(request Request) (Response, error) {
+	waiting := make(chan Response, 1)
+	p.mutex.Lock()
+	if p.err != nil {
+		p.mutex.Unlock()
+		return Response{}, p.err
+	}
+	request.ID = p.next
+	p.next++
+	p.pending[request.ID] = waiting
+	data, _ := json.Marshal(request)
+	// written under the mutex, so that requests aren't interleaved
+	_, err := p.stdin.Write(append(data, '\n'))
+	p.mutex.Unlock()
+	if err != nil {
+		return Response{}, err
+	}
+
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	select {
+	case response := <-waiting:
+		return response, nil
+	case <-timer.C:
+		p.mutex.Lock()
+		delete(p.pending, request.ID)
+		p.mutex.Unlock()
+		return Response{}, fmt.Errorf("no response in %v", Timeout)
+	case <-p.done:
+		return Response{}, p.err
+	}
+}
+
+// Close stops the plugin, by closing its stdin, killing it if it won't
+// exit.
+func (p *Plugin) Close() error {
+	p.stdin.Close()
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+	case <-time.After(Timeout):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	return p.cmd.Wait()
+}
+
+// failed is what to make of a request that the plugin failed to
+// respond to: nothing, unless it fails closed.
+func (p *Plugin) failed(what string, err error) Response {
+	log.Printf("PLG: %s failed to respond about %s: %v", p, what, err)
+	if p.hello.FailClosed {
+		return Response{Deny: fmt.Sprintf("plugin %s failed to respond", p)}
+	}
+	return Response{}
+}
+
+// wants is whether the plugin is asked about name, which ends in a dot
+// or not.
+func (p *Plugin) wants(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for _, pattern := range p.hello.Names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Plugins are asked in order, each about what the ones before made of
+// a request.
+type Plugins []*Plugin
+
+// Intercept asks the plugins about an intercept for ttl, zero for
+// forever, and returns what ttl to give it instead, or why it is
+// denied.
+func (plugins Plugins) Intercept(namespace, service string, port int, ttl time.Duration) (time.Duration, error) {
+	for _, p := range plugins {
+		if !p.hello.Intercepts {
+			continue
+		}
+		request := Request{Kind: "intercept", Namespace: namespace, Service: service, Port: port}
+		if ttl > 0 {
+			request.TTL = ttl.String()
+		}
+		response, err := p.ask(request)
+		if err != nil {
+			response = p.failed(fmt.Sprintf("intercepting %s/%s", namespace, service), err)
+		}
+		if response.Deny != "" {
+			return 0, fmt.Errorf("plugin %s denied intercepting %s/%s: %s", p, namespace, service, response.Deny)
+		}
+		if response.TTL != "" {
+			d, err := time.ParseDuration(response.TTL)
+			if err != nil || d <= 0 {
+				log.Printf("PLG: %s: ignoring ttl %q", p, response.TTL)
+				continue
+			}
+			ttl = d
+		}
+	}
+	return ttl, nil
+}
+
+// Answer asks the plugins about name, which teleproxy would answer
+// with ip, or not at all if ip is empty. It returns the address to
+// answer with instead, empty to relay the query, and whether the name
+// exists at all.
+func (plugins Plugins) Answer(name, ip string) (string, bool) {
+	for _, p := range plugins {
+		if !p.wants(name) {
+			continue
+		}
+		response, err := p.ask(Request{Kind: "dns", Name: strings.TrimSuffix(name, "."), Answer: ip})
+		if err != nil {
+			response = p.failed(name, err)
+		}
+		switch {
+		case response.Deny != "":
+			log.Printf("PLG: %s denied %s: %s", p, name, response.Deny)
+			return "", false
+		case response.Relay:
+			ip = ""
+		case response.Answer != "":
+			ip = response.Answer
+		}
+	}
+	return ip, true
+}
+
+// Close stops the plugins.
+func (plugins Plugins) Close() {
+	for _, p := range plugins {
+		p.Close()
+	}
+}
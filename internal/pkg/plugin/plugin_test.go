@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake runs a plugin in process, which answers requests with respond.
+func fake(t *testing.T, respond func(Request) *Response) *Plugin {
+	requests, stdin := io.Pipe()
+	stdout, responses := io.Pipe()
+	go func() {
+		lines := bufio.NewScanner(requests)
+		encoder := json.NewEncoder(responses)
+		for lines.Scan() {
+			var request Request
+			if err := json.Unmarshal(lines.Bytes(), &request); err != nil {
+				t.Error(err)
+				continue
+			}
+			if response := respond(request); response != nil {
+				response.ID = request.ID
+				encoder.Encode(response)
+			}
+		}
+		responses.Close()
+	}()
+	p := newPlugin("fake", stdin, stdout)
+	if err := p.greet(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func guard(request Request) *Response {
+	switch request.Kind {
+	case "hello":
+		return &Response{Name: "prod-guard", Intercepts: true, Names: []string{"*.prod.svc.cluster.local", "api.corp.example"}}
+	case "intercept":
+		if request.Namespace == "prod" {
+			return &Response{Deny: "prod is never intercepted"}
+		}
+		if request.TTL == "" {
+			return &Response{TTL: "1h"}
+		}
+	case "dns":
+		switch request.Name {
+		case "api.corp.example":
+			return &Response{Answer: "10.0.0.5"}
+		case "db.prod.svc.cluster.local":
+			return &Response{Deny: "no"}
+		case "web.prod.svc.cluster.local":
+			return &Response{Relay: true}
+		}
+	}
+	return &Response{}
+}
+
+func TestPlugins(t *testing.T) {
+	p := fake(t, guard)
+	defer p.Close()
+	plugins := Plugins{p}
+
+	if _, err := plugins.Intercept("prod", "web", 80, 0); err == nil || !strings.Contains(err.Error(), "prod is never intercepted") {
+		t.Errorf("expected intercepting prod to be denied, got %v", err)
+	}
+	if ttl, err := plugins.Intercept("dev", "web", 80, 0); err != nil || ttl != time.Hour {
+		t.Errorf("expected intercepts of dev to last an hour, got %v, %v", ttl, err)
+	}
+	if ttl, err := plugins.Intercept("dev", "web", 80, time.Minute); err != nil || ttl != time.Minute {
+		t.Errorf("expected the ttl to be left alone, got %v, %v", ttl, err)
+	}
+
+	for _, c := range []struct {
+		name, ip, answer string
+		exists           bool
+	}{
+		{"api.corp.example.", "", "10.0.0.5", true},
+		{"db.prod.svc.cluster.local.", "10.96.0.11", "", false},
+		{"web.prod.svc.cluster.local.", "10.96.0.10", "", true},
+		{"cache.prod.svc.cluster.local.", "10.96.0.12", "10.96.0.12", true},
+		// not asked about
+		{"db.dev.svc.cluster.local.", "10.96.0.13", "10.96.0.13", true},
+	} {
+		if answer, exists := plugins.Answer(c.name, c.ip); answer != c.answer || exists != c.exists {
+			t.Errorf("expected %s to be %q, %v, got %q, %v", c.name, c.answer, c.exists, answer, exists)
+		}
+	}
+}
+
+func TestPluginFailures(t *testing.T) {
+	silent := func(failClosed bool) *Plugin {
+		return fake(t, func(request Request) *Response {
+			if request.Kind == "hello" {
+				return &Response{Intercepts: true, Names: []string{"*"}, FailClosed: failClosed}
+			}
+			return nil
+		})
+	}
+	open, closed := silent(false), silent(true)
+	defer open.Close()
+	defer closed.Close()
+
+	if _, err := (Plugins{open}).Intercept("dev", "web", 80, 0); err != nil {
+		t.Errorf("expected a plugin that doesn't respond to be passed over, got %v", err)
+	}
+	if _, err := (Plugins{closed}).Intercept("dev", "web", 80, 0); err == nil {
+		t.Errorf("expected a plugin that fails closed to deny")
+	}
+	if _, exists := (Plugins{closed}).Answer("web.", "10.96.0.10"); exists {
+		t.Errorf("expected a plugin that fails closed to deny")
+	}
+
+	dead := fake(t, guard)
+	dead.Close()
+	<-dead.done
+	if _, err := dead.ask(Request{Kind: "intercept"}); err == nil {
+		t.Errorf("expected asking a plugin that exited to fail")
+	}
+}
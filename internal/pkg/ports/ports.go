@@ -0,0 +1,180 @@
+// Package ports picks the local ports teleproxy listens on, so that
+// collisions with ports that are already in use are found before
+// anything starts rather than by a listener failing halfway through.
+package ports
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Range is an inclusive range of ports. The zero Range lets the
+// operating system choose.
+type Range struct {
+	Low  int
+	High int
+}
+
+// ParseRange parses a range of the form "low-high". The empty string
+// is the zero Range.
+func ParseRange(s string) (r Range, err error) {
+	if s == "" {
+		return
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) == 2 {
+		r.Low, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err == nil {
+			r.High, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		}
+	}
+	if len(parts) != 2 || err != nil || r.Low < 1 || r.High > 65535 || r.Low > r.High {
+		return Range{}, fmt.Errorf("invalid port range %q, expected low-high", s)
+	}
+	return r, nil
+}
+
+func (r Range) String() string {
+	if r.Low == 0 {
+		return "any"
+	}
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// A ConflictError reports that a port that had to be used is taken.
+type ConflictError struct {
+	Name string
+	Port int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("port %d for %s is already in use", e.Port, e.Name)
+}
+
+// Free reports whether nothing is listening on port, for each of the
+// given protocols ("tcp" or "udp").
+func Free(port int, protos ...string) bool {
+	address := ":" + strconv.Itoa(port)
+	for _, proto := range protos {
+		switch proto {
+		case "tcp":
+			ln, err := net.Listen("tcp", address)
+			if err != nil {
+				return false
+			}
+			ln.Close()
+		case "udp":
+			pc, err := net.ListenPacket("udp", address)
+			if err != nil {
+				return false
+			}
+			pc.Close()
+		default:
+			panic("unknown protocol: " + proto)
+		}
+	}
+	return true
+}
+
+// An Allocator hands out ports by name. The ports are only checked,
+// not held, so the caller needs to start listening promptly.
+type Allocator struct {
+	Range Range
+
+	mutex sync.Mutex
+	ports map[string]int
+	used  map[int]bool
+}
+
+// NewAllocator returns an allocator that picks ports from r when the
+// preferred ones are unavailable.
+func NewAllocator(r Range) *Allocator {
+	return &Allocator{
+		Range: r,
+		ports: make(map[string]int),
+		used:  make(map[int]bool),
+	}
+}
+
+func (a *Allocator) available(port int, protos []string) bool {
+	return !a.used[port] && Free(port, protos...)
+}
+
+func (a *Allocator) take(name string, port int) int {
+	a.ports[name] = port
+	a.used[port] = true
+	return port
+}
+
+// Require allocates exactly port, failing with a *ConflictError if it
+// is in use.
+func (a *Allocator) Require(name string, port int, protos ...string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.available(port, protos) {
+		return 0, &ConflictError{name, port}
+	}
+	return a.take(name, port), nil
+}
+
+// Allocate allocates the preferred port if it is free (and nonzero),
+// and otherwise a free port from the range.
+func (a *Allocator) Allocate(name string, preferred int, protos ...string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if preferred != 0 && a.available(preferred, protos) {
+		return a.take(name, preferred), nil
+	}
+	if a.Range.Low == 0 {
+		// the os only hands out ports that are free for one
+		// protocol, so try a few
+		for i := 0; i < 10; i++ {
+			ln, err := net.Listen("tcp", ":0")
+			if err != nil {
+				return 0, err
+			}
+			port := ln.Addr().(*net.TCPAddr).Port
+			ln.Close()
+			if a.available(port, protos) {
+				return a.take(name, port), nil
+			}
+		}
+	} else {
+		for port := a.Range.Low; port <= a.Range.High; port++ {
+			if a.available(port, protos) {
+				return a.take(name, port), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no free port for %s in range %s", name, a.Range)
+}
+
+// Ports returns the allocated ports by name.
+func (a *Allocator) Ports() map[string]int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := make(map[string]int, len(a.ports))
+	for name, port := range a.ports {
+		result[name] = port
+	}
+	return result
+}
+
+// String describes the allocations for logging.
+func (a *Allocator) String() string {
+	ports := a.Ports()
+	var names []string
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []string
+	for _, name := range names {
+		result = append(result, fmt.Sprintf("%s=%d", name, ports[name]))
+	}
+	return strings.Join(result, " ")
+}
@@ -0,0 +1,58 @@
+package ports
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	if r, err := ParseRange("20000-20010"); err != nil || r != (Range{20000, 20010}) {
+		t.Errorf("got %v, %v", r, err)
+	}
+	if r, err := ParseRange(""); err != nil || r != (Range{}) {
+		t.Errorf("got %v, %v", r, err)
+	}
+	for _, s := range []string{"20000", "2-1", "0-10", "a-b", "1-70000"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	taken := busy.Addr().(*net.TCPAddr).Port
+
+	a := NewAllocator(Range{})
+	if _, err := a.Require("socks", taken, "tcp"); err == nil {
+		t.Errorf("expected a conflict for port %d", taken)
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("expected a ConflictError, got %v", err)
+	}
+
+	port, err := a.Allocate("proxy", taken, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port == taken {
+		t.Errorf("allocated a port that is in use")
+	}
+
+	// a port that was handed out isn't handed out again
+	again, err := a.Allocate("dns", port, "tcp", "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == port {
+		t.Errorf("allocated port %d twice", port)
+	}
+
+	ports := a.Ports()
+	if len(ports) != 2 || ports["proxy"] != port || ports["dns"] != again {
+		t.Errorf("unexpected allocations: %v", ports)
+	}
+}
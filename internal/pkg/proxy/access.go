@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Entry of the access log describes one intercepted connection,
+// once it is closed.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Client is the address the connection came from, and PID and
+	// Process the local process that made it, if it can be found.
+	Client  string `json:"client"`
+	PID     int    `json:"pid,omitempty"`
+	Process string `json:"process,omitempty"`
+	// Destination is where the connection was headed, as far as
+	// the firewall knows, and Service whose address that is.
+	// Target is where it was relayed to, if that differs, e.g. by
+	// its Host header.
+	Destination string `json:"destination,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+	// Seconds is how long the connection lasted, and Outcome why
+	// it ended, "closed" unless something went wrong.
+	Seconds float64 `json:"seconds"`
+	Outcome string  `json:"outcome"`
+}
+
+func (e Entry) String() string {
+	s := fmt.Sprintf("%s client=%s", e.Time.Format(time.RFC3339), e.Client)
+	if e.PID != 0 {
+		s += fmt.Sprintf(" pid=%d process=%q", e.PID, e.Process)
+	}
+	if e.Destination != "" {
+		s += " destination=" + e.Destination
+	}
+	if e.Service != "" {
+		s += " service=" + e.Service
+	}
+	if e.Target != "" {
+		s += " target=" + e.Target
+	}
+	return s + fmt.Sprintf(" sent=%d received=%d duration=%.3fs outcome=%q", e.Sent, e.Received, e.Seconds, e.Outcome)
+}
+
+// ParseEntry parses a line of the access log, a json object or a line
+// of text as String writes it.
+func ParseEntry(line string) (Entry, error) {
+	var e Entry
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		err := json.Unmarshal([]byte(line), &e)
+		return e, err
+	}
+	space := strings.IndexByte(line, ' ')
+	if space < 0 {
+		return e, fmt.Errorf("access log line %q has no fields", line)
+	}
+	var err error
+	if e.Time, err = time.Parse(time.RFC3339, line[:space]); err != nil {
+		return e, err
+	}
+	for rest := strings.TrimLeft(line[space:], " "); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return e, fmt.Errorf("access log field %q is not key=value", rest)
+		}
+		key, value := rest[:eq], rest[eq+1:]
+		if strings.HasPrefix(value, `"`) {
+			end := quoteEnd(value)
+			if end < 0 {
+				return e, fmt.Errorf("access log field %s is not quoted properly", key)
+			}
+			if value, err = strconv.Unquote(value[:end]); err != nil {
+				return e, fmt.Errorf("access log field %s: %v", key, err)
+			}
+			rest = rest[eq+1+end:]
+		} else {
+			if space := strings.IndexByte(value, ' '); space >= 0 {
+				value = value[:space]
+			}
+			rest = rest[eq+1+len(value):]
+		}
+		switch key {
+		case "client":
+			e.Client = value
+		case "pid":
+			e.PID, err = strconv.Atoi(value)
+		case "process":
+			e.Process = value
+		case "destination":
+			e.Destination = value
+		case "service":
+			e.Service = value
+		case "target":
+			e.Target = value
+		case "sent":
+			e.Sent, err = strconv.ParseUint(value, 10, 64)
+		case "received":
+			e.Received, err = strconv.ParseUint(value, 10, 64)
+		case "duration":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil {
+				e.Seconds = d.Seconds()
+			}
+		case "outcome":
+			e.Outcome = value
+		}
+		if err != nil {
+			return e, fmt.Errorf("access log field %s: %v", key, err)
+		}
+	}
+	return e, nil
+}
+
+// quoteEnd returns the length of the quoted string s starts with, or
+// -1 if it isn't closed.
+func quoteEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+type accessLog struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	json    bool
+	service func(host string) string
+}
+
+func (a *accessLog) write(e Entry) {
+	var line []byte
+	if a.json {
+		line, _ = json.Marshal(e)
+	} else {
+		line = []byte(e.String())
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.w.Write(append(line, '\n'))
+}
+
+// SetAccessLog makes the proxy write an entry to w for every
+// connection, as a line of text or a json object. Service names the
+// destination of a connection, as in "hello.default" for the address
+// of that service, or returns "" if it doesn't know it. It must be
+// invoked before Start.
+func (p *Proxy) SetAccessLog(w io.Writer, asJSON bool, service func(host string) string) {
+	p.access = &accessLog{w: w, json: asJSON, service: service}
+}
+
+// A connection is what the access log notes about a connection as it
+// is relayed.
+type connection struct {
+	p     *Proxy
+	start time.Time
+	mutex sync.Mutex
+	entry Entry
+	// tee, if not nil, gets a copy of what the client sends
+	tee func([]byte)
+}
+
+// open notes a connection accepted. Finding the process that made it
+// takes a walk through the fds of every process, so it is only looked
+// for with the access log on.
+func (p *Proxy) open(conn *net.TCPConn) *connection {
+	c := &connection{p: p, start: time.Now()}
+	c.entry.Client = conn.RemoteAddr().String()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && p.access != nil {
+		c.entry.PID, c.entry.Process = owner(addr)
+	}
+	return c
+}
+
+func (c *connection) headed(destination string) {
+	c.entry.Destination = destination
+	if c.entry.Process != "" {
+		c.p.usage.attribute(c.entry.Process, c.entry.PID, destination)
+	}
+	if c.p.access != nil && c.p.access.service != nil {
+		c.entry.Service = c.p.access.service(destination)
+	}
+}
+
+func (c *connection) relayed(target string) {
+	if target != c.entry.Destination {
+		c.entry.Target = target
+	}
+}
+
+// counter returns what the relay to or from target adds to, which
+// counts towards the usage too.
+func (c *connection) counter(target string, sent bool) func(int) {
+	usage := c.p.usage.counter(target, sent)
+	process := func(int) {}
+	if c.entry.Process != "" {
+		process = c.p.usage.processCounter(c.entry.Process, sent)
+	}
+	return func(n int) {
+		usage(n)
+		process(n)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if sent {
+			c.entry.Sent += uint64(n)
+		} else {
+			c.entry.Received += uint64(n)
+		}
+	}
+}
+
+// fail notes why the connection ended, unless that is known already.
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entry.Outcome == "" {
+		c.entry.Outcome = err.Error()
+	}
+}
+
+func (c *connection) close() {
+	if c.p.access == nil {
+		return
+	}
+	c.mutex.Lock()
+	e := c.entry
+	c.mutex.Unlock()
+	e.Time = c.start
+	e.Seconds = time.Since(c.start).Seconds()
+	if e.Outcome == "" {
+		e.Outcome = "closed"
+	}
+	c.p.access.write(e)
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// responses bigger than this are relayed, not cached
+	maxCachedBody = 1 << 20
+	// what all the cached responses may add up to
+	maxCacheSize = 64 << 20
+)
+
+// CacheHTTP caches responses to GET requests for the hosts that match,
+// on the ports that RouteHTTP routes, so that the same requests over
+// and over, e.g. from a hot reloading frontend, don't each go through
+// the tunnel. A response is cached for as long as its Cache-Control
+// max-age says or, without one, for ttl, if that isn't zero. Requests
+// that ask for a fresh response (as a browser's reload does), or that
+// carry credentials, go to the backend. It must be invoked before
+// Start.
+func (p *Proxy) CacheHTTP(match func(host string) bool, ttl time.Duration) {
+	p.cache = &httpCache{
+		match:   match,
+		ttl:     ttl,
+		entries: make(map[string]*cachedResponse),
+		stats:   make(map[string]*CacheStats),
+	}
+}
+
+// CacheStats counts how the requests for a host were answered.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Bypassed requests couldn't be answered from the cache at all,
+	// e.g. POSTs.
+	Bypassed uint64 `json:"bypassed"`
+	// HitRate is the share of the requests that could have been
+	// answered from the cache that were.
+	HitRate float64 `json:"hit_rate"`
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+type httpCache struct {
+	match func(string) bool
+	ttl   time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*cachedResponse
+	// order has the keys of entries, oldest first
+	order []string
+	size  int
+	stats map[string]*CacheStats
+}
+
+func (h *httpCache) caches(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return h.match(host)
+}
+
+func (h *httpCache) count(host string, f func(*CacheStats)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.stats[host]
+	if !ok {
+		s = &CacheStats{}
+		h.stats[host] = s
+	}
+	f(s)
+}
+
+func (h *httpCache) report() map[string]CacheStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	result := make(map[string]CacheStats, len(h.stats))
+	for host, s := range h.stats {
+		r := *s
+		if r.Hits+r.Misses > 0 {
+			r.HitRate = float64(r.Hits) / float64(r.Hits+r.Misses)
+		}
+		result[host] = r
+	}
+	return result
+}
+
+// cacheKey identifies what a GET request asks for. Only the encoding
+// of a response is allowed to vary, so it is part of the key.
+func cacheKey(req *http.Request, target string) string {
+	return target + " " + req.URL.RequestURI() + " " + req.Header.Get("Accept-Encoding")
+}
+
+func (h *httpCache) lookup(key string) *cachedResponse {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e, ok := h.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		h.remove(key)
+		return nil
+	}
+	return e
+}
+
+func (h *httpCache) store(e *cachedResponse) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.remove(e.key)
+	h.entries[e.key] = e
+	h.order = append(h.order, e.key)
+	h.size += len(e.body)
+	for h.size > maxCacheSize && len(h.order) > 0 {
+		h.remove(h.order[0])
+	}
+}
+
+// remove forgets the response for key. The caller holds the mutex.
+func (h *httpCache) remove(key string) {
+	e, ok := h.entries[key]
+	if !ok {
+		return
+	}
+	h.size -= len(e.body)
+	delete(h.entries, key)
+	for i, k := range h.order {
+		if k == key {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// cacheable reports whether a request could be answered from the
+// cache, and whether it may be answered with something cached, which
+// it can't when it asks for a fresh response.
+func cacheable(req *http.Request) (cacheable, fromCache bool) {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return false, false
+	}
+	for _, directive := range directives(req.Header) {
+		if directive == "no-cache" || directive == "no-store" || directive == "max-age=0" {
+			return true, false
+		}
+	}
+	return true, req.Header.Get("Pragma") != "no-cache"
+}
+
+// freshFor returns how long resp may be cached for, if at all.
+func freshFor(resp *http.Response, ttl time.Duration) time.Duration {
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	for _, vary := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if vary = strings.TrimSpace(vary); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+			return 0
+		}
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	for _, directive := range directives(resp.Header) {
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return ttl
+}
+
+func directives(header http.Header) (result []string) {
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			if directive = strings.ToLower(strings.TrimSpace(directive)); directive != "" {
+				result = append(result, directive)
+			}
+		}
+	}
+	return
+}
+
+// handleCached answers the requests on conn, the first of which is req
+// and the rest of which are still to be read from br, from the cache
+// where possible. Misses go to target, over a connection of their own.
+func (p *Proxy) handleCached(c *connection, conn *net.TCPConn, br *bufio.Reader, req *http.Request, target string) {
+	p.log("CONNECT %s %s (http %s, cached)", conn.RemoteAddr(), c.entry.Destination, target)
+	c.relayed(target)
+	defer conn.Close()
+
+	var upstream *net.TCPConn
+	var ur *bufio.Reader
+	defer func() {
+		if upstream != nil {
+			upstream.Close()
+		}
+	}()
+	sent, received := c.counter(target, true), c.counter(target, false)
+
+	for {
+		ok, fromCache := cacheable(req)
+		key := cacheKey(req, target)
+		if fromCache {
+			if e := p.cache.lookup(key); e != nil {
+				p.cache.count(target, func(s *CacheStats) { s.Hits++ })
+				if err := e.response(req).Write(conn); err != nil {
+					c.fail(err)
+					return
+				}
+				if req.Close {
+					return
+				}
+				var err error
+				if req, err = http.ReadRequest(br); err != nil {
+					return
+				}
+				continue
+			}
+		}
+		p.cache.count(target, func(s *CacheStats) {
+			if ok {
+				s.Misses++
+			} else {
+				s.Bypassed++
+			}
+		})
+
+		if upstream == nil {
+			var err error
+			if upstream, err = p.dial(target); err != nil {
+				p.dialFailed(err)
+				c.fail(err)
+				unreachable(conn, target, err)
+				return
+			}
+			ur = bufio.NewReader(io.TeeReader(upstream, countingWriter{ioutil.Discard, received}))
+		}
+		if err := req.Write(countingWriter{upstream, sent}); err != nil {
+			p.log(err.Error())
+			c.fail(err)
+			return
+		}
+		if req.Header.Get("Upgrade") != "" {
+			// websockets, e.g. for hot reloading, are relayed
+			// as is from here on
+			p.upgrade(c, conn, br, upstream, ur, target)
+			return
+		}
+		resp, err := http.ReadResponse(ur, req)
+		if err != nil {
+			p.log(err.Error())
+			c.fail(err)
+			return
+		}
+		if err := p.cache.relay(resp, key, ok, conn); err != nil {
+			c.fail(err)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+		if req, err = http.ReadRequest(br); err != nil {
+			return
+		}
+	}
+}
+
+// relay writes resp to conn, caching it if it may be.
+func (h *httpCache) relay(resp *http.Response, key string, mayCache bool, conn io.Writer) error {
+	defer resp.Body.Close()
+	fresh := time.Duration(0)
+	if mayCache {
+		fresh = freshFor(resp, h.ttl)
+	}
+	if fresh <= 0 || resp.ContentLength > maxCachedBody {
+		return resp.Write(conn)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxCachedBody {
+		// too big after all, relay the rest
+		resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body))
+		return resp.Write(conn)
+	}
+	now := time.Now()
+	e := &cachedResponse{key: key, status: resp.StatusCode, header: resp.Header, body: body, stored: now, expires: now.Add(fresh)}
+	h.store(e)
+	return e.response(resp.Request).Write(conn)
+}
+
+func (e *cachedResponse) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(e.header)+1)
+	for name, values := range e.header {
+		header[name] = values
+	}
+	// the body was read whole, however it came
+	header.Del("Transfer-Encoding")
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	return &http.Response{
+		StatusCode:    e.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+		Close:         req.Close,
+	}
+}
+
+// upgrade relays an upgraded connection, after the request for it was
+// sent upstream. Whatever was read ahead on either side goes first.
+func (p *Proxy) upgrade(c *connection, conn *net.TCPConn, br *bufio.Reader, upstream *net.TCPConn, ur *bufio.Reader, target string) {
+	if err := flush(br, countingWriter{upstream, c.counter(target, true)}); err != nil {
+		c.fail(err)
+		return
+	}
+	// ur counts what it reads already
+	if err := flush(ur, conn); err != nil {
+		c.fail(err)
+		return
+	}
+	p.relay(c, conn, upstream, target, c.counter(target, true))
+}
+
+func flush(r *bufio.Reader, w io.Writer) error {
+	if n := r.Buffered(); n > 0 {
+		buffered, _ := r.Peek(n)
+		_, err := w.Write(buffered)
+		return err
+	}
+	return nil
+}
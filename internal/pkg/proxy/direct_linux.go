@@ -0,0 +1,32 @@
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// directDialer returns a dial that marks its sockets with mark, so
+// that the firewall lets them through unredirected.
+func directDialer(mark int) func(host string) (*net.TCPConn, error) {
+	dialer := net.Dialer{
+		Timeout: directTimeout,
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return func(host string) (*net.TCPConn, error) {
+		conn, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// directDialer would return a dial that bypasses the firewall, but pf
+// can't tell our sockets apart, so every direct dial would just come
+// back to us.
+func directDialer(mark int) func(host string) (*net.TCPConn, error) {
+	return func(host string) (*net.TCPConn, error) {
+		return nil, errors.New("dialing directly is only supported on linux")
+	}
+}
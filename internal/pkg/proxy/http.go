@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how long a client gets to send the request head
+const headerTimeout = 10 * time.Second
+
+// RouteHTTP makes connections originally destined to the given ports
+// be parsed as HTTP and relayed by their Host header instead of their
+// destination address: names resolve through the tunnel, i.e. in the
+// cluster. This lets several virtual services share an address, and
+// gets clients an error page rather than a reset when the backend is
+// unreachable. It must be invoked before Start.
+//
+// Only the first request of a connection is looked at, so a
+// connection stays with the backend it started with. Clients only
+// reuse connections for the same host, so in practice this doesn't
+// matter.
+func (p *Proxy) RouteHTTP(ports []int) {
+	p.http = make(map[string]bool)
+	for _, port := range ports {
+		p.http[strconv.Itoa(port)] = true
+	}
+}
+
+func (p *Proxy) routesHTTP(host string) bool {
+	_, port, err := net.SplitHostPort(host)
+	return err == nil && p.http[port]
+}
+
+// handleHTTP relays conn, which was headed for host, to wherever the
+// Host header of its first request says. Anything that doesn't parse
+// as HTTP goes to host as usual.
+func (p *Proxy) handleHTTP(c *connection, conn *net.TCPConn, host string) {
+	// keep everything read, so that it can be replayed to the
+	// backend verbatim
+	var head bytes.Buffer
+	rec := &recorder{r: conn, kept: &head}
+	br := bufio.NewReader(rec)
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := http.ReadRequest(br)
+	conn.SetReadDeadline(time.Time{})
+
+	target := host
+	if err != nil {
+		p.log("not http, relaying to %s: %v", host, err)
+	} else if req.Host != "" {
+		target = req.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			_, port, _ := net.SplitHostPort(host)
+			target = net.JoinHostPort(target, port)
+		}
+	}
+
+	if req != nil && p.cache != nil && p.cache.caches(target) {
+		// requests are parsed one by one from here on, so nothing
+		// needs replaying
+		rec.kept = nil
+		p.handleCached(c, conn, br, req, target)
+		return
+	}
+
+	p.log("CONNECT %s %s (http %s)", conn.RemoteAddr(), host, target)
+	c.relayed(target)
+	upstream, err := p.dial(target)
+	if err != nil {
+		p.log(err.Error())
+		c.fail(err)
+		if req != nil {
+			unreachable(conn, target, err)
+		}
+		conn.Close()
+		return
+	}
+
+	p.replay(c, conn, upstream, target, head.Bytes())
+}
+
+// replay sends upstream what was already read from conn, then relays
+// the rest.
+func (p *Proxy) replay(c *connection, conn, upstream *net.TCPConn, target string, head []byte) {
+	sent := c.counter(target, true)
+	if _, err := (countingWriter{upstream, sent}).Write(head); err != nil {
+		p.log(err.Error())
+		c.fail(err)
+		upstream.Close()
+		conn.Close()
+		return
+	}
+
+	p.relay(c, conn, upstream, target, sent)
+}
+
+// A recorder keeps what is read through it, until kept is cleared.
+type recorder struct {
+	r    io.Reader
+	kept *bytes.Buffer
+}
+
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.kept != nil {
+		r.kept.Write(b[:n])
+	}
+	return n, err
+}
+
+// unreachable sends an error page for a backend that couldn't be
+// reached.
+func unreachable(conn *net.TCPConn, target string, err error) {
+	body := fmt.Sprintf("teleproxy could not reach %s: %v\n", target, err)
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		http.StatusBadGateway, http.StatusText(http.StatusBadGateway), len(body), body)
+}
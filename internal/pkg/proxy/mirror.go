@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+const (
+	// how long connecting to a mirror may take before the connection
+	// goes ahead without it
+	mirrorDial = time.Second
+	// how many reads a mirror may fall behind before it is dropped,
+	// rather than hold up what it mirrors
+	mirrorBacklog = 256
+)
+
+// Mirror copies what is sent to port of service, "namespace/service",
+// to local as well, e.g. "localhost:8080", which is how something
+// local can see real traffic before it is swapped in. The service
+// still gets the traffic and answers it, what local answers is
+// discarded. Mirrored connections are relayed as they are, without
+// routing http by Host or terminating tls. It may be invoked at any
+// time, and affects connections made after.
+func (p *Proxy) Mirror(service string, port int, local string) {
+	p.mirrorsMutex.Lock()
+	defer p.mirrorsMutex.Unlock()
+	if p.mirrors == nil {
+		p.mirrors = make(map[string]string)
+	}
+	p.mirrors[service+":"+strconv.Itoa(port)] = local
+}
+
+// Unmirror stops copying what is sent to port of service.
+func (p *Proxy) Unmirror(service string, port int) {
+	p.mirrorsMutex.Lock()
+	defer p.mirrorsMutex.Unlock()
+	delete(p.mirrors, service+":"+strconv.Itoa(port))
+}
+
+// mirrorOf returns where what is sent to host is mirrored, if at all.
+func (p *Proxy) mirrorOf(host string) string {
+	ip, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return ""
+	}
+	name := route.NameOf(ip)
+	if name == "" {
+		return ""
+	}
+	p.mirrorsMutex.Lock()
+	defer p.mirrorsMutex.Unlock()
+	return p.mirrors[name+":"+port]
+}
+
+func (p *Proxy) handleMirrored(c *connection, conn *net.TCPConn, host, local string) {
+	p.log("CONNECT %s %s (mirrored to %s)", conn.RemoteAddr(), host, local)
+
+	upstream, err := p.dial(host)
+	if err != nil {
+		p.dialFailed(err)
+		c.fail(err)
+		conn.Close()
+		return
+	}
+
+	if m, err := dialMirror(local); err != nil {
+		p.log("not mirroring %s: %v", host, err)
+	} else {
+		defer m.close()
+		c.tee = m.send
+	}
+	p.relay(c, conn, upstream, host, c.counter(host, true))
+}
+
+// A mirror writes what it is sent to a connection in the background,
+// and discards whatever comes back.
+type mirror struct {
+	conn    net.Conn
+	queue   chan []byte
+	dropped bool
+}
+
+func dialMirror(local string) (*mirror, error) {
+	conn, err := net.DialTimeout("tcp", local, mirrorDial)
+	if err != nil {
+		return nil, err
+	}
+	m := &mirror{conn: conn, queue: make(chan []byte, mirrorBacklog)}
+	go io.Copy(ioutil.Discard, conn)
+	go func() {
+		defer conn.Close()
+		for data := range m.queue {
+			if _, err := conn.Write(data); err != nil {
+				conn.Close()
+				// drain the rest
+				for range m.queue {
+				}
+				return
+			}
+		}
+	}()
+	return m, nil
+}
+
+// send queues a copy of data. A mirror that can't keep up is dropped.
+// It must not be invoked after close.
+func (m *mirror) send(data []byte) {
+	if m.dropped {
+		return
+	}
+	select {
+	case m.queue <- append([]byte(nil), data...):
+	default:
+		m.dropped = true
+		close(m.queue)
+	}
+}
+
+func (m *mirror) close() {
+	if !m.dropped {
+		m.dropped = true
+		close(m.queue)
+	}
+}
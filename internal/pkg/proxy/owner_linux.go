@@ -0,0 +1,146 @@
+// +build linux
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// owner returns the pid and the name of the local process with the tcp
+// socket at addr, or 0 if there is none, e.g. for connections from
+// containers, whose sockets are in other network namespaces.
+func owner(addr *net.TCPAddr) (int, string) {
+	inode := ""
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode = socketInode(table, addr); inode != "" {
+			break
+		}
+	}
+	if inode == "" {
+		return 0, ""
+	}
+
+	pid := socketOwner(inode)
+	if pid == 0 {
+		return 0, ""
+	}
+	comm, _ := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	return pid, strings.TrimSpace(string(comm))
+}
+
+// sockets are the pids owning each socket inode, as of the last walk
+// through the fds of every process, which started at walked. A walk
+// started after a connection was asked about answers for it, and
+// connections that come while one is under way wait for it and share
+// the next one, rather than each making its own.
+var sockets struct {
+	sync.Mutex
+	owners  map[string]int
+	walked  time.Time
+	walking chan struct{}
+}
+
+// walk is where socketOwner gets the pids owning each socket inode.
+var walk = walkSockets
+
+// socketOwner returns the pid of the process with the socket inode
+// open, or 0 if none has.
+func socketOwner(inode string) int {
+	asked := time.Now()
+	for {
+		sockets.Lock()
+		if pid, ok := sockets.owners[inode]; ok {
+			sockets.Unlock()
+			return pid
+		}
+		if sockets.walked.After(asked) {
+			sockets.Unlock()
+			return 0
+		}
+		if walking := sockets.walking; walking != nil {
+			sockets.Unlock()
+			<-walking
+			continue
+		}
+		walking := make(chan struct{})
+		sockets.walking = walking
+		sockets.Unlock()
+
+		started := time.Now()
+		owners := walk()
+		sockets.Lock()
+		sockets.owners, sockets.walked, sockets.walking = owners, started, nil
+		sockets.Unlock()
+		close(walking)
+		return owners[inode]
+	}
+}
+
+// walkSockets returns the pid owning each socket inode, from the fds
+// of every process.
+func walkSockets() map[string]int {
+	owners := make(map[string]int)
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.Split(fd, "/")[2])
+		owners[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] = pid
+	}
+	return owners
+}
+
+// socketInode returns the inode of the socket bound to addr in table,
+// one of the /proc/net/tcp files.
+func socketInode(table string, addr *net.TCPAddr) string {
+	f, err := os.Open(table)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if local, ok := parseProcAddr(fields[1]); ok && local.Port == addr.Port && local.IP.Equal(addr.IP) {
+			return fields[9]
+		}
+	}
+	return ""
+}
+
+// parseProcAddr parses an address as /proc/net/tcp has them, e.g.
+// 0100007F:1F90 for 127.0.0.1:8080. The ip is in 32 bit words of host
+// byte order, which is little endian everywhere teleproxy runs.
+func parseProcAddr(s string) (*net.TCPAddr, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, false
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, false
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, true
+}
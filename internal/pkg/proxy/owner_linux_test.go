@@ -0,0 +1,71 @@
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOwner(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if pid, _ := owner(conn.LocalAddr().(*net.TCPAddr)); pid != os.Getpid() {
+		t.Errorf("expected the connection to be ours, got pid %d", pid)
+	}
+}
+
+func TestSocketOwnerSharesWalks(t *testing.T) {
+	defer func(w func() map[string]int) { walk = w }(walk)
+	var mutex sync.Mutex
+	walks := 0
+	release := make(chan struct{})
+	walk = func() map[string]int {
+		mutex.Lock()
+		walks++
+		mutex.Unlock()
+		<-release
+		return map[string]int{"1": 42}
+	}
+
+	// the first asks for a walk, and the rest wait for the next one
+	// without holding up anything else
+	var wg sync.WaitGroup
+	pids := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pids <- socketOwner("1")
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	sockets.Lock()
+	walking := sockets.walking != nil
+	sockets.Unlock()
+	if !walking {
+		t.Fatal("expected a walk under way, without the lock held")
+	}
+	close(release)
+	wg.Wait()
+	close(pids)
+	for pid := range pids {
+		if pid != 42 {
+			t.Errorf("expected 42, got %d", pid)
+		}
+	}
+	if walks > 2 {
+		t.Errorf("expected the lookups to share walks, got %d", walks)
+	}
+}
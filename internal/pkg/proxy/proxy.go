@@ -1,30 +1,67 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/shaping"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
 	"github.com/datawire/teleproxy/pkg/tpu"
 	"golang.org/x/net/proxy"
 )
 
 type Proxy struct {
 	listener net.Listener
+	socks    string
 	router   func(*net.TCPConn) (string, error)
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// active counts the connections being relayed
+	active   int64
+	usage    *Usage
+	access   *accessLog
+	warm     *warm
+	race     *race
+	cache    *httpCache
+	timeouts *timeouts.Table
+	shaping  *shaping.Table
+	hush     hush
+	// mirrors are where what is sent to "namespace/service:port" is
+	// copied to
+	mirrorsMutex sync.Mutex
+	mirrors      map[string]string
+	splitsMutex  sync.Mutex
+	splits       map[string]Split
+	// http lists the original ports routed by Host header
+	http map[string]bool
+	// tls lists the original ports where tls may be terminated
+	tls            map[string]bool
+	tlsMatch       func(string) bool
+	tlsCertificate func(string) (*tls.Certificate, error)
 }
 
-func NewProxy(address string, router func(*net.TCPConn) (string, error)) (proxy *Proxy, err error) {
+// NewProxy listens on address and relays every connection it accepts
+// to the destination returned by router, by way of the SOCKS5 proxy
+// at socks.
+func NewProxy(address, socks string, router func(*net.TCPConn) (string, error)) (proxy *Proxy, err error) {
 	tpu.Rlimit()
-	ln, err := net.Listen("tcp", ":1234")
+	ln, err := net.Listen("tcp", address)
 	if err == nil {
-		proxy = &Proxy{ln, router}
+		proxy = &Proxy{listener: ln, socks: socks, router: router, stopped: make(chan struct{}), usage: newUsage()}
 	}
 	return
 }
 
 func (p *Proxy) log(line string, args ...interface{}) {
-	log.Printf("PXY: "+line+"\n", args...)
+	log.Print(route.Annotate(fmt.Sprintf("PXY: "+line+"\n", args...)))
 }
 
 func (p *Proxy) Start(limit int) {
@@ -34,6 +71,11 @@ func (p *Proxy) Start(limit int) {
 		for {
 			conn, err := p.listener.Accept()
 			if err != nil {
+				select {
+				case <-p.stopped:
+					return
+				default:
+				}
 				p.log(err.Error())
 			} else {
 				switch conn := conn.(type) {
@@ -52,42 +94,201 @@ func (p *Proxy) Start(limit int) {
 	}()
 }
 
+// Report returns the counts of what the proxy relayed, and of how
+// the cache did, if any.
+func (p *Proxy) Report() Report {
+	r := p.usage.Report()
+	if p.cache != nil {
+		r.Cache = p.cache.report()
+	}
+	return r
+}
+
+// Usage returns the counts of what the proxy relays.
+func (p *Proxy) Usage() *Usage {
+	return p.usage
+}
+
+// Stop closes the listener. Connections that are already being relayed
+// are unaffected. It is safe to invoke more than once.
+func (p *Proxy) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+		p.listener.Close()
+		if p.warm != nil {
+			p.warm.close()
+		}
+	})
+}
+
+// Active returns how many connections are being relayed.
+func (p *Proxy) Active() int {
+	return int(atomic.LoadInt64(&p.active))
+}
+
+// Drain stops the proxy and waits up to timeout for the connections it
+// relays to finish, returning how many are left.
+func (p *Proxy) Drain(timeout time.Duration) int {
+	p.Stop()
+	deadline := time.Now().Add(timeout)
+	for p.Active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return p.Active()
+}
+
 func (p *Proxy) handleConnection(conn *net.TCPConn) {
+	atomic.AddInt64(&p.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+	p.usage.connected()
+	c := p.open(conn)
+	defer c.close()
+
 	host, err := p.router(conn)
 	if err != nil {
 		p.log("router error: %v", err)
+		c.fail(err)
+		conn.Close()
+		return
+	}
+	c.headed(host)
+
+	// connections that weren't redirected to us by the firewall
+	// would otherwise make us an open relay into the cluster
+	if host == conn.LocalAddr().String() {
+		p.log("rejecting direct connection from %s", conn.RemoteAddr())
+		c.fail(errors.New("rejected direct connection"))
+		conn.Close()
+		return
+	}
+
+	if local := p.mirrorOf(host); local != "" {
+		p.handleMirrored(c, conn, host, local)
+		return
+	}
+	if s, ok := p.splitOf(host); ok {
+		if s.Header != "" {
+			p.handleSelected(c, conn, host, s)
+			return
+		}
+		if p.handleLocal(c, conn, host, s.Local) {
+			return
+		}
+	}
+	if p.terminatesTLS(host) {
+		p.handleTLS(c, conn, host)
+		return
+	}
+	if p.routesHTTP(host) {
+		p.handleHTTP(c, conn, host)
 		return
 	}
 
 	p.log("CONNECT %s %s", conn.RemoteAddr(), host)
 
-	// setting up an ssh tunnel with dynamic socks proxy at this end
-	// seems faster than connecting directly to a socks proxy
-	dialer, err := proxy.SOCKS5("tcp", "localhost:1080", nil, proxy.Direct)
-	//	dialer, err := proxy.SOCKS5("tcp", "localhost:9050", nil, proxy.Direct)
+	proxy, err := p.dial(host)
 	if err != nil {
-		p.log(err.Error())
+		p.dialFailed(err)
+		c.fail(err)
 		conn.Close()
 		return
 	}
 
-	_proxy, err := dialer.Dial("tcp", host)
-	if err != nil {
-		p.log(err.Error())
-		conn.Close()
+	p.relay(c, conn, proxy, host, c.counter(host, true))
+}
+
+type hush struct {
+	mutex      sync.Mutex
+	until      time.Time
+	suppressed int
+}
+
+// Hush stops logging each connection that fails to get through for d,
+// e.g. while the tunnel is known to be reconnecting, and just counts
+// them. Hushing for 0 ends it early. Either way the count is logged
+// once it ends.
+func (p *Proxy) Hush(d time.Duration) {
+	p.hush.mutex.Lock()
+	defer p.hush.mutex.Unlock()
+	p.hush.until = time.Now().Add(d)
+	if d <= 0 {
+		p.hushed()
+	}
+}
+
+// hushed logs what was suppressed, if anything. The caller holds the
+// mutex.
+func (p *Proxy) hushed() {
+	if p.hush.suppressed > 0 {
+		p.log("%d connections failed while reconnecting", p.hush.suppressed)
+		p.hush.suppressed = 0
+	}
+}
+
+func (p *Proxy) dialFailed(err error) {
+	p.hush.mutex.Lock()
+	defer p.hush.mutex.Unlock()
+	if time.Now().Before(p.hush.until) {
+		p.hush.suppressed++
 		return
 	}
-	proxy := _proxy.(*net.TCPConn)
+	p.hushed()
+	p.log(err.Error())
+}
+
+// dial connects to host through the tunnel, or directly if that is
+// faster.
+func (p *Proxy) dial(host string) (*net.TCPConn, error) {
+	if p.race == nil {
+		return p.forward(host)
+	}
+	conn, direct, err := p.race.dial(host, p.forward)
+	if err == nil && direct {
+		p.log("DIRECT %s", host)
+	}
+	return conn, err
+}
 
-	done := tpu.NewLatch(2)
+// forward connects to host through the tunnel, or hands out the warm
+// connection to it.
+func (p *Proxy) forward(host string) (*net.TCPConn, error) {
+	if p.warm != nil {
+		if conn := p.warm.take(host); conn != nil {
+			return conn, nil
+		}
+	}
+	return p.tunnel(host)
+}
 
-	go p.pipe(conn, proxy, done)
-	go p.pipe(proxy, conn, done)
+// tunnel connects to host through the tunnel.
+func (p *Proxy) tunnel(host string) (*net.TCPConn, error) {
+	// setting up an ssh tunnel with dynamic socks proxy at this end
+	// seems faster than connecting directly to a socks proxy
+	var forward proxy.Dialer = proxy.Direct
+	timeout := p.timeouts.Dial(host, 0)
+	if timeout > 0 {
+		forward = deadline(timeout)
+	}
+	dialer, err := proxy.SOCKS5("tcp", p.socks, nil, forward)
+	//	dialer, err := proxy.SOCKS5("tcp", "localhost:9050", nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
 
-	done.Wait()
+	conn, err := dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return conn.(*net.TCPConn), nil
 }
 
-func (p *Proxy) pipe(from, to *net.TCPConn, done tpu.Latch) {
+// pipe copies from one side to the other, adding what it copies to
+// count, and telling fail what went wrong, if anything. Unless tee is
+// nil, it gets a look at what is copied too.
+func (p *Proxy) pipe(from, to *net.TCPConn, done tpu.Latch, count func(int), fail func(error), tee func([]byte)) {
 	defer func() {
 		p.log("CLOSED WRITE %v", to.RemoteAddr())
 		to.CloseWrite()
@@ -105,13 +306,19 @@ func (p *Proxy) pipe(from, to *net.TCPConn, done tpu.Latch) {
 		if err != nil {
 			if err != io.EOF {
 				p.log(err.Error())
+				fail(err)
 			}
 			break
 		} else {
 			_, err := to.Write(buf[0:n])
+			count(n)
+			if tee != nil {
+				tee(buf[0:n])
+			}
 
 			if err != nil {
 				p.log(err.Error())
+				fail(err)
 				break
 			}
 		}
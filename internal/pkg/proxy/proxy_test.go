@@ -0,0 +1,984 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/shaping"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+	"github.com/datawire/teleproxy/internal/pkg/tlsterm"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the proxy logs every connection, which drowns out the
+	// benchmark results
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestSelfTest(t *testing.T) {
+	m, err := SelfTest(1024, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RoundTrips == 0 {
+		t.Errorf("no round trips: %v", m)
+	}
+}
+
+func TestRouteHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.Host)
+	}))
+	defer backend.Close()
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	// the original destination is never dialed when there is a
+	// Host header
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return "192.0.2.1:80", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.RouteHTTP([]int{80})
+	p.Start(10)
+	defer p.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", p.listener.Addr().String())
+		},
+	}}
+
+	host := backend.Listener.Addr().String()
+	resp, err := client.Get("http://" + host + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from "+host {
+		t.Errorf("expected the backend, got %s: %q", resp.Status, body)
+	}
+
+	// nothing listens on port 1
+	resp, err = client.Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || !bytes.Contains(body, []byte("127.0.0.1:1")) {
+		t.Errorf("expected an error page, got %s: %q", resp.Status, body)
+	}
+}
+
+func TestTerminateTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.Host)
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := tlsterm.LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := ioutil.ReadFile(ca.CertFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	addr := backend.Listener.Addr().String()
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return addr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	p.TerminateTLS([]int{n}, tlsterm.Matcher([]string{"*.svc.test"}), ca.Certificate)
+	p.Start(10)
+	defer p.Stop()
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", p.listener.Addr().String())
+	}
+
+	// matching names get our certificate
+	client := &http.Client{Transport: &http.Transport{DialContext: dial, TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://web.svc.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from web.svc.test" {
+		t.Errorf("expected the backend, got %q", body)
+	}
+
+	// others go straight through to the backend
+	conn, err := tls.Dial("tcp", p.listener.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.ConnectionState().PeerCertificates[0].Equal(backend.Certificate()) {
+		t.Error("expected the backend's own certificate")
+	}
+}
+
+func dialRig(b *testing.B) (*rig, net.Conn) {
+	r, err := newRig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", r.proxy.listener.Addr().String())
+	if err != nil {
+		r.close()
+		b.Fatal(err)
+	}
+	return r, conn
+}
+
+func benchmarkRoundTrip(b *testing.B, size int) {
+	r, conn := dialRig(b)
+	defer r.close()
+	defer conn.Close()
+
+	out := bytes.Repeat([]byte{'x'}, size)
+	in := make([]byte, size)
+	b.SetBytes(int64(2 * size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(out); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRoundTrip64(b *testing.B)  { benchmarkRoundTrip(b, 64) }
+func BenchmarkRoundTrip1K(b *testing.B)  { benchmarkRoundTrip(b, 1024) }
+func BenchmarkRoundTrip64K(b *testing.B) { benchmarkRoundTrip(b, 64*1024) }
+func BenchmarkRoundTrip1M(b *testing.B)  { benchmarkRoundTrip(b, 1024*1024) }
+
+func BenchmarkConnect(b *testing.B) {
+	r, conn := dialRig(b)
+	defer r.close()
+	conn.Close()
+
+	addr := r.proxy.listener.Addr().String()
+	buf := make([]byte, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// make sure the whole chain is connected
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func TestUsage(t *testing.T) {
+	u := newUsage()
+	over := make(chan uint64, 1)
+	u.SetQuota(100, func(sent, received uint64) { over <- sent + received })
+
+	u.counter("web:80", true)(40)
+	u.counter("web:80", false)(50)
+	u.counter("db:5432", true)(5)
+	select {
+	case total := <-over:
+		t.Fatalf("quota exceeded early, at %d", total)
+	default:
+	}
+	u.counter("db:5432", false)(10)
+	u.counter("db:5432", false)(10)
+
+	if total := <-over; total != 105 {
+		t.Errorf("expected the quota to be exceeded at 105, got %d", total)
+	}
+	r := u.Report()
+	if r.Total != (Traffic{45, 70}) || r.Destinations["web:80"] != (Traffic{40, 50}) || r.Destinations["db:5432"] != (Traffic{5, 20}) {
+		t.Errorf("unexpected %+v", r)
+	}
+	select {
+	case total := <-over:
+		t.Errorf("expected the quota to be exceeded once, again at %d", total)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+type lines chan []byte
+
+func (l lines) Write(b []byte) (int, error) {
+	l <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	addr := backend.Listener.Addr().String()
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return addr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(lines, 1)
+	p.SetAccessLog(entries, true, func(host string) string { return "web.default" })
+	p.Start(10)
+	defer p.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", p.listener.Addr().String())
+		},
+	}}
+	resp, err := client.Get("http://web.default/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var e Entry
+	select {
+	case line := <-entries:
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing logged")
+	}
+	if e.Destination != addr || e.Service != "web.default" || e.Sent == 0 || e.Received == 0 || e.Outcome != "closed" {
+		t.Errorf("unexpected %+v", e)
+	}
+	if runtime.GOOS == "linux" {
+		if e.PID != os.Getpid() {
+			t.Errorf("expected the connection to be ours, got pid %d", e.PID)
+		}
+		pt := p.Report().Processes[e.Process]
+		if pt.Connections != 1 || !reflect.DeepEqual(pt.PIDs, []int{os.Getpid()}) ||
+			!reflect.DeepEqual(pt.Destinations, []string{addr}) || pt.Sent == 0 {
+			t.Errorf("unexpected usage of %q: %+v", e.Process, pt)
+		}
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	e := Entry{
+		Time:        time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC),
+		Client:      "127.0.0.1:53412",
+		PID:         42,
+		Process:     `my "app" server`,
+		Destination: "10.96.0.10:80",
+		Service:     "default/web",
+		Sent:        10,
+		Received:    100,
+		Seconds:     1.5,
+		Outcome:     "connection reset by peer",
+	}
+	parsed, err := ParseEntry(e.String())
+	if err != nil || !reflect.DeepEqual(parsed, e) {
+		t.Errorf("text: %+v, %v", parsed, err)
+	}
+	line, _ := json.Marshal(e)
+	if parsed, err := ParseEntry(string(line)); err != nil || !reflect.DeepEqual(parsed, e) {
+		t.Errorf("json: %+v, %v", parsed, err)
+	}
+	if _, err := ParseEntry(`2019-03-01T12:00:00Z client=127.0.0.1:1 outcome="closed`); err == nil {
+		t.Errorf("expected an unclosed quote to fail")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialed := make(chan string, 10)
+	w := &warm{size: 2, spares: make(map[string]*spare), dial: func(host string) (*net.TCPConn, error) {
+		dialed <- host
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}}
+	defer w.close()
+	ready := func(host string) {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			w.mutex.Lock()
+			s, ok := w.spares[host]
+			warmed := ok && s.conn != nil
+			w.mutex.Unlock()
+			if warmed {
+				return
+			}
+		}
+		t.Fatalf("%s was never warmed", host)
+	}
+
+	// the first connection isn't warm, but warms the next
+	if conn := w.take("web:80"); conn != nil {
+		t.Errorf("expected nothing warm yet")
+	}
+	ready("web:80")
+	if conn := w.take("web:80"); conn == nil {
+		t.Errorf("expected a warm connection")
+	} else {
+		conn.Close()
+	}
+	ready("web:80")
+
+	// only the most recent destinations are kept warm
+	w.take("db:5432")
+	w.take("cache:6379")
+	w.mutex.Lock()
+	_, kept := w.spares["web:80"]
+	order := append([]string(nil), w.order...)
+	w.mutex.Unlock()
+	if kept || len(order) != 2 || order[0] != "db:5432" || order[1] != "cache:6379" {
+		t.Errorf("expected web:80 to be evicted, got %v", order)
+	}
+}
+
+func TestRace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	connect := func(delay time.Duration, fail bool) func(string) (*net.TCPConn, error) {
+		return func(host string) (*net.TCPConn, error) {
+			time.Sleep(delay)
+			if fail {
+				return nil, fmt.Errorf("%s unreachable", host)
+			}
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			return conn.(*net.TCPConn), nil
+		}
+	}
+	tunneled := make(chan string, 10)
+	tunnel := func(host string) (*net.TCPConn, error) {
+		tunneled <- host
+		return connect(50*time.Millisecond, false)(host)
+	}
+
+	// on the VPN, direct wins, and then skips the tunnel
+	r := &race{direct: connect(0, false), winners: make(map[string]winner)}
+	for i := 0; i < 2; i++ {
+		conn, direct, err := r.dial("web:80", tunnel)
+		if err != nil || !direct {
+			t.Fatalf("dial %d: direct=%v err=%v", i, direct, err)
+		}
+		conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(tunneled) != 1 {
+		t.Errorf("expected only the race to use the tunnel, got %d", len(tunneled))
+	}
+
+	// off it, the tunnel wins
+	r = &race{direct: connect(0, true), winners: make(map[string]winner)}
+	conn, direct, err := r.dial("web:80", tunnel)
+	if err != nil || direct {
+		t.Fatalf("direct=%v err=%v", direct, err)
+	}
+	conn.Close()
+	if w, ok := r.winner("web:80"); !ok || w.direct {
+		t.Errorf("expected the tunnel to be remembered, got %v", w)
+	}
+}
+
+func TestHush(t *testing.T) {
+	p := &Proxy{}
+	p.Hush(time.Minute)
+	p.dialFailed(errors.New("connection refused"))
+	p.dialFailed(errors.New("connection refused"))
+	if p.hush.suppressed != 2 {
+		t.Errorf("expected 2 failures suppressed, got %d", p.hush.suppressed)
+	}
+	p.Hush(0)
+	if p.hush.suppressed != 0 {
+		t.Errorf("expected the count to be logged and reset, got %d", p.hush.suppressed)
+	}
+}
+
+func TestCacheHTTP(t *testing.T) {
+	requests := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		if r.URL.Path == "/static" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	addr := backend.Listener.Addr().String()
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return addr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	p.RouteHTTP([]int{n})
+	p.CacheHTTP(func(string) bool { return true }, 0)
+	p.Start(10)
+	defer p.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", p.listener.Addr().String())
+		},
+	}}
+	get := func(path string, header ...string) string {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if body := get("/static"); body != "hello from /static" {
+			t.Fatalf("got %q", body)
+		}
+	}
+	// no max-age and no ttl
+	get("/dynamic")
+	get("/dynamic")
+	// a reload asks for a fresh one
+	get("/static", "Cache-Control", "no-cache")
+
+	close(requests)
+	var seen []string
+	for path := range requests {
+		seen = append(seen, path)
+	}
+	if fmt.Sprint(seen) != "[/static /dynamic /dynamic /static]" {
+		t.Errorf("unexpected requests to the backend: %v", seen)
+	}
+	stats := p.Report().Cache[addr]
+	if stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("unexpected %+v", stats)
+	}
+}
+
+func TestFreshFor(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		header   http.Header
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{200, http.Header{"Cache-Control": {"public, max-age=30"}}, 0, 30 * time.Second},
+		{200, http.Header{"Cache-Control": {"no-store"}}, time.Minute, 0},
+		{200, http.Header{}, time.Minute, time.Minute},
+		{200, http.Header{}, 0, 0},
+		{200, http.Header{"Vary": {"Accept-Encoding"}}, time.Minute, time.Minute},
+		{200, http.Header{"Vary": {"Cookie"}}, time.Minute, 0},
+		{200, http.Header{"Set-Cookie": {"id=1"}}, time.Minute, 0},
+		{500, http.Header{"Cache-Control": {"max-age=30"}}, 0, 0},
+	} {
+		if fresh := freshFor(&http.Response{StatusCode: c.status, Header: c.header}, c.ttl); fresh != c.expected {
+			t.Errorf("%d %v ttl=%s: expected %s, got %s", c.status, c.header, c.ttl, c.expected, fresh)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go accept(echo, func(conn net.Conn) { io.Copy(conn, conn) })
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return echo.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := timeouts.NewTable(timeouts.Config{Timeouts: timeouts.Timeouts{Idle: timeouts.Duration(200 * time.Millisecond)}})
+	p.SetTimeouts(table)
+	p.Start(10)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	// traffic keeps it open
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("x"))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("closed while in use: %v", err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("closed after only %s", elapsed)
+	}
+}
+
+func TestShaping(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go accept(echo, func(conn net.Conn) { io.Copy(conn, conn) })
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return echo.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := shaping.NewTable(shaping.Config{Rules: []shaping.Rule{{
+		Match: []string{"127.0.0.1"},
+		Shape: shaping.Shape{Latency: timeouts.Duration(100 * time.Millisecond), Bandwidth: 250000},
+	}}})
+	p.SetShaping(table)
+	p.Start(10)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	roundTrip := func(size int) time.Duration {
+		start := time.Now()
+		if _, err := conn.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	// opening it takes a round trip as well
+	if elapsed := roundTrip(1); elapsed < 190*time.Millisecond {
+		t.Errorf("expected the first round trip to take 200ms, took %s", elapsed)
+	}
+	if elapsed := roundTrip(1); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected a round trip to take 100ms, took %s", elapsed)
+	}
+	// 50000 bytes at 250000 a second, each way at once
+	if elapsed := roundTrip(50000); elapsed < 250*time.Millisecond {
+		t.Errorf("expected 50000 bytes to take 300ms there and back, took %s", elapsed)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go accept(echo, func(conn net.Conn) { io.Copy(conn, conn) })
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	mirrored := make(chan string, 1)
+	go accept(local, func(conn net.Conn) {
+		// answers that go nowhere
+		conn.Write([]byte("local"))
+		data, _ := ioutil.ReadAll(conn)
+		mirrored <- string(data)
+	})
+
+	route.Remember("127.0.0.1", "web.default.svc.cluster.local")
+	defer route.Forget("127.0.0.1", "web.default.svc.cluster.local")
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return echo.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	n, _ := strconv.Atoi(port)
+	p.Mirror("default/web", n, local.Addr().String())
+	p.Start(10)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(reply) != "hello" {
+		t.Fatalf("got %q, %v from the service", reply, err)
+	}
+	select {
+	case data := <-mirrored:
+		if data != "hello" {
+			t.Errorf("mirrored %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing mirrored")
+	}
+
+	p.Unmirror("default/web", n)
+	if m := p.mirrorOf(echo.Addr().String()); m != "" {
+		t.Errorf("still mirrored to %s", m)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	cluster, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	go accept(cluster, func(conn net.Conn) { conn.Write([]byte("cluster")) })
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go accept(local, func(conn net.Conn) { conn.Write([]byte("local")) })
+
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return cluster.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(10)
+	defer p.Stop()
+	get := func() string {
+		conn, err := net.Dial("tcp", p.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 16)
+		n, _ := io.ReadAtLeast(conn, buf, 5)
+		return string(buf[:n])
+	}
+
+	for percent, expected := range map[int]string{100: "local", 0: "cluster"} {
+		p.SetSplits(map[string]Split{cluster.Addr().String(): {Local: local.Addr().String(), Percent: percent}})
+		for i := 0; i < 5; i++ {
+			if got := get(); got != expected {
+				t.Errorf("%d%%: got %q", percent, got)
+			}
+		}
+	}
+
+	// with nothing local, everything goes to the cluster
+	p.SetSplits(map[string]Split{cluster.Addr().String(): {Local: local.Addr().String(), Percent: 100}})
+	local.Close()
+	if got := get(); got != "cluster" {
+		t.Errorf("got %q with nothing local", got)
+	}
+}
+
+func TestSplitByHeader(t *testing.T) {
+	backend := func(name string) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go accept(ln, func(conn net.Conn) {
+			http.ReadRequest(bufio.NewReader(conn))
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(name), name)
+		})
+		return ln
+	}
+	cluster := backend("cluster")
+	defer cluster.Close()
+	local := backend("local")
+	defer local.Close()
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return cluster.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(10)
+	defer p.Stop()
+	p.SetSplits(map[string]Split{cluster.Addr().String(): {Local: local.Addr().String(), Percent: 100, Header: "X-Teleproxy-User", Value: "alice"}})
+
+	for user, expected := range map[string]string{"alice": "local", "bob": "cluster", "": "cluster"} {
+		req, _ := http.NewRequest("GET", "http://"+p.listener.Addr().String()+"/", nil)
+		if user != "" {
+			req.Header.Set("x-teleproxy-user", user)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("user %q: got %q, not %q", user, body, expected)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go accept(echo, func(conn net.Conn) { io.Copy(conn, conn) })
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go accept(socks, serveSOCKS5)
+
+	p, err := NewProxy("127.0.0.1:0", socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return echo.Addr().String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(10)
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	conn.Write([]byte("x"))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Active(); n != 1 {
+		t.Fatalf("expected 1 active connection, got %d", n)
+	}
+	// a connection that stays open is left after the timeout
+	if left := p.Drain(200 * time.Millisecond); left != 1 {
+		t.Errorf("expected 1 connection left, got %d", left)
+	}
+	if _, err := net.DialTimeout("tcp", p.listener.Addr().String(), time.Second); err == nil {
+		t.Errorf("expected a drained proxy to refuse connections")
+	}
+	// and one that finishes in time isn't
+	conn.Write([]byte("y"))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("closed while draining: %v", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+	if left := p.Drain(5 * time.Second); left != 0 {
+		t.Errorf("expected no connections left, got %d", left)
+	}
+}
+
+func TestProcessesBounded(t *testing.T) {
+	u := newUsage()
+	for i := 0; i < 2*maxProcessPIDs; i++ {
+		u.attribute("curl", 1000+i, fmt.Sprintf("10.96.0.%d:80", i%10))
+	}
+	for i := 0; i < 2*maxProcessDestinations; i++ {
+		u.attribute("node", 7, fmt.Sprintf("10.96.%d.%d:80", i/250, i%250))
+	}
+	for i := 0; i < maxProcesses; i++ {
+		u.attribute(fmt.Sprintf("job-%d", i), 2000+i, "10.96.0.1:80")
+	}
+	r := u.Report()
+	if len(r.Processes) != maxProcesses {
+		t.Errorf("expected %d processes, got %d", maxProcesses, len(r.Processes))
+	}
+	if _, ok := r.Processes["curl"]; ok {
+		t.Error("expected curl, seen least recently, to be forgotten")
+	}
+	u = newUsage()
+	for i := 0; i < 2*maxProcessPIDs; i++ {
+		u.attribute("curl", 1000+i, fmt.Sprintf("10.96.0.%d:80", i))
+	}
+	pt := u.Report().Processes["curl"]
+	if len(pt.PIDs) != maxProcessPIDs || pt.PIDs[0] != 1000+maxProcessPIDs || pt.Connections != 2*maxProcessPIDs {
+		t.Errorf("expected the last %d pids, got %v", maxProcessPIDs, pt.PIDs)
+	}
+	if len(pt.Destinations) != 2*maxProcessPIDs {
+		t.Errorf("expected every destination, got %d", len(pt.Destinations))
+	}
+}
+
+func TestNoOwnerWithoutAccessLog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &Proxy{}
+	if c := p.open(conn.(*net.TCPConn)); c.entry.PID != 0 {
+		t.Errorf("expected no lookup without the access log, got pid %d", c.entry.PID)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a direct dial may take, e.g. while the destination
+	// is on a VPN that is down
+	directTimeout = 3 * time.Second
+	// how long the winner of a race is remembered for, after which
+	// the next connection races again in case things have changed
+	raceMemory = 5 * time.Minute
+)
+
+// RaceDirect dials destinations directly, bypassing the firewall by
+// way of mark, as well as through the tunnel, and keeps whichever
+// connects first. The winner is remembered per destination, so that
+// only the first connection to a destination (or the first after a
+// while) races, and destinations that are reachable on a VPN don't
+// pay for the tunnel. The firewall must let sockets with mark through
+// unredirected, which only linux does. It must be invoked before
+// Start.
+func (p *Proxy) RaceDirect(mark int) {
+	p.race = &race{direct: directDialer(mark), winners: make(map[string]winner)}
+}
+
+type winner struct {
+	direct bool
+	at     time.Time
+}
+
+type race struct {
+	direct func(host string) (*net.TCPConn, error)
+
+	mutex   sync.Mutex
+	winners map[string]winner
+}
+
+func (r *race) winner(host string) (w winner, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	w, ok = r.winners[host]
+	if ok && time.Since(w.at) > raceMemory {
+		delete(r.winners, host)
+		ok = false
+	}
+	return
+}
+
+func (r *race) remember(host string, direct bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.winners[host] = winner{direct: direct, at: time.Now()}
+}
+
+func (r *race) forget(host string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.winners, host)
+}
+
+type dialed struct {
+	conn   *net.TCPConn
+	err    error
+	direct bool
+}
+
+// dial connects to host the way that won last time, or races both ways
+// if there was no last time. tunnel is how to go through the tunnel.
+func (r *race) dial(host string, tunnel func(string) (*net.TCPConn, error)) (*net.TCPConn, bool, error) {
+	if w, ok := r.winner(host); ok {
+		if !w.direct {
+			conn, err := tunnel(host)
+			return conn, false, err
+		}
+		conn, err := r.direct(host)
+		if err == nil {
+			return conn, true, nil
+		}
+		// the VPN went away, say
+		r.forget(host)
+	}
+
+	results := make(chan dialed, 2)
+	go func() {
+		conn, err := r.direct(host)
+		results <- dialed{conn, err, true}
+	}()
+	go func() {
+		conn, err := tunnel(host)
+		results <- dialed{conn, err, false}
+	}()
+
+	first := <-results
+	if first.err == nil {
+		r.remember(host, first.direct)
+		go func() {
+			if late := <-results; late.err == nil {
+				late.conn.Close()
+			}
+		}()
+		return first.conn, first.direct, nil
+	}
+	second := <-results
+	if second.err == nil {
+		r.remember(host, second.direct)
+		return second.conn, second.direct, nil
+	}
+	// the tunnel's error says more
+	if first.direct {
+		return nil, false, second.err
+	}
+	return nil, false, first.err
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A Measurement is the result of a SelfTest.
+type Measurement struct {
+	Payload    int
+	RoundTrips int
+	Elapsed    time.Duration
+}
+
+// Throughput is in bytes per second, counting both directions.
+func (m Measurement) Throughput() float64 {
+	return float64(2*m.Payload*m.RoundTrips) / m.Elapsed.Seconds()
+}
+
+// Latency is the mean time for a payload to go there and back.
+func (m Measurement) Latency() time.Duration {
+	if m.RoundTrips == 0 {
+		return 0
+	}
+	return m.Elapsed / time.Duration(m.RoundTrips)
+}
+
+func (m Measurement) String() string {
+	return fmt.Sprintf("payload=%d round-trips=%d throughput=%.1fMB/s latency=%v",
+		m.Payload, m.RoundTrips, m.Throughput()/1e6, m.Latency())
+}
+
+// SelfTest relays payload sized messages through a Proxy to a local
+// echo server for the given duration. The SOCKS tunnel is replaced by
+// a minimal in process SOCKS5 server, so this measures the relay
+// itself rather than the network or the cluster.
+func SelfTest(payload int, duration time.Duration) (m Measurement, err error) {
+	rig, err := newRig()
+	if err != nil {
+		return
+	}
+	defer rig.close()
+
+	conn, err := net.Dial("tcp", rig.proxy.listener.Addr().String())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	out := bytes.Repeat([]byte{'x'}, payload)
+	in := make([]byte, payload)
+	m.Payload = payload
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err = conn.Write(out); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, in); err != nil {
+			return
+		}
+		m.RoundTrips++
+	}
+	m.Elapsed = time.Since(start)
+	return
+}
+
+// A rig wires a Proxy to an echo server, via a SOCKS5 server.
+type rig struct {
+	echo, socks net.Listener
+	proxy       *Proxy
+}
+
+func newRig() (r *rig, err error) {
+	r = &rig{}
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+
+	if r.echo, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go accept(r.echo, func(conn net.Conn) { io.Copy(conn, conn) })
+
+	if r.socks, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go accept(r.socks, serveSOCKS5)
+
+	echo := r.echo.Addr().String()
+	r.proxy, err = NewProxy("127.0.0.1:0", r.socks.Addr().String(), func(*net.TCPConn) (string, error) {
+		return echo, nil
+	})
+	if err != nil {
+		return
+	}
+	r.proxy.Start(100)
+	return
+}
+
+func (r *rig) close() {
+	for _, ln := range []net.Listener{r.echo, r.socks} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	if r.proxy != nil {
+		r.proxy.Stop()
+	}
+}
+
+func accept(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+// serveSOCKS5 implements just enough of RFC 1928 for our dialer:
+// no authentication and CONNECT to an ipv4 address or hostname.
+func serveSOCKS5(conn net.Conn) {
+	if err := socks5Handshake(conn); err != nil {
+		return
+	}
+	target, err := socks5Request(conn)
+	if err != nil {
+		return
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, upstream)
+}
+
+func socks5Handshake(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 5 {
+		return errors.New("not socks5")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte{5, 0})
+	return err
+}
+
+func socks5Request(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[1] != 1 {
+		return "", errors.New("only CONNECT is supported")
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errors.New("unsupported address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/shaping"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// SetShaping sets how relayed connections are slowed down, by
+// destination, so that what is developed locally sees the latency and
+// bandwidth of the cluster rather than of localhost. Without it, or
+// where the table doesn't say, connections go as fast as they can. It
+// must be invoked before Start.
+func (p *Proxy) SetShaping(table *shaping.Table) {
+	p.shaping = table
+}
+
+type piper func(from, to *net.TCPConn, done tpu.Latch, count func(int), fail func(error), tee func([]byte))
+
+// piperFor returns what copies each side of a connection to target to
+// the other: pipe, or if target is shaped, shaped, once the connection
+// has taken as long to open as the latency says.
+func (p *Proxy) piperFor(conn *net.TCPConn, target string) piper {
+	shape := p.shaping.Lookup(target)
+	if shape.Zero() {
+		return p.pipe
+	}
+	p.log("SHAPE %s %s %v", conn.RemoteAddr(), target, shape)
+	time.Sleep(time.Duration(shape.Latency))
+	return p.shaped(shape)
+}
+
+// chunk is what a shaped pipe has read, to be written when it is due.
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// shaped returns a pipe that delays what it copies by half the latency
+// of shape, and paces it to the bandwidth. Chunks are read while
+// earlier ones wait, so the latency holds up each of them rather than
+// the throughput, up to a window of them, after which the sender is
+// held up as a slow network would.
+func (p *Proxy) shaped(shape shaping.Shape) piper {
+	delay := time.Duration(shape.Latency) / 2
+	rate := int64(shape.Bandwidth)
+	return func(from, to *net.TCPConn, done tpu.Latch, count func(int), fail func(error), tee func([]byte)) {
+		defer func() {
+			p.log("CLOSED WRITE %v", to.RemoteAddr())
+			to.CloseWrite()
+		}()
+		defer func() {
+			p.log("CLOSED READ %v", from.RemoteAddr())
+			from.CloseRead()
+		}()
+		defer done.Notify()
+
+		chunks := make(chan chunk, 16)
+		go func() {
+			defer close(chunks)
+			// small enough to pace smoothly
+			const size = 16 * 1024
+			for {
+				buf := make([]byte, size)
+				n, err := from.Read(buf)
+				if n > 0 {
+					if tee != nil {
+						tee(buf[:n])
+					}
+					chunks <- chunk{buf[:n], time.Now().Add(delay)}
+				}
+				if err != nil {
+					if err != io.EOF {
+						p.log(err.Error())
+						fail(err)
+					}
+					return
+				}
+			}
+		}()
+
+		var next time.Time
+		failed := false
+		for c := range chunks {
+			if failed {
+				// until the reader notices
+				continue
+			}
+			if c.due.Before(next) {
+				c.due = next
+			}
+			time.Sleep(time.Until(c.due))
+			_, err := to.Write(c.data)
+			count(len(c.data))
+			if rate > 0 {
+				next = time.Now().Add(time.Duration(int64(len(c.data)) * int64(time.Second) / rate))
+			}
+			if err != nil {
+				p.log(err.Error())
+				fail(err)
+				failed = true
+				from.CloseRead()
+			}
+		}
+	}
+}
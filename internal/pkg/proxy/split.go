@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A Split sends Percent of the connections to a destination to Local,
+// e.g. "127.0.0.1:8080", and the rest through the tunnel as usual.
+//
+// If Header is set, it is the connections whose first request carries
+// that header with Value that go to Local instead, whatever Percent
+// is. As with RouteHTTP, later requests of a connection stay where the
+// first one went.
+type Split struct {
+	Local   string
+	Percent int
+	Header  string
+	Value   string
+}
+
+// SetSplits replaces the splits, by destination ("ip:port"). It may be
+// invoked at any time, and affects connections made after.
+func (p *Proxy) SetSplits(splits map[string]Split) {
+	p.splitsMutex.Lock()
+	defer p.splitsMutex.Unlock()
+	p.splits = splits
+}
+
+// splitOf returns the split of connections to host, if this one may go
+// local: all of them for a split by header, a share of them otherwise.
+func (p *Proxy) splitOf(host string) (Split, bool) {
+	p.splitsMutex.Lock()
+	s, ok := p.splits[host]
+	p.splitsMutex.Unlock()
+	if !ok || s.Header == "" && rand.Intn(100) >= s.Percent {
+		return Split{}, false
+	}
+	return s, true
+}
+
+// handleLocal relays a connection to the local end of a split. If
+// nothing listens there, it returns false for the connection to go to
+// the cluster after all.
+func (p *Proxy) handleLocal(c *connection, conn *net.TCPConn, host, local string) bool {
+	upstream, err := net.DialTimeout("tcp", local, time.Second)
+	if err != nil {
+		p.log("LOCAL %s %s unreachable, going to the cluster: %v", conn.RemoteAddr(), local, err)
+		return false
+	}
+	p.log("CONNECT %s %s (local %s)", conn.RemoteAddr(), host, local)
+	c.relayed(local)
+	p.relay(c, conn, upstream.(*net.TCPConn), local, c.counter(local, true))
+	return true
+}
+
+// handleSelected relays conn, which was headed for host, to the local
+// end of the split if its first request carries the header, and to
+// host otherwise. Anything that doesn't parse as HTTP goes to host.
+func (p *Proxy) handleSelected(c *connection, conn *net.TCPConn, host string, s Split) {
+	var head bytes.Buffer
+	br := bufio.NewReader(&recorder{r: conn, kept: &head})
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := http.ReadRequest(br)
+	conn.SetReadDeadline(time.Time{})
+
+	var upstream *net.TCPConn
+	target := host
+	if err != nil {
+		p.log("not http, relaying to %s: %v", host, err)
+	} else if req.Header.Get(s.Header) == s.Value {
+		local, err := net.DialTimeout("tcp", s.Local, time.Second)
+		if err != nil {
+			p.log("LOCAL %s %s unreachable, going to the cluster: %v", conn.RemoteAddr(), s.Local, err)
+		} else {
+			target, upstream = s.Local, local.(*net.TCPConn)
+		}
+	}
+
+	if upstream == nil {
+		p.log("CONNECT %s %s", conn.RemoteAddr(), host)
+		upstream, err = p.dial(host)
+		if err != nil {
+			p.dialFailed(err)
+			c.fail(err)
+			if req != nil {
+				unreachable(conn, host, err)
+			}
+			conn.Close()
+			return
+		}
+	} else {
+		p.log("CONNECT %s %s (local %s by %s)", conn.RemoteAddr(), host, s.Local, s.Header)
+	}
+	c.relayed(target)
+	p.replay(c, conn, upstream, target, head.Bytes())
+}
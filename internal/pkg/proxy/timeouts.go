@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+var errIdle = errors.New("idle for too long")
+
+// SetTimeouts sets how long dialing through the tunnel, and relayed
+// connections going idle, may take for each destination. Without it,
+// or where the table doesn't say, dials wait as long as the tunnel
+// does and connections may be idle forever. It must be invoked before
+// Start.
+func (p *Proxy) SetTimeouts(table *timeouts.Table) {
+	p.timeouts = table
+}
+
+// deadline is a dialer for the connection to the SOCKS5 proxy whose
+// handshake, and so the dial through it, must be done within it.
+type deadline time.Duration
+
+func (d deadline) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, time.Duration(d))
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Duration(d)))
+	}
+	return conn, err
+}
+
+// relay copies between conn and upstream both ways until both sides
+// are done, counting what conn sends with sent, and showing it to the
+// tee of c, if any. If nothing goes either way for the idle timeout of
+// target, both are closed. Connections to shaped targets are slowed
+// down as SetShaping says.
+func (p *Proxy) relay(c *connection, conn, upstream *net.TCPConn, target string, sent func(int)) {
+	received := c.counter(target, false)
+	done := tpu.NewLatch(2)
+	pipe := p.piperFor(conn, target)
+
+	idle := p.timeouts.Idle(target, 0)
+	if idle <= 0 {
+		go pipe(conn, upstream, done, sent, c.fail, c.tee)
+		go pipe(upstream, conn, done, received, c.fail, nil)
+		done.Wait()
+		return
+	}
+
+	last := time.Now().UnixNano()
+	active := func(count func(int)) func(int) {
+		return func(n int) {
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			count(n)
+		}
+	}
+	stop := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-timer.C:
+			}
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&last)))
+			if since < idle {
+				timer.Reset(idle - since)
+				continue
+			}
+			p.log("IDLE %s %s for %s", conn.RemoteAddr(), target, idle)
+			c.fail(errIdle)
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}()
+	go pipe(conn, upstream, done, active(sent), c.fail, c.tee)
+	go pipe(upstream, conn, done, active(received), c.fail, nil)
+	done.Wait()
+	close(stop)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TerminateTLS makes connections originally destined to the given
+// ports be decrypted here, with a certificate from certificate, if
+// their server name matches. They are encrypted again on the way to
+// the backend, whose certificate isn't checked since it is usually
+// issued by the cluster. Connections for other names are relayed
+// untouched. It must be invoked before Start.
+func (p *Proxy) TerminateTLS(ports []int, match func(name string) bool, certificate func(name string) (*tls.Certificate, error)) {
+	p.tls = make(map[string]bool)
+	for _, port := range ports {
+		p.tls[strconv.Itoa(port)] = true
+	}
+	p.tlsMatch = match
+	p.tlsCertificate = certificate
+}
+
+func (p *Proxy) terminatesTLS(host string) bool {
+	_, port, err := net.SplitHostPort(host)
+	return err == nil && p.tls[port]
+}
+
+var errSniffed = errors.New("sniffed")
+
+// readOnly lets the tls package parse a ClientHello without answering
+// it.
+type readOnly struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnly) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnly) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// replay is a connection where what was already read is read again.
+type replay struct {
+	*net.TCPConn
+	r io.Reader
+}
+
+func (c replay) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// serverName returns the server name the client asked for, and what
+// was read to find out.
+func serverName(conn *net.TCPConn) (string, []byte) {
+	var head bytes.Buffer
+	var name string
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	tls.Server(readOnly{conn, io.TeeReader(conn, &head)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return name, head.Bytes()
+}
+
+// handleTLS relays conn, which was headed for host, decrypting it if
+// the server name matches.
+func (p *Proxy) handleTLS(c *connection, conn *net.TCPConn, host string) {
+	name, head := serverName(conn)
+
+	upstream, err := p.dial(host)
+	if err != nil {
+		p.log(err.Error())
+		c.fail(err)
+		conn.Close()
+		return
+	}
+
+	if name == "" || !p.tlsMatch(name) {
+		p.log("CONNECT %s %s", conn.RemoteAddr(), host)
+		sent := c.counter(host, true)
+		if _, err := (countingWriter{upstream, sent}).Write(head); err != nil {
+			p.log(err.Error())
+			c.fail(err)
+			upstream.Close()
+			conn.Close()
+			return
+		}
+		p.relay(c, conn, upstream, host, sent)
+		return
+	}
+
+	p.log("CONNECT %s %s (tls %s)", conn.RemoteAddr(), host, name)
+	client := tls.Server(replay{conn, io.MultiReader(bytes.NewReader(head), conn)}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.tlsCertificate(name)
+		},
+	})
+	backend := tls.Client(upstream, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	defer client.Close()
+	defer backend.Close()
+	for _, side := range []*tls.Conn{client, backend} {
+		side.SetDeadline(time.Now().Add(headerTimeout))
+		if err := side.Handshake(); err != nil {
+			p.log("tls %s: %v", name, err)
+			c.fail(err)
+			return
+		}
+		side.SetDeadline(time.Time{})
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(from, to *tls.Conn, count func(int)) {
+		io.Copy(countingWriter{to, count}, from)
+		to.CloseWrite()
+		done <- struct{}{}
+	}
+	go relay(client, backend, c.counter(host, true))
+	go relay(backend, client, c.counter(host, false))
+	<-done
+	<-done
+}
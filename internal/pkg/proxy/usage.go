@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// Traffic is how many bytes were relayed each way.
+type Traffic struct {
+	// Sent is to the cluster, Received from it.
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+func (t Traffic) total() uint64 {
+	return t.Sent + t.Received
+}
+
+// A Report summarizes Usage.
+type Report struct {
+	Total Traffic `json:"total"`
+	// Connections counts the connections relayed.
+	Connections  uint64             `json:"connections"`
+	Destinations map[string]Traffic `json:"destinations,omitempty"`
+	// Services names the services whose addresses destinations
+	// are, where known.
+	Services map[string]string `json:"services,omitempty"`
+	// Quota is the soft quota, if any.
+	Quota uint64 `json:"quota,omitempty"`
+	// Cache has how the HTTP cache did for each host, if there is
+	// one.
+	Cache map[string]CacheStats `json:"cache,omitempty"`
+	// Processes breaks the connections down by the name of the local
+	// process that made them, where that can be found.
+	Processes map[string]ProcessTraffic `json:"processes,omitempty"`
+}
+
+// ProcessTraffic is what the connections of the local processes of a
+// name relayed.
+type ProcessTraffic struct {
+	Traffic
+	Connections uint64 `json:"connections"`
+	// PIDs are those of the processes.
+	PIDs []int `json:"pids"`
+	// Destinations are where the connections went, by the service
+	// whose address that is where known.
+	Destinations []string `json:"destinations"`
+}
+
+// processUsage is what Usage counts of ProcessTraffic. The pids and
+// destinations are by when each was last seen.
+type processUsage struct {
+	Traffic
+	connections  uint64
+	pids         map[int]time.Time
+	destinations map[string]time.Time
+	seen         time.Time
+}
+
+// Usage keeps this many processes, and this many pids and destinations
+// of each, forgetting the ones seen least recently past that, so that
+// a long session that runs through many short lived processes doesn't
+// grow without bound.
+const (
+	maxProcesses           = 256
+	maxProcessPIDs         = 64
+	maxProcessDestinations = 256
+)
+
+// Usage counts the bytes relayed through the tunnel, in total and by
+// destination, since the proxy started.
+type Usage struct {
+	mutex        sync.Mutex
+	total        Traffic
+	connections  uint64
+	destinations map[string]*Traffic
+	processes    map[string]*processUsage
+
+	quota    uint64
+	over     func(sent, received uint64)
+	exceeded bool
+}
+
+func newUsage() *Usage {
+	return &Usage{destinations: make(map[string]*Traffic), processes: make(map[string]*processUsage)}
+}
+
+// SetQuota makes over be invoked, once, when more than quota bytes
+// have been relayed in total. Nothing is cut off.
+func (u *Usage) SetQuota(quota uint64, over func(sent, received uint64)) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.quota = quota
+	u.over = over
+}
+
+// connected counts a connection being relayed.
+func (u *Usage) connected() {
+	u.mutex.Lock()
+	u.connections++
+	u.mutex.Unlock()
+}
+
+// attribute counts a connection to destination being relayed for the
+// local process named process with pid.
+func (u *Usage) attribute(process string, pid int, destination string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	now := time.Now()
+	pu, ok := u.processes[process]
+	if !ok {
+		if len(u.processes) >= maxProcesses {
+			var oldest string
+			for name, other := range u.processes {
+				if oldest == "" || other.seen.Before(u.processes[oldest].seen) {
+					oldest = name
+				}
+			}
+			delete(u.processes, oldest)
+		}
+		pu = &processUsage{pids: make(map[int]time.Time), destinations: make(map[string]time.Time)}
+		u.processes[process] = pu
+	}
+	pu.connections++
+	pu.seen = now
+	if _, ok := pu.pids[pid]; !ok && len(pu.pids) >= maxProcessPIDs {
+		var oldest int
+		for p, seen := range pu.pids {
+			if oldest == 0 || seen.Before(pu.pids[oldest]) {
+				oldest = p
+			}
+		}
+		delete(pu.pids, oldest)
+	}
+	pu.pids[pid] = now
+	if _, ok := pu.destinations[destination]; !ok && len(pu.destinations) >= maxProcessDestinations {
+		var oldest string
+		for d, seen := range pu.destinations {
+			if oldest == "" || seen.Before(pu.destinations[oldest]) {
+				oldest = d
+			}
+		}
+		delete(pu.destinations, oldest)
+	}
+	pu.destinations[destination] = now
+}
+
+// processCounter returns what the relay of a connection attributed to
+// process adds to, besides counter.
+func (u *Usage) processCounter(process string, sent bool) func(int) {
+	return func(n int) {
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		pu, ok := u.processes[process]
+		if !ok {
+			return
+		}
+		if sent {
+			pu.Sent += uint64(n)
+		} else {
+			pu.Received += uint64(n)
+		}
+	}
+}
+
+// Totals returns the bytes and the connections relayed so far, which is
+// Report without the breakdown.
+func (u *Usage) Totals() (Traffic, uint64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.total, u.connections
+}
+
+// counter returns what the relay to or from destination adds to.
+func (u *Usage) counter(destination string, sent bool) func(int) {
+	return func(n int) {
+		u.mutex.Lock()
+		t, ok := u.destinations[destination]
+		if !ok {
+			t = &Traffic{}
+			u.destinations[destination] = t
+		}
+		if sent {
+			t.Sent += uint64(n)
+			u.total.Sent += uint64(n)
+		} else {
+			t.Received += uint64(n)
+			u.total.Received += uint64(n)
+		}
+		var over func(sent, received uint64)
+		if u.quota > 0 && !u.exceeded && u.total.total() > u.quota {
+			u.exceeded = true
+			over = u.over
+		}
+		total := u.total
+		u.mutex.Unlock()
+		if over != nil {
+			go over(total.Sent, total.Received)
+		}
+	}
+}
+
+// Report returns the counts so far.
+func (u *Usage) Report() Report {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	r := Report{Total: u.total, Connections: u.connections, Destinations: make(map[string]Traffic, len(u.destinations)), Quota: u.quota}
+	for destination, t := range u.destinations {
+		r.Destinations[destination] = *t
+		if ip, _, err := net.SplitHostPort(destination); err == nil {
+			if name := route.NameOf(ip); name != "" {
+				if r.Services == nil {
+					r.Services = make(map[string]string)
+				}
+				r.Services[destination] = name
+			}
+		}
+	}
+	for process, pu := range u.processes {
+		if r.Processes == nil {
+			r.Processes = make(map[string]ProcessTraffic, len(u.processes))
+		}
+		pt := ProcessTraffic{Traffic: pu.Traffic, Connections: pu.connections}
+		for pid := range pu.pids {
+			pt.PIDs = append(pt.PIDs, pid)
+		}
+		sort.Ints(pt.PIDs)
+		named := make(map[string]bool, len(pu.destinations))
+		for destination := range pu.destinations {
+			if name := r.Services[destination]; name != "" {
+				destination = name
+			}
+			if !named[destination] {
+				named[destination] = true
+				pt.Destinations = append(pt.Destinations, destination)
+			}
+		}
+		sort.Strings(pt.Destinations)
+		r.Processes[process] = pt
+	}
+	return r
+}
+
+// countingWriter counts what is written to it.
+type countingWriter struct {
+	w     io.Writer
+	count func(int)
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.count(n)
+	return n, err
+}
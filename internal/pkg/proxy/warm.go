@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// how long a warm connection is handed out for, after which the
+// backend may well have given up on it
+const warmIdle = 5 * time.Second
+
+// Warm keeps a connection through the tunnel ready for each of the
+// size destinations connected to most recently, so that the next
+// connection to one of them doesn't wait for the tunnel to set one up.
+// Connections can still go anywhere, only the first one to a
+// destination (or the first after a while) pays for the setup. It must
+// be invoked before Start.
+//
+// Every warm connection is a real one as far as the backend is
+// concerned, which is why none are kept unless asked for.
+func (p *Proxy) Warm(size int) {
+	if size > 0 {
+		p.warm = &warm{size: size, dial: p.tunnel, spares: make(map[string]*spare)}
+	}
+}
+
+type spare struct {
+	conn *net.TCPConn
+	at   time.Time
+}
+
+type warm struct {
+	mutex sync.Mutex
+	size  int
+	dial  func(host string) (*net.TCPConn, error)
+	// spares is an LRU of the destinations, most recent last in
+	// order. A destination whose spare is being dialed has a nil
+	// conn.
+	spares map[string]*spare
+	order  []string
+}
+
+// take returns the warm connection to host, if there is a fresh one,
+// and starts warming the next.
+func (w *warm) take(host string) *net.TCPConn {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	s, ok := w.spares[host]
+	if ok && s.conn == nil {
+		// still being dialed
+		w.touch(host)
+		return nil
+	}
+	var conn *net.TCPConn
+	if ok && time.Since(s.at) < warmIdle {
+		conn = s.conn
+	} else if ok {
+		s.conn.Close()
+	}
+	w.spares[host] = &spare{}
+	w.touch(host)
+	go w.refill(host)
+	return conn
+}
+
+func (w *warm) refill(host string) {
+	conn, err := w.dial(host)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	s, ok := w.spares[host]
+	if err != nil || !ok || s.conn != nil {
+		// the destination was evicted (or warmed twice) meanwhile,
+		// or it can't be reached
+		if err == nil {
+			conn.Close()
+		}
+		if ok && s.conn == nil {
+			w.evict(host)
+		}
+		return
+	}
+	s.conn, s.at = conn, time.Now()
+}
+
+// touch makes host the most recent destination, evicting the least
+// recent ones over size. The caller holds the mutex.
+func (w *warm) touch(host string) {
+	for i, h := range w.order {
+		if h == host {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+	w.order = append(w.order, host)
+	for len(w.order) > w.size {
+		w.evict(w.order[0])
+	}
+}
+
+// evict forgets host, closing its spare. The caller holds the mutex.
+func (w *warm) evict(host string) {
+	if s, ok := w.spares[host]; ok && s.conn != nil {
+		s.conn.Close()
+	}
+	delete(w.spares, host)
+	for i, h := range w.order {
+		if h == host {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// close closes every spare.
+func (w *warm) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.order) > 0 {
+		w.evict(w.order[0])
+	}
+}
@@ -0,0 +1,143 @@
+// Package redact keeps sensitive hostnames and addresses out of logs.
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+
+	"github.com/datawire/teleproxy/internal/pkg/jsonfile"
+)
+
+// Config selects what to redact.
+type Config struct {
+	// Domains are redacted along with every name under them.
+	Domains []string `json:"domains,omitempty"`
+	// Patterns are regular expressions for anything else to
+	// redact.
+	Patterns []string `json:"patterns,omitempty"`
+	// IPs redacts every ipv4 address.
+	IPs bool `json:"ips,omitempty"`
+	// QueryNames redacts the name in every dns query log, whether
+	// or not it matches anything else.
+	QueryNames bool `json:"query_names,omitempty"`
+	// Mode is "mask" (the default), which replaces what is
+	// redacted with a placeholder, or "hash", which replaces it
+	// with a digest so that the same name can still be followed
+	// from line to line. Salt makes the digests hard to reverse
+	// by guessing.
+	Mode string `json:"mode,omitempty"`
+	Salt string `json:"salt,omitempty"`
+}
+
+// ReadConfig reads the domains, patterns, and mode to redact with
+// from filename.
+func ReadConfig(filename string) (config Config, err error) {
+	err = jsonfile.Read(filename, &config)
+	return
+}
+
+const mask = "<redacted>"
+
+var (
+	ipv4 = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// as logged by the dns server, e.g. "DNS: QUERY foo.bar. -> "
+	query = regexp.MustCompile(`(DNS: (?:QUERY|QTYPE\[\d+\]) )(\S+)`)
+)
+
+type rules struct {
+	config   Config
+	patterns []*regexp.Regexp
+}
+
+func compile(config Config) (*rules, error) {
+	switch config.Mode {
+	case "", "mask", "hash":
+	default:
+		return nil, fmt.Errorf("unknown redaction mode %q", config.Mode)
+	}
+	r := &rules{config: config}
+	for _, domain := range config.Domains {
+		r.patterns = append(r.patterns, regexp.MustCompile(`(?i)\b(?:[a-z0-9-]+\.)*`+regexp.QuoteMeta(domain)+`\b`))
+	}
+	for _, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	if config.IPs {
+		r.patterns = append(r.patterns, ipv4)
+	}
+	return r, nil
+}
+
+func (r *rules) replace(match []byte) []byte {
+	if r.config.Mode != "hash" {
+		return []byte(mask)
+	}
+	sum := sha256.Sum256(append([]byte(r.config.Salt), match...))
+	return []byte("<" + hex.EncodeToString(sum[:4]) + ">")
+}
+
+func (r *rules) line(line []byte) []byte {
+	if r.config.QueryNames {
+		line = query.ReplaceAllFunc(line, func(match []byte) []byte {
+			parts := query.FindSubmatch(match)
+			return append(append([]byte(nil), parts[1]...), r.replace(parts[2])...)
+		})
+	}
+	for _, re := range r.patterns {
+		line = re.ReplaceAllFunc(line, r.replace)
+	}
+	return line
+}
+
+// A Writer redacts each line written to it before passing it on. It
+// is meant to be the output of a log.Logger, which writes a line at a
+// time.
+type Writer struct {
+	out   io.Writer
+	mutex sync.RWMutex
+	rules *rules
+}
+
+// NewWriter returns a Writer to out that redacts nothing until it is
+// configured.
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{out: out, rules: &rules{}}
+}
+
+// Configure replaces what is redacted in the lines written from then
+// on. A pattern that doesn't compile is an error, and then the lines
+// go on being redacted as they were.
+func (w *Writer) Configure(config Config) error {
+	r, err := compile(config)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.rules = r
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.RLock()
+	r := w.rules
+	w.mutex.RUnlock()
+
+	var out []byte
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		out = append(out, r.line(line)...)
+	}
+	if _, err := w.out.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
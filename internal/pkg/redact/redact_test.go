@@ -0,0 +1,59 @@
+package redact
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	cases := []struct {
+		config   Config
+		line     string
+		expected string
+	}{
+		{Config{}, "DNS: QUERY db.corp.example.com. -> 10.0.0.1", "DNS: QUERY db.corp.example.com. -> 10.0.0.1"},
+		{Config{Domains: []string{"corp.example.com"}},
+			"PXY: CONNECT 127.0.0.1:5555 db.Corp.example.com:5432",
+			"PXY: CONNECT 127.0.0.1:5555 <redacted>:5432"},
+		{Config{Domains: []string{"example.com"}}, "QUERY notexample.com.", "QUERY notexample.com."},
+		{Config{IPs: true}, "BRG: service 10.96.0.10 on 8080", "BRG: service <redacted> on 8080"},
+		{Config{QueryNames: true}, "DNS: QUERY kubernetes.default. -> 10.96.0.1", "DNS: QUERY <redacted> -> 10.96.0.1"},
+		{Config{QueryNames: true}, "DNS: QTYPE[28] kubernetes.default. -> EMPTY", "DNS: QTYPE[28] <redacted> -> EMPTY"},
+		{Config{Patterns: []string{`secret-[a-z]+`}}, "KUB: watching secret-thing", "KUB: watching <redacted>"},
+		{Config{IPs: true, Mode: "hash"}, "a 10.0.0.1 b 10.0.0.1", "a <f5047344> b <f5047344>"},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if err := w.Configure(c.config); err != nil {
+			t.Fatal(err)
+		}
+		logger := log.New(w, "", 0)
+		logger.Print(c.line)
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != c.expected {
+			t.Errorf("%+v: expected %q, got %q", c.config, c.expected, got)
+		}
+	}
+}
+
+func TestConfigureInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.Configure(Config{IPs: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Configure(Config{Patterns: []string{"("}}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+	if err := w.Configure(Config{Mode: "rot13"}); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	// the previous configuration still applies
+	w.Write([]byte("1.2.3.4\n"))
+	if buf.String() != mask+"\n" {
+		t.Errorf("expected the ip to be redacted, got %q", buf.String())
+	}
+}
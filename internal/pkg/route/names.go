@@ -0,0 +1,77 @@
+package route
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The names of the addresses routes have, so that logs can say which
+// service an address belongs to. Nobody memorizes cluster ips.
+var (
+	names     = make(map[string]string)
+	namesLock sync.RWMutex
+)
+
+// Remember notes that ip is the address of the route named name.
+func Remember(ip, name string) {
+	if name == "" {
+		return
+	}
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	names[ip] = name
+}
+
+// Forget forgets that ip is the address of the route named name. The
+// address may have gone to another route since.
+func Forget(ip, name string) {
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	if names[ip] == name {
+		delete(names, ip)
+	}
+}
+
+// NameOf returns what ip is the address of, "namespace/service" for
+// kubernetes services, or "" if that isn't known.
+func NameOf(ip string) string {
+	namesLock.RLock()
+	name, ok := names[ip]
+	namesLock.RUnlock()
+	if !ok {
+		return ""
+	}
+	return Shorten(name)
+}
+
+// Shorten returns "namespace/service" for the name of the route of a
+// kubernetes service, e.g. "default/hello" for
+// "hello.default.svc.cluster.local", and other names as they are.
+func Shorten(name string) string {
+	labels := strings.Split(name, ".")
+	if len(labels) > 3 && labels[2] == "svc" {
+		return labels[1] + "/" + labels[0]
+	}
+	return name
+}
+
+var ipv4 = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+
+// Annotate appends what the addresses in line belong to, if known, as
+// in "CONNECT 10.96.0.10:80 [default/hello]".
+func Annotate(line string) string {
+	var found []string
+	seen := make(map[string]bool)
+	for _, ip := range ipv4.FindAllString(line, -1) {
+		if name := NameOf(ip); name != "" && !seen[name] {
+			seen[name] = true
+			found = append(found, name)
+		}
+	}
+	if len(found) == 0 {
+		return line
+	}
+	trimmed := strings.TrimRight(line, "\n")
+	return trimmed + " [" + strings.Join(found, ", ") + "]" + line[len(trimmed):]
+}
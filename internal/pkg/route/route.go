@@ -5,8 +5,8 @@ import (
 )
 
 type Table struct {
-	Name   string  `json:"name"`
-	Routes []Route `json:"routes"`
+	Name   string  `json:"name" yaml:"name"`
+	Routes []Route `json:"routes" yaml:"routes"`
 }
 
 func (t *Table) Add(route Route) {
@@ -14,13 +14,84 @@ func (t *Table) Add(route Route) {
 }
 
 type Route struct {
-	Name   string `json:"name,omitempty"`
-	Ip     string `json:"ip"`
-	Proto  string `json:"proto"`
-	Target string `json:"target"`
-	Action string `json:"action,omitempty"`
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Ip     string `json:"ip" yaml:"ip"`
+	Proto  string `json:"proto" yaml:"proto,omitempty"`
+	Target string `json:"target" yaml:"target,omitempty"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
 }
 
 func (r Route) Domain() string {
 	return strings.ToLower(r.Name + ".")
 }
+
+// A Delta describes how a table changed, so that large tables can be
+// updated without sending them in full.
+type Delta struct {
+	Name string `json:"name"`
+	// Upsert holds the routes that were added or changed.
+	Upsert []Route `json:"upsert,omitempty"`
+	// Remove holds the names of the routes that were removed.
+	Remove []string `json:"remove,omitempty"`
+	// Count is the number of routes in the resulting table, which
+	// lets the receiver notice that it has diverged from the
+	// sender.
+	Count int `json:"count"`
+}
+
+// Diff returns the changes that turn old into new. Routes are
+// identified by name.
+func Diff(old, new Table) Delta {
+	delta := Delta{Name: new.Name, Count: len(new.Routes)}
+	previous := make(map[string]Route, len(old.Routes))
+	for _, route := range old.Routes {
+		previous[route.Name] = route
+	}
+	for _, route := range new.Routes {
+		if p, ok := previous[route.Name]; !ok || p != route {
+			delta.Upsert = append(delta.Upsert, route)
+		}
+		delete(previous, route.Name)
+	}
+	for _, route := range old.Routes {
+		if _, ok := previous[route.Name]; ok {
+			delta.Remove = append(delta.Remove, route.Name)
+		}
+	}
+	return delta
+}
+
+// Empty reports whether the delta changes nothing.
+func (d Delta) Empty() bool {
+	return len(d.Upsert) == 0 && len(d.Remove) == 0
+}
+
+// Apply returns the result of applying the delta to t. Existing routes
+// keep their order, and new ones are appended.
+func (d Delta) Apply(t Table) Table {
+	result := Table{Name: d.Name}
+	upserts := make(map[string]Route, len(d.Upsert))
+	for _, route := range d.Upsert {
+		upserts[route.Name] = route
+	}
+	removed := make(map[string]bool, len(d.Remove))
+	for _, name := range d.Remove {
+		removed[name] = true
+	}
+	for _, route := range t.Routes {
+		if removed[route.Name] {
+			continue
+		}
+		if upsert, ok := upserts[route.Name]; ok {
+			route = upsert
+			delete(upserts, route.Name)
+		}
+		result.Add(route)
+	}
+	for _, route := range d.Upsert {
+		if _, ok := upserts[route.Name]; ok {
+			result.Add(route)
+		}
+	}
+	return result
+}
@@ -43,3 +43,58 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestDiff(t *testing.T) {
+	old := Table{Name: "table", Routes: []Route{
+		{Name: "a", Ip: "10.0.0.1", Proto: "tcp"},
+		{Name: "b", Ip: "10.0.0.2", Proto: "tcp"},
+		{Name: "c", Ip: "10.0.0.3", Proto: "tcp"},
+	}}
+	new := Table{Name: "table", Routes: []Route{
+		{Name: "a", Ip: "10.0.0.1", Proto: "tcp"},
+		{Name: "c", Ip: "10.0.0.4", Proto: "tcp"},
+		{Name: "d", Ip: "10.0.0.5", Proto: "tcp"},
+	}}
+
+	delta := Diff(old, new)
+	expected := Delta{
+		Name:   "table",
+		Upsert: []Route{new.Routes[1], new.Routes[2]},
+		Remove: []string{"b"},
+		Count:  3,
+	}
+	if !reflect.DeepEqual(delta, expected) {
+		t.Errorf("got %v, expected %v", delta, expected)
+	}
+	if applied := delta.Apply(old); !reflect.DeepEqual(applied, new) {
+		t.Errorf("got %v, expected %v", applied, new)
+	}
+	if !Diff(new, new).Empty() {
+		t.Errorf("expected no changes")
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	Remember("10.96.0.10", "hello.default.svc.cluster.local")
+	Remember("172.17.0.2", "redis")
+	defer Forget("10.96.0.10", "hello.default.svc.cluster.local")
+	defer Forget("172.17.0.2", "redis")
+
+	for line, expected := range map[string]string{
+		"CONNECT 127.0.0.1:5555 10.96.0.10:80\n":   "CONNECT 127.0.0.1:5555 10.96.0.10:80 [default/hello]\n",
+		"-A teleproxy --dest 172.17.0.2/32 -p tcp": "-A teleproxy --dest 172.17.0.2/32 -p tcp [redis]",
+		"QUERY hello -> 10.96.0.10 and 10.96.0.10": "QUERY hello -> 10.96.0.10 and 10.96.0.10 [default/hello]",
+		"QUERY example.com -> 93.184.216.34":       "QUERY example.com -> 93.184.216.34",
+	} {
+		if annotated := Annotate(line); annotated != expected {
+			t.Errorf("expected %q, got %q", expected, annotated)
+		}
+	}
+
+	Remember("10.96.0.10", "web.default.svc.cluster.local")
+	Forget("10.96.0.10", "hello.default.svc.cluster.local")
+	if name := NameOf("10.96.0.10"); name != "default/web" {
+		t.Errorf("expected the address to have moved to default/web, got %q", name)
+	}
+	Forget("10.96.0.10", "web.default.svc.cluster.local")
+}
@@ -0,0 +1,163 @@
+// Package session makes sure only one teleproxy at a time manages
+// the DNS and firewall state of a machine.
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Owner describes the process holding a session.
+type Owner struct {
+	Pid     int       `json:"pid"`
+	User    string    `json:"user"`
+	Mode    string    `json:"mode"`
+	Started time.Time `json:"started"`
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("pid %d (user %s, mode %q, started %s)", o.Pid, o.User, o.Mode, o.Started.Format(time.RFC3339))
+}
+
+// A Session is held for as long as its lock file is open. The kernel
+// drops the lock when the process dies, so a crashed teleproxy never
+// leaves a stale session behind.
+type Session struct {
+	path string
+	file *os.File
+}
+
+// BusyError is returned by Acquire when another process holds the
+// session.
+type BusyError struct {
+	Owner Owner
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("another teleproxy session is active: %s", e.Owner)
+}
+
+// Acquire takes the session lock at path and records ourselves as its
+// owner. The user is the name of whoever started us.
+func Acquire(path, username, mode string) (*Session, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			owner, _ := Read(path)
+			return nil, &BusyError{owner}
+		}
+		return nil, err
+	}
+
+	owner := Owner{
+		Pid:     os.Getpid(),
+		User:    username,
+		Mode:    mode,
+		Started: time.Now(),
+	}
+	content, err := json.Marshal(owner)
+	if err != nil {
+		panic(err)
+	}
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt(append(content, '\n'), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Session{path, file}, nil
+}
+
+// Read returns the owner recorded in the lock file at path.
+func Read(path string) (owner Owner, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &owner)
+	return
+}
+
+// Takeover asks the owner of the session at path to shut down and
+// waits for it to release the session, after which Acquire will
+// succeed. Teleproxy cleans up its DNS and firewall changes on
+// SIGTERM, so this is the same as the owner stopping normally.
+func Takeover(path string, timeout time.Duration) (Owner, error) {
+	owner, err := Read(path)
+	if err != nil {
+		return owner, err
+	}
+	if owner.Pid == 0 || owner.Pid == os.Getpid() {
+		return owner, fmt.Errorf("invalid session owner: %s", owner)
+	}
+
+	process, err := os.FindProcess(owner.Pid)
+	if err != nil {
+		return owner, err
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		// it's already gone
+		return owner, nil
+	}
+
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(100 * time.Millisecond) {
+		if !held(path) {
+			return owner, nil
+		}
+	}
+	return owner, fmt.Errorf("timed out waiting for %s to shut down", owner)
+}
+
+// Running returns the owner of the session at path, if someone holds
+// it.
+func Running(path string) (Owner, bool) {
+	if !held(path) {
+		return Owner{}, false
+	}
+	owner, err := Read(path)
+	return owner, err == nil
+}
+
+// held reports whether someone holds the lock at path.
+func held(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return true
+	}
+	return false
+}
+
+// Release gives up the session. The lock file is left in place since
+// removing it could let two processes lock different files.
+func (s *Session) Release() {
+	s.file.Close()
+}
+
+// Username returns the name of the user who started us, looking
+// through sudo.
+func Username() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	u, err := user.Current()
+	if err != nil {
+		return strconv.Itoa(os.Getuid())
+	}
+	return u.Username
+}
@@ -0,0 +1,38 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teleproxy.lock")
+
+	s, err := Acquire(path, "alice", "intercept")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(path, "bob", "intercept")
+	busy, ok := err.(*BusyError)
+	if !ok {
+		t.Fatalf("expected a BusyError, got %v", err)
+	}
+	if busy.Owner.User != "alice" || busy.Owner.Pid != os.Getpid() {
+		t.Errorf("unexpected owner: %s", busy.Owner)
+	}
+
+	s.Release()
+	s, err = Acquire(path, "bob", "intercept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Release()
+}
@@ -0,0 +1,181 @@
+// Package shaping looks up how to slow relayed traffic down, by
+// destination, so that a service developed locally sees its
+// dependencies in the cluster about as far away as they are from
+// inside it, rather than at the speed of localhost.
+package shaping
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/jsonfile"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+)
+
+// A Rate is a bandwidth in bytes a second, written in bits a second as
+// e.g. "10mbit" in json, as tc does.
+type Rate int64
+
+var units = []struct {
+	suffix string
+	bits   int64
+}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	bits := int64(r) * 8
+	for _, u := range units {
+		if bits%u.bits == 0 {
+			return json.Marshal(strconv.FormatInt(bits/u.bits, 10) + u.suffix)
+		}
+	}
+	return json.Marshal(strconv.FormatInt(bits, 10) + "bit")
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// ParseRate parses a bandwidth such as "512kbit" or "1.5mbit".
+func ParseRate(s string) (Rate, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(lower, u.suffix), 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return Rate(n * float64(u.bits) / 8), nil
+		}
+	}
+	return 0, fmt.Errorf("bad bandwidth %q, expected e.g. 10mbit", s)
+}
+
+// A Shape is how traffic is slowed down. Zero leaves it as it is.
+type Shape struct {
+	// Latency is how much longer a round trip takes: connections
+	// take that long to open, and what is sent takes half of it to
+	// arrive, each way.
+	Latency timeouts.Duration `json:"latency,omitempty"`
+	// Bandwidth is how fast what is sent may go, each way.
+	Bandwidth Rate `json:"bandwidth,omitempty"`
+}
+
+// Zero reports whether s leaves traffic as it is.
+func (s Shape) Zero() bool {
+	return s.Latency <= 0 && s.Bandwidth <= 0
+}
+
+func (s Shape) String() string {
+	var parts []string
+	if s.Latency > 0 {
+		parts = append(parts, "latency "+time.Duration(s.Latency).String())
+	}
+	if s.Bandwidth > 0 {
+		data, _ := s.Bandwidth.MarshalJSON()
+		parts = append(parts, "bandwidth "+strings.Trim(string(data), `"`))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A Rule applies its Shape to the destinations it matches, which are
+// matched as the rules of timeouts are.
+type Rule struct {
+	Match []string `json:"match"`
+	Shape
+}
+
+// Config has the default Shape, and then Rules for particular
+// destinations, the first of which to match (and set a latency, or a
+// bandwidth) wins.
+type Config struct {
+	Shape
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// ReadConfig reads the latency and bandwidth of all traffic, and of
+// the rules by destination, from filename.
+func ReadConfig(filename string) (config Config, err error) {
+	err = jsonfile.Read(filename, &config)
+	return
+}
+
+type rule struct {
+	matcher *timeouts.Matcher
+	shape   Shape
+}
+
+// A Table looks up the Shape of destinations. A nil Table leaves
+// everything as it is.
+type Table struct {
+	mutex    sync.RWMutex
+	defaults Shape
+	rules    []rule
+}
+
+// NewTable returns a Table for config.
+func NewTable(config Config) (*Table, error) {
+	t := &Table{}
+	if err := t.Configure(config); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Configure replaces the shapes of the connections relayed from then
+// on, those relayed already keep the shape they started with. If a
+// rule doesn't parse, the table is left as it was.
+func (t *Table) Configure(config Config) error {
+	var rules []rule
+	for _, r := range config.Rules {
+		matcher, err := timeouts.NewMatcher(r.Match)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule{matcher, r.Shape})
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.defaults = config.Shape
+	t.rules = rules
+	return nil
+}
+
+// Lookup returns the Shape of traffic to destination, which is a name
+// or an address, with or without a port.
+func (t *Table) Lookup(destination string) Shape {
+	if t == nil {
+		return Shape{}
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	shape := t.defaults
+	var latency, bandwidth bool
+	for _, r := range t.rules {
+		if (latency || r.shape.Latency <= 0) && (bandwidth || r.shape.Bandwidth <= 0) {
+			continue
+		}
+		if !r.matcher.Matches(destination) {
+			continue
+		}
+		if !latency && r.shape.Latency > 0 {
+			shape.Latency, latency = r.shape.Latency, true
+		}
+		if !bandwidth && r.shape.Bandwidth > 0 {
+			shape.Bandwidth, bandwidth = r.shape.Bandwidth, true
+		}
+	}
+	return shape
+}
@@ -0,0 +1,69 @@
+package shaping
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+)
+
+const config = `{
+	"latency": "1ms",
+	"rules": [
+		{"match": ["*.db.svc.cluster.local", "10.0.0.0/8:5432"], "latency": "20ms", "bandwidth": "100mbit"},
+		{"match": ["data/*"], "bandwidth": "1.5mbit"}
+	]
+}`
+
+func TestTable(t *testing.T) {
+	var c Config
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Remember("10.1.2.3", "warehouse.data.svc.cluster.local")
+	defer route.Forget("10.1.2.3", "warehouse.data.svc.cluster.local")
+
+	ms := func(n int) timeouts.Duration { return timeouts.Duration(time.Duration(n) * time.Millisecond) }
+	for _, c := range []struct {
+		destination string
+		expected    Shape
+	}{
+		{"pg.db.svc.cluster.local:5432", Shape{ms(20), 12500000}},
+		{"10.9.9.9:5432", Shape{ms(20), 12500000}},
+		{"10.9.9.9:80", Shape{ms(1), 0}},
+		// by the name of its route
+		{"10.1.2.3:8080", Shape{ms(1), 187500}},
+	} {
+		if shape := table.Lookup(c.destination); shape != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.destination, c.expected, shape)
+		}
+	}
+
+	var none *Table
+	if shape := none.Lookup("10.9.9.9:80"); !shape.Zero() {
+		t.Errorf("expected a nil table to leave traffic alone, got %v", shape)
+	}
+}
+
+func TestRate(t *testing.T) {
+	for s, expected := range map[string]Rate{"8bit": 1, "512kbit": 64000, "1.5mbit": 187500, "1Gbit": 125000000} {
+		if r, err := ParseRate(s); err != nil || r != expected {
+			t.Errorf("%s: expected %d, got %d, %v", s, expected, r, err)
+		}
+	}
+	for _, s := range []string{"10", "10mb", "-1mbit", "mbit"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+	data, err := json.Marshal(Rate(187500))
+	if err != nil || string(data) != `"1500kbit"` {
+		t.Errorf(`expected "1500kbit", got %s, %v`, data, err)
+	}
+}
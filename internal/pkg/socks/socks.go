@@ -0,0 +1,482 @@
+// Package socks is a SOCKS5 proxy in front of the tunnel into the
+// cluster. The tunnel is ssh's dynamic forward, which only speaks
+// CONNECT, so clients that try UDP ASSOCIATE (for dns, or quic) get
+// nowhere with it. This proxy relays CONNECT to the tunnel and answers
+// UDP ASSOCIATE itself: dns queries are relayed into the cluster over
+// tcp, which the tunnel can carry, and other datagrams are dropped
+// with a log line, since there is no way to get them into the cluster.
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+const (
+	version = 5
+
+	cmdConnect   = 1
+	cmdBind      = 2
+	cmdAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	methodNone = 0
+	// MethodToken is the method, one for private use, that clients
+	// of a policy server log in with: the length of a bearer token,
+	// two bytes, then the token, which RFC 1929 passwords are too
+	// short for. The server answers 1 and 0 if it let them in.
+	MethodToken    = 0x80
+	methodRejected = 0xff
+
+	repSucceeded       = 0
+	repFailure         = 1
+	repNotAllowed      = 2
+	repRefused         = 5
+	repNotSupported    = 7
+	repAddrUnsupported = 8
+)
+
+// how long a relayed dns query may take
+const dnsTimeout = 5 * time.Second
+
+type Server struct {
+	listener net.Listener
+	// dial connects through the tunnel. It is a field so tests can
+	// substitute a direct dial.
+	dial    func(network, address string) (net.Conn, error)
+	policy  Policy
+	stopped chan struct{}
+
+	mutex   sync.Mutex
+	dropped map[string]bool
+}
+
+// NewServer listens on address as a SOCKS5 proxy relaying to the one
+// (the tunnel) at upstream.
+func NewServer(address, upstream string) (*Server, error) {
+	dialer, err := proxy.SOCKS5("tcp", upstream, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return NewDialServer(address, dialer.Dial)
+}
+
+// NewDialServer listens on address as a SOCKS5 proxy that connects
+// with dial, for tunnels that aren't SOCKS5 proxies themselves.
+func NewDialServer(address string, dial func(network, address string) (net.Conn, error)) (*Server, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		listener: ln,
+		dial:     dial,
+		stopped:  make(chan struct{}),
+		dropped:  make(map[string]bool),
+	}, nil
+}
+
+// A Policy has clients log in with a bearer token, and decides where
+// each may connect to.
+type Policy interface {
+	// Login returns who token is for, or why they may not log in.
+	Login(token string) (who string, err error)
+	// Allow returns why who may not connect to host, if they may not.
+	Allow(who, host string) error
+}
+
+// NewPolicyServer listens on address as a SOCKS5 proxy that connects
+// with dial, for clients that log in as policy says, and only to where
+// it lets them. There is no UDP ASSOCIATE.
+func NewPolicyServer(address string, dial func(network, address string) (net.Conn, error), policy Policy) (*Server, error) {
+	s, err := NewDialServer(address, dial)
+	if err != nil {
+		return nil, err
+	}
+	s.policy = policy
+	return s, nil
+}
+
+func (s *Server) log(line string, args ...interface{}) {
+	log.Print(route.Annotate(fmt.Sprintf("SOX: "+line, args...)))
+}
+
+// Addr returns the address the proxy listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Start() {
+	s.log("listening on %s", s.Addr())
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				select {
+				case <-s.stopped:
+					return
+				default:
+				}
+				s.log(err.Error())
+				continue
+			}
+			go s.handle(conn)
+		}
+	}()
+}
+
+// Stop closes the listener. Connections and associations already
+// relayed last until their clients close them.
+func (s *Server) Stop() {
+	close(s.stopped)
+	s.listener.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	cmd, host, who, err := s.handshake(conn)
+	if err != nil {
+		s.log("%s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	switch {
+	case cmd == cmdConnect && s.policy != nil:
+		if err := s.policy.Allow(who, host); err != nil {
+			s.log("CONNECT %s: refused %s: %v", host, who, err)
+			reply(conn, repNotAllowed, nil)
+			return
+		}
+		s.connect(conn, host)
+	case cmd == cmdConnect:
+		s.connect(conn, host)
+	case cmd == cmdAssociate && s.policy == nil:
+		s.associate(conn)
+	default:
+		reply(conn, repNotSupported, nil)
+	}
+}
+
+// handshake negotiates no authentication, or with a policy, a login,
+// and reads the request.
+func (s *Server) handshake(conn net.Conn) (cmd byte, host, who string, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	if head[0] != version {
+		return 0, "", "", fmt.Errorf("socks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(methodNone)
+	if s.policy != nil {
+		method = MethodToken
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{version, methodRejected})
+		return 0, "", "", errors.New("no acceptable authentication method")
+	}
+	if _, err = conn.Write([]byte{version, method}); err != nil {
+		return
+	}
+	if s.policy != nil {
+		if who, err = s.login(conn); err != nil {
+			return
+		}
+	}
+
+	var request [3]byte
+	if _, err = io.ReadFull(conn, request[:]); err != nil {
+		return
+	}
+	host, err = readAddr(conn)
+	if err == errAddrType {
+		reply(conn, repAddrUnsupported, nil)
+	}
+	return request[1], host, who, err
+}
+
+// login reads the token the client logs in with, and tells it whether
+// the policy let it in.
+func (s *Server) login(conn net.Conn) (string, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return "", err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return "", err
+	}
+	who, err := s.policy.Login(string(token))
+	if err != nil {
+		conn.Write([]byte{1, 1})
+		return "", fmt.Errorf("login: %v", err)
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return who, err
+}
+
+var errAddrType = errors.New("unsupported address type")
+
+// ErrLoginRefused is what Relay returns if the policy server doesn't
+// let the token in.
+var ErrLoginRefused = errors.New("login refused")
+
+// readAddr reads a socks address and port as host:port.
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendAddr appends a socks address for addr, an ip and port.
+func appendAddr(b []byte, addr *net.UDPAddr) []byte {
+	if addr == nil {
+		return append(b, atypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	if ip := addr.IP.To4(); ip != nil {
+		b = append(append(b, atypIPv4), ip...)
+	} else {
+		b = append(append(b, atypIPv6), addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+func reply(conn net.Conn, rep byte, bound *net.UDPAddr) error {
+	_, err := conn.Write(appendAddr([]byte{version, rep, 0}, bound))
+	return err
+}
+
+func (s *Server) connect(conn net.Conn, host string) {
+	upstream, err := s.dial("tcp", host)
+	if err != nil {
+		s.log("CONNECT %s: %v", host, err)
+		reply(conn, repRefused, nil)
+		return
+	}
+	defer upstream.Close()
+	if err := reply(conn, repSucceeded, nil); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(from, to net.Conn) {
+		io.Copy(to, from)
+		if half, ok := to.(interface{ CloseWrite() error }); ok {
+			half.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go relay(conn, upstream)
+	go relay(upstream, conn)
+	<-done
+	<-done
+}
+
+// associate relays the client's datagrams for as long as conn, the
+// connection it asked on, stays open.
+func (s *Server) associate(conn net.Conn) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	client := conn.RemoteAddr().(*net.TCPAddr)
+	packets, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		s.log("UDP ASSOCIATE %s: %v", client, err)
+		reply(conn, repFailure, nil)
+		return
+	}
+	defer packets.Close()
+	if err := reply(conn, repSucceeded, packets.LocalAddr().(*net.UDPAddr)); err != nil {
+		return
+	}
+	s.log("UDP ASSOCIATE %s on %s", client, packets.LocalAddr())
+
+	go func() {
+		// the client sends nothing more on conn, it just closes it
+		io.Copy(ioutil.Discard, conn)
+		packets.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := packets.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// only the client may use the association
+		if !from.IP.Equal(client.IP) {
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		go s.datagram(packets, from, datagram)
+	}
+}
+
+// datagram relays one of the client's datagrams, which start with the
+// socks udp request header.
+func (s *Server) datagram(packets *net.UDPConn, from *net.UDPAddr, datagram []byte) {
+	if len(datagram) < 4 || datagram[2] != 0 {
+		// fragments aren't worth reassembling for dns, which is all
+		// that gets through
+		return
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, err := readAddr(r)
+	if err != nil {
+		return
+	}
+	header, payload := datagram[:len(datagram)-r.Len()], datagram[len(datagram)-r.Len():]
+	_, port, _ := net.SplitHostPort(host)
+	if port != "53" {
+		s.drop(host)
+		return
+	}
+	answer, err := s.query(host, payload)
+	if err != nil {
+		s.log("UDP %s: %v", host, err)
+		return
+	}
+	packets.WriteToUDP(append(append([]byte{}, header...), answer...), from)
+}
+
+func (s *Server) drop(host string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dropped[host] {
+		s.dropped[host] = true
+		s.log("UDP %s: dropping datagrams, the tunnel only carries tcp (and dns)", host)
+	}
+}
+
+// query relays a dns query to host over tcp, where messages are
+// prefixed with their length.
+func (s *Server) query(host string, msg []byte) ([]byte, error) {
+	conn, err := s.dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+	if _, err := conn.Write(append(length[:], msg...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Relay hands the client on conn, which negotiates no authentication,
+// to the policy server on upstream, logging in with token for it. It
+// returns once the server answered the client's request, with the host
+// asked for and whether the policy refused it; the caller relays the
+// rest.
+func Relay(conn, upstream net.Conn, token string) (host string, refused bool, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, make([]byte, head[1])); err != nil {
+		return
+	}
+	if _, err = conn.Write([]byte{version, methodNone}); err != nil {
+		return
+	}
+
+	var request bytes.Buffer
+	if _, err = io.CopyN(&request, conn, 3); err != nil {
+		return
+	}
+	if host, err = readAddr(io.TeeReader(conn, &request)); err != nil {
+		return
+	}
+	if len(token) > 0xffff {
+		return host, false, errors.New("token too long")
+	}
+	login := []byte{version, 1, MethodToken, byte(len(token) >> 8), byte(len(token))}
+	if _, err = upstream.Write(append(login, token...)); err != nil {
+		return
+	}
+	var answer [2]byte
+	if _, err = io.ReadFull(upstream, answer[:]); err != nil {
+		return
+	}
+	if answer[1] == MethodToken {
+		_, err = io.ReadFull(upstream, answer[:])
+	}
+	if err != nil || answer[0] != 1 || answer[1] != 0 {
+		reply(conn, repFailure, nil)
+		return host, false, ErrLoginRefused
+	}
+
+	if _, err = upstream.Write(request.Bytes()); err != nil {
+		return
+	}
+	var response bytes.Buffer
+	if _, err = io.CopyN(&response, upstream, 3); err != nil {
+		return
+	}
+	if _, err = readAddr(io.TeeReader(upstream, &response)); err != nil {
+		return
+	}
+	_, err = conn.Write(response.Bytes())
+	return host, response.Bytes()[1] == repNotAllowed, err
+}
@@ -0,0 +1,249 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server whose "tunnel" dials everything at
+// backend.
+func newTestServer(t *testing.T, backend string) *Server {
+	s, err := NewServer("127.0.0.1:0", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dial = func(network, address string) (net.Conn, error) {
+		return net.Dial(network, backend)
+	}
+	s.Start()
+	return s
+}
+
+func TestConnect(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	s := newTestServer(t, backend.Addr().String())
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{version, 1, 0})
+	name := "hello.default"
+	conn.Write(append(append([]byte{version, cmdConnect, 0, atypDomain, byte(len(name))}, name...), 0, 80))
+	var resp [2 + 10]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		t.Fatal(err)
+	}
+	if resp[3] != repSucceeded {
+		t.Fatalf("connect: reply %d", resp[3])
+	}
+	body, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("got %q", body)
+	}
+}
+
+// associate asks s for a udp association, returning the control
+// connection and where to send datagrams.
+func associate(t *testing.T, s *Server) (net.Conn, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{version, 1, 0})
+	conn.Write([]byte{version, cmdAssociate, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	var resp [2 + 10]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		t.Fatal(err)
+	}
+	if resp[3] != repSucceeded {
+		t.Fatalf("associate: reply %d", resp[3])
+	}
+	return conn, &net.UDPAddr{
+		IP:   net.IP(resp[6:10]),
+		Port: int(binary.BigEndian.Uint16(resp[10:12])),
+	}
+}
+
+func TestAssociateDNS(t *testing.T) {
+	// a dns server over tcp, that answers with the query reversed
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length [2]byte
+		io.ReadFull(conn, length[:])
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		io.ReadFull(conn, query)
+		for i, j := 0, len(query)-1; i < j; i, j = i+1, j-1 {
+			query[i], query[j] = query[j], query[i]
+		}
+		conn.Write(append(length[:], query...))
+	}()
+
+	s := newTestServer(t, backend.Addr().String())
+	defer s.Stop()
+	control, relay := associate(t, s)
+	defer control.Close()
+
+	packets, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packets.Close()
+	header := []byte{0, 0, 0, atypIPv4, 10, 96, 0, 10, 0, 53}
+	if _, err := packets.WriteToUDP(append(header, "query"...), relay); err != nil {
+		t.Fatal(err)
+	}
+	packets.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, _, err := packets.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(header, "yreuq"...); !bytes.Equal(buf[:n], expected) {
+		t.Errorf("got %v, expected %v", buf[:n], expected)
+	}
+}
+
+func TestAssociateDrops(t *testing.T) {
+	s := newTestServer(t, "127.0.0.1:1")
+	defer s.Stop()
+	control, relay := associate(t, s)
+	defer control.Close()
+
+	packets, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packets.Close()
+	header := []byte{0, 0, 0, atypIPv4, 10, 96, 0, 10, 1, 187}
+	packets.WriteToUDP(append(header, "quic"...), relay)
+	packets.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := packets.ReadFromUDP(make([]byte, 512)); err == nil {
+		t.Error("expected the datagram to be dropped")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dropped["10.96.0.10:443"] {
+		t.Errorf("drop of 10.96.0.10:443 not noted: %v", s.dropped)
+	}
+}
+
+type testPolicy struct{}
+
+func (testPolicy) Login(token string) (string, error) {
+	if token != "alice's token" {
+		return "", errors.New("who are you")
+	}
+	return "alice", nil
+}
+
+func (testPolicy) Allow(who, host string) error {
+	if who != "alice" || host != "hello.default:80" {
+		return errors.New("not there")
+	}
+	return nil
+}
+
+// relay has a client connect to host through a policy server for
+// backend, relayed with token, and returns what Relay said and what
+// the client read.
+func relay(t *testing.T, backend, token, host string) (bool, error, string) {
+	s, err := NewPolicyServer("127.0.0.1:0", func(network, address string) (net.Conn, error) {
+		return net.Dial(network, backend)
+	}, testPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	upstream, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	type result struct {
+		refused bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer conn.Close()
+		_, refused, err := Relay(conn, upstream, token)
+		done <- result{refused, err}
+		if err == nil {
+			io.Copy(conn, upstream)
+		}
+	}()
+	client.Write([]byte{version, 1, 0})
+	var resp [2 + 10]byte
+	io.ReadFull(client, resp[:2])
+	client.Write(append(append([]byte{version, cmdConnect, 0, atypDomain, byte(len(host))}, host...), 0, 80))
+	io.ReadFull(client, resp[2:])
+	body, _ := ioutil.ReadAll(client)
+	r := <-done
+	return r.refused, r.err, string(body)
+}
+
+func TestPolicy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	if refused, err, body := relay(t, backend.Addr().String(), "alice's token", "hello.default"); refused || err != nil || body != "hello" {
+		t.Errorf("allowed: refused %v, %v, got %q", refused, err, body)
+	}
+	if refused, err, body := relay(t, backend.Addr().String(), "alice's token", "secret.prod"); !refused || err != nil || body != "" {
+		t.Errorf("not allowed: refused %v, %v, got %q", refused, err, body)
+	}
+	if refused, err, body := relay(t, backend.Addr().String(), "mallory's token", "hello.default"); refused || err != ErrLoginRefused || body != "" {
+		t.Errorf("not logged in: refused %v, %v, got %q", refused, err, body)
+	}
+}
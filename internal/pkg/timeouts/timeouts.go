@@ -0,0 +1,256 @@
+// Package timeouts looks up how long to wait for what, by destination,
+// so that e.g. a database behind the tunnel can have a longer idle
+// timeout than everything else.
+package timeouts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/jsonfile"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// A Duration is a time.Duration that is written as e.g. "30s" in
+// json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Timeouts are how long to wait for each thing. Zero leaves it to
+// whatever waits, which uses its own default.
+type Timeouts struct {
+	// Dial is how long connecting through the tunnel may take.
+	Dial Duration `json:"dial,omitempty"`
+	// Idle is how long a relayed tcp connection may go without
+	// anything sent either way before it is closed.
+	Idle Duration `json:"idle,omitempty"`
+	// UDPFlow is how long a relayed udp flow may go without a
+	// packet before it is forgotten.
+	UDPFlow Duration `json:"udp_flow,omitempty"`
+	// DNSQuery is how long a dns query may take.
+	DNSQuery Duration `json:"dns_query,omitempty"`
+}
+
+// A Rule applies its Timeouts to the destinations it matches.
+type Rule struct {
+	// Match lists patterns of destinations. A pattern is a glob
+	// (as in path.Match) of names, "namespace/service" names of
+	// services included, or of addresses, or a cidr. It may end in
+	// ":port" to match only that port.
+	Match []string `json:"match"`
+	Timeouts
+}
+
+// Config has the default Timeouts, and then Rules for particular
+// destinations, the first of which to match (and set a timeout) wins.
+type Config struct {
+	Timeouts
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// ReadConfig reads the default timeouts, and those of the rules by
+// destination, from filename.
+func ReadConfig(filename string) (config Config, err error) {
+	err = jsonfile.Read(filename, &config)
+	return
+}
+
+type pattern struct {
+	glob string
+	cidr *net.IPNet
+	port string
+}
+
+func parse(s string) (p pattern, err error) {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		s, p.port = host, port
+	}
+	if strings.Contains(s, "/") {
+		if _, cidr, err := net.ParseCIDR(s); err == nil {
+			p.cidr = cidr
+			return p, nil
+		}
+	}
+	p.glob = strings.ToLower(strings.TrimSuffix(s, "."))
+	_, err = path.Match(p.glob, "")
+	if err != nil {
+		err = fmt.Errorf("bad pattern %q: %v", s, err)
+	}
+	return
+}
+
+func (p pattern) matches(host, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+	if p.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && p.cidr.Contains(ip)
+	}
+	ok, _ := path.Match(p.glob, host)
+	return ok
+}
+
+// A Matcher matches destinations against the patterns of a Match, so
+// that other settings can be looked up by destination the same way.
+type Matcher struct {
+	patterns []pattern
+}
+
+// NewMatcher returns a Matcher for patterns, as in Rule.Match.
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, s := range patterns {
+		p, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return m, nil
+}
+
+// Matches reports whether destination, a name or an address, with or
+// without a port, matches any of the patterns. Addresses also match by
+// the name of their route, if they have one.
+func (m *Matcher) Matches(destination string) bool {
+	hosts, port := split(destination)
+	return m.matches(hosts, port)
+}
+
+func (m *Matcher) matches(hosts []string, port string) bool {
+	for _, p := range m.patterns {
+		for _, h := range hosts {
+			if p.matches(h, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// split returns the names destination goes by, and its port, if any.
+func split(destination string) (hosts []string, port string) {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	hosts = []string{host}
+	if name := route.NameOf(host); name != "" {
+		hosts = append(hosts, name)
+	}
+	return hosts, port
+}
+
+type rule struct {
+	matcher  *Matcher
+	timeouts Timeouts
+}
+
+// A Table looks up the Timeouts of destinations. A nil Table has no
+// timeouts of its own.
+type Table struct {
+	mutex    sync.RWMutex
+	defaults Timeouts
+	rules    []rule
+}
+
+// NewTable returns a Table for config.
+func NewTable(config Config) (*Table, error) {
+	t := &Table{}
+	if err := t.Configure(config); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Configure replaces the timeouts of the dials and idle connections
+// that look them up from then on. If a rule doesn't parse, the table
+// is left as it was.
+func (t *Table) Configure(config Config) error {
+	var rules []rule
+	for _, r := range config.Rules {
+		matcher, err := NewMatcher(r.Match)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule{matcher, r.Timeouts})
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.defaults = config.Timeouts
+	t.rules = rules
+	return nil
+}
+
+// lookup returns the timeout that get picks out, for destination,
+// which is a name or an address, with or without a port. Addresses
+// also match by the name of their route, if they have one.
+func (t *Table) lookup(destination string, fallback time.Duration, get func(Timeouts) Duration) time.Duration {
+	if t == nil {
+		return fallback
+	}
+	hosts, port := split(destination)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, r := range t.rules {
+		d := get(r.timeouts)
+		if d == 0 {
+			continue
+		}
+		if r.matcher.matches(hosts, port) {
+			return time.Duration(d)
+		}
+	}
+	if d := get(t.defaults); d != 0 {
+		return time.Duration(d)
+	}
+	return fallback
+}
+
+// Dial returns how long connecting to destination may take, or
+// fallback if that isn't configured.
+func (t *Table) Dial(destination string, fallback time.Duration) time.Duration {
+	return t.lookup(destination, fallback, func(t Timeouts) Duration { return t.Dial })
+}
+
+// Idle returns how long a connection to destination may be idle for,
+// or fallback if that isn't configured.
+func (t *Table) Idle(destination string, fallback time.Duration) time.Duration {
+	return t.lookup(destination, fallback, func(t Timeouts) Duration { return t.Idle })
+}
+
+// UDPFlow returns how long a udp flow to destination may be idle for,
+// or fallback if that isn't configured.
+func (t *Table) UDPFlow(destination string, fallback time.Duration) time.Duration {
+	return t.lookup(destination, fallback, func(t Timeouts) Duration { return t.UDPFlow })
+}
+
+// DNSQuery returns how long a query for the name destination may take,
+// or fallback if that isn't configured.
+func (t *Table) DNSQuery(destination string, fallback time.Duration) time.Duration {
+	return t.lookup(destination, fallback, func(t Timeouts) Duration { return t.DNSQuery })
+}
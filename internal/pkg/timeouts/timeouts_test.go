@@ -0,0 +1,72 @@
+package timeouts
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+const config = `{
+	"dial": "10s",
+	"dns_query": "2s",
+	"rules": [
+		{"match": ["10.0.0.0/8:5432", "*.db.svc.cluster.local"], "idle": "1h"},
+		{"match": ["data/*"], "idle": "10m", "dial": "30s"},
+		{"match": ["*.slow.example.com"], "dns_query": "10s"}
+	]
+}`
+
+func TestTable(t *testing.T) {
+	var c Config
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.Remember("10.1.2.3", "warehouse.data.svc.cluster.local")
+	defer route.Forget("10.1.2.3", "warehouse.data.svc.cluster.local")
+
+	for _, c := range []struct {
+		get         func(string, time.Duration) time.Duration
+		destination string
+		expected    time.Duration
+	}{
+		{table.Dial, "10.9.9.9:80", 10 * time.Second},
+		{table.Idle, "10.9.9.9:80", 0},
+		{table.Idle, "10.9.9.9:5432", time.Hour},
+		{table.Idle, "pg.db.svc.cluster.local:5432", time.Hour},
+		{table.Idle, "PG.db.svc.cluster.local.", time.Hour},
+		// by the name of its route
+		{table.Idle, "10.1.2.3:8080", 10 * time.Minute},
+		{table.Dial, "10.1.2.3:8080", 30 * time.Second},
+		{table.DNSQuery, "api.slow.example.com.", 10 * time.Second},
+		{table.DNSQuery, "example.com.", 2 * time.Second},
+		{table.UDPFlow, "10.9.9.9:53", 0},
+	} {
+		if d := c.get(c.destination, 0); d != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.destination, c.expected, d)
+		}
+	}
+}
+
+func TestNilTable(t *testing.T) {
+	var table *Table
+	if d := table.UDPFlow("10.0.0.1:53", 30*time.Second); d != 30*time.Second {
+		t.Errorf("expected the fallback, got %s", d)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	table, _ := NewTable(Config{Timeouts: Timeouts{Idle: Duration(time.Minute)}})
+	err := table.Configure(Config{Rules: []Rule{{Match: []string{"[bad"}, Timeouts: Timeouts{Idle: Duration(time.Second)}}}})
+	if err == nil {
+		t.Error("expected a bad pattern to be rejected")
+	}
+	if d := table.Idle("10.0.0.1:80", 0); d != time.Minute {
+		t.Errorf("expected the previous timeouts to be kept, got %s", d)
+	}
+}
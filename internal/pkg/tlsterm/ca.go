@@ -0,0 +1,190 @@
+// Package tlsterm issues certificates from a local certificate
+// authority, so that teleproxy can terminate TLS for cluster services
+// with certificates the laptop trusts.
+package tlsterm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDir is where the authority is kept.
+const DefaultDir = "/var/lib/teleproxy"
+
+const (
+	certName = "ca.pem"
+	keyName  = "ca-key.pem"
+	// leaves are reissued on every run, so they can be short
+	// lived
+	leafLifetime = 7 * 24 * time.Hour
+	caLifetime   = 10 * 365 * 24 * time.Hour
+)
+
+// A CA is a locally trusted certificate authority.
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mutex  sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// LoadCA loads the authority kept in dir, creating one the first time.
+func LoadCA(dir string) (*CA, error) {
+	ca := &CA{dir: dir, leaves: make(map[string]*tls.Certificate)}
+	certPEM, err := ioutil.ReadFile(ca.CertFile())
+	if os.IsNotExist(err) {
+		return ca, ca.create()
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, keyName))
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if ca.key, ok = pair.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		return nil, errors.New("unexpected key type for " + ca.CertFile())
+	}
+	return ca, nil
+}
+
+// CertFile is the file the authority's certificate is kept in, which
+// is what needs to be trusted.
+func (ca *CA) CertFile() string {
+	return filepath.Join(ca.dir, certName)
+}
+
+func (ca *CA) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{Organization: []string{"teleproxy local CA"}, CommonName: "teleproxy " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// it only ever signs leaves
+		MaxPathLenZero: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	ca.key = key
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ca.dir, 0755); err != nil {
+		return err
+	}
+	// anyone holding the key can impersonate any site to us
+	if err := ioutil.WriteFile(filepath.Join(ca.dir, keyName), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ca.CertFile(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Certificate returns a certificate for name signed by the authority.
+func (ca *CA) Certificate(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if leaf, ok := ca.leaves[name]; ok && time.Now().Before(leaf.Leaf.NotAfter.Add(-time.Hour)) {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{Organization: []string{"teleproxy"}, CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	ca.leaves[name] = cert
+	return cert, nil
+}
+
+// Matcher returns whether a name matches one of the patterns, which
+// are names or wildcards like "*.svc.cluster.local" that match every
+// name under a domain.
+func Matcher(patterns []string) func(name string) bool {
+	var normalized []string
+	for _, pattern := range patterns {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(pattern, ".")))
+	}
+	return func(name string) bool {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, pattern := range normalized {
+			if strings.HasPrefix(pattern, "*.") {
+				if strings.HasSuffix(name, pattern[1:]) {
+					return true
+				}
+			} else if name == pattern {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package tlsterm
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	created, err := LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second time around it is loaded rather than created
+	ca, err := LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.cert.Equal(created.cert) {
+		t.Fatal("expected the same authority after reloading")
+	}
+
+	cert, err := ca.Certificate("Web.Default.Svc.Cluster.Local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(created.cert)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "web.default.svc.cluster.local", Roots: roots}); err != nil {
+		t.Error(err)
+	}
+	again, err := ca.Certificate("web.default.svc.cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != cert {
+		t.Error("expected the certificate to be reused")
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	match := Matcher([]string{"*.svc.cluster.local", "Grafana.monitoring."})
+	for name, expected := range map[string]bool{
+		"web.default.svc.cluster.local":  true,
+		"web.default.svc.cluster.local.": true,
+		"svc.cluster.local":              false,
+		"grafana.monitoring":             true,
+		"grafana.monitoring.svc":         false,
+		"example.com":                    false,
+	} {
+		if match(name) != expected {
+			t.Errorf("%s: expected %v", name, expected)
+		}
+	}
+}
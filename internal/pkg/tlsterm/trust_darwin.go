@@ -0,0 +1,14 @@
+// +build darwin
+
+package tlsterm
+
+import (
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// Trust adds the authority to the system keychain.
+func (ca *CA) Trust() error {
+	_, err := tpu.Cmd("security", "add-trusted-cert", "-d", "-r", "trustRoot",
+		"-k", "/Library/Keychains/System.keychain", ca.CertFile())
+	return err
+}
@@ -0,0 +1,40 @@
+// +build linux
+
+package tlsterm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// the anchors directories of Debian and Fedora derived systems
+var stores = []struct {
+	dir, update string
+}{
+	{"/usr/local/share/ca-certificates", "update-ca-certificates"},
+	{"/etc/pki/ca-trust/source/anchors", "update-ca-trust"},
+}
+
+// Trust adds the authority to the system's trusted certificates.
+// Browsers with a store of their own (e.g. Firefox) need it imported
+// separately.
+func (ca *CA) Trust() error {
+	data, err := ioutil.ReadFile(ca.CertFile())
+	if err != nil {
+		return err
+	}
+	for _, store := range stores {
+		if _, err := os.Stat(store.dir); err != nil {
+			continue
+		}
+		if err := ioutil.WriteFile(store.dir+"/teleproxy-ca.crt", data, 0644); err != nil {
+			return err
+		}
+		_, err := tpu.Cmd(store.update)
+		return err
+	}
+	return fmt.Errorf("no known store of trusted certificates, add %s by hand", ca.CertFile())
+}
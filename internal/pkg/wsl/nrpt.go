@@ -0,0 +1,125 @@
+package wsl
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// nrptComment tags the rules of ours, so that those left behind by a
+// teleproxy that didn't get to remove them go too.
+const nrptComment = "teleproxy"
+
+// suffix is what a namespace of the Name Resolution Policy Table may
+// be, as far as we write them.
+var suffix = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// powershell runs a script in Windows' PowerShell.
+var powershell = func(script string, logf func(string, ...interface{})) error {
+	_, err := tpu.CmdLogf([]string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script}, logf)
+	return err
+}
+
+// An NRPT sends Windows' queries for the names under some suffixes,
+// e.g. cluster.local, to a nameserver of ours, with rules of its Name
+// Resolution Policy Table. Windows' resolver keeps answering the rest
+// as it did, rather than being pointed at us wholesale, and its own
+// dns cache honors the rules. It takes an elevated Windows session.
+type NRPT struct {
+	nameserver string
+	suffixes   []string
+	// set is whether suffixes are in the table
+	set bool
+}
+
+// NewNRPT returns an NRPT sending queries to nameserver, an address on
+// port 53 that Windows can reach, e.g. VMAddr.
+func NewNRPT(nameserver string) *NRPT {
+	return &NRPT{nameserver: nameserver}
+}
+
+func (n *NRPT) log(line string, args ...interface{}) {
+	log.Printf("WSL: "+line, args...)
+}
+
+// Set makes the rules of the table ours for suffixes, replacing those
+// of ours that were there, whether we put them there or a teleproxy
+// before us did. No suffixes removes them. Nothing is run if they are
+// the suffixes already set.
+func (n *NRPT) Set(suffixes []string) error {
+	suffixes = append([]string(nil), suffixes...)
+	sort.Strings(suffixes)
+	if n.set && strings.Join(suffixes, ",") == strings.Join(n.suffixes, ",") {
+		return nil
+	}
+	script, err := nrptScript(suffixes, n.nameserver)
+	if err != nil {
+		return err
+	}
+	if err := powershell(script, n.log); err != nil {
+		return err
+	}
+	if len(suffixes) > 0 {
+		n.log("resolving %s through %s", strings.Join(suffixes, ", "), n.nameserver)
+	}
+	n.suffixes, n.set = suffixes, true
+	return nil
+}
+
+// nrptScript removes our rules, and adds one sending the queries under
+// each suffix to nameserver.
+func nrptScript(suffixes []string, nameserver string) (string, error) {
+	lines := []string{
+		fmt.Sprintf("Get-DnsClientNrptRule | Where-Object { $_.Comment -eq '%s' } | Remove-DnsClientNrptRule -Force", nrptComment),
+	}
+	for _, s := range suffixes {
+		if !suffix.MatchString(s) {
+			return "", fmt.Errorf("%q is not a dns suffix", s)
+		}
+		// the leading dot makes it take every name under s
+		lines = append(lines, fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.%s' -NameServers '%s' -Comment '%s'", s, nameserver, nrptComment))
+	}
+	lines = append(lines, "Clear-DnsClientCache")
+	return strings.Join(lines, "; "), nil
+}
+
+// Suffixes returns what an NRPT needs to send every name of a search
+// path, e.g. default.svc.cluster.local, svc.cluster.local, and
+// cluster.local, to us: the suffixes no other is a suffix of, e.g.
+// just cluster.local.
+func Suffixes(search []string) []string {
+	var trimmed []string
+	for _, s := range search {
+		if s = strings.ToLower(strings.Trim(s, ".")); s != "" {
+			trimmed = append(trimmed, s)
+		}
+	}
+	var result []string
+	for _, s := range trimmed {
+		under := false
+		for _, other := range trimmed {
+			if other != s && strings.HasSuffix(s, "."+other) {
+				under = true
+				break
+			}
+		}
+		if !under && !contains(result, s) {
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
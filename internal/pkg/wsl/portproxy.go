@@ -0,0 +1,160 @@
+package wsl
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/datawire/teleproxy/internal/pkg/loopback"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+const (
+	portProxyBegin = "# BEGIN teleproxy portproxy"
+	portProxyEnd   = "# END teleproxy portproxy"
+)
+
+// A PortProxy gives a handful of services to Windows without routes
+// or firewall rules, for when the Publisher can't be had. Each service
+// gets a loopback address of Windows' own, named in its hosts file,
+// where netsh's portproxy forwards each of its ports to a relay on the
+// VM, which dials the service through the tunnel. It takes no more
+// than netsh, from an elevated Windows session.
+type PortProxy struct {
+	network *net.IPNet
+	dial    func(network, address string) (net.Conn, error)
+	vm      string
+
+	mutex sync.Mutex
+	// assigned has the Windows address of each service, by host
+	assigned map[string]net.IP
+	// relays are by the Windows address and port they are
+	// forwarded from
+	relays map[string]net.Listener
+	hosts  string
+	closed bool
+}
+
+// NewPortProxy returns a PortProxy giving services addresses from
+// cidr, a loopback range, on the Windows side.
+func NewPortProxy(cidr string, dial func(network, address string) (net.Conn, error)) (*PortProxy, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if !network.IP.IsLoopback() || network.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 loopback range", cidr)
+	}
+	vm, err := VMAddr()
+	if err != nil {
+		return nil, err
+	}
+	return &PortProxy{
+		network:  network,
+		dial:     dial,
+		vm:       vm,
+		assigned: make(map[string]net.IP),
+		relays:   make(map[string]net.Listener),
+	}, nil
+}
+
+func (p *PortProxy) log(line string, args ...interface{}) {
+	log.Printf("WSL: "+line, args...)
+}
+
+// Bind gives services to Windows, and takes back the ones it had
+// before but aren't among them.
+func (p *PortProxy) Bind(services []loopback.Service) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Host < services[j].Host })
+
+	wanted := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, svc := range services {
+		hosts[svc.Host] = true
+	}
+	var lines []string
+	for _, svc := range services {
+		ip, ok := p.assigned[svc.Host]
+		if !ok {
+			if ip = loopback.Allocate(p.network, p.assigned); ip == nil {
+				p.log("not giving %s to windows: %s is used up", svc.Host, p.network)
+				continue
+			}
+			p.assigned[svc.Host] = ip
+		}
+		for _, port := range svc.Ports {
+			listen := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			wanted[listen] = true
+			if _, ok := p.relays[listen]; ok {
+				continue
+			}
+			ln, err := net.Listen("tcp", net.JoinHostPort(p.vm, "0"))
+			if err != nil {
+				p.log("not giving %s to windows: %v", svc.Host, err)
+				continue
+			}
+			_, relayPort, _ := net.SplitHostPort(ln.Addr().String())
+			if _, err := tpu.CmdLogf([]string{"netsh.exe", "interface", "portproxy", "add", "v4tov4",
+				"listenaddress=" + ip.String(), "listenport=" + strconv.Itoa(port),
+				"connectaddress=" + p.vm, "connectport=" + relayPort}, p.log); err != nil {
+				ln.Close()
+				continue
+			}
+			p.relays[listen] = ln
+			go loopback.Serve(ln, net.JoinHostPort(svc.Host, strconv.Itoa(port)), p.dial, p.log)
+		}
+		lines = append(lines, ip.String()+" "+strings.Join(svc.Names, " "))
+	}
+	for listen, ln := range p.relays {
+		if !wanted[listen] {
+			p.unproxy(listen, ln)
+		}
+	}
+	for host := range p.assigned {
+		if !hosts[host] {
+			delete(p.assigned, host)
+		}
+	}
+	p.writeHosts(strings.Join(lines, "\r\n"))
+}
+
+func (p *PortProxy) unproxy(listen string, ln net.Listener) {
+	ip, port, _ := net.SplitHostPort(listen)
+	tpu.CmdLogf([]string{"netsh.exe", "interface", "portproxy", "delete", "v4tov4",
+		"listenaddress=" + ip, "listenport=" + port}, p.log)
+	ln.Close()
+	delete(p.relays, listen)
+}
+
+func (p *PortProxy) writeHosts(block string) {
+	if block == p.hosts {
+		return
+	}
+	if err := writeHosts(portProxyBegin, portProxyEnd, block); err != nil {
+		p.log("error updating %s: %v", HostsFile, err)
+		return
+	}
+	p.hosts = block
+	tpu.CmdLogf([]string{"ipconfig.exe", "/flushdns"}, p.log)
+}
+
+// Close takes everything back from Windows.
+func (p *PortProxy) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for listen, ln := range p.relays {
+		p.unproxy(listen, ln)
+	}
+	p.assigned = make(map[string]net.IP)
+	p.writeHosts("")
+}
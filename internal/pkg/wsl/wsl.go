@@ -0,0 +1,250 @@
+// Package wsl makes the cluster visible to Windows when teleproxy runs
+// inside WSL2.
+//
+// WSL2 distributions run in a lightweight VM with their own network
+// stack, so Windows applications never see our DNS server or our
+// firewall rules. To bridge the gap, a Publisher keeps a block of
+// entries in the Windows hosts file in sync with the interceptor's
+// routing tables so that Windows resolves cluster names. It also adds
+// host routes (via route.exe) pointing each intercepted ip at the VM,
+// so that Windows connections to those ips arrive on the VM's eth0
+// where the PREROUTING rules divert them to the proxy.
+//
+// With an NRPT, Windows also sends its queries for the names under the
+// cluster's domain to our DNS server, so that it resolves names the
+// hosts file doesn't have yet, or at all.
+//
+// All of it requires an elevated Windows session; failures are logged
+// and retried.
+package wsl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	rt "github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+const (
+	// Interface is the VM side of the WSL2 virtual switch.
+	Interface = "eth0"
+
+	begin = "# BEGIN teleproxy"
+	end   = "# END teleproxy"
+)
+
+// HostsFile is the Windows hosts file as seen from inside WSL.
+var HostsFile = "/mnt/c/Windows/System32/drivers/etc/hosts"
+
+// Detect reports whether we are running inside WSL2.
+func Detect() bool {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	// WSL1 kernels report "Microsoft", WSL2 kernels report
+	// "microsoft-standard"
+	return strings.Contains(string(release), "microsoft-standard")
+}
+
+// A Publisher mirrors routes to the Windows host.
+type Publisher struct {
+	routes  func() []rt.Route
+	gateway string
+	// ips that we have successfully added windows routes for
+	published map[string]bool
+	hosts     string
+	// nrpt, if set, sends the queries under suffixes to us
+	nrpt     *NRPT
+	suffixes func() []string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewPublisher returns a Publisher that polls routes for the current
+// set of intercepted names.
+func NewPublisher(routes func() []rt.Route) (*Publisher, error) {
+	gateway, err := VMAddr()
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		routes:    routes,
+		gateway:   gateway,
+		published: make(map[string]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+func (p *Publisher) log(line string, args ...interface{}) {
+	log.Printf("WSL: "+line, args...)
+}
+
+// VMAddr returns the address Windows uses to reach the VM.
+func VMAddr() (string, error) {
+	iface, err := net.InterfaceByName(Interface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no ipv4 address", Interface)
+}
+
+// ResolveThrough also has Windows resolve the names under suffixes, as
+// Suffixes returns them, through nrpt, rather than only those in its
+// hosts file, until Stop. It must be invoked before Start.
+func (p *Publisher) ResolveThrough(nrpt *NRPT, suffixes func() []string) {
+	p.nrpt, p.suffixes = nrpt, suffixes
+}
+
+// Start publishes routes once a second until Stop is called.
+func (p *Publisher) Start() {
+	p.log("publishing to windows via %s", p.gateway)
+	go func() {
+		defer close(p.done)
+		for {
+			p.publish(p.routes())
+			select {
+			case <-p.stop:
+				p.publish(nil)
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// Stop removes everything that was published to Windows.
+func (p *Publisher) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *Publisher) publish(routes []rt.Route) {
+	names := make(map[string]string)
+	ips := make(map[string]bool)
+	for _, route := range routes {
+		ip := net.ParseIP(route.Ip)
+		// windows can't reach our loopback addresses
+		if ip == nil || ip.IsLoopback() || route.Target == "" {
+			continue
+		}
+		ips[route.Ip] = true
+		if route.Name != "" {
+			names[route.Name] = route.Ip
+		}
+	}
+
+	for ip := range p.published {
+		if !ips[ip] {
+			_, err := tpu.CmdLogf([]string{"route.exe", "delete", ip}, p.log)
+			if err == nil {
+				delete(p.published, ip)
+			}
+		}
+	}
+	for ip := range ips {
+		if !p.published[ip] {
+			_, err := tpu.CmdLogf([]string{"route.exe", "add", ip, "mask", "255.255.255.255", p.gateway}, p.log)
+			if err == nil {
+				p.published[ip] = true
+			}
+		}
+	}
+
+	if p.nrpt != nil {
+		var suffixes []string
+		if routes != nil {
+			suffixes = p.suffixes()
+		}
+		if err := p.nrpt.Set(suffixes); err != nil {
+			p.log("error updating the name resolution policy table: %v", err)
+		}
+	}
+
+	hosts := Hosts(names)
+	if hosts == p.hosts {
+		return
+	}
+	if err := writeHosts(begin, end, hosts); err != nil {
+		p.log("error updating %s: %v", HostsFile, err)
+		return
+	}
+	p.hosts = hosts
+	tpu.CmdLogf([]string{"ipconfig.exe", "/flushdns"}, p.log)
+}
+
+// writeHosts replaces the block between begin and end in the Windows
+// hosts file.
+func writeHosts(begin, end, block string) error {
+	info, err := os.Stat(HostsFile)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(HostsFile)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(HostsFile, []byte(splice(string(content), begin, end, block)), info.Mode())
+}
+
+// Hosts renders a block of hosts file entries for the given names.
+// Cluster names are also published without the ".svc.cluster.local"
+// suffix since Windows doesn't know about the cluster's search path.
+func Hosts(names map[string]string) string {
+	var lines []string
+	for name, ip := range names {
+		aliases := name
+		if short := strings.TrimSuffix(name, ".svc.cluster.local"); short != name {
+			aliases += " " + short
+		}
+		lines = append(lines, ip+" "+aliases)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\r\n")
+}
+
+// Splice replaces the teleproxy block within the content of a hosts
+// file. An empty block removes it.
+func Splice(content, block string) string {
+	return splice(content, begin, end, block)
+}
+
+func splice(content, begin, end, block string) string {
+	var result []string
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimRight(line, "\r")
+		switch {
+		case trimmed == begin:
+			inside = true
+		case trimmed == end:
+			inside = false
+		case !inside:
+			result = append(result, trimmed)
+		}
+	}
+	for len(result) > 0 && result[len(result)-1] == "" {
+		result = result[:len(result)-1]
+	}
+	if block != "" {
+		result = append(result, begin, block, end)
+	}
+	return strings.Join(result, "\r\n") + "\r\n"
+}
@@ -0,0 +1,98 @@
+package wsl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+	actual := Hosts(map[string]string{
+		"foo.default.svc.cluster.local": "10.0.0.2",
+		"bar":                           "10.0.0.1",
+	})
+	expected := "10.0.0.1 bar\r\n10.0.0.2 foo.default.svc.cluster.local foo.default"
+	if actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+var splices = []struct {
+	content string
+	block   string
+	out     string
+}{
+	{"", "", "\r\n"},
+	{"127.0.0.1 localhost\r\n", "10.0.0.1 bar",
+		"127.0.0.1 localhost\r\n# BEGIN teleproxy\r\n10.0.0.1 bar\r\n# END teleproxy\r\n"},
+	{"127.0.0.1 localhost\r\n# BEGIN teleproxy\r\n10.0.0.1 bar\r\n# END teleproxy\r\n::1 localhost\n", "10.0.0.2 foo",
+		"127.0.0.1 localhost\r\n::1 localhost\r\n# BEGIN teleproxy\r\n10.0.0.2 foo\r\n# END teleproxy\r\n"},
+	{"127.0.0.1 localhost\r\n# BEGIN teleproxy\r\n10.0.0.1 bar\r\n# END teleproxy\r\n", "",
+		"127.0.0.1 localhost\r\n"},
+}
+
+func TestSplice(t *testing.T) {
+	for _, tt := range splices {
+		actual := Splice(tt.content, tt.block)
+		if actual != tt.out {
+			t.Errorf("Splice(%q, %q): expected %q, got %q", tt.content, tt.block, tt.out, actual)
+		}
+	}
+}
+
+func TestSpliceBoth(t *testing.T) {
+	content := splice("127.0.0.1 localhost\r\n", portProxyBegin, portProxyEnd, "127.0.3.1 web.default")
+	content = Splice(content, "10.0.0.1 bar")
+	content = Splice(content, "10.0.0.2 foo")
+	expected := "127.0.0.1 localhost\r\n" +
+		"# BEGIN teleproxy portproxy\r\n127.0.3.1 web.default\r\n# END teleproxy portproxy\r\n" +
+		"# BEGIN teleproxy\r\n10.0.0.2 foo\r\n# END teleproxy\r\n"
+	if content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+	content = splice(content, portProxyBegin, portProxyEnd, "")
+	expected = "127.0.0.1 localhost\r\n# BEGIN teleproxy\r\n10.0.0.2 foo\r\n# END teleproxy\r\n"
+	if content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+func TestSuffixes(t *testing.T) {
+	actual := Suffixes([]string{"default.svc.cluster.local.", "svc.cluster.local.", "Cluster.Local.", "corp.example.com", ""})
+	expected := []string{"cluster.local", "corp.example.com"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestNRPT(t *testing.T) {
+	var scripts []string
+	saved := powershell
+	defer func() { powershell = saved }()
+	powershell = func(script string, logf func(string, ...interface{})) error {
+		scripts = append(scripts, script)
+		return nil
+	}
+
+	n := NewNRPT("172.20.0.2")
+	if err := n.Set([]string{"cluster.local"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Get-DnsClientNrptRule | Where-Object { $_.Comment -eq 'teleproxy' } | Remove-DnsClientNrptRule -Force; " +
+		"Add-DnsClientNrptRule -Namespace '.cluster.local' -NameServers '172.20.0.2' -Comment 'teleproxy'; Clear-DnsClientCache"
+	if len(scripts) != 1 || scripts[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, scripts)
+	}
+	if err := n.Set([]string{"cluster.local"}); err != nil || len(scripts) != 1 {
+		t.Errorf("expected nothing to be run for the same suffixes, got %q", scripts)
+	}
+	if err := n.Set([]string{"x'; Remove-Item C:\\"}); err == nil || len(scripts) != 1 {
+		t.Errorf("expected a suffix that isn't one to be refused, got %q", scripts)
+	}
+	if err := n.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 2 || strings.Contains(scripts[1], "Add-") {
+		t.Errorf("expected the rules to be removed, got %q", scripts)
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/datawire/teleproxy/internal/pkg/mdns"
+	"github.com/datawire/teleproxy/internal/pkg/session"
+)
+
+// AdvertiseType is the type of service that teleproxies advertise
+// themselves as with multicast dns, to browse for with e.g.
+// "dns-sd -B _teleproxy._tcp" or "avahi-browse _teleproxy._tcp".
+const AdvertiseType = "_teleproxy._tcp"
+
+// A TeamStatus is what an advertised session tells the rest of the
+// network about itself: whose it is, and what it intercepts.
+type TeamStatus struct {
+	User       string           `json:"user"`
+	Host       string           `json:"host"`
+	Context    string           `json:"context,omitempty"`
+	Namespace  string           `json:"namespace,omitempty"`
+	Intercepts []InterceptSetup `json:"intercepts"`
+}
+
+// teamStatus returns the status the session advertises.
+func (s *Session) teamStatus() TeamStatus {
+	setup := s.Setup()
+	status := TeamStatus{
+		User:       session.Username(),
+		Host:       shortHostname(),
+		Context:    setup.Context,
+		Namespace:  setup.Namespace,
+		Intercepts: setup.Intercepts,
+	}
+	if status.Intercepts == nil {
+		status.Intercepts = []InterceptSetup{}
+	}
+	return status
+}
+
+// text is the TXT record of the advertisement, which says enough to
+// tell whose teleproxy it is without asking for the status.
+func (status TeamStatus) text() []string {
+	text := []string{"user=" + status.User, "path=/status", "intercepts=" + strconv.Itoa(len(status.Intercepts))}
+	if status.Context != "" {
+		text = append(text, "context="+status.Context)
+	}
+	if status.Namespace != "" {
+		text = append(text, "namespace="+status.Namespace)
+	}
+	return text
+}
+
+func shortHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.SplitN(hostname, ".", 2)[0]
+}
+
+// advertise serves the TeamStatus of the session, read only, at
+// /status on addr, and advertises it with multicast dns. It returns a
+// function that withdraws it.
+func (s *Session) advertise(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	handler := http.NewServeMux()
+	handler.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := json.MarshalIndent(s.teamStatus(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(result, '\n'))
+	})
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	status := s.teamStatus()
+	advertiser, err := mdns.Advertise(mdns.Service{
+		Instance: status.User + "@" + status.Host,
+		Type:     AdvertiseType,
+		Host:     status.Host,
+		Port:     port,
+		Text:     func() []string { return s.teamStatus().text() },
+	})
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	log.Printf("TPY: advertising whose teleproxy this is, and what it intercepts, at http://%s.local:%d/status", status.Host, port)
+	return func() {
+		advertiser.Close()
+		server.Close()
+	}, nil
+}
@@ -0,0 +1,548 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/coexist"
+	"github.com/datawire/teleproxy/internal/pkg/docker"
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// bridges routes the services of the cluster, and the containers of
+// the runtime. Whatever is missing from network is detected.
+func (s *Session) bridges(kubeinfo *k8s.KubeInfo, containerRuntime *docker.Runtime, network k8s.Network) func() {
+	var c *cache
+	var last cached
+	if s.opts.Offline || s.opts.WarmStart {
+		var err error
+		if c, err = newCache(s.opts.CacheDir, kubeinfo.Context); err != nil {
+			log.Printf("BRG: not caching services: %v", err)
+		} else if cachedState, ok, err := c.load(); err != nil {
+			log.Printf("BRG: error loading %s: %v", c.filename, err)
+		} else if ok {
+			last = cachedState
+		}
+	}
+	if network.Domain == "" && network.ServiceCIDR == "" && last.Network.Domain != "" {
+		// detecting it needs the cluster, which may not be there
+		network = last.Network
+	}
+
+	kube := k8s.NewClient(kubeinfo)
+	compat := kube.Compatibility()
+	if compat.EndpointSlices != "" {
+		log.Printf("BRG: %s, endpoint slices at %s", compat, compat.EndpointSlices)
+	} else {
+		log.Printf("BRG: %s, without endpoint slices", compat)
+	}
+	for _, warning := range compat.Warnings() {
+		log.Printf("BRG: WARNING: %s", warning)
+	}
+
+	// Nothing else needs the tunnel to be up, and it takes a few
+	// round trips to the cluster, so it comes up in the background.
+	var disconnect, reconnect func()
+	connected := make(chan struct{})
+	go func() {
+		disconnect, reconnect = s.connect(kubeinfo)
+		close(connected)
+	}()
+	if network.Domain == "" || network.ServiceCIDR == "" {
+		detected := k8s.DetectNetwork(kube, kubeinfo)
+		if network.Domain == "" {
+			network.Domain = detected.Domain
+		}
+		if network.ServiceCIDR == "" {
+			network.ServiceCIDR = detected.ServiceCIDR
+		}
+		if network.ServiceCIDR == "" && s.local != nil {
+			// e.g. k3s leaves no trace of it to find
+			log.Printf("BRG: assuming the usual service range of %s", s.local.Kind)
+			network.ServiceCIDR = s.local.ServiceCIDR
+		}
+	}
+	log.Printf("BRG: cluster domain=%s service-cidr=%s", network.Domain, network.ServiceCIDR)
+
+	var pol *policy
+	if s.opts.EnforceRBAC {
+		pol = newPolicy(kubeinfo)
+	}
+
+	// setup kubernetes bridge
+	log.Printf("BRG: kubernetes ctx=%s ns=%s", kubeinfo.Context, kubeinfo.Namespace)
+	w := kube.Watcher()
+	b := newKubernetesBridge(s, network, pol)
+	if err := w.Watch("services", func(w *k8s.Watcher) {
+		b.update(w.List("services"))
+	}); err != nil {
+		log.Printf("BRG: %v", err)
+	}
+	b.cache = c
+	if err := s.checkOverlaps(b); err != nil {
+		log.Printf("BRG: %v", err)
+	}
+	if b.remap != nil {
+		// keep handing out the addresses resolvers may have cached
+		if p, err := newPins(s.opts.CacheDir, kubeinfo.Context); err != nil {
+			log.Printf("BRG: not pinning virtual addresses: %v", err)
+		} else if pinned, err := p.load(); err != nil {
+			log.Printf("BRG: not pinning virtual addresses, error loading %s: %v", p.filename, err)
+		} else {
+			b.remap.restore(pinned)
+			b.pins = p
+		}
+		if b.pins == nil && last.Virtual != nil {
+			b.remap.restore(last.Virtual)
+		}
+	}
+	unbind := s.startLoopback(b)
+	unproxy := s.startPortProxy(b)
+	if last.Services != nil {
+		b.restore(last.Services)
+	}
+	s.kubernetes = b
+	s.postPorts()
+	tunnel := make(chan struct{})
+	go s.watchTunnel(s.opts.Socks, tunnel, func(up bool) {
+		if s.opts.Offline {
+			b.tunnel(up)
+		}
+	})
+	s.reconnectOnWake(tunnel, func() {
+		<-connected
+		reconnect()
+	})
+	if c == nil {
+		w.Start()
+	} else {
+		// the watcher gives up on a cluster it can't reach, so wait
+		// for it without holding up the cached services
+		go func() {
+			for {
+				if _, err := kube.ListNamespace(kubeinfo.Namespace, "services"); err == nil {
+					break
+				}
+				select {
+				case <-tunnel:
+					return
+				case <-time.After(tunnelCheck):
+				}
+			}
+			w.Start()
+		}()
+	}
+
+	// Set up DNS search path based on current Kubernetes namespace
+	paths := []string{
+		kubeinfo.Namespace + ".svc." + network.Domain + ".",
+		"svc." + network.Domain + ".",
+		network.Domain + ".",
+		"",
+	}
+	log.Println("BRG: Setting DNS search path:", paths[0])
+	s.search = nil
+	for _, path := range paths[:len(paths)-1] {
+		s.search = append(s.search, strings.TrimSuffix(path, "."))
+	}
+	body, err := json.Marshal(paths)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.api.Post("http://teleproxy/api/search", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error setting up search path: %v", err)
+		panic(err) // Because this will fail if we win the startup race
+	}
+
+	// setup docker bridge
+	dw := docker.NewWatcher()
+	dw.Runtime = containerRuntime
+	containers := &publisher{session: s}
+	dw.Start(func(w *docker.Watcher) {
+		table := route.Table{Name: "docker"}
+		for name, ip := range w.Containers {
+			table.Add(route.Route{Name: name, Ip: ip, Proto: "tcp"})
+		}
+		containers.publish(table)
+	})
+
+	return func() {
+		dw.Stop()
+		w.Stop()
+		b.stop()
+		unbind()
+		unproxy()
+		s.post(route.Table{Name: "intercepts"}, route.Table{Name: "kubernetes"}, route.Table{Name: "docker"})
+		close(tunnel)
+		<-connected
+		disconnect()
+	}
+}
+
+// mirror copies the routing tables and search path of the upstream
+// teleproxy into our own. This is how the docker VM shim learns what
+// to intercept.
+func (s *Session) mirror(upstream string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		var lastTables, lastSearch []byte
+		mirrored := make(map[string]bool)
+		for {
+			body, err := s.getUpstream(upstream + "/api/tables/")
+			if err != nil {
+				log.Printf("MIR: error fetching tables: %v", err)
+			} else if !bytes.Equal(body, lastTables) {
+				var tables []route.Table
+				if err := json.Unmarshal(body, &tables); err != nil {
+					log.Printf("MIR: error decoding tables: %v", err)
+				} else {
+					lastTables = body
+					current := make(map[string]bool)
+					var update []route.Table
+					for _, t := range tables {
+						// we have our own bootstrap table
+						if t.Name == "bootstrap" {
+							continue
+						}
+						current[t.Name] = true
+						update = append(update, t)
+					}
+					for name := range mirrored {
+						if !current[name] {
+							update = append(update, route.Table{Name: name})
+						}
+					}
+					mirrored = current
+					if len(update) > 0 {
+						s.post(update...)
+					}
+				}
+			}
+
+			body, err = s.getUpstream(upstream + "/api/search")
+			if err != nil {
+				log.Printf("MIR: error fetching search path: %v", err)
+			} else if !bytes.Equal(body, lastSearch) {
+				_, err = s.api.Post("http://teleproxy/api/search", "application/json", bytes.NewReader(body))
+				if err != nil {
+					log.Printf("MIR: error setting search path: %v", err)
+				} else {
+					lastSearch = body
+				}
+			}
+
+			select {
+			case <-stop:
+				var clear []route.Table
+				for name := range mirrored {
+					clear = append(clear, route.Table{Name: name})
+				}
+				if len(clear) > 0 {
+					s.post(clear...)
+				}
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *Session) get(url string) ([]byte, error) {
+	return s.fetch(url, "")
+}
+
+// getUpstream is get from the api of the Upstream teleproxy, with the
+// UpstreamToken if there is one.
+func (s *Session) getUpstream(url string) ([]byte, error) {
+	return s.fetch(url, s.opts.UpstreamToken)
+}
+
+func (s *Session) fetch(url, token string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(api.TokenHeader, api.Bearer(token))
+	}
+	resp, err := s.api.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *Session) post(tables ...route.Table) bool {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.Name
+	}
+	jnames := strings.Join(names, ", ")
+
+	body, err := json.Marshal(tables)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/tables/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting update to %s: %v", jnames, err)
+		return false
+	}
+	resp.Body.Close()
+	log.Printf("BRG: posted update to %s: %v", jnames, resp.StatusCode)
+	return resp.StatusCode == http.StatusOK
+}
+
+// patch sends only the changes to a table, and reports whether they
+// were applied.
+func (s *Session) patch(delta route.Delta) bool {
+	body, err := json.Marshal([]route.Delta{delta})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest(http.MethodPatch, "http://teleproxy/api/tables/", bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.api.Do(req)
+	if err != nil {
+		log.Printf("BRG: error patching %s: %v", delta.Name, err)
+		return false
+	}
+	resp.Body.Close()
+	log.Printf("BRG: patched %s (+%d -%d): %v", delta.Name, len(delta.Upsert), len(delta.Remove), resp.StatusCode)
+	return resp.StatusCode == http.StatusOK
+}
+
+// A publisher keeps a table up to date with as little work as
+// possible for teleproxy: after the first full post it only sends what
+// changed, and falls back to a full post if teleproxy lost track.
+type publisher struct {
+	session *Session
+	last    *route.Table
+}
+
+func (p *publisher) publish(table route.Table) {
+	if p.last != nil {
+		delta := route.Diff(*p.last, table)
+		if delta.Empty() || p.session.patch(delta) {
+			p.last = &table
+			return
+		}
+	}
+	if p.session.post(table) {
+		p.last = &table
+	} else {
+		p.last = nil
+	}
+}
+
+// checkOverlaps warns about local networks that the service range
+// clashes with, and gives services virtual addresses instead if so
+// configured.
+func (s *Session) checkOverlaps(b *kubernetesBridge) error {
+	var overlaps []coexist.Overlap
+	if b.network.ServiceCIDR != "" {
+		var err error
+		if overlaps, err = coexist.Overlaps([]string{b.network.ServiceCIDR}); err != nil {
+			return err
+		}
+	}
+	for _, overlap := range overlaps {
+		log.Printf("BRG: WARNING: the service range clashes with a local network, %s", overlap)
+	}
+	if s.opts.Remap == "always" || (s.opts.Remap == "auto" && len(overlaps) > 0) {
+		remap, err := newRemapper(s.opts.VirtualCIDR)
+		if err != nil {
+			return err
+		}
+		clashes, err := coexist.Overlaps([]string{s.opts.VirtualCIDR})
+		if err != nil {
+			return err
+		}
+		if len(clashes) > 0 {
+			return fmt.Errorf("not remapping, the virtual range clashes too: %s", clashes[0])
+		}
+		log.Printf("BRG: giving services virtual addresses from %s", s.opts.VirtualCIDR)
+		b.remap = remap
+	} else if len(overlaps) > 0 {
+		log.Printf("BRG: WARNING: pass -remap auto to give services virtual addresses instead")
+	}
+
+	body, err := json.Marshal(overlaps)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/overlaps", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting overlaps: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// postStale reports which tables are only last known answers, so
+// that they show up in the status.
+func (s *Session) postStale(tables []string) {
+	body, err := json.Marshal(tables)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/stale", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting stale tables: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// postDenied reports the namespaces that policy kept us from
+// intercepting so that they show up in the status.
+func (s *Session) postDenied(denied []string) {
+	body, err := json.Marshal(denied)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/denied", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting denied namespaces: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// refused reports a destination that the policy of the teleproxy pods
+// refused so that it shows up in the status.
+func (s *Session) refused(host string) {
+	body, err := json.Marshal(host)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/refused", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting a refused destination: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// hostKeys are the host keys of the teleproxy pods as the session has
+// them pinned.
+func (s *Session) hostKeys() hostKeys {
+	keys := hostKeys{knownHosts: s.opts.KnownHosts}
+	if s.opts.TrustFirstKey {
+		keys.trustFirst = s.unchecked
+	}
+	return keys
+}
+
+// unchecked reports a teleproxy pod whose host key was trusted on
+// first use so that it shows up in the status.
+func (s *Session) unchecked(pod string) {
+	body, err := json.Marshal(pod)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/unchecked", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting an unchecked pod: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// health returns what reports the health of a command kept running for
+// the session, e.g. ssh, and how it last died, in the status and to the
+// hooks.
+func (s *Session) health(command string) func(tpu.Health, error) {
+	return func(h tpu.Health, err error) {
+		health := interceptor.Command{Health: h.String()}
+		detail := command + ": " + h.String()
+		if err != nil {
+			health.Error = err.Error()
+			detail += ": " + err.Error()
+		}
+		if failed, ok := err.(*tpu.CmdError); ok {
+			health.ExitCode = failed.ExitCode
+		}
+		s.emit(EventHealth, detail)
+		body, err := json.Marshal(struct {
+			Name string `json:"command"`
+			interceptor.Command
+		}{command, health})
+		if err != nil {
+			panic(err)
+		}
+		resp, err := s.api.Post("http://teleproxy/api/health", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("BRG: error posting the health of %s: %v", command, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+}
+
+// connect runs the tunnel into the cluster on socks, by way of a
+// port-forward to the teleproxy pod, as applied from pod, on the local
+// port forward. The pod is checked against the host key pinned in
+// keys, and the health of the port-forward and ssh is reported to
+// health. It returns functions to take the tunnel down, and to set it
+// up again from scratch.
+func connect(kubeinfo *k8s.KubeInfo, pod, socks string, forward int, keys hostKeys, health func(command string) func(tpu.Health, error)) (disconnect, reconnect func()) {
+	// setup remote teleproxy pod
+	apply := tpu.NewKeeper("KAP", "kubectl "+kubeinfo.GetKubectl("apply -f -"))
+	apply.Input = pod
+	apply.Limit = 1
+	apply.Start()
+	apply.Wait()
+	go checkPull(kubeinfo)
+
+	pf := tpu.NewKeeper("KPF", "kubectl "+kubeinfo.GetKubectl(fmt.Sprintf("port-forward pod/teleproxy %d:8022", forward)))
+	pf.Inspect = "kubectl " + kubeinfo.GetKubectl("get pod/teleproxy")
+	pf.OnHealth = health("port-forward")
+
+	// XXX: probably need some kind of keepalive check for ssh, first
+	// curl after wakeup seems to trigger detection of death
+	ssh := tpu.NewKeeper("SSH", "ssh -D "+socks+" -C -N -oConnectTimeout=5 -oExitOnForwardFailure=yes "+
+		hostKeyOptions(kubeinfo, keys)+fmt.Sprintf(" telepresence@localhost -p %d", forward))
+	ssh.OnHealth = health("ssh")
+
+	pf.Start()
+	ssh.Start()
+
+	disconnect = func() {
+		ssh.Stop()
+		pf.Stop()
+	}
+	reconnect = func() {
+		pf.Restart()
+		ssh.Restart()
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+// A cache keeps the last known state of a cluster, so that its
+// services still resolve when it can't be reached, or before it has
+// been heard from.
+type cache struct {
+	filename string
+}
+
+type cached struct {
+	Network  k8s.Network    `json:"network"`
+	Services []k8s.Resource `json:"services"`
+	// Virtual holds the virtual addresses of remapped cluster ips.
+	Virtual map[string]string `json:"virtual,omitempty"`
+}
+
+var unsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// newCache returns the cache for a kubernetes context, kept in dir, or
+// the user's cache directory if dir is empty.
+func newCache(dir, context string) (*cache, error) {
+	dir, err := stateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &cache{filepath.Join(dir, unsafe.ReplaceAllString(context, "_")+".json")}, nil
+}
+
+// stateDir is dir, or the teleproxy directory in the user's cache
+// directory if dir is empty.
+func stateDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "teleproxy"), nil
+}
+
+// load returns what was last saved, if anything.
+func (c *cache) load() (cached, bool, error) {
+	var result cached
+	data, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return result, false, nil
+	}
+	if err != nil {
+		return result, false, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return result, false, err
+	}
+	return result, true, nil
+}
+
+func (c *cache) save(state cached) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0700); err != nil {
+		return err
+	}
+	// written aside and renamed, so that a crash never leaves half a
+	// cache
+	tmp := c.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
+}
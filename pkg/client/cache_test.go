@@ -0,0 +1,80 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+func service(name, ip string) k8s.Resource {
+	return k8s.Resource{
+		"metadata": map[string]interface{}{"name": name, "namespace": "default"},
+		"spec":     map[string]interface{}{"clusterIP": ip},
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newCache(dir, "arn:aws:eks:us-east-1:1234:cluster/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.load(); ok || err != nil {
+		t.Fatalf("expected nothing cached, got %v, %v", ok, err)
+	}
+	network := k8s.Network{Domain: "cluster.local", ServiceCIDR: "10.96.0.0/12"}
+	if err := c.save(cached{Network: network, Services: []k8s.Resource{service("web", "10.96.0.10")}}); err != nil {
+		t.Fatal(err)
+	}
+	last, ok, err := c.load()
+	if !ok || err != nil {
+		t.Fatalf("expected the saved services, got %v, %v", ok, err)
+	}
+	if last.Network != network || len(last.Services) != 1 || last.Services[0].Name() != "web" {
+		t.Errorf("unexpected %+v", last)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := &recorder{}
+	s := &Session{api: &http.Client{Transport: api}, proxyPort: 1234}
+	b := newKubernetesBridge(s, k8s.Network{Domain: "cluster.local", ServiceCIDR: "10.96.0.0/12"}, nil)
+	b.cache, _ = newCache(dir, "minikube")
+
+	b.update([]k8s.Resource{service("web", "10.96.0.10")})
+	b.tunnel(false)
+	sent := len(api.requests)
+	b.update([]k8s.Resource{service("web", "10.96.0.10"), service("db", "10.96.0.11")})
+	if len(api.requests) != sent {
+		t.Errorf("expected changes to be held back while the tunnel is down")
+	}
+	if len(b.services) != 1 {
+		t.Errorf("expected the last published services to stay, got %d", len(b.services))
+	}
+	if _, err := b.intercept("default", "db", 80, 0); err == nil {
+		t.Errorf("expected only services already published to be interceptable")
+	}
+
+	b.tunnel(true)
+	if len(b.services) != 2 || b.queued != nil {
+		t.Errorf("expected the held back services to be published, got %d", len(b.services))
+	}
+	last, ok, err := b.cache.load()
+	if !ok || err != nil || len(last.Services) != 2 {
+		t.Errorf("expected the latest services to be cached, got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,898 @@
+// Package client runs teleproxy inside another program: it makes the
+// services of a cluster (and local containers) reachable by name from
+// the host, the same as the teleproxy command does.
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/docker"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	"github.com/datawire/teleproxy/internal/pkg/plugin"
+	"github.com/datawire/teleproxy/internal/pkg/ports"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/shaping"
+	"github.com/datawire/teleproxy/internal/pkg/timeouts"
+	"github.com/datawire/teleproxy/internal/pkg/tlsterm"
+	"github.com/datawire/teleproxy/internal/pkg/wsl"
+)
+
+const (
+	// DefaultSocks is where the tunnel into the cluster listens.
+	DefaultSocks = "localhost:1080"
+	// DefaultTokenFile is where the api token is saved.
+	DefaultTokenFile = "/var/run/teleproxy.token"
+	// DefaultLockFile is the lock that keeps two teleproxies from
+	// managing dns and the firewall at once.
+	DefaultLockFile = "/var/run/teleproxy.lock"
+)
+
+// Options configures a Session. The zero value of a field selects its
+// default.
+type Options struct {
+	// Intercept programs dns and the firewall, which requires
+	// root.
+	Intercept bool
+	// Observe, with Intercept, discovers and plans everything that
+	// intercepting would do and serves it on the api, but changes
+	// nothing on this host, for a look at what teleproxy would do
+	// before it does it.
+	Observe bool
+	// Bridge routes the services of the cluster and the
+	// containers of the local runtime.
+	Bridge bool
+	// Upstream is the url of a teleproxy api to mirror routing
+	// tables from instead of bridging. This is how the Docker
+	// Desktop VM shim works.
+	Upstream string
+	// UpstreamToken is the token the api of Upstream takes, for one
+	// that doesn't listen on localhost.
+	UpstreamToken string
+
+	// Kubeconfig, Context, and Namespace select the cluster, and
+	// default to whatever kubectl would use.
+	Kubeconfig string
+	Context    string
+	Namespace  string
+	// ClusterDomain and ServiceCIDR are detected if empty.
+	ClusterDomain string
+	ServiceCIDR   string
+	// EnforceRBAC only intercepts namespaces where the cluster
+	// permits creating InterceptResource. This is advisory, as it
+	// is up to the client.
+	EnforceRBAC bool
+	// InterceptTTL is how long intercepts last unless given a
+	// lifetime of their own, forever if zero. Forgotten intercepts
+	// otherwise linger until teleproxy stops.
+	InterceptTTL time.Duration
+
+	// DNS is the dns server to intercept, detected from
+	// /etc/resolv.conf if empty. Fallback is where queries we
+	// don't answer go, Google's by default.
+	DNS      string
+	Fallback string
+	// DNSClientRate, if set, is how many queries a second each
+	// client address may make, past which they are refused, so
+	// that one container stuck in a loop can't starve the rest.
+	DNSClientRate int
+	// DNSRewrites map vanity suffixes onto cluster names, as rules
+	// like "dev.internal=default.svc.cluster.local", so that
+	// web.dev.internal resolves as web.default.svc.cluster.local.
+	DNSRewrites []string
+	// DNSCorefile is a CoreDNS Corefile to take forwarding, hosts,
+	// rewrites, and caching from, see dns.Corefile for what of it
+	// is understood. Fallback and DNSRewrites take precedence.
+	DNSCorefile string
+	// NATBackend defaults to detecting one, see NATBackends.
+	NATBackend string
+	// ClampMSS clamps the segment size of intercepted connections to
+	// the path MTU, for VPNs where large requests stall otherwise.
+	// TunMTU is the MTU of the device of the tun backend.
+	ClampMSS bool
+	TunMTU   int
+	// RejectQUIC refuses udp to port 443 of intercepted services, so
+	// that browsers fall back from QUIC to tcp, which is relayed,
+	// right away rather than after stalling.
+	RejectQUIC bool
+	// JumpAfter is an iptables chain, e.g. a security agent's, whose
+	// jumps ours go after rather than first.
+	JumpAfter string
+	// ProcessScoped intercepts only the traffic of processes started
+	// with Run, instead of that of the whole host. It requires linux
+	// with cgroup v2.
+	ProcessScoped bool
+	// TunnelOnly opens just the tunnel into the cluster, at Socks,
+	// without intercepting or bridging anything. It is for
+	// Session.Run where processes can't be scoped.
+	TunnelOnly bool
+	// IncludeNetworks restricts interception of container traffic
+	// to these container networks (or bridge interfaces), and
+	// ExcludeNetworks lists ones never to intercept.
+	IncludeNetworks []string
+	ExcludeNetworks []string
+	// RouteCIDRs lists ranges, typically the service and pod ranges
+	// of the cluster, to route through a device of teleproxy's
+	// own. On macOS this keeps VPN clients that capture traffic
+	// ahead of pf from swallowing it. Other platforms don't support
+	// it.
+	RouteCIDRs []string
+	// Remap is "never", "always", or "auto", which gives services
+	// virtual addresses from VirtualCIDR (by default
+	// DefaultVirtualCIDR) instead of their cluster ips, only if the
+	// service range overlaps a local network. Otherwise intercepting
+	// the range would cut the host off from that network. It
+	// defaults to "never", or to "auto" for local clusters like kind,
+	// since they share the host with the networks they may clash
+	// with. The virtual addresses of names are pinned in CacheDir,
+	// so that they stay the same from one session to the next.
+	Remap       string
+	VirtualCIDR string
+	// Loopback lists the services, as "namespace/name" patterns like
+	// "default/*", to bind to loopback addresses of their own from
+	// LoopbackCIDR (by default DefaultLoopbackCIDR), at their ports,
+	// for clients that won't go through a proxy and insist on
+	// localhost. They are named in HostsFile, DefaultHostsFile by
+	// default.
+	Loopback     []string
+	LoopbackCIDR string
+	HostsFile    string
+	// HostsDNS leaves dns alone, for hosts that can't have it
+	// intercepted, and names the routes in a block of HostsFile
+	// instead, as long as the session lasts. HostsNames lists
+	// patterns, like "*.default.svc.cluster.local", of the names to
+	// publish, all of them by default.
+	HostsDNS   bool
+	HostsNames []string
+	// NeverProxy lists domains, e.g. "*.okta.com", that are never
+	// resolved or intercepted by teleproxy.
+	NeverProxy []string
+	// Socks is the address of the tunnel into the cluster.
+	Socks string
+	// Replicas, if more than one, runs the tunnel by way of a
+	// deployment of that many teleproxy pods rather than the lone
+	// one, so that losing a pod, e.g. to a node drain, only loses the
+	// connections through it.
+	Replicas int
+	// AgentImage is the image of the teleproxy pods, e.g. from a
+	// registry of your own, AgentImage by default. AgentArch lists
+	// the architectures it is built for, if not all the cluster may
+	// have.
+	AgentImage string
+	AgentArch  []string
+	// AgentPullSecrets name the secrets to pull AgentImage with,
+	// e.g. from a private registry.
+	AgentPullSecrets []string
+	// AgentInstalled connects to the teleproxy pods that a platform
+	// team installed from a Manifest, in the namespace of the
+	// session, rather than applying them.
+	AgentInstalled bool
+	// AgentTokenCmd, if set, is a shell command that prints the bearer
+	// token, e.g. from kubectl create token, to log into teleproxy
+	// pods installed with Manifest.Auth "token". It is run for every
+	// login, so short lived tokens do. AgentIdentity is instead the
+	// ssh private key to log into pods with Auth "cert", whose
+	// certificate is next to it as <key>-cert.pub.
+	AgentTokenCmd string
+	AgentIdentity string
+	// AgentTLS reaches teleproxy pods installed with Manifest.TLS
+	// over mutual TLS, with a certificate from the CA in their
+	// namespace, which the first session creates.
+	AgentTLS bool
+	// ExecPod, if set, runs the tunnel through kubectl exec into
+	// that existing pod, which needs nc, rather than through a
+	// teleproxy pod. It takes nothing but permission to exec in it,
+	// for clusters that allow no more, but there is no ssh: each
+	// connection is a kubectl of its own.
+	ExecPod string
+	// KnownHosts is where the host key of the teleproxy pod of each
+	// context is pinned, DefaultKnownHosts() by default. It is
+	// fetched through the kubernetes api the first time, and ssh
+	// refuses a pod whose key can't be, unless TrustFirstKey,
+	// which pins whatever key the pod offers first instead, and lists
+	// the pod in the status as unchecked.
+	KnownHosts    string
+	TrustFirstKey bool
+	// HTTPPorts lists ports where intercepted traffic is parsed as
+	// HTTP and routed by its Host header, rather than by its
+	// destination address.
+	HTTPPorts []int
+	// Timeouts, if set, says how long dials through the tunnel,
+	// idle connections and udp flows, and dns queries may take, by
+	// destination. It may be reconfigured while the session runs.
+	Timeouts *timeouts.Table
+	// Shaping, if set, says how much latency and how little
+	// bandwidth connections relayed through the tunnel get, by
+	// destination, so that a service developed locally sees its
+	// dependencies as far away as they are in the cluster. It may be
+	// reconfigured while the session runs.
+	Shaping *shaping.Table
+	// CacheHosts lists names, or wildcards like "*.svc.cluster.local",
+	// whose responses to GET requests on the HTTPPorts are cached
+	// locally, for as long as their Cache-Control allows or, without
+	// one, for CacheTTL.
+	CacheHosts []string
+	CacheTTL   time.Duration
+	// Quota is a soft limit on the bytes that go through the tunnel
+	// (each way combined, for the whole session), over which an
+	// EventQuotaExceeded warns. Nothing is cut off. Zero means no
+	// limit.
+	Quota uint64
+	// WarmForwards keeps a connection through the tunnel ready for
+	// each of this many destinations connected to most recently,
+	// which saves setting one up on the next connection. Zero keeps
+	// none.
+	WarmForwards int
+	// RaceDirect dials intercepted destinations directly as well as
+	// through the tunnel, and keeps whichever connects first,
+	// remembering the winner for a while, so that destinations that
+	// are reachable on a VPN don't pay for the tunnel. It is only
+	// supported on linux.
+	RaceDirect bool
+	// AccessLog is a file to note every intercepted connection in,
+	// with who made it, where it went, and how it ended, as a line
+	// of text or, with AccessLogJSON, a json object.
+	AccessLog     string
+	AccessLogJSON bool
+	// TLSHosts lists names, or wildcards like "*.svc.cluster.local",
+	// whose tls is terminated locally with certificates from the
+	// authority in CADir, and encrypted again on the way to the
+	// cluster. TLSPorts are where to look for it, 443 by default.
+	TLSHosts []string
+	TLSPorts []int
+	CADir    string
+	// ContainerRuntime is "docker", "podman", or (by default)
+	// "auto".
+	ContainerRuntime string
+	// DockerVMImage, if set, is run as a shim inside the Docker
+	// Desktop VM so its containers are intercepted too.
+	DockerVMImage string
+	// PublishWindows makes the cluster reachable from the Windows
+	// host of a WSL2 VM.
+	PublishWindows bool
+	// WindowsDNS also has Windows send its queries for the names
+	// under the cluster's domain to teleproxy's dns, on port 53 of
+	// the VM, through rules of its Name Resolution Policy Table,
+	// which are removed on Close. It requires PublishWindows.
+	WindowsDNS bool
+	// WindowsPortProxy lists services, as "namespace/name" patterns,
+	// to give to Windows from WSL2 with netsh's portproxy and its
+	// hosts file instead, where the routes of PublishWindows can't
+	// be had. Each gets a loopback address of Windows' own.
+	WindowsPortProxy []string
+
+	// UpstreamProxy and Bastion are mutually exclusive ways of
+	// reaching a cluster that isn't directly reachable. Either
+	// applies to the whole process, since they work by setting
+	// HTTPS_PROXY.
+	UpstreamProxy string
+	Bastion       []string
+
+	// APITokenFile is where the token for the api is saved (or
+	// read from, when not intercepting). APISocket, if set, is a
+	// unix socket the api is also served on. APIListen is the
+	// address the api listens on, a random localhost port if
+	// empty, which the shim of DockerVMImage reaches too. Off
+	// localhost, or with DockerVMImage, reads take the token too.
+	APITokenFile string
+	APISocket    string
+	APIListen    string
+	// Debug serves pprof and expvar on the api.
+	Debug bool
+	// Advertise, if set, is an address, e.g. ":7979", to serve the
+	// TeamStatus of the session on, read only, and to advertise on
+	// the local network with multicast dns, so that teammates can
+	// tell whose teleproxy intercepts what.
+	Advertise string
+	// PortRange, e.g. "20000-20100", is where ports are picked
+	// from when the usual ones are taken. By default the operating
+	// system picks.
+	PortRange string
+
+	// Offline keeps the services of the cluster in CacheDir, by
+	// default the user's cache directory, so that they still resolve
+	// when it can't be reached. Meanwhile the status marks them
+	// stale, and changes to them are held back until the tunnel is
+	// back.
+	//
+	// WarmStart uses the same cache to route the services of the
+	// last session (with the same virtual addresses, if remapped)
+	// right away, marked stale until the cluster has been listed.
+	Offline   bool
+	WarmStart bool
+	CacheDir  string
+
+	// LockFile is the session lock. Takeover shuts down whichever
+	// teleproxy holds it instead of failing.
+	LockFile string
+	Takeover bool
+	// IgnoreConflicts intercepts even when another tool that
+	// redirects the same traffic is running.
+	IgnoreConflicts bool
+
+	// Hooks are told about each Event: urls are posted the event
+	// as json, and anything else is run as a shell command with
+	// the event on its stdin and the type of event in
+	// $TELEPROXY_EVENT. OnEvent, if set, is invoked too.
+	Hooks   []string
+	OnEvent func(Event)
+	// Plugins are shell commands that run policy plugins, which
+	// may deny or shorten intercepts and replace or deny the
+	// answers for names, in order. See the plugin package for the
+	// protocol they speak.
+	Plugins []string
+}
+
+// NATBackends returns the names of the available nat backends.
+func NATBackends() []string {
+	return nat.Backends()
+}
+
+// An Intercept is a named table of routes. Each route makes Name
+// resolve to Ip, and (if Target is set) redirects Proto traffic for Ip
+// to the local port Target.
+type Intercept = route.Table
+
+// A Route is a single entry of an Intercept.
+type Route = route.Route
+
+// A Session is a running teleproxy.
+type Session struct {
+	opts        Options
+	token       string
+	kubeContext string
+	// kubeNamespace is the namespace of the cluster, as resolved
+	kubeNamespace string
+	// local is the cluster, if it runs on this host
+	local      *k8s.LocalCluster
+	apis       *api.APIServer
+	api        *http.Client
+	kubernetes *kubernetesBridge
+	plugins    plugin.Plugins
+	nameserver string
+	search     []string
+	proxy      *proxy.Proxy
+	ready      *readiness
+
+	// tables are the intercepts added with AddIntercept, in order
+	tablesMutex sync.Mutex
+	tables      map[string]Intercept
+	tableOrder  []string
+
+	// woke is when the machine last woke from sleep
+	wakeMutex sync.Mutex
+	woke      time.Time
+
+	ports   *ports.Allocator
+	dnsPort int
+	// dnsConns are the dns sockets of socket activation, if any
+	dnsConns    []net.PacketConn
+	proxyPort   int
+	forwardPort int
+	bastionPort int
+	// replicaPorts has the ports of each replica, if there are
+	// several
+	replicaPorts []replicaPorts
+	// exposer publishes local ports into the cluster, if the tunnel
+	// can carry them
+	exposer *exposer
+	// login is how the tunnel logs into the teleproxy pods
+	login agentLogin
+
+	stoppers []func()
+	once     sync.Once
+}
+
+// Connect starts teleproxy as described by opts. The session lasts
+// until it is closed or ctx is done.
+func Connect(ctx context.Context, opts Options) (*Session, error) {
+	if opts.Socks == "" {
+		opts.Socks = DefaultSocks
+	}
+	if opts.APITokenFile == "" {
+		opts.APITokenFile = DefaultTokenFile
+	}
+	if opts.LockFile == "" {
+		opts.LockFile = DefaultLockFile
+	}
+	if opts.KnownHosts == "" {
+		opts.KnownHosts = DefaultKnownHosts()
+	}
+	if opts.Replicas < 1 {
+		opts.Replicas = 1
+	}
+	if opts.CADir == "" {
+		opts.CADir = tlsterm.DefaultDir
+	}
+	if len(opts.TLSPorts) == 0 {
+		opts.TLSPorts = []int{443}
+	}
+	local := detectLocal(opts)
+	if opts.Remap == "" {
+		opts.Remap = "never"
+		if local != nil {
+			opts.Remap = "auto"
+		}
+	}
+	if opts.VirtualCIDR == "" {
+		opts.VirtualCIDR = DefaultVirtualCIDR
+	}
+	if opts.LoopbackCIDR == "" {
+		opts.LoopbackCIDR = DefaultLoopbackCIDR
+	}
+	if opts.HostsFile == "" {
+		opts.HostsFile = DefaultHostsFile
+	}
+	if opts.ContainerRuntime == "" {
+		opts.ContainerRuntime = "auto"
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	portRange, err := ports.ParseRange(opts.PortRange)
+	if err != nil {
+		return nil, err
+	}
+
+	waitFor := []string{"started"}
+	if opts.Bridge {
+		waitFor = append(waitFor, "tunnel", "services")
+	}
+	s := &Session{opts: opts, local: local, ports: ports.NewAllocator(portRange), ready: newReadiness(waitFor...)}
+	s.api = &http.Client{Transport: authTransport{&http.Transport{}, s.apiToken}}
+
+	if err := s.start(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.apis != nil {
+		s.apis.ServeSetup(s.exportSetup, s.applySetup)
+		s.apis.ServeIntercepts(s.interceptPorts, s.setIntercept)
+		s.apis.ServeWeights(s.interceptWeights, s.SetInterceptWeight)
+		s.apis.ServeSelectors(s.interceptSelectors, s.SetInterceptHeader)
+		s.apis.ServeExposes(s.exposedPorts, s.Expose)
+		s.apis.ServeTunnels(s.tunnels)
+	}
+	s.ready.mark("started")
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return s, nil
+}
+
+// kubeInfo loads the kubeconfig, and unless the session may do without
+// the cluster makes sure it answers.
+func (s *Session) kubeInfo() (*k8s.KubeInfo, error) {
+	kubeinfo, err := k8s.NewKubeInfo(s.opts.Kubeconfig, s.opts.Context, s.opts.Namespace)
+	if err == nil {
+		_, err = kubeinfo.GetRestConfig()
+	}
+	if err != nil {
+		return nil, KubeconfigInvalid(errors.Wrap(err, "KubeInfo"))
+	}
+	if !s.opts.Offline {
+		if err := kubeinfo.Reachable(); err != nil {
+			return nil, ClusterUnreachable(errors.Wrapf(err, "context %s", kubeinfo.Context))
+		}
+	}
+	return kubeinfo, nil
+}
+
+func (s *Session) start(ctx context.Context) error {
+	if s.local != nil && (s.opts.UpstreamProxy != "" || len(s.opts.Bastion) > 0) {
+		bypassProxy(s.local)
+	}
+	if s.opts.UpstreamProxy != "" {
+		if err := useProxy(s.opts.UpstreamProxy); err != nil {
+			return err
+		}
+	}
+
+	rt, err := docker.RuntimeNamed(s.opts.ContainerRuntime)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range s.opts.Plugins {
+		p, err := plugin.Start(command)
+		if err != nil {
+			return err
+		}
+		s.plugins = append(s.plugins, p)
+	}
+	s.onClose(s.plugins.Close)
+
+	if s.opts.Bridge || s.opts.TunnelOnly {
+		if s.login, err = newAgentLogin(s.opts); err != nil {
+			return errors.Wrap(err, "agent login")
+		}
+		// withTLS adds to the login later
+		s.onClose(func() { s.login.close() })
+	}
+
+	if s.opts.Intercept {
+		// observers leave the firewall to whoever holds the lock
+		if !s.opts.Observe {
+			mode := "intercept"
+			if s.opts.Upstream != "" {
+				mode = "shim"
+			}
+			sess, err := acquire(s.opts.LockFile, mode, s.opts.Takeover)
+			if err != nil {
+				return err
+			}
+			s.onClose(func() { sess.Release() })
+		}
+
+		var natConfig nat.Config
+		natConfig.IncludeInterfaces, err = networkInterfaces(s.opts.IncludeNetworks, rt)
+		if err != nil {
+			return err
+		}
+		natConfig.ExcludeInterfaces, err = networkInterfaces(s.opts.ExcludeNetworks, rt)
+		if err != nil {
+			return err
+		}
+		if iface, ok := s.localInterface(rt); ok {
+			natConfig.ExcludeInterfaces = append(natConfig.ExcludeInterfaces, iface)
+		}
+		natConfig.RouteCIDRs = s.opts.RouteCIDRs
+		natConfig.ClampMSS = s.opts.ClampMSS
+		natConfig.RejectQUIC = s.opts.RejectQUIC
+		natConfig.JumpAfter = s.opts.JumpAfter
+		natConfig.MTU = s.opts.TunMTU
+		if s.opts.RaceDirect {
+			natConfig.BypassMark = bypassMark
+		}
+		if s.opts.ProcessScoped {
+			if err := processScope(DefaultCgroup); err != nil {
+				return err
+			}
+			natConfig.Cgroup = DefaultCgroup
+			s.onClose(func() { removeCgroup(DefaultCgroup) })
+		}
+		if err := s.interceptPorts(); err != nil {
+			return err
+		}
+		if s.opts.PublishWindows && len(natConfig.IncludeInterfaces) > 0 {
+			// windows traffic arrives on the vm's interface
+			natConfig.IncludeInterfaces = append(natConfig.IncludeInterfaces, wsl.Interface)
+		}
+		intercept := s.intercept
+		if s.opts.Observe {
+			intercept = s.observe
+		}
+		shutdown, err := intercept(natConfig)
+		if err != nil {
+			return errors.Wrap(err, "intercept")
+		}
+		s.onClose(shutdown)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.opts.Upstream != "" {
+		s.onClose(s.mirror(s.opts.Upstream))
+	}
+	if s.opts.Bridge {
+		if err := s.bridgePorts(); err != nil {
+			return err
+		}
+		log.Printf("TPY: ports %s", s.ports)
+		if len(s.opts.Bastion) > 0 {
+			shutdown, err := bastion(s.opts.Bastion, net.JoinHostPort("localhost", strconv.Itoa(s.bastionPort)), s.health("bastion"))
+			if err != nil {
+				return err
+			}
+			s.onClose(shutdown)
+		}
+		kubeinfo, err := s.kubeInfo()
+		if err != nil {
+			return err
+		}
+		s.kubeContext = kubeinfo.Context
+		s.kubeNamespace = kubeinfo.Namespace
+		if s.opts.AgentTLS {
+			if err := s.login.withTLS(kubeinfo); err != nil {
+				return errors.Wrap(err, "agent tls")
+			}
+		}
+		s.onClose(s.bridges(kubeinfo, rt, k8s.Network{Domain: s.opts.ClusterDomain, ServiceCIDR: s.opts.ServiceCIDR}))
+		s.startExposer(kubeinfo)
+	} else if s.opts.TunnelOnly {
+		if err := s.tunnelPorts(); err != nil {
+			return err
+		}
+		kubeinfo, err := s.kubeInfo()
+		if err != nil {
+			return err
+		}
+		s.kubeContext = kubeinfo.Context
+		s.kubeNamespace = kubeinfo.Namespace
+		if s.opts.AgentTLS {
+			if err := s.login.withTLS(kubeinfo); err != nil {
+				return errors.Wrap(err, "agent tls")
+			}
+		}
+		disconnect, reconnect := s.connect(kubeinfo)
+		stop := make(chan struct{})
+		s.reconnectOnWake(stop, reconnect)
+		s.onClose(func() {
+			close(stop)
+			disconnect()
+		})
+		s.startExposer(kubeinfo)
+	}
+	if s.opts.Advertise != "" {
+		withdraw, err := s.advertise(s.opts.Advertise)
+		if err != nil {
+			return errors.Wrap(err, "advertise")
+		}
+		s.onClose(withdraw)
+	}
+	return ctx.Err()
+}
+
+// onClose arranges for f to be invoked when the session is closed, in
+// the reverse order of registration.
+func (s *Session) onClose(f func()) {
+	s.stoppers = append(s.stoppers, f)
+}
+
+// Close stops everything the session started. It is safe to invoke
+// more than once.
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		hooks := make(chan struct{})
+		go func() {
+			s.emit(EventShutdown, "").Wait()
+			close(hooks)
+		}()
+		select {
+		case <-hooks:
+		case <-time.After(hookTimeout):
+		}
+
+		for i := len(s.stoppers) - 1; i >= 0; i-- {
+			s.stoppers[i]()
+		}
+	})
+	return nil
+}
+
+// InterceptService diverts traffic from this host for the given port of
+// the service to a local port instead of the cluster, and returns that
+// port. It is the port the service targets, so that whatever stands in
+// for the service locally can listen where its pods do. The cluster ip
+// is tracked as the service changes.
+//
+// The firewall redirects by address, so traffic for the other ports of
+// the service goes to the local port too.
+//
+// The intercept lasts for Options.InterceptTTL, if set, or until it is
+// removed.
+func (s *Session) InterceptService(namespace, service string, port int) (int, error) {
+	return s.InterceptServiceFor(namespace, service, port, s.opts.InterceptTTL)
+}
+
+// InterceptServiceFor is InterceptService for an intercept that is
+// removed after ttl, or never if ttl is zero.
+func (s *Session) InterceptServiceFor(namespace, service string, port int, ttl time.Duration) (int, error) {
+	if s.kubernetes == nil {
+		return 0, errors.New("intercepting services requires bridging")
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative lifetime %v", ttl)
+	}
+	ttl, err := s.plugins.Intercept(namespace, service, port, ttl)
+	if err != nil {
+		return 0, err
+	}
+	local, err := s.kubernetes.intercept(namespace, service, port, ttl)
+	if err == nil {
+		detail := fmt.Sprintf("%s/%s:%d -> %d", namespace, service, port, local)
+		if ttl > 0 {
+			detail += fmt.Sprintf(" for %v", ttl)
+		}
+		s.emit(EventInterceptAdded, detail)
+	}
+	return local, err
+}
+
+// ReleaseService sends traffic for the service back to the cluster.
+func (s *Session) ReleaseService(namespace, service string) error {
+	if s.kubernetes == nil {
+		return errors.New("intercepting services requires bridging")
+	}
+	err := s.kubernetes.release(namespace, service)
+	if err == nil {
+		s.emit(EventInterceptRemoved, namespace+"/"+service)
+	}
+	return err
+}
+
+// SetInterceptWeight routes percent of the connections to an
+// intercepted service to its local port, and the rest to the cluster
+// as if it weren't intercepted, e.g. 10 to try the local port on a
+// tenth of them. 100 is the usual intercept, which routes them all
+// locally. The firewall can't split connections up, so the proxy
+// does, which takes intercepting in this session. Releasing the
+// intercept forgets its weight.
+func (s *Session) SetInterceptWeight(namespace, service string, percent int) error {
+	if s.kubernetes == nil {
+		return errors.New("intercepting services requires bridging")
+	}
+	if s.proxy == nil {
+		return errors.New("weighing intercepts requires intercepting")
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("weight %d%% is not between 0 and 100", percent)
+	}
+	if err := s.kubernetes.weigh(namespace, service, percent); err != nil {
+		return err
+	}
+	log.Printf("TPY: routing %d%% of %s/%s locally", percent, namespace, service)
+	return nil
+}
+
+// SetInterceptHeader routes the connections to an intercepted service
+// whose first request carries header, e.g. "x-teleproxy-user: alice",
+// to its local port, and the rest to the cluster, so that others
+// sharing this host and the service aren't intercepted along. Only
+// http is routed by header, anything else goes to the cluster. As with
+// SetInterceptWeight, it takes intercepting in this session. An empty
+// header goes back to the weight of the intercept, if any.
+func (s *Session) SetInterceptHeader(namespace, service, header string) error {
+	if s.kubernetes == nil {
+		return errors.New("intercepting services requires bridging")
+	}
+	if s.proxy == nil {
+		return errors.New("routing intercepts by header requires intercepting")
+	}
+	var sel selector
+	if header != "" {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("header %q is not \"name: value\"", header)
+		}
+		sel = selector{http.CanonicalHeaderKey(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])}
+	}
+	if err := s.kubernetes.selectBy(namespace, service, sel); err != nil {
+		return err
+	}
+	if header == "" {
+		log.Printf("TPY: not routing %s/%s by header", namespace, service)
+	} else {
+		log.Printf("TPY: routing %s/%s locally for %s: %s", namespace, service, sel.header, sel.value)
+	}
+	return nil
+}
+
+// AddMirror copies what this host sends to the given port of the
+// service to localPort as well, so that whatever stands in for the
+// service locally sees real traffic before it is intercepted. The
+// service still gets and answers the traffic; what the local port
+// answers is discarded.
+func (s *Session) AddMirror(namespace, service string, port, localPort int) error {
+	if s.proxy == nil {
+		return errors.New("mirroring services requires intercepting")
+	}
+	s.proxy.Mirror(namespace+"/"+service, port, net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+	log.Printf("TPY: mirroring %s/%s:%d to %d", namespace, service, port, localPort)
+	return nil
+}
+
+// RemoveMirror stops copying what is sent to the port of the service.
+func (s *Session) RemoveMirror(namespace, service string, port int) error {
+	if s.proxy == nil {
+		return errors.New("mirroring services requires intercepting")
+	}
+	s.proxy.Unmirror(namespace+"/"+service, port)
+	return nil
+}
+
+// AddIntercept adds the intercept, replacing any previous one of the
+// same name.
+func (s *Session) AddIntercept(intercept Intercept) error {
+	if !s.post(intercept) {
+		return fmt.Errorf("failed to add intercept %s", intercept.Name)
+	}
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+	if s.tables == nil {
+		s.tables = make(map[string]Intercept)
+	}
+	if _, ok := s.tables[intercept.Name]; !ok {
+		s.tableOrder = append(s.tableOrder, intercept.Name)
+	}
+	s.tables[intercept.Name] = intercept
+	return nil
+}
+
+// RemoveIntercept removes the named intercept.
+func (s *Session) RemoveIntercept(name string) error {
+	if strings.Contains(name, "/") || name == "" {
+		return fmt.Errorf("invalid intercept name %q", name)
+	}
+	req, err := http.NewRequest(http.MethodDelete, "http://teleproxy/api/tables/"+name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.api.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("removing intercept %s: %s", name, resp.Status)
+	}
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+	if _, ok := s.tables[name]; ok {
+		delete(s.tables, name)
+		for i, n := range s.tableOrder {
+			if n == name {
+				s.tableOrder = append(s.tableOrder[:i], s.tableOrder[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Session) apiToken() (string, error) {
+	if s.token != "" {
+		return s.token, nil
+	}
+	return api.ReadToken(s.opts.APITokenFile)
+}
+
+// API returns a client for the teleproxy api at http://teleproxy/. It
+// authenticates with the token saved in tokenFile. Other hosts are
+// reached directly, never via a proxy.
+func API(tokenFile string) *http.Client {
+	return &http.Client{Transport: authTransport{&http.Transport{}, func() (string, error) {
+		return api.ReadToken(tokenFile)
+	}}}
+}
+
+// authTransport adds the api token to requests for http://teleproxy.
+type authTransport struct {
+	base  http.RoundTripper
+	token func() (string, error)
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "teleproxy" {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.token()
+	if err != nil {
+		return nil, errors.Wrap(err, "api token")
+	}
+	// RoundTrippers must not modify the request
+	authed := *req
+	authed.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authed.Header[k] = v
+	}
+	authed.Header.Set(api.TokenHeader, api.Bearer(token))
+	return t.base.RoundTrip(&authed)
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+type recorder struct {
+	requests []*http.Request
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestAuthTransport(t *testing.T) {
+	base := &recorder{}
+	c := &http.Client{Transport: authTransport{base, func() (string, error) { return "secret", nil }}}
+	for _, url := range []string{"http://teleproxy/api/tables/", "http://example.com/"} {
+		if _, err := c.Get(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if auth := base.requests[0].Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected the token for teleproxy, got %q", auth)
+	}
+	if auth := base.requests[1].Header.Get("Authorization"); auth != "" {
+		t.Errorf("expected no token for other hosts, got %q", auth)
+	}
+}
+
+func TestRemoveInterceptName(t *testing.T) {
+	s := &Session{}
+	for _, name := range []string{"", "a/b"} {
+		if err := s.RemoveIntercept(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dump writes everything the session knows to w, for SIGUSR1: what it
+// is connected to and intercepting, the ports and tunnels it runs, the
+// routes and so the names dns answers, the firewall mappings, and the
+// stacks of every goroutine. It is meant to be read by a person, and
+// parts that can't be had are noted as such.
+func (s *Session) Dump(w io.Writer) {
+	section := func(title string) {
+		fmt.Fprintf(w, "=== %s\n", title)
+	}
+	fromAPI := func(title, url string) {
+		section(title)
+		body, err := s.get(url)
+		if err != nil {
+			fmt.Fprintf(w, "unavailable: %v\n", err)
+			return
+		}
+		w.Write(body)
+	}
+
+	section("session")
+	fmt.Fprintf(w, "context %s, namespace %s\n", s.kubeContext, s.kubeNamespace)
+	if pending := s.ready.pending(); len(pending) > 0 {
+		fmt.Fprintf(w, "waiting on %s\n", strings.Join(pending, ", "))
+	} else {
+		fmt.Fprintln(w, "ready")
+	}
+	if setup, err := s.Setup().Marshal(); err == nil {
+		w.Write(setup)
+	}
+	if s.proxy != nil {
+		fmt.Fprintf(w, "relaying %d connections\n", s.proxy.Active())
+	}
+
+	section("ports")
+	allocated := s.ports.Ports()
+	var names []string
+	for name := range allocated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %d\n", name, allocated[name])
+	}
+	for i, replica := range s.replicaPorts {
+		fmt.Fprintf(w, "replica %d: forward %d, tunnel %d\n", i+1, replica.forward, replica.tunnel)
+	}
+	for service, port := range s.exposedPorts() {
+		fmt.Fprintf(w, "exposed %d as svc/%s\n", port, service)
+	}
+
+	if s.opts.Intercept {
+		fromAPI("status", "http://teleproxy/api/status")
+		fromAPI("routes", "http://teleproxy/api/tables/")
+		fromAPI("nat", "http://teleproxy/api/nat")
+	}
+
+	section("goroutines")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// logWriter logs each line written to it, with a prefix.
+type logWriter struct {
+	prefix  string
+	partial string
+}
+
+func (l *logWriter) Write(data []byte) (int, error) {
+	lines := strings.Split(l.partial+string(data), "\n")
+	l.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		log.Print(l.prefix + line)
+	}
+	return len(data), nil
+}
+
+// DumpToLog logs the Dump of the session, a line at a time.
+func (s *Session) DumpToLog() {
+	w := &logWriter{prefix: "TPY: "}
+	s.Dump(w)
+	if w.partial != "" {
+		log.Print(w.prefix + w.partial)
+	}
+}
+
+// Drain stops relaying new intercepted connections, and waits up to
+// timeout for the ones being relayed to finish, so that closing the
+// session afterwards cuts off as little as possible. It is what SIGTERM
+// does before closing.
+func (s *Session) Drain(timeout time.Duration) {
+	if s.proxy == nil {
+		return
+	}
+	if n := s.proxy.Active(); n > 0 {
+		log.Printf("TPY: draining %d connections for up to %v", n, timeout)
+	}
+	if left := s.proxy.Drain(timeout); left > 0 {
+		log.Printf("TPY: closing with %d connections left", left)
+	}
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	w := &logWriter{prefix: "TPY: "}
+	w.Write([]byte("=== ports\nproxy 12"))
+	w.Write([]byte("34\n\ndns 53\n"))
+	expected := "TPY: === ports\nTPY: proxy 1234\nTPY: \nTPY: dns 53\n"
+	if actual := out.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if w.partial != "" {
+		t.Errorf("unexpected partial line %q", w.partial)
+	}
+}
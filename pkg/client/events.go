@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of Event.
+const (
+	// EventConnected is when the tunnel into the cluster comes up,
+	// initially or after being lost.
+	EventConnected = "connected"
+	// EventTunnelLost is when the tunnel into the cluster goes
+	// down. It is reestablished automatically.
+	EventTunnelLost = "tunnel-lost"
+	// EventInterceptAdded and EventInterceptRemoved are when
+	// InterceptService and ReleaseService succeed, or an intercept
+	// expires.
+	EventInterceptAdded   = "intercept-added"
+	EventInterceptRemoved = "intercept-removed"
+	// EventQuotaExceeded is when more than Options.Quota bytes have
+	// gone through the tunnel. It happens once per session.
+	EventQuotaExceeded = "quota-exceeded"
+	// EventHealth is when a command kept running for the session,
+	// e.g. ssh, starts flapping, is given up on, or recovers. The
+	// detail is e.g. "ssh: flapping".
+	EventHealth = "health"
+	// EventShutdown is when the session is closing. Hooks get a
+	// chance to run before anything is torn down.
+	EventShutdown = "shutdown"
+)
+
+// An Event is a change in the session that hooks are told about.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Context is the kubernetes context, if bridging.
+	Context string `json:"context,omitempty"`
+	// Detail is e.g. the intercepted service.
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	// hooks that take longer are abandoned
+	hookTimeout = 10 * time.Second
+	// how often the tunnel is checked
+	tunnelCheck = 2 * time.Second
+)
+
+// emit tells the hooks about an event, and returns what to wait on
+// for them to finish.
+func (s *Session) emit(kind, detail string) *sync.WaitGroup {
+	event := Event{Type: kind, Time: time.Now(), Context: s.kubeContext, Detail: detail}
+	var wg sync.WaitGroup
+	if s.opts.OnEvent != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.opts.OnEvent(event)
+		}()
+	}
+	if len(s.opts.Hooks) == 0 {
+		return &wg
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	for _, hook := range s.opts.Hooks {
+		wg.Add(1)
+		go func(hook string) {
+			defer wg.Done()
+			if err := runHook(hook, kind, body); err != nil {
+				log.Printf("TPY: %s hook %s: %v", kind, hook, err)
+			}
+		}(hook)
+	}
+	return &wg
+}
+
+// runHook posts the event to urls, and runs anything else as a shell
+// command with the event on stdin and its type in $TELEPROXY_EVENT.
+func runHook(hook, kind string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		req, err := http.NewRequest(http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "TELEPROXY_EVENT="+kind)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("TPY: %s hook: %s", kind, strings.TrimSpace(string(output)))
+	}
+	return err
+}
+
+// watchTunnel emits EventConnected and EventTunnelLost as the tunnel
+// at socks comes and goes, until stop is closed. changed is invoked
+// too.
+func (s *Session) watchTunnel(socks string, stop chan struct{}, changed func(up bool)) {
+	up := false
+	ticker := time.NewTicker(tunnelCheck)
+	defer ticker.Stop()
+	for {
+		conn, err := net.DialTimeout("tcp", socks, tunnelCheck)
+		if err == nil {
+			conn.Close()
+		}
+		switch {
+		case err == nil && !up:
+			s.ready.mark("tunnel")
+			s.emit(EventConnected, socks)
+			changed(true)
+			if s.proxy != nil && s.waking() {
+				s.proxy.Hush(0)
+			}
+		case err != nil && up && s.waking():
+			// expected, and soon over
+			log.Printf("BRG: tunnel is reconnecting after sleep")
+			changed(false)
+		case err != nil && up:
+			s.emit(EventTunnelLost, err.Error())
+			changed(false)
+		}
+		up = err == nil
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
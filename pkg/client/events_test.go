@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "event")
+
+	posted := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		posted <- event
+	}))
+	defer server.Close()
+
+	var called Event
+	s := &Session{
+		opts: Options{
+			Hooks:   []string{server.URL, `echo $TELEPROXY_EVENT > ` + file + `; cat >> ` + file},
+			OnEvent: func(event Event) { called = event },
+		},
+		kubeContext: "minikube",
+	}
+	s.emit(EventInterceptAdded, "default/web:80 -> 8080").Wait()
+
+	if called.Type != EventInterceptAdded || called.Context != "minikube" || called.Detail != "default/web:80 -> 8080" {
+		t.Errorf("unexpected event %+v", called)
+	}
+	if event := <-posted; event.Type != EventInterceptAdded {
+		t.Errorf("unexpected posted event %+v", event)
+	}
+
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := string(output)
+	var event Event
+	if err := json.Unmarshal(output[len(EventInterceptAdded)+1:], &event); err != nil {
+		t.Fatalf("%q: %v", lines, err)
+	}
+	if lines[:len(EventInterceptAdded)] != EventInterceptAdded || event.Detail != called.Detail {
+		t.Errorf("unexpected hook input %q", lines)
+	}
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// connectExec runs the tunnel into the cluster on address without a
+// teleproxy pod of its own: each connection is an nc run in pod, an
+// existing pod of the cluster, through kubectl exec. That takes nothing
+// but permission to exec in pod, for clusters where creating pods
+// isn't allowed, at the cost of a kubectl per connection, and of
+// connections that are refused only showing up as closed. The pod
+// needs nc, e.g. from busybox.
+func connectExec(kubeinfo *k8s.KubeInfo, pod, address string) (disconnect, reconnect func()) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := checkExec(kubeinfo, pod)
+			if err == nil {
+				break
+			}
+			log.Printf("EXC: can't tunnel through pod/%s: %v", pod, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(replicaRetry):
+			}
+		}
+		srv, err := socks.NewDialServer(address, execDialer(kubeinfo, pod))
+		if err != nil {
+			log.Printf("EXC: %v", err)
+			return
+		}
+		srv.Start()
+		<-stop
+		srv.Stop()
+	}()
+
+	disconnect = func() {
+		close(stop)
+		<-done
+	}
+	// each connection execs anew, so there is nothing to reconnect
+	reconnect = func() {}
+	return
+}
+
+// checkExec tells whether pod is there to exec nc in.
+func checkExec(kubeinfo *k8s.KubeInfo, pod string) error {
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+kubeinfo.GetKubectl(fmt.Sprintf("exec %s -- sh -c 'command -v nc'", pod)))
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// execDialer dials addresses as seen from pod.
+func execDialer(kubeinfo *k8s.KubeInfo, pod string) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return dialExec("exec kubectl " + kubeinfo.GetKubectl(fmt.Sprintf("exec -i %s -- nc %s %s", pod, host, port)))
+	}
+}
+
+// An execConn is a connection over the stdin and stdout of a command.
+type execConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *io.PipeReader
+	stderr bytes.Buffer
+
+	once  sync.Once
+	mutex sync.Mutex
+	timer *time.Timer
+}
+
+// dialExec starts command, which exec's whatever relays its stdin and
+// stdout, so that killing the shell kills it too.
+func dialExec(command string) (*execConn, error) {
+	c := &execConn{cmd: exec.Command("sh", "-c", command)}
+	var stdout *io.PipeWriter
+	c.stdout, stdout = io.Pipe()
+	c.cmd.Stdout = stdout
+	c.cmd.Stderr = &c.stderr
+	var err error
+	if c.stdin, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		err := c.cmd.Wait()
+		if err != nil && c.stderr.Len() > 0 {
+			log.Printf("EXC: %v: %s", err, strings.TrimSpace(c.stderr.String()))
+		}
+		stdout.Close()
+	}()
+	return c, nil
+}
+
+func (c *execConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *execConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// CloseWrite closes stdin, which nc passes on.
+func (c *execConn) CloseWrite() error { return c.stdin.Close() }
+
+func (c *execConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *execConn) LocalAddr() net.Addr  { return execAddr{} }
+func (c *execConn) RemoteAddr() net.Addr { return execAddr{} }
+
+// SetDeadline closes the connection once t passes, since pipes have no
+// deadlines of their own.
+func (c *execConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+	return nil
+}
+
+func (c *execConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+type execAddr struct{}
+
+func (execAddr) Network() string { return "exec" }
+func (execAddr) String() string  { return "exec" }
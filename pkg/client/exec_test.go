@@ -0,0 +1,39 @@
+package client
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestExecConn(t *testing.T) {
+	conn, err := dialExec("exec cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWrite()
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	idle, err := dialExec("exec cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(idle)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("deadline didn't close the connection")
+	}
+}
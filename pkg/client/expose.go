@@ -0,0 +1,188 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// the first port of the teleproxy pod that exposed ports are forwarded
+// from; the pod's sshd runs as an unprivileged user, so they can't be
+// the ports of the services
+const exposeBase = 9100
+
+// services are dns labels
+var serviceName = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// An exposer publishes local ports into the cluster, each as a service
+// of the teleproxy pod, which ssh forwards back to this host.
+type exposer struct {
+	kubeinfo   *k8s.KubeInfo
+	forward    int
+	pinnedKeys hostKeys
+	health     func(command string) func(tpu.Health, error)
+
+	mutex   sync.Mutex
+	exposed map[string]*exposure
+	next    int
+}
+
+// An exposure is the forward of one port.
+type exposure struct {
+	port, remote int
+	ssh          *tpu.Keeper
+}
+
+func newExposer(kubeinfo *k8s.KubeInfo, forward int, keys hostKeys, health func(command string) func(tpu.Health, error)) *exposer {
+	return &exposer{kubeinfo: kubeinfo, forward: forward, pinnedKeys: keys, health: health, exposed: make(map[string]*exposure)}
+}
+
+var exposeTemplate = template.Must(template.New("expose").Parse(`---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  labels:
+    app.kubernetes.io/managed-by: teleproxy
+spec:
+  selector:
+    name: teleproxy
+  ports:
+  - protocol: TCP
+    port: {{.Port}}
+    targetPort: {{.Remote}}
+`))
+
+// expose publishes port as service, replacing whichever port it
+// published before.
+func (e *exposer) expose(service string, port int) error {
+	if !serviceName.MatchString(service) || len(service) > 63 {
+		return fmt.Errorf("%q is not a valid service name", service)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%d is not a port", port)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for name, x := range e.exposed {
+		if x.port == port && name != service {
+			return fmt.Errorf("port %d is already exposed as svc/%s", port, name)
+		}
+	}
+	if x, ok := e.exposed[service]; ok {
+		if x.port == port {
+			return nil
+		}
+		x.ssh.Stop()
+		delete(e.exposed, service)
+	}
+
+	x := &exposure{port: port, remote: exposeBase + e.next}
+	e.next++
+	var manifest bytes.Buffer
+	if err := exposeTemplate.Execute(&manifest, struct {
+		Name         string
+		Port, Remote int
+	}{service, port, x.remote}); err != nil {
+		panic(err)
+	}
+	if _, err := tpu.Run([]string{"sh", "-c", "kubectl " + e.kubeinfo.GetKubectl("apply -f -")}, manifest.String()); err != nil {
+		return errors.Wrapf(err, "applying svc/%s", service)
+	}
+	x.ssh = tpu.NewKeeper("SSH", fmt.Sprintf("ssh -R 0.0.0.0:%d:127.0.0.1:%d -N -oConnectTimeout=5 -oExitOnForwardFailure=yes ", x.remote, port)+
+		hostKeyOptions(e.kubeinfo, e.pinnedKeys)+fmt.Sprintf(" telepresence@localhost -p %d", e.forward))
+	x.ssh.OnHealth = e.health("ssh (svc/" + service + ")")
+	x.ssh.Start()
+	e.exposed[service] = x
+	log.Printf("SSH: exposed port %d as svc/%s", port, service)
+	return nil
+}
+
+// unexpose deletes service and stops forwarding to its port.
+func (e *exposer) unexpose(service string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	x, ok := e.exposed[service]
+	if !ok {
+		return fmt.Errorf("svc/%s is not exposed", service)
+	}
+	x.ssh.Stop()
+	delete(e.exposed, service)
+	if _, err := tpu.Run([]string{"sh", "-c", "kubectl " + e.kubeinfo.GetKubectl("delete service --ignore-not-found "+service)}, ""); err != nil {
+		return errors.Wrapf(err, "deleting svc/%s", service)
+	}
+	log.Printf("SSH: unexposed svc/%s", service)
+	return nil
+}
+
+// close unexposes everything, since the services are of no use
+// without the session.
+func (e *exposer) close() {
+	for _, service := range e.services() {
+		if err := e.unexpose(service); err != nil {
+			log.Printf("SSH: %v", err)
+		}
+	}
+}
+
+func (e *exposer) services() (services []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for service := range e.exposed {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return
+}
+
+// exposedPorts returns the ports exposed, by service.
+func (e *exposer) exposedPorts() map[string]int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	result := make(map[string]int)
+	for service, x := range e.exposed {
+		result[service] = x.port
+	}
+	return result
+}
+
+// startExposer lets the session expose ports, if its tunnel is through
+// the lone teleproxy pod.
+func (s *Session) startExposer(kubeinfo *k8s.KubeInfo) {
+	if s.replicated() || s.opts.ExecPod != "" {
+		return
+	}
+	s.exposer = newExposer(kubeinfo, s.forwardPort, s.hostKeys(), s.health)
+	s.onClose(s.exposer.close)
+}
+
+// Expose publishes the local port as service, in the namespace of the
+// session, so that the cluster and others on the tunnel can call what
+// listens on it. Port 0 unexposes service. The services last as long
+// as the session does, and only the lone teleproxy pod can carry them.
+func (s *Session) Expose(service string, port int) error {
+	if s.exposer == nil {
+		return errors.New("exposing ports takes a tunnel through the lone teleproxy pod")
+	}
+	if port == 0 {
+		return s.exposer.unexpose(service)
+	}
+	return s.exposer.expose(service, port)
+}
+
+// exposedPorts is nil safe, for the api.
+func (s *Session) exposedPorts() map[string]int {
+	if s.exposer == nil {
+		return map[string]int{}
+	}
+	return s.exposer.exposedPorts()
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+func TestExposeChecks(t *testing.T) {
+	if err := (&Session{}).Expose("api", 8080); err == nil {
+		t.Error("expected an error exposing without a tunnel to carry it")
+	}
+
+	e := newExposer(nil, 0, hostKeys{}, nil)
+	e.exposed["api"] = &exposure{port: 8080, remote: exposeBase, ssh: tpu.NewKeeper("SSH", "true")}
+	for _, test := range []struct {
+		service string
+		port    int
+	}{
+		{"My_API", 8081},
+		{"-api", 8081},
+		{"web", 70000},
+		{"web", 8080},
+	} {
+		if err := e.expose(test.service, test.port); err == nil {
+			t.Errorf("%s %d: expected an error", test.service, test.port)
+		}
+	}
+	// the same again is nothing to do
+	if err := e.expose("api", 8080); err != nil {
+		t.Error(err)
+	}
+	if err := e.unexpose("web"); err == nil {
+		t.Error("expected an error unexposing what isn't exposed")
+	}
+	if ports := e.exposedPorts(); len(ports) != 1 || ports["api"] != 8080 {
+		t.Errorf("exposed %v", ports)
+	}
+}
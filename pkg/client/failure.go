@@ -0,0 +1,102 @@
+package client
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// The exit codes of the common reasons a session can't start, for
+// scripts and editor integrations to act on. 1 is anything else, and
+// 2 is a usage error, as the flag package has it, which invalid
+// Options are too.
+const (
+	ExitOther              = 1
+	ExitInvalidOptions     = 2
+	ExitNotRoot            = 3
+	ExitPortBusy           = 4
+	ExitKubeconfigInvalid  = 5
+	ExitClusterUnreachable = 6
+	ExitAgentMissing       = 7
+	ExitNATUnsupported     = 8
+)
+
+// A Failure is an error of one of the common kinds, with a name that
+// stays the same from release to release, e.g. "port-busy", and the
+// code to exit with. The name isn't part of the message, it is for
+// whoever reports the error to add.
+type Failure struct {
+	Name string
+	Code int
+	Err  error
+}
+
+func (f *Failure) Error() string {
+	return f.Err.Error()
+}
+
+// InvalidOptions is the Failure of Options to validate, of Problems.
+func InvalidOptions(err error) error {
+	return &Failure{"invalid-options", ExitInvalidOptions, err}
+}
+
+// NotRoot is the Failure to intercept without root.
+func NotRoot(err error) error {
+	return &Failure{"no-root", ExitNotRoot, err}
+}
+
+// PortBusy is the Failure to listen on a port that had to be used.
+func PortBusy(err error) error {
+	return &Failure{"port-busy", ExitPortBusy, err}
+}
+
+// KubeconfigInvalid is the Failure to load the kubeconfig, or the
+// context of it.
+func KubeconfigInvalid(err error) error {
+	return &Failure{"kubeconfig-invalid", ExitKubeconfigInvalid, err}
+}
+
+// ClusterUnreachable is the Failure of the cluster to answer.
+func ClusterUnreachable(err error) error {
+	return &Failure{"cluster-unreachable", ExitClusterUnreachable, err}
+}
+
+// AgentMissing is the Failure of the teleproxy pod to be there, or to
+// answer.
+func AgentMissing(err error) error {
+	return &Failure{"agent-missing", ExitAgentMissing, err}
+}
+
+// NATUnsupported is the Failure to find a nat backend that works here.
+func NATUnsupported(err error) error {
+	return &Failure{"nat-unsupported", ExitNATUnsupported, err}
+}
+
+// FailureOf returns the Failure err is, or was wrapped from, if any.
+func FailureOf(err error) *Failure {
+	f, _ := errors.Cause(err).(*Failure)
+	return f
+}
+
+// ExitCode returns the code to exit with for err: that of its Failure,
+// if it has one, otherwise ExitOther.
+func ExitCode(err error) int {
+	if f := FailureOf(err); f != nil {
+		return f.Code
+	}
+	return ExitOther
+}
+
+// addressInUse reports whether err is from listening on an address
+// that something else listens on already.
+func addressInUse(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sc, ok := err.(*os.SyscallError); ok {
+		err = sc.Err
+	}
+	return err == syscall.EADDRINUSE
+}
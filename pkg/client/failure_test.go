@@ -0,0 +1,54 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	cause := errors.New("listen udp 127.0.0.1:1233: bind: address already in use")
+	for _, test := range []struct {
+		err  error
+		code int
+		name string
+	}{
+		{cause, ExitOther, ""},
+		{PortBusy(cause), ExitPortBusy, "port-busy"},
+		{errors.Wrap(errors.Wrap(PortBusy(cause), "DNS"), "intercept"), ExitPortBusy, "port-busy"},
+		{ClusterUnreachable(cause), ExitClusterUnreachable, "cluster-unreachable"},
+	} {
+		if code := ExitCode(test.err); code != test.code {
+			t.Errorf("%v: exit code %d, not %d", test.err, code, test.code)
+		}
+		name := ""
+		if f := FailureOf(test.err); f != nil {
+			name = f.Name
+		}
+		if name != test.name {
+			t.Errorf("%v: failure %q, not %q", test.err, name, test.name)
+		}
+	}
+	if msg := errors.Wrap(PortBusy(cause), "DNS").Error(); msg != "DNS: "+cause.Error() {
+		t.Errorf("message %q", msg)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_, err = net.ListenPacket("udp", pc.LocalAddr().String())
+	if err == nil {
+		t.Fatal("listened twice")
+	}
+	if !addressInUse(err) {
+		t.Errorf("%v: not in use", err)
+	}
+	if addressInUse(errors.New("address already in use")) {
+		t.Error("only the errno counts")
+	}
+}
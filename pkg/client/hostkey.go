@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// DefaultKnownHosts is where the host keys of the teleproxy pods are
+// pinned, under the user's home directory.
+func DefaultKnownHosts() string {
+	home := os.Getenv("HOME")
+	if u, err := user.Current(); err == nil && u.HomeDir != "" {
+		home = u.HomeDir
+	}
+	return filepath.Join(home, ".teleproxy", "known_hosts")
+}
+
+// hostKeyAlias is what the host key of the teleproxy pod of a context
+// is pinned as. The pod is reached by way of a port-forward to a port
+// that changes, so its address can't be.
+func hostKeyAlias(context string) string {
+	return "teleproxy." + unsafe.ReplaceAllString(context, "_")
+}
+
+// pinned reports whether a host key is pinned for alias.
+func pinned(knownHosts, alias string) bool {
+	data, err := ioutil.ReadFile(knownHosts)
+	if err != nil {
+		return false
+	}
+	_, found := withoutAlias(data, alias)
+	return found
+}
+
+// withoutAlias returns the known hosts without the lines for alias.
+func withoutAlias(data []byte, alias string) ([]byte, bool) {
+	var result bytes.Buffer
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := scanner.Text(); isFor(line, alias) {
+			found = true
+		} else {
+			result.WriteString(line + "\n")
+		}
+	}
+	return result.Bytes(), found
+}
+
+func isFor(line, alias string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, host := range strings.Split(fields[0], ",") {
+		if host == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// pinHostKey fetches the host keys of a teleproxy pod by way of the
+// kubernetes api, which is authenticated, and pins them for alias.
+func pinHostKey(kubeinfo *k8s.KubeInfo, knownHosts, pod, alias string) error {
+	wait := "kubectl " + kubeinfo.GetKubectl("wait --for=condition=Ready pod/"+pod+" --timeout=60s")
+	if _, err := tpu.Run([]string{"sh", "-c", wait}, ""); err != nil {
+		return err
+	}
+	exec := "kubectl " + kubeinfo.GetKubectl(`exec pod/`+pod+` -- sh -c "cat /etc/ssh/ssh_host_*_key.pub"`)
+	result, err := tpu.Run([]string{"sh", "-c", exec}, "")
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && (strings.HasPrefix(fields[0], "ssh-") || strings.HasPrefix(fields[0], "ecdsa-")) {
+			lines = append(lines, alias+" "+fields[0]+" "+fields[1]+"\n")
+		}
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("no host keys in %q", result.Stdout)
+	}
+	if err := os.MkdirAll(filepath.Dir(knownHosts), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHosts, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, ""))
+	return err
+}
+
+// hostKeys is where the host keys of the teleproxy pods are pinned, and
+// what to do about a pod whose key can't be fetched to pin: ssh refuses
+// it, unless trustFirst is set, which has whatever key is offered first
+// pinned, and is told of the pod.
+type hostKeys struct {
+	knownHosts string
+	trustFirst func(pod string)
+}
+
+// hostKeyOptions are the ssh options that check the teleproxy pod of
+// the context against its pinned host key. If there is none yet, it is
+// fetched.
+func hostKeyOptions(kubeinfo *k8s.KubeInfo, keys hostKeys) string {
+	return podKeyOptions(kubeinfo, keys, "teleproxy", hostKeyAlias(kubeinfo.Context))
+}
+
+// podKeyOptions are hostKeyOptions for any teleproxy pod, whose host
+// key is pinned as alias.
+func podKeyOptions(kubeinfo *k8s.KubeInfo, keys hostKeys, pod, alias string) string {
+	checking := "yes"
+	if !pinned(keys.knownHosts, alias) {
+		err := pinHostKey(kubeinfo, keys.knownHosts, pod, alias)
+		switch {
+		case err == nil:
+			log.Printf("SSH: pinned the host key of pod/%s in %s", pod, keys.knownHosts)
+		case keys.trustFirst != nil:
+			log.Printf("SSH: couldn't fetch the host key of pod/%s, trusting the first one offered: %v", pod, err)
+			checking = "accept-new"
+			keys.trustFirst(pod)
+		default:
+			log.Printf("SSH: couldn't fetch the host key of pod/%s, which ssh refuses without it (see -trust-first-host-key): %v", pod, err)
+		}
+	}
+	return fmt.Sprintf("-oStrictHostKeyChecking=%s -oUserKnownHostsFile=%s -oHostKeyAlias=%s -oCheckHostIP=no",
+		checking, shellQuote(keys.knownHosts), alias)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ForgetHostKey unpins the host key of the teleproxy pod of a
+// kubernetes context, so that a new one, e.g. after the pod was
+// recreated, is accepted. It reports whether one was pinned.
+func ForgetHostKey(knownHosts, context string) (bool, error) {
+	return forgetAlias(knownHosts, hostKeyAlias(context))
+}
+
+func forgetAlias(knownHosts, alias string) (bool, error) {
+	data, err := ioutil.ReadFile(knownHosts)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rest, found := withoutAlias(data, alias)
+	if !found {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(knownHosts, rest, 0600)
+}
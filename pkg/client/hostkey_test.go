@@ -0,0 +1,67 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+func TestForgetHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+
+	alias := hostKeyAlias("gke_proj_zone_prod")
+	keys := "github.com ssh-ed25519 AAAAgithub\n" +
+		alias + " ssh-ed25519 AAAAprod\n" +
+		hostKeyAlias("minikube") + " ssh-rsa AAAAminikube\n" +
+		alias + ",other ecdsa-sha2-nistp256 AAAAprod2\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !pinned(knownHosts, alias) {
+		t.Errorf("expected %s to be pinned", alias)
+	}
+	if found, err := ForgetHostKey(knownHosts, "gke_proj_zone_prod"); !found || err != nil {
+		t.Fatalf("expected the key to be forgotten, got %v, %v", found, err)
+	}
+	data, _ := ioutil.ReadFile(knownHosts)
+	if expected := "github.com ssh-ed25519 AAAAgithub\n" + hostKeyAlias("minikube") + " ssh-rsa AAAAminikube\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+	if found, _ := ForgetHostKey(knownHosts, "gke_proj_zone_prod"); found {
+		t.Errorf("expected nothing left to forget")
+	}
+}
+
+func TestHostKeyUnfetched(t *testing.T) {
+	// a pod whose key kubectl doesn't show
+	_, cleanup := fakeKubectl(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeinfo := &k8s.KubeInfo{Context: "test", Namespace: "dev"}
+	keys := hostKeys{knownHosts: filepath.Join(dir, "known_hosts")}
+
+	if options := hostKeyOptions(kubeinfo, keys); !strings.Contains(options, "-oStrictHostKeyChecking=yes ") {
+		t.Errorf("expected ssh to refuse the pod, got %q", options)
+	}
+	var trusted []string
+	keys.trustFirst = func(pod string) { trusted = append(trusted, pod) }
+	if options := hostKeyOptions(kubeinfo, keys); !strings.Contains(options, "-oStrictHostKeyChecking=accept-new ") {
+		t.Errorf("expected ssh to trust the first key, got %q", options)
+	}
+	if len(trusted) != 1 || trusted[0] != "teleproxy" {
+		t.Errorf("expected the pod to be reported unchecked, got %v", trusted)
+	}
+}
@@ -0,0 +1,473 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/coexist"
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	"github.com/datawire/teleproxy/internal/pkg/docker"
+	"github.com/datawire/teleproxy/internal/pkg/hosts"
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/lsm"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/session"
+	"github.com/datawire/teleproxy/internal/pkg/tlsterm"
+	"github.com/datawire/teleproxy/internal/pkg/wsl"
+)
+
+// bypassMark is the firewall mark of the proxy's direct dials, which
+// the firewall lets through rather than redirecting them back to it
+// ("tp" in ascii)
+const bypassMark = 0x7470
+
+func dnsListeners(port string) (listeners []string) {
+	// turns out you need to listen on localhost for nat to work
+	// properly for udp, otherwise you get an "unexpected source
+	// blah thingy" because the dns reply packets look like they
+	// are coming from the wrong place
+	listeners = append(listeners, "127.0.0.1:"+port)
+
+	if runtime.GOOS == "linux" {
+		// These are the container bridges (docker0 and
+		// friends). We need to listen here because the nat
+		// logic we use to intercept dns packets will divert
+		// the packet to the interface it originates from,
+		// which in the case of containers is the bridge.
+		// Without this dns won't work from inside containers.
+		//
+		// Rootless podman containers don't need this, their
+		// dns queries come from slirp4netns on the host.
+		addrs := docker.BridgeAddrs()
+		if len(addrs) == 0 {
+			log.Printf("TPY: no container bridges found, dns from containers will not be intercepted")
+		}
+		for _, addr := range addrs {
+			listeners = append(listeners, addr+":"+port)
+		}
+	}
+
+	return
+}
+
+// uncovered returns the listeners that none of conns, the sockets of
+// socket activation, listens on already, by address and port or by
+// port on every address.
+func uncovered(listeners []string, conns []net.PacketConn) (result []string) {
+	for _, listener := range listeners {
+		host, port, _ := net.SplitHostPort(listener)
+		covered := false
+		for _, conn := range conns {
+			addr, ok := conn.LocalAddr().(*net.UDPAddr)
+			if ok && strconv.Itoa(addr.Port) == port && (addr.IP.IsUnspecified() || addr.IP.Equal(net.ParseIP(host))) {
+				covered = true
+			}
+		}
+		if !covered {
+			result = append(result, listener)
+		}
+	}
+	return
+}
+
+// intercept starts the interceptor, and only returns once the
+// interceptor is successfully running in another goroutine.  It
+// returns a function to call to shut down that goroutine.
+//
+// Everything but natConfig, which restricts which container networks
+// are intercepted, comes from the session options. If no dns server is
+// given, it will be detected from /etc/resolv.conf, and the fallback
+// defaults to Google DNS.
+func (s *Session) intercept(natConfig nat.Config) (func(), error) {
+	if err := privileged(); err != nil {
+		return nil, NotRoot(err)
+	}
+
+	dnsIP, fallback, corefile, err := s.nameservers()
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := coexist.Detect()
+	for _, conflict := range conflicts {
+		log.Printf("TPY: another interception tool is running: %s", conflict)
+	}
+	for _, conflict := range conflicts {
+		if conflict.Fatal && !s.opts.IgnoreConflicts {
+			return nil, fmt.Errorf("found %s, %s (or pass -ignore-conflicts)", conflict.Evidence, conflict.Remedy)
+		}
+	}
+
+	security := lsm.Detect()
+	for _, m := range security {
+		if m.Denies() {
+			log.Printf("TPY: %s, which may deny what teleproxy does, see teleproxy security-policy %s", m, m.Name)
+		}
+	}
+
+	iceptor, err := interceptor.NewInterceptor("teleproxy", s.opts.NATBackend)
+	if err != nil {
+		return nil, NATUnsupported(errors.Wrap(err, "Interceptor"))
+	}
+	s.configure(iceptor, natConfig)
+	iceptor.SetConflicts(conflicts)
+	iceptor.SetSecurity(security)
+
+	s.token = api.NewToken()
+	if err := api.WriteToken(s.opts.APITokenFile, s.token); err != nil {
+		return nil, errors.Wrap(lsm.Explain(err, security), "API Server")
+	}
+	apis, err := api.NewAPIServer(iceptor, s.opts.APIListen, s.token, s.opts.APISocket)
+	if err != nil {
+		return nil, errors.Wrap(err, "API Server")
+	}
+	if s.opts.DockerVMImage != "" {
+		// the shim, and anything else in the VM, reaches us on
+		// loopback
+		apis.ShareLoopback()
+	}
+	if s.opts.Debug {
+		apis.EnableDebug()
+	}
+	s.apis = apis
+	apiPort, _ := strconv.Atoi(apis.Port())
+	iceptor.AddPorts(map[string]int{"api": apiPort})
+
+	srv := s.dnsServer(iceptor, fallback, corefile)
+	apis.ServeAnswers(srv.Answer)
+
+	// hmm, we may not actually need to get the original
+	// destination, we could just forward each ip to a unique port
+	// and either listen on that port or run port-forward
+	proxy, err := proxy.NewProxy(":"+strconv.Itoa(s.proxyPort), s.opts.Socks, iceptor.Destination)
+	if err != nil {
+		return nil, errors.Wrap(err, "Proxy")
+	}
+	if len(s.opts.HTTPPorts) > 0 {
+		proxy.RouteHTTP(s.opts.HTTPPorts)
+	}
+	if len(s.opts.CacheHosts) > 0 {
+		proxy.CacheHTTP(tlsterm.Matcher(s.opts.CacheHosts), s.opts.CacheTTL)
+	}
+	if len(s.opts.TLSHosts) > 0 {
+		ca, err := tlsterm.LoadCA(s.opts.CADir)
+		if err != nil {
+			return nil, errors.Wrap(err, "certificate authority")
+		}
+		proxy.TerminateTLS(s.opts.TLSPorts, tlsterm.Matcher(s.opts.TLSHosts), ca.Certificate)
+	}
+	proxy.SetTimeouts(s.opts.Timeouts)
+	proxy.SetShaping(s.opts.Shaping)
+	proxy.Warm(s.opts.WarmForwards)
+	if s.opts.RaceDirect {
+		proxy.RaceDirect(bypassMark)
+	}
+	iceptor.SetUsage(proxy.Report)
+	s.proxy = proxy
+	totals, err := newLifetime(s.opts.CacheDir, func() interceptor.Totals {
+		traffic, connections := proxy.Usage().Totals()
+		return interceptor.Totals{Traffic: traffic, Connections: connections, DNSQueries: srv.Queries(), Sessions: 1}
+	})
+	if err != nil {
+		log.Printf("TPY: not keeping lifetime totals: %v", err)
+	} else {
+		iceptor.SetTotals(totals.totals)
+	}
+	var access *os.File
+	if s.opts.AccessLog != "" {
+		access, err = os.OpenFile(s.opts.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "access log")
+		}
+		proxy.SetAccessLog(access, s.opts.AccessLogJSON, iceptor.Service)
+	}
+	if s.opts.Quota > 0 {
+		proxy.Usage().SetQuota(s.opts.Quota, func(sent, received uint64) {
+			log.Printf("TPY: WARNING: more than the quota of %d bytes went through the tunnel", s.opts.Quota)
+			s.emit(EventQuotaExceeded, fmt.Sprintf("sent %d bytes, received %d bytes", sent, received))
+		})
+	}
+
+	bootstrap := route.Table{Name: "bootstrap"}
+	bootstrap.Add(route.Route{
+		Name:   "teleproxy",
+		Ip:     "127.254.254.254",
+		Target: apis.Port(),
+		Proto:  "tcp",
+	})
+
+	apis.Start()
+	restore := func() {}
+	var names *hosts.Publisher
+	// the address Windows sends its queries to, with WindowsDNS
+	var windowsDNS string
+	if s.opts.HostsDNS {
+		iceptor.SetDNS(interceptor.DNS{Strategy: "hosts", HostsFile: s.opts.HostsFile})
+		names = hosts.NewPublisher(s.opts.HostsFile, iceptor.Routes, func(name string) bool {
+			return name == "teleproxy" || len(s.opts.HostsNames) == 0 || matchesAny(s.opts.HostsNames, name)
+		})
+	} else {
+		iceptor.SetDNS(interceptor.DNS{Strategy: "redirect", Nameserver: net.JoinHostPort(dnsIP, "53"), Port: s.dnsPort})
+		bootstrap.Add(route.Route{
+			Ip:     dnsIP,
+			Target: strconv.Itoa(s.dnsPort),
+			Proto:  "udp",
+		})
+		if s.opts.WindowsDNS {
+			// Windows only sends queries to port 53, of the VM
+			// here, where nothing else listens
+			if windowsDNS, err = wsl.VMAddr(); err != nil {
+				apis.Stop()
+				return nil, errors.Wrap(err, "Windows DNS")
+			}
+			srv.Listeners = append(srv.Listeners, net.JoinHostPort(windowsDNS, "53"))
+		}
+		if err := srv.Start(); err != nil {
+			apis.Stop()
+			if addressInUse(err) {
+				err = PortBusy(err)
+			}
+			return nil, errors.Wrap(err, "DNS")
+		}
+		restore = dns.OverrideSearchDomains(".")
+	}
+	proxy.Start(10000)
+
+	if err := iceptor.Start(); err != nil {
+		apis.Stop()
+		restore()
+		return nil, errors.Wrap(lsm.Explain(err, security), "Interceptor")
+	}
+	iceptor.Update(bootstrap)
+	unsubscribe := func() {}
+	if names != nil {
+		names.Start()
+		// the firewall is programmed as the routes change, so
+		// that is when to publish them
+		var changes <-chan nat.Change
+		changes, unsubscribe = iceptor.Subscribe(64)
+		go func() {
+			for range changes {
+				names.Wake()
+			}
+		}()
+	}
+
+	var shim *docker.Shim
+	if s.opts.DockerVMImage != "" {
+		shim = docker.NewShim(s.opts.DockerVMImage)
+		// the shim reaches the host through Docker Desktop's
+		// special hostname
+		_, socksPort, err := net.SplitHostPort(s.opts.Socks)
+		if err == nil {
+			err = shim.Start("http://host.docker.internal:"+apis.Port(), "host.docker.internal:"+socksPort, s.token)
+		}
+		if err != nil {
+			log.Printf("TPY: Error starting docker vm shim: %v", err)
+		}
+	}
+
+	var windows *wsl.Publisher
+	if s.opts.PublishWindows {
+		windows, err = wsl.NewPublisher(iceptor.Routes)
+		if err != nil {
+			log.Printf("TPY: Error publishing to windows: %v", err)
+		} else {
+			if windowsDNS != "" {
+				windows.ResolveThrough(wsl.NewNRPT(windowsDNS), func() []string {
+					return wsl.Suffixes(iceptor.GetSearchPath())
+				})
+			}
+			windows.Start()
+		}
+	}
+
+	if totals != nil {
+		totals.start()
+	}
+
+	return func() {
+		unsubscribe()
+		if names != nil {
+			names.Stop()
+		}
+		if windows != nil {
+			windows.Stop()
+		}
+		if shim != nil {
+			shim.Stop()
+		}
+		// stop the api server first since it makes calls into
+		// the interceptor
+		apis.Stop()
+		os.Remove(s.opts.APITokenFile)
+		iceptor.Stop()
+		if totals != nil {
+			totals.close()
+		}
+		restore()
+		dns.Flush()
+		if access != nil {
+			access.Close()
+		}
+	}, nil
+}
+
+// nameservers finds the dns server to intercept the queries to, by
+// default the first of /etc/resolv.conf, and the one to relay the rest
+// to, by default that of the corefile, if any, or Google DNS.
+func (s *Session) nameservers() (dnsIP, fallback string, corefile dns.Corefile, err error) {
+	dnsIP = s.opts.DNS
+	fallbackIP := s.opts.Fallback
+
+	if dnsIP == "" {
+		dat, err := ioutil.ReadFile("/etc/resolv.conf")
+		if err != nil {
+			return "", "", corefile, err
+		}
+		for _, line := range strings.Split(string(dat), "\n") {
+			if strings.Contains(line, "nameserver") {
+				fields := strings.Fields(line)
+				dnsIP = fields[1]
+				log.Printf("TPY: Automatically set -dns=%v", dnsIP)
+				break
+			}
+		}
+	}
+	if dnsIP == "" {
+		return "", "", corefile, errors.New("couldn't determine dns ip from /etc/resolv.conf")
+	}
+
+	s.nameserver = dnsIP
+
+	if s.opts.DNSCorefile != "" {
+		if corefile, err = dns.LoadCorefile(s.opts.DNSCorefile); err != nil {
+			return "", "", corefile, errors.Wrap(err, "corefile")
+		}
+		for _, ignored := range corefile.Ignored {
+			log.Printf("TPY: corefile %s: ignoring %s", s.opts.DNSCorefile, ignored)
+		}
+	}
+	if fallbackIP == "" && corefile.Fallback != "" {
+		fallback = corefile.Fallback
+		fallbackIP, _, _ = net.SplitHostPort(fallback)
+	}
+	if fallbackIP == "" {
+		if dnsIP == "8.8.8.8" {
+			fallbackIP = "8.8.4.4"
+		} else {
+			fallbackIP = "8.8.8.8"
+		}
+		log.Printf("TPY: Automatically set -fallback=%v", dnsIP)
+	}
+	if fallbackIP == dnsIP {
+		return "", "", corefile, errors.New("if your fallbackIP and your dnsIP are the same, you will have a dns loop")
+	}
+	if fallback == "" {
+		fallback = fallbackIP + ":53"
+	}
+	return
+}
+
+// configure sets up iceptor with the firewall settings and routing of
+// the session options.
+func (s *Session) configure(iceptor *interceptor.Interceptor, natConfig nat.Config) {
+	natConfig.Timeouts = s.opts.Timeouts
+	iceptor.Configure(natConfig)
+	iceptor.SetNeverProxy(s.opts.NeverProxy)
+	iceptor.AddPorts(s.ports.Ports())
+	if s.opts.Remap != "never" {
+		_, virtual, _ := net.ParseCIDR(s.opts.VirtualCIDR)
+		iceptor.Remap(virtual)
+	}
+}
+
+// dnsServer is the dns server that answers for iceptor, relaying the
+// rest to fallback. It isn't started.
+func (s *Session) dnsServer(iceptor *interceptor.Interceptor, fallback string, corefile dns.Corefile) *dns.Server {
+	// validated already
+	rewrites, _ := dns.ParseRewrites(s.opts.DNSRewrites)
+	srv := &dns.Server{
+		Listeners:   uncovered(dnsListeners(strconv.Itoa(s.dnsPort)), s.dnsConns),
+		PacketConns: s.dnsConns,
+		Fallback:    fallback,
+		Resolve: func(domain string) string {
+			route := iceptor.Resolve(domain)
+			if route != nil {
+				return route.Ip
+			} else {
+				return ""
+			}
+		},
+		Excluded:    iceptor.NeverProxy,
+		Avoid:       iceptor.Avoid,
+		Provisional: iceptor.Provisional,
+		Timeouts:    s.opts.Timeouts,
+		ClientRate:  s.opts.DNSClientRate,
+		Rewrites:    rewrites,
+	}
+	corefile.Configure(srv)
+	if len(s.plugins) > 0 {
+		srv.Filter = s.plugins.Answer
+	}
+	return srv
+}
+
+// acquire takes the session lock, optionally shutting down whoever
+// currently holds it.
+func acquire(path, mode string, takeover bool) (*session.Session, error) {
+	sess, err := session.Acquire(path, session.Username(), mode)
+	busy, ok := err.(*session.BusyError)
+	if !ok {
+		return sess, err
+	}
+	if !takeover {
+		return nil, fmt.Errorf("%v, take it over to shut it down", err)
+	}
+	log.Printf("TPY: taking over from %s", busy.Owner)
+	if _, err := session.Takeover(path, 30*time.Second); err != nil {
+		return nil, err
+	}
+	return session.Acquire(path, session.Username(), mode)
+}
+
+// networkInterfaces resolves container networks to the names of their
+// bridge interfaces.
+func networkInterfaces(networks []string, containerRuntime *docker.Runtime) (result []string, err error) {
+	if len(networks) == 0 {
+		return
+	}
+
+	runtime := docker.Docker
+	if containerRuntime != nil {
+		runtime = *containerRuntime
+	} else if detected, err := docker.DetectRuntime(); err == nil {
+		runtime = detected
+	}
+
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		iface, err := runtime.NetworkInterface(network)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("TPY: network %s is interface %s", network, iface)
+		result = append(result, iface)
+	}
+	return
+}
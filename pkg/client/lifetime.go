@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+)
+
+// how often the lifetime totals are saved while a session runs, which
+// bounds what a crash loses
+const lifetimeInterval = time.Minute
+
+// A lifetime keeps the totals of every session there has been in the
+// cache directory, so that the status of a session can show them next
+// to its own, e.g. to tell how much traffic teleproxy has relayed
+// rather than deploying to the cluster.
+type lifetime struct {
+	filename string
+	session  func() interceptor.Totals
+	// before totals the sessions before this one
+	before interceptor.Totals
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newLifetime returns the lifetime totals kept in dir, or the user's
+// cache directory if dir is empty, which session adds to.
+func newLifetime(dir string, session func() interceptor.Totals) (*lifetime, error) {
+	dir, err := stateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &lifetime{
+		filename: filepath.Join(dir, "lifetime.json"),
+		session:  session,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	data, err := ioutil.ReadFile(l.filename)
+	if err == nil {
+		err = json.Unmarshal(data, &l.before)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return l, nil
+}
+
+// totals returns the totals of this session, and of every session
+// including this one.
+func (l *lifetime) totals() (session, lifetime interceptor.Totals) {
+	session = l.session()
+	return session, l.before.Add(session)
+}
+
+func (l *lifetime) save() error {
+	_, total := l.totals()
+	data, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.filename), 0700); err != nil {
+		return err
+	}
+	tmp := l.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.filename)
+}
+
+// start saves the totals every lifetimeInterval until close.
+func (l *lifetime) start() {
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(lifetimeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.save(); err != nil {
+					log.Printf("TPY: Error saving lifetime totals: %v", err)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops saving periodically, and saves the totals one last time.
+func (l *lifetime) close() {
+	close(l.stop)
+	<-l.done
+	if err := l.save(); err != nil {
+		log.Printf("TPY: Error saving lifetime totals: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+)
+
+func TestLifetime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifetime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	current := interceptor.Totals{Traffic: proxy.Traffic{Sent: 100, Received: 1000}, Connections: 3, DNSQueries: 7, Sessions: 1}
+	first, err := newLifetime(dir, func() interceptor.Totals { return current })
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.start()
+	first.close()
+
+	current = interceptor.Totals{Traffic: proxy.Traffic{Sent: 10, Received: 20}, Connections: 1, DNSQueries: 2, Sessions: 1}
+	second, err := newLifetime(dir, func() interceptor.Totals { return current })
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, lifetime := second.totals()
+	if session != current {
+		t.Errorf("expected the session totals %+v, got %+v", current, session)
+	}
+	expected := interceptor.Totals{Traffic: proxy.Traffic{Sent: 110, Received: 1020}, Connections: 4, DNSQueries: 9, Sessions: 2}
+	if lifetime != expected {
+		t.Errorf("expected the lifetime totals %+v, got %+v", expected, lifetime)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "lifetime.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newLifetime(dir, func() interceptor.Totals { return current }); err == nil {
+		t.Error("expected corrupt totals to be reported")
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/datawire/teleproxy/internal/pkg/docker"
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+// detectLocal returns the local cluster that opts select, if they
+// select one.
+func detectLocal(opts Options) *k8s.LocalCluster {
+	if !opts.Bridge && !opts.TunnelOnly {
+		return nil
+	}
+	kubeinfo, err := k8s.NewKubeInfo(opts.Kubeconfig, opts.Context, opts.Namespace)
+	if err != nil {
+		// connecting will say what is wrong
+		return nil
+	}
+	local := kubeinfo.LocalCluster()
+	if local != nil {
+		where := "in a vm"
+		if local.Network != "" {
+			where = "on container network " + local.Network
+		}
+		log.Printf("TPY: %s is a local %s cluster %s", kubeinfo.Context, local.Kind, where)
+	}
+	return local
+}
+
+// localInterface returns the bridge interface of the network of a
+// local cluster, so that the traffic of its nodes can be left alone.
+// Otherwise whatever the nodes send to the host, e.g. the dns queries
+// of the cluster itself, would be intercepted and sent right back into
+// the cluster through the tunnel.
+func (s *Session) localInterface(containerRuntime *docker.Runtime) (string, bool) {
+	if s.local == nil || s.local.Network == "" {
+		return "", false
+	}
+	for _, network := range s.opts.IncludeNetworks {
+		if strings.TrimSpace(network) == s.local.Network {
+			// asked for explicitly
+			return "", false
+		}
+	}
+	ifaces, err := networkInterfaces([]string{s.local.Network}, containerRuntime)
+	if err != nil {
+		log.Printf("TPY: not excluding the %s network of the cluster: %v", s.local.Network, err)
+		return "", false
+	}
+	return ifaces[0], true
+}
+
+// bypassProxy keeps the api server of a local cluster from being
+// reached through an upstream proxy or bastion, which can't reach this
+// host's containers. Loopback addresses are never proxied anyway, but
+// e.g. the 0.0.0.0 that k3d uses would be.
+func bypassProxy(local *k8s.LocalCluster) {
+	for _, name := range []string{"NO_PROXY", "no_proxy"} {
+		value := os.Getenv(name)
+		if value != "" {
+			value += ","
+		}
+		os.Setenv(name, value+local.APIHost)
+	}
+}
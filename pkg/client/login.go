@@ -0,0 +1,213 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/agentauth"
+	"github.com/datawire/teleproxy/internal/pkg/agenttls"
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// tokenTTL is how long the token that AgentTokenCmd printed is logged
+// into the proxy of the pods with before it is asked for again.
+const tokenTTL = time.Minute
+
+// An agentLogin is how ssh logs into the teleproxy pods. Unless they
+// were installed with Manifest.Auth, anyone gets in as is.
+type agentLogin struct {
+	// env comes before the ssh command, options right after it
+	env, options string
+	// askpass is the script ssh asks for the token, if any
+	askpass string
+	// tokens, with a token, is what the proxy of the pods, which
+	// ssh only forwards to then, is logged into with
+	tokens *tokenSource
+	// bundle, with mutual TLS, is the certificate ssh reaches the
+	// pods with, see withTLS
+	bundle string
+}
+
+// newAgentLogin returns the login of opts: with the token that
+// AgentTokenCmd prints, which ssh asks for as the password, with the
+// certificate of AgentIdentity, or as is.
+func newAgentLogin(opts Options) (agentLogin, error) {
+	switch {
+	case opts.AgentIdentity != "":
+		if _, err := os.Stat(opts.AgentIdentity + "-cert.pub"); err != nil {
+			return agentLogin{}, err
+		}
+		return agentLogin{options: "-i " + shellQuote(opts.AgentIdentity) + " -oIdentitiesOnly=yes -oPreferredAuthentications=publickey "}, nil
+	case opts.AgentTokenCmd != "":
+		f, err := ioutil.TempFile("", "teleproxy-askpass")
+		if err != nil {
+			return agentLogin{}, err
+		}
+		defer f.Close()
+		if _, err := f.WriteString("#!/bin/sh\n" + opts.AgentTokenCmd + "\n"); err != nil {
+			os.Remove(f.Name())
+			return agentLogin{}, err
+		}
+		if err := f.Chmod(0700); err != nil {
+			os.Remove(f.Name())
+			return agentLogin{}, err
+		}
+		// older ssh only asks without a terminal, and with a display
+		return agentLogin{
+			env:     "SSH_ASKPASS=" + shellQuote(f.Name()) + " SSH_ASKPASS_REQUIRE=force DISPLAY=${DISPLAY:-:0} ",
+			options: "-oPreferredAuthentications=password -oNumberOfPasswordPrompts=1 ",
+			askpass: f.Name(),
+			tokens:  &tokenSource{command: opts.AgentTokenCmd},
+		}, nil
+	}
+	return agentLogin{}, nil
+}
+
+// port is the port of the pods that ssh reaches, by way of a
+// port-forward.
+func (l agentLogin) port() int {
+	if l.bundle != "" {
+		return agenttls.Port
+	}
+	return 8022
+}
+
+// withTLS has ssh reach the pods, which were installed with
+// Manifest.TLS, over mutual TLS, with a certificate from the CA that
+// the cluster keeps in agenttls.Secret. The first session to connect
+// creates the CA.
+func (l *agentLogin) withTLS(kubeinfo *k8s.KubeInfo) error {
+	ca, err := tunnelCA(kubeinfo)
+	if err != nil {
+		return err
+	}
+	name := "teleproxy"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	bundle, err := ca.Bundle(name)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// only readable by us, as TempFile creates it
+	f, err := ioutil.TempFile("", "teleproxy-tls")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(bundle); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	l.bundle = f.Name()
+	l.options += "-o" + shellQuote("ProxyCommand="+shellQuote(exe)+" -mode agent-dial "+shellQuote(l.bundle)+" %h:%p") + " "
+	return nil
+}
+
+// tunnelCA returns the CA in agenttls.Secret, which it creates if it
+// isn't there.
+func tunnelCA(kubeinfo *k8s.KubeInfo) (*agenttls.CA, error) {
+	get := "kubectl " + kubeinfo.GetKubectl("get secret "+agenttls.Secret+` -o 'jsonpath={.data.ca\.pem} {.data.ca-key\.pem}'`)
+	for attempt := 0; ; attempt++ {
+		result, err := tpu.Run([]string{"sh", "-c", get}, "")
+		if err == nil {
+			fields := strings.Fields(result.Stdout)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("secret %s has no %s and %s", agenttls.Secret, agenttls.CertFile, agenttls.KeyFile)
+			}
+			certPEM, err := base64.StdEncoding.DecodeString(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			keyPEM, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			return agenttls.ParseCA(certPEM, keyPEM)
+		}
+		if attempt > 0 || !strings.Contains(result.Stderr, "NotFound") {
+			return nil, err
+		}
+
+		certPEM, keyPEM, err := agenttls.NewCA()
+		if err != nil {
+			return nil, err
+		}
+		secret := fmt.Sprintf("apiVersion: v1\nkind: Secret\nmetadata:\n  name: %s\ndata:\n  %s: %s\n  %s: %s\n",
+			agenttls.Secret, agenttls.CertFile, base64.StdEncoding.EncodeToString(certPEM),
+			agenttls.KeyFile, base64.StdEncoding.EncodeToString(keyPEM))
+		// create rather than apply, so that of two sessions at
+		// once, both end up with the CA of the first
+		create := "kubectl " + kubeinfo.GetKubectl("create -f -")
+		if result, err := tpu.Run([]string{"sh", "-c", create}, secret); err != nil && !strings.Contains(result.Stderr, "AlreadyExists") {
+			return nil, err
+		}
+	}
+}
+
+// forward is the option of ssh that has it forward port to the pods:
+// as a SOCKS proxy, or, with a token, to the one in the pods.
+func (l agentLogin) forward(port int) string {
+	if l.tokens != nil {
+		return fmt.Sprintf("-L 127.0.0.1:%d:%s ", port, agentauth.ProxyAddress)
+	}
+	return fmt.Sprintf("-D 127.0.0.1:%d ", port)
+}
+
+// ssh is the command line of ssh with args, logging in as l.
+func (l agentLogin) ssh(args string) string {
+	return l.env + "ssh " + l.options + args
+}
+
+func (l agentLogin) close() {
+	for _, file := range []string{l.askpass, l.bundle} {
+		if file != "" {
+			os.Remove(file)
+		}
+	}
+}
+
+// A tokenSource runs command for a token, and keeps it for a while.
+type tokenSource struct {
+	command string
+
+	mutex sync.Mutex
+	token string
+	at    time.Time
+}
+
+func (t *tokenSource) get() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.token != "" && time.Since(t.at) < tokenTTL {
+		return t.token, nil
+	}
+	out, err := exec.Command("sh", "-c", t.command).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", t.command, err)
+	}
+	t.token, t.at = strings.TrimSpace(string(out)), time.Now()
+	return t.token, nil
+}
+
+// forget has the token asked for again, e.g. once it was refused.
+func (t *tokenSource) forget() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.token = ""
+}
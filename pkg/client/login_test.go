@@ -0,0 +1,124 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datawire/teleproxy/internal/pkg/agenttls"
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+func TestAgentLogin(t *testing.T) {
+	if l, err := newAgentLogin(Options{}); err != nil || l.ssh(l.forward(9050)+"-N host") != "ssh -D 127.0.0.1:9050 -N host" {
+		t.Errorf("as is: %q, %v", l.ssh(l.forward(9050)+"-N host"), err)
+	}
+
+	l, err := newAgentLogin(Options{AgentTokenCmd: "echo minted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ssh runs the askpass script for the password
+	result, err := tpu.Run([]string{"sh", "-c", l.env + `sh -c '"$SSH_ASKPASS" password:'`}, "")
+	if err != nil || result.Stdout != "minted\n" {
+		t.Errorf("askpass: %q, %v", result.Stdout, err)
+	}
+	if command := l.ssh("-N host"); !strings.Contains(command, "SSH_ASKPASS_REQUIRE=force ") || !strings.Contains(command, "ssh -oPreferredAuthentications=password ") {
+		t.Errorf("token: %q", command)
+	}
+	if token, err := l.tokens.get(); err != nil || token != "minted" {
+		t.Errorf("token for the proxy: %q, %v", token, err)
+	}
+	if forward := l.forward(9050); forward != "-L 127.0.0.1:9050:127.0.0.1:1080 " {
+		t.Errorf("token forward: %q", forward)
+	}
+	l.close()
+	if _, err := os.Stat(l.askpass); !os.IsNotExist(err) {
+		t.Errorf("askpass left behind: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_ed25519")
+	if _, err := newAgentLogin(Options{AgentIdentity: key}); err == nil {
+		t.Errorf("expected an error without a certificate")
+	}
+	if err := ioutil.WriteFile(key+"-cert.pub", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err = newAgentLogin(Options{AgentIdentity: key})
+	if err != nil || !strings.HasPrefix(l.ssh("-N host"), "ssh -i '"+key+"' -oIdentitiesOnly=yes ") {
+		t.Errorf("cert: %q, %v", l.ssh("-N host"), err)
+	}
+}
+
+// fakeKubectl puts a kubectl on the PATH that keeps the one secret it
+// is given to create, in the fashion of tunnelCA, and logs how it was
+// run.
+func fakeKubectl(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kubectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "secret")
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\ncase \"$*\" in\n" +
+		"*create*) [ -e " + secret + " ] && { echo AlreadyExists >&2; exit 1; }; cat > " + secret + " ;;\n" +
+		"*get*) [ -e " + secret + " ] || { echo NotFound >&2; exit 1; }\n" +
+		"    echo $(sed -n 's/^  ca.pem: //p' " + secret + ") $(sed -n 's/^  ca-key.pem: //p' " + secret + ") ;;\n" +
+		"esac\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return calls, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentLoginTLS(t *testing.T) {
+	calls, cleanup := fakeKubectl(t)
+	defer cleanup()
+	kubeinfo := &k8s.KubeInfo{Context: "test", Namespace: "dev"}
+
+	// the first session creates the CA, and the next one uses it
+	for i := 0; i < 2; i++ {
+		if _, err := tunnelCA(kubeinfo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creates := strings.Count(string(log), " create -f -"); creates != 1 {
+		t.Errorf("expected the CA to be created once, got\n%s", log)
+	}
+
+	var l agentLogin
+	if err := l.withTLS(kubeinfo); err != nil {
+		t.Fatal(err)
+	}
+	if l.port() != agenttls.Port || !strings.Contains(l.ssh("-N host"), "ProxyCommand=") || !strings.Contains(l.ssh("-N host"), " -mode agent-dial ") {
+		t.Errorf("tls: %d, %q", l.port(), l.ssh("-N host"))
+	}
+	bundle, err := ioutil.ReadFile(l.bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agenttls.ParseBundle(bundle); err != nil {
+		t.Errorf("bundle: %v", err)
+	}
+	l.close()
+	if _, err := os.Stat(l.bundle); !os.IsNotExist(err) {
+		t.Errorf("bundle left behind: %v", err)
+	}
+}
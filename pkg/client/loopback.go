@@ -0,0 +1,107 @@
+package client
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/datawire/teleproxy/internal/pkg/loopback"
+	"github.com/datawire/teleproxy/internal/pkg/wsl"
+)
+
+// DefaultLoopbackCIDR is the range services are bound to with
+// Options.Loopback, clear of 127.0.0.1.
+const DefaultLoopbackCIDR = "127.0.2.0/24"
+
+// the range of Windows' loopback addresses that Options.WindowsPortProxy
+// gives services
+const windowsPortProxyCIDR = "127.0.3.0/24"
+
+// DefaultHostsFile is where the services bound to loopback addresses
+// are named.
+const DefaultHostsFile = "/etc/hosts"
+
+// startLoopback binds the services of b that the session asks for to
+// loopback addresses, relaying through the tunnel.
+func (s *Session) startLoopback(b *kubernetesBridge) func() {
+	if len(s.opts.Loopback) == 0 {
+		return func() {}
+	}
+	dialer, err := proxy.SOCKS5("tcp", s.opts.Socks, nil, proxy.Direct)
+	if err == nil {
+		b.loopback, err = loopback.NewBinder(s.opts.LoopbackCIDR, s.opts.HostsFile, dialer.Dial)
+	}
+	if err != nil {
+		log.Printf("BRG: not binding services to loopback addresses: %v", err)
+		return func() {}
+	}
+	log.Printf("BRG: binding %s to loopback addresses from %s", strings.Join(s.opts.Loopback, ", "), s.opts.LoopbackCIDR)
+	return b.loopback.Close
+}
+
+// startPortProxy gives the services of b that the session asks for to
+// Windows, by way of netsh's portproxy.
+func (s *Session) startPortProxy(b *kubernetesBridge) func() {
+	if len(s.opts.WindowsPortProxy) == 0 {
+		return func() {}
+	}
+	dialer, err := proxy.SOCKS5("tcp", s.opts.Socks, nil, proxy.Direct)
+	if err == nil {
+		b.portProxy, err = wsl.NewPortProxy(windowsPortProxyCIDR, dialer.Dial)
+	}
+	if err != nil {
+		log.Printf("BRG: not giving services to windows: %v", err)
+		return func() {}
+	}
+	log.Printf("BRG: giving %s to windows at addresses from %s", strings.Join(s.opts.WindowsPortProxy, ", "), windowsPortProxyCIDR)
+	return b.portProxy.Close
+}
+
+// boundServices are the services that match patterns, to bind to
+// addresses of their own, by the name they have in the cluster, with
+// their tcp ports.
+func (b *kubernetesBridge) boundServices(patterns []string) []loopback.Service {
+	var result []loopback.Service
+	for _, svc := range b.services {
+		if b.pol != nil && !b.pol.decided(svc.Namespace()) {
+			continue
+		}
+		if !matchesAny(patterns, svc.Namespace()+"/"+svc.Name()) {
+			continue
+		}
+		short := svc.Name() + "." + svc.Namespace()
+		bound := loopback.Service{
+			Host:  short + ".svc." + b.network.Domain,
+			Names: []string{short, short + ".svc", short + ".svc." + b.network.Domain},
+		}
+		if svc.Namespace() == b.session.kubeNamespace {
+			bound.Names = append([]string{svc.Name()}, bound.Names...)
+		}
+		ports, _ := svc.Spec()["ports"].([]interface{})
+		for _, p := range ports {
+			port, _ := p.(map[string]interface{})
+			if protocol, _ := port["protocol"].(string); protocol != "" && protocol != "TCP" {
+				continue
+			}
+			if n, ok := number(port["port"]); ok {
+				bound.Ports = append(bound.Ports, n)
+			}
+		}
+		if len(bound.Ports) > 0 {
+			result = append(result, bound)
+		}
+	}
+	return result
+}
+
+// matchesAny is whether name matches one of patterns, e.g. "default/*".
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+func TestLoopbackServices(t *testing.T) {
+	s := &Session{opts: Options{Loopback: []string{"default/web", "kube-system/*"}}, kubeNamespace: "default"}
+	b := newKubernetesBridge(s, k8s.Network{Domain: "cluster.local"}, nil)
+	web := service("web", "10.96.0.10")
+	web.Spec()["ports"] = []interface{}{
+		map[string]interface{}{"port": int64(80), "protocol": "TCP"},
+		map[string]interface{}{"port": int64(53), "protocol": "UDP"},
+	}
+	api := service("api", "10.96.0.11")
+	api.Spec()["ports"] = []interface{}{map[string]interface{}{"port": int64(8080)}}
+	dns := k8s.Resource{
+		"metadata": map[string]interface{}{"name": "kube-dns", "namespace": "kube-system"},
+		"spec":     map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(53), "protocol": "UDP"}}},
+	}
+	b.services = []k8s.Resource{web, api, dns}
+
+	services := b.boundServices(s.opts.Loopback)
+	if len(services) != 1 {
+		t.Fatalf("services %+v", services)
+	}
+	if svc := services[0]; svc.Host != "web.default.svc.cluster.local" ||
+		!reflect.DeepEqual(svc.Names, []string{"web", "web.default", "web.default.svc", "web.default.svc.cluster.local"}) ||
+		!reflect.DeepEqual(svc.Ports, []int{80}) {
+		t.Errorf("bound %+v", svc)
+	}
+}
@@ -0,0 +1,597 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/agenttls"
+)
+
+// AgentImage is the image of the teleproxy pods, unless configured
+// otherwise.
+const AgentImage = "datawire/telepresence-k8s:0.75"
+
+// AgentArch lists the architectures AgentImage is built for.
+var AgentArch = []string{"amd64"}
+
+// A Manifest describes the teleproxy pods for a platform team to
+// install themselves, e.g. through GitOps, rather than each session
+// applying its own. Sessions with Options.AgentInstalled connect to
+// them.
+type Manifest struct {
+	// Namespace defaults to whichever one the manifest is applied
+	// to. Sessions need to be pointed at it.
+	Namespace string
+	// Image defaults to AgentImage.
+	Image string
+	// Arch lists the architectures, e.g. "arm64", that Image is
+	// built for, and so the nodes the pods may run on. It defaults
+	// to AgentArch for AgentImage, and to any for other images,
+	// which are taken to be multi-arch: the nodes pull whichever
+	// build is theirs.
+	Arch []string
+	// PullSecrets name the secrets, in the namespace of the pods,
+	// to pull Image with, e.g. from a private registry.
+	PullSecrets []string
+	// Replicas defaults to one.
+	Replicas int
+	// CPU and Memory, e.g. "100m" and "64Mi", are requested and
+	// limited to, if set.
+	CPU, Memory  string
+	NodeSelector map[string]string
+	// RBAC is the scope of the permissions granted to Group, the
+	// developers' group, to connect: "namespace" for the pods, or
+	// "cluster" to also list and watch services everywhere, as
+	// bridging does. Without either, permissions are left to the
+	// platform team.
+	RBAC  string
+	Group string
+	// Auth has the pods authenticate each developer that logs in:
+	// with a bearer token that the kubernetes api accepts ("token"),
+	// of Group if set, or with an ssh certificate signed by the CA
+	// that is ca.pub in the secret CASecret ("cert"). Either takes
+	// an Image built from docker/teleproxy-agent. Without, anyone who
+	// may port-forward to the pods gets in.
+	Auth     string
+	CASecret string
+	// Policy, with token Auth, has the pods only connect developers to
+	// services and pods in namespaces where the cluster permits them
+	// to create InterceptResource.
+	Policy bool
+	// TLS has the pods take the tunnel over mutual TLS only, from
+	// sessions with Options.AgentTLS, which is the CA kept in the
+	// secret agenttls.Secret. The first session creates it, and the
+	// pods start once it is there. It takes an Image built from
+	// docker/teleproxy-agent.
+	TLS bool
+	// BudgetVersion is the group version of the pod disruption
+	// budget, policy/v1 unless set, e.g. from KubeInfo.BudgetVersion
+	// for clusters older than 1.21. Helm charts ask the cluster instead.
+	BudgetVersion string
+}
+
+func (m Manifest) defaults() (Manifest, error) {
+	switch m.Auth {
+	case "", "token":
+	case "cert":
+		if m.CASecret == "" {
+			return m, fmt.Errorf("cert auth requires the secret of the CA")
+		}
+	default:
+		return m, fmt.Errorf("auth %q is neither token nor cert", m.Auth)
+	}
+	if m.Policy && m.Auth != "token" {
+		return m, fmt.Errorf("the policy requires token auth, to know who to review access for")
+	}
+	if m.Auth != "" && m.Image == "" {
+		return m, fmt.Errorf("%s auth requires an image built from docker/teleproxy-agent, %s can't authenticate", m.Auth, AgentImage)
+	}
+	if m.TLS && m.Image == "" {
+		return m, fmt.Errorf("tls requires an image built from docker/teleproxy-agent, %s can't terminate it", AgentImage)
+	}
+	if m.Image == "" {
+		m.Image = AgentImage
+		if len(m.Arch) == 0 {
+			m.Arch = AgentArch
+		}
+	}
+	if m.Replicas < 1 {
+		m.Replicas = 1
+	}
+	if m.BudgetVersion == "" {
+		m.BudgetVersion = "policy/v1"
+	}
+	switch m.RBAC {
+	case "", "namespace", "cluster":
+	default:
+		return m, fmt.Errorf("rbac scope %q is neither namespace nor cluster", m.RBAC)
+	}
+	if m.RBAC != "" && m.Group == "" {
+		return m, fmt.Errorf("rbac scope %s requires a group", m.RBAC)
+	}
+	return m, nil
+}
+
+// The replicas are spread over nodes where possible, and the budget
+// keeps a drain from evicting more than one at a time, so that the
+// others carry the tunnel meanwhile. The label is not the one of the
+// lone teleproxy pod, which the deployment would otherwise adopt.
+//
+// The delimiters leave those of helm alone: with .Helm, the parameters
+// come from the values of the chart instead.
+var manifestTemplate = template.Must(template.New("manifest").Delims("[[", "]]").Parse(`
+[[- define "namespace"]]
+[[- if .Namespace]]
+  namespace: [[.Namespace]]
+[[- end]]
+[[- end]]
+[[- define "arch"]]
+        nodeAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            nodeSelectorTerms:
+            - matchExpressions:
+              - key: kubernetes.io/arch
+                operator: In
+                values:
+[[- end]]
+[[- define "limits"]]
+[[- if .CPU]]
+            cpu: [[printf "%q" .CPU]]
+[[- end]]
+[[- if .Memory]]
+            memory: [[printf "%q" .Memory]]
+[[- end]]
+[[- end]]
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: teleproxy
+[[- template "namespace" .]]
+spec:
+[[- if .Helm]]
+  replicas: {{ .Values.replicas }}
+[[- else]]
+  replicas: [[.Replicas]]
+[[- end]]
+  selector:
+    matchLabels:
+      name: teleproxy-replica
+  template:
+    metadata:
+      labels:
+        name: teleproxy-replica
+    spec:
+      affinity:
+[[- if .Helm]]
+        {{- with .Values.arch }}
+[[- template "arch"]]
+                {{- toYaml . | nindent 16 }}
+        {{- end }}
+[[- else if .Arch]]
+[[- template "arch"]]
+[[- range .Arch]]
+                - [[printf "%q" .]]
+[[- end]]
+[[- end]]
+        podAntiAffinity:
+          preferredDuringSchedulingIgnoredDuringExecution:
+          - weight: 100
+            podAffinityTerm:
+              topologyKey: kubernetes.io/hostname
+              labelSelector:
+                matchLabels:
+                  name: teleproxy-replica
+[[- if .Helm]]
+      {{- with .Values.nodeSelector }}
+      nodeSelector:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+[[- else if .NodeSelector]]
+      nodeSelector:
+[[- range $key, $value := .NodeSelector]]
+        [[$key]]: [[printf "%q" $value]]
+[[- end]]
+[[- end]]
+[[- if .Helm]]
+      {{- with .Values.pullSecrets }}
+      imagePullSecrets:
+      {{- range . }}
+      - name: {{ . | quote }}
+      {{- end }}
+      {{- end }}
+[[- else if .PullSecrets]]
+      imagePullSecrets:
+[[- range .PullSecrets]]
+      - name: [[printf "%q" .]]
+[[- end]]
+[[- end]]
+[[- if eq .Auth "token"]]
+      serviceAccountName: teleproxy
+[[- end]]
+[[- if or (eq .Auth "cert") .TLS]]
+      volumes:
+[[- if eq .Auth "cert"]]
+      - name: auth
+        secret:
+          secretName: [[printf "%q" .CASecret]]
+[[- end]]
+[[- if .TLS]]
+      - name: tls
+        secret:
+          secretName: [[.TLSSecret]]
+[[- end]]
+[[- end]]
+      containers:
+      - name: proxy
+[[- if .Helm]]
+        image: {{ .Values.image | quote }}
+[[- else]]
+        image: [[.Image]]
+[[- end]]
+        ports:
+        - protocol: TCP
+[[- if .TLS]]
+          containerPort: [[.TLSPort]]
+[[- else]]
+          containerPort: 8022
+[[- end]]
+[[- if or .Auth .TLS]]
+        env:
+[[- end]]
+[[- if .Auth]]
+        - name: TELEPROXY_AUTH
+          value: [[.Auth]]
+[[- if and (eq .Auth "token") .Group]]
+        - name: TELEPROXY_GROUP
+          value: [[printf "%q" .Group]]
+[[- end]]
+[[- if .Policy]]
+        - name: TELEPROXY_POLICY
+          value: rbac
+[[- end]]
+[[- end]]
+[[- if .TLS]]
+        - name: TELEPROXY_TLS
+          value: "1"
+[[- end]]
+[[- if or (eq .Auth "cert") .TLS]]
+        volumeMounts:
+[[- end]]
+[[- if eq .Auth "cert"]]
+        - name: auth
+          mountPath: /etc/teleproxy/auth
+          readOnly: true
+[[- end]]
+[[- if .TLS]]
+        - name: tls
+          mountPath: [[.TLSDir]]
+          readOnly: true
+[[- end]]
+[[- if .Helm]]
+        {{- if or .Values.cpu .Values.memory }}
+        resources:
+          {{- range list "requests" "limits" }}
+          {{ . }}:
+            {{- with $.Values.cpu }}
+            cpu: {{ . | quote }}
+            {{- end }}
+            {{- with $.Values.memory }}
+            memory: {{ . | quote }}
+            {{- end }}
+          {{- end }}
+        {{- end }}
+[[- else if or .CPU .Memory]]
+        resources:
+          requests:
+[[- template "limits" .]]
+          limits:
+[[- template "limits" .]]
+[[- end]]
+---
+[[- if .Helm]]
+{{- if .Capabilities.APIVersions.Has "policy/v1/PodDisruptionBudget" }}
+apiVersion: policy/v1
+{{- else }}
+apiVersion: policy/v1beta1
+{{- end }}
+[[- else]]
+apiVersion: [[.BudgetVersion]]
+[[- end]]
+kind: PodDisruptionBudget
+metadata:
+  name: teleproxy
+[[- template "namespace" .]]
+spec:
+  maxUnavailable: 1
+  selector:
+    matchLabels:
+      name: teleproxy-replica
+[[- if .RBAC]]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: teleproxy-connect
+[[- template "namespace" .]]
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["get", "list", "watch"]
+- apiGroups: [""]
+  resources: ["pods/portforward", "pods/exec"]
+  verbs: ["create"]
+[[- if .TLS]]
+- apiGroups: [""]
+  resources: ["secrets"]
+  resourceNames: [[printf "[%q]" .TLSSecret]]
+  verbs: ["get"]
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["create"]
+[[- end]]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: teleproxy-connect
+[[- template "namespace" .]]
+subjects:
+- kind: Group
+  name: [[printf "%q" .Group]]
+  apiGroup: rbac.authorization.k8s.io
+roleRef:
+  kind: Role
+  name: teleproxy-connect
+  apiGroup: rbac.authorization.k8s.io
+[[- end]]
+[[- if eq .RBAC "cluster"]]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: teleproxy-services
+rules:
+- apiGroups: [""]
+  resources: ["services"]
+  verbs: ["get", "list", "watch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: teleproxy-services
+subjects:
+- kind: Group
+  name: [[printf "%q" .Group]]
+  apiGroup: rbac.authorization.k8s.io
+roleRef:
+  kind: ClusterRole
+  name: teleproxy-services
+  apiGroup: rbac.authorization.k8s.io
+[[- end]]
+[[- if eq .Auth "token"]]
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: teleproxy
+[[- template "namespace" .]]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+[[- if .Helm]]
+  name: teleproxy-token-review-{{ .Release.Namespace }}
+[[- else]]
+  name: teleproxy-token-review-[[.Namespace]]
+[[- end]]
+subjects:
+- kind: ServiceAccount
+  name: teleproxy
+[[- if .Helm]]
+  namespace: {{ .Release.Namespace }}
+[[- else]]
+  namespace: [[.Namespace]]
+[[- end]]
+roleRef:
+  kind: ClusterRole
+  name: system:auth-delegator
+  apiGroup: rbac.authorization.k8s.io
+[[- end]]
+[[- if .Policy]]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: teleproxy-directory
+rules:
+- apiGroups: [""]
+  resources: ["services", "pods"]
+  verbs: ["list"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+[[- if .Helm]]
+  name: teleproxy-directory-{{ .Release.Namespace }}
+[[- else]]
+  name: teleproxy-directory-[[.Namespace]]
+[[- end]]
+subjects:
+- kind: ServiceAccount
+  name: teleproxy
+[[- if .Helm]]
+  namespace: {{ .Release.Namespace }}
+[[- else]]
+  namespace: [[.Namespace]]
+[[- end]]
+roleRef:
+  kind: ClusterRole
+  name: teleproxy-directory
+  apiGroup: rbac.authorization.k8s.io
+[[- end]]
+`))
+
+// podTemplate is the lone teleproxy pod that sessions apply for
+// themselves, unless they have replicas.
+var podTemplate = template.Must(template.New("pod").Delims("[[", "]]").Parse(`
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: teleproxy
+  labels:
+    name: teleproxy
+spec:
+[[- if .Arch]]
+  affinity:
+    nodeAffinity:
+      requiredDuringSchedulingIgnoredDuringExecution:
+        nodeSelectorTerms:
+        - matchExpressions:
+          - key: kubernetes.io/arch
+            operator: In
+            values:
+[[- range .Arch]]
+            - [[printf "%q" .]]
+[[- end]]
+[[- end]]
+[[- if .PullSecrets]]
+  imagePullSecrets:
+[[- range .PullSecrets]]
+  - name: [[printf "%q" .]]
+[[- end]]
+[[- end]]
+  containers:
+  - name: proxy
+    image: [[.Image]]
+    ports:
+    - protocol: TCP
+      containerPort: 8022
+`))
+
+// manifestData is what the template is executed with.
+type manifestData struct {
+	Manifest
+	Helm bool
+	// where the pods keep the CA of TLS, and take the tunnel
+	TLSSecret, TLSDir string
+	TLSPort           int
+}
+
+func (m Manifest) render(helm bool) (string, error) {
+	m, err := m.defaults()
+	if err != nil {
+		return "", err
+	}
+	if helm {
+		// helm takes the namespace from the release
+		m.Namespace = ""
+	} else if m.Auth == "token" && m.Namespace == "" {
+		return "", fmt.Errorf("token auth requires a namespace, for the binding that lets the pods review tokens")
+	}
+	var out bytes.Buffer
+	if err := manifestTemplate.Execute(&out, manifestData{m, helm, agenttls.Secret, agenttls.Dir, agenttls.Port}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Render returns the manifest as yaml for kubectl apply.
+func (m Manifest) Render() (string, error) {
+	return m.render(false)
+}
+
+// pod returns the yaml of the lone teleproxy pod, with the image and
+// architectures of m.
+func (m Manifest) pod() (string, error) {
+	m, err := m.defaults()
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := podTemplate.Execute(&out, m); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Chart writes the manifest as a helm chart archive, with m for its
+// default values, to w.
+func (m Manifest) Chart(w io.Writer, version string) error {
+	agent, err := m.render(true)
+	if err != nil {
+		return err
+	}
+	m, _ = m.defaults()
+	files := []struct{ name, content string }{
+		{"Chart.yaml", fmt.Sprintf("apiVersion: v1\nname: teleproxy\nversion: %s\ndescription: The pods teleproxy tunnels into the cluster through\n", version)},
+		{"values.yaml", m.values()},
+		{"templates/agent.yaml", agent},
+	}
+
+	now := time.Now()
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    "teleproxy/" + f.name,
+			Mode:    0644,
+			Size:    int64(len(f.content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// values are the chart's values.yaml.
+func (m Manifest) values() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "image: %q\nreplicas: %d\ncpu: %q\nmemory: %q\n", m.Image, m.Replicas, m.CPU, m.Memory)
+	if len(m.Arch) == 0 {
+		out.WriteString("arch: []\n")
+	} else {
+		out.WriteString("arch:\n")
+		for _, arch := range m.Arch {
+			fmt.Fprintf(&out, "- %q\n", arch)
+		}
+	}
+	if len(m.PullSecrets) == 0 {
+		out.WriteString("pullSecrets: []\n")
+	} else {
+		out.WriteString("pullSecrets:\n")
+		for _, secret := range m.PullSecrets {
+			fmt.Fprintf(&out, "- %q\n", secret)
+		}
+	}
+	if len(m.NodeSelector) == 0 {
+		out.WriteString("nodeSelector: {}\n")
+	} else {
+		out.WriteString("nodeSelector:\n")
+		var keys []string
+		for key := range m.NodeSelector {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&out, "  %s: %q\n", key, m.NodeSelector[key])
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestManifestRender(t *testing.T) {
+	plain, err := Manifest{}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"replicas: 1\n", "image: " + AgentImage + "\n", "apiVersion: policy/v1\nkind: PodDisruptionBudget"} {
+		if !strings.Contains(plain, expected) {
+			t.Errorf("missing %q in\n%s", expected, plain)
+		}
+	}
+	for _, unexpected := range []string{"namespace:", "nodeSelector:", "resources:", "Role", "{{", "[["} {
+		if strings.Contains(plain, unexpected) {
+			t.Errorf("unexpected %q in\n%s", unexpected, plain)
+		}
+	}
+
+	full, err := Manifest{
+		Namespace:    "teleproxy",
+		Replicas:     3,
+		Memory:       "64Mi",
+		NodeSelector: map[string]string{"kubernetes.io/os": "linux"},
+		RBAC:         "cluster",
+		Group:        "developers",
+		// an old cluster
+		BudgetVersion: "policy/v1beta1",
+	}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"  namespace: teleproxy\n",
+		"replicas: 3\n",
+		"      nodeSelector:\n        kubernetes.io/os: \"linux\"\n",
+		"        resources:\n          requests:\n            memory: \"64Mi\"\n          limits:\n            memory: \"64Mi\"\n",
+		"kind: Role\n",
+		"kind: ClusterRole\n",
+		"  name: \"developers\"\n",
+		"apiVersion: policy/v1beta1\nkind: PodDisruptionBudget",
+	} {
+		if !strings.Contains(full, expected) {
+			t.Errorf("missing %q in\n%s", expected, full)
+		}
+	}
+	if strings.Contains(full, "cpu:") {
+		t.Errorf("unexpected cpu in\n%s", full)
+	}
+
+	for _, m := range []Manifest{{RBAC: "namespace"}, {RBAC: "everywhere", Group: "developers"}} {
+		if _, err := m.Render(); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
+
+func TestManifestChart(t *testing.T) {
+	var archive bytes.Buffer
+	if err := (Manifest{Namespace: "teleproxy", Replicas: 2, CPU: "100m"}).Chart(&archive, "1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+
+	if !strings.Contains(files["teleproxy/Chart.yaml"], "version: 1.2.3\n") {
+		t.Errorf("Chart.yaml:\n%s", files["teleproxy/Chart.yaml"])
+	}
+	if values := files["teleproxy/values.yaml"]; !strings.Contains(values, "replicas: 2\n") || !strings.Contains(values, "cpu: \"100m\"\n") {
+		t.Errorf("values.yaml:\n%s", values)
+	}
+	agent := files["teleproxy/templates/agent.yaml"]
+	for _, expected := range []string{"replicas: {{ .Values.replicas }}", "image: {{ .Values.image | quote }}", "{{- with .Values.nodeSelector }}",
+		`{{- if .Capabilities.APIVersions.Has "policy/v1/PodDisruptionBudget" }}`} {
+		if !strings.Contains(agent, expected) {
+			t.Errorf("missing %q in\n%s", expected, agent)
+		}
+	}
+	if strings.Contains(agent, "namespace:") || strings.Contains(agent, "100m") {
+		t.Errorf("parameters left in\n%s", agent)
+	}
+}
+
+func TestManifestArch(t *testing.T) {
+	for _, test := range []struct {
+		m    Manifest
+		arch string
+	}{
+		{Manifest{}, "                - \"amd64\"\n"},
+		{Manifest{Image: "registry.local/agent:1"}, ""},
+		{Manifest{Image: "registry.local/agent:1", Arch: []string{"arm64"}}, "                - \"arm64\"\n"},
+	} {
+		for _, pod := range []bool{false, true} {
+			render, arch := test.m.Render, test.arch
+			if pod {
+				render, arch = test.m.pod, strings.Replace(arch, "    ", "", 1)
+			}
+			yaml, err := render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if arch == "" && strings.Contains(yaml, "nodeAffinity") {
+				t.Errorf("%+v: unexpected affinity in\n%s", test.m, yaml)
+			} else if !strings.Contains(yaml, arch) {
+				t.Errorf("%+v: missing %q in\n%s", test.m, arch, yaml)
+			}
+		}
+	}
+}
+
+func TestManifestPullSecrets(t *testing.T) {
+	m := Manifest{Image: "registry.local/agent:1", PullSecrets: []string{"registry"}}
+	for _, render := range []func() (string, error){m.Render, m.pod} {
+		yaml, err := render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(yaml, "imagePullSecrets:\n") || !strings.Contains(yaml, "- name: \"registry\"\n") {
+			t.Errorf("no pull secret in\n%s", yaml)
+		}
+	}
+}
+
+func TestManifestAuth(t *testing.T) {
+	token, err := Manifest{Namespace: "teleproxy", Image: "registry.local/agent:1", Auth: "token", Group: "developers"}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"      serviceAccountName: teleproxy\n",
+		"        env:\n        - name: TELEPROXY_AUTH\n          value: token\n        - name: TELEPROXY_GROUP\n          value: \"developers\"\n",
+		"kind: ServiceAccount\nmetadata:\n  name: teleproxy\n  namespace: teleproxy\n",
+		"  name: teleproxy-token-review-teleproxy\n",
+		"- kind: ServiceAccount\n  name: teleproxy\n  namespace: teleproxy\n",
+		"  name: system:auth-delegator\n",
+	} {
+		if !strings.Contains(token, expected) {
+			t.Errorf("missing %q in\n%s", expected, token)
+		}
+	}
+
+	if strings.Contains(token, "TELEPROXY_POLICY") || strings.Contains(token, "teleproxy-directory") {
+		t.Errorf("policy without -agent-policy in\n%s", token)
+	}
+	policy, err := Manifest{Namespace: "teleproxy", Image: "registry.local/agent:1", Auth: "token", Policy: true}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"        - name: TELEPROXY_POLICY\n          value: rbac\n",
+		"  resources: [\"services\", \"pods\"]\n  verbs: [\"list\"]\n",
+		"  name: teleproxy-directory-teleproxy\n",
+	} {
+		if !strings.Contains(policy, expected) {
+			t.Errorf("missing %q in\n%s", expected, policy)
+		}
+	}
+
+	cert, err := Manifest{Image: "registry.local/agent:1", Auth: "cert", CASecret: "teleproxy-ca"}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"          secretName: \"teleproxy-ca\"\n",
+		"          value: cert\n",
+		"          mountPath: /etc/teleproxy/auth\n",
+	} {
+		if !strings.Contains(cert, expected) {
+			t.Errorf("missing %q in\n%s", expected, cert)
+		}
+	}
+	if strings.Contains(cert, "ServiceAccount") || strings.Contains(cert, "TELEPROXY_GROUP") {
+		t.Errorf("token auth in\n%s", cert)
+	}
+
+	for _, m := range []Manifest{
+		{Namespace: "teleproxy", Auth: "token"},
+		{Image: "registry.local/agent:1", Auth: "token"},
+		{Image: "registry.local/agent:1", Auth: "cert"},
+		{Image: "registry.local/agent:1", Auth: "oidc"},
+		{Image: "registry.local/agent:1", Auth: "cert", CASecret: "teleproxy-ca", Policy: true},
+	} {
+		if _, err := m.Render(); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
+
+func TestManifestTLS(t *testing.T) {
+	yaml, err := Manifest{Image: "registry.local/agent:1", Auth: "cert", CASecret: "teleproxy-ca", RBAC: "namespace", Group: "developers", TLS: true}.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"      volumes:\n      - name: auth\n        secret:\n          secretName: \"teleproxy-ca\"\n      - name: tls\n        secret:\n          secretName: teleproxy-tls\n",
+		"          containerPort: 8443\n",
+		"        env:\n        - name: TELEPROXY_AUTH\n          value: cert\n        - name: TELEPROXY_TLS\n          value: \"1\"\n",
+		"        volumeMounts:\n        - name: auth\n          mountPath: /etc/teleproxy/auth\n          readOnly: true\n        - name: tls\n          mountPath: /etc/teleproxy/tls\n",
+		"  resources: [\"secrets\"]\n  resourceNames: [\"teleproxy-tls\"]\n  verbs: [\"get\"]\n",
+	} {
+		if !strings.Contains(yaml, expected) {
+			t.Errorf("missing %q in\n%s", expected, yaml)
+		}
+	}
+	if strings.Contains(yaml, "containerPort: 8022") {
+		t.Errorf("sshd exposed without tls in\n%s", yaml)
+	}
+	if _, err := (Manifest{TLS: true}).Render(); err == nil {
+		t.Errorf("expected tls to require an image")
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/coexist"
+	"github.com/datawire/teleproxy/internal/pkg/interceptor"
+	"github.com/datawire/teleproxy/internal/pkg/lsm"
+	"github.com/datawire/teleproxy/internal/pkg/nat"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+)
+
+// observe is intercept for Options.Observe. Everything is discovered
+// and routed as it would be, and the api serves it, but nothing on the
+// host is changed: the firewall is planned rather than programmed, dns
+// is answered at /api/resolve rather than on port 53, nothing is
+// relayed, and no token, lock, or socket is written. It takes no root,
+// and runs alongside a teleproxy that does intercept.
+func (s *Session) observe(natConfig nat.Config) (func(), error) {
+	dnsIP, fallback, corefile, err := s.nameservers()
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing is intercepted to conflict with, but they are worth
+	// knowing about before anything is
+	conflicts := coexist.Detect()
+	for _, conflict := range conflicts {
+		log.Printf("TPY: another interception tool is running: %s", conflict)
+	}
+
+	iceptor := interceptor.NewObserver("teleproxy")
+	s.configure(iceptor, natConfig)
+	iceptor.SetConflicts(conflicts)
+	iceptor.SetSecurity(lsm.Detect())
+
+	s.token = api.NewToken()
+	apis, err := api.NewAPIServer(iceptor, "", s.token, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "API Server")
+	}
+	if s.opts.Debug {
+		apis.EnableDebug()
+	}
+	s.apis = apis
+	apiPort, _ := strconv.Atoi(apis.Port())
+	iceptor.AddPorts(map[string]int{"api": apiPort})
+	s.api.Transport = authTransport{direct(apis.Port()), s.apiToken}
+
+	srv := s.dnsServer(iceptor, fallback, corefile)
+	apis.ServeAnswers(srv.Answer)
+
+	bootstrap := route.Table{Name: "bootstrap"}
+	bootstrap.Add(route.Route{
+		Name:   "teleproxy",
+		Ip:     "127.254.254.254",
+		Target: apis.Port(),
+		Proto:  "tcp",
+	})
+	iceptor.SetDNS(interceptor.DNS{Strategy: "redirect", Nameserver: net.JoinHostPort(dnsIP, "53"), Port: s.dnsPort})
+	bootstrap.Add(route.Route{
+		Ip:     dnsIP,
+		Target: strconv.Itoa(s.dnsPort),
+		Proto:  "udp",
+	})
+
+	apis.Start()
+	if err := iceptor.Start(); err != nil {
+		apis.Stop()
+		return nil, errors.Wrap(err, "Interceptor")
+	}
+	iceptor.Update(bootstrap)
+	log.Printf("TPY: observing only, nothing on this host is changed, see http://127.0.0.1:%s/api/status, /api/nat, and /api/resolve?name=", apis.Port())
+
+	return func() {
+		apis.Stop()
+		iceptor.Stop()
+	}, nil
+}
+
+// direct is a transport that reaches the api at http://teleproxy on
+// port of localhost, since there is no firewall to route it there.
+func direct(port string) *http.Transport {
+	return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		if addr == "teleproxy:80" {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}}
+}
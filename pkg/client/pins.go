@@ -0,0 +1,105 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pins keep the virtual addresses that remapping gives names, by
+// kubernetes context, across sessions. Long running processes resolve
+// a name once and hang on to the address, so it has to mean the same
+// service after teleproxy restarts, until `teleproxy dns reset`.
+type pins struct {
+	filename string
+}
+
+// pinsDir is where the pins of every context are kept, in dir, or the
+// user's cache directory if dir is empty.
+func pinsDir(dir string) (string, error) {
+	dir, err := stateDir(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pins"), nil
+}
+
+// newPins returns the pins of a kubernetes context, kept in dir, or the
+// user's cache directory if dir is empty.
+func newPins(dir, context string) (*pins, error) {
+	dir, err := pinsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &pins{filepath.Join(dir, unsafe.ReplaceAllString(context, "_")+".json")}, nil
+}
+
+// load returns the virtual addresses pinned, by name, if any.
+func (p *pins) load() (map[string]string, error) {
+	data, err := ioutil.ReadFile(p.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pinned map[string]string
+	if err := json.Unmarshal(data, &pinned); err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+func (p *pins) save(pinned map[string]string) error {
+	data, err := json.MarshalIndent(pinned, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.filename), 0700); err != nil {
+		return err
+	}
+	// as in cache.save
+	tmp := p.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.filename)
+}
+
+// ResetPins forgets the virtual addresses pinned for a kubernetes
+// context, or for every context if context is empty, kept in dir, or
+// the user's cache directory if dir is empty. The next session gives
+// names addresses afresh. It returns the contexts forgotten.
+func ResetPins(dir, context string) ([]string, error) {
+	if context != "" {
+		p, err := newPins(dir, context)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Remove(p.filename); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []string{context}, nil
+	}
+	dir, err := pinsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var forgotten []string
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return forgotten, err
+		}
+		forgotten = append(forgotten, strings.TrimSuffix(filepath.Base(file), ".json"))
+	}
+	return forgotten, nil
+}
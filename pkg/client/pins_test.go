@@ -0,0 +1,67 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+func TestPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := k8s.Network{Domain: "cluster.local", ServiceCIDR: "10.96.0.0/12"}
+	session := func() *kubernetesBridge {
+		s := &Session{api: &http.Client{Transport: &recorder{}}, proxyPort: 1234}
+		b := newKubernetesBridge(s, network, nil)
+		b.remap, _ = newRemapper(DefaultVirtualCIDR)
+		b.pins, _ = newPins(dir, "kind-kind")
+		pinned, err := b.pins.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.remap.restore(pinned)
+		return b
+	}
+
+	first := session()
+	first.update([]k8s.Resource{service("web", "10.96.0.10"), service("db", "10.96.0.11")})
+	expected := map[string]string{
+		"web.default.svc.cluster.local": "198.18.0.1",
+		"db.default.svc.cluster.local":  "198.18.0.2",
+	}
+	if !reflect.DeepEqual(first.remap.assigned, expected) {
+		t.Fatalf("expected %v, got %v", expected, first.remap.assigned)
+	}
+
+	// the next session lists them the other way round, web with a
+	// new cluster ip, and another service besides
+	next := session()
+	next.update([]k8s.Resource{service("api", "10.96.0.12"), service("db", "10.96.0.11"), service("web", "10.96.0.20")})
+	expected["api.default.svc.cluster.local"] = "198.18.0.3"
+	if !reflect.DeepEqual(next.remap.assigned, expected) {
+		t.Errorf("expected the pinned addresses, got %v", next.remap.assigned)
+	}
+
+	other, _ := newPins(dir, "minikube")
+	other.save(map[string]string{"web.default.svc.cluster.local": "198.18.0.9"})
+	if forgotten, err := ResetPins(dir, "kind-kind"); err != nil || !reflect.DeepEqual(forgotten, []string{"kind-kind"}) {
+		t.Errorf("expected kind-kind to be forgotten, got %v, %v", forgotten, err)
+	}
+	if pinned, _ := next.pins.load(); pinned != nil {
+		t.Errorf("expected nothing pinned, got %v", pinned)
+	}
+	if pinned, _ := other.load(); len(pinned) != 1 {
+		t.Errorf("expected the pins of other contexts to stay, got %v", pinned)
+	}
+	if forgotten, err := ResetPins(dir, ""); err != nil || !reflect.DeepEqual(forgotten, []string{"minikube"}) {
+		t.Errorf("expected minikube to be forgotten, got %v, %v", forgotten, err)
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// InterceptResource is what platform teams grant the "create" verb
+// on, per namespace, to permit intercepting the services in it. It
+// only exists for use in RBAC rules.
+const InterceptResource = "intercepts.teleproxy.datawire.io"
+
+// policyTTL is how long an access review is trusted for, and
+// policyRetry how long one that failed is before it is retried.
+const (
+	policyTTL   = time.Minute
+	policyRetry = 10 * time.Second
+)
+
+// how many access reviews run at once
+const reviewers = 8
+
+type decision struct {
+	allowed bool
+	failed  bool
+	reason  string
+	at      time.Time
+}
+
+// A policy decides which namespaces may be intercepted by asking the
+// cluster whether the current user may create InterceptResource there.
+// The client enforces it with -rbac, which keeps developers from
+// intercepting namespaces by mistake. The teleproxy pods enforce the
+// same rule, installed with Manifest.Policy, for anyone who logs in.
+type policy struct {
+	canI func(namespace string) (bool, error)
+
+	mutex     sync.Mutex
+	decisions map[string]decision
+	reviewing bool
+}
+
+func newPolicy(kubeinfo *k8s.KubeInfo) *policy {
+	return &policy{
+		canI: func(namespace string) (bool, error) {
+			return kubeinfo.CanI("create", InterceptResource, namespace)
+		},
+		decisions: make(map[string]decision),
+	}
+}
+
+// stale returns the namespaces that need reviewing. The caller holds
+// the mutex.
+func (p *policy) stale(namespaces []string) (pending []string) {
+	seen := make(map[string]bool)
+	for _, namespace := range namespaces {
+		d, ok := p.decisions[namespace]
+		ttl := policyTTL
+		if d.failed {
+			ttl = policyRetry
+		}
+		if !seen[namespace] && (!ok || time.Since(d.at) >= ttl) {
+			pending = append(pending, namespace)
+		}
+		seen[namespace] = true
+	}
+	return
+}
+
+// decided reports whether services in the namespace may be
+// intercepted, as of the last review. Namespaces not reviewed yet and
+// failed reviews deny.
+func (p *policy) decided(namespace string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.decisions[namespace].allowed
+}
+
+// refresh reviews the namespaces that need it in the background, so
+// that kubectl doesn't hold up the watch, and calls reviewed once they
+// have been.
+func (p *policy) refresh(namespaces []string, reviewed func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.reviewing || len(p.stale(namespaces)) == 0 {
+		return
+	}
+	p.reviewing = true
+	go func() {
+		p.prefetch(namespaces)
+		p.mutex.Lock()
+		p.reviewing = false
+		p.mutex.Unlock()
+		reviewed()
+	}()
+}
+
+// prefetch reviews the namespaces that need it, several at a time, so
+// that a cluster with many namespaces doesn't hold up publishing its
+// services for one review after another.
+func (p *policy) prefetch(namespaces []string) {
+	p.mutex.Lock()
+	pending := p.stale(namespaces)
+	p.mutex.Unlock()
+	results := make([]decision, len(pending))
+	tasks := make([]func(), len(pending))
+	for i, namespace := range pending {
+		i, namespace := i, namespace
+		tasks[i] = func() { results[i] = p.review(namespace) }
+	}
+	tpu.Parallel(reviewers, tasks...)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, namespace := range pending {
+		p.record(namespace, results[i])
+	}
+}
+
+func (p *policy) review(namespace string) (d decision) {
+	allowed, err := p.canI(namespace)
+	switch {
+	case err != nil:
+		log.Printf("BRG: access review for namespace %s failed: %v", namespace, err)
+		d = decision{failed: true, reason: fmt.Sprintf("namespace %s: access review failed: %v", namespace, err), at: time.Now()}
+	case !allowed:
+		d = decision{reason: fmt.Sprintf("namespace %s: not permitted to create %s", namespace, InterceptResource), at: time.Now()}
+	default:
+		d = decision{allowed: true, at: time.Now()}
+	}
+	return
+}
+
+// record keeps the decision for the namespace. The caller holds the
+// mutex.
+func (p *policy) record(namespace string, d decision) {
+	if previous, ok := p.decisions[namespace]; d.allowed != previous.allowed || !ok {
+		log.Printf("BRG: intercepting namespace %s allowed=%v", namespace, d.allowed)
+	}
+	p.decisions[namespace] = d
+}
+
+// denied returns the reasons for every namespace that was denied.
+func (p *policy) denied() (result []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, d := range p.decisions {
+		if !d.allowed {
+			result = append(result, d.reason)
+		}
+	}
+	sort.Strings(result)
+	return
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicyPrefetch(t *testing.T) {
+	var mutex sync.Mutex
+	reviews := make(map[string]int)
+	running, most := 0, 0
+	p := &policy{
+		canI: func(namespace string) (bool, error) {
+			mutex.Lock()
+			reviews[namespace]++
+			running++
+			if running > most {
+				most = running
+			}
+			// each review waits, for a while, until as many as
+			// may have run at once
+			for wait := time.Now(); most < reviewers && time.Since(wait) < time.Second; {
+				mutex.Unlock()
+				time.Sleep(time.Millisecond)
+				mutex.Lock()
+			}
+			running--
+			mutex.Unlock()
+			switch namespace {
+			case "kube-system":
+				return false, nil
+			case "broken":
+				return false, errors.New("timed out")
+			}
+			return true, nil
+		},
+		decisions: make(map[string]decision),
+	}
+
+	namespaces := []string{"kube-system", "broken", "default", "default"}
+	for i := 0; i < 20; i++ {
+		namespaces = append(namespaces, string(rune('a'+i)))
+	}
+	p.prefetch(namespaces)
+	if most != reviewers {
+		t.Errorf("expected %d reviews at once, got %d", reviewers, most)
+	}
+	if reviews["default"] != 1 {
+		t.Errorf("expected each namespace to be reviewed once, default was %d times", reviews["default"])
+	}
+	if !p.decided("default") || p.decided("kube-system") || p.decided("broken") {
+		t.Errorf("unexpected decisions %+v", p.decisions)
+	}
+
+	// the failed review is only retried once it is due
+	p.prefetch(namespaces)
+	if reviews["broken"] != 1 {
+		t.Errorf("expected the failed review to be kept, got %v", reviews)
+	}
+	d := p.decisions["broken"]
+	d.at = d.at.Add(-policyRetry)
+	p.decisions["broken"] = d
+	p.prefetch(namespaces)
+	if reviews["default"] != 1 || reviews["kube-system"] != 1 || reviews["broken"] != 2 {
+		t.Errorf("unexpected reviews %v", reviews)
+	}
+}
+
+func TestPolicyRefresh(t *testing.T) {
+	release := make(chan struct{})
+	p := &policy{
+		canI: func(namespace string) (bool, error) {
+			<-release
+			return true, nil
+		},
+		decisions: make(map[string]decision),
+	}
+	reviewed := make(chan struct{}, 2)
+	done := func() { reviewed <- struct{}{} }
+
+	// doesn't wait for the review, and doesn't start another while
+	// one is under way
+	p.refresh([]string{"default"}, done)
+	p.refresh([]string{"default"}, done)
+	if p.decided("default") {
+		t.Error("expected default to be denied until reviewed")
+	}
+	close(release)
+	select {
+	case <-reviewed:
+	case <-time.After(time.Second):
+		t.Fatal("not reviewed")
+	}
+	if !p.decided("default") {
+		t.Error("expected default to be allowed once reviewed")
+	}
+	p.refresh([]string{"default"}, done)
+	select {
+	case <-reviewed:
+		t.Error("expected no review of a fresh namespace")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
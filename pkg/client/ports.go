@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/activation"
+)
+
+// The ports teleproxy has traditionally used, which are still
+// preferred when they are free.
+const (
+	dnsPort     = 1233
+	proxyPort   = 1234
+	socksPort   = 1080
+	bastionPort = 1081
+	forwardPort = 8022
+)
+
+// interceptPorts allocates the ports the interceptor listens on, and
+// (unless one was configured) the port it expects the bridge to serve
+// the tunnel into the cluster on.
+func (s *Session) interceptPorts() (err error) {
+	// under socket activation, the firewall redirects queries to
+	// the loopback socket systemd listens on, if there is one
+	if s.dnsConns, err = activation.PacketConns("dns"); err != nil {
+		return err
+	}
+	for _, conn := range s.dnsConns {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.IsLoopback() {
+			s.dnsPort = addr.Port
+		}
+	}
+	// port 53 is never listened on, whatever owns it keeps it, and
+	// the firewall redirects queries to this port instead
+	if s.dnsPort == 0 {
+		if s.dnsPort, err = s.ports.Allocate("dns", dnsPort, "udp"); err != nil {
+			return err
+		}
+		if s.dnsPort != dnsPort {
+			log.Printf("TPY: port %d is busy, serving dns on port %d instead", dnsPort, s.dnsPort)
+		}
+	}
+	if s.proxyPort, err = s.ports.Allocate("proxy", proxyPort, "tcp"); err != nil {
+		return err
+	}
+	if s.opts.Socks == DefaultSocks {
+		port, err := s.ports.Allocate("socks", socksPort, "tcp")
+		if err != nil {
+			return err
+		}
+		s.opts.Socks = net.JoinHostPort("localhost", strconv.Itoa(port))
+	}
+	return nil
+}
+
+// bridgePorts allocates the ports the bridge listens on. Without an
+// interceptor of our own, the tunnel and proxy ports are whatever the
+// running interceptor chose.
+func (s *Session) bridgePorts() error {
+	if !s.opts.Intercept {
+		s.proxyPort = proxyPort
+		body, err := s.get("http://teleproxy/api/status")
+		if err != nil {
+			log.Printf("BRG: can't ask teleproxy for its ports, assuming the defaults: %v", err)
+		} else {
+			var status struct {
+				Ports map[string]int `json:"ports"`
+			}
+			if err := json.Unmarshal(body, &status); err != nil {
+				return errors.Wrap(err, "teleproxy status")
+			}
+			if port, ok := status.Ports["proxy"]; ok {
+				s.proxyPort = port
+			}
+			if port, ok := status.Ports["socks"]; ok && s.opts.Socks == DefaultSocks {
+				s.opts.Socks = net.JoinHostPort("localhost", strconv.Itoa(port))
+			}
+		}
+	}
+
+	if _, ok := s.ports.Ports()["socks"]; !ok {
+		_, port, err := net.SplitHostPort(s.opts.Socks)
+		if err != nil {
+			return errors.Wrap(err, "socks")
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return errors.Wrap(err, "socks")
+		}
+		if _, err := s.ports.Require("socks", n, "tcp"); err != nil {
+			return PortBusy(err)
+		}
+	}
+
+	var err error
+	if s.forwardPort, err = s.ports.Allocate("port-forward", forwardPort, "tcp"); err != nil {
+		return err
+	}
+	if err := s.allocateReplicas(); err != nil {
+		return err
+	}
+	if len(s.opts.Bastion) > 0 {
+		if s.bastionPort, err = s.ports.Allocate("bastion", bastionPort, "tcp"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tunnelPorts allocates the ports of a tunnel of our own, when there
+// is neither an interceptor nor a bridge.
+func (s *Session) tunnelPorts() (err error) {
+	if s.opts.Socks == DefaultSocks {
+		port, err := s.ports.Allocate("socks", socksPort, "tcp")
+		if err != nil {
+			return err
+		}
+		s.opts.Socks = net.JoinHostPort("localhost", strconv.Itoa(port))
+	}
+	if s.forwardPort, err = s.ports.Allocate("port-forward", forwardPort, "tcp"); err != nil {
+		return err
+	}
+	return s.allocateReplicas()
+}
+
+// postPorts adds our allocations to the teleproxy status.
+func (s *Session) postPorts() {
+	body, err := json.Marshal(s.ports.Ports())
+	if err != nil {
+		panic(err)
+	}
+	resp, err := s.api.Post("http://teleproxy/api/ports", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("BRG: error posting ports: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,101 @@
+// +build linux
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// the capabilities that intercepting takes, instead of root
+var capabilities = []struct {
+	name string
+	bit  uint
+}{
+	{"cap_net_admin", 12},
+	{"cap_net_bind_service", 10},
+}
+
+// MissingCapabilities lists the capabilities, e.g. "cap_net_admin",
+// that this process lacks to intercept without root.
+func MissingCapabilities() []string {
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		return names()
+	}
+	return missing(effective)
+}
+
+// missing lists the capabilities that effective, a set as in
+// /proc/self/status, lacks.
+func missing(effective uint64) (result []string) {
+	for _, c := range capabilities {
+		if effective&(1<<c.bit) == 0 {
+			result = append(result, c.name)
+		}
+	}
+	return
+}
+
+func names() (result []string) {
+	for _, c := range capabilities {
+		result = append(result, c.name)
+	}
+	return
+}
+
+// effectiveCapabilities reads the effective set of this process.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "CapEff:" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no CapEff in /proc/self/status")
+}
+
+// privileged checks that this process may intercept: that it is root,
+// or has the capabilities it takes. In the latter case they are passed
+// on to iptables and the like, which it runs.
+func privileged() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if missing := MissingCapabilities(); len(missing) > 0 {
+		return fmt.Errorf("intercepting takes root, or %s, run teleproxy with sudo, or grant it them with sudo teleproxy grant-caps", strings.Join(missing, " and "))
+	}
+	var bits []uint
+	for _, c := range capabilities {
+		bits = append(bits, c.bit)
+	}
+	tpu.PassCapabilities(bits)
+	return nil
+}
+
+// GrantCapabilities gives binary, with setcap, the file capabilities
+// to intercept without sudo. It takes root.
+func GrantCapabilities(binary string) error {
+	grant := strings.Join(names(), ",") + "+ep"
+	out, err := exec.Command("setcap", grant, binary).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("setcap %s %s: %v: %s", grant, binary, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingCapabilities(t *testing.T) {
+	for effective, expected := range map[uint64][]string{
+		// what root has
+		0x3fffffffff:  nil,
+		1<<12 | 1<<10: nil,
+		1 << 12:       {"cap_net_bind_service"},
+		0:             {"cap_net_admin", "cap_net_bind_service"},
+	} {
+		if got := missing(effective); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %x to miss %v, got %v", effective, expected, got)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// +build !linux
+
+package client
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// MissingCapabilities is nothing but on linux, where intercepting may
+// take capabilities rather than root.
+func MissingCapabilities() []string {
+	return nil
+}
+
+// privileged checks that this process may intercept, which takes root.
+func privileged() error {
+	if os.Geteuid() != 0 {
+		return errors.New("intercepting takes root, run teleproxy with sudo")
+	}
+	return nil
+}
+
+// GrantCapabilities is only supported on linux.
+func GrantCapabilities(binary string) error {
+	return errors.New("capabilities are only supported on linux, run teleproxy with sudo")
+}
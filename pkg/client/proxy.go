@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// useProxy configures everything that talks to the cluster to go via
+// the given proxy. Both kubectl and client-go honor HTTPS_PROXY and
+// NO_PROXY (including https:// proxies and credentials in the url), so
+// we just need to set it before anything reads it.
+func useProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return errors.Wrap(err, "upstream proxy")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("upstream proxy: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("upstream proxy: missing host in %q", proxy)
+	}
+	os.Setenv("HTTPS_PROXY", proxy)
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	log.Printf("TPY: using upstream proxy %s", u)
+	return nil
+}
+
+// validHop matches [user@]host[:port], which mustn't start with a dash
+// either, lest ssh take it for an option.
+var validHop = regexp.MustCompile(`^[A-Za-z0-9@._:\[\]][A-Za-z0-9@._:\[\]-]*$`)
+
+// bastion keeps an ssh connection open through the given chain of
+// hops and points our cluster traffic at the SOCKS proxy it provides,
+// so that every kubectl and api connection is multiplexed over the one
+// chain. The ssh connection is restarted whenever it dies, and keep
+// alives make sure that happens promptly when the network goes away.
+// The SOCKS proxy listens on bastionSocks, which must not collide with
+// the tunnel into the cluster. The health of the ssh connection is
+// reported to health.
+func bastion(hops []string, bastionSocks string, health func(tpu.Health, error)) (func(), error) {
+	var chain []string
+	for _, hop := range hops {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+		// the keeper runs this via the shell
+		if !validHop.MatchString(hop) {
+			return nil, fmt.Errorf("bastion: invalid hop %q", hop)
+		}
+		chain = append(chain, hop)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("bastion: no hops")
+	}
+
+	command := "ssh -D " + bastionSocks + " -N -C -oConnectTimeout=5 -oExitOnForwardFailure=yes " +
+		"-oServerAliveInterval=5 -oServerAliveCountMax=3 -oBatchMode=yes"
+	if len(chain) > 1 {
+		command += " -J " + strings.Join(chain[:len(chain)-1], ",")
+	}
+	last := chain[len(chain)-1]
+	if host, port, err := net.SplitHostPort(last); err == nil {
+		command += " -p " + port + " " + host
+	} else {
+		command += " " + last
+	}
+
+	keeper := tpu.NewKeeper("BST", command)
+	keeper.OnHealth = health
+	keeper.Start()
+
+	// everything after this talks to the cluster, so wait for the
+	// tunnel to come up
+	for start := time.Now(); ; time.Sleep(250 * time.Millisecond) {
+		conn, err := net.Dial("tcp", bastionSocks)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 30*time.Second {
+			keeper.Stop()
+			return nil, fmt.Errorf("bastion: timed out waiting for ssh via %s", strings.Join(chain, ","))
+		}
+	}
+
+	if err := useProxy("socks5://" + bastionSocks); err != nil {
+		keeper.Stop()
+		return nil, err
+	}
+	return keeper.Stop, nil
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// how long the teleproxy pods get to pull their image before they are
+// given up on as not pulling it
+const pullTimeout = 90 * time.Second
+
+// the reasons a container waits for an image it won't get
+var pullFailures = map[string]bool{
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// AgentPullError returns what keeps the teleproxy pods of the
+// namespace of kubeinfo from pulling their image, if anything, e.g.
+// a registry that isn't reachable from the cluster, or a missing pull
+// secret.
+func AgentPullError(kubeinfo *k8s.KubeInfo) error {
+	output, err := agentImages(kubeinfo)
+	if err != nil {
+		return err
+	}
+	_, err = parsePulled(output)
+	return err
+}
+
+// agentImages lists the teleproxy pods with their image, and why their
+// container waits, if it does.
+func agentImages(kubeinfo *k8s.KubeInfo) (string, error) {
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+kubeinfo.GetKubectl(
+		`get pods -l 'name in (teleproxy,teleproxy-replica)' `+
+			`-o jsonpath='{range .items[*]}{.metadata.name}{"\t"}{.status.containerStatuses[0].image}{"\t"}`+
+			`{.status.containerStatuses[0].state.waiting.reason}{"\t"}{.status.containerStatuses[0].state.waiting.message}{"\n"}{end}'`))
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// parsePulled returns whether all the pods of agentImages got their
+// image, and why one can't if so.
+func parsePulled(output string) (bool, error) {
+	pulled, waiting := false, false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		if pullFailures[fields[2]] {
+			return false, fmt.Errorf("pod/%s can't pull %s: %s: %s", fields[0], fields[1], fields[2], fields[3])
+		}
+		if fields[2] != "" || fields[1] == "" {
+			// e.g. still pulling, or not scheduled yet
+			waiting = true
+		} else {
+			pulled = true
+		}
+	}
+	return pulled && !waiting, nil
+}
+
+// checkPull tells why, once the teleproxy pods fail to pull their
+// image, rather than leaving the tunnel to just never come up. It
+// gives up after pullTimeout, or as soon as they have their image.
+func checkPull(kubeinfo *k8s.KubeInfo) {
+	deadline := time.After(pullTimeout)
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-time.After(replicaRetry):
+		}
+		output, err := agentImages(kubeinfo)
+		if err != nil {
+			// e.g. not allowed to list pods, which is fine
+			continue
+		}
+		pulled, err := parsePulled(output)
+		if pulled {
+			return
+		}
+		if err != nil {
+			log.Printf("SSH: %v; if the cluster can't reach the registry, mirror the image and use -agent-image, with -agent-pull-secret if it takes credentials", err)
+			return
+		}
+	}
+}
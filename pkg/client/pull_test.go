@@ -0,0 +1,23 @@
+package client
+
+import "testing"
+
+func TestParsePulled(t *testing.T) {
+	for _, test := range []struct {
+		output string
+		pulled bool
+		failed bool
+	}{
+		{"", false, false},
+		{"teleproxy\tregistry.local/agent:1\t\t\n", true, false},
+		{"teleproxy\t\t\t\n", false, false},
+		{"teleproxy\tregistry.local/agent:1\tContainerCreating\t\n", false, false},
+		{"teleproxy-a\tregistry.local/agent:1\t\t\nteleproxy-b\tregistry.local/agent:1\tContainerCreating\t\n", false, false},
+		{"teleproxy-a\tregistry.local/agent:1\tContainerCreating\t\nteleproxy-b\tregistry.local/agent:1\tImagePullBackOff\tBack-off pulling image\n", false, true},
+	} {
+		pulled, err := parsePulled(test.output)
+		if pulled != test.pulled || (err != nil) != test.failed {
+			t.Errorf("%q: pulled %v, error %v", test.output, pulled, err)
+		}
+	}
+}
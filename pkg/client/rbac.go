@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A permission is what a session does with a resource, and why.
+type permission struct {
+	// namespace is "" for that of the session, and cluster is for
+	// resources outside of any namespace, or in all of them.
+	namespace string
+	cluster   bool
+	group     string
+	resource  string
+	verbs     []string
+	// optional permissions are tried, and done without if denied.
+	optional bool
+	reason   string
+}
+
+// permissions lists what a session with opts asks of the cluster.
+func permissions(opts Options) []permission {
+	if !opts.Bridge {
+		// intercepting is all on this host
+		return nil
+	}
+	var perms []permission
+	need := func(p permission) { perms = append(perms, p) }
+
+	switch {
+	case opts.ExecPod != "":
+		need(permission{resource: "pods", verbs: []string{"get"}, reason: "find the exec pod"})
+		need(permission{resource: "pods/exec", verbs: []string{"create"}, reason: "tunnel through the exec pod"})
+	default:
+		need(permission{resource: "pods", verbs: []string{"get", "watch"}, reason: "wait for the teleproxy pods"})
+		need(permission{resource: "pods/portforward", verbs: []string{"create"}, reason: "tunnel to the teleproxy pods"})
+		need(permission{resource: "pods/exec", verbs: []string{"create"}, reason: "fetch the host keys of the teleproxy pods"})
+		switch {
+		case opts.AgentInstalled:
+			need(permission{resource: "pods", verbs: []string{"list"}, reason: "find the installed teleproxy pods"})
+			if opts.AgentTLS {
+				need(permission{resource: "secrets", verbs: []string{"get", "create"}, reason: "issue the certificate of the tunnel, from a CA created on first use"})
+			}
+		case opts.Replicas > 1:
+			need(permission{group: "apps", resource: "deployments", verbs: []string{"get", "create", "patch"}, reason: "apply the teleproxy deployment"})
+			need(permission{group: "policy", resource: "poddisruptionbudgets", verbs: []string{"get", "create", "patch"}, reason: "apply the teleproxy deployment"})
+			need(permission{resource: "pods", verbs: []string{"list"}, reason: "find the teleproxy pods"})
+		default:
+			need(permission{resource: "pods", verbs: []string{"create", "patch"}, reason: "apply the teleproxy pod"})
+			need(permission{resource: "pods", verbs: []string{"list"}, optional: true, reason: "report pods that can't pull their image"})
+			need(permission{resource: "services", verbs: []string{"get", "create", "patch", "delete"}, optional: true, reason: "expose local ports"})
+		}
+		if !opts.AgentInstalled {
+			need(permission{cluster: true, resource: "nodes", verbs: []string{"list"}, optional: true, reason: "warn if no node can run the teleproxy image"})
+		}
+	}
+
+	need(permission{cluster: true, resource: "services", verbs: []string{"list", "watch"}, reason: "bridge the services of all namespaces"})
+	if opts.ClusterDomain == "" || opts.ServiceCIDR == "" {
+		reason := "detect the cluster domain and service range"
+		need(permission{namespace: "kube-system", resource: "configmaps", verbs: []string{"list"}, optional: true, reason: reason})
+		need(permission{namespace: "kube-system", resource: "pods", verbs: []string{"list"}, optional: true, reason: reason})
+	}
+	if opts.ServiceCIDR == "" {
+		need(permission{resource: "services", verbs: []string{"create"}, optional: true, reason: "detect the service range, with a dry run"})
+	}
+	if opts.EnforceRBAC {
+		need(permission{cluster: true, group: "authorization.k8s.io", resource: "selfsubjectaccessreviews", verbs: []string{"create"},
+			reason: "check which namespaces may be intercepted"})
+	}
+	return perms
+}
+
+// RequiredRBAC returns the Role and ClusterRole, as yaml, that grant a
+// session with opts what it needs of the cluster and nothing else. The
+// permissions it does without, if denied, are only listed, as
+// comments.
+func RequiredRBAC(opts Options) string {
+	var out strings.Builder
+	var optional []string
+	roles := make(map[string][]permission)
+	var scopes []string
+	for _, p := range permissions(opts) {
+		if p.optional {
+			where := "namespace " + p.namespace
+			switch {
+			case p.cluster:
+				where = "the cluster"
+			case p.namespace == "":
+				where = "the namespace"
+			}
+			optional = append(optional, fmt.Sprintf("#   %s %s in %s, to %s", strings.Join(p.verbs, ", "), qualified(p), where, p.reason))
+			continue
+		}
+		scope := p.namespace
+		if p.cluster {
+			scope = "*"
+		}
+		if _, ok := roles[scope]; !ok {
+			scopes = append(scopes, scope)
+		}
+		roles[scope] = append(roles[scope], p)
+	}
+
+	if len(scopes) == 0 {
+		out.WriteString("# this session needs no permissions of the cluster\n")
+	}
+	if len(optional) > 0 {
+		out.WriteString("# optional, and done without if denied:\n")
+		out.WriteString(strings.Join(optional, "\n") + "\n")
+	}
+	sort.Strings(scopes)
+	for _, scope := range scopes {
+		out.WriteString("---\napiVersion: rbac.authorization.k8s.io/v1\n")
+		switch {
+		case scope == "*":
+			out.WriteString("kind: ClusterRole\nmetadata:\n  name: teleproxy-session\n")
+		case scope != "":
+			fmt.Fprintf(&out, "kind: Role\nmetadata:\n  name: teleproxy-session\n  namespace: %s\n", scope)
+		case opts.Namespace != "":
+			fmt.Fprintf(&out, "kind: Role\nmetadata:\n  name: teleproxy-session\n  namespace: %s\n", opts.Namespace)
+		default:
+			out.WriteString("kind: Role\nmetadata:\n  name: teleproxy-session\n")
+		}
+		out.WriteString("rules:\n")
+		for _, p := range mergePermissions(roles[scope]) {
+			fmt.Fprintf(&out, "# to %s\n- apiGroups: [%q]\n  resources: [%q]\n  verbs: [%s]\n", p.reason, p.group, p.resource, quoteAll(p.verbs))
+		}
+	}
+	return out.String()
+}
+
+// mergePermissions combines the permissions on the same resource, in
+// the order they first appear.
+func mergePermissions(perms []permission) (merged []permission) {
+	index := make(map[string]int)
+	for _, p := range perms {
+		key := qualified(p)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			p.verbs = append([]string(nil), p.verbs...)
+			merged = append(merged, p)
+			continue
+		}
+		m := &merged[i]
+		for _, verb := range p.verbs {
+			if !contains(m.verbs, verb) {
+				m.verbs = append(m.verbs, verb)
+			}
+		}
+		if !strings.Contains(m.reason, p.reason) {
+			m.reason += " and " + p.reason
+		}
+	}
+	return
+}
+
+func qualified(p permission) string {
+	if p.group == "" {
+		return p.resource
+	}
+	return p.resource + "." + p.group
+}
+
+func quoteAll(values []string) string {
+	var quoted []string
+	for _, v := range values {
+		quoted = append(quoted, fmt.Sprintf("%q", v))
+	}
+	return strings.Join(quoted, ", ")
+}
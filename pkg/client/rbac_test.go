@@ -0,0 +1,63 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequiredRBAC(t *testing.T) {
+	for _, test := range []struct {
+		opts                 Options
+		expected, unexpected []string
+	}{
+		{
+			Options{},
+			[]string{"needs no permissions"},
+			[]string{"kind:"},
+		},
+		{
+			Options{Bridge: true, Namespace: "dev"},
+			[]string{
+				"kind: Role\nmetadata:\n  name: teleproxy-session\n  namespace: dev\n",
+				"  resources: [\"pods\"]\n  verbs: [\"get\", \"watch\", \"create\", \"patch\"]\n",
+				"  resources: [\"pods/portforward\"]\n",
+				"kind: ClusterRole\n",
+				"  resources: [\"services\"]\n  verbs: [\"list\", \"watch\"]\n",
+				"#   list configmaps in namespace kube-system, to detect",
+				"#   create services in the namespace, to detect the service range",
+			},
+			[]string{"deployments", "selfsubjectaccessreviews", "verbs: [\"create\"]\n# to bridge"},
+		},
+		{
+			Options{Bridge: true, Replicas: 3, ClusterDomain: "cluster.local", ServiceCIDR: "10.96.0.0/12", EnforceRBAC: true},
+			[]string{
+				"- apiGroups: [\"apps\"]\n  resources: [\"deployments\"]\n",
+				"  resources: [\"pods\"]\n  verbs: [\"get\", \"watch\", \"list\"]\n",
+				"  resources: [\"selfsubjectaccessreviews\"]\n",
+			},
+			[]string{"namespace:", "configmaps", "create services"},
+		},
+		{
+			Options{Bridge: true, ExecPod: "tools"},
+			[]string{"  resources: [\"pods\"]\n  verbs: [\"get\"]\n", "  resources: [\"pods/exec\"]\n"},
+			[]string{"portforward", "nodes"},
+		},
+		{
+			Options{Bridge: true, AgentInstalled: true, AgentTLS: true},
+			[]string{"  resources: [\"secrets\"]\n  verbs: [\"get\", \"create\"]\n"},
+			[]string{"nodes", "deployments"},
+		},
+	} {
+		yaml := RequiredRBAC(test.opts)
+		for _, expected := range test.expected {
+			if !strings.Contains(yaml, expected) {
+				t.Errorf("%+v: missing %q in\n%s", test.opts, expected, yaml)
+			}
+		}
+		for _, unexpected := range test.unexpected {
+			if strings.Contains(yaml, unexpected) {
+				t.Errorf("%+v: unexpected %q in\n%s", test.opts, unexpected, yaml)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"sort"
+	"sync"
+)
+
+// readiness tracks what a session waits on before it is fully up. A
+// nil readiness waits on nothing.
+type readiness struct {
+	mutex   sync.Mutex
+	waiting map[string]bool
+	done    chan struct{}
+}
+
+func newReadiness(what ...string) *readiness {
+	r := &readiness{waiting: make(map[string]bool), done: make(chan struct{})}
+	for _, w := range what {
+		r.waiting[w] = true
+	}
+	return r
+}
+
+// mark notes that what is up, which may be what everything else was
+// waiting on.
+func (r *readiness) mark(what string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.waiting) == 0 {
+		return
+	}
+	delete(r.waiting, what)
+	if len(r.waiting) == 0 {
+		close(r.done)
+	}
+}
+
+// pending returns what the session still waits on.
+func (r *readiness) pending() []string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []string
+	for what := range r.waiting {
+		result = append(result, what)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Ready is closed once the session is fully up: intercepting, and if it
+// bridges, with the tunnel connected and the services of the cluster
+// listed and routed. It stays open for a session that failed to start.
+func (s *Session) Ready() <-chan struct{} {
+	return s.ready.done
+}
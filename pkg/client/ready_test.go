@@ -0,0 +1,26 @@
+package client
+
+import "testing"
+
+func TestReadiness(t *testing.T) {
+	r := newReadiness("started", "tunnel", "services")
+	for _, what := range []string{"tunnel", "tunnel", "started"} {
+		r.mark(what)
+		select {
+		case <-r.done:
+			t.Fatalf("ready after %s", what)
+		default:
+		}
+	}
+	r.mark("services")
+	select {
+	case <-r.done:
+	default:
+		t.Fatal("not ready")
+	}
+	// again, e.g. after the tunnel comes back
+	r.mark("tunnel")
+
+	var none *readiness
+	none.mark("tunnel")
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DefaultVirtualCIDR is where services get virtual addresses from when
+// remapping. It is reserved for benchmarking, so local networks almost
+// never use it.
+const DefaultVirtualCIDR = "198.18.0.0/15"
+
+// A remapper gives each name a virtual address, which stays the same
+// for as long as teleproxy runs, and with pins, after. Addresses are
+// never handed to another name, even once theirs is gone, since
+// whatever resolved it may still be connecting to it.
+type remapper struct {
+	network  *net.IPNet
+	next     uint32
+	assigned map[string]string
+	// changed is whether addresses were assigned since the last
+	// time it was cleared
+	changed bool
+}
+
+func newRemapper(cidr string) (*remapper, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("virtual range %s is not ipv4", cidr)
+	}
+	// skip the network address
+	return &remapper{network: network, next: 1, assigned: make(map[string]string)}, nil
+}
+
+// restore hands out the virtual addresses of assigned again, those
+// that are in the range anyway.
+func (r *remapper) restore(assigned map[string]string) {
+	base := binary.BigEndian.Uint32(r.network.IP.To4())
+	for ip, v := range assigned {
+		addr := net.ParseIP(v).To4()
+		if addr == nil || !r.network.Contains(addr) {
+			continue
+		}
+		r.assigned[ip] = v
+		if offset := binary.BigEndian.Uint32(addr) - base; offset >= r.next {
+			r.next = offset + 1
+		}
+	}
+}
+
+func (r *remapper) virtual(name string) (string, error) {
+	if v, ok := r.assigned[name]; ok {
+		return v, nil
+	}
+	ones, bits := r.network.Mask.Size()
+	// leave out the broadcast address
+	if uint64(r.next) >= uint64(1)<<uint(bits-ones)-1 {
+		return "", fmt.Errorf("virtual range %s is exhausted, `teleproxy dns reset` forgets the addresses pinned", r.network)
+	}
+	addr := make(net.IP, 4)
+	binary.BigEndian.PutUint32(addr, binary.BigEndian.Uint32(r.network.IP.To4())+r.next)
+	r.next++
+	r.assigned[name] = addr.String()
+	r.changed = true
+	return r.assigned[name], nil
+}
@@ -0,0 +1,472 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+	"github.com/datawire/teleproxy/pkg/tpu"
+
+	"github.com/datawire/teleproxy/internal/pkg/api"
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+const (
+	// how long a replica waits before looking for a pod again
+	replicaRetry = 5 * time.Second
+	// how many times in a row a replica's ssh may die before it
+	// moves on to another pod
+	replicaMaxRestarts = 5
+)
+
+// replicaPorts are the local ports of each replica: the port-forward to
+// its pod, and its own tunnel.
+type replicaPorts struct {
+	forward, tunnel int
+}
+
+// allocateReplicas allocates the ports of the replicas beyond the
+// first, which uses the usual port-forward.
+func (s *Session) allocateReplicas() error {
+	s.replicaPorts = nil
+	if !s.replicated() {
+		return nil
+	}
+	for i := 0; i < s.opts.Replicas; i++ {
+		p := replicaPorts{forward: s.forwardPort}
+		var err error
+		if i > 0 {
+			if p.forward, err = s.ports.Allocate(fmt.Sprintf("port-forward-%d", i+1), 0, "tcp"); err != nil {
+				return err
+			}
+		}
+		if p.tunnel, err = s.ports.Allocate(fmt.Sprintf("tunnel-%d", i+1), 0, "tcp"); err != nil {
+			return err
+		}
+		s.replicaPorts = append(s.replicaPorts, p)
+	}
+	return nil
+}
+
+// replicated is whether the tunnel goes through the replicas of the
+// teleproxy deployment rather than the lone pod.
+func (s *Session) replicated() bool {
+	return s.opts.Replicas > 1 || s.opts.AgentInstalled
+}
+
+// connect runs the tunnel of the session, by way of the lone teleproxy
+// pod, or of several replicas if so configured, or of an exec pod.
+// Unless they were installed already, teleproxy pods are applied
+// first.
+func (s *Session) connect(kubeinfo *k8s.KubeInfo) (disconnect, reconnect func()) {
+	if s.opts.ExecPod != "" {
+		return connectExec(kubeinfo, s.opts.ExecPod, s.opts.Socks)
+	}
+	m := Manifest{Image: s.opts.AgentImage, Arch: s.opts.AgentArch, PullSecrets: s.opts.AgentPullSecrets, Replicas: s.opts.Replicas}
+	if !s.replicated() {
+		pod, err := m.pod()
+		if err != nil {
+			panic(err)
+		}
+		checkArch(kubeinfo, m)
+		return connect(kubeinfo, pod, s.opts.Socks, s.forwardPort, s.hostKeys(), s.health)
+	}
+	manifest := ""
+	if !s.opts.AgentInstalled {
+		var err error
+		m.BudgetVersion = kubeinfo.BudgetVersion()
+		if manifest, err = m.Render(); err != nil {
+			panic(err)
+		}
+		checkArch(kubeinfo, m)
+	}
+	return connectReplicas(kubeinfo, manifest, s.opts.Socks, s.replicaPorts, s.hostKeys(), s.login, s.health, s.refused)
+}
+
+// tunnels lists the tunnels of the session into the cluster, and
+// whether each accepts connections, for /api/tunnels.
+func (s *Session) tunnels() []api.Tunnel {
+	up := func(address string) bool {
+		conn, err := net.DialTimeout("tcp", address, tunnelCheck)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}
+	main := api.Tunnel{Name: "tunnel", Address: s.opts.Socks}
+	switch {
+	case s.opts.ExecPod != "":
+		main.Via = "kubectl exec in pod/" + s.opts.ExecPod
+	case s.replicated():
+		main.Via = "the replicas"
+	default:
+		main.Via = "port-forward to pod/teleproxy"
+		main.Forward = s.forwardPort
+	}
+	main.Up = up(main.Address)
+	tunnels := []api.Tunnel{main}
+	if s.opts.ExecPod != "" {
+		return tunnels
+	}
+	for i, p := range s.replicaPorts {
+		address := net.JoinHostPort("127.0.0.1", strconv.Itoa(p.tunnel))
+		tunnels = append(tunnels, api.Tunnel{
+			Name:    fmt.Sprintf("replica %d", i+1),
+			Address: address,
+			Via:     "port-forward to a pod of the teleproxy-replica deployment",
+			Forward: p.forward,
+			Up:      up(address),
+		})
+	}
+	return tunnels
+}
+
+// checkArch warns if none of the nodes of the cluster can run the
+// image of m, since its pods would never be scheduled.
+func checkArch(kubeinfo *k8s.KubeInfo, m Manifest) {
+	m, _ = m.defaults()
+	if len(m.Arch) == 0 {
+		return
+	}
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+kubeinfo.GetKubectl("get nodes -o jsonpath={.items[*].status.nodeInfo.architecture}"))
+	if err != nil {
+		// e.g. not allowed to list nodes, which is fine
+		return
+	}
+	var nodes []string
+	for _, arch := range strings.Fields(output) {
+		if contains(m.Arch, arch) {
+			return
+		}
+		if !contains(nodes, arch) {
+			nodes = append(nodes, arch)
+		}
+	}
+	if len(nodes) > 0 {
+		log.Printf("SSH: WARNING: %s is built for %s, but the nodes are %s: use -agent-image with an image built for them",
+			m.Image, strings.Join(m.Arch, ", "), strings.Join(nodes, ", "))
+	}
+}
+
+// connectReplicas runs the tunnel into the cluster on socks by way of a
+// deployment of teleproxy pods, applying manifest first unless it is
+// empty, with a replica per ports. Each replica has a
+// tunnel of its own to one of the pods, and connections to socks are
+// spread over the tunnels that are up. Losing a pod only loses the
+// connections through it: the others carry on, and the replica moves
+// on to another pod. The pods are logged into as login, and refused
+// is told the destinations their policy refuses.
+func connectReplicas(kubeinfo *k8s.KubeInfo, manifest, socks string, ports []replicaPorts, keys hostKeys, login agentLogin, health func(command string) func(tpu.Health, error), refused func(host string)) (disconnect, reconnect func()) {
+	if manifest != "" {
+		apply := tpu.NewKeeper("KAP", "kubectl "+kubeinfo.GetKubectl("apply -f -"))
+		apply.Input = manifest
+		apply.Limit = 1
+		apply.Start()
+		apply.Wait()
+		go checkPull(kubeinfo)
+	}
+
+	var replicas []*replica
+	var tunnels []string
+	for i, p := range ports {
+		r := &replica{
+			slot:       i,
+			ports:      p,
+			kubeinfo:   kubeinfo,
+			pinnedKeys: keys,
+			login:      login,
+			health:     health,
+			stop:       make(chan struct{}),
+			restart:    make(chan struct{}),
+			done:       make(chan struct{}),
+		}
+		go r.run()
+		replicas = append(replicas, r)
+		tunnels = append(tunnels, net.JoinHostPort("127.0.0.1", strconv.Itoa(p.tunnel)))
+	}
+	f := newFailover(socks, tunnels, login, refused)
+	go f.run()
+
+	disconnect = func() {
+		f.close()
+		for _, r := range replicas {
+			close(r.stop)
+			<-r.done
+		}
+	}
+	reconnect = func() {
+		for _, r := range replicas {
+			select {
+			case r.restart <- struct{}{}:
+			case <-r.done:
+			}
+		}
+	}
+	return
+}
+
+// A replica keeps a tunnel to one of the teleproxy pods of the
+// deployment, and moves on to another when that one goes away.
+type replica struct {
+	slot       int
+	ports      replicaPorts
+	kubeinfo   *k8s.KubeInfo
+	pinnedKeys hostKeys
+	login      agentLogin
+	health     func(command string) func(tpu.Health, error)
+	stop       chan struct{}
+	restart    chan struct{}
+	done       chan struct{}
+}
+
+func (r *replica) log(line string, args ...interface{}) {
+	log.Printf("SSH: replica %d: "+line, append([]interface{}{r.slot + 1}, args...)...)
+}
+
+func (r *replica) run() {
+	defer close(r.done)
+	for {
+		pods, err := replicaPods(r.kubeinfo)
+		if err != nil || len(pods) == 0 {
+			r.log("no teleproxy pod to connect to: %v", err)
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(replicaRetry):
+				continue
+			}
+		}
+		// replicas take the pods in turn, and share them if there
+		// are too few
+		pod := pods[r.slot%len(pods)]
+		alias := hostKeyAlias(r.kubeinfo.Context) + "." + pod
+
+		pf := tpu.NewKeeper("KPF", "kubectl "+r.kubeinfo.GetKubectl(fmt.Sprintf("port-forward pod/%s %d:%d", pod, r.ports.forward, r.login.port())))
+		// a port-forward that died is to a pod that may be gone,
+		// so it isn't restarted as is
+		pf.Limit = 1
+		ssh := tpu.NewKeeper("SSH", r.login.ssh(r.login.forward(r.ports.tunnel)+"-C -N -oConnectTimeout=5 -oExitOnForwardFailure=yes "+
+			podKeyOptions(r.kubeinfo, r.pinnedKeys, pod, alias)+fmt.Sprintf(" telepresence@localhost -p %d", r.ports.forward)))
+		// nor is an ssh that keeps dying
+		ssh.MaxRestarts = replicaMaxRestarts
+		ssh.OnHealth = r.health(fmt.Sprintf("ssh (replica %d)", r.slot+1))
+		r.log("connecting to pod/%s", pod)
+		pf.Start()
+		ssh.Start()
+		died := make(chan string, 2)
+		go func() {
+			pf.Wait()
+			died <- "the port-forward"
+		}()
+		go func() {
+			ssh.Wait()
+			died <- "ssh"
+		}()
+
+		select {
+		case what := <-died:
+			ssh.Stop()
+			pf.Stop()
+			r.log("lost %s to pod/%s, moving on", what, pod)
+			if what == "ssh" {
+				// the ssh to the next pod starts over
+				r.health(fmt.Sprintf("ssh (replica %d)", r.slot+1))(tpu.Healthy, nil)
+			}
+			if pods, err := replicaPods(r.kubeinfo); err == nil && !contains(pods, pod) {
+				// pod names aren't reused
+				forgetAlias(r.pinnedKeys.knownHosts, alias)
+			}
+		case <-r.restart:
+			pf.Stop()
+			ssh.Stop()
+		case <-r.stop:
+			ssh.Stop()
+			pf.Stop()
+			return
+		}
+	}
+}
+
+// replicaPods lists the teleproxy pods of the deployment that are
+// running and not on their way out, by name.
+func replicaPods(kubeinfo *k8s.KubeInfo) ([]string, error) {
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+kubeinfo.GetKubectl(
+		`get pods -l name=teleproxy-replica --field-selector=status.phase=Running `+
+			`-o jsonpath='{range .items[*]}{.metadata.name} {.metadata.deletionTimestamp}{"\n"}{end}'`))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+	}
+	return parseReplicaPods(output), nil
+}
+
+func parseReplicaPods(output string) (pods []string) {
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 1 {
+			pods = append(pods, fields[0])
+		}
+	}
+	sort.Strings(pods)
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A failover listens on the address of the tunnel, as long as one of
+// the tunnels of the replicas is up, and relays each connection to the
+// next of them that is, in turn. Whoever checks the tunnel sees it go
+// down only when all of them are.
+type failover struct {
+	address string
+	tunnels []string
+	login   agentLogin
+	refused func(host string)
+
+	mutex    sync.Mutex
+	listener net.Listener
+	next     int
+	closed   bool
+	stop     chan struct{}
+}
+
+func newFailover(address string, tunnels []string, login agentLogin, refused func(host string)) *failover {
+	return &failover{address: address, tunnels: tunnels, login: login, refused: refused, stop: make(chan struct{})}
+}
+
+func (f *failover) run() {
+	ticker := time.NewTicker(tunnelCheck)
+	defer ticker.Stop()
+	for {
+		f.check()
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check listens if any tunnel is up, and stops listening otherwise.
+func (f *failover) check() {
+	up := false
+	for _, t := range f.tunnels {
+		if conn, err := net.DialTimeout("tcp", t, tunnelCheck); err == nil {
+			conn.Close()
+			up = true
+			break
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case f.closed:
+	case up && f.listener == nil:
+		ln, err := net.Listen("tcp", f.address)
+		if err != nil {
+			log.Printf("SSH: can't listen on %s: %v", f.address, err)
+			return
+		}
+		f.listener = ln
+		go f.accept(ln)
+	case !up && f.listener != nil:
+		log.Printf("SSH: no replica is up")
+		f.listener.Close()
+		f.listener = nil
+	}
+}
+
+func (f *failover) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.relay(conn)
+	}
+}
+
+// relay hands conn to the next tunnel that takes it. SOCKS is relayed
+// as it is, so the tunnel answers the handshake, except that with a
+// token, the proxy of the pods is logged into first.
+func (f *failover) relay(conn net.Conn) {
+	defer conn.Close()
+	f.mutex.Lock()
+	first := f.next
+	f.next = (f.next + 1) % len(f.tunnels)
+	f.mutex.Unlock()
+
+	var upstream net.Conn
+	for i := range f.tunnels {
+		var err error
+		if upstream, err = net.DialTimeout("tcp", f.tunnels[(first+i)%len(f.tunnels)], tunnelCheck); err == nil {
+			break
+		}
+	}
+	if upstream == nil {
+		return
+	}
+	defer upstream.Close()
+	if f.login.tokens != nil && !f.logIn(conn, upstream) {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	<-done
+}
+
+// logIn hands conn to the proxy on upstream, logged in with the token,
+// and reports whether it connected.
+func (f *failover) logIn(conn, upstream net.Conn) bool {
+	token, err := f.login.tokens.get()
+	if err != nil {
+		log.Printf("SSH: no token to log into the proxy of the pods with: %v", err)
+		return false
+	}
+	host, refused, err := socks.Relay(conn, upstream, token)
+	switch {
+	case err == socks.ErrLoginRefused:
+		log.Printf("SSH: the proxy of the pods refused the token")
+		f.login.tokens.forget()
+	case err != nil:
+	case refused:
+		log.Printf("SSH: the policy of the pods refused %s", host)
+		f.refused(host)
+	default:
+		return true
+	}
+	return false
+}
+
+func (f *failover) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	close(f.stop)
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+}
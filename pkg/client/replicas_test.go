@@ -0,0 +1,177 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+func TestParseReplicaPods(t *testing.T) {
+	output := "teleproxy-b 2026-10-14T10:00:00Z\nteleproxy-c \nteleproxy-a \n"
+	if pods := parseReplicaPods(output); !reflect.DeepEqual(pods, []string{"teleproxy-a", "teleproxy-c"}) {
+		t.Errorf("pods %v", pods)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	tunnel := func(name string) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+				conn.Close()
+			}
+		}()
+		return ln
+	}
+	a, b := tunnel("a"), tunnel("b")
+	defer b.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	f := newFailover(address, []string{a.Addr().String(), b.Addr().String()}, agentLogin{}, nil)
+	defer f.close()
+	get := func() string {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, _ := ioutil.ReadAll(conn)
+		return string(data)
+	}
+
+	f.check()
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[get()] = true
+	}
+	if !reflect.DeepEqual(seen, map[string]bool{"a": true, "b": true}) {
+		t.Errorf("spread over %v", seen)
+	}
+
+	a.Close()
+	for i := 0; i < 4; i++ {
+		if got := get(); got != "b" {
+			t.Errorf("with a gone, got %q", got)
+		}
+	}
+
+	b.Close()
+	f.check()
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Error("still listening with no tunnel up")
+	}
+}
+
+type onlyDefault struct{}
+
+func (onlyDefault) Login(token string) (string, error) {
+	if token != "alice's token" {
+		return "", errors.New("who are you")
+	}
+	return "alice", nil
+}
+
+func (onlyDefault) Allow(who, host string) error {
+	if host != "hello.default:80" {
+		return errors.New("not in default")
+	}
+	return nil
+}
+
+func TestFailoverPolicy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	proxy, err := socks.NewPolicyServer("127.0.0.1:0", func(network, address string) (net.Conn, error) {
+		return net.Dial(network, backend.Addr().String())
+	}, onlyDefault{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Start()
+	defer proxy.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	refused := make(chan string, 1)
+	login := agentLogin{tokens: &tokenSource{command: "echo \"alice's token\""}}
+	f := newFailover(address, []string{proxy.Addr()}, login, func(host string) { refused <- host })
+	defer f.close()
+	f.check()
+	get := func(host string) string {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{5, 1, 0})
+		conn.Write(append(append([]byte{5, 1, 0, 3, byte(len(host))}, host...), 0, 80))
+		data, _ := ioutil.ReadAll(conn)
+		if len(data) < 12 {
+			return ""
+		}
+		return string(data[12:])
+	}
+
+	if got := get("hello.default"); got != "hello" {
+		t.Errorf("allowed: got %q", got)
+	}
+	if got := get("secret.prod"); got != "" {
+		t.Errorf("refused: got %q", got)
+	}
+	select {
+	case host := <-refused:
+		if host != "secret.prod:80" {
+			t.Errorf("refused %q", host)
+		}
+	case <-time.After(time.Second):
+		t.Error("the refusal was not reported")
+	}
+
+	login.tokens.mutex.Lock()
+	login.tokens.token = "mallory's token"
+	login.tokens.mutex.Unlock()
+	if got := get("hello.default"); got != "" {
+		t.Errorf("with a refused token: got %q", got)
+	}
+	if got := get("hello.default"); got != "hello" {
+		t.Errorf("with the token asked for again: got %q", got)
+	}
+}
@@ -0,0 +1,49 @@
+// +build linux
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// startWithResolvConf starts cmd in a mount namespace of its own, where
+// /etc/resolv.conf is conf.
+func startWithResolvConf(cmd *exec.Cmd, conf []byte) error {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(conf)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	started := make(chan error)
+	go func() {
+		// The namespace belongs to this thread, and the command is
+		// forked from it. The thread is never unlocked, so it exits
+		// with the goroutine rather than going back to the runtime.
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+			started <- err
+			return
+		}
+		// keep the mount from propagating to the host
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			started <- err
+			return
+		}
+		if err := syscall.Mount(f.Name(), "/etc/resolv.conf", "", syscall.MS_BIND, ""); err != nil {
+			started <- err
+			return
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/internal/pkg/socks"
+)
+
+// DefaultCgroup is the cgroup whose processes a process scoped
+// teleproxy intercepts. It is a cgroup v2 path.
+const DefaultCgroup = "teleproxy"
+
+// where cgroup v2 is mounted, and where the session that made a
+// cgroup records its pid
+var (
+	cgroupRoot = "/sys/fs/cgroup"
+	runDir     = "/run"
+)
+
+// how long Session.Run waits for the tunnel to come up
+const tunnelTimeout = 30 * time.Second
+
+func cgroupDir(cgroup string) string {
+	return filepath.Join(cgroupRoot, cgroup)
+}
+
+func ownerFile(cgroup string) string {
+	return filepath.Join(runDir, "teleproxy-"+cgroup+".pid")
+}
+
+// cgroupOwner returns the pid of the running session that made cgroup,
+// if there is one. A cgroup without one was left behind by a session
+// that didn't get to clean up.
+func cgroupOwner(cgroup string) (int, bool) {
+	content, err := ioutil.ReadFile(ownerFile(cgroup))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0, false
+	}
+	if _, err := os.Stat(filepath.Join(cgroupDir(cgroup), "cgroup.procs")); err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+// CanScopeProcesses reports whether teleproxy can intercept only some
+// processes here, which takes root on linux with cgroup v2.
+func CanScopeProcesses() bool {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// processScope checks that traffic can be scoped to processes, and
+// makes the cgroup they are put in, owned by this process. A cgroup
+// left behind by an earlier session is removed first.
+func processScope(cgroup string) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return errors.Wrap(err, "intercepting only some processes requires cgroup v2")
+	}
+	if pid, ok := cgroupOwner(cgroup); ok && pid != os.Getpid() {
+		return errors.Errorf("%s belongs to the teleproxy running as pid %d", cgroupDir(cgroup), pid)
+	}
+	if err := removeCgroup(cgroup); err != nil {
+		return errors.Wrap(err, "removing the stale "+cgroupDir(cgroup))
+	}
+	if err := os.MkdirAll(cgroupDir(cgroup), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ownerFile(cgroup), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// removeCgroup removes cgroup and its owner, moving any processes still
+// in it to the root cgroup, which is the only way to empty it.
+func removeCgroup(cgroup string) error {
+	os.Remove(ownerFile(cgroup))
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupDir(cgroup), "cgroup.procs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := ioutil.WriteFile(filepath.Join(cgroupRoot, "cgroup.procs"), []byte(pid), 0644); err != nil {
+			return err
+		}
+	}
+	return os.Remove(cgroupDir(cgroup))
+}
+
+// Run runs command so that only its traffic is intercepted by the
+// teleproxy already running. If that teleproxy is process scoped,
+// which is only possible on linux, the command joins its cgroup. A
+// cgroup whose session is gone doesn't count.
+// Otherwise the command is pointed at the tunnel on socks with the
+// proxy environment variables (see proxied), which is cross platform
+// but only covers programs that honor them.
+//
+// Joining the cgroup requires root, so under sudo the command runs as
+// the invoking user.
+func Run(command []string, cgroup, socks string) (int, error) {
+	cmd, err := newCommand(command)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := cgroupOwner(cgroup); !ok {
+		log.Printf("TPY: no process scoped teleproxy, using a socks proxy at %s instead", socks)
+		return proxied(cmd, socks)
+	}
+	if err := joinCgroup(cgroup); err != nil {
+		return 0, err
+	}
+	return wait(cmd, cmd.Start())
+}
+
+// Run runs command with access to the cluster through the session, and
+// returns its exit status once it exits. The session is meant to be
+// closed then, so that teleproxy lasts exactly as long as the command.
+//
+// A process scoped session puts the command in its cgroup, and on
+// linux gives it a resolv.conf of its own, in a mount namespace, that
+// searches the cluster domains like a pod's. Otherwise the command
+// gets the proxy environment variables.
+func (s *Session) Run(command []string) (int, error) {
+	cmd, err := newCommand(command)
+	if err != nil {
+		return 0, err
+	}
+	if err := waitForTunnel(s.opts.Socks, tunnelTimeout); err != nil {
+		return 0, err
+	}
+	if !s.opts.ProcessScoped {
+		return proxied(cmd, s.opts.Socks)
+	}
+
+	if err := joinCgroup(DefaultCgroup); err != nil {
+		return 0, err
+	}
+	host, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return 0, err
+	}
+	return wait(cmd, startWithResolvConf(cmd, resolvConf(host, s.nameserver, s.search)))
+}
+
+func newCommand(command []string) (*exec.Cmd, error) {
+	if len(command) == 0 {
+		return nil, errors.New("nothing to run")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if uid, gid, ok := sudoer(); ok {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: gid}}
+	}
+	return cmd, nil
+}
+
+// joinCgroup moves us into cgroup, so that the commands we start are
+// in it too.
+func joinCgroup(cgroup string) error {
+	procs := filepath.Join(cgroupDir(cgroup), "cgroup.procs")
+	if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return errors.Wrap(err, "joining "+cgroupDir(cgroup))
+	}
+	return nil
+}
+
+// proxied runs cmd with the proxy variables pointing at a socks proxy
+// of our own in front of the tunnel. Unlike the tunnel, it
+// takes UDP ASSOCIATE, so that clients that send their dns over it get
+// answers from the cluster, and clients that try quic over it are
+// logged.
+func proxied(cmd *exec.Cmd, tunnel string) (int, error) {
+	front, err := socks.NewServer("127.0.0.1:0", tunnel)
+	if err != nil {
+		return 0, err
+	}
+	front.Start()
+	defer front.Stop()
+	proxyEnv(cmd, front.Addr())
+	return wait(cmd, cmd.Start())
+}
+
+func proxyEnv(cmd *exec.Cmd, socks string) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+		// socks5h resolves names in the cluster
+		cmd.Env = append(cmd.Env, name+"=socks5h://"+socks)
+	}
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		cmd.Env = append(cmd.Env, name+"=socks5://"+socks)
+	}
+}
+
+// wait waits for cmd, if it started, and returns its exit status.
+func wait(cmd *exec.Cmd, started error) (int, error) {
+	if started != nil {
+		return 0, started
+	}
+	err := cmd.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func waitForTunnel(socks string, timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(250 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", socks); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("the tunnel on %s didn't come up within %s", socks, timeout)
+}
+
+// resolvConf returns host, the host's resolv.conf, with nameserver
+// instead of its own (if given), and the cluster domains in search
+// ahead of its own.
+func resolvConf(host []byte, nameserver string, search []string) []byte {
+	var result bytes.Buffer
+	result.WriteString("# generated by teleproxy run\n")
+	if nameserver != "" {
+		result.WriteString("nameserver " + nameserver + "\n")
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(host))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "search", "domain":
+			search = append(search, fields[1:]...)
+		case "nameserver":
+			if nameserver == "" {
+				result.WriteString(line + "\n")
+			}
+		default:
+			result.WriteString(line + "\n")
+		}
+	}
+	if len(search) > 0 {
+		result.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	return result.Bytes()
+}
+
+// sudoer returns who invoked sudo, if we are running under it.
+func sudoer() (uint32, uint32, bool) {
+	if os.Getuid() != 0 {
+		return 0, 0, false
+	}
+	uid, err := strconv.ParseUint(os.Getenv("SUDO_UID"), 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	gid, err := strconv.ParseUint(os.Getenv("SUDO_GID"), 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(uid), uint32(gid), true
+}
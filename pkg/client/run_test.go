@@ -0,0 +1,93 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	host := []byte(`# managed by systemd-resolved
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+options edns0 trust-ad
+search corp.example.com
+`)
+	search := []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"}
+
+	expected := `# generated by teleproxy run
+nameserver 127.0.0.53
+options edns0 trust-ad
+search default.svc.cluster.local svc.cluster.local cluster.local corp.example.com
+`
+	if conf := string(resolvConf(host, "127.0.0.53", search)); conf != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, conf)
+	}
+
+	expected = `# generated by teleproxy run
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+options edns0 trust-ad
+search corp.example.com
+`
+	if conf := string(resolvConf(host, "", nil)); conf != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, conf)
+	}
+}
+
+func TestStaleCgroup(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(cgroupRoot0, runDir0 string) { cgroupRoot, runDir = cgroupRoot0, runDir0 }(cgroupRoot, runDir)
+	cgroupRoot, runDir = root, root
+	for _, file := range []string{"cgroup.controllers", "cgroup.procs"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// left behind by a session that is gone, with a process still in it
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(cgroupDir("tp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(cgroupDir("tp"), "cgroup.procs"), []byte("4242\n"), 0644)
+	ioutil.WriteFile(ownerFile("tp"), []byte(strconv.Itoa(exited.Process.Pid)), 0644)
+	if _, ok := cgroupOwner("tp"); ok {
+		t.Error("expected the cgroup of an exited session to be stale")
+	}
+
+	// cgroup.procs can't be removed from a real cgroup dir, but can here
+	os.Remove(filepath.Join(cgroupDir("tp"), "cgroup.procs"))
+	ioutil.WriteFile(filepath.Join(cgroupDir("tp"), "cgroup.procs"), []byte("4242\n"), 0644)
+	if err := removeCgroup("tp"); err == nil {
+		t.Error("expected a dir with files in it to stay")
+	}
+	if moved, _ := ioutil.ReadFile(filepath.Join(root, "cgroup.procs")); string(moved) != "4242" {
+		t.Errorf("expected 4242 moved to the root cgroup, got %q", moved)
+	}
+	os.Remove(filepath.Join(cgroupDir("tp"), "cgroup.procs"))
+
+	if err := processScope("tp"); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(cgroupDir("tp"), "cgroup.procs"), nil, 0644)
+	if pid, ok := cgroupOwner("tp"); !ok || pid != os.Getpid() {
+		t.Errorf("expected the cgroup to be ours, got %d, %v", pid, ok)
+	}
+
+	// another live session owns it
+	ioutil.WriteFile(ownerFile("tp"), []byte("1"), 0644)
+	if err := processScope("tp"); err == nil {
+		t.Error("expected a cgroup owned by another session to be refused")
+	}
+}
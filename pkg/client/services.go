@@ -0,0 +1,484 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+
+	"github.com/datawire/teleproxy/internal/pkg/loopback"
+	"github.com/datawire/teleproxy/internal/pkg/proxy"
+	"github.com/datawire/teleproxy/internal/pkg/route"
+	"github.com/datawire/teleproxy/internal/pkg/wsl"
+)
+
+type serviceKey struct {
+	namespace string
+	name      string
+}
+
+// kubernetesBridge routes services to the tunnel into the cluster,
+// except for intercepted ones, which are routed to a local port.
+type kubernetesBridge struct {
+	session *Session
+	network k8s.Network
+	pol     *policy
+
+	mutex      sync.Mutex
+	services   []k8s.Resource
+	intercepts map[serviceKey]int
+	expiries   map[serviceKey]*time.Timer
+	// lifetimes has the ttl each expiring intercept was made with
+	lifetimes map[serviceKey]time.Duration
+	// weights has the percentage of connections routed locally for
+	// intercepts that don't route all of them there. These are
+	// split up by the proxy, since the firewall can't.
+	weights map[serviceKey]int
+	// selectors has the header that picks which requests are routed
+	// locally, for intercepts that route by header.
+	selectors map[serviceKey]selector
+	cluster   publisher
+	local     publisher
+
+	// With a cache, services are published from it until the
+	// cluster is heard from. Offline, changes to them are also held
+	// back while the tunnel is down: what is published is then
+	// stale, but better than nothing.
+	cache   *cache
+	offline bool
+	stale   bool
+	queued  []k8s.Resource
+
+	// remap, if set, gives services virtual addresses in place of
+	// ones that clash with local networks, and pins, if set, keeps
+	// them for the sessions to come
+	remap *remapper
+	pins  *pins
+	// loopback, if set, binds services to loopback addresses of
+	// their own
+	loopback *loopback.Binder
+	// portProxy, if set, gives services to Windows
+	portProxy *wsl.PortProxy
+}
+
+func newKubernetesBridge(s *Session, network k8s.Network, pol *policy) *kubernetesBridge {
+	return &kubernetesBridge{
+		session:    s,
+		network:    network,
+		pol:        pol,
+		intercepts: make(map[serviceKey]int),
+		expiries:   make(map[serviceKey]*time.Timer),
+		lifetimes:  make(map[serviceKey]time.Duration),
+		weights:    make(map[serviceKey]int),
+		selectors:  make(map[serviceKey]selector),
+		cluster:    publisher{session: s},
+		local:      publisher{session: s},
+	}
+}
+
+func (b *kubernetesBridge) update(services []k8s.Resource) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cache != nil {
+		if b.offline {
+			b.save(services)
+			log.Printf("BRG: tunnel is down, holding back %d services", len(services))
+			b.queued = services
+			return
+		}
+		b.stale = false
+		b.markStale()
+	}
+	b.services = services
+	b.publish(false)
+	b.session.ready.mark("services")
+	if b.cache != nil {
+		// after publishing, which assigns any new virtual addresses
+		b.save(services)
+	}
+}
+
+func (b *kubernetesBridge) save(services []k8s.Resource) {
+	state := cached{Network: b.network, Services: services}
+	if b.remap != nil {
+		state.Virtual = b.remap.assigned
+	}
+	if err := b.cache.save(state); err != nil {
+		log.Printf("BRG: error caching services: %v", err)
+	}
+}
+
+// restore publishes services from the cache as stale, until the
+// cluster is heard from.
+func (b *kubernetesBridge) restore(services []k8s.Resource) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	log.Printf("BRG: restoring %d services from %s", len(services), b.cache.filename)
+	b.services = services
+	b.stale = true
+	b.publish(false)
+	b.markStale()
+}
+
+// tunnel publishes whatever was held back once the tunnel is up
+// again, and marks the services stale while it is down.
+func (b *kubernetesBridge) tunnel(up bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.offline = !up
+	if up && b.queued != nil {
+		log.Printf("BRG: tunnel is up, reconciling %d services", len(b.queued))
+		b.services, b.queued = b.queued, nil
+		b.stale = false
+		b.publish(false)
+		b.session.ready.mark("services")
+	}
+	b.markStale()
+}
+
+func (b *kubernetesBridge) markStale() {
+	var tables []string
+	if b.stale || b.offline {
+		tables = []string{"kubernetes", "intercepts"}
+	}
+	b.session.postStale(tables)
+}
+
+// publish routes the services. A route that moves between tables must
+// be removed from the old one first, or removing it would clear the
+// firewall mapping just installed for the new one, so intercepting
+// publishes the cluster table first and releasing the local one.
+func (b *kubernetesBridge) publish(releasing bool) {
+	cluster := route.Table{Name: "kubernetes"}
+	local := route.Table{Name: "intercepts"}
+	splits := make(map[string]proxy.Split)
+	if b.pol != nil {
+		var namespaces []string
+		for _, svc := range b.services {
+			namespaces = append(namespaces, svc.Namespace())
+		}
+		b.pol.refresh(namespaces, b.reviewed)
+	}
+	for _, svc := range b.services {
+		ip, ok := svc.Spec()["clusterIP"]
+		// for headless services the IP is None, we
+		// should properly handle these by listening
+		// for endpoints and returning multiple A
+		// records at some point
+		if b.pol != nil && !b.pol.decided(svc.Namespace()) {
+			continue
+		}
+		if !ok || ip == "None" {
+			continue
+		}
+		if !b.network.Contains(ip.(string)) {
+			log.Printf("BRG: %s.%s has cluster ip %s outside of %s", svc.Name(), svc.Namespace(), ip, b.network.ServiceCIDR)
+			continue
+		}
+		name := svc.Name() + "." + svc.Namespace() + ".svc." + b.network.Domain
+		addr := ip.(string)
+		if b.remap != nil {
+			var err error
+			// by name, so that the address outlives the
+			// service being recreated with a new cluster ip
+			if addr, err = b.remap.virtual(name); err != nil {
+				log.Printf("BRG: not routing %s.%s: %v", svc.Name(), svc.Namespace(), err)
+				continue
+			}
+		}
+		r := route.Route{
+			Name:   name,
+			Ip:     addr,
+			Proto:  "tcp",
+			Target: strconv.Itoa(b.session.proxyPort),
+		}
+		key := serviceKey{svc.Namespace(), svc.Name()}
+		if port, ok := b.intercepts[key]; ok {
+			target, err := targetPort(svc, port)
+			if err == nil && b.splitting(key) {
+				sel := b.selectors[key]
+				splits[net.JoinHostPort(addr, strconv.Itoa(port))] = proxy.Split{
+					Local:   net.JoinHostPort("127.0.0.1", strconv.Itoa(target)),
+					Percent: b.weights[key],
+					Header:  sel.header,
+					Value:   sel.value,
+				}
+				cluster.Add(r)
+				continue
+			}
+			if err == nil {
+				r.Target = strconv.Itoa(target)
+				local.Add(r)
+				continue
+			}
+			log.Printf("BRG: not intercepting %s.%s: %v", svc.Name(), svc.Namespace(), err)
+		}
+		cluster.Add(r)
+	}
+	if releasing {
+		b.local.publish(local)
+		b.cluster.publish(cluster)
+	} else {
+		b.cluster.publish(cluster)
+		b.local.publish(local)
+	}
+	if b.session.proxy != nil {
+		b.session.proxy.SetSplits(splits)
+	}
+	if b.pins != nil && b.remap.changed {
+		if err := b.pins.save(b.remap.assigned); err != nil {
+			log.Printf("BRG: error pinning virtual addresses: %v", err)
+		} else {
+			b.remap.changed = false
+		}
+	}
+	if b.loopback != nil {
+		b.loopback.Bind(b.boundServices(b.session.opts.Loopback))
+	}
+	if b.portProxy != nil {
+		b.portProxy.Bind(b.boundServices(b.session.opts.WindowsPortProxy))
+	}
+	if b.pol != nil {
+		b.session.postDenied(b.pol.denied())
+	}
+}
+
+// reviewed publishes the services again once the policy has reviewed
+// their namespaces.
+func (b *kubernetesBridge) reviewed() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.publish(false)
+}
+
+func (b *kubernetesBridge) find(namespace, name string) k8s.Resource {
+	for _, svc := range b.services {
+		if svc.Namespace() == namespace && svc.Name() == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// intercept routes the service to a local port, for ttl if it isn't
+// zero. Intercepting it again replaces the ttl.
+func (b *kubernetesBridge) intercept(namespace, name string, port int, ttl time.Duration) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	svc := b.find(namespace, name)
+	if svc == nil {
+		return 0, fmt.Errorf("service %s.%s not found", name, namespace)
+	}
+	target, err := targetPort(svc, port)
+	if err != nil {
+		return 0, err
+	}
+	key := serviceKey{namespace, name}
+	b.intercepts[key] = port
+	if timer, ok := b.expiries[key]; ok {
+		timer.Stop()
+		delete(b.expiries, key)
+		delete(b.lifetimes, key)
+	}
+	if ttl > 0 {
+		// the timer can fire before it is assigned, so expire only
+		// looks at it under the mutex
+		var timer *time.Timer
+		timer = time.AfterFunc(ttl, func() { b.expire(key, &timer) })
+		b.expiries[key] = timer
+		b.lifetimes[key] = ttl
+	}
+	b.publish(false)
+	return target, nil
+}
+
+// expire releases an intercept whose ttl is up, unless it was
+// released or intercepted again meanwhile.
+func (b *kubernetesBridge) expire(key serviceKey, timer **time.Timer) {
+	b.mutex.Lock()
+	if b.expiries[key] != *timer {
+		b.mutex.Unlock()
+		return
+	}
+	log.Printf("BRG: intercept of %s.%s expired", key.name, key.namespace)
+	delete(b.expiries, key)
+	delete(b.lifetimes, key)
+	delete(b.intercepts, key)
+	delete(b.weights, key)
+	delete(b.selectors, key)
+	b.publish(true)
+	b.mutex.Unlock()
+	b.session.emit(EventInterceptRemoved, key.namespace+"/"+key.name+" (expired)")
+}
+
+func (b *kubernetesBridge) release(namespace, name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := serviceKey{namespace, name}
+	if _, ok := b.intercepts[key]; !ok {
+		return fmt.Errorf("service %s.%s is not intercepted", name, namespace)
+	}
+	delete(b.intercepts, key)
+	delete(b.weights, key)
+	delete(b.selectors, key)
+	if timer, ok := b.expiries[key]; ok {
+		timer.Stop()
+		delete(b.expiries, key)
+		delete(b.lifetimes, key)
+	}
+	b.publish(true)
+	return nil
+}
+
+// weigh routes percent of the connections to an intercepted service to
+// its local port, and the rest to the cluster.
+func (b *kubernetesBridge) weigh(namespace, name string, percent int) error {
+	return b.resplit(serviceKey{namespace, name}, func(key serviceKey) {
+		if percent >= 100 {
+			delete(b.weights, key)
+		} else {
+			b.weights[key] = percent
+		}
+	})
+}
+
+// A selector is the header, and its value, of the requests that an
+// intercept routes locally.
+type selector struct {
+	header, value string
+}
+
+// selectBy routes the connections to an intercepted service whose
+// first request carries the header of sel to its local port, and the
+// rest to the cluster. An empty selector goes back to the weight, if
+// any.
+func (b *kubernetesBridge) selectBy(namespace, name string, sel selector) error {
+	return b.resplit(serviceKey{namespace, name}, func(key serviceKey) {
+		if sel.header == "" {
+			delete(b.selectors, key)
+		} else {
+			b.selectors[key] = sel
+		}
+	})
+}
+
+// splitting is whether the proxy splits up the connections to an
+// intercepted service, rather than the firewall routing them all
+// locally. The caller holds the mutex.
+func (b *kubernetesBridge) splitting(key serviceKey) bool {
+	_, weighted := b.weights[key]
+	_, selected := b.selectors[key]
+	return weighted || selected
+}
+
+// resplit changes how the connections to an intercepted service are
+// split up.
+func (b *kubernetesBridge) resplit(key serviceKey, change func(serviceKey)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.intercepts[key]; !ok {
+		return fmt.Errorf("service %s.%s is not intercepted", key.name, key.namespace)
+	}
+	before := b.splitting(key)
+	change(key)
+	// moving from the intercepts table to the cluster one releases
+	b.publish(!before && b.splitting(key))
+	return nil
+}
+
+// interceptWeights returns the percentages of weighted intercepts, by
+// "namespace/service".
+func (b *kubernetesBridge) interceptWeights() map[string]int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	result := make(map[string]int, len(b.weights))
+	for key, percent := range b.weights {
+		result[key.namespace+"/"+key.name] = percent
+	}
+	return result
+}
+
+// interceptSelectors returns the headers, "name: value", of intercepts
+// that route by header, by "namespace/service".
+func (b *kubernetesBridge) interceptSelectors() map[string]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	result := make(map[string]string, len(b.selectors))
+	for key, sel := range b.selectors {
+		result[key.namespace+"/"+key.name] = sel.header + ": " + sel.value
+	}
+	return result
+}
+
+// interceptSetups lists the intercepts, sorted by service.
+func (b *kubernetesBridge) interceptSetups() (result []InterceptSetup) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, port := range b.intercepts {
+		i := InterceptSetup{Namespace: key.namespace, Service: key.name, Port: port}
+		if ttl, ok := b.lifetimes[key]; ok {
+			i.TTL = ttl.String()
+		}
+		result = append(result, i)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Service < result[j].Service
+	})
+	return
+}
+
+// stop keeps intercepts from expiring once the bridge is shut down.
+func (b *kubernetesBridge) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, timer := range b.expiries {
+		timer.Stop()
+		delete(b.expiries, key)
+	}
+}
+
+// targetPort returns the port that the service sends traffic for port
+// to, which is where a local stand in for the service would listen.
+// Named target ports refer to the pods and can't be resolved from the
+// service, so they map to the service port.
+func targetPort(svc k8s.Resource, port int) (int, error) {
+	ports, _ := svc.Spec()["ports"].([]interface{})
+	for _, p := range ports {
+		p, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if n, ok := number(p["port"]); !ok || n != port {
+			continue
+		}
+		if protocol, ok := p["protocol"].(string); ok && protocol != "TCP" {
+			return 0, fmt.Errorf("port %d of %s.%s is %s, only TCP can be intercepted", port, svc.Name(), svc.Namespace(), protocol)
+		}
+		if target, ok := number(p["targetPort"]); ok {
+			return target, nil
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("service %s.%s has no port %d", svc.Name(), svc.Namespace(), port)
+}
+
+func number(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	default:
+		return 0, false
+	}
+}
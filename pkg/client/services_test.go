@@ -0,0 +1,166 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+)
+
+func TestTargetPort(t *testing.T) {
+	svc := k8s.Resource{
+		"metadata": map[string]interface{}{"name": "web", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"port": int64(80), "targetPort": int64(8080), "protocol": "TCP"},
+				map[string]interface{}{"port": int64(443), "targetPort": "https", "protocol": "TCP"},
+				map[string]interface{}{"port": int64(53), "protocol": "UDP"},
+			},
+		},
+	}
+	for port, expected := range map[int]int{80: 8080, 443: 443} {
+		if actual, err := targetPort(svc, port); err != nil || actual != expected {
+			t.Errorf("port %d: expected %d, got %d (%v)", port, expected, actual, err)
+		}
+	}
+	for _, port := range []int{53, 8000} {
+		if _, err := targetPort(svc, port); err == nil {
+			t.Errorf("port %d: expected an error", port)
+		}
+	}
+}
+
+func TestRemap(t *testing.T) {
+	r, err := newRemapper("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ip := range []string{"10.96.0.10", "10.96.0.11"} {
+		expected := []string{"198.18.0.1", "198.18.0.2"}[i]
+		if actual, err := r.virtual(ip); err != nil || actual != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", ip, expected, actual, err)
+		}
+		if again, _ := r.virtual(ip); again != expected {
+			t.Errorf("%s: expected the same address again, got %s", ip, again)
+		}
+	}
+	if _, err := r.virtual("10.96.0.12"); err == nil {
+		t.Errorf("expected the range to be exhausted")
+	}
+}
+
+func TestInterceptExpiry(t *testing.T) {
+	api := &recorder{}
+	s := &Session{api: &http.Client{Transport: api}, proxyPort: 1234}
+	b := newKubernetesBridge(s, k8s.Network{Domain: "cluster.local"}, nil)
+	web := service("web", "10.96.0.10")
+	web.Spec()["ports"] = []interface{}{map[string]interface{}{"port": int64(80)}}
+	b.update([]k8s.Resource{web})
+
+	if _, err := b.intercept("default", "web", 80, 0); err != nil {
+		t.Fatal(err)
+	}
+	// intercepting again replaces the lifetime
+	if _, err := b.intercept("default", "web", 80, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	b.mutex.Lock()
+	_, intercepted := b.intercepts[serviceKey{"default", "web"}]
+	b.mutex.Unlock()
+	if intercepted {
+		t.Errorf("expected the intercept to expire")
+	}
+	if err := b.release("default", "web"); err == nil {
+		t.Errorf("expected an expired intercept to be gone")
+	}
+}
+
+func TestRemapRestore(t *testing.T) {
+	r, err := newRemapper("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.restore(map[string]string{"10.96.0.10": "198.18.0.2", "10.96.0.11": "192.0.2.1"})
+	if v, _ := r.virtual("10.96.0.10"); v != "198.18.0.2" {
+		t.Errorf("expected the cached address, got %s", v)
+	}
+	// out of range addresses are assigned afresh, after the cached
+	// ones
+	if _, err := r.virtual("10.96.0.11"); err == nil {
+		t.Errorf("expected the range to be exhausted")
+	}
+}
+
+func TestInterceptWeights(t *testing.T) {
+	api := &recorder{}
+	s := &Session{api: &http.Client{Transport: api}, proxyPort: 1234}
+	b := newKubernetesBridge(s, k8s.Network{Domain: "cluster.local"}, nil)
+	web := service("web", "10.96.0.10")
+	web.Spec()["ports"] = []interface{}{map[string]interface{}{"port": int64(80)}}
+	b.update([]k8s.Resource{web})
+
+	if err := b.weigh("default", "web", 10); err == nil {
+		t.Error("expected an error weighing a service that isn't intercepted")
+	}
+	if _, err := b.intercept("default", "web", 80, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.weigh("default", "web", 10); err != nil {
+		t.Fatal(err)
+	}
+	if w := b.interceptWeights(); w["default/web"] != 10 || len(w) != 1 {
+		t.Errorf("weights %v", w)
+	}
+	// all of them is the usual intercept
+	b.weigh("default", "web", 100)
+	if w := b.interceptWeights(); len(w) != 0 {
+		t.Errorf("weights %v", w)
+	}
+	b.weigh("default", "web", 0)
+	if err := b.release("default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if w := b.interceptWeights(); len(w) != 0 {
+		t.Errorf("released, but weights %v", w)
+	}
+}
+
+func TestInterceptSelectors(t *testing.T) {
+	api := &recorder{}
+	s := &Session{api: &http.Client{Transport: api}, proxyPort: 1234}
+	b := newKubernetesBridge(s, k8s.Network{Domain: "cluster.local"}, nil)
+	web := service("web", "10.96.0.10")
+	web.Spec()["ports"] = []interface{}{map[string]interface{}{"port": int64(80)}}
+	b.update([]k8s.Resource{web})
+
+	alice := selector{"X-Teleproxy-User", "alice"}
+	if err := b.selectBy("default", "web", alice); err == nil {
+		t.Error("expected an error selecting for a service that isn't intercepted")
+	}
+	if _, err := b.intercept("default", "web", 80, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.selectBy("default", "web", alice); err != nil {
+		t.Fatal(err)
+	}
+	if sel := b.interceptSelectors(); sel["default/web"] != "X-Teleproxy-User: alice" || len(sel) != 1 {
+		t.Errorf("selectors %v", sel)
+	}
+	b.weigh("default", "web", 10)
+	b.selectBy("default", "web", selector{})
+	if sel := b.interceptSelectors(); len(sel) != 0 {
+		t.Errorf("selectors %v", sel)
+	}
+	if !b.splitting(serviceKey{"default", "web"}) {
+		t.Error("the weight should still split it")
+	}
+	b.selectBy("default", "web", alice)
+	if err := b.release("default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if sel := b.interceptSelectors(); len(sel) != 0 {
+		t.Errorf("released, but selectors %v", sel)
+	}
+}
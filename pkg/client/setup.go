@@ -0,0 +1,199 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A Setup is what a session intercepts and routes, as opposed to how
+// it goes about it on this particular host, so that a teammate can
+// reproduce it with Apply.
+type Setup struct {
+	// Context and Namespace are those of the cluster.
+	Context   string `yaml:"context,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	// NeverProxy, IncludeNetworks, and ExcludeNetworks are as in
+	// Options.
+	NeverProxy      []string         `yaml:"never_proxy,omitempty"`
+	IncludeNetworks []string         `yaml:"include_networks,omitempty"`
+	ExcludeNetworks []string         `yaml:"exclude_networks,omitempty"`
+	Intercepts      []InterceptSetup `yaml:"intercepts,omitempty"`
+	// Tables are the intercepts added with AddIntercept, e.g. to
+	// point names somewhere other than where dns would.
+	Tables []Intercept `yaml:"tables,omitempty"`
+}
+
+// An InterceptSetup is an intercept of a service, as made by
+// InterceptServiceFor.
+type InterceptSetup struct {
+	Namespace string `yaml:"namespace" json:"namespace"`
+	Service   string `yaml:"service" json:"service"`
+	Port      int    `yaml:"port" json:"port"`
+	// TTL is the lifetime the intercept was made with, e.g. "1h",
+	// if it expires.
+	TTL string `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+}
+
+// ParseSetup reads a Setup written by Marshal.
+func ParseSetup(data []byte) (setup Setup, err error) {
+	err = yaml.UnmarshalStrict(data, &setup)
+	if err != nil {
+		return
+	}
+	for _, i := range setup.Intercepts {
+		if i.Namespace == "" || i.Service == "" {
+			return setup, fmt.Errorf("intercept of %s.%s: namespace and service are required", i.Service, i.Namespace)
+		}
+		if i.TTL != "" {
+			if _, err := time.ParseDuration(i.TTL); err != nil {
+				return setup, fmt.Errorf("intercept of %s.%s: %v", i.Service, i.Namespace, err)
+			}
+		}
+	}
+	for _, table := range setup.Tables {
+		if table.Name == "" {
+			return setup, errors.New("tables need names")
+		}
+	}
+	return
+}
+
+// Marshal writes the setup as yaml.
+func (setup Setup) Marshal() ([]byte, error) {
+	return yaml.Marshal(setup)
+}
+
+// Options returns opts with the cluster and networks of the setup, for
+// starting a session to Apply it to.
+func (setup Setup) Options(opts Options) Options {
+	opts.Context = setup.Context
+	opts.Namespace = setup.Namespace
+	opts.NeverProxy = setup.NeverProxy
+	opts.IncludeNetworks = setup.IncludeNetworks
+	opts.ExcludeNetworks = setup.ExcludeNetworks
+	return opts
+}
+
+// Setup returns what the session intercepts and routes.
+func (s *Session) Setup() Setup {
+	setup := Setup{
+		Context:         s.kubeContext,
+		Namespace:       s.kubeNamespace,
+		NeverProxy:      s.opts.NeverProxy,
+		IncludeNetworks: s.opts.IncludeNetworks,
+		ExcludeNetworks: s.opts.ExcludeNetworks,
+	}
+	if s.kubernetes != nil {
+		setup.Intercepts = s.kubernetes.interceptSetups()
+	}
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+	for _, name := range s.tableOrder {
+		setup.Tables = append(setup.Tables, s.tables[name])
+	}
+	return setup
+}
+
+// Apply adds the tables and intercepts of setup to the session. The
+// cluster and networks can't change while the session runs, so if
+// they differ nothing is applied. Applying the same setup twice is
+// harmless.
+func (s *Session) Apply(setup Setup) error {
+	running := s.Setup()
+	for _, field := range []struct {
+		name       string
+		setup, ran interface{}
+	}{
+		{"context", setup.Context, running.Context},
+		{"namespace", setup.Namespace, running.Namespace},
+		{"never_proxy", setup.NeverProxy, running.NeverProxy},
+		{"include_networks", setup.IncludeNetworks, running.IncludeNetworks},
+		{"exclude_networks", setup.ExcludeNetworks, running.ExcludeNetworks},
+	} {
+		if !same(field.setup, field.ran) && reflect.ValueOf(field.setup).Len() > 0 {
+			return fmt.Errorf("the %s of the setup is %v, not %v as for this session; restart teleproxy to apply it", field.name, field.setup, field.ran)
+		}
+	}
+
+	for _, table := range setup.Tables {
+		if err := s.AddIntercept(table); err != nil {
+			return err
+		}
+	}
+	for _, i := range setup.Intercepts {
+		// checked by ParseSetup
+		ttl, _ := time.ParseDuration(i.TTL)
+		if i.TTL == "" {
+			ttl = s.opts.InterceptTTL
+		}
+		local, err := s.InterceptServiceFor(i.Namespace, i.Service, i.Port, ttl)
+		if err != nil {
+			return errors.Wrapf(err, "intercepting %s.%s", i.Service, i.Namespace)
+		}
+		log.Printf("TPY: intercepted %s/%s:%d to %d", i.Namespace, i.Service, i.Port, local)
+	}
+	return nil
+}
+
+// same compares strings or slices of them, where nil is the same as
+// empty.
+func same(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b) || reflect.ValueOf(a).Len() == 0 && reflect.ValueOf(b).Len() == 0
+}
+
+// interceptPorts and setIntercept serve the intercepts of services on
+// the api, port 0 releasing one, and a nil ttl lasting for
+// Options.InterceptTTL.
+func (s *Session) interceptPorts() map[string]int {
+	result := make(map[string]int)
+	if s.kubernetes != nil {
+		for _, i := range s.kubernetes.interceptSetups() {
+			result[i.Namespace+"/"+i.Service] = i.Port
+		}
+	}
+	return result
+}
+
+func (s *Session) setIntercept(namespace, service string, port int, ttl *time.Duration) (int, error) {
+	if port == 0 {
+		return 0, s.ReleaseService(namespace, service)
+	}
+	if ttl == nil {
+		return s.InterceptService(namespace, service, port)
+	}
+	return s.InterceptServiceFor(namespace, service, port, *ttl)
+}
+
+// interceptWeights serves the weights of intercepts on the api.
+func (s *Session) interceptWeights() map[string]int {
+	if s.kubernetes == nil {
+		return map[string]int{}
+	}
+	return s.kubernetes.interceptWeights()
+}
+
+// interceptSelectors serves the headers of intercepts on the api.
+func (s *Session) interceptSelectors() map[string]string {
+	if s.kubernetes == nil {
+		return map[string]string{}
+	}
+	return s.kubernetes.interceptSelectors()
+}
+
+// exportSetup and applySetup serve Setup and Apply on the api.
+func (s *Session) exportSetup() ([]byte, error) {
+	return s.Setup().Marshal()
+}
+
+func (s *Session) applySetup(data []byte) error {
+	setup, err := ParseSetup(data)
+	if err != nil {
+		return err
+	}
+	return s.Apply(setup)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetupRoundTrip(t *testing.T) {
+	setup := Setup{
+		Context:    "staging",
+		Namespace:  "team-a",
+		NeverProxy: []string{"*.okta.com"},
+		Intercepts: []InterceptSetup{
+			{Namespace: "team-a", Service: "web", Port: 80, TTL: "1h0m0s"},
+			{Namespace: "team-a", Service: "worker", Port: 8080},
+		},
+		Tables: []Intercept{{Name: "overrides", Routes: []Route{{Name: "api.internal", Ip: "10.0.0.5"}}}},
+	}
+	data, err := setup.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "proto") || strings.Contains(string(data), "include_networks") {
+		t.Errorf("expected empty fields to be left out:\n%s", data)
+	}
+	parsed, err := ParseSetup(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, setup) {
+		t.Errorf("expected %+v, got %+v", setup, parsed)
+	}
+}
+
+func TestParseSetupErrors(t *testing.T) {
+	for _, data := range []string{
+		"contxt: staging\n",
+		"intercepts:\n- service: web\n  port: 80\n",
+		"intercepts:\n- namespace: a\n  service: web\n  ttl: forever\n",
+		"tables:\n- routes: []\n",
+	} {
+		if _, err := ParseSetup([]byte(data)); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+func TestApplyChecksCluster(t *testing.T) {
+	s := &Session{kubeContext: "staging", kubeNamespace: "default", opts: Options{NeverProxy: []string{"*.okta.com"}}}
+	for _, setup := range []Setup{
+		{Context: "prod"},
+		{Context: "staging", ExcludeNetworks: []string{"kind"}},
+		{NeverProxy: []string{"*.corp.example.com"}},
+	} {
+		if err := s.Apply(setup); err == nil || !strings.Contains(err.Error(), "restart") {
+			t.Errorf("expected %+v not to apply, got %v", setup, err)
+		}
+	}
+	// what the setup leaves out is whatever the session has
+	if err := s.Apply(Setup{Context: "staging", IncludeNetworks: []string{}}); err != nil {
+		t.Error(err)
+	}
+}
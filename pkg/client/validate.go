@@ -0,0 +1,310 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/datawire/teleproxy/pkg/k8s"
+
+	"github.com/datawire/teleproxy/internal/pkg/dns"
+	"github.com/datawire/teleproxy/internal/pkg/loopback"
+	"github.com/datawire/teleproxy/internal/pkg/ports"
+	"github.com/datawire/teleproxy/internal/pkg/wsl"
+)
+
+// A Problem is one thing wrong with Options, and what might fix it.
+type Problem struct {
+	Message    string
+	Suggestion string
+}
+
+func (p Problem) String() string {
+	if p.Suggestion == "" {
+		return p.Message
+	}
+	return p.Message + " (" + p.Suggestion + ")"
+}
+
+// Problems are everything wrong with Options, so that they can be
+// fixed in one go rather than one per run.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	if len(p) == 1 {
+		return p[0].String()
+	}
+	lines := []string{fmt.Sprintf("%d problems with the options:", len(p))}
+	for _, problem := range p {
+		lines = append(lines, "  "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Problems) add(suggestion, message string, args ...interface{}) {
+	*p = append(*p, Problem{fmt.Sprintf(message, args...), suggestion})
+}
+
+// Validate reports everything wrong with opts that can be told without
+// starting a session, as an InvalidOptions Failure of Problems: modes
+// that can't be combined, or aren't supported here, malformed or
+// overlapping ranges, ports out of range, and a context the kubeconfig
+// doesn't have. Connect validates opts before it starts anything, but a
+// caller may do so sooner. Fields left empty are fine, they select
+// their defaults.
+func (opts Options) Validate() error {
+	var p Problems
+
+	if opts.ExecPod != "" && (opts.Replicas > 1 || opts.AgentInstalled) {
+		p.add("drop the replicas or the exec pod", "tunneling through an exec pod and through teleproxy pods are mutually exclusive")
+	}
+	if opts.AgentTokenCmd != "" && opts.AgentIdentity != "" {
+		p.add("", "logging into the teleproxy pods with a token and with a certificate are mutually exclusive")
+	}
+	if (opts.AgentTokenCmd != "" || opts.AgentIdentity != "") && !opts.AgentInstalled {
+		p.add("install them with teleproxy manifest -agent-auth", "logging into the teleproxy pods requires installed ones")
+	}
+	if opts.AgentTLS && !opts.AgentInstalled {
+		p.add("install them with teleproxy manifest -agent-tls", "mutual TLS with the teleproxy pods requires installed ones")
+	}
+	if opts.UpstreamProxy != "" && len(opts.Bastion) > 0 {
+		p.add("", "an upstream proxy and a bastion are mutually exclusive")
+	}
+	for _, hop := range opts.Bastion {
+		if hop = strings.TrimSpace(hop); hop != "" && !validHop.MatchString(hop) {
+			p.add("", "bastion hop %q is not [user@]host[:port]", hop)
+		}
+	}
+	if opts.Upstream != "" && opts.Bridge {
+		p.add("bridge in the upstream teleproxy instead", "mirroring an upstream teleproxy and bridging are mutually exclusive")
+	}
+	if len(opts.Loopback) > 0 && !opts.Bridge {
+		p.add("bridge too", "binding services to loopback addresses requires bridging")
+	}
+	if opts.WindowsDNS && !opts.PublishWindows {
+		p.add("publish to windows too", "resolving names for windows requires publishing to it")
+	}
+	if opts.WindowsDNS && opts.HostsDNS {
+		p.add("", "resolving names for windows takes the dns server, which publishing names in the hosts file doesn't run")
+	}
+	if len(opts.WindowsPortProxy) > 0 && !opts.Bridge {
+		p.add("bridge too", "giving services to windows requires bridging")
+	}
+	if opts.Advertise != "" && !opts.Bridge {
+		p.add("bridge too", "advertising what is intercepted requires bridging")
+	}
+	if opts.Observe {
+		if !opts.Intercept {
+			p.add("intercept too", "observing stands in for intercepting")
+		}
+		for _, x := range []struct {
+			set  bool
+			what string
+		}{
+			{opts.HostsDNS, "publish names in the hosts file"},
+			{len(opts.Loopback) > 0, "bind services to loopback addresses"},
+			{opts.ProcessScoped, "put processes in a cgroup"},
+			{opts.PublishWindows || len(opts.WindowsPortProxy) > 0, "publish to windows"},
+			{opts.DockerVMImage != "", "start the docker vm shim"},
+		} {
+			if x.set {
+				p.add("", "observing changes nothing on this host, so it can't %s", x.what)
+			}
+		}
+	}
+	if len(opts.CacheHosts) > 0 && len(opts.HTTPPorts) == 0 {
+		p.add("list the http ports, e.g. 80", "caching http responses requires the ports to parse http on")
+	}
+
+	if len(opts.RouteCIDRs) > 0 && runtime.GOOS != "darwin" {
+		p.add("leave routing to the firewall", "routing cluster ranges through a tunnel device is only supported on macOS")
+	}
+	if opts.ProcessScoped && runtime.GOOS != "linux" {
+		p.add("intercept the whole host instead", "intercepting only some processes is only supported on linux")
+	}
+	if opts.RaceDirect && runtime.GOOS != "linux" {
+		p.add("", "racing direct dials against the tunnel is only supported on linux")
+	}
+	if (opts.PublishWindows || len(opts.WindowsPortProxy) > 0) && !wsl.Detect() {
+		p.add("", "publishing to windows requires WSL2")
+	}
+
+	switch opts.Remap {
+	case "", "never", "auto", "always":
+	default:
+		p.add(didYouMean(opts.Remap, []string{"never", "auto", "always"}), "remap must be never, auto, or always, not %q", opts.Remap)
+	}
+	virtual := opts.VirtualCIDR
+	if virtual == "" {
+		virtual = DefaultVirtualCIDR
+	}
+	if _, err := newRemapper(virtual); err != nil {
+		p.add("", "virtual range: %v", err)
+	}
+	loopbackCIDR := opts.LoopbackCIDR
+	if loopbackCIDR == "" {
+		loopbackCIDR = DefaultLoopbackCIDR
+	}
+	if _, err := loopback.NewBinder(loopbackCIDR, opts.HostsFile, nil); err != nil {
+		p.add("e.g. "+DefaultLoopbackCIDR, "loopback range: %v", err)
+	}
+	if opts.ServiceCIDR != "" {
+		if _, _, err := net.ParseCIDR(opts.ServiceCIDR); err != nil {
+			p.add("or leave it to be detected", "service range: %v", err)
+		} else if opts.Remap != "" && opts.Remap != "never" && overlap(virtual, opts.ServiceCIDR) {
+			p.add("pick a virtual range clear of it", "virtual range %s overlaps the service range %s it stands in for", virtual, opts.ServiceCIDR)
+		}
+	}
+	var routes []string
+	for _, cidr := range opts.RouteCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			p.add("", "route range: %v", err)
+			continue
+		}
+		for _, other := range routes {
+			if overlap(cidr, other) {
+				p.add("list each range once", "route ranges %s and %s overlap", other, cidr)
+			}
+		}
+		routes = append(routes, cidr)
+	}
+
+	for _, patterns := range []struct {
+		what string
+		list []string
+	}{
+		{"hosts name", opts.HostsNames},
+		{"loopback", opts.Loopback},
+		{"windows portproxy", opts.WindowsPortProxy},
+	} {
+		for _, pattern := range patterns.list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				p.add("", "%s pattern %q: %v", patterns.what, pattern, err)
+			}
+		}
+	}
+
+	if opts.Socks != "" {
+		if _, port, err := net.SplitHostPort(opts.Socks); err != nil {
+			p.add("e.g. "+DefaultSocks, "socks address: %v", err)
+		} else if !validPort(port) {
+			p.add("e.g. "+DefaultSocks, "socks address %s has no valid port", opts.Socks)
+		}
+	}
+	if opts.Advertise != "" {
+		if _, port, err := net.SplitHostPort(opts.Advertise); err != nil {
+			p.add("e.g. :7979", "advertise address: %v", err)
+		} else if port != "0" && !validPort(port) {
+			p.add("e.g. :7979", "advertise address %s has no valid port", opts.Advertise)
+		}
+	}
+	for _, list := range []struct {
+		what  string
+		ports []int
+	}{{"http", opts.HTTPPorts}, {"tls", opts.TLSPorts}} {
+		for _, port := range list.ports {
+			if !validPort(strconv.Itoa(port)) {
+				p.add("ports are from 1 to 65535", "%s port %d is not a port", list.what, port)
+			}
+		}
+	}
+	if _, err := ports.ParseRange(opts.PortRange); err != nil {
+		p.add("e.g. 20000-20100", "port range: %v", err)
+	}
+	if opts.TunMTU < 0 {
+		p.add("or leave it to the default", "tun mtu %d is negative", opts.TunMTU)
+	}
+	if _, err := dns.ParseRewrites(opts.DNSRewrites); err != nil {
+		p.add("e.g. dev.internal=default.svc.cluster.local", "dns rewrite: %v", err)
+	}
+	if opts.DNSCorefile != "" {
+		if _, err := dns.LoadCorefile(opts.DNSCorefile); err != nil {
+			p.add("", "dns corefile %s: %v", opts.DNSCorefile, err)
+		}
+	}
+	if opts.DNSClientRate < 0 {
+		p.add("or leave it unlimited", "dns client rate %d is negative", opts.DNSClientRate)
+	}
+	if opts.WarmForwards < 0 {
+		p.add("", "%d warm forwards is negative", opts.WarmForwards)
+	}
+	if opts.InterceptTTL < 0 {
+		p.add("or leave intercepts to last", "intercept lifetime %v is negative", opts.InterceptTTL)
+	}
+
+	if opts.Context != "" && (opts.Bridge || opts.TunnelOnly) {
+		// a kubeconfig that doesn't load is reported when the session
+		// starts, as KubeconfigInvalid
+		if info, err := k8s.NewKubeInfo(opts.Kubeconfig, "", ""); err == nil {
+			if contexts, err := info.Contexts(); err == nil && !contains(contexts, opts.Context) {
+				suggestion := didYouMean(opts.Context, contexts)
+				if suggestion == "" && len(contexts) > 0 {
+					suggestion = "it has " + strings.Join(contexts, ", ")
+				}
+				p.add(suggestion, "context %q is not in the kubeconfig", opts.Context)
+			}
+		}
+	}
+
+	if len(p) > 0 {
+		return InvalidOptions(p)
+	}
+	return nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// overlap is whether two ranges, both valid, share addresses.
+func overlap(a, b string) bool {
+	_, x, _ := net.ParseCIDR(a)
+	_, y, _ := net.ParseCIDR(b)
+	return x.Contains(y.IP) || y.Contains(x.IP)
+}
+
+// didYouMean suggests the candidate closest to s, if one is close
+// enough to be a typo of it.
+func didYouMean(s string, candidates []string) string {
+	best, distance := "", len(s)/2+1
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < distance {
+			best, distance = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("did you mean %q?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := prev + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			prev, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
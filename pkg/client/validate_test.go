@@ -0,0 +1,70 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if err := (Options{Intercept: true, Bridge: true}).Validate(); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+	err := Options{
+		Upstream:      "http://localhost:8888",
+		Bridge:        true,
+		Remap:         "alwyas",
+		ServiceCIDR:   "198.18.0.0/16",
+		HTTPPorts:     []int{80, 70000},
+		Socks:         "localhost",
+		PortRange:     "20100-20000",
+		LoopbackCIDR:  "10.0.0.0/24",
+		WindowsDNS:    true,
+		Bastion:       []string{"jump.example.com", "-oProxyCommand=sh"},
+		AgentIdentity: "id_ed25519",
+		AgentTLS:      true,
+	}.Validate()
+	f := FailureOf(err)
+	if f == nil || f.Code != ExitInvalidOptions {
+		t.Fatalf("expected invalid options, got %v", err)
+	}
+	problems := f.Err.(Problems)
+	for _, expected := range []string{
+		"mirroring an upstream teleproxy and bridging are mutually exclusive",
+		`remap must be never, auto, or always, not "alwyas" (did you mean "always"?)`,
+		"virtual range 198.18.0.0/15 overlaps the service range 198.18.0.0/16",
+		"http port 70000 is not a port",
+		"socks address:",
+		"port range:",
+		"loopback range: 10.0.0.0/24 is not an ipv4 loopback range",
+		"resolving names for windows requires publishing to it",
+		`bastion hop "-oProxyCommand=sh" is not [user@]host[:port]`,
+		"logging into the teleproxy pods requires installed ones",
+		"mutual TLS with the teleproxy pods requires installed ones",
+	} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem.String(), expected)
+		}
+		if !found {
+			t.Errorf("expected %q among:\n%v", expected, err)
+		}
+	}
+	if len(problems) != 11 {
+		t.Errorf("expected 11 problems, got:\n%v", err)
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	contexts := []string{"kind-kind", "staging", "production"}
+	for s, expected := range map[string]string{
+		"stagign":    `did you mean "staging"?`,
+		"kind":       "",
+		"prodution":  `did you mean "production"?`,
+		"elsewhere":  "",
+		"kind-kind2": `did you mean "kind-kind"?`,
+	} {
+		if actual := didYouMean(s, contexts); actual != expected {
+			t.Errorf("%s: expected %q, got %q", s, expected, actual)
+		}
+	}
+}
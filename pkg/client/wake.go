@@ -0,0 +1,73 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// how often the clocks are compared
+	wakeCheck = 5 * time.Second
+	// how much further the wall clock must have moved than the
+	// monotonic one to count as a sleep, rather than, say, ntp
+	// stepping the clock
+	wakeSlack = 30 * time.Second
+	// how long after waking the tunnel is given to come back before
+	// its loss is reported again
+	wakeGrace = time.Minute
+)
+
+// watchWake invokes woke whenever the machine wakes from sleep, until
+// stop is closed. The monotonic clock stops while the machine sleeps
+// (on macOS and linux alike) and the wall clock doesn't, so a sleep
+// shows up as the two drifting apart, which needs neither IOKit nor
+// logind.
+func watchWake(stop chan struct{}, woke func(slept time.Duration)) {
+	ticker := time.NewTicker(wakeCheck)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		now := time.Now()
+		if slept := asleep(last, now); slept > wakeSlack {
+			woke(slept)
+		}
+		last = now
+	}
+}
+
+// asleep returns how long the machine slept between then and now.
+func asleep(then, now time.Time) time.Duration {
+	// Round(0) strips the monotonic reading, leaving the wall clock
+	return now.Round(0).Sub(then.Round(0)) - now.Sub(then)
+}
+
+// reconnectOnWake reconnects the tunnel whenever the machine wakes
+// from sleep, until stop is closed. The tunnel is dead by then, but
+// would otherwise only be found out as connections through it time
+// out. Until it is back, its loss isn't reported and connections that
+// fail to get through aren't logged one by one.
+func (s *Session) reconnectOnWake(stop chan struct{}, reconnect func()) {
+	go watchWake(stop, func(slept time.Duration) {
+		log.Printf("BRG: woke up after %s asleep, reconnecting", slept.Round(time.Second))
+		s.wakeMutex.Lock()
+		s.woke = time.Now()
+		s.wakeMutex.Unlock()
+		if s.proxy != nil {
+			s.proxy.Hush(wakeGrace)
+		}
+		reconnect()
+	})
+}
+
+// waking reports whether the machine woke recently enough that the
+// tunnel may still be reconnecting.
+func (s *Session) waking() bool {
+	s.wakeMutex.Lock()
+	defer s.wakeMutex.Unlock()
+	return !s.woke.IsZero() && time.Since(s.woke) < wakeGrace
+}
@@ -0,0 +1,207 @@
+// Package dtest provides disposable kubernetes clusters for tests.
+//
+// Each Cluster is a k3s server running in a docker container next to
+// a private docker registry, all on a docker network of their own.
+// Names and ports are unique per cluster, so tests (and packages) can
+// bring up clusters in parallel:
+//
+//	func TestSomething(t *testing.T) {
+//		t.Parallel()
+//		cluster := dtest.MustStart(t)
+//		defer cluster.Stop()
+//		... use cluster.Kubeconfig and cluster.Registry ...
+//	}
+package dtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+var (
+	// K3sImage is the k3s server image clusters run.
+	K3sImage = "rancher/k3s:v0.10.2"
+	// RegistryImage is the image the private registries run.
+	RegistryImage = "registry:2"
+	// Timeout bounds how long Start waits for a cluster to be
+	// usable.
+	Timeout = 3 * time.Minute
+)
+
+// A Cluster is a running k3s cluster.
+type Cluster struct {
+	// Name is unique to this cluster and is used to name its
+	// containers and network.
+	Name string
+	// Kubeconfig is the path of a kubeconfig file for the
+	// cluster.
+	Kubeconfig string
+	// Registry is the host:port of a registry that both the host
+	// and the cluster can use, e.g. for images built by the test.
+	Registry string
+
+	dir string
+}
+
+var counter int64
+
+// UniqueName returns a name that is unique across processes and
+// across calls in this process, suitable for docker objects.
+func UniqueName(prefix string) string {
+	var buf [3]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s-%d-%d-%s", prefix, os.Getpid(), atomic.AddInt64(&counter, 1), hex.EncodeToString(buf[:]))
+}
+
+// FreePort returns a localhost port that is currently unused.
+func FreePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (c *Cluster) log(line string, args ...interface{}) {
+	log.Printf("DTS: %s: "+line, append([]interface{}{c.Name}, args...)...)
+}
+
+func (c *Cluster) docker(args ...string) (string, error) {
+	return tpu.CmdLogf(append([]string{"docker"}, args...), c.log)
+}
+
+// MustStart is like Start, but fails the test on error.
+func MustStart(t testing.TB) *Cluster {
+	c, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Start brings up a new cluster and waits for it to be usable. The
+// caller must Stop it.
+func Start() (c *Cluster, err error) {
+	c = &Cluster{Name: UniqueName("dtest")}
+	defer func() {
+		if err != nil {
+			c.Stop()
+			c = nil
+		}
+	}()
+
+	c.dir, err = ioutil.TempDir("", c.Name)
+	if err != nil {
+		return
+	}
+
+	apiPort, err := FreePort()
+	if err != nil {
+		return
+	}
+	registryPort, err := FreePort()
+	if err != nil {
+		return
+	}
+	c.Registry = "localhost:" + strconv.Itoa(registryPort)
+
+	if _, err = c.docker("network", "create", c.Name); err != nil {
+		return
+	}
+	if _, err = c.docker("run", "--detach", "--rm",
+		"--name", c.registry(),
+		"--network", c.Name,
+		"--publish", "127.0.0.1:"+strconv.Itoa(registryPort)+":5000",
+		RegistryImage); err != nil {
+		return
+	}
+
+	// let the cluster pull the images we push to the registry
+	// using the same name we push them with
+	registries := filepath.Join(c.dir, "registries.yaml")
+	err = ioutil.WriteFile(registries, []byte(fmt.Sprintf(`mirrors:
+  %q:
+    endpoint:
+    - "http://%s:5000"
+`, c.Registry, c.registry())), 0644)
+	if err != nil {
+		return
+	}
+	if _, err = c.docker("run", "--detach", "--rm", "--privileged",
+		"--name", c.Name,
+		"--network", c.Name,
+		"--publish", "127.0.0.1:"+strconv.Itoa(apiPort)+":6443",
+		"--volume", registries+":/etc/rancher/k3s/registries.yaml",
+		K3sImage, "server", "--https-listen-port", "6443"); err != nil {
+		return
+	}
+
+	err = c.waitFor(func() error {
+		return c.writeKubeconfig(apiPort)
+	})
+	if err != nil {
+		return
+	}
+	// pods can't be created until the default service account
+	// exists
+	err = c.waitFor(func() error {
+		_, err := tpu.CmdLogf([]string{"kubectl", "--kubeconfig", c.Kubeconfig, "get", "serviceaccount", "default"}, c.log)
+		return err
+	})
+	return
+}
+
+func (c *Cluster) registry() string {
+	return c.Name + "-registry"
+}
+
+var server = regexp.MustCompile(`server: https://[^\s]+`)
+
+func (c *Cluster) writeKubeconfig(apiPort int) error {
+	output, err := tpu.Cmd("docker", "exec", c.Name, "cat", "/etc/rancher/k3s/k3s.yaml")
+	if err != nil {
+		return err
+	}
+	kubeconfig := server.ReplaceAllString(output, "server: https://127.0.0.1:"+strconv.Itoa(apiPort))
+	path := filepath.Join(c.dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		return err
+	}
+	c.Kubeconfig = path
+	return nil
+}
+
+func (c *Cluster) waitFor(check func() error) error {
+	var err error
+	for start := time.Now(); time.Since(start) < Timeout; time.Sleep(time.Second) {
+		if err = check(); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: timed out: %v", c.Name, err)
+}
+
+// Stop removes the cluster and everything that was created for it.
+func (c *Cluster) Stop() {
+	c.docker("rm", "--force", c.Name, c.registry())
+	c.docker("network", "rm", c.Name)
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
@@ -0,0 +1,37 @@
+package dtest
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+func TestUniqueName(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		name := UniqueName("test")
+		if seen[name] {
+			t.Fatalf("duplicate name: %s", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cluster bring up in short mode")
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is required")
+	}
+	t.Parallel()
+
+	c := MustStart(t)
+	defer c.Stop()
+
+	_, err := tpu.Cmd("kubectl", "--kubeconfig", c.Kubeconfig, "get", "nodes")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -10,6 +10,7 @@ package k8s
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,6 +22,8 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/pkg/errors"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
 )
 
 // KubeInfo holds the data required to talk to a cluster
@@ -97,6 +100,36 @@ func (info *KubeInfo) GetRestConfig() (*rest.Config, error) {
 	return config, nil
 }
 
+// Contexts returns the names of the contexts of the kubeconfig, in
+// order.
+func (info *KubeInfo) Contexts() ([]string, error) {
+	config, err := info.clientConfig.RawConfig()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reachable reports whether the cluster answers, by asking it for its
+// version.
+func (info *KubeInfo) Reachable() error {
+	config, err := info.GetRestConfig()
+	if err != nil {
+		return err
+	}
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	_, err = disco.ServerVersion()
+	return err
+}
+
 // GetKubectl returns the arguments for a runnable kubectl command that talks to
 // the same cluster as the associated ClientConfig.
 func (info *KubeInfo) GetKubectl(args string) string {
@@ -109,10 +142,39 @@ func (info *KubeInfo) GetKubectl(args string) string {
 	return strings.Join(res[1:], " ") // Drop leading "kubectl" because reasons...
 }
 
+// CanI reports whether the current user may perform verb on resource
+// in namespace, as decided by a SelfSubjectAccessReview.
+func (info *KubeInfo) CanI(verb, resource, namespace string) (bool, error) {
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+info.GetKubectl(fmt.Sprintf("auth can-i %s %s --namespace %s", verb, resource, namespace)))
+	answer := strings.TrimSpace(output)
+	switch {
+	case answer == "yes":
+		return true, nil
+	case strings.HasPrefix(answer, "no"):
+		// kubectl exits non zero for "no"
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return false, fmt.Errorf("unexpected answer from kubectl auth can-i: %q", answer)
+	}
+}
+
+// BudgetVersion returns the group version the cluster serves pod
+// disruption budgets at, policy/v1 if it can't be asked.
+func (info *KubeInfo) BudgetVersion() string {
+	output, err := tpu.Cmd("sh", "-c", "kubectl "+info.GetKubectl("api-versions"))
+	if err != nil {
+		return budgetVersion(nil)
+	}
+	return budgetVersion(strings.Fields(output))
+}
+
 // Client is the top-level handle to the Kubernetes cluster.
 type Client struct {
 	config    *rest.Config
 	resources []*v1.APIResourceList
+	compat    Compatibility
 }
 
 // NewClient constructs a k8s.Client, optionally using a previously-constructed
@@ -136,16 +198,36 @@ func NewClient(info *KubeInfo) *Client {
 	}
 
 	resources, err := disco.ServerResources()
-	if err != nil {
+	var unavailable []string
+	if failed, ok := err.(*discovery.ErrGroupDiscoveryFailed); ok {
+		// e.g. an aggregated api whose server is down, which
+		// shouldn't keep the rest from being watched
+		for gv := range failed.Groups {
+			unavailable = append(unavailable, gv.String())
+		}
+		sort.Strings(unavailable)
+	} else if err != nil {
 		log.Fatal(err)
 	}
 
+	var version, minor string
+	if info, err := disco.ServerVersion(); err == nil {
+		version, minor = info.GitVersion, info.Minor
+	}
+
 	return &Client{
 		config:    config,
 		resources: resources,
+		compat:    compatibility(version, minor, resources, unavailable),
 	}
 }
 
+// Compatibility returns what version of kubernetes the cluster runs,
+// and which of the apis that matter to watching it serves.
+func (c *Client) Compatibility() Compatibility {
+	return c.compat
+}
+
 // ResourceType describes a Kubernetes resource type in a particular cluster.
 // See ResolveResourceType() for more information.
 //
@@ -165,22 +247,22 @@ type ResourceType struct {
 //
 // For example, with Kubernetes v1.10.5:
 //   "pod"        --> {Group: "",           Version: "v1",      Name: "pods",        Kind: "Pod",        Namespaced: true}
-//   "deployment" --> {Group: "extensions", Version: "v1beta1", Name: "deployments", Kind: "Deployment", Namespaced: true}
+//   "deployment" --> {Group: "apps",       Version: "v1",      Name: "deployments", Kind: "Deployment", Namespaced: true}
 //
-// Newer versions of Kubernetes might instead put "pod" in the "core"
-// group, or put "deployment" in apps/v1 instead of
-// extensions/v1beta1.  Because of discrepancies between different
-// clusters, it may be a good idea to use this even for internal
-// callers, rather than treating it purely as a UI concern.
+// Where several API groups or versions serve a resource type of the
+// same name, the most stable version wins, as kubernetes ranks them
+// (v1 over v1beta1 over v1alpha1), and then the first group. Older
+// clusters serve "deployment" from extensions/v1beta1 alone, and newer
+// ones "endpointslice" from discovery.k8s.io/v1 as well as v1beta1.
+// Because of discrepancies between different clusters, it may be a
+// good idea to use this even for internal callers, rather than
+// treating it purely as a UI concern.
 //
 // BUG(lukeshu): ResolveResourceType currently only takes the type name, it should
 // accept TYPE[[.VERSION].GROUP], like `kubectl`.
 //
-// BUG(lukeshu): ResolveResourceType currently returns the first
-// match.  In the event of multiple resource types with the same name
-// (multiple API groups, multiple versions), it should do something
-// more intelligent than that; it should at least pay attention to the
-// API group's PreferredVersion.
+// BUG(lukeshu): ResolveResourceType ranks versions by stability rather
+// than paying attention to the API group's PreferredVersion.
 //
 // Should be equivalent to
 // k8s.io/cli-runtime/pkg/genericclioptions/resource.Builder.mappingFor(),
@@ -191,6 +273,16 @@ func (c *Client) ResolveResourceType(resource string) ResourceType {
 	if resource == "" {
 		panic("empty resource string")
 	}
+	ri, ok := c.resolve(resource)
+	if !ok {
+		panic(fmt.Sprintf("unrecognized resource: %s", resource))
+	}
+	return ri
+}
+
+// resolve is ResolveResourceType, saying whether the cluster serves the
+// resource type rather than panicking.
+func (c *Client) resolve(resource string) (result ResourceType, ok bool) {
 	lresource := strings.ToLower(resource)
 	for _, rl := range c.resources {
 		for _, r := range rl.APIResources {
@@ -216,12 +308,15 @@ func (c *Client) ResolveResourceType(resource string) ResourceType {
 					default:
 						panic("unrecognized GroupVersion")
 					}
-					return ResourceType{group, version, r.Name, r.Kind, r.Namespaced}
+					if !ok || moreStable(version, result.Version) {
+						result, ok = ResourceType{group, version, r.Name, r.Kind, r.Namespaced}, true
+					}
+					break
 				}
 			}
 		}
 	}
-	panic(fmt.Sprintf("unrecognized resource: %s", resource))
+	return
 }
 
 // List calls ListNamespace(...) with the empty string as the namespace, which
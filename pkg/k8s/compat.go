@@ -0,0 +1,128 @@
+package k8s
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// oldestMinor is the oldest minor version of kubernetes 1 supported.
+// The client speaks 1.13, and decodes what servers three versions
+// older than that serve.
+const oldestMinor = 10
+
+// Compatibility is what version of kubernetes a cluster runs, and which
+// of the apis that matter to watching it serves.
+type Compatibility struct {
+	// Version is the version of the api server, e.g. v1.21.1, empty
+	// if it didn't say.
+	Version string
+	// Minor is the minor version of kubernetes 1, 0 if unknown.
+	Minor int
+	// EndpointSlices is the group version that endpoint slices are
+	// watched at: discovery.k8s.io/v1 from 1.21, v1beta1 before, or
+	// empty before 1.17, where there are only endpoints.
+	EndpointSlices string
+	// Unavailable lists the group versions of apis that discovery
+	// failed for, such as aggregated apis whose servers are down.
+	// They can't be watched, the rest can.
+	Unavailable []string
+	// services is whether the cluster serves services at all
+	services bool
+}
+
+// compatibility sizes up a cluster from its version and the resources
+// it serves.
+func compatibility(version, minor string, resources []*v1.APIResourceList, unavailable []string) Compatibility {
+	c := &Client{resources: resources}
+	result := Compatibility{Version: version, Unavailable: unavailable}
+	// e.g. "13+" on gke
+	result.Minor, _ = strconv.Atoi(strings.TrimRight(minor, "+"))
+	if ri, ok := c.resolve("endpointslices"); ok {
+		result.EndpointSlices = ri.Group + "/" + ri.Version
+	}
+	_, result.services = c.resolve("services")
+	return result
+}
+
+func (c Compatibility) String() string {
+	if c.Version == "" {
+		return "kubernetes of unknown version"
+	}
+	return "kubernetes " + c.Version
+}
+
+// Warnings says what of the cluster isn't supported, and what happens
+// instead, rather than leaving it to fail to decode later.
+func (c Compatibility) Warnings() []string {
+	var warnings []string
+	if c.Minor > 0 && c.Minor < oldestMinor {
+		warnings = append(warnings, fmt.Sprintf("%s is older than 1.%d, the oldest supported, what it serves may not decode", c, oldestMinor))
+	}
+	if !c.services {
+		warnings = append(warnings, fmt.Sprintf("%s serves no services, there is nothing to route", c))
+	}
+	if len(c.Unavailable) > 0 {
+		warnings = append(warnings, fmt.Sprintf("discovery failed for %s, which can't be watched, the rest can", strings.Join(c.Unavailable, ", ")))
+	}
+	return warnings
+}
+
+// kubeVersion is how api versions are written: v1, v2beta1, v1alpha1.
+var kubeVersion = regexp.MustCompile(`^v(\d+)(?:(alpha|beta)(\d+))?$`)
+
+// stability ranks api versions as kubernetes does: general availability
+// ahead of beta ahead of alpha, then by number, and versions unlike
+// those last.
+func stability(version string) [3]int {
+	m := kubeVersion.FindStringSubmatch(version)
+	if m == nil {
+		return [3]int{-1, 0, 0}
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[3])
+	switch m[2] {
+	case "alpha":
+		return [3]int{0, major, minor}
+	case "beta":
+		return [3]int{1, major, minor}
+	default:
+		return [3]int{2, major, 0}
+	}
+}
+
+// moreStable reports whether api version a ranks ahead of b.
+func moreStable(a, b string) bool {
+	x, y := stability(a), stability(b)
+	for i := range x {
+		if x[i] != y[i] {
+			return x[i] > y[i]
+		}
+	}
+	return false
+}
+
+// budgetVersion returns the group version to write pod disruption
+// budgets at for a cluster that serves apiVersions, as kubectl
+// api-versions lists them: policy/v1 from 1.21, which is also the
+// default, or policy/v1beta1 on older clusters, since 1.25 serves
+// only policy/v1.
+func budgetVersion(apiVersions []string) string {
+	best := ""
+	for _, gv := range apiVersions {
+		version := strings.TrimPrefix(gv, "policy/")
+		if version == gv || stability(version)[0] < 1 {
+			continue
+		}
+		if best == "" || moreStable(version, best) {
+			best = version
+		}
+	}
+	if best == "" {
+		return "policy/v1"
+	}
+	return "policy/" + best
+}
@@ -0,0 +1,78 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func served(groupVersion string, names ...string) *v1.APIResourceList {
+	list := &v1.APIResourceList{GroupVersion: groupVersion}
+	for _, name := range names {
+		list.APIResources = append(list.APIResources, v1.APIResource{Name: name, Namespaced: true})
+	}
+	return list
+}
+
+func TestCompatibility(t *testing.T) {
+	resources := []*v1.APIResourceList{
+		served("v1", "services", "endpoints"),
+		served("extensions/v1beta1", "deployments"),
+		served("apps/v1beta2", "deployments"),
+		served("apps/v1", "deployments"),
+		served("discovery.k8s.io/v1beta1", "endpointslices"),
+		served("discovery.k8s.io/v1", "endpointslices"),
+	}
+	c := &Client{resources: resources}
+	if ri := c.ResolveResourceType("deployments"); ri.Group != "apps" || ri.Version != "v1" {
+		t.Errorf("expected apps/v1 deployments, got %s/%s", ri.Group, ri.Version)
+	}
+	if _, ok := c.resolve("ingresses"); ok {
+		t.Errorf("expected ingresses not to be served")
+	}
+
+	compat := compatibility("v1.21.1", "21+", resources, nil)
+	if compat.Minor != 21 || compat.EndpointSlices != "discovery.k8s.io/v1" {
+		t.Errorf("expected 1.21 with discovery.k8s.io/v1 endpoint slices, got %+v", compat)
+	}
+	if warnings := compat.Warnings(); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %q", warnings)
+	}
+
+	old := compatibility("v1.8.4", "8", resources[:2], []string{"metrics.k8s.io/v1beta1"})
+	expected := []string{
+		"kubernetes v1.8.4 is older than 1.10, the oldest supported, what it serves may not decode",
+		"discovery failed for metrics.k8s.io/v1beta1, which can't be watched, the rest can",
+	}
+	if old.EndpointSlices != "" || !reflect.DeepEqual(old.Warnings(), expected) {
+		t.Errorf("expected %q without endpoint slices, got %q, %s", expected, old.Warnings(), old.EndpointSlices)
+	}
+	if warnings := compatibility("", "", nil, nil).Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning that services aren't served, got %q", warnings)
+	}
+}
+
+func TestStability(t *testing.T) {
+	ordered := []string{"v2", "v1", "v2beta1", "v1beta2", "v1beta1", "v1alpha1", "foo"}
+	for i := 0; i+1 < len(ordered); i++ {
+		if !moreStable(ordered[i], ordered[i+1]) || moreStable(ordered[i+1], ordered[i]) {
+			t.Errorf("expected %s ahead of %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func TestBudgetVersion(t *testing.T) {
+	for expected, served := range map[string][]string{
+		"policy/v1":      {"apps/v1", "policy/v1", "policy/v1beta1", "v1"},
+		"policy/v1beta1": {"apps/v1", "policy/v1beta1", "v1"},
+	} {
+		if actual := budgetVersion(served); actual != expected {
+			t.Errorf("%v: expected %s, got %s", served, expected, actual)
+		}
+	}
+	// e.g. kubectl couldn't reach the cluster
+	if actual := budgetVersion(nil); actual != "policy/v1" {
+		t.Errorf("expected policy/v1 by default, got %s", actual)
+	}
+}
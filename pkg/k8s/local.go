@@ -0,0 +1,83 @@
+package k8s
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A LocalCluster is a cluster that runs on this host, in containers
+// (kind, k3d, or minikube with its docker driver) or in a vm
+// (minikube with any other driver).
+type LocalCluster struct {
+	// Kind is "kind", "k3d", or "minikube".
+	Kind string
+	// Network is the container network of the nodes, or "" if they
+	// are in a vm.
+	Network string
+	// ServiceCIDR is the service range that kind of cluster uses
+	// unless told otherwise.
+	ServiceCIDR string
+	// APIHost is the host of the api server, e.g. "127.0.0.1" where
+	// a container runtime publishes it.
+	APIHost string
+}
+
+// the service ranges that local clusters default to
+var localServiceCIDRs = map[string]string{
+	"kind":     "10.96.0.0/16",
+	"k3d":      "10.43.0.0/16",
+	"minikube": "10.96.0.0/12",
+}
+
+// LocalCluster returns what kind of local cluster the context is, or
+// nil if it isn't one, as far as the kubeconfig can tell.
+func (info *KubeInfo) LocalCluster() *LocalCluster {
+	config, err := info.clientConfig.RawConfig()
+	if err != nil {
+		return nil
+	}
+	context, ok := config.Contexts[info.Context]
+	if !ok {
+		return nil
+	}
+	cluster, ok := config.Clusters[context.Cluster]
+	if !ok {
+		return nil
+	}
+	return detectLocal(info.Context, context.Cluster, cluster.Server, cluster.CertificateAuthority)
+}
+
+// detectLocal recognizes local clusters by the names their tools give
+// contexts, and minikube also by where it keeps its certificates.
+func detectLocal(context, cluster, server, ca string) *LocalCluster {
+	var local LocalCluster
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	local.APIHost = host
+	published := host == "localhost" || host == "0.0.0.0" || host == "host.docker.internal"
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		published = true
+	}
+
+	switch {
+	case strings.HasPrefix(context, "kind-"):
+		// every kind cluster shares the one network
+		local.Kind, local.Network = "kind", "kind"
+	case strings.HasPrefix(context, "k3d-"):
+		local.Kind, local.Network = "k3d", context
+	case context == "minikube" || strings.Contains(ca, "/.minikube/") || strings.Contains(ca, `\.minikube\`):
+		local.Kind = "minikube"
+		if published {
+			// the docker driver publishes the api server, and
+			// names the network after the profile
+			local.Network = cluster
+		}
+	default:
+		return nil
+	}
+	local.ServiceCIDR = localServiceCIDRs[local.Kind]
+	return &local
+}
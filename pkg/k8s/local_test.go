@@ -0,0 +1,28 @@
+package k8s
+
+import (
+	"testing"
+)
+
+func TestDetectLocal(t *testing.T) {
+	for _, c := range []struct {
+		context, cluster, server, ca string
+		expected                     *LocalCluster
+	}{
+		{"kind-dev", "kind-dev", "https://127.0.0.1:41234", "",
+			&LocalCluster{Kind: "kind", Network: "kind", ServiceCIDR: "10.96.0.0/16", APIHost: "127.0.0.1"}},
+		{"k3d-demo", "k3d-demo", "https://0.0.0.0:6550", "",
+			&LocalCluster{Kind: "k3d", Network: "k3d-demo", ServiceCIDR: "10.43.0.0/16", APIHost: "0.0.0.0"}},
+		{"minikube", "minikube", "https://127.0.0.1:55000", "/home/me/.minikube/ca.crt",
+			&LocalCluster{Kind: "minikube", Network: "minikube", ServiceCIDR: "10.96.0.0/12", APIHost: "127.0.0.1"}},
+		// a vm driver, with a profile of its own
+		{"work", "work", "https://192.168.64.3:8443", "/home/me/.minikube/ca.crt",
+			&LocalCluster{Kind: "minikube", ServiceCIDR: "10.96.0.0/12", APIHost: "192.168.64.3"}},
+		{"gke_project_zone_prod", "gke_project_zone_prod", "https://35.1.2.3", "", nil},
+	} {
+		actual := detectLocal(c.context, c.cluster, c.server, c.ca)
+		if (actual == nil) != (c.expected == nil) || actual != nil && *actual != *c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.context, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package k8s
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/datawire/teleproxy/pkg/tpu"
+)
+
+// DefaultClusterDomain is the cluster domain almost every cluster
+// uses.
+const DefaultClusterDomain = "cluster.local"
+
+// Network describes how services are addressed in a cluster.
+type Network struct {
+	// Domain is the cluster domain, e.g. "cluster.local".
+	Domain string
+	// ServiceCIDR is the range cluster ips are allocated from, or
+	// empty if it is unknown.
+	ServiceCIDR string
+}
+
+// Contains reports whether ip is in the service range. Everything is
+// in an unknown range.
+func (n Network) Contains(ip string) bool {
+	if n.ServiceCIDR == "" {
+		return true
+	}
+	_, cidr, err := net.ParseCIDR(n.ServiceCIDR)
+	if err != nil {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && cidr.Contains(addr)
+}
+
+// DetectNetwork asks the cluster for its domain and service range.
+// None of the places these are recorded are universal, so it tries
+// the kubeadm-config and coredns ConfigMaps, then the flags of a
+// static kube-apiserver pod, and finally (for the service range) the
+// error the apiserver gives for a service with an out of range ip. The
+// domain falls back to DefaultClusterDomain.
+func DetectNetwork(c *Client, info *KubeInfo) (result Network) {
+	configmaps, _ := c.ListNamespace("kube-system", "configmaps")
+	for _, cm := range configmaps {
+		data := Map(Map(cm).getMap("data"))
+		switch cm.Name() {
+		case "kubeadm-config":
+			domain, cidr := parseKubeadmConfig(data.getString("ClusterConfiguration"))
+			if result.Domain == "" {
+				result.Domain = domain
+			}
+			if result.ServiceCIDR == "" {
+				result.ServiceCIDR = cidr
+			}
+		case "coredns":
+			if result.Domain == "" {
+				result.Domain = parseCorefile(data.getString("Corefile"))
+			}
+		}
+	}
+
+	if result.ServiceCIDR == "" {
+		pods, _ := c.ListNamespace("kube-system", "pods")
+		for _, pod := range pods {
+			if !strings.HasPrefix(pod.Name(), "kube-apiserver") {
+				continue
+			}
+			for _, container := range pod.Spec().getMaps("containers") {
+				var args []string
+				for _, key := range []string{"command", "args"} {
+					values, _ := container[key].([]interface{})
+					for _, v := range values {
+						if s, ok := v.(string); ok {
+							args = append(args, s)
+						}
+					}
+				}
+				if cidr := parseServiceRangeFlag(args); cidr != "" {
+					result.ServiceCIDR = cidr
+				}
+			}
+		}
+	}
+
+	if result.ServiceCIDR == "" && info != nil {
+		// nothing is created, and no cluster ip is valid in every
+		// range, but 0.0.0.1 is as close as we can get
+		output, _ := tpu.Cmd("sh", "-c", "kubectl "+info.GetKubectl(
+			"create service clusterip teleproxy-probe --tcp=80 --clusterip=0.0.0.1 --dry-run=server"))
+		result.ServiceCIDR = parseServiceRangeError(output)
+	}
+
+	if result.Domain == "" {
+		result.Domain = DefaultClusterDomain
+	}
+	return
+}
+
+// parseKubeadmConfig extracts the domain and service range from a
+// kubeadm ClusterConfiguration.
+func parseKubeadmConfig(config string) (domain, cidr string) {
+	var cc struct {
+		Networking struct {
+			DNSDomain     string `yaml:"dnsDomain"`
+			ServiceSubnet string `yaml:"serviceSubnet"`
+		} `yaml:"networking"`
+	}
+	if err := yaml.Unmarshal([]byte(config), &cc); err != nil {
+		return "", ""
+	}
+	return strings.TrimSuffix(cc.Networking.DNSDomain, "."), firstIPv4CIDR(cc.Networking.ServiceSubnet)
+}
+
+// parseCorefile extracts the domain served by the kubernetes plugin
+// of a coredns Corefile.
+func parseCorefile(corefile string) string {
+	for _, line := range strings.Split(corefile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "kubernetes" {
+			continue
+		}
+		// the reverse zones are listed after the cluster domain
+		for _, zone := range fields[1:] {
+			zone = strings.TrimSuffix(zone, ".")
+			if zone == "{" {
+				break
+			}
+			if !strings.HasSuffix(zone, ".arpa") {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+func parseServiceRangeFlag(args []string) string {
+	const flag = "--service-cluster-ip-range="
+	for _, arg := range args {
+		if strings.HasPrefix(arg, flag) {
+			return firstIPv4CIDR(arg[len(flag):])
+		}
+	}
+	return ""
+}
+
+var rangeError = regexp.MustCompile(`valid IPs is ([0-9a-fA-F.:/,]+)`)
+
+// parseServiceRangeError extracts the service range from the error
+// the apiserver gives for an invalid cluster ip.
+func parseServiceRangeError(output string) string {
+	match := rangeError.FindStringSubmatch(output)
+	if match == nil {
+		return ""
+	}
+	return firstIPv4CIDR(match[1])
+}
+
+// firstIPv4CIDR returns the first ipv4 range of a comma separated
+// (dual stack) list, since teleproxy only intercepts ipv4.
+func firstIPv4CIDR(cidrs string) string {
+	for _, cidr := range strings.Split(cidrs, ",") {
+		ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err == nil && ip.To4() != nil {
+			return strings.TrimSpace(cidr)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package k8s
+
+import (
+	"testing"
+)
+
+func TestParseKubeadmConfig(t *testing.T) {
+	domain, cidr := parseKubeadmConfig(`apiVersion: kubeadm.k8s.io/v1beta2
+kind: ClusterConfiguration
+networking:
+  dnsDomain: corp.example
+  podSubnet: 10.244.0.0/16
+  serviceSubnet: fd00::/108,10.96.0.0/12
+`)
+	if domain != "corp.example" || cidr != "10.96.0.0/12" {
+		t.Errorf("got %q %q", domain, cidr)
+	}
+}
+
+func TestParseCorefile(t *testing.T) {
+	for corefile, expected := range map[string]string{
+		".:53 {\n    kubernetes cluster.local in-addr.arpa ip6.arpa {\n       pods insecure\n    }\n}\n": "cluster.local",
+		".:53 {\n    kubernetes in-addr.arpa corp.example. {\n    }\n}\n":                                "corp.example",
+		".:53 {\n    forward . /etc/resolv.conf\n}\n":                                                    "",
+	} {
+		if actual := parseCorefile(corefile); actual != expected {
+			t.Errorf("expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+func TestParseServiceRange(t *testing.T) {
+	flags := []string{"kube-apiserver", "--secure-port=6443", "--service-cluster-ip-range=10.43.0.0/16"}
+	if cidr := parseServiceRangeFlag(flags); cidr != "10.43.0.0/16" {
+		t.Errorf("flag: got %q", cidr)
+	}
+	output := `The Service "teleproxy-probe" is invalid: spec.clusterIPs: Invalid value: []string{"0.0.0.1"}: failed to allocate IP 0.0.0.1: provided IP is not in the valid range. The range of valid IPs is 10.100.0.0/16`
+	if cidr := parseServiceRangeError(output); cidr != "10.100.0.0/16" {
+		t.Errorf("error: got %q", cidr)
+	}
+}
+
+func TestNetworkContains(t *testing.T) {
+	n := Network{ServiceCIDR: "10.96.0.0/12"}
+	if !n.Contains("10.96.0.10") || n.Contains("192.168.1.1") {
+		t.Errorf("wrong containment for %v", n)
+	}
+	if !(Network{}).Contains("192.168.1.1") {
+		t.Errorf("unknown range should contain everything")
+	}
+}
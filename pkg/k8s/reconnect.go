@@ -0,0 +1,152 @@
+package k8s
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	pwatch "k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// watchIdleTimeout bounds how long a watch may go without
+	// events before it is restarted (resuming from the last
+	// resourceVersion). Through a flaky VPN a dead connection can
+	// otherwise go unnoticed indefinitely.
+	watchIdleTimeout = 2 * time.Minute
+	// relistAfter is how long we must have been out of contact
+	// before relisting from etcd rather than the apiserver cache.
+	relistAfter = 5 * time.Minute
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+)
+
+// connection tracks the health of the list/watch calls for a single
+// resource type so that failures are retried with exponential
+// backoff.
+type connection struct {
+	name        string
+	stop        <-chan struct{}
+	mutex       sync.Mutex
+	failures    int
+	lastContact time.Time
+}
+
+func newConnection(name string, stop <-chan struct{}) *connection {
+	return &connection{name: name, stop: stop, lastContact: time.Now()}
+}
+
+func (c *connection) backoff() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failures == 0 {
+		return 0
+	}
+	delay := maxBackoff
+	if c.failures < 6 {
+		delay = minBackoff << uint(c.failures-1)
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+	return delay
+}
+
+// wait sleeps for the current backoff, or until the watcher stops.
+func (c *connection) wait() {
+	delay := c.backoff()
+	if delay == 0 {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-c.stop:
+	}
+}
+
+// result records the outcome of a call to the apiserver.
+func (c *connection) result(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		c.failures++
+		log.Printf("KUB: %s: %v (retry %d)", c.name, err, c.failures)
+		return
+	}
+	if c.failures > 0 {
+		log.Printf("KUB: %s: reconnected after %s", c.name, time.Since(c.lastContact).Round(time.Second))
+	}
+	c.failures = 0
+	c.lastContact = time.Now()
+}
+
+func (c *connection) contact() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastContact = time.Now()
+}
+
+// stale reports whether we have been out of contact for so long that
+// the apiserver cache can't be trusted to reflect what we missed.
+func (c *connection) stale() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Since(c.lastContact) > relistAfter
+}
+
+// idleWatch ends the wrapped watch when no events arrive for a while.
+// The reflector then starts a new one from the last resourceVersion
+// it saw, or relists if that fails.
+type idleWatch struct {
+	inner  pwatch.Interface
+	result chan pwatch.Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newIdleWatch(inner pwatch.Interface, timeout time.Duration, contact func()) *idleWatch {
+	w := &idleWatch{
+		inner:  inner,
+		result: make(chan pwatch.Event),
+		done:   make(chan struct{}),
+	}
+	go w.run(timeout, contact)
+	return w
+}
+
+func (w *idleWatch) run(timeout time.Duration, contact func()) {
+	defer close(w.result)
+	defer w.inner.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.inner.ResultChan():
+			if !ok {
+				return
+			}
+			contact()
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+			select {
+			case w.result <- event:
+			case <-w.done:
+				return
+			}
+		case <-timer.C:
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *idleWatch) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *idleWatch) ResultChan() <-chan pwatch.Event {
+	return w.result
+}
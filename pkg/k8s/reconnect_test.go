@@ -0,0 +1,57 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pwatch "k8s.io/apimachinery/pkg/watch"
+)
+
+func TestBackoff(t *testing.T) {
+	c := newConnection("services", nil)
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, delay := range expected {
+		if actual := c.backoff(); actual != delay {
+			t.Errorf("after %d failures: expected %v, got %v", i, delay, actual)
+		}
+		c.result(errors.New("connection refused"))
+	}
+	c.result(nil)
+	if actual := c.backoff(); actual != 0 {
+		t.Errorf("after success: expected no backoff, got %v", actual)
+	}
+}
+
+type fakeWatch struct {
+	events  chan pwatch.Event
+	stopped chan struct{}
+}
+
+func (w *fakeWatch) Stop()                           { close(w.stopped) }
+func (w *fakeWatch) ResultChan() <-chan pwatch.Event { return w.events }
+
+func TestIdleWatch(t *testing.T) {
+	inner := &fakeWatch{make(chan pwatch.Event), make(chan struct{})}
+	contacts := 0
+	w := newIdleWatch(inner, 50*time.Millisecond, func() { contacts++ })
+
+	inner.events <- pwatch.Event{Type: pwatch.Added}
+	if event := <-w.ResultChan(); event.Type != pwatch.Added {
+		t.Errorf("expected the event to be relayed, got %v", event)
+	}
+
+	select {
+	case _, ok := <-w.ResultChan():
+		if ok {
+			t.Errorf("expected the watch to end")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the idle watch to time out")
+	}
+	<-inner.stopped
+	if contacts != 1 {
+		t.Errorf("expected 1 contact, got %d", contacts)
+	}
+}
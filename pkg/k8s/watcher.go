@@ -20,16 +20,34 @@ import (
 
 type listWatchAdapter struct {
 	resource dynamic.ResourceInterface
+	conn     *connection
 }
 
 func (lw listWatchAdapter) List(options v1.ListOptions) (runtime.Object, error) {
+	lw.conn.wait()
+	if lw.conn.stale() {
+		// an empty resourceVersion reads from etcd rather than
+		// the apiserver cache
+		options.ResourceVersion = ""
+	}
+	result, err := lw.resource.List(options)
+	lw.conn.result(err)
+	if err != nil {
+		return nil, err
+	}
 	// silently coerce the returned *unstructured.UnstructuredList
 	// struct to a runtime.Object interface.
-	return lw.resource.List(options)
+	return result, nil
 }
 
 func (lw listWatchAdapter) Watch(options v1.ListOptions) (pwatch.Interface, error) {
-	return lw.resource.Watch(options)
+	lw.conn.wait()
+	result, err := lw.resource.Watch(options)
+	lw.conn.result(err)
+	if err != nil {
+		return nil, err
+	}
+	return newIdleWatch(result, watchIdleTimeout, lw.conn.contact), nil
 }
 
 type Watcher struct {
@@ -119,7 +137,10 @@ func (w *Watcher) Watch(resources string, listener func(*Watcher)) error {
 }
 
 func (w *Watcher) WatchNamespace(namespace, resources string, listener func(*Watcher)) error {
-	ri := w.client.ResolveResourceType(resources)
+	ri, ok := w.client.resolve(resources)
+	if !ok {
+		return fmt.Errorf("%s doesn't serve %s", w.client.compat, resources)
+	}
 	dyn, err := dynamic.NewForConfig(w.client.config)
 	if err != nil {
 		return err
@@ -144,7 +165,7 @@ func (w *Watcher) WatchNamespace(namespace, resources string, listener func(*Wat
 	}
 
 	store, controller := cache.NewInformer(
-		listWatchAdapter{watched},
+		listWatchAdapter{watched, newConnection(ri.Name, w.stop)},
 		nil,
 		5*time.Minute,
 		cache.ResourceEventHandlerFuncs{
@@ -0,0 +1,28 @@
+// Package origdst finds out where a connection that the firewall
+// redirected to a local listener was originally headed. It covers
+// conntrack NAT on linux (as installed by iptables or nftables) and pf
+// on darwin.
+//
+// The destination is returned as a *net.TCPAddr, which carries IPv4
+// and IPv6 addresses alike.
+package origdst
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrUnsupported is returned where the platform has no way of looking
+// up original destinations.
+var ErrUnsupported = errors.New("original destinations can't be looked up on this platform")
+
+// Lookup returns the destination conn was headed for before it was
+// redirected. A connection that wasn't redirected either fails or
+// returns its own local address, depending on the platform.
+func Lookup(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("connection has no local tcp address")
+	}
+	return lookup(conn, local)
+}
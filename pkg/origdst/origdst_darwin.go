@@ -0,0 +1,69 @@
+// +build darwin
+
+package origdst
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// diocNatLook is DIOCNATLOOK, _IOWR('D', 23, struct pfioc_natlook)
+// from net/pfvar.h.
+const diocNatLook = 0xc0544417
+
+// pf's direction for outgoing packets, which is where rdr rules on
+// lo0 translate them
+const pfOut = 2
+
+// pfioc_natlook, addresses and ports in network byte order
+type natlook struct {
+	saddr, daddr, rsaddr, rdaddr     [16]byte
+	sxport, dxport, rsxport, rdxport [4]byte
+	af, proto, protoVariant, dir     uint8
+}
+
+var (
+	once sync.Once
+	dev  *os.File
+	derr error
+)
+
+// lookup asks pf for the state of the redirected connection. /dev/pf
+// is opened on the first lookup and kept open: every connection does
+// one.
+func lookup(conn *net.TCPConn, local *net.TCPAddr) (*net.TCPAddr, error) {
+	once.Do(func() { dev, derr = os.OpenFile("/dev/pf", os.O_RDWR, 0) })
+	if derr != nil {
+		return nil, derr
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("connection has no remote tcp address")
+	}
+
+	nl := natlook{proto: syscall.IPPROTO_TCP, dir: pfOut}
+	size := net.IPv6len
+	if local.IP.To4() != nil {
+		nl.af, size = syscall.AF_INET, net.IPv4len
+		copy(nl.saddr[:], remote.IP.To4())
+		copy(nl.daddr[:], local.IP.To4())
+	} else {
+		nl.af = syscall.AF_INET6
+		copy(nl.saddr[:], remote.IP.To16())
+		copy(nl.daddr[:], local.IP.To16())
+	}
+	nl.sxport[0], nl.sxport[1] = byte(remote.Port>>8), byte(remote.Port)
+	nl.dxport[0], nl.dxport[1] = byte(local.Port>>8), byte(local.Port)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), diocNatLook, uintptr(unsafe.Pointer(&nl)))
+	if errno != 0 {
+		return nil, os.NewSyscallError("DIOCNATLOOK", errno)
+	}
+	ip := make(net.IP, size)
+	copy(ip, nl.rdaddr[:size])
+	return &net.TCPAddr{IP: ip, Port: int(nl.rdxport[0])<<8 | int(nl.rdxport[1])}, nil
+}
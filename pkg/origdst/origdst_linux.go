@@ -0,0 +1,76 @@
+// +build linux
+
+package origdst
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// the getsockopts of lookup4 and lookup6, which tests fake
+var (
+	getsockoptIPv6Mreq    = syscall.GetsockoptIPv6Mreq
+	getsockoptIPv6MTUInfo = syscall.GetsockoptIPv6MTUInfo
+)
+
+// lookup asks conntrack for the address that was NATed away, which is
+// what the iptables and nftables redirects both leave behind.
+func lookup(conn *net.TCPConn, local *net.TCPAddr) (result *net.TCPAddr, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := local.IP.To4() != nil
+	cerr := rawConn.Control(func(fd uintptr) {
+		if ipv4 {
+			result, err = lookup4(int(fd))
+		} else {
+			result, err = lookup6(int(fd))
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	return result, nil
+}
+
+// lookup4 reads the sockaddr_in the kernel answers with. Of the
+// syscall package's getsockopts, the one for an IPv6Mreq is the one
+// that hands back 16 bytes, enough to hold it.
+func lookup4(fd int) (*net.TCPAddr, error) {
+	mreq, err := getsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	raw := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]).To4(),
+		Port: int(raw[2])<<8 | int(raw[3]),
+	}, nil
+}
+
+// lookup6 reads a sockaddr_in6 the same way, by way of the getsockopt
+// that hands back one inside an IPv6MTUInfo.
+func lookup6(fd int) (*net.TCPAddr, error) {
+	info, err := getsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	raw := info.Addr
+	// the port is in network byte order, whatever the host's
+	port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, raw.Addr[:])
+	return &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}, nil
+}
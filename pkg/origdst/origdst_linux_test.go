@@ -0,0 +1,80 @@
+// +build linux
+
+package origdst
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// connected returns both ends of a tcp connection over loopback on
+// network, tcp4 or tcp6.
+func connected(t *testing.T, network, address string) (client, server *net.TCPConn) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial(network, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestLookup4(t *testing.T) {
+	defer func(saved func(int, int, int) (*syscall.IPv6Mreq, error)) { getsockoptIPv6Mreq = saved }(getsockoptIPv6Mreq)
+	getsockoptIPv6Mreq = func(fd, level, opt int) (*syscall.IPv6Mreq, error) {
+		if level != syscall.IPPROTO_IP || opt != soOriginalDst {
+			t.Errorf("unexpected getsockopt %d %d", level, opt)
+		}
+		// a sockaddr_in of 10.96.0.10:443
+		mreq := &syscall.IPv6Mreq{}
+		copy(mreq.Multiaddr[:], []byte{2, 0, 1, 187, 10, 96, 0, 10})
+		return mreq, nil
+	}
+	client, server := connected(t, "tcp4", "127.0.0.1:0")
+	defer client.Close()
+	defer server.Close()
+	addr, err := Lookup(server)
+	if err != nil || addr.String() != "10.96.0.10:443" {
+		t.Errorf("expected 10.96.0.10:443, got %v, %v", addr, err)
+	}
+}
+
+func TestLookup6(t *testing.T) {
+	defer func(saved func(int, int, int) (*syscall.IPv6MTUInfo, error)) { getsockoptIPv6MTUInfo = saved }(getsockoptIPv6MTUInfo)
+	getsockoptIPv6MTUInfo = func(fd, level, opt int) (*syscall.IPv6MTUInfo, error) {
+		if level != syscall.IPPROTO_IPV6 || opt != ip6tSoOriginalDst {
+			t.Errorf("unexpected getsockopt %d %d", level, opt)
+		}
+		info := &syscall.IPv6MTUInfo{}
+		copy(info.Addr.Addr[:], net.ParseIP("fd00::10"))
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		port[0], port[1] = 0x1f, 0x90
+		return info, nil
+	}
+	client, server := connected(t, "tcp6", "[::1]:0")
+	defer client.Close()
+	defer server.Close()
+	addr, err := Lookup(server)
+	if err != nil || addr.String() != "[fd00::10]:8080" {
+		t.Errorf("expected [fd00::10]:8080, got %v, %v", addr, err)
+	}
+}
+
+func TestLookupNotRedirected(t *testing.T) {
+	client, server := connected(t, "tcp4", "127.0.0.1:0")
+	defer client.Close()
+	defer server.Close()
+	// conntrack knows nothing of it, or isn't loaded at all
+	if addr, err := Lookup(server); err == nil && addr.String() != server.LocalAddr().String() {
+		t.Errorf("expected an error or the local address, got %v", addr)
+	}
+}
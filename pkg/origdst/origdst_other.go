@@ -0,0 +1,9 @@
+// +build !linux,!darwin
+
+package origdst
+
+import "net"
+
+func lookup(conn *net.TCPConn, local *net.TCPAddr) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
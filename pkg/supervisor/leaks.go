@@ -0,0 +1,135 @@
+package supervisor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workerLabel is the profiler label that attributes goroutines to the
+// worker that started them. Labels are inherited by goroutines, so
+// anything a worker spawns is accounted to it too.
+const workerLabel = "supervisor-worker"
+
+// Stats is a snapshot of resource usage.
+type Stats struct {
+	Goroutines int            `json:"goroutines"`
+	FDs        int            `json:"fds"` // -1 if unknown
+	Workers    map[string]int `json:"workers"`
+}
+
+var countLine = regexp.MustCompile(`^(\d+) @`)
+
+// Stats reports the goroutines currently running on behalf of each
+// worker, along with the totals for the whole process. File
+// descriptors can't be attributed to goroutines, so only the process
+// total is available.
+func (s *Supervisor) Stats() Stats {
+	stats := Stats{
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        countFDs(),
+		Workers:    make(map[string]int),
+	}
+
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	scanner := bufio.NewScanner(&buf)
+	count := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := countLine.FindStringSubmatch(line); m != nil {
+			count, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if !strings.HasPrefix(line, "# labels: ") {
+			continue
+		}
+		var labels map[string]string
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "# labels: ")), &labels); err != nil {
+			continue
+		}
+		if name, ok := labels[workerLabel]; ok {
+			stats.Workers[name] += count
+		}
+	}
+	return stats
+}
+
+func countFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := ioutil.ReadDir(dir); err == nil {
+			// don't count the descriptor used for reading
+			// the directory
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
+
+// LeakDetector returns the work function for a worker that samples
+// Stats every interval and logs a warning whenever a count has grown
+// on every one of the last samples. Counts that go up and down are
+// normal, counts that only ever go up are leaks.
+//
+//	s.Supervise(&Worker{Name: "leaks", Work: LeakDetector(time.Minute, 5)})
+func LeakDetector(interval time.Duration, samples int) func(*Process) error {
+	return func(p *Process) error {
+		history := make(map[string][]int)
+		p.Ready()
+		for {
+			select {
+			case <-p.Shutdown():
+				return nil
+			case <-time.After(interval):
+			}
+
+			stats := p.Supervisor().Stats()
+			current := map[string]int{
+				"goroutines": stats.Goroutines,
+				"fds":        stats.FDs,
+			}
+			for name, n := range stats.Workers {
+				current["goroutines of "+name] = n
+			}
+			for key := range history {
+				if _, ok := current[key]; !ok {
+					delete(history, key)
+				}
+			}
+
+			var keys []string
+			for key := range current {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				h := append(history[key], current[key])
+				if len(h) > samples {
+					h = h[len(h)-samples:]
+				}
+				history[key] = h
+				if len(h) == samples && increasing(h) {
+					p.Logf("possible leak: %s grew from %d to %d over %v", key, h[0], h[len(h)-1],
+						time.Duration(samples-1)*interval)
+				}
+			}
+		}
+	}
+}
+
+func increasing(counts []int) bool {
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			return false
+		}
+	}
+	return true
+}
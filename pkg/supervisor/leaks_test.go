@@ -0,0 +1,114 @@
+package supervisor
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := WithContext(context.Background())
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(3)
+	s.Supervise(&Worker{
+		Name: "spawner",
+		Work: func(p *Process) error {
+			// goroutines started by a worker count towards it
+			for i := 0; i < 3; i++ {
+				go func() {
+					started.Done()
+					<-release
+				}()
+			}
+			started.Wait()
+			stats := s.Stats()
+			if stats.Workers["spawner"] != 4 {
+				t.Errorf("expected 4 goroutines for spawner, got %v", stats.Workers)
+			}
+			if stats.Goroutines < 4 {
+				t.Errorf("expected at least 4 goroutines, got %d", stats.Goroutines)
+			}
+			close(release)
+			return nil
+		},
+	})
+	s.Run()
+}
+
+type recorder struct {
+	sync.Mutex
+	lines []string
+}
+
+func (r *recorder) Printf(format string, v ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.lines = append(r.lines, format)
+	for _, arg := range v {
+		if s, ok := arg.(string); ok {
+			r.lines = append(r.lines, s)
+		}
+	}
+}
+
+func (r *recorder) contains(substr string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, line := range r.lines {
+		if strings.Contains(line, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeakDetector(t *testing.T) {
+	s := WithContext(context.Background())
+	logger := &recorder{}
+	s.Logger = logger
+	stop := make(chan struct{})
+	s.Supervise(&Worker{
+		Name: "leaks",
+		Work: LeakDetector(20*time.Millisecond, 3),
+	})
+	s.Supervise(&Worker{
+		Name: "leaky",
+		Work: func(p *Process) error {
+			for {
+				select {
+				case <-p.Shutdown():
+					close(stop)
+					return nil
+				case <-time.After(2 * time.Millisecond):
+					go func() { <-stop }()
+				}
+			}
+		},
+	})
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		s.Shutdown()
+	}()
+	s.Run()
+	if !logger.contains("possible leak: goroutines of leaky") {
+		t.Errorf("leak not detected: %q", logger.lines)
+	}
+}
+
+func TestIncreasing(t *testing.T) {
+	for _, tt := range []struct {
+		counts   []int
+		expected bool
+	}{
+		{[]int{1, 2, 3}, true},
+		{[]int{1, 2, 2}, false},
+		{[]int{3, 2, 4}, false},
+	} {
+		if increasing(tt.counts) != tt.expected {
+			t.Errorf("increasing(%v) != %v", tt.counts, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Reason is why a worker stopped running.
+type Reason string
+
+const (
+	// Done is returning nil of its own accord.
+	Done Reason = "done"
+	// Stopped is returning nil after being asked to shut down.
+	Stopped Reason = "stopped"
+	// Failed is returning an error, which shuts down the supervisor.
+	Failed Reason = "failed"
+	// Panicked is panicking, which shuts down the supervisor.
+	Panicked Reason = "panicked"
+	// Retried is failing (or panicking) as a worker that is retried.
+	Retried Reason = "retried"
+)
+
+// A Termination is a worker stopping, and why.
+type Termination struct {
+	Worker string    `json:"worker"`
+	Reason Reason    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+	// Count is how many times in a row this happened, which only a
+	// retried worker failing alike does more than once.
+	Count int `json:"count,omitempty"`
+	// Shutdown is whether the supervisor was shutting down by then,
+	// in which case that, not the worker, is likely to blame.
+	Shutdown bool `json:"shutdown,omitempty"`
+
+	seq int
+}
+
+func (t Termination) String() string {
+	line := fmt.Sprintf("%s %s", t.Worker, t.Reason)
+	if t.Error != "" {
+		line += ": " + t.Error
+	}
+	if t.Count > 1 {
+		line += fmt.Sprintf(" (%d times)", t.Count)
+	}
+	if t.Shutdown {
+		line += " during shutdown"
+	}
+	return line
+}
+
+// A Report is what ended the workers of a supervisor, with whatever
+// started the shutdown first and the rest in the order they happened,
+// so that the root cause of a failed run isn't lost among the failures
+// it caused.
+type Report struct {
+	// Cause is what started the shutdown, e.g. "server failed: ...",
+	// or empty if it hasn't.
+	Cause        string        `json:"cause,omitempty"`
+	Terminations []Termination `json:"terminations"`
+}
+
+func (r Report) String() string {
+	lines := []string{"shut down because " + r.Cause}
+	if r.Cause == "" {
+		lines[0] = "not shut down"
+	}
+	for _, t := range r.Terminations {
+		lines = append(lines, "  "+t.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Failed reports whether a worker failed or panicked, other than while
+// being retried.
+func (r Report) Failed() bool {
+	for _, t := range r.Terminations {
+		if t.Reason == Failed || t.Reason == Panicked {
+			return true
+		}
+	}
+	return false
+}
+
+// Report returns the Report of the workers that have stopped so far.
+func (s *Supervisor) Report() Report {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.report()
+}
+
+// this assumes that s.mutex is already held
+func (s *Supervisor) report() Report {
+	r := Report{Cause: s.cause}
+	r.Terminations = append([]Termination(nil), s.terminations...)
+	sort.SliceStable(r.Terminations, func(i, j int) bool {
+		return r.Terminations[i].seq == s.root && r.Terminations[j].seq != s.root
+	})
+	return r
+}
+
+// this assumes that s.mutex is already held
+func (s *Supervisor) terminated(worker *Worker, reason Reason, err error) {
+	t := Termination{Worker: worker.Name, Reason: reason, At: time.Now(), Count: 1, Shutdown: s.wantsShutdown}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	if reason == Retried {
+		if n := len(s.terminations); n > 0 {
+			last := &s.terminations[n-1]
+			if last.Worker == t.Worker && last.Reason == Retried && last.Error == t.Error {
+				last.Count++
+				last.At = t.At
+				return
+			}
+		}
+	}
+	s.seq++
+	t.seq = s.seq
+	s.terminations = append(s.terminations, t)
+	if (reason == Failed || reason == Panicked) && s.cause == "" {
+		s.cause = t.String()
+		s.root = t.seq
+	}
+}
+
+// this assumes that s.mutex is already held
+func (s *Supervisor) shutdown(cause string) {
+	if s.cause == "" && !s.wantsShutdown {
+		s.cause = cause
+	}
+	s.wantsShutdown = true
+	s.changed.Broadcast()
+}
+
+// Status is the status of a supervisor, as served by StatusHandler.
+type Status struct {
+	Stats  Stats  `json:"stats"`
+	Report Report `json:"report"`
+}
+
+// StatusHandler serves the Stats and the Report of s, as json, for
+// a program to add to its status api.
+func (s *Supervisor) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := Status{Stats: s.Stats(), Report: s.Report()}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,115 @@
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReport(t *testing.T) {
+	s := WithContext(context.Background())
+	flaky := 0
+	s.Supervise(&Worker{
+		Name:  "flaky",
+		Retry: true,
+		Work: func(p *Process) error {
+			if flaky++; flaky < 3 {
+				return errors.New("refused")
+			}
+			p.Ready()
+			<-p.Shutdown()
+			return nil
+		},
+	})
+	s.Supervise(&Worker{
+		Name:     "db",
+		Requires: []string{"flaky"},
+		Work: func(p *Process) error {
+			p.Ready()
+			return errors.New("disk full")
+		},
+	})
+	s.Supervise(&Worker{
+		Name: "app",
+		Work: func(p *Process) error {
+			p.Ready()
+			<-p.Shutdown()
+			return errors.New("lost db")
+		},
+	})
+	if errs := s.Run(); len(errs) != 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	report := s.Report()
+	if report.Cause != "db failed: disk full" {
+		t.Errorf("unexpected cause %q", report.Cause)
+	}
+	var lines []string
+	for _, term := range report.Terminations {
+		lines = append(lines, term.String())
+	}
+	expected := []string{
+		"db failed: disk full",
+		"flaky retried: refused (2 times)",
+	}
+	if len(lines) != 4 || lines[0] != expected[0] || lines[1] != expected[1] {
+		t.Fatalf("unexpected terminations:\n%s", strings.Join(lines, "\n"))
+	}
+	rest := strings.Join(lines[2:], "\n")
+	for _, line := range []string{"app failed: lost db during shutdown", "flaky stopped during shutdown"} {
+		if !strings.Contains(rest, line) {
+			t.Errorf("expected %q among:\n%s", line, rest)
+		}
+	}
+	if !report.Failed() {
+		t.Errorf("expected the report to have failed")
+	}
+}
+
+func TestReportShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := WithContext(ctx)
+	s.Supervise(&Worker{
+		Name: "server",
+		Work: func(p *Process) error {
+			p.Ready()
+			cancel()
+			<-p.Shutdown()
+			return nil
+		},
+	})
+	s.Run()
+	report := s.Report()
+	if report.Cause != "context canceled" || report.Failed() {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+	if len(report.Terminations) != 1 || report.Terminations[0].Reason != Stopped {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	s := WithContext(context.Background())
+	s.Supervise(&Worker{
+		Name: "once",
+		Work: func(p *Process) error { return nil },
+	})
+	s.Run()
+	w := httptest.NewRecorder()
+	s.StatusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Report.Terminations) != 1 || status.Report.Terminations[0].Reason != Done {
+		t.Errorf("unexpected status %s", w.Body.String())
+	}
+	if status.Stats.Goroutines == 0 {
+		t.Errorf("unexpected status %s", w.Body.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"runtime/pprof"
 	"sync"
 	"sync/atomic"
 
@@ -38,6 +39,12 @@ type Supervisor struct {
 	workers       map[string]*Worker // keyed by worker name
 	errors        []error
 	Logger        Logger
+
+	// what ended the workers, for the Report
+	terminations []Termination
+	seq          int
+	cause        string // what started the shutdown
+	root         int    // seq of the termination that did, if any
 }
 
 func WithContext(ctx context.Context) *Supervisor {
@@ -115,6 +122,9 @@ func (s *Supervisor) remove(worker *Worker) {
 //
 // The graceful shutdown sequence shuts down workers in an order that
 // respects worker dependencies.
+//
+// If a worker failed, Run logs the Report of the run before returning,
+// which puts the failure that started the shutdown first.
 func (s *Supervisor) Run() []error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -123,7 +133,9 @@ func (s *Supervisor) Run() []error {
 	// need to worry about shutdown
 	go func() {
 		<-s.context.Done()
-		s.Shutdown()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.shutdown(s.context.Err().Error())
 	}()
 
 	// reconcile may delete workers
@@ -132,6 +144,9 @@ func (s *Supervisor) Run() []error {
 		s.changed.Wait()
 		s.reconcile()
 	}
+	if report := s.report(); report.Failed() {
+		s.Logger.Printf("%s", report)
+	}
 	return s.errors
 }
 
@@ -140,8 +155,7 @@ func (s *Supervisor) Run() []error {
 func (s *Supervisor) Shutdown() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.wantsShutdown = true
-	s.changed.Broadcast()
+	s.shutdown("shutdown requested")
 }
 
 // Gets the worker with the specified name. Will return nil if no such
@@ -247,13 +261,18 @@ func (s *Supervisor) launch(worker *Worker) {
 	worker.process = process
 	go func() {
 		var err error
+		panicked := false
 		func() {
 			defer func() {
 				if r := recover(); r != nil {
 					err = errors.Errorf("PANIC: %v", r)
+					panicked = true
 				}
 			}()
-			err = worker.Work(process)
+			labels := pprof.Labels(workerLabel, worker.Name)
+			pprof.Do(context.Background(), labels, func(context.Context) {
+				err = worker.Work(process)
+			})
 		}()
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
@@ -261,18 +280,29 @@ func (s *Supervisor) launch(worker *Worker) {
 		if err != nil {
 			process.Log(err)
 			if worker.Retry {
+				s.terminated(worker, Retried, err)
 				if worker.shuttingDown() {
 					s.remove(worker)
 				} else {
 					process.Log("retrying...")
 				}
 			} else {
+				reason := Failed
+				if panicked {
+					reason = Panicked
+				}
+				s.terminated(worker, reason, err)
 				s.remove(worker)
 				worker.error = err
 				s.errors = append(s.errors, worker)
 				s.wantsShutdown = true
 			}
 		} else {
+			if worker.shuttingDown() {
+				s.terminated(worker, Stopped, nil)
+			} else {
+				s.terminated(worker, Done, nil)
+			}
 			s.remove(worker)
 		}
 		s.changed.Broadcast()
@@ -0,0 +1,80 @@
+// +build linux
+
+package tpu
+
+import (
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// _LINUX_CAPABILITY_VERSION_3, which has two words of each set
+const capabilityVersion = 0x20080522
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+var (
+	ambient      []uintptr
+	ambientMutex sync.Mutex
+)
+
+// PassCapabilities makes the commands that Run starts from now on
+// have caps, which are capability numbers, e.g. 12 for CAP_NET_ADMIN,
+// that this process has. A process that has them as file capabilities
+// doesn't pass them on otherwise, the way it would with systemd's
+// AmbientCapabilities.
+func PassCapabilities(caps []uint) {
+	ambientMutex.Lock()
+	defer ambientMutex.Unlock()
+	ambient = nil
+	for _, c := range caps {
+		ambient = append(ambient, uintptr(c))
+	}
+}
+
+// startCmd starts cmd, with the capabilities to pass on as ambient ones.
+// Those must be inheritable by the thread that forks it, and whether
+// they are is up to each thread, so the fork happens on this one.
+func startCmd(cmd *exec.Cmd) error {
+	ambientMutex.Lock()
+	caps := ambient
+	ambientMutex.Unlock()
+	if len(caps) == 0 {
+		return cmd.Start()
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := inheritable(caps); err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{AmbientCaps: caps}
+	return cmd.Start()
+}
+
+// inheritable adds caps, which must be permitted, to the inheritable
+// set of this thread.
+func inheritable(caps []uintptr) error {
+	header := capHeader{version: capabilityVersion}
+	var data [2]capData
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	for _, c := range caps {
+		data[c/32].inheritable |= 1 << (c % 32)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
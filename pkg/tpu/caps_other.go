@@ -0,0 +1,14 @@
+// +build !linux
+
+package tpu
+
+import (
+	"os/exec"
+)
+
+// PassCapabilities does nothing but on linux.
+func PassCapabilities(caps []uint) {}
+
+func startCmd(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
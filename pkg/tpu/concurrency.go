@@ -1,5 +1,9 @@
 package tpu
 
+import (
+	"sync"
+)
+
 type empty interface{}
 
 // Semaphore
@@ -22,6 +26,23 @@ func (s Semaphore) Release() {
 	s <- nil
 }
 
+// Parallel runs the tasks, at most n at a time, and returns once they
+// have all finished.
+func Parallel(n int, tasks ...func()) {
+	sem := NewSemaphore(n)
+	var wg sync.WaitGroup
+	wg.Add(len(tasks))
+	for _, task := range tasks {
+		sem.Acquire()
+		go func(task func()) {
+			defer wg.Done()
+			defer sem.Release()
+			task()
+		}(task)
+	}
+	wg.Wait()
+}
+
 // Latch
 
 type Latch struct {
@@ -0,0 +1,20 @@
+// +build !windows
+
+package tpu
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ownGroup has cmd start a process group of its own, which killGroup
+// then kills.
+func ownGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
+
+func killGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
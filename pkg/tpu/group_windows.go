@@ -0,0 +1,13 @@
+package tpu
+
+import (
+	"os/exec"
+)
+
+// ownGroup does nothing on windows, where killGroup only kills the
+// process itself.
+func ownGroup(cmd *exec.Cmd) {}
+
+func killGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
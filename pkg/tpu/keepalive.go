@@ -2,22 +2,87 @@ package tpu
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"log"
+	"math/rand"
 	"os/exec"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
+// The Health of a Keeper's command.
+type Health int
+
+const (
+	// Healthy is running, or restarting now and then.
+	Healthy Health = iota
+	// Flapping is dying again soon after each of several restarts.
+	Flapping
+	// Broken is having died MaxRestarts times in a row, after which
+	// the keeper gives up.
+	Broken
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Flapping:
+		return "flapping"
+	default:
+		return "broken"
+	}
+}
+
+const (
+	// DefaultMinDelay and DefaultMaxDelay bound the delay before
+	// restarting a command that died.
+	DefaultMinDelay = time.Second
+	DefaultMaxDelay = 30 * time.Second
+	// a command that dies this many times in a row is flapping
+	flapping = 3
+)
+
+// A Keeper keeps a command running, restarting it whenever it dies. The
+// delay before each restart doubles, from MinDelay up to MaxDelay, for
+// as long as the command keeps dying within MaxDelay of being started,
+// and is jittered so that keepers that lost the same thing, e.g. the
+// api server, don't all come back at once. A run that lasts longer
+// than MaxDelay starts over from MinDelay.
 type Keeper struct {
 	Prefix  string
 	Command string
 	Input   string
 	Inspect string
-	Limit   int
-	stop    chan empty
-	done    chan empty
+	// Limit is how many times to start the command at most, no
+	// limit if zero.
+	Limit int
+	// MinDelay and MaxDelay default to DefaultMinDelay and
+	// DefaultMaxDelay.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxRestarts, if set, is how many times in a row the command
+	// may die before the keeper gives up on it, as Broken.
+	MaxRestarts int
+	// OnHealth, if set, is invoked when the health of the command
+	// changes: Flapping once it has died soon after a few restarts
+	// in a row, Healthy again once a run lasts, and Broken if the
+	// keeper gives up, along with Err. Invocations don't overlap,
+	// and may ask for the Health.
+	OnHealth func(Health, error)
+	stop     chan empty
+	restart  chan empty
+	done     chan empty
+
+	healthMutex sync.Mutex
+	health      Health
+	err         error
+	// the last lines the current run wrote to stderr
+	stderr []string
+	// serializes OnHealth
+	callbackMutex sync.Mutex
 }
 
 func NewKeeper(prefix, command string) (k *Keeper) {
@@ -25,12 +90,18 @@ func NewKeeper(prefix, command string) (k *Keeper) {
 		Prefix:  prefix,
 		Command: command,
 		stop:    make(chan empty),
+		restart: make(chan empty),
 		done:    make(chan empty),
 	}
 }
 
+// Stop kills the command for good. It does nothing once the keeper is
+// done, e.g. past its Limit.
 func (k *Keeper) Stop() {
-	k.stop <- nil
+	select {
+	case k.stop <- nil:
+	case <-k.done:
+	}
 	k.Wait()
 }
 
@@ -38,20 +109,130 @@ func (k *Keeper) Wait() {
 	<-k.done
 }
 
+// Restart kills the command, which is started again right away, e.g.
+// when it is known to be stuck. It does nothing once the keeper is
+// done.
+func (k *Keeper) Restart() {
+	select {
+	case k.restart <- nil:
+	case <-k.done:
+	}
+}
+
 func (k *Keeper) log(line string, args ...interface{}) {
 	log.Printf(k.Prefix+": "+line, args...)
 }
 
+// Health returns the health of the command.
+func (k *Keeper) Health() Health {
+	k.healthMutex.Lock()
+	defer k.healthMutex.Unlock()
+	return k.health
+}
+
+// Err returns how the command last died, a *CmdError with what it
+// wrote to stderr and its exit code, or nil if it hasn't died since a
+// run last lasted.
+func (k *Keeper) Err() error {
+	k.healthMutex.Lock()
+	defer k.healthMutex.Unlock()
+	return k.err
+}
+
+// how many lines of stderr a CmdError of the keeper carries
+const stderrLines = 5
+
+func (k *Keeper) addStderr(line string) {
+	k.healthMutex.Lock()
+	defer k.healthMutex.Unlock()
+	k.stderr = append(k.stderr, strings.TrimRight(line, "\n"))
+	if len(k.stderr) > stderrLines {
+		k.stderr = k.stderr[len(k.stderr)-stderrLines:]
+	}
+}
+
+// died records how a run that started at started died.
+func (k *Keeper) died(err error, started time.Time) {
+	k.healthMutex.Lock()
+	defer k.healthMutex.Unlock()
+	result := Result{
+		Command:  []string{"sh", "-c", k.Command},
+		Stderr:   strings.Join(k.stderr, "\n"),
+		Duration: time.Since(started),
+	}
+	if err == nil {
+		err = errors.New("exited")
+	} else {
+		result.ExitCode = exitCode(err)
+	}
+	k.err = &CmdError{Result: result, Err: err}
+}
+
+func (k *Keeper) setHealth(h Health) {
+	k.callbackMutex.Lock()
+	defer k.callbackMutex.Unlock()
+	k.healthMutex.Lock()
+	changed := h != k.health
+	k.health = h
+	if h == Healthy {
+		k.err = nil
+	}
+	err := k.err
+	k.healthMutex.Unlock()
+	if !changed {
+		return
+	}
+	k.log("%s is %s", strings.Fields(k.Command)[0], h)
+	if k.OnHealth != nil {
+		k.OnHealth(h, err)
+	}
+}
+
+// delay is how long to wait before restarting after failures deaths in
+// a row: MinDelay doubled for each but the first, up to MaxDelay, and
+// then anywhere from half of that to all of it.
+func (k *Keeper) delay(failures int, random *rand.Rand) time.Duration {
+	min, max := k.MinDelay, k.MaxDelay
+	if min <= 0 {
+		min = DefaultMinDelay
+	}
+	if max <= 0 {
+		max = DefaultMaxDelay
+	}
+	if max < min {
+		max = min
+	}
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(random.Int63n(int64(d/2)+1))
+}
+
+func (k *Keeper) maxDelay() time.Duration {
+	if k.MaxDelay <= 0 {
+		return DefaultMaxDelay
+	}
+	return k.MaxDelay
+}
+
 func (k *Keeper) Start() {
 	go func() {
 		count := 0
+		// deaths in a row, each soon after starting
+		failures := 0
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
 		defer close(k.done)
 		for {
 			cmd := exec.Command("sh", "-c", k.Command)
-			cmd.SysProcAttr = &syscall.SysProcAttr{
-				Setpgid: true,
-			}
+			ownGroup(cmd)
 			k.log("%s", k.Command)
+			k.healthMutex.Lock()
+			k.stderr = nil
+			k.healthMutex.Unlock()
 			l := k.forwardOutput(cmd)
 
 			err := writeInput(cmd, k.Input)
@@ -63,9 +244,13 @@ func (k *Keeper) Start() {
 			if err != nil {
 				panic(err)
 			}
+			started := time.Now()
 
-			died := make(chan empty)
+			died := make(chan empty, 1)
 			go func() {
+				// the output is read in full first, as
+				// Wait closes the pipes
+				l.Wait()
 				err = cmd.Wait()
 				if err != nil {
 					k.log("%s", err.Error())
@@ -74,22 +259,54 @@ func (k *Keeper) Start() {
 			}()
 
 			count += 1
+			// a run that lasts is healthy, whatever came before
+			stable := time.AfterFunc(k.maxDelay(), func() { k.setHealth(Healthy) })
 
 			select {
 			case <-died:
-				l.Wait()
-				if count < k.Limit || k.Limit == 0 {
-					k.log("%s restarting...", strings.Fields(k.Command)[0])
+				stable.Stop()
+				k.died(err, started)
+				if count >= k.Limit && k.Limit != 0 {
+					return
+				}
+				if time.Since(started) >= k.maxDelay() {
+					failures = 0
+				}
+				failures++
+				if k.MaxRestarts > 0 && failures > k.MaxRestarts {
+					k.log("%s died %d times in a row, giving up", strings.Fields(k.Command)[0], failures)
+					k.setHealth(Broken)
+					return
+				}
+				if failures >= flapping {
+					k.setHealth(Flapping)
+				}
+				delay := k.delay(failures, random)
+				k.log("%s restarting in %v...", strings.Fields(k.Command)[0], delay.Round(time.Millisecond))
+				if k.Inspect != "" {
 					ShellLog(k.Inspect, func(line string) {
 						k.log("%s", line)
 					})
-					time.Sleep(time.Second)
-				} else {
+				}
+				select {
+				case <-time.After(delay):
+				case <-k.restart:
+				case <-k.stop:
 					return
 				}
+			case <-k.restart:
+				stable.Stop()
+				k.log("%s restarting...", strings.Fields(k.Command)[0])
+				// the whole group, in case sh didn't exec the
+				// command
+				killGroup(cmd)
+				<-died
 			case <-k.stop:
-				cmd.Process.Kill()
-				l.Wait()
+				stable.Stop()
+				// the whole group, which is what holds the
+				// output open
+				killGroup(cmd)
+				<-died
 				return
 			}
 
@@ -103,12 +320,12 @@ func (k *Keeper) forwardOutput(cmd *exec.Cmd) Latch {
 		panic(err)
 	}
 	l := NewLatch(2)
-	go k.reader(pipe, l)
+	go k.reader(pipe, l, func(string) {})
 	pipe, err = cmd.StderrPipe()
 	if err != nil {
 		panic(err)
 	}
-	go k.reader(pipe, l)
+	go k.reader(pipe, l, k.addStderr)
 	return l
 }
 
@@ -125,11 +342,14 @@ func writeInput(cmd *exec.Cmd, input string) error {
 	return err
 }
 
-func (k *Keeper) reader(pipe io.ReadCloser, l Latch) {
+func (k *Keeper) reader(pipe io.ReadCloser, l Latch, keep func(string)) {
 	defer pipe.Close()
 	buf := bufio.NewReader(pipe)
 	for {
 		line, err := buf.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			keep(line)
+		}
 		if err != nil {
 			if strings.TrimSpace(line) != "" {
 				k.log("%s", line)
@@ -3,6 +3,7 @@ package tpu
 import (
 	"bytes"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"testing"
 	"time"
@@ -11,6 +12,8 @@ import (
 func TestKeepalive(t *testing.T) {
 	os.Remove("/tmp/lines")
 	k := NewKeeper("TST", "echo hi >> /tmp/lines")
+	// restarts every half a second to a second, jittered
+	k.MinDelay, k.MaxDelay = time.Second, time.Second
 	k.Start()
 	time.Sleep(3500 * time.Millisecond)
 	k.Stop()
@@ -20,7 +23,143 @@ func TestKeepalive(t *testing.T) {
 		panic(err)
 	}
 	lines := bytes.Count(dat, []byte("\n"))
-	if lines != 4 {
-		t.Errorf("incorrect number of lines: %v", 4)
+	if lines < 4 || lines > 7 {
+		t.Errorf("incorrect number of lines: %v", lines)
+	}
+}
+
+func TestKeeperRestart(t *testing.T) {
+	os.Remove("/tmp/restarts")
+	k := NewKeeper("TST", "echo hi >> /tmp/restarts; sleep 60")
+	k.Start()
+	time.Sleep(500 * time.Millisecond)
+	k.Restart()
+	time.Sleep(500 * time.Millisecond)
+	k.Stop()
+	dat, err := ioutil.ReadFile("/tmp/restarts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(dat, []byte("\n")); lines != 2 {
+		t.Errorf("expected the command to be started twice, got %d", lines)
+	}
+}
+
+func TestKeeperDelay(t *testing.T) {
+	k := NewKeeper("TST", "true")
+	k.MinDelay, k.MaxDelay = 100*time.Millisecond, time.Second
+	random := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := k.delay(test.failures, random); d < test.max/2 || d > test.max {
+				t.Fatalf("after %d failures: %v is not between %v and %v", test.failures, d, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestKeeperGivesUp(t *testing.T) {
+	k := NewKeeper("TST", "false")
+	k.MinDelay, k.MaxDelay = 10*time.Millisecond, 20*time.Millisecond
+	k.MaxRestarts = 4
+	var health []Health
+	k.OnHealth = func(h Health, _ error) { health = append(health, h) }
+	k.Start()
+	done := make(chan struct{})
+	go func() {
+		k.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		k.Stop()
+		t.Fatal("expected the keeper to give up")
+	}
+	if len(health) != 2 || health[0] != Flapping || health[1] != Broken {
+		t.Errorf("unexpected health %v", health)
+	}
+	if k.Health() != Broken {
+		t.Errorf("unexpected health %v", k.Health())
+	}
+	// Stop does nothing once it has given up
+	k.Stop()
+}
+
+func TestKeeperRecovers(t *testing.T) {
+	os.Remove("/tmp/recovers")
+	// dies right away three times, then stays up
+	k := NewKeeper("TST", "echo >> /tmp/recovers; [ $(wc -l < /tmp/recovers) -gt 3 ] && sleep 60")
+	k.MinDelay, k.MaxDelay = 10*time.Millisecond, 300*time.Millisecond
+	health := make(chan Health, 10)
+	k.OnHealth = func(h Health, _ error) { health <- h }
+	k.Start()
+	defer k.Stop()
+	for _, expected := range []Health{Flapping, Healthy} {
+		select {
+		case h := <-health:
+			if h != expected {
+				t.Fatalf("expected %v, got %v", expected, h)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected %v", expected)
+		}
+	}
+}
+
+func TestKeeperHealthReentrant(t *testing.T) {
+	k := NewKeeper("TST", "false")
+	k.MinDelay, k.MaxDelay = 10*time.Millisecond, 20*time.Millisecond
+	k.MaxRestarts = 3
+	health := make(chan Health, 10)
+	k.OnHealth = func(Health, error) { health <- k.Health() }
+	k.Start()
+	done := make(chan struct{})
+	go func() {
+		k.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected OnHealth to be able to ask for the Health")
+	}
+	if h := <-health; h != Flapping {
+		t.Errorf("expected flapping, got %v", h)
+	}
+	if h := <-health; h != Broken {
+		t.Errorf("expected broken, got %v", h)
+	}
+}
+
+func TestKeeperErr(t *testing.T) {
+	k := NewKeeper("TST", "echo starting; echo refused >&2; exit 3")
+	k.MinDelay, k.MaxDelay = 10*time.Millisecond, 20*time.Millisecond
+	k.MaxRestarts = 3
+	errs := make(chan error, 10)
+	k.OnHealth = func(_ Health, err error) { errs <- err }
+	k.Start()
+	k.Wait()
+	for _, health := range []Health{Flapping, Broken} {
+		err, ok := (<-errs).(*CmdError)
+		if !ok {
+			t.Fatalf("%v: expected a *CmdError, got %v", health, err)
+		}
+		if err.ExitCode != 3 || err.Stderr != "refused" {
+			t.Errorf("%v: expected exit code 3 and the stderr, got %d, %q", health, err.ExitCode, err.Stderr)
+		}
+	}
+	if k.Err() == nil {
+		t.Error("expected the keeper to remember how the command died")
 	}
 }
@@ -0,0 +1,5 @@
+package tpu
+
+// Rlimit does nothing on windows, which has no limit on open files to
+// raise.
+func Rlimit() {}
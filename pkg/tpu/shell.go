@@ -1,10 +1,100 @@
 package tpu
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Result captures everything we know about a finished command.
+type Result struct {
+	Command  []string
+	Stdout   string
+	Stderr   string
+	Output   string // stdout and stderr interleaved
+	ExitCode int
+	Duration time.Duration
+}
+
+// CmdError is returned when a command could not be started or exited
+// with a non-zero status. It carries the full Result so callers can
+// report stderr and the exit code rather than just "exit status 1".
+type CmdError struct {
+	Result
+	Err error
+}
+
+func (e *CmdError) Error() string {
+	msg := fmt.Sprintf("%s: %v", strings.Join(e.Command, " "), e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// lockedWriter lets the stdout and stderr copiers share a single
+// combined buffer.
+type lockedWriter struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// Run executes the command with the supplied stdin and returns a
+// structured Result. The error is a *CmdError whenever the command
+// failed to start or exited non-zero.
+func Run(command []string, stdin string) (Result, error) {
+	var stdout, stderr, combined bytes.Buffer
+	mu := &sync.Mutex{}
+	both := lockedWriter{mu, &combined}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	cmd.Stdout = io.MultiWriter(&stdout, both)
+	cmd.Stderr = io.MultiWriter(&stderr, both)
+
+	start := time.Now()
+	err := startCmd(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	result := Result{
+		Command:  command,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Output:   combined.String(),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		result.ExitCode = exitCode(err)
+		return result, &CmdError{Result: result, Err: err}
+	}
+	return result, nil
+}
+
+// exitCode returns the exit status of a command that failed with err,
+// or -1 if it didn't get to exit.
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
 func ShellLog(command string, logln func(string)) (string, error) {
 	return CmdLog([]string{"sh", "-c", command}, logln)
 }
@@ -18,10 +108,14 @@ func CmdLogf(command []string, logf func(string, ...interface{})) (string, error
 }
 
 func CmdLog(command []string, logln func(string)) (string, error) {
+	return CmdLogInput(command, "", logln)
+}
+
+// CmdLogInput is like CmdLog, but feeds input to the command's stdin.
+func CmdLogInput(command []string, input string, logln func(string)) (string, error) {
 	logln(strings.Join(command, " "))
-	cmd := exec.Command(command[0], command[1:]...)
-	out, err := cmd.CombinedOutput()
-	str := string(out)
+	result, err := Run(command, input)
+	str := result.Output
 	lines := strings.Split(str, "\n")
 	for idx, line := range lines {
 		if strings.TrimSpace(line) != "" {
@@ -31,7 +125,9 @@ func CmdLog(command []string, logln func(string)) (string, error) {
 		}
 	}
 	if err != nil {
-		logln(err.Error())
+		// the output has already been logged, so just log
+		// the exit status
+		logln(err.(*CmdError).Err.Error())
 	}
 	return str, err
 }
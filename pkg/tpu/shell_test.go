@@ -0,0 +1,42 @@
+package tpu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunSuccess(t *testing.T) {
+	result, err := Run([]string{"sh", "-c", "echo out; echo err >&2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "out\n" {
+		t.Errorf("unexpected stdout: %q", result.Stdout)
+	}
+	if result.Stderr != "err\n" {
+		t.Errorf("unexpected stderr: %q", result.Stderr)
+	}
+	if result.ExitCode != 0 {
+		t.Errorf("unexpected exit code: %d", result.ExitCode)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	result, err := Run([]string{"sh", "-c", "cat; echo oops >&2; exit 3"}, "input")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	cerr, ok := err.(*CmdError)
+	if !ok {
+		t.Fatalf("expected a *CmdError, got %T", err)
+	}
+	if cerr.ExitCode != 3 || result.ExitCode != 3 {
+		t.Errorf("unexpected exit code: %d", cerr.ExitCode)
+	}
+	if result.Stdout != "input" {
+		t.Errorf("stdin was not passed through: %q", result.Stdout)
+	}
+	if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error does not include stderr: %v", err)
+	}
+}